@@ -0,0 +1,163 @@
+/*
+ * Export of a commit's tree as a tar or zip archive
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A checkout makes a farm of hard links to blob files in the scratch
+// directory, which is quick but easy to damage by accident and leaves
+// debris behind.  An archive is a self-contained copy of the same tree
+// that can be looked at anywhere.  Entries are in path order and carry
+// the commit date, so archiving the same commit twice gives the same
+// bytes.  As with git archive, a submodule becomes an empty directory.
+
+// archiveFormats are the formats an archive can be written in.
+var archiveFormats = []string{"tgz", "tar", "zip"}
+
+// archiveEntry is a file of a commit's tree.  Blob content is only
+// read as the entry is written, so the whole tree needn't be in memory.
+type archiveEntry struct {
+	path   string
+	mode   os.FileMode
+	inline []byte
+	blob   *Blob
+}
+
+func (entry archiveEntry) content() []byte {
+	if entry.blob != nil {
+		return entry.blob.getContent()
+	}
+	return entry.inline
+}
+
+// archiveEntries returns the files of a commit's tree in path order.
+func (commit *Commit) archiveEntries() ([]archiveEntry, error) {
+	manifest := commit.manifest()
+	paths := manifest.pathnames()
+	sort.Strings(paths)
+	entries := make([]archiveEntry, 0, len(paths))
+	for _, path := range paths {
+		v, _ := manifest.get(path)
+		fileop := v.(*FileOp)
+		entry := archiveEntry{path: path}
+		switch fileop.mode {
+		case "160000":
+			entries = append(entries, archiveEntry{path: path + "/", mode: os.ModeDir | 0755})
+			continue
+		case "120000":
+			entry.mode = os.ModeSymlink | 0777
+		default:
+			perm, err := strconv.ParseUint(fileop.mode, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad mode %q at %s: %v", fileop.mode, path, err)
+			}
+			entry.mode = os.FileMode(perm) & os.ModePerm
+		}
+		if fileop.ref == "inline" {
+			entry.inline = fileop.inline
+		} else if blob, ok := commit.repo.markToEvent(fileop.ref).(*Blob); ok {
+			entry.blob = blob
+		} else {
+			return nil, fmt.Errorf("no blob %s for %s", fileop.ref, path)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// writeTar writes archive entries as a tar file.
+func writeTar(w io.Writer, entries []archiveEntry, prefix string, modtime time.Time) error {
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		content := entry.content()
+		header := &tar.Header{
+			Name:     prefix + entry.path,
+			Mode:     int64(entry.mode.Perm()),
+			ModTime:  modtime,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}
+		if entry.mode&os.ModeDir != 0 {
+			header.Typeflag = tar.TypeDir
+		} else if entry.mode&os.ModeSymlink != 0 {
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = string(content)
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(content); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// writeZip writes archive entries as a zip file.  Symbolic links are
+// stored the usual way, as entries with the link mode whose content is
+// the target.
+func writeZip(w io.Writer, entries []archiveEntry, prefix string, modtime time.Time) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		header := &zip.FileHeader{
+			Name:     prefix + entry.path,
+			Method:   zip.Deflate,
+			Modified: modtime,
+		}
+		header.SetMode(entry.mode)
+		if entry.mode&os.ModeDir != 0 {
+			header.Method = zip.Store
+		}
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(entry.content()); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// archive writes the tree of a commit to w in one of archiveFormats,
+// with prefix in front of every path.
+func (commit *Commit) archive(w io.Writer, format string, prefix string) error {
+	entries, err := commit.archiveEntries()
+	if err != nil {
+		return err
+	}
+	modtime := commit.committer.date.timestamp
+	switch format {
+	case "tgz":
+		gz := gzip.NewWriter(w)
+		if err := writeTar(gz, entries, prefix, modtime); err != nil {
+			return err
+		}
+		return gz.Close()
+	case "tar":
+		return writeTar(w, entries, prefix, modtime)
+	case "zip":
+		return writeZip(w, entries, prefix, modtime)
+	}
+	return fmt.Errorf("unknown archive format %q", format)
+}
+
+// end
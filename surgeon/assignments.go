@@ -0,0 +1,160 @@
+/*
+ * Saving and loading named selections
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Assignments are kept as sets of event indices, which mean nothing
+// outside the process that made them and not much after a renumber or
+// a resort.  To carry a named selection into a later session it is
+// written out as names of its events that don't depend on their
+// positions: a commit by its action stamp, with an ordinal suffix if
+// other commits share it; a tag by its name; a reset by reset@ and its
+// branch; anything else by its mark.  Each name is checked to resolve
+// back to its event when saved, and a mark is used for any that
+// doesn't.  Passthroughs have no names and can't be saved.
+//
+// The file has one line per assignment, the name followed by the
+// names of its events.  Blank lines and lines beginning with # are
+// ignored.
+
+// namedQuietly is repo.named, except that a name matching nothing
+// gives an undefined selection rather than an error.
+func (repo *Repository) namedQuietly(ref string) (found selectionSet) {
+	defer func() {
+		if e := catch("command", recover()); e != nil {
+			found = undefinedSelectionSet
+		}
+	}()
+	return repo.named(ref)
+}
+
+// eventNames returns, for each event of the repository, a name that
+// resolves to it alone, or "" if there is none.
+func (repo *Repository) eventNames() []string {
+	names := make([]string, len(repo.events))
+	shared := make(map[string]int)
+	for _, commit := range repo.commits(undefinedSelectionSet) {
+		shared[commit.actionStamp()]++
+	}
+	seen := make(map[string]int)
+	for i, event := range repo.events {
+		candidate := ""
+		switch e := event.(type) {
+		case *Commit:
+			stamp := e.actionStamp()
+			seen[stamp]++
+			candidate = stamp
+			if shared[stamp] > 1 {
+				candidate = fmt.Sprintf("%s#%d", stamp, seen[stamp])
+			}
+		case *Tag:
+			candidate = e.tagname
+		case *Reset:
+			candidate = "reset@" + branchbase(e.ref)
+		}
+		if candidate != "" {
+			if found := repo.namedQuietly(candidate); found.isDefined() && found.Size() == 1 && found.Fetch(0) == i {
+				names[i] = candidate
+				continue
+			}
+		}
+		names[i] = event.getMark()
+	}
+	return names
+}
+
+// writeAssignments writes the repository's assignments in name order.
+// Returns the number of events that couldn't be named, which are left
+// out.
+func (repo *Repository) writeAssignments(w io.Writer) (int, error) {
+	keys := make([]string, 0, len(repo.assignments))
+	for name := range repo.assignments {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	names := repo.eventNames()
+	unnamed := 0
+	for _, key := range keys {
+		fields := []string{key}
+		for it := repo.assignments[key].Iterator(); it.Next(); {
+			if i := it.Value(); i < len(names) && names[i] != "" {
+				fields = append(fields, names[i])
+			} else {
+				unnamed++
+			}
+		}
+		if _, err := fmt.Fprintln(w, strings.Join(fields, " ")); err != nil {
+			return unnamed, err
+		}
+	}
+	return unnamed, nil
+}
+
+// readAssignments reads assignments written by writeAssignments.  A
+// name already assigned, or one that would shadow a branch, tag or
+// other name, is an error.  Event names that no longer resolve to a
+// single event are dropped with a warning.  Returns the number of
+// assignments made.
+func (repo *Repository) readAssignments(r io.Reader) (int, error) {
+	loaded := make(map[string]selectionSet)
+	order := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024*1024)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		name := fields[0]
+		if _, ok := repo.assignments[name]; ok {
+			return 0, fmt.Errorf("line %d: %s has already been set", lineno, name)
+		}
+		if _, ok := loaded[name]; ok {
+			return 0, fmt.Errorf("line %d: %s is assigned twice", lineno, name)
+		}
+		if repo.namedQuietly(name).isDefined() {
+			return 0, fmt.Errorf("line %d: %s conflicts with a branch, tag, legacy-ID, date, or previous assignment", lineno, name)
+		}
+		selection := newSelectionSet()
+		for _, id := range fields[1:] {
+			found := repo.namedQuietly(id)
+			if !found.isDefined() || found.Size() != 1 {
+				if logEnable(logWARN) {
+					logit("in %s, %s doesn't identify exactly one event", name, id)
+				}
+				continue
+			}
+			selection.Add(found.Fetch(0))
+		}
+		selection.Sort()
+		loaded[name] = selection
+		order = append(order, name)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if repo.assignments == nil {
+		repo.assignments = make(map[string]selectionSet)
+	}
+	for _, name := range order {
+		repo.assignments[name] = loaded[name]
+	}
+	return len(order), nil
+}
+
+// end
@@ -9,6 +9,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math"
@@ -33,6 +34,8 @@ type Baton struct {
 	progress        Progress
 	process         Process
 	ti              *terminfo.Terminfo
+	reporter        io.Writer // Where machine-readable progress goes, if anywhere
+	reportLock      sync.Mutex
 }
 
 // Twirly is the state of a twirly indefinite progress meter that ships indications to stdout.
@@ -72,6 +75,20 @@ type Process struct {
 	start      time.Time
 }
 
+// progressReport is one line of machine-readable progress.  Event is
+// "start", "progress" or "end".  Rate is in items per second and the
+// times are in seconds; ETA is -1 when there is no estimate yet.
+type progressReport struct {
+	Phase    string  `json:"phase"`
+	Event    string  `json:"event"`
+	Count    uint64  `json:"count"`
+	Expected uint64  `json:"expected"`
+	Percent  float64 `json:"percent"`
+	Rate     float64 `json:"rate"`
+	Elapsed  float64 `json:"elapsed"`
+	ETA      float64 `json:"eta"`
+}
+
 type msgType uint8
 
 const (
@@ -151,6 +168,48 @@ func (baton *Baton) setInteractivity(enabled bool) {
 	baton.progressEnabled = enabled
 }
 
+// setReporter directs machine-readable progress, one JSON object per
+// line, to a writer; nil turns it off.
+func (baton *Baton) setReporter(w io.Writer) {
+	baton.reportLock.Lock()
+	baton.reporter = w
+	baton.reportLock.Unlock()
+}
+
+// tracking tells whether anyone is watching progress meters.
+func (baton *Baton) tracking() bool {
+	return baton != nil && (baton.progressEnabled || baton.reporter != nil)
+}
+
+// report ships the state of the progress meter as a JSON line.
+func (baton *Baton) report(event string) {
+	baton.reportLock.Lock()
+	defer baton.reportLock.Unlock()
+	if baton.reporter == nil {
+		return
+	}
+	baton.progress.RLock()
+	line := progressReport{
+		Phase:    string(baton.progress.tag),
+		Event:    event,
+		Count:    baton.progress.count,
+		Expected: baton.progress.expected,
+		Elapsed:  baton.progress.lastupdate.Sub(baton.progress.start).Seconds(),
+		ETA:      -1,
+	}
+	if rate, eta, ok := baton.progress.estimate(); ok {
+		line.Rate = rate
+		line.ETA = eta.Seconds()
+	}
+	baton.progress.RUnlock()
+	if line.Expected > 0 {
+		line.Percent = math.Round(float64(line.Count)*10000/float64(line.Expected)) / 100
+	}
+	if out, err := json.Marshal(line); err == nil {
+		baton.reporter.Write(append(out, '\n'))
+	}
+}
+
 // printLog prints out a simple log message
 func (baton *Baton) printLog(str []byte) {
 	if baton != nil {
@@ -261,19 +320,21 @@ func (baton *Baton) endcounter() {
 }
 
 func (baton *Baton) startProgress(tag string, expected uint64) {
-	if baton != nil && baton.progressEnabled {
+	if baton.tracking() {
 		baton.progress.Lock()
-		defer baton.progress.Unlock()
 		baton.progress.start = time.Now()
 		baton.progress.lastupdate = baton.progress.start
 		baton.progress.tag = []byte(tag)
 		baton.progress.count = 0
+		baton.progress.lastcount = 0
 		baton.progress.expected = expected
+		baton.progress.Unlock()
+		baton.report("start")
 	}
 }
 
 func (baton *Baton) percentProgress(ccount uint64) {
-	if baton != nil && baton.progressEnabled {
+	if baton.tracking() {
 		baton.progress.Lock()
 		if time.Since(baton.progress.lastupdate) > progressInterval || ccount == baton.progress.expected {
 			baton.progress.lastcount = baton.progress.count
@@ -281,6 +342,7 @@ func (baton *Baton) percentProgress(ccount uint64) {
 			baton.progress.lastupdate = time.Now()
 			baton.progress.Unlock()
 			baton.printProgress()
+			baton.report("progress")
 		} else {
 			baton.progress.Unlock()
 		}
@@ -288,19 +350,24 @@ func (baton *Baton) percentProgress(ccount uint64) {
 }
 
 func (baton *Baton) endProgress() {
-	if baton != nil && baton.progressEnabled {
+	if baton.tracking() {
 		baton.progress.Lock()
 		baton.progress.count = baton.progress.expected
 		baton.progress.lastupdate = time.Now()
 		baton.progress.Unlock()
-		var buf bytes.Buffer
-		baton.progress.render(&buf)
-		baton.logFunc(buf.String())
+		baton.report("end")
+		if baton.progressEnabled {
+			var buf bytes.Buffer
+			baton.progress.render(&buf)
+			baton.logFunc(buf.String())
+		}
 		baton.progress.Lock()
 		baton.progress.tag = nil
 		baton.progress.count = 0
 		baton.progress.expected = 0
-		baton.progressWrite(PROGRESS, nil)
+		if baton.progressEnabled {
+			baton.progressWrite(PROGRESS, nil)
+		}
 		baton.progress.Unlock()
 	}
 }
@@ -345,6 +412,21 @@ func (baton *Counter) render(b io.Writer) {
 	}
 }
 
+// estimate returns the average rate of progress in items per second
+// and the time left at that rate.  The caller holds the lock.
+func (baton *Progress) estimate() (float64, time.Duration, bool) {
+	elapsed := baton.lastupdate.Sub(baton.start).Seconds()
+	if elapsed <= 0 || baton.count == 0 || baton.expected == 0 {
+		return 0, 0, false
+	}
+	rate := float64(baton.count) / elapsed
+	left := float64(0)
+	if baton.count < baton.expected {
+		left = float64(baton.expected-baton.count) / rate
+	}
+	return rate, time.Duration(left * float64(time.Second)), true
+}
+
 func (baton *Progress) render(b io.Writer) {
 	baton.RLock()
 	defer baton.RUnlock()
@@ -383,6 +465,9 @@ func (baton *Progress) render(b io.Writer) {
 		}
 		fmt.Fprintf(b, "%s %.2f%% %s/%s, %v @ %s/s, %s/s",
 			baton.tag, frac*100, scale(float64(baton.count)), scale(float64(baton.expected)), elapsed, ratemsg, ratemsg2)
+		if _, eta, ok := baton.estimate(); ok && baton.count < baton.expected {
+			fmt.Fprintf(b, ", ETA %v", eta.Round(time.Second))
+		}
 	}
 }
 
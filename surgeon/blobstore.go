@@ -0,0 +1,156 @@
+/*
+ * Content-addressed blob storage shared across repositories
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A blob read from a stream file has no file of its own; its content
+// is a span of the stream.  Moving or cloning it into another
+// repository used to mean copying that span into a new file, so
+// uniting or grafting two big stream-backed repositories doubled the
+// disk usage of the scratch area, and splitting one wrote every
+// shared blob twice.
+//
+// Instead such content goes into a store in the scratch area, one
+// file per distinct content named by its git hash, and the blob files
+// of the repositories using it are hard links to that.  Identical
+// content from different repositories, or reaching a repository by
+// different routes, is stored once.  The store counts the repositories
+// using each entry, and drops an entry when no loaded repository uses
+// it any more; the repositories' own links are removed with their
+// scratch directories.
+
+type blobStore struct {
+	sync.Mutex
+	dir  string
+	refs map[gitHashType]int                  // Repositories using each entry
+	held map[*Repository]map[gitHashType]bool // Entries each repository links to
+}
+
+var sharedBlobs blobStore
+
+// path returns where content with a given hash is kept.
+func (bs *blobStore) path(hash gitHashType) string {
+	hex := hash.hexify()
+	return filepath.Join(bs.dir, hex[:2], hex[2:])
+}
+
+func (bs *blobStore) init() error {
+	if bs.refs != nil {
+		return nil
+	}
+	d, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	// Not named like a repository subdirectory, so no repository
+	// cleanup can remove it.  It goes when reposurgeon exits.
+	bs.dir = filepath.Join(d, fmt.Sprintf(".rs%d.blobs", os.Getpid()))
+	bs.refs = make(map[gitHashType]int)
+	bs.held = make(map[*Repository]map[gitHashType]bool)
+	return nil
+}
+
+// ingest copies content into the store, returning its hash.  The
+// content is hashed as it is copied, so it is read only once.
+func (bs *blobStore) ingest(content io.Reader, size int64) (gitHashType, error) {
+	var hash gitHashType
+	if err := os.MkdirAll(bs.dir, userReadWriteSearchMode); err != nil {
+		return hash, err
+	}
+	tmp, err := ioutil.TempFile(bs.dir, "ingest")
+	if err != nil {
+		return hash, err
+	}
+	defer os.Remove(tmp.Name())
+	hasher := sha1.New()
+	fmt.Fprintf(hasher, "blob %d\x00", size)
+	w, err := newBlobWriter(tmp)
+	if err != nil {
+		tmp.Close()
+		return hash, err
+	}
+	_, err = io.Copy(io.MultiWriter(w, hasher), content)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return hash, err
+	}
+	copy(hash[:], hasher.Sum(nil))
+	entry := bs.path(hash)
+	if exists(entry) {
+		return hash, nil
+	}
+	if err = os.MkdirAll(filepath.Dir(entry), userReadWriteSearchMode); err != nil {
+		return hash, err
+	}
+	return hash, os.Rename(tmp.Name(), entry)
+}
+
+// adopt gives a blob a file in its repository holding the content read
+// from a stream, by way of the store.  If the blob's hash is known and
+// the store has that content already, the stream isn't read at all.
+func (bs *blobStore) adopt(b *Blob, content io.Reader) {
+	bs.Lock()
+	defer bs.Unlock()
+	if err := bs.init(); err != nil {
+		panic(fmt.Errorf("Blob store: %v", err))
+	}
+	hash := b.hash
+	if !hash.isValid() || !exists(bs.path(hash)) {
+		var err error
+		if hash, err = bs.ingest(content, b.size); err != nil {
+			panic(fmt.Errorf("Blob store: %v", err))
+		}
+	}
+	b.start = noOffset
+	b.cookie = nil
+	dest := b.getBlobfile(true)
+	if logEnable(logSHUFFLE) {
+		logit("blob store links %s to %s for %s", hash.hexify(), relpath(dest), b.idMe())
+	}
+	if err := os.Link(bs.path(hash), dest); err != nil {
+		panic(fmt.Errorf("Blob store: %v", err))
+	}
+	if bs.held[b.repo] == nil {
+		bs.held[b.repo] = make(map[gitHashType]bool)
+	}
+	if !bs.held[b.repo][hash] {
+		bs.held[b.repo][hash] = true
+		bs.refs[hash]++
+	}
+}
+
+// release drops a repository's references to the store, removing
+// entries no other repository uses.
+func (bs *blobStore) release(repo *Repository) {
+	bs.Lock()
+	defer bs.Unlock()
+	for hash := range bs.held[repo] {
+		bs.refs[hash]--
+		if bs.refs[hash] <= 0 {
+			delete(bs.refs, hash)
+			os.Remove(bs.path(hash))
+		}
+	}
+	delete(bs.held, repo)
+	if len(bs.refs) == 0 && bs.dir != "" {
+		os.RemoveAll(bs.dir)
+	}
+}
+
+// end
@@ -0,0 +1,143 @@
+/*
+ * Content types of blobs, and filtering by type
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A big conversion carries every kind of file, and a policy for one
+// kind is wrong for another: stripping EXIF data is for photographs,
+// reindenting for XML, and neither should touch a tarball.  Paths are
+// a poor guide, as extensions lie and many files have none.  So the
+// type of each blob is sniffed from its first bytes, with the same
+// algorithm browsers use, and remembered until its content changes.
+// A census reports how much of each type there is; a selection can
+// pick blobs by type through the mimetype field of event expressions;
+// and a table of rules can send each blob through a filter chosen by
+// its type, all in one pass.
+
+// contentType returns the media type of a blob's content, without
+// parameters such as charset.
+func (b *Blob) contentType() string {
+	if b.mimetype == "" {
+		// DetectContentType looks at no more than 512 bytes
+		content := make([]byte, 512)
+		stream := b.getContentStream()
+		n, _ := io.ReadFull(stream, content)
+		closeOrDie(stream)
+		mimetype := http.DetectContentType(content[:n])
+		if i := strings.Index(mimetype, ";"); i != -1 {
+			mimetype = mimetype[:i]
+		}
+		b.mimetype = mimetype
+	}
+	return b.mimetype
+}
+
+// blobTypeCensus reports the number and total size of the selected
+// blobs of each content type, most frequent first.
+func (repo *Repository) blobTypeCensus(w io.Writer, selection selectionSet) {
+	counts := make(map[string]int)
+	sizes := make(map[string]int64)
+	for it := selection.Iterator(); it.Next(); {
+		if blob, ok := repo.events[it.Value()].(*Blob); ok {
+			counts[blob.contentType()]++
+			sizes[blob.contentType()] += blob.size
+		}
+	}
+	types := make([]string, 0, len(counts))
+	for mimetype := range counts {
+		types = append(types, mimetype)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if counts[types[i]] != counts[types[j]] {
+			return counts[types[i]] > counts[types[j]]
+		}
+		return types[i] < types[j]
+	})
+	for _, mimetype := range types {
+		fmt.Fprintf(w, "%6d %10d %s\n", counts[mimetype], sizes[mimetype], mimetype)
+	}
+}
+
+// command; a rule whose command is "-" leaves them alone.
+// command; a rule without a command leaves them alone.
+type blobTypeRule struct {
+	pattern string
+	command string
+}
+
+// readBlobTypeRules reads a table of rules, a type glob and a shell
+// command per line.  A command of "-" exempts the types from later
+// rules.  Blank lines and lines beginning with # are ignored.
+func readBlobTypeRules(r io.Reader) ([]*blobTypeRule, error) {
+	rules := make([]*blobTypeRule, 0)
+	scanner := bufio.NewScanner(r)
+	linecount := 0
+	for scanner.Scan() {
+		linecount++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		pattern, command := fields[0], ""
+		if len(fields) > 1 {
+			command = strings.TrimSpace(fields[1])
+		}
+		if _, err := path.Match(pattern, ""); err != nil || command == "" {
+			return nil, fmt.Errorf("bad line syntax in type rules: line %d %q", linecount, line)
+		}
+		rules = append(rules, &blobTypeRule{pattern: pattern, command: command})
+	}
+	return rules, scanner.Err()
+}
+
+// filterByType runs each selected blob through the filter of the first
+// rule its content type matches.  Blobs changed get Q bits.  Returns
+// the number of blobs changed.
+func (repo *Repository) filterByType(selection selectionSet, rules []*blobTypeRule) int {
+	repo.clearColor(colorQSET)
+	altered := new(Safecounter)
+	repo.walkEvents(selection, func(idx int, event Event) bool {
+		blob, ok := event.(*Blob)
+		if !ok {
+			return true
+		}
+		mimetype := blob.contentType()
+		for _, rule := range rules {
+			if matched, _ := path.Match(rule.pattern, mimetype); !matched {
+				continue
+			}
+			if rule.command == "-" {
+				break
+			}
+			content := string(blob.getContent())
+			modified, err := runShellFilter(rule.command, content, map[string]string{"%PATHS%": fmt.Sprintf("%v", blob.paths(nil))})
+			if err != nil {
+				croak("%s at %s", err, blob.idMe())
+			} else if modified != content {
+				blob.setContent([]byte(modified), noOffset)
+				altered.bump()
+				blob.addColor(colorQSET)
+			}
+			break
+		}
+		return true
+	})
+	return altered.value
+}
+
+// end
@@ -0,0 +1,122 @@
+/*
+ * Removal of exporter boilerplate from comments
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Converters and exporters leave text of their own in comments:
+// cvs2svn explains the commits it manufactured, git-svn records where
+// each commit came from, and CVS (in whatever language the server
+// spoke) fills in a log message nobody wrote.  None of it means
+// anything once the conversion is done.  Each kind is recognized by a
+// named regular expression, matched in multiline mode, and whatever it
+// matches is cut out.
+
+type boilerplatePattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+var boilerplateLibrary = []boilerplatePattern{
+	// A manufactured-commit sentence and the paragraphs after it
+	// saying what was copied or deleted, with their indented file
+	// lists.
+	{"cvs2svn", regexp.MustCompile(`(?m)^This commit was manufactured by cvs2svn to [^\n]*\n?(\n*(Cherrypick from|Sprout from|Delete:|Add:|Change:)[^\n]*\n?([ \t]+\S[^\n]*\n?)*)*`)},
+	{"git-svn-id", regexp.MustCompile(`(?m)^git-svn-id: \S+ [0-9a-fA-F-]+\s*$\n?`)},
+	{"cvs-empty", regexp.MustCompile(`(?mi)^\s*\*\*\*\s*(empty log message|leere log-nachricht|message de log vide|mensaje de registro vac[ií]o|messaggio di log vuoto|mensagem de log vazia|lege log-boodschap)\s*\*\*\*\s*$\n?`)},
+	{"no-message", regexp.MustCompile(`(?mi)^\s*[(<\[]\s*(no|empty) (log )?message\s*[)>\]]\s*$\n?`)},
+}
+
+// parseBoilerplatePatterns reads user patterns, one per line as a name
+// followed by a regular expression.  Blank lines and lines beginning
+// with # are ignored.  Patterns are matched in multiline mode.
+func parseBoilerplatePatterns(r io.Reader) ([]boilerplatePattern, error) {
+	patterns := make([]boilerplatePattern, 0)
+	scanner := bufio.NewScanner(r)
+	linecount := 0
+	for scanner.Scan() {
+		linecount++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+			return nil, fmt.Errorf("bad line syntax in boilerplate patterns: line %d %q", linecount, line)
+		}
+		re, err := regexp.Compile("(?m)" + strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern in boilerplate patterns line %d: %v", linecount, err)
+		}
+		patterns = append(patterns, boilerplatePattern{fields[0], re})
+	}
+	return patterns, scanner.Err()
+}
+
+var excessBlankLines = regexp.MustCompile(`\n{3,}`)
+
+// stripBoilerplate removes every match of the patterns from a comment,
+// then squeezes out the blank lines left behind.  The counts of
+// matches are added to hits, indexed like patterns.
+func stripBoilerplate(comment string, patterns []boilerplatePattern, hits []int) string {
+	stripped := comment
+	for i, p := range patterns {
+		if n := len(p.re.FindAllStringIndex(stripped, -1)); n > 0 {
+			hits[i] += n
+			stripped = p.re.ReplaceAllString(stripped, "")
+		}
+	}
+	if stripped == comment {
+		return comment
+	}
+	stripped = strings.TrimSpace(excessBlankLines.ReplaceAllString(stripped, "\n\n"))
+	if stripped != "" {
+		stripped += "\n"
+	}
+	return stripped
+}
+
+// dropBoilerplate strips boilerplate from the comments of the commits
+// and tags in a selection, setting Q bits on those changed.  Returns
+// the hit count of each pattern and the number of events changed.
+func (repo *Repository) dropBoilerplate(selection selectionSet, patterns []boilerplatePattern, dryrun bool) ([]int, int) {
+	hits := make([]int, len(patterns))
+	changed := 0
+	repo.clearColor(colorQSET)
+	for it := selection.Iterator(); it.Next(); {
+		switch e := repo.events[it.Value()].(type) {
+		case *Commit:
+			if stripped := stripBoilerplate(e.Comment, patterns, hits); stripped != e.Comment {
+				if !dryrun {
+					e.Comment = stripped
+					e.hash.invalidate()
+				}
+				e.addColor(colorQSET)
+				changed++
+			}
+		case *Tag:
+			if stripped := stripBoilerplate(e.Comment, patterns, hits); stripped != e.Comment {
+				if !dryrun {
+					e.Comment = stripped
+					e.hash.invalidate()
+				}
+				e.addColor(colorQSET)
+				changed++
+			}
+		}
+	}
+	return hits, changed
+}
+
+// end
@@ -0,0 +1,184 @@
+/*
+ * Resolution of callouts after the fact
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A segment written with --callout refers to parents outside it by
+// action stamp.  Graft resolves those when the segment is grafted back
+// onto the repository it came from, but a segment may outlive that
+// repository, or need stitching to one it was never part of.  Here a
+// callout is resolved against the chosen repository itself (after a
+// unite, say), or through a commit hash: either from a second loaded
+// repository holding the commit with that stamp, or from a map of
+// stamps to hashes.  A hash that names a commit of the chosen
+// repository, by its git hash or its original-oid, becomes a real
+// parent.  Otherwise, if asked, the callout becomes a gitlink to the
+// commit in the other repository.
+
+type calloutRef struct {
+	commit *Commit
+	stamp  string
+}
+
+// calloutParents returns the callout parents of the selected commits.
+func (repo *Repository) calloutParents(selection selectionSet) []calloutRef {
+	found := make([]calloutRef, 0)
+	for _, commit := range repo.commits(selection) {
+		for _, parent := range commit.parents() {
+			if _, ok := parent.(*Callout); ok {
+				found = append(found, calloutRef{commit, parent.getMark()})
+			}
+		}
+	}
+	return found
+}
+
+// readStampMap reads lines of an action stamp and a commit hash
+// separated by whitespace.  Blank lines and lines beginning with #
+// are ignored.
+func readStampMap(r io.Reader) (map[string]string, error) {
+	mapping := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	linecount := 0
+	for scanner.Scan() {
+		linecount++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad line syntax in stamp map: line %d %q", linecount, line)
+		}
+		if _, err := hex.DecodeString(fields[1]); err != nil || len(fields[1]) != 2*len(nullGitHash) {
+			return nil, fmt.Errorf("bad hash %q in stamp map: line %d", fields[1], linecount)
+		}
+		mapping[fields[0]] = strings.ToLower(fields[1])
+	}
+	return mapping, scanner.Err()
+}
+
+// stampCommit returns the one commit with an action stamp, or nil.
+// Unlike named() it is quiet about a stamp that isn't there.
+func (repo *Repository) stampCommit(stamp string) *Commit {
+	var found *Commit
+	for _, commit := range repo.commits(undefinedSelectionSet) {
+		match := commit.committer.actionStamp() == stamp
+		if len(commit.authors) > 0 && commit.authors[0].actionStamp() == stamp {
+			match = true
+		}
+		if match {
+			if found != nil {
+				return nil
+			}
+			found = commit
+		}
+	}
+	return found
+}
+
+// hashIndex maps the git hashes and original-oids of the commits of a
+// repository to the commits.  A commit with a callout among its
+// ancestors has no git hash to speak of.
+func (repo *Repository) hashIndex() map[string]*Commit {
+	index := make(map[string]*Commit)
+	incomplete := make(map[*Commit]bool)
+	for _, commit := range repo.commits(undefinedSelectionSet) {
+		if commit.recorded != nil {
+			index[commit.recorded.oid.hexify()] = commit
+		}
+		for _, parent := range commit.parents() {
+			if p, ok := parent.(*Commit); !ok || incomplete[p] {
+				incomplete[commit] = true
+			}
+		}
+		if !incomplete[commit] {
+			index[commit.gitHash().hexify()] = commit
+		}
+	}
+	return index
+}
+
+// resolveCallouts replaces the callout parents of the selected commits
+// where it can.  lookup gives the commit hash for a stamp, or "".  If
+// gitlink isn't empty, a callout with a hash not found here becomes a
+// gitlink at that path.  Returns the numbers of callouts turned into
+// parents and into gitlinks, and the stamps left unresolved.  Changed
+// commits get Q bits.
+func (repo *Repository) resolveCallouts(selection selectionSet, lookup func(string) string, gitlink string) (int, int, []string) {
+	repo.clearColor(colorQSET)
+	var index map[string]*Commit
+	if lookup != nil {
+		// Before any parents change, since that changes hashes
+		index = repo.hashIndex()
+	}
+	parented, linked := 0, 0
+	unresolved := make([]string, 0)
+	resort := false
+	for _, commit := range repo.commits(selection) {
+		changed := false
+		parents := make([]CommitLike, 0, len(commit.parents()))
+		links := make([]*FileOp, 0)
+		for _, parent := range commit.parents() {
+			if _, ok := parent.(*Callout); !ok {
+				parents = append(parents, parent)
+				continue
+			}
+			stamp := parent.getMark()
+			target := repo.stampCommit(stamp)
+			hash := ""
+			if target == nil && lookup != nil {
+				if hash = lookup(stamp); hash != "" {
+					target = index[hash]
+				}
+			}
+			if target != nil && target != commit && !target.descendedFrom(commit) {
+				parents = append(parents, target)
+				resort = resort || repo.eventToIndex(target) > repo.eventToIndex(commit)
+				parented++
+				changed = true
+			} else if hash != "" && gitlink != "" {
+				links = append(links, newFileOp(repo).construct(opM, gitlinkMode, hash, gitlink))
+				linked++
+				changed = true
+			} else {
+				parents = append(parents, parent)
+				unresolved = append(unresolved, stamp)
+			}
+		}
+		if changed {
+			// A callout may resolve to a parent the commit already has
+			seen := make(map[CommitLike]bool)
+			unique := parents[:0]
+			for _, parent := range parents {
+				if !seen[parent] {
+					seen[parent] = true
+					unique = append(unique, parent)
+				}
+			}
+			commit.setParents(unique)
+			for _, op := range links {
+				commit.appendOperation(op)
+			}
+			commit.addColor(colorQSET)
+		}
+	}
+	if resort {
+		repo.resort()
+	}
+	return parented, linked, unresolved
+}
+
+// end
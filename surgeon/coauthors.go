@@ -0,0 +1,168 @@
+/*
+ * Co-author trailers
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A fast-import stream can give a commit several author lines, and
+// bzr keeps them all, but git keeps only the first.  The convention
+// git tools understand instead is a "Co-authored-by:" trailer in the
+// last paragraph of the comment for each author after the first.
+// Going to git the extra authors are best turned into trailers; going
+// the other way, to a system that has multiple authors, trailers can
+// be turned back into authors.  Either way, trailers already present
+// are respelled in the canonical form and duplicates dropped.
+
+// coauthorTrailer is the canonical spelling of the trailer key.
+const coauthorTrailer = "Co-authored-by"
+
+// splitCoauthors removes the co-author trailers, however capitalized,
+// from the trailer block of a comment, returning the rest of it and the
+// trailer payloads in order.
+func splitCoauthors(comment string) (string, []string) {
+	body, trailers := trailerBlock(comment)
+	coauthors := make([]string, 0)
+	if trailers == nil {
+		return comment, coauthors
+	}
+	for _, trailer := range trailers {
+		if strings.EqualFold(trailer[0], coauthorTrailer) {
+			coauthors = append(coauthors, wsRE.ReplaceAllLiteralString(trailer[1], " "))
+		} else {
+			body = joinTrailers(body, trailer[0], []string{trailer[1]})
+		}
+	}
+	return body, coauthors
+}
+
+// joinCoauthors appends co-author trailers to a comment.
+func joinCoauthors(comment string, coauthors []string) string {
+	return joinTrailers(comment, coauthorTrailer, coauthors)
+}
+
+// joinTrailers appends trailers with a key to a comment, in the last
+// paragraph if that is already trailers and in a new one otherwise.
+func joinTrailers(comment string, key string, values []string) string {
+	if len(values) == 0 {
+		return comment
+	}
+	trailers := make([]string, len(values))
+	for i, value := range values {
+		trailers[i] = fmt.Sprintf("%s: %s", key, value)
+	}
+	if comment == "" {
+		return strings.Join(trailers, "\n") + "\n"
+	}
+	separator := "\n\n"
+	if _, trailers := trailerBlock(comment); trailers != nil {
+		separator = "\n"
+	}
+	return strings.TrimRight(comment, "\n") + separator + strings.Join(trailers, "\n") + "\n"
+}
+
+// addressOf returns the lowercased address in a "Name <address>"
+// string, or the whole string if it has none.
+func addressOf(who string) string {
+	if m := addressRE.FindStringSubmatch(who); m != nil {
+		return strings.ToLower(m[2])
+	}
+	return strings.ToLower(who)
+}
+
+// coauthorsToTrailers turns every author of a commit after the first
+// into a co-author trailer.  Returns whether the commit changed.
+func (commit *Commit) coauthorsToTrailers() bool {
+	original, count := commit.Comment, len(commit.authors)
+	body, found := splitCoauthors(commit.Comment)
+	seen := make(map[string]bool)
+	if len(commit.authors) > 0 {
+		seen[strings.ToLower(commit.authors[0].email)] = true
+	}
+	coauthors := make([]string, 0, len(found)+len(commit.authors))
+	for _, coauthor := range found {
+		if !seen[addressOf(coauthor)] {
+			seen[addressOf(coauthor)] = true
+			coauthors = append(coauthors, coauthor)
+		}
+	}
+	if len(commit.authors) > 1 {
+		for _, author := range commit.authors[1:] {
+			if !seen[strings.ToLower(author.email)] {
+				seen[strings.ToLower(author.email)] = true
+				coauthors = append(coauthors, author.who())
+			}
+		}
+		commit.authors = commit.authors[:1]
+	}
+	commit.Comment = joinCoauthors(body, coauthors)
+	return commit.Comment != original || len(commit.authors) != count
+}
+
+// trailersToCoauthors turns the co-author trailers of a commit into
+// authors after the first, dated like the first.  Trailers without a
+// usable address are left in place.  Returns whether the commit
+// changed.
+func (commit *Commit) trailersToCoauthors() bool {
+	body, found := splitCoauthors(commit.Comment)
+	if len(found) == 0 {
+		return false
+	}
+	original, count := commit.Comment, len(commit.authors)
+	if len(commit.authors) == 0 {
+		commit.authors = append(commit.authors, *commit.committer.clone())
+	}
+	seen := make(map[string]bool)
+	for _, author := range commit.authors {
+		seen[strings.ToLower(author.email)] = true
+	}
+	unparsed := make([]string, 0)
+	for _, coauthor := range found {
+		m := addressRE.FindStringSubmatch(coauthor)
+		if m == nil {
+			unparsed = append(unparsed, coauthor)
+			continue
+		}
+		if seen[strings.ToLower(m[2])] {
+			continue
+		}
+		seen[strings.ToLower(m[2])] = true
+		author := commit.authors[0].clone()
+		author.fullname, author.email = m[1], m[2]
+		commit.authors = append(commit.authors, *author)
+	}
+	commit.Comment = joinCoauthors(body, unparsed)
+	return commit.Comment != original || len(commit.authors) != count
+}
+
+// normalizeCoauthors moves co-authors of the selected commits into
+// trailers, or out of them into authors if toAuthors is set.  Changed
+// commits get Q bits.  Returns the number changed.
+func (repo *Repository) normalizeCoauthors(selection selectionSet, toAuthors bool) int {
+	repo.clearColor(colorQSET)
+	changed := 0
+	for _, commit := range repo.commits(selection) {
+		var modified bool
+		if toAuthors {
+			modified = commit.trailersToCoauthors()
+		} else {
+			modified = commit.coauthorsToTrailers()
+		}
+		if modified {
+			commit.hash.invalidate()
+			commit.addColor(colorQSET)
+			changed++
+		}
+	}
+	repo.invalidateNamecache()
+	return changed
+}
+
+// end
@@ -0,0 +1,233 @@
+/*
+ * Compression codecs for on-disk blob copies
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// With the compress option on, blob files in the scratch directory are
+// written through a codec.  gzip is built in; it is also slow enough
+// to be the bottleneck reading and writing a large tree.  zstd and lz4
+// are much faster at a similar or slightly worse ratio.  There are no
+// Go implementations of those in our dependency set, so reposurgeon
+// runs the zstd or lz4 program on each blob; the process startup is
+// repaid on all but small blobs.
+//
+// Blob files carry no record of the codec that wrote them, so the
+// codec must not change while a repository is loaded with compress on.
+
+type blobCodec struct {
+	name       string
+	ratio      int64 // Rough compression ratio, for disk-space estimates
+	compress   func(w io.Writer) (io.WriteCloser, error)
+	decompress func(r io.Reader) (io.ReadCloser, error)
+}
+
+var blobCodecs = []*blobCodec{
+	{
+		name:  "gzip",
+		ratio: blobCompressionRatio,
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		name:       "zstd",
+		ratio:      blobCompressionRatio,
+		compress:   externalCompressor("zstd", "-q", "-c"),
+		decompress: externalDecompressor("zstd", "-q", "-d", "-c"),
+	},
+	{
+		name:       "lz4",
+		ratio:      blobCompressionRatio,
+		compress:   externalCompressor("lz4", "-q", "-c"),
+		decompress: externalDecompressor("lz4", "-q", "-d", "-c"),
+	},
+}
+
+// findCodec returns the codec with a given name, or nil.
+func findCodec(name string) *blobCodec {
+	for _, codec := range blobCodecs {
+		if codec.name == name {
+			return codec
+		}
+	}
+	return nil
+}
+
+// codecNames lists the known codecs.
+func codecNames() []string {
+	names := make([]string, len(blobCodecs))
+	for i, codec := range blobCodecs {
+		names[i] = codec.name
+	}
+	return names
+}
+
+// activeCodec returns the codec blob files are written with, or nil if
+// they aren't compressed.
+func activeCodec() *blobCodec {
+	if !control.flagOptions["compress"] {
+		return nil
+	}
+	if codec := findCodec(control.codec); codec != nil {
+		return codec
+	}
+	return blobCodecs[0]
+}
+
+// checkCodec makes sure a codec can be used here.
+func checkCodec(name string) error {
+	codec := findCodec(name)
+	if codec == nil {
+		return fmt.Errorf("unknown codec %q, must be one of %s", name, strings.Join(codecNames(), ", "))
+	}
+	if codec != blobCodecs[0] {
+		if _, err := exec.LookPath(codec.name); err != nil {
+			return fmt.Errorf("codec %s needs the %s program: %v", codec.name, codec.name, err)
+		}
+	}
+	return nil
+}
+
+// filterWriter feeds what is written to it through a program.
+type filterWriter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func (fw *filterWriter) Write(p []byte) (int, error) {
+	return fw.stdin.Write(p)
+}
+
+func (fw *filterWriter) Close() error {
+	err := fw.stdin.Close()
+	if werr := fw.cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+func externalCompressor(program string, args ...string) func(io.Writer) (io.WriteCloser, error) {
+	return func(w io.Writer) (io.WriteCloser, error) {
+		cmd := exec.Command(program, args...)
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &filterWriter{cmd, stdin}, nil
+	}
+}
+
+// filterReader reads the output of a program.
+type filterReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+}
+
+func (fr *filterReader) Read(p []byte) (int, error) {
+	return fr.stdout.Read(p)
+}
+
+func (fr *filterReader) Close() error {
+	// Drain, so a reader that stops early doesn't kill the program
+	// with SIGPIPE and make that look like a failure.
+	io.Copy(ioutil.Discard, fr.stdout)
+	return fr.cmd.Wait()
+}
+
+func externalDecompressor(program string, args ...string) func(io.Reader) (io.ReadCloser, error) {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		cmd := exec.Command(program, args...)
+		cmd.Stdin = r
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &filterReader{cmd, stdout}, nil
+	}
+}
+
+// codecWriter is a compressing writer that closes its file when it is
+// closed.
+type codecWriter struct {
+	io.WriteCloser
+	file *os.File
+}
+
+func (cw *codecWriter) Close() error {
+	err := cw.WriteCloser.Close()
+	if cerr := cw.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// codecReader is a decompressing reader that closes its file when it
+// is closed.
+type codecReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (cr *codecReader) Close() error {
+	err := cr.ReadCloser.Close()
+	if cerr := cr.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// newBlobWriter returns a writer storing blob content in a file,
+// compressed if compress is on.  Closing it closes the file.
+func newBlobWriter(file *os.File) (io.WriteCloser, error) {
+	codec := activeCodec()
+	if codec == nil {
+		return file, nil
+	}
+	w, err := codec.compress(file)
+	if err != nil {
+		return nil, err
+	}
+	return &codecWriter{w, file}, nil
+}
+
+// newBlobReader returns a reader of the blob content in a file,
+// decompressed if compress is on.  Closing it closes the file.
+func newBlobReader(file *os.File) (io.ReadCloser, error) {
+	codec := activeCodec()
+	if codec == nil {
+		return file, nil
+	}
+	r, err := codec.decompress(file)
+	if err != nil {
+		return nil, err
+	}
+	return &codecReader{r, file}, nil
+}
+
+// end
@@ -0,0 +1,152 @@
+/*
+ * Draft CODEOWNERS from attribution history
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// After a conversion the first thing many teams want is a CODEOWNERS
+// file for the forge they are moving to.  The history already says who
+// has been working where, so we can draft one: for each directory
+// prefix down to a given depth, rank authors by the number of commits
+// in which they touched something under it, counting only commits
+// within a recency window ending at the newest commit considered.
+//
+// CODEOWNERS is last-match-wins, so entries are written shallowest
+// first; a deeper prefix overrides the one above it.  Owners are given
+// by email address, which the forges accept in place of a user name.
+
+type ownerTally struct {
+	email   string
+	commits int
+	latest  time.Time
+}
+
+type ownerEntry struct {
+	prefix string // "*" for the root, otherwise "/dir/.../"
+	owners []ownerTally
+}
+
+// ownerPrefixes returns the CODEOWNERS patterns a path falls under, to
+// the given directory depth.
+func ownerPrefixes(path string, depth int) []string {
+	prefixes := []string{"*"}
+	parts := strings.Split(path, "/")
+	for i := 1; i < len(parts) && i <= depth; i++ {
+		prefixes = append(prefixes, "/"+strings.Join(parts[:i], "/")+"/")
+	}
+	return prefixes
+}
+
+// codeOwners ranks the authors of the selected commits under each path
+// prefix.  A window of zero means all of history.
+func (repo *Repository) codeOwners(selection selectionSet, depth int, window time.Duration, top int) []ownerEntry {
+	commits := repo.commits(selection)
+	var newest time.Time
+	for _, commit := range commits {
+		if d := commit.committer.date.timestamp; d.After(newest) {
+			newest = d
+		}
+	}
+	tallies := make(map[string]map[string]*ownerTally)
+	for _, commit := range commits {
+		when := commit.committer.date.timestamp
+		if window > 0 && newest.Sub(when) > window {
+			continue
+		}
+		var email string
+		if len(commit.authors) > 0 {
+			email = commit.authors[0].email
+		} else {
+			email = commit.committer.email
+		}
+		if email == "" {
+			continue
+		}
+		touched := newOrderedStringSet()
+		for _, op := range commit.operations() {
+			if op.op == opR {
+				touched.Add(op.Source)
+			}
+			if op.op != deleteall {
+				touched.Add(op.Path)
+			}
+		}
+		prefixes := newOrderedStringSet()
+		for _, path := range touched {
+			for _, prefix := range ownerPrefixes(path, depth) {
+				prefixes.Add(prefix)
+			}
+		}
+		for _, prefix := range prefixes {
+			if tallies[prefix] == nil {
+				tallies[prefix] = make(map[string]*ownerTally)
+			}
+			t := tallies[prefix][email]
+			if t == nil {
+				t = &ownerTally{email: email}
+				tallies[prefix][email] = t
+			}
+			t.commits++
+			if when.After(t.latest) {
+				t.latest = when
+			}
+		}
+	}
+	entries := make([]ownerEntry, 0, len(tallies))
+	for prefix, byEmail := range tallies {
+		owners := make([]ownerTally, 0, len(byEmail))
+		for _, t := range byEmail {
+			owners = append(owners, *t)
+		}
+		// Most commits first, then most recent, then by address
+		// so the output is stable.
+		sort.Slice(owners, func(i, j int) bool {
+			if owners[i].commits != owners[j].commits {
+				return owners[i].commits > owners[j].commits
+			}
+			if !owners[i].latest.Equal(owners[j].latest) {
+				return owners[i].latest.After(owners[j].latest)
+			}
+			return owners[i].email < owners[j].email
+		})
+		if top > 0 && len(owners) > top {
+			owners = owners[:top]
+		}
+		entries = append(entries, ownerEntry{prefix, owners})
+	}
+	// "*" sorts before "/", so the root comes first and every
+	// directory precedes its subdirectories.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].prefix < entries[j].prefix })
+	return entries
+}
+
+// writeCodeOwners writes owner entries in CODEOWNERS format, each
+// preceded by a comment giving the owners' commit counts.
+func writeCodeOwners(w io.Writer, entries []ownerEntry) {
+	fmt.Fprintf(w, "# Draft CODEOWNERS generated by reposurgeon from commit history.\n")
+	fmt.Fprintf(w, "# Review before use; owners are ranked by commits touching each path.\n")
+	for _, entry := range entries {
+		emails := make([]string, len(entry.owners))
+		counts := make([]string, len(entry.owners))
+		for i, t := range entry.owners {
+			emails[i] = t.email
+			counts[i] = fmt.Sprintf("%s %d", t.email, t.commits)
+		}
+		fmt.Fprintf(w, "\n# %s\n", strings.Join(counts, ", "))
+		prefix := strings.ReplaceAll(entry.prefix, " ", "\\ ")
+		fmt.Fprintf(w, "%s %s\n", prefix, strings.Join(emails, " "))
+	}
+}
+
+// end
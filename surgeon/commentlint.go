@@ -0,0 +1,158 @@
+/*
+ * Comment policy checks for lint
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Comments imported from older systems are often untidy in ways git
+// tools notice: no final newline, lines far longer than the 72
+// columns git log output is laid out for, the rows of dashes or equals
+// signs some CVS and Subversion front ends put between entries, and
+// nothing at all.  A conversion that promises Legacy-ID trailers may
+// also want every event with a legacy ID to carry one.  Some of these
+// can be repaired mechanically; a long line or an empty comment needs
+// a human.
+
+// commentPolicy says what lint checks in comments.
+type commentPolicy struct {
+	width  int  // Longest acceptable line in runes, 0 for no limit
+	legacy bool // Require a Legacy-ID trailer where there is a legacy ID
+}
+
+// The default line width is git's convention
+const defaultCommentWidth = 72
+
+// isSeparatorLine tells whether a line is nothing but a row of four or
+// more of the same punctuation character.
+func isSeparatorLine(line string) bool {
+	line = strings.TrimSpace(line)
+	if len(line) < 4 || !strings.ContainsRune("-=*#~_+", rune(line[0])) {
+		return false
+	}
+	return strings.Count(line, line[:1]) == len(line)
+}
+
+// hasLegacyTrailer tells whether a comment has the trailer that write
+// --legacy would add for a legacy ID.
+func hasLegacyTrailer(comment string, legacyID string) bool {
+	for _, line := range strings.Split(comment, "\n") {
+		if strings.TrimSpace(line) == "Legacy-ID: "+legacyID {
+			return true
+		}
+	}
+	return false
+}
+
+// problems describes what is wrong with a comment under the policy.
+// The second value tells whether fix would change anything.
+func (policy commentPolicy) problems(comment string, legacyID string) ([]string, bool) {
+	found := make([]string, 0)
+	fixable := false
+	if emptyComment(comment) {
+		found = append(found, "empty comment")
+	} else if !strings.HasSuffix(comment, "\n") {
+		found = append(found, "comment not LF-terminated")
+		fixable = true
+	}
+	separators := 0
+	for i, line := range strings.Split(strings.TrimSuffix(comment, "\n"), "\n") {
+		if isSeparatorLine(line) {
+			separators++
+		} else if n := utf8.RuneCountInString(strings.TrimRight(line, "\r")); policy.width > 0 && n > policy.width {
+			found = append(found, fmt.Sprintf("line %d is %d characters long", i+1, n))
+		}
+	}
+	if separators > 0 {
+		found = append(found, fmt.Sprintf("%d separator line(s)", separators))
+		fixable = true
+	}
+	if policy.legacy && legacyID != "" && !hasLegacyTrailer(comment, legacyID) {
+		found = append(found, "missing Legacy-ID trailer")
+		fixable = true
+	}
+	return found, fixable
+}
+
+// fix makes the mechanical repairs to a comment: separator lines are
+// removed, the comment is LF-terminated, and a missing Legacy-ID
+// trailer is appended if the policy requires one.
+func (policy commentPolicy) fix(comment string, legacyID string) string {
+	kept := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimSuffix(comment, "\n"), "\n") {
+		if !isSeparatorLine(line) {
+			kept = append(kept, line)
+		}
+	}
+	// Dropping separators can leave blank lines at either end
+	for len(kept) > 0 && strings.TrimSpace(kept[0]) == "" {
+		kept = kept[1:]
+	}
+	for len(kept) > 0 && strings.TrimSpace(kept[len(kept)-1]) == "" {
+		kept = kept[:len(kept)-1]
+	}
+	fixed := ""
+	if len(kept) > 0 {
+		fixed = strings.Join(kept, "\n") + "\n"
+	}
+	if policy.legacy && legacyID != "" && !hasLegacyTrailer(fixed, legacyID) {
+		if fixed != "" {
+			fixed += "\n"
+		}
+		fixed += fmt.Sprintf("Legacy-ID: %s\n", legacyID)
+	}
+	return fixed
+}
+
+// lintComments checks the comments of the selected commits and tags,
+// reporting each problem to the returned list as "ID: problem".  With
+// repair, fixable comments are fixed.  Events with problems get Q
+// bits; Q bits are not cleared first.  Returns the reports and the
+// number of comments fixed.
+func (repo *Repository) lintComments(selection selectionSet, policy commentPolicy, repair bool) ([]string, int) {
+	reports := make([]string, 0)
+	fixed := 0
+	for it := selection.Iterator(); it.Next(); {
+		var comment, legacyID string
+		switch event := repo.events[it.Value()].(type) {
+		case *Commit:
+			comment, legacyID = event.Comment, event.legacyID
+		case *Tag:
+			comment, legacyID = event.Comment, event.legacyID
+		default:
+			continue
+		}
+		event := repo.events[it.Value()]
+		found, fixable := policy.problems(comment, legacyID)
+		if len(found) == 0 {
+			continue
+		}
+		event.addColor(colorQSET)
+		for _, problem := range found {
+			reports = append(reports, fmt.Sprintf("%s: %s", event.idMe(), problem))
+		}
+		if !repair || !fixable {
+			continue
+		}
+		switch event := event.(type) {
+		case *Commit:
+			event.Comment = policy.fix(comment, legacyID)
+			event.hash.invalidate()
+		case *Tag:
+			event.Comment = policy.fix(comment, legacyID)
+			event.hash.invalidate()
+		}
+		fixed++
+	}
+	return reports, fixed
+}
+
+// end
@@ -0,0 +1,167 @@
+/*
+ * Compaction of repository storage after large deletions
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"unsafe" // Actually safe - only uses Sizeof
+)
+
+// Deletion is done in place wherever it can be, for speed: the event
+// list is filtered without reallocation, parent and child links are
+// nulled out rather than removed, and blob files are left on disk.
+// After a squash or expunge that throws away most of a repository,
+// that leaves a lot of capacity and disk behind.  compact reclaims it
+// without changing anything visible - event numbers, marks and content
+// all stay as they are.
+//
+// Blob files are named by a sequence number, fanned out over three
+// directory levels.  Survivors of a large deletion are scattered over
+// most of the original directories, so they are renumbered in event
+// order into a fresh range, which packs them into as few directories
+// as possible, and the emptied directories are removed.
+
+type compactReport struct {
+	eventSlots  int   // unused capacity dropped from the event list
+	linkSlots   int   // null parent and child links squeezed out
+	opSlots     int   // unused capacity dropped from fileop lists
+	blobsMoved  int   // blob files renumbered
+	orphans     int   // blob files belonging to no blob, removed
+	directories int   // empty blob directories removed
+	memory      int64 // bytes of slice storage released
+	disk        int64 // bytes of files and directories removed
+}
+
+// compactLinks drops nils from a parent or child list, reallocating it
+// to fit.  Returns the new list and the number of slots removed.
+func compactLinks(links []CommitLike) ([]CommitLike, int) {
+	live := 0
+	for _, c := range links {
+		if c != nil {
+			live++
+		}
+	}
+	if live == cap(links) {
+		return links, 0
+	}
+	out := make([]CommitLike, 0, live)
+	for _, c := range links {
+		if c != nil {
+			out = append(out, c)
+		}
+	}
+	return out, cap(links) - live
+}
+
+// compact rebuilds the repository's in-core lists to fit and repacks
+// its blob storage.
+func (repo *Repository) compact(baton *Baton) compactReport {
+	var report compactReport
+	var linkSize = int64(unsafe.Sizeof(CommitLike(nil)))
+	var opSize = int64(unsafe.Sizeof((*FileOp)(nil)))
+	var eventSize = int64(unsafe.Sizeof(Event(nil)))
+
+	if cap(repo.events) > len(repo.events) {
+		report.eventSlots = cap(repo.events) - len(repo.events)
+		events := make([]Event, len(repo.events))
+		copy(events, repo.events)
+		repo.events = events
+	}
+	report.memory += int64(report.eventSlots) * eventSize
+
+	baton.startProgress("compact", uint64(len(repo.events)))
+	blobs := make([]*Blob, 0)
+	for i, event := range repo.events {
+		switch e := event.(type) {
+		case *Commit:
+			var n int
+			e._parentNodes, n = compactLinks(e._parentNodes)
+			report.linkSlots += n
+			e._childNodes, n = compactLinks(e._childNodes)
+			report.linkSlots += n
+			if cap(e.fileops) > len(e.fileops) {
+				report.opSlots += cap(e.fileops) - len(e.fileops)
+				ops := make([]*FileOp, len(e.fileops))
+				copy(ops, e.fileops)
+				e.fileops = ops
+			}
+		case *Blob:
+			if cap(e.opset) > len(e.opset) {
+				report.opSlots += cap(e.opset) - len(e.opset)
+				ops := make([]*FileOp, len(e.opset))
+				copy(ops, e.opset)
+				e.opset = ops
+			}
+			if e.abspath == "" && e.hasfile() {
+				blobs = append(blobs, e)
+			}
+		}
+		baton.percentProgress(uint64(i) + 1)
+	}
+	baton.endProgress()
+	report.memory += int64(report.linkSlots)*linkSize + int64(report.opSlots)*opSize
+
+	// Renumber blob files into a fresh, dense range.  The new
+	// numbers are past every existing one, so nothing can collide.
+	live := make(map[string]bool)
+	for _, blob := range blobs {
+		oldpath := blob.getBlobfile(false)
+		if !exists(oldpath) {
+			continue
+		}
+		blob.blobseq = control.blobseq
+		control.blobseq++
+		if control.blobseq == ^blobidx(0) {
+			panic("blob index overflow, rebuild with a larger size")
+		}
+		newpath := blob.getBlobfile(true)
+		if err := os.Rename(oldpath, newpath); err != nil {
+			panic(throw("command", "while moving blob file: %v", err))
+		}
+		live[newpath] = true
+		report.blobsMoved++
+	}
+
+	// Anything else in the blob tree belongs to a deleted blob.
+	root := filepath.Join(repo.subdir(""), "blobs")
+	dirs := make([]string, 0)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != root {
+				dirs = append(dirs, path)
+			}
+		} else if !live[path] {
+			if os.Remove(path) == nil {
+				report.orphans++
+				report.disk += info.Size()
+			}
+		}
+		return nil
+	})
+	// Deepest first, so a directory is emptied before its parent
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err == nil && os.Remove(dir) == nil {
+			report.directories++
+			report.disk += info.Size()
+		}
+	}
+
+	// Drop the lookup caches too; they will be rebuilt to fit.
+	// Event numbers haven't changed, so assignments stand.
+	repo.declareSequenceMutation("")
+	return report
+}
+
+// end
@@ -0,0 +1,124 @@
+/*
+ * Comparison of the commit graphs of two repositories
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A conversion is usually run more than once before cutover, with a
+// fixed lift script or a newer reposurgeon, and the question each time
+// is what the new run does differently from the last.  Comparing the
+// exported streams textually drowns the answer in mark renumbering.
+// So commits of the two repositories are paired by what identifies
+// them independently of marks, and then compared as pairs.
+//
+// By default commits are paired by action stamp, which survives most
+// surgery; commits sharing a stamp are paired in event order.  Pairing
+// by tree hash instead finds the same content committed under different
+// attributions or dates, as after a timezone or author-map fix.  Each
+// pair is compared in the respects equivalent commits agree in,
+// committer, authors, comment and tree, and then in branch and parents,
+// the parents being compared through the pairing.
+
+// compareKeys returns the pairing key of each commit of a repository,
+// with an ordinal suffix where commits share one.
+func (repo *Repository) compareKeys(byTree bool) ([]*Commit, map[*Commit]string, map[string]*Commit) {
+	commits := repo.commits(undefinedSelectionSet)
+	keys := make(map[*Commit]string, len(commits))
+	index := make(map[string]*Commit, len(commits))
+	seen := make(map[string]int)
+	for _, commit := range commits {
+		var key string
+		if byTree {
+			key = commit.manifest().gitHash().hexify()
+		} else {
+			key = commit.actionStamp()
+		}
+		seen[key]++
+		if seen[key] > 1 {
+			key = fmt.Sprintf("%s#%d", key, seen[key])
+		}
+		keys[commit] = key
+		index[key] = commit
+	}
+	return commits, keys, index
+}
+
+// commitSummary is the first line of a commit comment.
+func commitSummary(commit *Commit) string {
+	return strings.SplitN(strings.TrimSpace(commit.Comment), "\n", 2)[0]
+}
+
+// compareRepos reports how the commits of another repository differ
+// from this one's: commits only in this one, prefixed "-", commits only
+// in the other, prefixed "+", and pairs that differ, prefixed "~" and
+// followed by what differs.  Commits here that differ or are unpaired
+// get Q bits.  Returns the number of differences found.
+func (repo *Repository) compareRepos(w io.Writer, other *Repository, byTree bool) int {
+	repo.clearColor(colorQSET)
+	mine, myKeys, myIndex := repo.compareKeys(byTree)
+	theirs, theirKeys, theirIndex := other.compareKeys(byTree)
+	parentKeys := func(commit *Commit, keys map[*Commit]string) string {
+		parents := make([]string, 0)
+		for it := commit.parentIterator(); it.Next(); {
+			if parent, ok := it.Value().(*Commit); ok {
+				parents = append(parents, keys[parent])
+			} else {
+				parents = append(parents, it.Value().getMark())
+			}
+		}
+		return strings.Join(parents, " ")
+	}
+	var removed, added, changed, reshaped int
+	for _, commit := range mine {
+		partner, ok := theirIndex[myKeys[commit]]
+		if !ok {
+			fmt.Fprintf(w, "- %s %s %q\n", commit.mark, commit.actionStamp(), commitSummary(commit))
+			commit.addColor(colorQSET)
+			removed++
+			continue
+		}
+		// Parents are compared through the pairing rather than by
+		// action stamp.
+		differences := make([]string, 0)
+		for _, field := range commit.differences(partner, false) {
+			if field != "parents" {
+				differences = append(differences, field)
+			}
+		}
+		if commit.Branch != partner.Branch {
+			differences = append(differences, "branch")
+		}
+		metadata := len(differences)
+		if parentKeys(commit, myKeys) != parentKeys(partner, theirKeys) {
+			differences = append(differences, "parents")
+			reshaped++
+		}
+		if len(differences) > 0 {
+			fmt.Fprintf(w, "~ %s %s %s\n", commit.mark, partner.mark, strings.Join(differences, " "))
+			commit.addColor(colorQSET)
+			if metadata > 0 {
+				changed++
+			}
+		}
+	}
+	for _, commit := range theirs {
+		if _, ok := myIndex[theirKeys[commit]]; !ok {
+			fmt.Fprintf(w, "+ %s %s %q\n", commit.mark, commit.actionStamp(), commitSummary(commit))
+			added++
+		}
+	}
+	fmt.Fprintf(w, "%d commits only in %s, %d only in %s, %d with metadata differences, %d with topology differences.\n",
+		removed, repo.name, added, other.name, changed, reshaped)
+	return removed + added + changed + reshaped
+}
+
+// end
@@ -0,0 +1,231 @@
+/*
+ * Verification of recomputed hashes against recorded object IDs
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// A stream exported from git with --show-original-ids carries the
+// object ID of every blob and commit.  Surgery on the repository
+// changes the hashes the events would have if written back to git,
+// and the drift report says which ones have moved and why.
+//
+// A commit's hash covers its tree, its parents' hashes, and its
+// metadata (attributions and comment).  Alongside the recorded ID we
+// keep digests of the last two as they were read, which is enough to
+// tell the causes apart: a commit whose parents are the ones it was
+// read with, with unchanged hashes, and whose metadata digest is
+// unchanged, can only have drifted because its tree did.  When parents
+// or metadata have also changed the tree can't be isolated, since the
+// original tree hash was never in the stream, and it is reported as
+// unknown.
+
+type oidRecord struct {
+	oid      gitHashType // the original-oid of the commit
+	parents  gitHashType // digest of the parents' original-oids
+	metadata gitHashType // digest of the hash trailer
+}
+
+// recordedParents returns the original-oids of the commit's parents,
+// in order, and their digest.  A parent without one contributes a null
+// hash, so adding it changes the digest.
+func (commit *Commit) recordedParents() ([]gitHashType, gitHashType) {
+	oids := make([]gitHashType, 0)
+	var body []byte
+	for _, parent := range commit.parents() {
+		if c, ok := parent.(*Commit); ok {
+			var oid gitHashType
+			if c.recorded != nil {
+				oid = c.recorded.oid
+			}
+			oids = append(oids, oid)
+			body = append(body, oid[:]...)
+		}
+	}
+	return oids, gitHashString(string(body))
+}
+
+// record captures the commit's current hash as its original-oid, with
+// digests of its parentage and metadata.
+func (commit *Commit) record() {
+	_, parents := commit.recordedParents()
+	commit.recorded = &oidRecord{
+		oid:      commit.hash,
+		parents:  parents,
+		metadata: gitHashString(commit.hashTrailer()),
+	}
+}
+
+const (
+	driftContent  = "content"
+	driftParent   = "parent"
+	driftMetadata = "metadata"
+)
+
+type driftRecord struct {
+	Event    int      `json:"event"`
+	Mark     string   `json:"mark"`
+	Kind     string   `json:"kind"`
+	Recorded string   `json:"recorded"`
+	Computed string   `json:"computed"`
+	Causes   []string `json:"causes"`
+	Tree     string   `json:"tree,omitempty"` // same, changed, or unknown
+}
+
+// freshHashes holds hashes recomputed from the content of blobs and
+// commits, without reference to the hashes stored in the events, which
+// may have been taken from the stream and are what a write emits as
+// original-oids.
+type freshHashes struct {
+	blobs   map[*Blob]gitHashType
+	trees   map[*Commit]gitHashType
+	commits map[*Commit]gitHashType
+}
+
+// blob returns the recomputed hash of a blob, computing it on first use.
+func (fresh *freshHashes) blob(b *Blob) gitHashType {
+	hash, ok := fresh.blobs[b]
+	if !ok {
+		hash = b.contentHash()
+		fresh.blobs[b] = hash
+	}
+	return hash
+}
+
+// commit returns the recomputed hash of a commit, whose tree hash has
+// already been computed.
+func (fresh *freshHashes) commit(c *Commit) gitHashType {
+	hash, ok := fresh.commits[c]
+	if !ok {
+		parents := make([]gitHashType, 0)
+		for _, parent := range c.parents() {
+			if p, ok := parent.(*Commit); ok {
+				parents = append(parents, fresh.commit(p))
+			}
+		}
+		hash = c.hashWithParents(fresh.trees[c], parents)
+		fresh.commits[c] = hash
+	}
+	return hash
+}
+
+// recomputeHashes computes the tree hash of every commit from scratch.
+// Blob and commit hashes follow on demand.
+func (repo *Repository) recomputeHashes(baton *Baton) *freshHashes {
+	fresh := &freshHashes{
+		blobs:   make(map[*Blob]gitHashType),
+		trees:   make(map[*Commit]gitHashType),
+		commits: make(map[*Commit]gitHashType),
+	}
+	subtrees := make(map[*PathMap]gitHashType)
+	lookup := func(pm *PathMap) (gitHashType, bool) {
+		hash, ok := subtrees[pm]
+		return hash, ok
+	}
+	store := func(pm *PathMap, hash gitHashType) {
+		subtrees[pm] = hash
+	}
+	baton.startProgress("recompute hashes", uint64(len(repo.events)))
+	repo.walkManifests(func(idx int, commit *Commit, _ int, _ *Commit) {
+		fresh.trees[commit] = commit.manifest().hashWith(fresh.blob, lookup, store)
+		baton.percentProgress(uint64(idx) + 1)
+	})
+	baton.endProgress()
+	return fresh
+}
+
+// driftReport recomputes the hash of every blob and commit in the
+// selection that has a recorded original-oid and writes a JSON line to
+// w for each one that no longer matches.  The hashes stored in the
+// events are left alone, so a later write emits the same original-oids
+// it would have.  Returns the number of events checked and the number
+// that drifted.
+func (repo *Repository) driftReport(selection selectionSet, w io.Writer, baton *Baton) (int, int) {
+	fresh := repo.recomputeHashes(baton)
+	checked, drifted := 0, 0
+	enc := json.NewEncoder(w)
+	for it := selection.Iterator(); it.Next(); {
+		var record *driftRecord
+		switch e := repo.events[it.Value()].(type) {
+		case *Blob:
+			if !e.oid.isValid() {
+				continue
+			}
+			checked++
+			if computed := fresh.blob(e); computed != e.oid {
+				record = &driftRecord{
+					Kind:     "blob",
+					Mark:     e.mark,
+					Recorded: e.oid.hexify(),
+					Computed: computed.hexify(),
+					Causes:   []string{driftContent},
+				}
+			}
+		case *Commit:
+			if e.recorded == nil {
+				continue
+			}
+			checked++
+			if computed := fresh.commit(e); computed != e.recorded.oid {
+				causes, tree := e.driftCauses(fresh)
+				record = &driftRecord{
+					Kind:     "commit",
+					Mark:     e.mark,
+					Recorded: e.recorded.oid.hexify(),
+					Computed: computed.hexify(),
+					Causes:   causes,
+					Tree:     tree,
+				}
+			}
+		}
+		if record != nil {
+			record.Event = it.Value()
+			drifted++
+			enc.Encode(record)
+		}
+	}
+	return checked, drifted
+}
+
+// driftCauses explains why a commit's hash differs from its recorded
+// one, and says whether its tree is the same, changed, or unknown.
+func (commit *Commit) driftCauses(fresh *freshHashes) ([]string, string) {
+	causes := make([]string, 0)
+	oids, digest := commit.recordedParents()
+	parentage := digest != commit.recorded.parents
+	if !parentage {
+		for _, parent := range commit.parents() {
+			if c, ok := parent.(*Commit); ok && c.recorded != nil && fresh.commit(c) != c.recorded.oid {
+				parentage = true
+				break
+			}
+		}
+	}
+	if parentage {
+		causes = append(causes, driftParent)
+	}
+	metadata := gitHashString(commit.hashTrailer()) != commit.recorded.metadata
+	if metadata {
+		causes = append(causes, driftMetadata)
+	}
+	tree := "unknown"
+	if digest == commit.recorded.parents && !metadata {
+		// Put the recorded parent hashes back and see if that
+		// accounts for the whole difference.
+		tree = "same"
+		if commit.hashWithParents(fresh.trees[commit], oids) != commit.recorded.oid {
+			tree = "changed"
+			causes = append(causes, driftContent)
+		}
+	}
+	return causes, tree
+}
+
+// end
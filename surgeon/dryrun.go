@@ -0,0 +1,184 @@
+/*
+ * Dry-run rebuilds: rebuild into a sandbox and compare with the target
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// A rebuild replaces the target's contents, keeping the old ones only
+// as a backup directory beside it.  Before doing that to a repository
+// people work in, it helps to know what would change.  A dry run does
+// the whole rebuild into a scratch directory, reads both that and the
+// target back in through the usual exporter, and compares them: the
+// commit counts, the commit each ref points at, and the trees of a
+// sample of commits.  The target and the directories around it are
+// never touched.
+
+// dryRunSample is how many commits have their trees compared.
+const dryRunSample = 20
+
+// refTips returns the commit each ref of a repository points at.
+func (repo *Repository) refTips() map[string]*Commit {
+	tips := make(map[string]*Commit)
+	for _, event := range repo.events {
+		switch e := event.(type) {
+		case *Commit:
+			tips[e.Branch] = e
+		case *Reset:
+			if commit, ok := repo.markToEvent(e.committish).(*Commit); ok {
+				tips[e.ref] = commit
+			}
+		case *Tag:
+			if commit, ok := repo.markToEvent(e.committish).(*Commit); ok {
+				tips["refs/tags/"+e.tagname] = commit
+			}
+		}
+	}
+	return tips
+}
+
+// sameCommit tells whether two commits from different reads of a
+// history are the same: same action stamp, same tree.
+func sameCommit(a *Commit, b *Commit) bool {
+	return a.actionStamp() == b.actionStamp() && a.manifest().gitHash() == b.manifest().gitHash()
+}
+
+// compareRebuild reports the differences between the target repository
+// as it is and as a rebuild would leave it.  Returns the number of
+// differences found.
+func compareRebuild(w io.Writer, before *Repository, after *Repository) int {
+	differences := 0
+	beforeCommits := before.commits(undefinedSelectionSet)
+	afterCommits := after.commits(undefinedSelectionSet)
+	fmt.Fprintf(w, "commits: %d in target, %d after rebuild\n", len(beforeCommits), len(afterCommits))
+	if len(beforeCommits) != len(afterCommits) {
+		differences++
+	}
+
+	beforeTips, afterTips := before.refTips(), after.refTips()
+	refs := make([]string, 0, len(beforeTips)+len(afterTips))
+	for ref := range beforeTips {
+		refs = append(refs, ref)
+	}
+	for ref := range afterTips {
+		if _, ok := beforeTips[ref]; !ok {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Strings(refs)
+	unchanged := 0
+	for _, ref := range refs {
+		oldTip, inBefore := beforeTips[ref]
+		newTip, inAfter := afterTips[ref]
+		switch {
+		case !inBefore:
+			fmt.Fprintf(w, "+ %s at %s\n", ref, newTip.actionStamp())
+		case !inAfter:
+			fmt.Fprintf(w, "- %s at %s\n", ref, oldTip.actionStamp())
+		case oldTip.actionStamp() != newTip.actionStamp():
+			fmt.Fprintf(w, "~ %s moves from %s to %s\n", ref, oldTip.actionStamp(), newTip.actionStamp())
+		case !sameCommit(oldTip, newTip):
+			fmt.Fprintf(w, "~ %s at %s has a different tree\n", ref, newTip.actionStamp())
+		default:
+			unchanged++
+			continue
+		}
+		differences++
+	}
+	fmt.Fprintf(w, "refs: %d unchanged\n", unchanged)
+
+	// Sample commits evenly across the rebuilt history and find
+	// each in the target by action stamp.
+	byStamp := make(map[string]*Commit)
+	for _, commit := range beforeCommits {
+		byStamp[commit.actionStamp()] = commit
+	}
+	sampled, matched := 0, 0
+	step := len(afterCommits) / dryRunSample
+	if step == 0 {
+		step = 1
+	}
+	for i := len(afterCommits) - 1; i >= 0; i -= step {
+		commit := afterCommits[i]
+		sampled++
+		old, ok := byStamp[commit.actionStamp()]
+		if !ok {
+			fmt.Fprintf(w, "+ commit %s is not in target\n", commit.actionStamp())
+			differences++
+		} else if old.manifest().gitHash() != commit.manifest().gitHash() {
+			fmt.Fprintf(w, "~ commit %s has a different tree\n", commit.actionStamp())
+			differences++
+		} else {
+			matched++
+		}
+	}
+	fmt.Fprintf(w, "trees: %d of %d sampled commits match\n", matched, sampled)
+	if differences == 0 {
+		fmt.Fprintln(w, "no differences found.")
+	}
+	return differences
+}
+
+// dryRunRebuild rebuilds into a scratch directory and reports how the
+// result differs from the target, leaving the target alone.
+func (repo *Repository) dryRunRebuild(ctx context.Context, w io.Writer, target string, preferred *VCS,
+	options stringSet, baton *Baton) error {
+	target, vcs, err := repo.rebuildTarget(target, preferred)
+	if err != nil {
+		return err
+	}
+	// Repositories without an exporter are read back by their extractor
+	var extractor Extractor
+	if vcs.exporter == "" {
+		for _, importer := range importers {
+			if importer.basevcs != nil && importer.basevcs.name == vcs.name && importer.engine != nil {
+				extractor = importer.engine
+			}
+		}
+	}
+	sandbox, err := ioutil.TempDir("", "rsdryrun")
+	if err != nil {
+		return fmt.Errorf("sandbox creation failed: %v", err)
+	}
+	defer os.RemoveAll(sandbox)
+	here, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("rebuild is disoriented: %v", err)
+	}
+	os.Chdir(sandbox)
+	err = repo.innerRebuildRepo(ctx, vcs, options, baton)
+	os.Chdir(here)
+	if err != nil {
+		return err
+	}
+	after, err := readRepo(sandbox, newStringSet(), vcs, extractor, true, baton)
+	if err != nil {
+		return fmt.Errorf("while reading back the sandbox: %v", err)
+	}
+	defer after.cleanup()
+	if !exists(target) || !vcs.manages(target) {
+		fmt.Fprintf(w, "%s is not a %s repository; rebuild would create one with %d commits and %d refs.\n",
+			target, vcs.name, len(after.commits(undefinedSelectionSet)), len(after.refTips()))
+		return nil
+	}
+	before, err := readRepo(target, newStringSet(), vcs, extractor, true, baton)
+	if err != nil {
+		return fmt.Errorf("while reading the target: %v", err)
+	}
+	defer before.cleanup()
+	compareRebuild(w, before, after)
+	return nil
+}
+
+// end
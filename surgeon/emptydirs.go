@@ -0,0 +1,234 @@
+/*
+ * Placeholder files for empty directories
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Subversion versions directories; git versions only files, so a
+// directory with nothing in it isn't in a git tree at all.  A
+// Subversion history converted as it stands loses every directory
+// that was created empty, or emptied and kept, and a build that
+// expects one to be there breaks on checkout.  The usual cure is a
+// placeholder file, by convention .gitkeep, in each directory that
+// would otherwise be empty.
+//
+// With "set emptydir" in effect, the Subversion reader marks every
+// directory inside a branch with a placeholder when it is added and
+// removes the mark when it is deleted, so the marks travel through
+// branch analysis with the files.  Once the commits are built, the
+// marks are made right: a directory keeps its placeholder only while
+// it has nothing else in it, not even a subdirectory with files or a
+// placeholder of its own.  The strip subcommand of emptydirs takes
+// placeholders out again.
+
+// defaultEmptyDir is the name of a placeholder when none is set.
+const defaultEmptyDir = ".gitkeep"
+
+// emptyDirPolicy returns the name and content of placeholders, as set
+// or by default.
+func emptyDirPolicy() (string, []byte) {
+	if control.emptyDir == "" {
+		return defaultEmptyDir, nil
+	}
+	return control.emptyDir, control.emptyDirContent
+}
+
+// placeholderText makes the content of a placeholder from its text on
+// a command line, which gets a newline if it lacks one.
+func placeholderText(text string) []byte {
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return []byte(text)
+}
+
+// placeholderDir returns the directory a placeholder path keeps, with
+// the empty string for the top of the tree.
+func placeholderDir(name string) string {
+	if dir := path.Dir(name); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// neededPlaceholders returns the placeholders in a manifest whose
+// directories have nothing else in them.
+func neededPlaceholders(manifest *Manifest, name string, isPlaceholder func(*FileOp) bool) map[string]bool {
+	occupied := make(map[string]bool)
+	occupy := func(dir string) {
+		for !occupied[dir] {
+			occupied[dir] = true
+			if dir == "" {
+				break
+			}
+			dir = placeholderDir(dir)
+		}
+	}
+	marks := make([]string, 0)
+	for _, pathname := range manifest.pathnames() {
+		entry, _ := manifest.get(pathname)
+		if path.Base(pathname) == name && isPlaceholder(entry.(*FileOp)) {
+			marks = append(marks, pathname)
+			if dir := placeholderDir(pathname); dir != "" {
+				occupy(placeholderDir(dir))
+			}
+		} else {
+			occupy(placeholderDir(pathname))
+		}
+	}
+	needed := make(map[string]bool)
+	for _, mark := range marks {
+		if !occupied[placeholderDir(mark)] {
+			needed[mark] = true
+		}
+	}
+	return needed
+}
+
+// fillEmptyDirs makes the placeholders in commits right, given trees
+// in which every directory that exists has one: each stays only while
+// its directory has nothing else in it.  Placeholders are modifications
+// of files with a given name that refer to a given blob.  Returns the
+// number of commits changed.
+func (repo *Repository) fillEmptyDirs(name string, ref string, baton *Baton) int {
+	isPlaceholder := func(fileop *FileOp) bool {
+		return fileop.op == opM && fileop.ref == ref
+	}
+	marked := make(map[*Commit]map[string]bool)
+	needed := make(map[*Commit]map[string]bool)
+	baton.startProgress("finding empty directories", uint64(len(repo.events)))
+	repo.walkManifests(func(index int, commit *Commit, _ int, _ *Commit) {
+		manifest := commit.manifest()
+		marks := make(map[string]bool)
+		for _, pathname := range manifest.pathnames() {
+			if entry, _ := manifest.get(pathname); path.Base(pathname) == name && isPlaceholder(entry.(*FileOp)) {
+				marks[pathname] = true
+			}
+		}
+		marked[commit] = marks
+		needed[commit] = neededPlaceholders(manifest, name, isPlaceholder)
+		baton.percentProgress(uint64(index) + 1)
+	})
+	baton.endProgress()
+	changed := 0
+	for _, commit := range repo.commits(undefinedSelectionSet) {
+		var before, parentMarks map[string]bool
+		if parent, ok := commit.firstParent().(*Commit); ok {
+			before, parentMarks = needed[parent], marked[parent]
+		}
+		kept := make([]*FileOp, 0, len(commit.operations()))
+		dropped := 0
+		for _, fileop := range commit.operations() {
+			if fileop.op == deleteall {
+				before = nil
+			}
+			if path.Base(fileop.Path) == name && (isPlaceholder(fileop) || fileop.op == opD && parentMarks[fileop.Path]) {
+				if blob, ok := repo.markToEvent(fileop.ref).(*Blob); ok && fileop.op == opM {
+					blob.removeOperation(fileop)
+				}
+				dropped++
+				continue
+			}
+			kept = append(kept, fileop)
+		}
+		deletions, additions := make([]string, 0), make([]string, 0)
+		for pathname := range before {
+			if !needed[commit][pathname] {
+				deletions = append(deletions, pathname)
+			}
+		}
+		for pathname := range needed[commit] {
+			if !before[pathname] {
+				additions = append(additions, pathname)
+			}
+		}
+		if dropped == 0 && len(deletions) == 0 && len(additions) == 0 {
+			continue
+		}
+		sort.Strings(deletions)
+		sort.Strings(additions)
+		ops := make([]*FileOp, 0, len(kept)+len(deletions)+len(additions))
+		for _, pathname := range deletions {
+			ops = append(ops, newFileOp(repo).construct(opD, pathname))
+		}
+		ops = append(ops, kept...)
+		for _, pathname := range additions {
+			ops = append(ops, newFileOp(repo).construct(opM, "100644", ref, pathname))
+		}
+		commit.setOperations(ops)
+		changed++
+	}
+	return changed
+}
+
+// stripEmptyDirs removes placeholders from the selected commits: the
+// modifications of files with a given name to given content, and the
+// deletions of placeholders.  Altered commits get Q bits.  Returns the
+// number of fileops removed.
+func (repo *Repository) stripEmptyDirs(selection selectionSet, name string, content []byte) int {
+	repo.clearColor(colorQSET)
+	matches := make(map[string]bool)
+	isPlaceholder := func(fileop *FileOp) bool {
+		if fileop.op != opM || path.Base(fileop.Path) != name {
+			return false
+		}
+		if fileop.ref == "inline" {
+			return bytes.Equal(fileop.inline, content)
+		}
+		match, ok := matches[fileop.ref]
+		if !ok {
+			match = bytes.Equal(repo.modeContent(fileop), content)
+			matches[fileop.ref] = match
+		}
+		return match
+	}
+	orphans := make(map[*Blob]bool)
+	removed := 0
+	for _, commit := range repo.commits(selection) {
+		var parent *Manifest
+		if p, ok := commit.firstParent().(*Commit); ok {
+			parent = p.manifest()
+		}
+		kept := make([]*FileOp, 0, len(commit.operations()))
+		for _, fileop := range commit.operations() {
+			drop := isPlaceholder(fileop)
+			if fileop.op == opD && path.Base(fileop.Path) == name {
+				// What a deletion removes is in the parent's
+				// tree, if anywhere.
+				drop = parent == nil
+				if parent != nil {
+					entry, ok := parent.get(fileop.Path)
+					drop = !ok || isPlaceholder(entry.(*FileOp))
+				}
+			}
+			if !drop {
+				kept = append(kept, fileop)
+				continue
+			}
+			if blob, ok := repo.markToEvent(fileop.ref).(*Blob); ok && fileop.op == opM {
+				if !blob.removeOperation(fileop) {
+					orphans[blob] = true
+				}
+			}
+			removed++
+		}
+		if len(kept) < len(commit.operations()) {
+			commit.setOperations(kept)
+			commit.addColor(colorQSET)
+		}
+	}
+	repo.dropBlobs(orphans)
+	return removed
+}
+
+// end
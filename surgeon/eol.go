@@ -0,0 +1,251 @@
+/*
+ * Binary/text classification of blobs and line-ending audit
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	difflib "github.com/ianbruene/go-difflib/difflib"
+)
+
+// Histories that passed through Windows checkouts, CVS servers with
+// text-mode translation, or Subversion eol-style properties often have
+// files whose line endings change from one revision to the next, and
+// sometimes within a single revision.  Once converted, every such
+// change shows as a whole-file diff.  This pass sorts the content of
+// the files a commit touches into binary and text, the way git does,
+// notes text that isn't UTF-8, and reports the files with a mixture of
+// CRLF and bare LF endings.  It can then rewrite text content to one
+// convention, leaving binary content alone.
+
+// An eolStyle is the line-ending convention of a piece of text.
+type eolStyle int
+
+const (
+	eolNone  eolStyle = iota // no line endings at all
+	eolLF                    // bare LF only
+	eolCRLF                  // CR-LF only
+	eolMixed                 // both
+)
+
+func (s eolStyle) String() string {
+	return [...]string{"none", "lf", "crlf", "mixed"}[s]
+}
+
+// A contentClass is the classification of a blob's content.
+type contentClass struct {
+	binary bool     // a NUL near the start, as git judges it
+	utf8   bool     // text that is valid UTF-8
+	eol    eolStyle // line endings of text; eolNone for binary
+}
+
+// classifyContent sorts content into binary or text and, for text,
+// says whether it is UTF-8 and what line endings it uses.
+func classifyContent(content []byte) contentClass {
+	if looksBinary(content) {
+		return contentClass{binary: true}
+	}
+	class := contentClass{utf8: utf8.Valid(content)}
+	crlf := bytes.Count(content, []byte("\r\n"))
+	lf := bytes.Count(content, []byte("\n"))
+	switch {
+	case lf == 0:
+		class.eol = eolNone
+	case crlf == 0:
+		class.eol = eolLF
+	case crlf == lf:
+		class.eol = eolCRLF
+	default:
+		class.eol = eolMixed
+	}
+	return class
+}
+
+// normalizeEOL rewrites the line endings of text content to sep, which
+// is either "\n" or "\r\n".  Binary content and lone CRs are left alone.
+func normalizeEOL(content []byte, sep string) []byte {
+	if looksBinary(content) {
+		return content
+	}
+	normalized := bytes.Replace(content, []byte("\r\n"), []byte("\n"), -1)
+	if sep == "\r\n" {
+		normalized = bytes.Replace(normalized, []byte("\n"), []byte("\r\n"), -1)
+	}
+	return normalized
+}
+
+// contentDiff writes a unified diff between two versions of a file's
+// content.  Binary content isn't diffed.  When the line endings differ
+// the change of convention is reported on its own line and the diff
+// is taken with both versions normalized to LF, so a file converted
+// between CRLF and LF doesn't show as rewritten line by line.
+func contentDiff(w io.Writer, path string, fromText []byte, toText []byte, fromLabel string, toLabel string) {
+	if bytes.Equal(fromText, toText) {
+		return
+	}
+	fromClass, toClass := classifyContent(fromText), classifyContent(toText)
+	if fromClass.binary || toClass.binary {
+		fmt.Fprintf(w, "%s: binary content differs\n", path)
+		return
+	}
+	if fromClass.eol != toClass.eol && fromClass.eol != eolNone && toClass.eol != eolNone {
+		fmt.Fprintf(w, "%s: line endings changed from %s to %s\n", path, fromClass.eol, toClass.eol)
+		fromText, toText = normalizeEOL(fromText, "\n"), normalizeEOL(toText, "\n")
+		if bytes.Equal(fromText, toText) {
+			return
+		}
+	}
+	diff := difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(fromText)),
+		B:        difflib.SplitLines(string(toText)),
+		FromFile: path + " (" + fromLabel + ")",
+		ToFile:   path + " (" + toLabel + ")",
+		Context:  3,
+	}
+	text, _ := difflib.GetUnifiedDiffString(diff)
+	fmt.Fprint(w, text)
+}
+
+// eolFileops calls a hook on each file modification of the selected
+// commits whose path matches pathRE, with its content.
+func (repo *Repository) eolFileops(selection selectionSet, pathRE *regexp.Regexp,
+	hook func(commit *Commit, fileop *FileOp, content []byte)) {
+	for _, commit := range repo.commits(selection) {
+		for _, fileop := range commit.operations() {
+			if fileop.op != opM || !pathRE.MatchString(fileop.Path) {
+				continue
+			}
+			if fileop.ref == "inline" {
+				hook(commit, fileop, fileop.inline)
+			} else if blob, ok := repo.markToEvent(fileop.ref).(*Blob); ok {
+				hook(commit, fileop, blob.getContent())
+			}
+		}
+	}
+}
+
+// eolAudit reports, for each selected commit, the files it modifies
+// that have mixed line endings or are text that isn't UTF-8, then a
+// summary of the classes of all content seen.  Commits with mixed
+// files get Q bits.  Returns the number of such commits.
+func (repo *Repository) eolAudit(w io.Writer, selection selectionSet, pathRE *regexp.Regexp) int {
+	repo.clearColor(colorQSET)
+	var binary, text, nonUTF8, mixedCommits int
+	styles := make(map[eolStyle]int)
+	mixedPaths := make(map[string]bool)
+	flagged := make(map[*Commit][]string)
+	order := make([]*Commit, 0)
+	repo.eolFileops(selection, pathRE, func(commit *Commit, fileop *FileOp, content []byte) {
+		class := classifyContent(content)
+		if class.binary {
+			binary++
+			return
+		}
+		text++
+		styles[class.eol]++
+		notes := make([]string, 0, 2)
+		if class.eol == eolMixed {
+			notes = append(notes, "mixed")
+			mixedPaths[fileop.Path] = true
+			if !commit.hasColor(colorQSET) {
+				commit.addColor(colorQSET)
+				mixedCommits++
+			}
+		}
+		if !class.utf8 {
+			notes = append(notes, "not UTF-8")
+			nonUTF8++
+		}
+		if len(notes) == 0 {
+			return
+		}
+		if _, ok := flagged[commit]; !ok {
+			order = append(order, commit)
+		}
+		flagged[commit] = append(flagged[commit], fmt.Sprintf("%s (%s)", fileop.Path, strings.Join(notes, ", ")))
+	})
+	for _, commit := range order {
+		fmt.Fprintf(w, "%s:\n", commit.idMe())
+		for _, line := range flagged[commit] {
+			fmt.Fprintf(w, "\t%s\n", line)
+		}
+	}
+	paths := make([]string, 0, len(mixedPaths))
+	for path := range mixedPaths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	fmt.Fprintf(w, "%d binary, %d text (%d lf, %d crlf, %d mixed, %d none; %d not UTF-8)\n",
+		binary, text, styles[eolLF], styles[eolCRLF], styles[eolMixed], styles[eolNone], nonUTF8)
+	fmt.Fprintf(w, "%d commits and %d paths with mixed line endings\n", mixedCommits, len(paths))
+	for _, path := range paths {
+		fmt.Fprintf(w, "\t%s\n", path)
+	}
+	return mixedCommits
+}
+
+// eolNormalize rewrites the text content of files modified by the
+// selected commits to the line endings sep.  Like keyword collapse, it
+// works on the blobs themselves, so a blob is rewritten everywhere it
+// is used.  If canonicalize is set the comments of the selected commits
+// are canonicalized as well.  Altered blobs and commits get Q bits.
+// Returns the count of blobs and inline contents altered.
+func (repo *Repository) eolNormalize(selection selectionSet, pathRE *regexp.Regexp,
+	sep string, canonicalize bool, baton *Baton) int {
+	altered := 0
+	colored := make([]Event, 0)
+	blobs := newSelectionSet()
+	for _, commit := range repo.commits(selection) {
+		for _, fileop := range commit.operations() {
+			if fileop.op != opM || !pathRE.MatchString(fileop.Path) {
+				continue
+			}
+			if fileop.ref != "inline" {
+				if blob, ok := repo.markToEvent(fileop.ref).(*Blob); ok {
+					blobs.Add(repo.eventToIndex(blob))
+				}
+				continue
+			}
+			modified := normalizeEOL(fileop.inline, sep)
+			if !bytes.Equal(modified, fileop.inline) {
+				fileop.inline = modified
+				colored = append(colored, commit)
+				altered++
+			}
+		}
+	}
+	// transformBlobs clears Q bits, so it has to run before we set any
+	if blobs.Size() > 0 {
+		altered += repo.transformBlobs(blobs, func(content []byte) []byte {
+			return normalizeEOL(content, sep)
+		}, baton)
+	} else {
+		repo.clearColor(colorQSET)
+	}
+	if canonicalize {
+		for _, commit := range repo.commits(selection) {
+			if comment := canonicalizeComment(commit.Comment); comment != commit.Comment {
+				commit.Comment = comment
+				commit.hash.invalidate()
+				colored = append(colored, commit)
+			}
+		}
+	}
+	for _, event := range colored {
+		event.addColor(colorQSET)
+	}
+	return altered
+}
+
+// end
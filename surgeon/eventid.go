@@ -0,0 +1,99 @@
+/*
+ * Stable event identifiers
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+)
+
+// Event numbers move whenever events are inserted, deleted or
+// resorted, and marks change under renumbering, so neither is any use
+// to a tool outside reposurgeon that wants to refer to an event before
+// and after surgery.  Each event is given an identifier in UUID form
+// when it is read, which it keeps for as long as it exists, through
+// moves between repositories, session saves and undo.
+//
+// The identifiers are name-based (RFC 4122 version 5) UUIDs made from
+// the repository's name and the hashes of its root commits when the
+// first was made, and a serial number, not random ones.  A lift script
+// rerun on the same history gives the events it reads the same
+// identifiers every time, so they can be written into the script
+// itself, while repositories sharing roots, as the parts of a split
+// or the result of a unite do, still get identifiers of their own.  Events made by surgery get theirs when identifiers
+// are next looked at, in event order.
+
+// eventSeed returns what the stable event identifiers of a repository
+// are made from, fixing it if none has been yet.
+func (repo *Repository) eventSeed() string {
+	if repo.eventseed == "" {
+		// The hashes are computed afresh rather than with gitHash,
+		// which would store them to be written as original-oids,
+		// and from manifests that aren't kept.
+		var seed strings.Builder
+		seed.WriteString(repo.name)
+		for _, commit := range repo.commits(undefinedSelectionSet) {
+			if !commit.hasParents() {
+				pm := newManifest().snapshot()
+				commit.applyFileOps(pm, false, false)
+				tree := pmToManifest(pm).freshHash()
+				seed.WriteString("\x00" + commit.hashWithParents(tree, nil).hexify())
+			}
+		}
+		repo.eventseed = seed.String()
+	}
+	return repo.eventseed
+}
+
+// newEventID returns the next stable event identifier of a repository.
+func (repo *Repository) newEventID() string {
+	repo.eventseq++
+	sum := sha1.Sum([]byte(fmt.Sprintf("reposurgeon\x00%s\x00%d", repo.eventSeed(), repo.eventseq)))
+	sum[6] = sum[6]&0x0f | 0x50 // Version 5
+	sum[8] = sum[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// identify gives an event a stable identifier if it doesn't have one.
+func (repo *Repository) identify(event Event) {
+	if event.getUUID() == "" {
+		event.setUUID(repo.newEventID())
+	}
+}
+
+// identifyEvents gives every event without a stable identifier one.
+func (repo *Repository) identifyEvents() {
+	for _, event := range repo.events {
+		repo.identify(event)
+	}
+}
+
+// eventByID returns the event with a stable identifier, or nil if
+// there is none.
+func (repo *Repository) eventByID(uuid string) Event {
+	if uuid == "" {
+		return nil
+	}
+	if matches, ok := repo.lookupName(uuid); ok && matches.Size() == 1 {
+		if event := repo.events[matches.Fetch(0)]; event.getUUID() == uuid {
+			return event
+		}
+	}
+	return nil
+}
+
+// setUUIDHeader puts the stable identifier of an event, if it has one,
+// in a message block.
+func (msg *MessageBlock) setUUIDHeader(event Event) {
+	if uuid := event.getUUID(); uuid != "" {
+		msg.setHeader("Event-UUID", uuid)
+	}
+}
+
+// end
@@ -0,0 +1,599 @@
+/*
+ * Event expressions: a small language for predicates and values over events
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Selection sets pick events by number, mark, name, text search, path
+// and a few metrics, and setfield gives a field one value everywhere.
+// Anything subtler has meant a change to the Go.  Event expressions
+// fill the gap: a little language over the fields of commits, tags,
+// resets and blobs, compiled once to closures and evaluated through
+// walkEvents, so it runs on every core.  Written in braces, an
+// expression is a selection atom matching the events for which it is
+// true; "map" sets a field of each selected event to the value of one,
+// and "eval" shows their values.
+//
+// Values are strings, integers or booleans.  Two integers compare
+// numerically and anything else by string form; + adds two integers
+// and concatenates anything else.  A string is true if it is not
+// empty, an integer if it is not zero.  A field an event doesn't have
+// is the empty string, or zero if it is a count.
+
+// An exprValue is a string, an int64 or a bool.
+type exprValue interface{}
+
+// An exprNode is a compiled expression.
+type exprNode func(Event) exprValue
+
+func exprString(v exprValue) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+func exprTruth(v exprValue) bool {
+	switch v := v.(type) {
+	case string:
+		return v != ""
+	case int64:
+		return v != 0
+	case bool:
+		return v
+	}
+	return false
+}
+
+func exprCompare(a exprValue, b exprValue) int {
+	if x, ok := a.(int64); ok {
+		if y, ok := b.(int64); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(exprString(a), exprString(b))
+}
+
+// exprAuthor is the attribution the author fields come from: a commit's
+// first author, or its committer if it has none, or a tag's tagger.
+func exprAuthor(e Event) *Attribution {
+	switch e := e.(type) {
+	case *Commit:
+		if len(e.authors) > 0 {
+			return &e.authors[0]
+		}
+		return &e.committer
+	case *Tag:
+		return &e.tagger
+	}
+	return nil
+}
+
+// exprCommitter is the attribution the committer fields come from.
+func exprCommitter(e Event) *Attribution {
+	switch e := e.(type) {
+	case *Commit:
+		return &e.committer
+	case *Tag:
+		return &e.tagger
+	}
+	return nil
+}
+
+func exprComment(e Event) string {
+	switch e := e.(type) {
+	case *Commit:
+		return e.Comment
+	case *Tag:
+		return e.Comment
+	}
+	return ""
+}
+
+// attributionFields makes the name, email, date and time fields of an
+// attribution.
+func attributionFields(prefix string, datename string, timename string,
+	attribution func(Event) *Attribution, fields map[string]func(Event) exprValue) {
+	fields[prefix] = func(e Event) exprValue {
+		if a := attribution(e); a != nil {
+			return a.fullname
+		}
+		return ""
+	}
+	fields[prefix+"email"] = func(e Event) exprValue {
+		if a := attribution(e); a != nil {
+			return a.email
+		}
+		return ""
+	}
+	fields[datename] = func(e Event) exprValue {
+		if a := attribution(e); a != nil {
+			return a.date.rfc3339()
+		}
+		return ""
+	}
+	fields[timename] = func(e Event) exprValue {
+		if a := attribution(e); a != nil {
+			return a.date.timestamp.Unix()
+		}
+		return int64(0)
+	}
+}
+
+// exprFields are the fields an expression can read.
+var exprFields = func() map[string]func(Event) exprValue {
+	fields := map[string]func(Event) exprValue{
+		"type": func(e Event) exprValue {
+			switch e.(type) {
+			case *Commit:
+				return "commit"
+			case *Tag:
+				return "tag"
+			case *Reset:
+				return "reset"
+			case *Blob:
+				return "blob"
+			case *Passthrough:
+				return "passthrough"
+			case *Callout:
+				return "callout"
+			}
+			return ""
+		},
+		"mark": func(e Event) exprValue { return e.getMark() },
+		"branch": func(e Event) exprValue {
+			switch e := e.(type) {
+			case *Commit:
+				return e.Branch
+			case *Reset:
+				return e.ref
+			}
+			return ""
+		},
+		"tagname": func(e Event) exprValue {
+			if t, ok := e.(*Tag); ok {
+				return t.tagname
+			}
+			return ""
+		},
+		"target": func(e Event) exprValue {
+			switch e := e.(type) {
+			case *Tag:
+				return e.committish
+			case *Reset:
+				return e.committish
+			}
+			return ""
+		},
+		"comment": func(e Event) exprValue { return exprComment(e) },
+		"summary": func(e Event) exprValue {
+			topline, _ := splitRuneFirst(exprComment(e), '\n')
+			return topline
+		},
+		"legacy": func(e Event) exprValue {
+			switch e := e.(type) {
+			case *Commit:
+				return e.legacyID
+			case *Tag:
+				return e.legacyID
+			case *Reset:
+				return e.legacyID
+			}
+			return ""
+		},
+		"children": func(e Event) exprValue {
+			if c, ok := e.(*Commit); ok {
+				return int64(c.childCount())
+			}
+			return int64(0)
+		},
+		"size": func(e Event) exprValue {
+			if b, ok := e.(*Blob); ok {
+				return b.size
+			}
+			return int64(0)
+		},
+		"mimetype": func(e Event) exprValue {
+			if b, ok := e.(*Blob); ok {
+				return b.contentType()
+			}
+			return ""
+		},
+	}
+	attributionFields("author", "authordate", "authortime", exprAuthor, fields)
+	attributionFields("committer", "date", "time", exprCommitter, fields)
+	for name, measure := range selMetrics {
+		measure := measure
+		fields[name] = func(e Event) exprValue {
+			if c, ok := e.(*Commit); ok {
+				return measure(c)
+			}
+			return int64(0)
+		}
+	}
+	return fields
+}()
+
+// exprFunctions are the functions of one argument.  sub, which takes a
+// regular expression, is parsed specially.
+var exprFunctions = map[string]func(exprValue) exprValue{
+	"lower": func(v exprValue) exprValue { return strings.ToLower(exprString(v)) },
+	"upper": func(v exprValue) exprValue { return strings.ToUpper(exprString(v)) },
+	"trim":  func(v exprValue) exprValue { return strings.TrimSpace(exprString(v)) },
+	"len":   func(v exprValue) exprValue { return int64(utf8.RuneCountInString(exprString(v))) },
+}
+
+// exprSetters are the fields "map" can set, each taking an event and a
+// value and reporting whether the event changed.
+var exprSetters = map[string]func(Event, string) bool{
+	"comment": func(e Event, v string) bool {
+		switch e := e.(type) {
+		case *Commit:
+			changed := e.Comment != v
+			e.Comment = v
+			return changed
+		case *Tag:
+			changed := e.Comment != v
+			e.Comment = v
+			return changed
+		}
+		return false
+	},
+	"branch": func(e Event, v string) bool {
+		switch e := e.(type) {
+		case *Commit:
+			return e.setBranch(v)
+		case *Reset:
+			changed := e.ref != v
+			e.ref = v
+			return changed
+		}
+		return false
+	},
+	"tagname": func(e Event, v string) bool {
+		if t, ok := e.(*Tag); ok {
+			changed := t.tagname != v
+			t.tagname = v
+			return changed
+		}
+		return false
+	},
+	"legacy": func(e Event, v string) bool {
+		switch e := e.(type) {
+		case *Commit:
+			changed := e.legacyID != v
+			e.legacyID = v
+			return changed
+		case *Tag:
+			changed := e.legacyID != v
+			e.legacyID = v
+			return changed
+		}
+		return false
+	},
+	"author": func(e Event, v string) bool {
+		return setAttributionField(exprAuthor(e), v, false)
+	},
+	"authoremail": func(e Event, v string) bool {
+		return setAttributionField(exprAuthor(e), v, true)
+	},
+	"committer": func(e Event, v string) bool {
+		return setAttributionField(exprCommitter(e), v, false)
+	},
+	"committeremail": func(e Event, v string) bool {
+		return setAttributionField(exprCommitter(e), v, true)
+	},
+}
+
+func setAttributionField(a *Attribution, v string, email bool) bool {
+	if a == nil {
+		return false
+	}
+	field := &a.fullname
+	if email {
+		field = &a.email
+	}
+	changed := *field != v
+	*field = v
+	return changed
+}
+
+// exprParser compiles an expression from the front of its text.
+// Errors are thrown as command exceptions, as in the selection parser.
+type exprParser struct {
+	text string
+}
+
+// compileExpr compiles the expression at the start of text and returns
+// it with the text that follows it.
+func compileExpr(text string) (exprNode, string) {
+	p := exprParser{text: text}
+	node := p.parseOr()
+	p.skipSpace()
+	return node, p.text
+}
+
+func (p *exprParser) skipSpace() {
+	p.text = strings.TrimLeft(p.text, " \t")
+}
+
+func (p *exprParser) accept(token string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.text, token) {
+		p.text = p.text[len(token):]
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(token string) {
+	if !p.accept(token) {
+		panic(throw("command", "expected %q in expression at %q", token, p.text))
+	}
+}
+
+func (p *exprParser) parseOr() exprNode {
+	left := p.parseAnd()
+	for p.accept("||") {
+		l, r := left, p.parseAnd()
+		left = func(e Event) exprValue { return exprTruth(l(e)) || exprTruth(r(e)) }
+	}
+	return left
+}
+
+func (p *exprParser) parseAnd() exprNode {
+	left := p.parseNot()
+	for p.accept("&&") {
+		l, r := left, p.parseNot()
+		left = func(e Event) exprValue { return exprTruth(l(e)) && exprTruth(r(e)) }
+	}
+	return left
+}
+
+func (p *exprParser) parseNot() exprNode {
+	p.skipSpace()
+	if strings.HasPrefix(p.text, "!") && !strings.HasPrefix(p.text, "!=") && !strings.HasPrefix(p.text, "!~") {
+		p.text = p.text[1:]
+		operand := p.parseNot()
+		return func(e Event) exprValue { return !exprTruth(operand(e)) }
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() exprNode {
+	left := p.parseSum()
+	for _, op := range []string{"=~", "!~"} {
+		if p.accept(op) {
+			pattern := p.stringLiteral()
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				panic(throw("command", "invalid regular expression %q in expression: %v", pattern, err))
+			}
+			want := op == "=~"
+			return func(e Event) exprValue { return re.MatchString(exprString(left(e))) == want }
+		}
+	}
+	tests := []struct {
+		op   string
+		test func(int) bool
+	}{
+		{"==", func(c int) bool { return c == 0 }},
+		{"!=", func(c int) bool { return c != 0 }},
+		{"<=", func(c int) bool { return c <= 0 }},
+		{">=", func(c int) bool { return c >= 0 }},
+		{"<", func(c int) bool { return c < 0 }},
+		{">", func(c int) bool { return c > 0 }},
+		{"=", func(c int) bool { return c == 0 }},
+	}
+	for _, t := range tests {
+		if p.accept(t.op) {
+			test, right := t.test, p.parseSum()
+			return func(e Event) exprValue { return test(exprCompare(left(e), right(e))) }
+		}
+	}
+	return left
+}
+
+func (p *exprParser) parseSum() exprNode {
+	left := p.parsePrimary()
+	for p.accept("+") {
+		l, r := left, p.parsePrimary()
+		left = func(e Event) exprValue {
+			a, b := l(e), r(e)
+			if x, ok := a.(int64); ok {
+				if y, ok := b.(int64); ok {
+					return x + y
+				}
+			}
+			return exprString(a) + exprString(b)
+		}
+	}
+	return left
+}
+
+func (p *exprParser) parsePrimary() exprNode {
+	p.skipSpace()
+	if p.text == "" {
+		panic(throw("command", "expression ends too soon"))
+	}
+	r, _ := utf8.DecodeRuneInString(p.text)
+	switch {
+	case r == '(':
+		p.text = p.text[1:]
+		node := p.parseOr()
+		p.expect(")")
+		return node
+	case r == '"':
+		s := p.stringLiteral()
+		return func(Event) exprValue { return s }
+	case unicode.IsDigit(r):
+		end := strings.IndexFunc(p.text, func(r rune) bool { return !unicode.IsDigit(r) })
+		if end == -1 {
+			end = len(p.text)
+		}
+		n, err := strconv.ParseInt(p.text[:end], 10, 64)
+		if err != nil {
+			panic(throw("command", "bad number in expression: %v", err))
+		}
+		p.text = p.text[end:]
+		return func(Event) exprValue { return n }
+	case unicode.IsLetter(r):
+		end := strings.IndexFunc(p.text, func(r rune) bool { return !unicode.IsLetter(r) })
+		if end == -1 {
+			end = len(p.text)
+		}
+		name := p.text[:end]
+		p.text = p.text[end:]
+		if strings.HasPrefix(p.text, "(") {
+			p.text = p.text[1:]
+			return p.parseCall(name)
+		}
+		if name == "true" || name == "false" {
+			b := name == "true"
+			return func(Event) exprValue { return b }
+		}
+		field, ok := exprFields[name]
+		if !ok {
+			panic(throw("command", "no such field as %q in expression", name))
+		}
+		return field
+	}
+	panic(throw("command", "unexpected %q in expression", string(r)))
+}
+
+// parseCall parses the arguments of a function call after the "(".
+func (p *exprParser) parseCall(name string) exprNode {
+	if name == "sub" {
+		subject := p.parseOr()
+		p.expect(",")
+		pattern := p.stringLiteral()
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			panic(throw("command", "invalid regular expression %q in expression: %v", pattern, err))
+		}
+		p.expect(",")
+		replacement := p.parseOr()
+		p.expect(")")
+		return func(e Event) exprValue {
+			return GoReplacer(re, exprString(subject(e)), exprString(replacement(e)))
+		}
+	}
+	function, ok := exprFunctions[name]
+	if !ok {
+		panic(throw("command", "no such function as %q in expression", name))
+	}
+	argument := p.parseOr()
+	p.expect(")")
+	return func(e Event) exprValue { return function(argument(e)) }
+}
+
+// stringLiteral parses a double-quoted string with Go escapes.
+func (p *exprParser) stringLiteral() string {
+	p.skipSpace()
+	if !strings.HasPrefix(p.text, `"`) {
+		panic(throw("command", "expected a string in expression at %q", p.text))
+	}
+	for i := 1; i < len(p.text); i++ {
+		switch p.text[i] {
+		case '\\':
+			i++
+		case '"':
+			s, err := strconv.Unquote(p.text[:i+1])
+			if err != nil {
+				panic(throw("command", "bad string %s in expression", p.text[:i+1]))
+			}
+			p.text = p.text[i+1:]
+			return s
+		}
+	}
+	panic(throw("command", "unterminated string in expression"))
+}
+
+// compileBracedExpr compiles an expression in braces at the start of
+// text and returns it with the text that follows.
+func compileBracedExpr(text string) (exprNode, string) {
+	text = strings.TrimLeft(text, " \t")
+	if !strings.HasPrefix(text, "{") {
+		panic(throw("command", "expected an expression in braces"))
+	}
+	node, rest := compileExpr(text[1:])
+	if !strings.HasPrefix(rest, "}") {
+		panic(throw("command", "expression not terminated by } at %q", rest))
+	}
+	return node, rest[1:]
+}
+
+// exprSelect returns the events of a selection for which a predicate is
+// true.
+func (repo *Repository) exprSelect(selection selectionSet, predicate exprNode) selectionSet {
+	hits := make([]bool, selection.Size())
+	repo.walkEvents(selection, func(i int, event Event) bool {
+		hits[i] = exprTruth(predicate(event))
+		return true
+	})
+	matched := newSelectionSet()
+	for it := selection.Iterator(); it.Next(); {
+		if hits[it.Index()] {
+			matched.Add(it.Value())
+		}
+	}
+	return matched
+}
+
+// exprValues evaluates an expression on each event of a selection, in
+// selection order.
+func (repo *Repository) exprValues(selection selectionSet, node exprNode) []exprValue {
+	values := make([]exprValue, selection.Size())
+	repo.walkEvents(selection, func(i int, event Event) bool {
+		values[i] = node(event)
+		return true
+	})
+	return values
+}
+
+// exprMap sets a field of each selected event that has it to the value
+// of an expression.  Values are all computed before any is assigned,
+// so an expression sees the events as they were.  Changed events get
+// Q bits.  Returns the number of events changed.
+func (repo *Repository) exprMap(selection selectionSet, field string, node exprNode) int {
+	setter := exprSetters[field]
+	values := repo.exprValues(selection, node)
+	repo.clearColor(colorQSET)
+	changed := 0
+	for it := selection.Iterator(); it.Next(); {
+		event := repo.events[it.Value()]
+		if setter(event, exprString(values[it.Index()])) {
+			if commit, ok := event.(*Commit); ok {
+				commit.hash.invalidate()
+			}
+			event.addColor(colorQSET)
+			changed++
+		}
+	}
+	repo.invalidateNamecache()
+	return changed
+}
+
+// end
@@ -43,6 +43,7 @@ import (
 	"bufio"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
@@ -327,7 +328,7 @@ func (ge *GitExtractor) gatherRevisionIDs(rs *RepoStreamer) error {
 		return nil
 	}
 	return lineByLine(rs,
-		"git log --all --date-order --reverse --format='%H %P'",
+		"GIT_NO_REPLACE_OBJECTS=1 GIT_GRAFT_FILE=.git/info/no-grafts git log --exclude='refs/replace/*' --all --date-order --reverse --format='%H %P'",
 		"git's gatherRevisionIDs: %v",
 		hook)
 }
@@ -342,7 +343,7 @@ func (ge *GitExtractor) gatherCommitData(rs *RepoStreamer) error {
 		return nil
 	}
 	return lineByLine(rs,
-		"git log --all --reverse --date=raw --format='%H|%cn <%ce> %cd|%an <%ae> %ad'",
+		"GIT_NO_REPLACE_OBJECTS=1 GIT_GRAFT_FILE=.git/info/no-grafts git log --exclude='refs/replace/*' --all --reverse --date=raw --format='%H|%cn <%ce> %cd|%an <%ae> %ad'",
 		"git's gatherCommitData: %v",
 		hook)
 }
@@ -354,6 +355,10 @@ func (ge *GitExtractor) gatherAllReferences(rs *RepoStreamer) error {
 			return err
 		}
 		if info.IsDir() {
+			// Replace refs are read as overrides, not history
+			if filepath.ToSlash(pathname) == ".git/refs/replace" {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 		data, err := ioutil.ReadFile(pathname)
@@ -454,7 +459,7 @@ func (ge *GitExtractor) colorBranches(rs *RepoStreamer) error {
 		return err1
 	}
 	defer markfile.Close()
-	data, err3 := captureFromProcess("git fast-export --all --export-marks="+file.Name(), control.baton)
+	data, err3 := captureFromProcess("git --no-replace-objects fast-export --exclude=refs/replace/* --all --export-marks="+file.Name(), control.baton)
 	if err3 != nil {
 		panic(throw("extractor", "Couldn't spawn git-fast-export: %v", err3))
 	}
@@ -1080,6 +1085,1257 @@ func (he HgExtractor) getComment(rev string) string {
 	return data
 }
 
+// BzrExtractor is a repository extractor for the Bazaar and Breezy
+// version-control systems, which share a CLI.
+type BzrExtractor struct {
+	command   string                  // "bzr" or "brz"
+	revisions map[string]*bzrRevision // revision-id -> log record
+	tip       string                  // revision-id of the branch tip
+	exportdir string                  // scratch space for tree exports
+	exported  string                  // tree of the last manifest call
+}
+
+// bzrRevision is one record of a "bzr log --long --show-ids" listing.
+type bzrRevision struct {
+	revid     string
+	parents   []string
+	committer string
+	authors   []string
+	timestamp string
+	message   string
+	depth     int // merge depth, 0 for the mainline
+}
+
+func newBzrExtractor(command string) *BzrExtractor {
+	// The bzr extractor reads a single branch, the one in the
+	// current directory; its history, merged revisions included,
+	// all goes to refs/heads/master. Tags become lightweight tags.
+	// Revision properties and ghost parents are not recovered.
+	//
+	// Trees are recovered by exporting each revision into scratch
+	// space, so this does not need the fast-export plugin.
+	be := new(BzrExtractor)
+	be.command = command
+	be.revisions = make(map[string]*bzrRevision)
+	return be
+}
+
+// bzrSeparatorRE matches the line of dashes that opens each log record
+var bzrSeparatorRE = regexp.MustCompile(`^((?:    )*)-{60}$`)
+
+// parseBzrLog parses the output of "bzr log -n0 --long --show-ids",
+// returning the revisions in log order, newest first.
+func parseBzrLog(r io.Reader) ([]*bzrRevision, error) {
+	revisions := make([]*bzrRevision, 0)
+	var current *bzrRevision
+	var indent string
+	inMessage := false
+	finish := func() {
+		if current != nil {
+			current.message = strings.TrimRight(current.message, "\n") + "\n"
+			revisions = append(revisions, current)
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := bzrSeparatorRE.FindStringSubmatch(line); m != nil {
+			finish()
+			indent = m[1]
+			current = &bzrRevision{depth: len(indent) / 4}
+			inMessage = false
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		line = strings.TrimPrefix(line, indent)
+		if inMessage {
+			current.message += strings.TrimPrefix(line, "  ") + "\n"
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon == -1 {
+			continue
+		}
+		key, value := line[:colon], strings.TrimSpace(line[colon+1:])
+		switch key {
+		case "revision-id":
+			current.revid = value
+		case "parent":
+			current.parents = append(current.parents, value)
+		case "committer":
+			current.committer = value
+		case "author":
+			for _, author := range strings.SplitAfter(value, ">, ") {
+				current.authors = append(current.authors, strings.TrimSuffix(author, ", "))
+			}
+		case "timestamp":
+			date, err := time.Parse("Mon 2006-01-02 15:04:05 -0700", value)
+			if err != nil {
+				return nil, fmt.Errorf("bad timestamp in log of %s: %v", current.revid, err)
+			}
+			current.timestamp = date.Format(time.RFC3339)
+		case "message":
+			inMessage = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	finish()
+	return revisions, nil
+}
+
+func (be *BzrExtractor) preExtract() {
+	dir, err := ioutil.TempDir("", "rsbzr")
+	if err != nil {
+		panic(throw("extractor", "Couldn't create scratch directory: %v", err))
+	}
+	be.exportdir = dir
+}
+
+func (be *BzrExtractor) keepHouse() error {
+	return nil
+}
+
+// gatherRevisionIDs gets the topologically-ordered list of revisions and parents.
+func (be *BzrExtractor) gatherRevisionIDs(rs *RepoStreamer) error {
+	stdout, cmd, err := readFromProcess(be.command + " log -n0 --long --show-ids")
+	if err != nil {
+		return err
+	}
+	revisions, err := parseBzrLog(stdout)
+	stdout.Close()
+	if cmd != nil {
+		cmd.Wait()
+	}
+	if err != nil {
+		return fmt.Errorf("%s's gatherRevisionIDs: %v", be.command, err)
+	}
+	for _, revision := range revisions {
+		be.revisions[revision.revid] = revision
+		if be.tip == "" && revision.depth == 0 {
+			be.tip = revision.revid
+		}
+	}
+	// The log runs newest first, with merged revisions listed
+	// after the merge, so reversing it puts parents first.
+	for i := len(revisions) - 1; i >= 0; i-- {
+		revid := revisions[i].revid
+		rs.revlist = append(rs.revlist, revid)
+		// Ghosts are parents whose revisions the branch doesn't have
+		parents := make([]string, 0)
+		for _, parent := range revisions[i].parents {
+			if _, ok := be.revisions[parent]; ok {
+				parents = append(parents, parent)
+			}
+		}
+		rs.parents[revid] = parents
+	}
+	return nil
+}
+
+// gatherCommitData gets all other per-commit data except branch IDs
+func (be *BzrExtractor) gatherCommitData(rs *RepoStreamer) error {
+	for revid, revision := range be.revisions {
+		rs.meta[revid] = new(CommitMeta)
+		rs.meta[revid].ci = revision.committer + " " + revision.timestamp
+		// Only the first of several authors survives; the
+		// RepoStreamer carries one author per commit.
+		if len(revision.authors) > 0 {
+			rs.meta[revid].ai = revision.authors[0] + " " + revision.timestamp
+		} else {
+			rs.meta[revid].ai = rs.meta[revid].ci
+		}
+	}
+	return nil
+}
+
+// gatherAllReferences finds the branch head and tags
+func (be *BzrExtractor) gatherAllReferences(rs *RepoStreamer) error {
+	if be.tip != "" {
+		rs.refs.set("refs/heads/master", be.tip)
+	}
+	hook := func(line string, rs *RepoStreamer) error {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil
+		}
+		// A tag pointing at a revision we don't have shows as "?"
+		revid := fields[len(fields)-1]
+		if _, ok := be.revisions[revid]; ok {
+			rs.refs.set("refs/tags/"+strings.Join(fields[:len(fields)-1], " "), revid)
+		}
+		return nil
+	}
+	return lineByLine(rs,
+		be.command+" tags --show-ids",
+		be.command+"'s gatherAllReferences: %v",
+		hook)
+}
+
+// colorBranches assigns branches to commits in an extracted repository
+func (be *BzrExtractor) colorBranches(rs *RepoStreamer) error {
+	for _, revid := range rs.revlist {
+		rs.meta[revid].branch = "refs/heads/master"
+	}
+	return nil
+}
+
+func (be *BzrExtractor) postExtract(_repo *Repository) {
+	if be.exportdir != "" {
+		os.RemoveAll(be.exportdir)
+		be.exportdir = ""
+	}
+}
+
+// isClean returns true if repo has no unsaved changes
+func (be *BzrExtractor) isClean() bool {
+	data, err := captureFromProcess(be.command+" status --short --versioned", control.baton)
+	if err != nil {
+		panic(throw("extractor", "Couldn't spawn %s status: %v", be.command, err))
+	}
+	return data == ""
+}
+
+// manifest lists all files present as of a specified revision.
+// It exports the revision's tree, which catFile then copies from.
+func (be *BzrExtractor) manifest(rev string) []manifestEntry {
+	if be.exported != "" {
+		os.RemoveAll(be.exported)
+	}
+	be.exported = filepath.Join(be.exportdir, "tree")
+	data, err := captureFromProcess(shellquote.Join(be.command, "export", "--format=dir",
+		"-r", "revid:"+rev, be.exported), control.baton)
+	if err != nil {
+		if logEnable(logSHOUT) {
+			shout("%s", strings.TrimSpace(data))
+		}
+		panic(throw("extractor", "Couldn't export %s: %v", rev, err))
+	}
+	var manifest = make([]manifestEntry, 0)
+	err = filepath.Walk(be.exported, func(pathname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		hash := sha1.New()
+		perms := 0644
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(pathname)
+			if err != nil {
+				return err
+			}
+			hash.Write([]byte(target))
+			perms = 0120000
+		} else {
+			if info.Mode()&0111 != 0 {
+				perms = 0755
+			}
+			fp, err := os.Open(pathname)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(hash, fp)
+			fp.Close()
+			if err != nil {
+				return err
+			}
+		}
+		var fixedhash [sha1.Size]byte
+		copy(fixedhash[:], hash.Sum(nil))
+		var me manifestEntry
+		me.pathname, _ = filepath.Rel(be.exported, pathname)
+		me.sig = newSignature(fixedhash, perms)
+		manifest = append(manifest, me)
+		return nil
+	})
+	if err != nil {
+		panic(throw("extractor", "Couldn't hash the export of %s: %v", rev, err))
+	}
+	return manifest
+}
+
+// catFile extracts file content into a specified destination path
+func (be *BzrExtractor) catFile(rev string, path string, dest string) error {
+	source := filepath.Join(be.exported, path)
+	if target, err := os.Readlink(source); err == nil {
+		return ioutil.WriteFile(dest, []byte(target), userReadWriteMode)
+	}
+	_, err := filecopy(source, dest)
+	return err
+}
+
+// getComment returns a commit's change comment as a string.
+func (be *BzrExtractor) getComment(rev string) string {
+	return be.revisions[rev].message
+}
+
+// FossilExtractor is a repository extractor for the Fossil version-control
+// system.  It has to be run in a checkout.
+type FossilExtractor struct {
+	branches map[string]string // checkin -> branch name
+	current  string            // checkin of the last manifest call
+	files    map[string]string // its path -> artifact hash
+}
+
+func newFossilExtractor() *FossilExtractor {
+	// Fossil keeps its metadata in an SQLite database, and
+	// "fossil sql" will answer queries against it; that is easier
+	// to parse than any of the reports. File lists come from the
+	// checkin manifests, which fossil artifact prints.
+	//
+	// Fossil's own tags other than branch names become
+	// lightweight tags.  Wiki, tickets, technotes and forum posts
+	// are not recovered.
+	fe := new(FossilExtractor)
+	fe.branches = make(map[string]string)
+	return fe
+}
+
+func (fe *FossilExtractor) preExtract() {
+}
+
+func (fe *FossilExtractor) keepHouse() error {
+	return nil
+}
+
+// query runs an SQL query against the repository and hands each line of
+// the result, columns separated by |, to a hook.
+func (fe *FossilExtractor) query(rs *RepoStreamer, sql string, errfmt string,
+	hook func(fields []string, rs *RepoStreamer) error) error {
+	return lineByLine(rs,
+		shellquote.Join("fossil", "sql", "--readonly", sql),
+		errfmt,
+		func(line string, rs *RepoStreamer) error {
+			return hook(strings.Split(strings.TrimRight(line, "\n"), "|"), rs)
+		})
+}
+
+// gatherRevisionIDs gets the topologically-ordered list of revisions and parents.
+func (fe *FossilExtractor) gatherRevisionIDs(rs *RepoStreamer) error {
+	err := fe.query(rs,
+		"SELECT blob.uuid FROM event JOIN blob ON blob.rid=event.objid WHERE event.type='ci' ORDER BY event.mtime;",
+		"fossil's gatherRevisionIDs: %v",
+		func(fields []string, rs *RepoStreamer) error {
+			rs.revlist = append(rs.revlist, fields[0])
+			rs.parents[fields[0]] = make([]string, 0)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	// The primary parent comes first
+	err = fe.query(rs,
+		"SELECT c.uuid, p.uuid FROM plink JOIN blob c ON c.rid=plink.cid JOIN blob p ON p.rid=plink.pid ORDER BY plink.cid, plink.isprim DESC;",
+		"fossil's gatherRevisionIDs: %v",
+		func(fields []string, rs *RepoStreamer) error {
+			if len(fields) == 2 {
+				rs.parents[fields[0]] = append(rs.parents[fields[0]], fields[1])
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	// Checkin times come from the clocks of whoever made them, so
+	// time order need not put parents first.  Fix that up.
+	placed := make(map[string]bool)
+	ordered := make([]string, 0, len(rs.revlist))
+	var place func(rev string)
+	place = func(rev string) {
+		if placed[rev] {
+			return
+		}
+		placed[rev] = true
+		for _, parent := range rs.parents[rev] {
+			place(parent)
+		}
+		ordered = append(ordered, rev)
+	}
+	for _, rev := range rs.revlist {
+		place(rev)
+	}
+	rs.revlist = ordered
+	return nil
+}
+
+// gatherCommitData gets all other per-commit data except branch IDs
+func (fe *FossilExtractor) gatherCommitData(rs *RepoStreamer) error {
+	return fe.query(rs,
+		`SELECT blob.uuid, coalesce(event.euser, event.user), strftime('%Y-%m-%dT%H:%M:%SZ', event.mtime),
+		(SELECT value FROM tagxref WHERE tagxref.rid=event.objid AND tagxref.tagid=(SELECT tagid FROM tag WHERE tagname='branch'))
+		FROM event JOIN blob ON blob.rid=event.objid WHERE event.type='ci';`,
+		"fossil's gatherCommitData: %v",
+		func(fields []string, rs *RepoStreamer) error {
+			if len(fields) != 4 {
+				panic(throw("extractor", "Garbled checkin data: %v", fields))
+			}
+			// Fossil knows users only by login name,
+			// so that does for the address too.
+			rs.meta[fields[0]] = new(CommitMeta)
+			rs.meta[fields[0]].ci = fmt.Sprintf("%s <%s> %s", fields[1], fields[1], fields[2])
+			rs.meta[fields[0]].ai = rs.meta[fields[0]].ci
+			branch := fields[3]
+			if branch == "" {
+				branch = "trunk"
+			}
+			fe.branches[fields[0]] = strings.ReplaceAll(branch, " ", "_")
+			return nil
+		})
+}
+
+// gatherAllReferences finds all branch heads and tags
+func (fe *FossilExtractor) gatherAllReferences(rs *RepoStreamer) error {
+	// A branch's head is its last checkin in topological order
+	for _, rev := range rs.revlist {
+		rs.refs.set("refs/heads/"+fe.branches[rev], rev)
+	}
+	// Tags that don't propagate are the ones that aren't branches
+	return fe.query(rs,
+		"SELECT substr(tag.tagname, 5), blob.uuid FROM tagxref JOIN tag ON tag.tagid=tagxref.tagid JOIN blob ON blob.rid=tagxref.rid WHERE tag.tagname GLOB 'sym-*' AND tagxref.tagtype=1;",
+		"fossil's gatherAllReferences: %v",
+		func(fields []string, rs *RepoStreamer) error {
+			if len(fields) == 2 {
+				if _, ok := rs.parents[fields[1]]; ok {
+					rs.refs.set("refs/tags/"+strings.ReplaceAll(fields[0], " ", "_"), fields[1])
+				}
+			}
+			return nil
+		})
+}
+
+// colorBranches assigns branches to commits in an extracted repository
+func (fe *FossilExtractor) colorBranches(rs *RepoStreamer) error {
+	for _, rev := range rs.revlist {
+		rs.meta[rev].branch = "refs/heads/" + fe.branches[rev]
+	}
+	return nil
+}
+
+func (fe *FossilExtractor) postExtract(repo *Repository) {
+	// Fossil's default branch is trunk
+	if !repo.branchset().Contains("refs/heads/master") {
+		walkEvents(repo.events, func(_ int, event Event) bool {
+			switch event.(type) {
+			case *Commit:
+				if event.(*Commit).Branch == "refs/heads/trunk" {
+					event.(*Commit).Branch = "refs/heads/master"
+				}
+			case *Reset:
+				if event.(*Reset).ref == "refs/heads/trunk" {
+					event.(*Reset).ref = "refs/heads/master"
+				}
+			}
+			return true
+		})
+	}
+}
+
+// isClean returns true if repo has no unsaved changes
+func (fe *FossilExtractor) isClean() bool {
+	data, err := captureFromProcess("fossil changes", control.baton)
+	if err != nil {
+		panic(throw("extractor", "Couldn't spawn fossil changes: %v", err))
+	}
+	return data == ""
+}
+
+// fossilDecode undoes the escaping of spaces, newlines and backslashes
+// in the fields of a fossil artifact card.
+func fossilDecode(field string) string {
+	return strings.NewReplacer(`\s`, " ", `\n`, "\n", `\\`, `\`).Replace(field)
+}
+
+// parseFossilManifest reads the F cards of a checkin manifest,
+// returning the baseline manifest named by its B card if it is a delta
+// manifest, and path -> "hash perms" for each file card.  In a delta
+// manifest a file card without a hash marks a deletion and maps to "".
+func parseFossilManifest(text string) (string, map[string]string) {
+	baseline := ""
+	files := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "B":
+			baseline = fields[1]
+		case "F":
+			path := fossilDecode(fields[1])
+			files[path] = ""
+			if len(fields) >= 3 {
+				files[path] = fields[2]
+				if len(fields) >= 4 {
+					files[path] += " " + fields[3]
+				}
+			}
+		}
+	}
+	return baseline, files
+}
+
+// artifact returns the text of a fossil artifact.
+func (fe *FossilExtractor) artifact(hash string) string {
+	data, err := captureFromProcess(shellquote.Join("fossil", "artifact", hash), control.baton)
+	if err != nil {
+		panic(throw("extractor", "Couldn't spawn fossil artifact: %v", err))
+	}
+	return data
+}
+
+// manifest lists all files present as of a specified revision.
+func (fe *FossilExtractor) manifest(rev string) []manifestEntry {
+	baseline, files := parseFossilManifest(fe.artifact(rev))
+	if baseline != "" {
+		_, base := parseFossilManifest(fe.artifact(baseline))
+		for path, card := range files {
+			if card == "" {
+				delete(base, path)
+			} else {
+				base[path] = card
+			}
+		}
+		files = base
+	}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	hashes := make(map[string]string)
+	var manifest = make([]manifestEntry, 0, len(paths))
+	for _, path := range paths {
+		fields := strings.Fields(files[path])
+		if len(fields) == 0 {
+			continue
+		}
+		// Artifact hashes are SHA1 or SHA3-256, of content alone
+		hash, err := hex.DecodeString(fields[0])
+		if err != nil {
+			panic(throw("extractor", "Malformed artifact hash: %v", err))
+		}
+		var fixedhash [sha1.Size]byte
+		if len(hash) == sha1.Size {
+			copy(fixedhash[:], hash)
+		} else {
+			fixedhash = sha1.Sum(hash)
+		}
+		perms := 0644
+		if len(fields) > 1 {
+			switch fields[1] {
+			case "x":
+				perms = 0755
+			case "l":
+				perms = 0120000
+			}
+		}
+		hashes[path] = fields[0]
+		var me manifestEntry
+		me.pathname = path
+		me.sig = newSignature(fixedhash, perms)
+		manifest = append(manifest, me)
+	}
+	fe.current, fe.files = rev, hashes
+	return manifest
+}
+
+// catFile extracts file content into a specified destination path
+func (fe *FossilExtractor) catFile(rev string, path string, dest string) error {
+	hash, ok := fe.files[path]
+	if rev != fe.current || !ok {
+		return fmt.Errorf("%s is not in the manifest of %s", path, rev)
+	}
+	cmd := exec.Command("fossil", "artifact", hash, dest)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// getComment returns a commit's change comment as a string.
+func (fe *FossilExtractor) getComment(rev string) string {
+	data, err := captureFromProcess(shellquote.Join("fossil", "sql", "--readonly",
+		"SELECT coalesce(event.ecomment, event.comment) FROM event JOIN blob ON blob.rid=event.objid WHERE blob.uuid='"+rev+"';"),
+		control.baton)
+	if err != nil {
+		panic(throw("extractor", "Couldn't spawn fossil sql: %v", err))
+	}
+	return data
+}
+
+// DarcsExtractor is a repository extractor for the darcs version-control
+// system.  It works from the patch log, so it can be used where
+// "darcs convert export" fails or isn't available.
+type DarcsExtractor struct {
+	patches    map[string]*darcsPatch // hash -> log record
+	visible    map[string]signature   // path -> signature as of the last manifest
+	scratch    map[string]string      // path -> file holding its latest content
+	scratchdir string
+	scratchseq int
+}
+
+// darcsPatch is one patch of a "darcs log --xml-output --summary" listing.
+type darcsPatch struct {
+	Author  string       `xml:"author,attr"`
+	Date    string       `xml:"date,attr"`
+	Hash    string       `xml:"hash,attr"`
+	Name    string       `xml:"name"`
+	Comment string       `xml:"comment"`
+	Summary darcsSummary `xml:"summary"`
+}
+
+// darcsSummary is the list of changes a patch makes.
+type darcsSummary struct {
+	Changes []darcsChange `xml:",any"`
+}
+
+// darcsChange is one change in a patch summary: add_file, modify_file,
+// remove_file, move, or the directory equivalents.
+type darcsChange struct {
+	XMLName xml.Name
+	Path    string `xml:",chardata"`
+	From    string `xml:"from,attr"`
+	To      string `xml:"to,attr"`
+}
+
+func newDarcsExtractor() *DarcsExtractor {
+	// Darcs has no commit graph, only a sequence of patches, so
+	// the history is linear and all of it goes to
+	// refs/heads/master.  Tag patches become lightweight tags on
+	// the patch before them.  Darcs doesn't record permissions,
+	// so every file is 0644.
+	//
+	// Trees are built up from the patch summaries; only the
+	// files a patch adds or changes are fetched.
+	de := new(DarcsExtractor)
+	de.patches = make(map[string]*darcsPatch)
+	de.visible = make(map[string]signature)
+	de.scratch = make(map[string]string)
+	return de
+}
+
+// parseDarcsLog parses the output of "darcs log --xml-output --summary",
+// returning the patches in log order, newest first.
+func parseDarcsLog(r io.Reader) ([]*darcsPatch, error) {
+	var changelog struct {
+		Patches []*darcsPatch `xml:"patch"`
+	}
+	if err := xml.NewDecoder(r).Decode(&changelog); err != nil {
+		return nil, err
+	}
+	for _, patch := range changelog.Patches {
+		// Older darcs versions prepend an Ignore-this line
+		comment := strings.TrimSpace(patch.Comment)
+		if strings.HasPrefix(comment, "Ignore-this:") {
+			comment = ""
+			if nl := strings.Index(patch.Comment, "\n"); nl != -1 {
+				comment = strings.TrimSpace(patch.Comment[nl+1:])
+			}
+		}
+		patch.Comment = comment
+		for i := range patch.Summary.Changes {
+			change := &patch.Summary.Changes[i]
+			change.Path = darcsPath(change.Path)
+			change.From = darcsPath(change.From)
+			change.To = darcsPath(change.To)
+		}
+	}
+	return changelog.Patches, nil
+}
+
+// darcsPath trims a path in a patch summary to repository-relative form.
+func darcsPath(path string) string {
+	return strings.TrimPrefix(strings.TrimSpace(path), "./")
+}
+
+// tagName returns the name of the tag a patch makes, or "" if it isn't a tag.
+func (patch *darcsPatch) tagName() string {
+	if strings.HasPrefix(patch.Name, "TAG ") {
+		return strings.TrimSpace(patch.Name[4:])
+	}
+	return ""
+}
+
+func (de *DarcsExtractor) preExtract() {
+	dir, err := ioutil.TempDir("", "rsdarcs")
+	if err != nil {
+		panic(throw("extractor", "Couldn't create scratch directory: %v", err))
+	}
+	de.scratchdir = dir
+}
+
+func (de *DarcsExtractor) keepHouse() error {
+	return nil
+}
+
+// gatherRevisionIDs gets the topologically-ordered list of revisions and parents.
+func (de *DarcsExtractor) gatherRevisionIDs(rs *RepoStreamer) error {
+	stdout, cmd, err := readFromProcess("darcs log --xml-output --summary")
+	if err != nil {
+		return err
+	}
+	patches, err := parseDarcsLog(stdout)
+	stdout.Close()
+	if cmd != nil {
+		cmd.Wait()
+	}
+	if err != nil {
+		return fmt.Errorf("darcs's gatherRevisionIDs: %v", err)
+	}
+	previous := ""
+	for i := len(patches) - 1; i >= 0; i-- {
+		patch := patches[i]
+		// Tags are patches too, but don't become commits
+		if tag := patch.tagName(); tag != "" {
+			if previous != "" {
+				rs.refs.set("refs/tags/"+strings.ReplaceAll(tag, " ", "_"), previous)
+			}
+			continue
+		}
+		de.patches[patch.Hash] = patch
+		rs.revlist = append(rs.revlist, patch.Hash)
+		rs.parents[patch.Hash] = make([]string, 0)
+		if previous != "" {
+			rs.parents[patch.Hash] = append(rs.parents[patch.Hash], previous)
+		}
+		previous = patch.Hash
+	}
+	return nil
+}
+
+// gatherCommitData gets all other per-commit data except branch IDs
+func (de *DarcsExtractor) gatherCommitData(rs *RepoStreamer) error {
+	for hash, patch := range de.patches {
+		// Darcs dates are UTC, written YYYYMMDDhhmmss
+		date, err := time.Parse("20060102150405", patch.Date)
+		if err != nil {
+			return fmt.Errorf("bad date in patch %s: %v", hash, err)
+		}
+		// The author field is free text, often but not always
+		// an address.
+		author := patch.Author
+		if !strings.Contains(author, "<") {
+			author = fmt.Sprintf("%s <%s>", author, author)
+		}
+		rs.meta[hash] = new(CommitMeta)
+		rs.meta[hash].ci = author + " " + date.Format(time.RFC3339)
+		rs.meta[hash].ai = rs.meta[hash].ci
+	}
+	return nil
+}
+
+// gatherAllReferences finds the branch head; tags were found with the patches
+func (de *DarcsExtractor) gatherAllReferences(rs *RepoStreamer) error {
+	if len(rs.revlist) > 0 {
+		rs.refs.set("refs/heads/master", rs.revlist[len(rs.revlist)-1])
+	}
+	return nil
+}
+
+// colorBranches assigns branches to commits in an extracted repository
+func (de *DarcsExtractor) colorBranches(rs *RepoStreamer) error {
+	for _, hash := range rs.revlist {
+		rs.meta[hash].branch = "refs/heads/master"
+	}
+	return nil
+}
+
+func (de *DarcsExtractor) postExtract(_repo *Repository) {
+	if de.scratchdir != "" {
+		os.RemoveAll(de.scratchdir)
+		de.scratchdir = ""
+	}
+}
+
+// isClean returns true if repo has no unsaved changes
+func (de *DarcsExtractor) isClean() bool {
+	// darcs whatsnew exits 1 when there is nothing to report
+	data, err := captureFromProcess("darcs whatsnew --summary", control.baton)
+	return err != nil || strings.HasPrefix(data, "No changes")
+}
+
+// renameUnder moves every path at or below from to the same place under to.
+func (de *DarcsExtractor) renameUnder(from string, to string) {
+	for path, sig := range de.visible {
+		if rest, ok := underPath(path, from); ok {
+			delete(de.visible, path)
+			de.visible[to+rest] = sig
+			if content, ok := de.scratch[path]; ok {
+				delete(de.scratch, path)
+				de.scratch[to+rest] = content
+			}
+		}
+	}
+}
+
+// fetch saves the content of a file as of a patch to scratch space and
+// returns its signature.
+func (de *DarcsExtractor) fetch(rev string, path string) signature {
+	de.scratchseq++
+	dest := filepath.Join(de.scratchdir, strconv.Itoa(de.scratchseq))
+	out, err := os.Create(dest)
+	if err != nil {
+		panic(throw("extractor", "Couldn't create scratch file: %v", err))
+	}
+	defer out.Close()
+	hash := sha1.New()
+	cmd := exec.Command("darcs", "show", "contents", "--match", "hash "+rev, path)
+	cmd.Stdout = io.MultiWriter(out, hash)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		panic(throw("extractor", "Couldn't get %s as of %s: %v", path, rev, err))
+	}
+	if old, ok := de.scratch[path]; ok {
+		os.Remove(old)
+	}
+	de.scratch[path] = dest
+	var fixedhash [sha1.Size]byte
+	copy(fixedhash[:], hash.Sum(nil))
+	return *newSignature(fixedhash, 0644)
+}
+
+// manifest lists all files present as of a specified revision.
+// Revisions arrive in order, so each tree is the one before it with
+// the patch's summary applied.
+func (de *DarcsExtractor) manifest(rev string) []manifestEntry {
+	for _, change := range de.patches[rev].Summary.Changes {
+		switch change.XMLName.Local {
+		case "add_file", "modify_file":
+			de.visible[change.Path] = de.fetch(rev, change.Path)
+		case "remove_file", "remove_directory":
+			for path := range de.visible {
+				if _, ok := underPath(path, change.Path); ok {
+					delete(de.visible, path)
+				}
+			}
+		case "move":
+			de.renameUnder(change.From, change.To)
+		}
+	}
+	paths := make([]string, 0, len(de.visible))
+	for path := range de.visible {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var manifest = make([]manifestEntry, 0, len(paths))
+	for _, path := range paths {
+		sig := de.visible[path]
+		var me manifestEntry
+		me.pathname = path
+		me.sig = &sig
+		manifest = append(manifest, me)
+	}
+	return manifest
+}
+
+// catFile extracts file content into a specified destination path
+func (de *DarcsExtractor) catFile(rev string, path string, dest string) error {
+	source, ok := de.scratch[path]
+	if !ok {
+		return fmt.Errorf("no content fetched for %s", path)
+	}
+	_, err := filecopy(source, dest)
+	return err
+}
+
+// getComment returns a commit's change comment as a string.
+func (de *DarcsExtractor) getComment(rev string) string {
+	patch := de.patches[rev]
+	if patch.Comment == "" {
+		return patch.Name + "\n"
+	}
+	return patch.Name + "\n\n" + patch.Comment + "\n"
+}
+
+// P4Extractor is a repository extractor for Perforce depots, read
+// through the p4 client from a workspace directory.
+type P4Extractor struct {
+	depot      string                          // depot path to read, in p4 syntax
+	root       string                          // its fixed part, where paths start
+	branches   []p4Branch                      // branch mappings, longest prefix first
+	changes    map[string]*p4Change            // revision -> changelist data
+	trees      map[string]map[string]signature // branch -> path -> signature
+	fetched    map[string]string               // path -> content fetched by the last manifest
+	scratchdir string
+}
+
+// p4Branch maps files under a depot prefix to a branch.
+type p4Branch struct {
+	prefix string
+	branch string
+}
+
+// p4File is one file revision in a changelist.
+type p4File struct {
+	depotFile string
+	path      string
+	action    string
+	filetype  string
+	rev       string
+}
+
+// p4Change is the part of a changelist that falls on one branch.
+type p4Change struct {
+	number int
+	branch string
+	user   string
+	time   string
+	desc   string
+	files  []p4File
+}
+
+func newP4Extractor() *P4Extractor {
+	// Perforce has no native notion of a branch beyond the
+	// layout of the depot, so branches are assigned by depot
+	// path.  A changelist touching several branches becomes one
+	// commit on each, with revision IDs like 1234@master.  The
+	// first commit on a branch other than master gets the latest
+	// master commit before it as parent; integrations are not
+	// turned into merges.  Labels become lightweight tags.
+	//
+	// Settings come from the workspace's P4CONFIG file, alongside
+	// the ones p4 reads from it:
+	//
+	// REPOSURGEON_DEPOT=//depot/project/...
+	// REPOSURGEON_BRANCH=//depot/project/main master
+	// REPOSURGEON_BRANCH=//depot/project/rel-1.0 rel-1.0
+	//
+	// The depot defaults to all of them.  Files not under any
+	// branch mapping go to master, with paths relative to the
+	// fixed part of the depot path.
+	pe := new(P4Extractor)
+	pe.depot = "//..."
+	pe.changes = make(map[string]*p4Change)
+	pe.trees = make(map[string]map[string]signature)
+	pe.fetched = make(map[string]string)
+	return pe
+}
+
+// configure reads the extractor settings from a P4CONFIG file.
+func (pe *P4Extractor) configure(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "REPOSURGEON_DEPOT=") {
+			pe.depot = strings.TrimPrefix(line, "REPOSURGEON_DEPOT=")
+		} else if strings.HasPrefix(line, "REPOSURGEON_BRANCH=") {
+			fields := strings.Fields(strings.TrimPrefix(line, "REPOSURGEON_BRANCH="))
+			if len(fields) != 2 {
+				return fmt.Errorf("ill-formed branch mapping %q", line)
+			}
+			pe.branches = append(pe.branches, p4Branch{strings.TrimSuffix(fields[0], "/") + "/", fields[1]})
+		}
+	}
+	sort.SliceStable(pe.branches, func(i, j int) bool {
+		return len(pe.branches[i].prefix) > len(pe.branches[j].prefix)
+	})
+	pe.root = pe.depot
+	for _, wildcard := range []string{"...", "*", "%%"} {
+		if i := strings.Index(pe.root, wildcard); i != -1 {
+			pe.root = pe.root[:i]
+		}
+	}
+	pe.root = pe.root[:strings.LastIndex(pe.root, "/")+1]
+	return scanner.Err()
+}
+
+// branchOf returns the branch of a depot file and its path on the branch.
+func (pe *P4Extractor) branchOf(depotFile string) (string, string) {
+	for _, mapping := range pe.branches {
+		if strings.HasPrefix(depotFile, mapping.prefix) {
+			return mapping.branch, depotFile[len(mapping.prefix):]
+		}
+	}
+	return "master", strings.TrimPrefix(depotFile, pe.root)
+}
+
+// parseP4Tagged parses the output of a p4 -ztag command into records
+// of field name -> value.  A record ends where a field name repeats;
+// lines not beginning with "... " continue the value before them.
+func parseP4Tagged(r io.Reader) ([]map[string]string, error) {
+	records := make([]map[string]string, 0)
+	var current map[string]string
+	key := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "... ") {
+			if current != nil && key != "" {
+				current[key] += "\n" + line
+			}
+			continue
+		}
+		fields := strings.SplitN(line[4:], " ", 2)
+		if _, ok := current[fields[0]]; current == nil || ok {
+			current = make(map[string]string)
+			records = append(records, current)
+		}
+		key = fields[0]
+		current[key] = ""
+		if len(fields) > 1 {
+			current[key] = fields[1]
+		}
+	}
+	for _, record := range records {
+		for k, v := range record {
+			record[k] = strings.TrimRight(v, "\n")
+		}
+	}
+	return records, scanner.Err()
+}
+
+// p4Perms returns the file permissions implied by a Perforce file type,
+// in either the current base+modifiers form or the old one.
+func p4Perms(filetype string) int {
+	base, modifiers := filetype, ""
+	if i := strings.Index(filetype, "+"); i != -1 {
+		base, modifiers = filetype[:i], filetype[i+1:]
+	}
+	if base == "symlink" {
+		return 0120000
+	}
+	if strings.Contains(modifiers, "x") || strings.HasPrefix(base, "x") || strings.HasPrefix(base, "kx") {
+		return 0755
+	}
+	return 0644
+}
+
+// tagged runs a p4 command in tagged mode and returns its records.
+func (pe *P4Extractor) tagged(args ...string) []map[string]string {
+	stdout, cmd, err := readFromProcess(shellquote.Join(append([]string{"p4", "-ztag"}, args...)...))
+	if err != nil {
+		panic(throw("extractor", "Couldn't spawn p4 %s: %v", args[0], err))
+	}
+	records, err := parseP4Tagged(stdout)
+	stdout.Close()
+	if cmd != nil {
+		cmd.Wait()
+	}
+	if err != nil {
+		panic(throw("extractor", "While reading p4 %s: %v", args[0], err))
+	}
+	return records
+}
+
+func (pe *P4Extractor) preExtract() {
+	if fp, err := os.Open(p4ConfigFile()); err == nil {
+		err = pe.configure(fp)
+		fp.Close()
+		if err != nil {
+			panic(throw("extractor", "In %s: %v", p4ConfigFile(), err))
+		}
+	}
+	dir, err := ioutil.TempDir("", "rsp4")
+	if err != nil {
+		panic(throw("extractor", "Couldn't create scratch directory: %v", err))
+	}
+	pe.scratchdir = dir
+}
+
+func (pe *P4Extractor) keepHouse() error {
+	return nil
+}
+
+// gatherRevisionIDs gets the topologically-ordered list of revisions and parents.
+func (pe *P4Extractor) gatherRevisionIDs(rs *RepoStreamer) error {
+	numbers := make([]int, 0)
+	for _, record := range pe.tagged("changes", "-s", "submitted", pe.depot) {
+		n, err := strconv.Atoi(record["change"])
+		if err != nil {
+			return fmt.Errorf("p4's gatherRevisionIDs: bad change number %q", record["change"])
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	tips := make(map[string]string)
+	for _, n := range numbers {
+		records := pe.tagged("describe", "-s", strconv.Itoa(n))
+		if len(records) == 0 {
+			return fmt.Errorf("p4's gatherRevisionIDs: no description of change %d", n)
+		}
+		record := records[0]
+		onBranch := make(map[string]*p4Change)
+		order := make([]string, 0)
+		for i := 0; ; i++ {
+			depotFile, ok := record[fmt.Sprintf("depotFile%d", i)]
+			if !ok {
+				break
+			}
+			// describe lists every file in the changelist,
+			// not just those under the depot path
+			if !strings.HasPrefix(depotFile, pe.root) {
+				continue
+			}
+			branch, path := pe.branchOf(depotFile)
+			change, ok := onBranch[branch]
+			if !ok {
+				change = &p4Change{number: n, branch: branch,
+					user: record["user"], time: record["time"], desc: record["desc"]}
+				onBranch[branch] = change
+				order = append(order, branch)
+			}
+			change.files = append(change.files, p4File{depotFile, path,
+				record[fmt.Sprintf("action%d", i)],
+				record[fmt.Sprintf("type%d", i)],
+				record[fmt.Sprintf("rev%d", i)]})
+		}
+		for _, branch := range order {
+			rev := fmt.Sprintf("%d@%s", n, branch)
+			pe.changes[rev] = onBranch[branch]
+			rs.revlist = append(rs.revlist, rev)
+			rs.parents[rev] = make([]string, 0)
+			if tip, ok := tips[branch]; ok {
+				rs.parents[rev] = append(rs.parents[rev], tip)
+			} else if tip, ok := tips["master"]; ok {
+				rs.parents[rev] = append(rs.parents[rev], tip)
+			}
+			tips[branch] = rev
+		}
+		rs.baton.twirl()
+	}
+	for branch, tip := range tips {
+		rs.refs.set("refs/heads/"+branch, tip)
+	}
+	return nil
+}
+
+// gatherCommitData gets all other per-commit data except branch IDs
+func (pe *P4Extractor) gatherCommitData(rs *RepoStreamer) error {
+	// Perforce knows users by login name; p4 users maps those
+	// to full names and addresses.
+	users := make(map[string]string)
+	for _, record := range pe.tagged("users", "-a") {
+		users[record["User"]] = fmt.Sprintf("%s <%s>", record["FullName"], record["Email"])
+	}
+	for rev, change := range pe.changes {
+		who, ok := users[change.user]
+		if !ok {
+			who = fmt.Sprintf("%s <%s>", change.user, change.user)
+		}
+		rs.meta[rev] = new(CommitMeta)
+		rs.meta[rev].ci = who + " " + change.time + " +0000"
+		rs.meta[rev].ai = rs.meta[rev].ci
+	}
+	return nil
+}
+
+// gatherAllReferences finds all tags; branch heads were found with the revisions
+func (pe *P4Extractor) gatherAllReferences(rs *RepoStreamer) error {
+	for _, label := range pe.tagged("labels", pe.depot) {
+		name := label["label"]
+		records := pe.tagged("changes", "-m1", pe.depot+"@"+name)
+		if len(records) == 0 {
+			continue
+		}
+		for _, rev := range rs.revlist {
+			if strings.HasPrefix(rev, records[0]["change"]+"@") {
+				rs.refs.set("refs/tags/"+name, rev)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// colorBranches assigns branches to commits in an extracted repository
+func (pe *P4Extractor) colorBranches(rs *RepoStreamer) error {
+	for _, rev := range rs.revlist {
+		rs.meta[rev].branch = "refs/heads/" + pe.changes[rev].branch
+	}
+	return nil
+}
+
+func (pe *P4Extractor) postExtract(_repo *Repository) {
+	if pe.scratchdir != "" {
+		os.RemoveAll(pe.scratchdir)
+		pe.scratchdir = ""
+	}
+}
+
+// isClean returns true if repo has no unsaved changes
+func (pe *P4Extractor) isClean() bool {
+	data, err := captureFromProcess(shellquote.Join("p4", "opened", pe.depot), control.baton)
+	if err != nil {
+		panic(throw("extractor", "Couldn't spawn p4 opened: %v", err))
+	}
+	return data == "" || strings.Contains(data, "not opened")
+}
+
+// manifest lists all files present as of a specified revision.
+// Revisions arrive in order, so each branch's tree is the one before
+// it with the changelist applied.
+func (pe *P4Extractor) manifest(rev string) []manifestEntry {
+	change := pe.changes[rev]
+	tree, ok := pe.trees[change.branch]
+	if !ok {
+		tree = make(map[string]signature)
+		pe.trees[change.branch] = tree
+	}
+	for _, stale := range pe.fetched {
+		os.Remove(stale)
+	}
+	pe.fetched = make(map[string]string)
+	for i, file := range change.files {
+		switch file.action {
+		case "delete", "move/delete", "purge", "archive":
+			delete(tree, file.path)
+			continue
+		}
+		dest := filepath.Join(pe.scratchdir, strconv.Itoa(i))
+		out, err := os.Create(dest)
+		if err != nil {
+			panic(throw("extractor", "Couldn't create scratch file: %v", err))
+		}
+		hash := sha1.New()
+		cmd := exec.Command("p4", "print", "-q", file.depotFile+"#"+file.rev)
+		cmd.Stdout = io.MultiWriter(out, hash)
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		out.Close()
+		if err != nil {
+			panic(throw("extractor", "Couldn't print %s#%s: %v", file.depotFile, file.rev, err))
+		}
+		var fixedhash [sha1.Size]byte
+		copy(fixedhash[:], hash.Sum(nil))
+		tree[file.path] = *newSignature(fixedhash, p4Perms(file.filetype))
+		pe.fetched[file.path] = dest
+	}
+	paths := make([]string, 0, len(tree))
+	for path := range tree {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var manifest = make([]manifestEntry, 0, len(paths))
+	for _, path := range paths {
+		sig := tree[path]
+		var me manifestEntry
+		me.pathname = path
+		me.sig = &sig
+		manifest = append(manifest, me)
+	}
+	return manifest
+}
+
+// catFile extracts file content into a specified destination path
+func (pe *P4Extractor) catFile(rev string, path string, dest string) error {
+	source, ok := pe.fetched[path]
+	if !ok {
+		return fmt.Errorf("no content fetched for %s", path)
+	}
+	_, err := filecopy(source, dest)
+	return err
+}
+
+// getComment returns a commit's change comment as a string.
+func (pe *P4Extractor) getComment(rev string) string {
+	return pe.changes[rev].desc + "\n"
+}
+
 // RepoStreamer is the repository factory driver class for all repo analyzers.
 type RepoStreamer struct {
 	revlist            []string               // commit identifiers, oldest first
@@ -1216,6 +2472,9 @@ func (rs *RepoStreamer) extract(repo *Repository, vcs *VCS) (_repo *Repository,
 	//		hash[0], hash[1], hash[2], hash[3], hash[4], hash[5])
 	//}
 	trunc := func(instr string) string {
+		if len(instr) < 12 {
+			return instr
+		}
 		return instr[:12]
 	}
 
@@ -0,0 +1,370 @@
+/*
+ * Inference of copy and rename fileops from modifications and deletions
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Streams made from Subversion dumps, and from exporters that don't
+// look for copies, express a copied file as a modification carrying
+// its whole content again.  Where the content and mode of the new file
+// are identical to those of a file the first parent already has, the
+// modification can be a C op from that file instead, which is smaller
+// in the stream and says what actually happened.  Blobs that no
+// longer have any references after this are dropped.
+//
+// Likewise a rename comes through a plain dump as a deletion and an
+// addition in the same commit.  Pairing them by content, exactly or by
+// a similarity threshold, gives an R op that tools following a file's
+// history can see.
+
+// touches tells whether a path is a fileop target or source in a list,
+// or lies under a directory that is.
+func touches(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// copySources indexes the files of a manifest by blob hash.  Each list
+// of paths is sorted.
+func (repo *Repository) copySources(manifest *Manifest) map[gitHashType][]string {
+	sources := make(map[gitHashType][]string)
+	manifest.iter(func(path string, v interface{}) {
+		fileop := v.(*FileOp)
+		if fileop.op != opM || fileop.ref == "inline" {
+			return
+		}
+		if blob, ok := repo.markToEvent(fileop.ref).(*Blob); ok {
+			sources[blob.gitHash()] = append(sources[blob.gitHash()], path)
+		}
+	})
+	for _, paths := range sources {
+		sort.Strings(paths)
+	}
+	return sources
+}
+
+// chooseCopySource picks the source of a copy to a path from paths
+// with the right content: the first that has the mode wanted and
+// hasn't been touched earlier in the commit, preferring one with the
+// same basename.
+func chooseCopySource(manifest *Manifest, paths []string, target *FileOp, touched []string) string {
+	choice := ""
+	for _, path := range paths {
+		if v, ok := manifest.get(path); !ok || v.(*FileOp).mode != target.mode || touches(touched, path) {
+			continue
+		}
+		if filepath.Base(path) == filepath.Base(target.Path) {
+			return path
+		}
+		if choice == "" {
+			choice = path
+		}
+	}
+	return choice
+}
+
+// inferCommitCopies rewrites the modifications of a commit that copy a
+// file of its first parent into C ops, and notes blobs that lose their
+// last reference.  Returns the number of ops rewritten.
+func (repo *Repository) inferCommitCopies(commit *Commit, orphans map[*Blob]bool) int {
+	parent, ok := commit.firstParent().(*Commit)
+	if !ok {
+		return 0
+	}
+	for _, fileop := range commit.operations() {
+		if fileop.op == deleteall {
+			return 0
+		}
+	}
+	manifest := parent.manifest()
+	var sources map[gitHashType][]string
+	touched := make([]string, 0)
+	rewritten := 0
+	for _, fileop := range commit.operations() {
+		if fileop.op == opR {
+			touched = append(touched, fileop.Source)
+		}
+		touched = append(touched, fileop.Path)
+		if fileop.op != opM || fileop.ref == "inline" {
+			continue
+		}
+		if _, ok := manifest.get(fileop.Path); ok {
+			continue
+		}
+		blob, ok := repo.markToEvent(fileop.ref).(*Blob)
+		if !ok {
+			continue
+		}
+		if sources == nil {
+			sources = repo.copySources(manifest)
+		}
+		source := chooseCopySource(manifest, sources[blob.gitHash()], fileop, touched)
+		if source == "" {
+			continue
+		}
+		if !blob.removeOperation(fileop) {
+			orphans[blob] = true
+		}
+		fileop.op = opC
+		fileop.Source = source
+		fileop.mode = ""
+		fileop.ref = ""
+		rewritten++
+	}
+	if rewritten > 0 {
+		commit.invalidateManifests()
+		commit.addColor(colorQSET)
+	}
+	return rewritten
+}
+
+// inferCopies turns modifications in the selected commits that copy
+// files of their first parents into C ops.  Altered commits get Q
+// bits.  Returns the number of ops rewritten.
+func (repo *Repository) inferCopies(selection selectionSet, baton *Baton) int {
+	repo.clearColor(colorQSET)
+	orphans := make(map[*Blob]bool)
+	commits := repo.commits(selection)
+	rewritten := 0
+	baton.startProgress("inferring copies", uint64(len(commits)))
+	for i, commit := range commits {
+		rewritten += repo.inferCommitCopies(commit, orphans)
+		baton.percentProgress(uint64(i) + 1)
+	}
+	baton.endProgress()
+	repo.dropBlobs(orphans)
+	return rewritten
+}
+
+// lineSimilarity returns the percentage of the lines of two texts that
+// they have in common.
+func lineSimilarity(a []byte, b []byte) int {
+	lines := func(text []byte) map[string]int {
+		counts := make(map[string]int)
+		for _, line := range bytes.SplitAfter(text, []byte("\n")) {
+			if len(line) > 0 {
+				counts[string(line)]++
+			}
+		}
+		return counts
+	}
+	left, right := lines(a), lines(b)
+	total, common := 0, 0
+	for line, n := range left {
+		total += n
+		if m := right[line]; m < n {
+			common += m
+		} else {
+			common += n
+		}
+	}
+	for _, n := range right {
+		total += n
+	}
+	if total == 0 {
+		return 100
+	}
+	return 200 * common / total
+}
+
+// inferCommitRenames pairs the deletions of a commit with additions of
+// the same content, or content at least similarity percent alike if
+// similarity is nonzero, and turns each pair into an R op.  An exact
+// addition by M op or C op from the deleted file becomes the R op; a
+// similar one is kept, after an R op that takes its place in the
+// order.  Paths other fileops of the commit touch are left alone.
+// Returns the number of renames made.
+func (repo *Repository) inferCommitRenames(commit *Commit, similarity int, orphans map[*Blob]bool) int {
+	parent, ok := commit.firstParent().(*Commit)
+	if !ok {
+		return 0
+	}
+	ops := commit.operations()
+	for _, fileop := range ops {
+		if fileop.op == deleteall {
+			return 0
+		}
+	}
+	manifest := parent.manifest()
+	// Paths of a pair mustn't be touched by other fileops; a deleted
+	// path may be the source of a C op, which becomes the rename.
+	touchCount := func(path string) int {
+		n := 0
+		for _, fileop := range ops {
+			if touches([]string{fileop.Path, fileop.Source}, path) {
+				n++
+			}
+		}
+		return n
+	}
+	blobOf := func(fileop *FileOp) *Blob {
+		if fileop.op != opM || fileop.ref == "inline" {
+			return nil
+		}
+		blob, _ := repo.markToEvent(fileop.ref).(*Blob)
+		return blob
+	}
+	deletions := make([]int, 0)
+	additions := make([]int, 0)
+	for i, fileop := range ops {
+		switch fileop.op {
+		case opD:
+			if v, ok := manifest.get(fileop.Path); ok && blobOf(v.(*FileOp)) != nil && touchCount(fileop.Path) <= 2 {
+				deletions = append(deletions, i)
+			}
+		case opM, opC:
+			if _, ok := manifest.get(fileop.Path); !ok && touchCount(fileop.Path) == 1 {
+				additions = append(additions, i)
+			}
+		}
+	}
+	if len(deletions) == 0 || len(additions) == 0 {
+		return 0
+	}
+	used := make(map[int]bool)
+	removed := make(map[int]bool)
+	inserted := make(map[int]*FileOp)
+	renamed := 0
+	pair := func(d int, a int, exact bool) {
+		source, addition := ops[d].Path, ops[a]
+		used[a] = true
+		removed[d] = true
+		renamed++
+		if !exact {
+			inserted[a] = newFileOp(repo).construct(opR, source, addition.Path)
+			return
+		}
+		if blob := blobOf(addition); blob != nil && !blob.removeOperation(addition) {
+			orphans[blob] = true
+		}
+		addition.op = opR
+		addition.Source = source
+		addition.mode = ""
+		addition.ref = ""
+	}
+	unpaired := make([]int, 0)
+	for _, d := range deletions {
+		v, _ := manifest.get(ops[d].Path)
+		original := v.(*FileOp)
+		hash := blobOf(original).gitHash()
+		found := false
+		for _, a := range additions {
+			addition := ops[a]
+			if used[a] {
+				continue
+			}
+			if addition.op == opC {
+				found = addition.Source == ops[d].Path && touchCount(ops[d].Path) == 2
+			} else if blob := blobOf(addition); blob != nil {
+				found = addition.mode == original.mode && blob.gitHash() == hash && touchCount(ops[d].Path) == 1
+			}
+			if found {
+				pair(d, a, true)
+				break
+			}
+		}
+		if !found {
+			unpaired = append(unpaired, d)
+		}
+	}
+	if similarity > 0 {
+		for _, d := range unpaired {
+			if touchCount(ops[d].Path) != 1 {
+				continue
+			}
+			v, _ := manifest.get(ops[d].Path)
+			content := blobOf(v.(*FileOp)).getContent()
+			if looksBinary(content) {
+				continue
+			}
+			best, bestScore := -1, similarity-1
+			for _, a := range additions {
+				blob := blobOf(ops[a])
+				if used[a] || blob == nil {
+					continue
+				}
+				other := blob.getContent()
+				if looksBinary(other) {
+					continue
+				}
+				if score := lineSimilarity(content, other); score > bestScore {
+					best, bestScore = a, score
+				}
+			}
+			if best != -1 {
+				pair(d, best, false)
+			}
+		}
+	}
+	if renamed == 0 {
+		return 0
+	}
+	newOps := make([]*FileOp, 0, len(ops))
+	for i, fileop := range ops {
+		if removed[i] {
+			continue
+		}
+		if rename, ok := inserted[i]; ok {
+			newOps = append(newOps, rename)
+		}
+		newOps = append(newOps, fileop)
+	}
+	commit.setOperations(newOps)
+	commit.addColor(colorQSET)
+	return renamed
+}
+
+// inferRenames turns deletions paired with additions of the same
+// content in the selected commits into R ops, pairing by similarity
+// too if similarity is nonzero.  Altered commits get Q bits.  Returns
+// the number of renames made.
+func (repo *Repository) inferRenames(selection selectionSet, similarity int, baton *Baton) int {
+	repo.clearColor(colorQSET)
+	orphans := make(map[*Blob]bool)
+	commits := repo.commits(selection)
+	renamed := 0
+	baton.startProgress("inferring renames", uint64(len(commits)))
+	for i, commit := range commits {
+		renamed += repo.inferCommitRenames(commit, similarity, orphans)
+		baton.percentProgress(uint64(i) + 1)
+	}
+	baton.endProgress()
+	repo.dropBlobs(orphans)
+	return renamed
+}
+
+// dropBlobs removes blobs from the event list.
+func (repo *Repository) dropBlobs(doomed map[*Blob]bool) {
+	if len(doomed) == 0 {
+		return
+	}
+	eligible := func(event Event) bool {
+		blob, ok := event.(*Blob)
+		return ok && doomed[blob]
+	}
+	repo.filterAssignments(eligible)
+	newEvents := repo.events[:0]
+	for _, event := range repo.events {
+		if !eligible(event) {
+			newEvents = append(newEvents, event)
+		}
+	}
+	repo.events = newEvents
+	repo.declareSequenceMutation("blob removal")
+}
+
+// end
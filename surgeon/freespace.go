@@ -0,0 +1,25 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+/*
+ * Free disk space, where statfs(2) reports it
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to an unprivileged
+// user on the filesystem containing pathname.
+func freeSpace(pathname string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(pathname, &st); err != nil {
+		return -1, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// end
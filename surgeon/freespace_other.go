@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!dragonfly
+
+/*
+ * Free disk space, on systems without statfs(2)
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import "errors"
+
+// freeSpace can't tell how much space is free here, so checkFreeSpace
+// skips its check.
+func freeSpace(pathname string) (int64, error) {
+	return -1, errors.New("free space is not available on this system")
+}
+
+// end
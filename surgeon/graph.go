@@ -0,0 +1,261 @@
+/*
+ * Commit-graph visualization in DOT and mermaid
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// The graph is drawn from the commits and annotated tags in a
+// selection.  Each branch gets a color from a small palette, in order
+// of first appearance, and the tip of each branch a label node.
+// Optionally, runs of commits that are uninteresting to look at -
+// one parent, one child, both on the same branch, and nothing
+// attached - are drawn as a single node, so the shape of a long
+// history fits on a screen.
+
+// Graph output formats
+var graphFormats = []string{"dot", "mermaid"}
+
+// Branch colors, cycled through if there are more branches
+var graphPalette = []string{
+	"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728",
+	"#9467bd", "#8c564b", "#e377c2", "#7f7f7f",
+}
+
+type graphEdge struct {
+	from, to string
+}
+
+// commitGraph is the selection digested for drawing.
+type commitGraph struct {
+	commits []*Commit            // Drawn commits, in event order
+	tags    []*Tag               // Tags pointing into the selection
+	node    map[*Commit]string   // Node each commit is drawn as
+	runs    map[string][]*Commit // Collapsed runs by node name
+	edges   []graphEdge
+	colors  map[string]int // Branch to palette index
+	tips    []*Commit      // Commits at the heads of branches
+}
+
+// buildCommitGraph digests a selection.  Nodes are named with the
+// function given.
+func (repo *Repository) buildCommitGraph(selection selectionSet, collapse bool, name func(mark string) string) *commitGraph {
+	g := &commitGraph{
+		node:   make(map[*Commit]string),
+		runs:   make(map[string][]*Commit),
+		colors: make(map[string]int),
+	}
+	for it := selection.Iterator(); it.Next(); {
+		switch e := repo.events[it.Value()].(type) {
+		case *Commit:
+			g.commits = append(g.commits, e)
+			if _, ok := g.colors[e.Branch]; !ok {
+				g.colors[e.Branch] = len(g.colors)
+			}
+		case *Tag:
+			if target, ok := repo.markToEvent(e.committish).(*Commit); ok && selection.Contains(repo.eventToIndex(target)) {
+				g.tags = append(g.tags, e)
+			}
+		}
+	}
+	drawn := func(c CommitLike) (*Commit, bool) {
+		commit, ok := c.(*Commit)
+		return commit, ok && selection.Contains(repo.eventToIndex(commit))
+	}
+	interior := func(commit *Commit) bool {
+		if !collapse || len(commit.attachments) > 0 {
+			return false
+		}
+		parents, children := commit.parents(), commit.children()
+		if len(parents) != 1 || len(children) != 1 {
+			return false
+		}
+		parent, pok := drawn(parents[0])
+		child, cok := drawn(children[0])
+		return pok && cok && parent.Branch == commit.Branch && child.Branch == commit.Branch
+	}
+	for _, commit := range g.commits {
+		if _, done := g.node[commit]; done {
+			continue
+		}
+		g.node[commit] = name(commit.mark)
+		if !interior(commit) {
+			continue
+		}
+		if parent, _ := drawn(commit.parents()[0]); interior(parent) {
+			continue // Not the start of a run; picked up from there
+		}
+		run := []*Commit{commit}
+		for next, _ := drawn(commit.children()[0]); interior(next); next, _ = drawn(next.children()[0]) {
+			run = append(run, next)
+		}
+		if len(run) > 1 {
+			id := "run" + commit.mark[1:]
+			g.runs[id] = run
+			for _, c := range run {
+				g.node[c] = id
+			}
+		}
+	}
+	seen := make(map[graphEdge]bool)
+	for _, commit := range g.commits {
+		for _, p := range commit.parents() {
+			if parent, ok := drawn(p); ok {
+				edge := graphEdge{g.node[parent], g.node[commit]}
+				if edge.from != edge.to && !seen[edge] {
+					seen[edge] = true
+					g.edges = append(g.edges, edge)
+				}
+			}
+		}
+		newbranch := true
+		for _, cchild := range commit.children() {
+			if child, ok := cchild.(*Commit); ok && commit.Branch == child.Branch {
+				newbranch = false
+			}
+		}
+		if newbranch {
+			g.tips = append(g.tips, commit)
+		}
+	}
+	return g
+}
+
+// color returns the palette color of a commit's branch.
+func (g *commitGraph) color(commit *Commit) string {
+	return graphPalette[g.colors[commit.Branch]%len(graphPalette)]
+}
+
+// graphCaption returns the first line of a comment cut down to size.
+func graphCaption(comment string, length int) string {
+	firstline, _ := splitRuneFirst(comment, '\n')
+	if len(firstline) > length {
+		firstline = utf8trunc(firstline, length)
+	}
+	return firstline
+}
+
+// runLabel describes a collapsed run.
+func runLabel(run []*Commit) string {
+	return fmt.Sprintf("%d commits %s..%s", len(run), run[0].mark, run[len(run)-1].mark)
+}
+
+// exportGraph writes a picture of the commit graph in the selection,
+// in DOT or mermaid.
+func (repo *Repository) exportGraph(selection selectionSet, format string, collapse bool, output io.Writer) error {
+	switch format {
+	case "dot":
+		repo.dotGraph(repo.buildCommitGraph(selection, collapse, func(mark string) string { return mark[1:] }), output)
+	case "mermaid":
+		repo.mermaidGraph(repo.buildCommitGraph(selection, collapse, func(mark string) string { return "c" + mark[1:] }), output)
+	default:
+		return fmt.Errorf("unknown graph format %q, must be one of %s", format, strings.Join(graphFormats, ", "))
+	}
+	return nil
+}
+
+// dotGraph renders a commit graph in the DOT language of graphviz.
+func (repo *Repository) dotGraph(g *commitGraph, output io.Writer) {
+	fmt.Fprint(output, "digraph {\n")
+	for _, edge := range g.edges {
+		fmt.Fprintf(output, "\t%s -> %s;\n", edge.from, edge.to)
+	}
+	for _, tag := range g.tags {
+		target := g.node[repo.markToEvent(tag.committish).(*Commit)]
+		fmt.Fprintf(output, "\t\"%s\" -> \"%s\" [style=dotted];\n",
+			tag.tagname, target)
+		fmt.Fprintf(output, "\t{rank=same; \"%s\"; \"%s\"}\n",
+			tag.tagname, target)
+	}
+	tips := make(map[*Commit]bool)
+	for _, commit := range g.tips {
+		tips[commit] = true
+	}
+	for _, commit := range g.commits {
+		id := g.node[commit]
+		if run, ok := g.runs[id]; ok {
+			if run[0] == commit {
+				fmt.Fprintf(output, "\t%s [shape=box,style=dashed,width=5,color=\"%s\",label=\"%s\"];\n",
+					id, g.color(commit), runLabel(run))
+			}
+			continue
+		}
+		summary := html.EscapeString(graphCaption(commit.Comment, 42))
+		cid := commit.mark
+		if commit.legacyID != "" {
+			cid = commit.showlegacy() + " &rarr; " + cid
+		}
+		fmt.Fprintf(output, "\t%s [shape=box,width=5,color=\"%s\",label=<<table cellspacing=\"0\" border=\"0\" cellborder=\"0\"><tr><td><font color=\"blue\">%s</font></td><td>%s</td></tr></table>>];\n",
+			id, g.color(commit), cid, summary)
+		if tips[commit] {
+			fmt.Fprintf(output, "\t\"%s\" [shape=oval,width=2,color=\"%s\"];\n", commit.Branch, g.color(commit))
+			fmt.Fprintf(output, "\t\"%s\" -> \"%s\" [style=dotted];\n", id, commit.Branch)
+		}
+	}
+	for _, tag := range g.tags {
+		summary := html.EscapeString(graphCaption(tag.Comment, graphCaptionLength))
+		fmt.Fprintf(output, "\t\"%s\" [label=<<table cellspacing=\"0\" border=\"0\" cellborder=\"0\"><tr><td><font color=\"blue\">%s</font></td><td>%s</td></tr></table>>];\n", tag.tagname, tag.tagname, summary)
+	}
+	fmt.Fprint(output, "}\n")
+}
+
+// mermaidText makes a string safe inside a quoted mermaid label.
+func mermaidText(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace(s)
+}
+
+// mermaidGraph renders a commit graph as a mermaid flowchart.
+func (repo *Repository) mermaidGraph(g *commitGraph, output io.Writer) {
+	fmt.Fprint(output, "flowchart TD\n")
+	classes := make([][]string, len(g.colors))
+	for _, commit := range g.commits {
+		id := g.node[commit]
+		if run, ok := g.runs[id]; ok {
+			if run[0] == commit {
+				fmt.Fprintf(output, "    %s[/\"%s\"/]\n", id, runLabel(run))
+				classes[g.colors[commit.Branch]] = append(classes[g.colors[commit.Branch]], id)
+			}
+			continue
+		}
+		cid := commit.mark
+		if commit.legacyID != "" {
+			cid = commit.showlegacy() + " → " + cid
+		}
+		fmt.Fprintf(output, "    %s[\"%s %s\"]\n", id, cid, mermaidText(graphCaption(commit.Comment, 42)))
+		classes[g.colors[commit.Branch]] = append(classes[g.colors[commit.Branch]], id)
+	}
+	for _, edge := range g.edges {
+		fmt.Fprintf(output, "    %s --> %s\n", edge.from, edge.to)
+	}
+	for i, commit := range g.tips {
+		fmt.Fprintf(output, "    b%d([\"%s\"])\n", i, mermaidText(commit.Branch))
+		fmt.Fprintf(output, "    %s -.- b%d\n", g.node[commit], i)
+		classes[g.colors[commit.Branch]] = append(classes[g.colors[commit.Branch]], fmt.Sprintf("b%d", i))
+	}
+	for i, tag := range g.tags {
+		label := tag.tagname
+		if caption := graphCaption(tag.Comment, graphCaptionLength); caption != "" {
+			label += ": " + caption
+		}
+		fmt.Fprintf(output, "    t%d{{\"%s\"}}\n", i, mermaidText(label))
+		fmt.Fprintf(output, "    t%d -.-> %s\n", i, g.node[repo.markToEvent(tag.committish).(*Commit)])
+	}
+	for i, members := range classes {
+		if len(members) == 0 {
+			continue
+		}
+		fmt.Fprintf(output, "    classDef branch%d stroke:%s,stroke-width:2px\n", i, graphPalette[i%len(graphPalette)])
+		fmt.Fprintf(output, "    class %s branch%d\n", strings.Join(members, ","), i)
+	}
+}
+
+// end
@@ -0,0 +1,223 @@
+/*
+ * Repository statistics and health reporting
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// A health report gathers in one pass the numbers worth looking at
+// before surgery: how the history is distributed over branches,
+// people, and time, and the small defects that make trouble later -
+// empty commits, blobs with inconsistent line endings, metadata that
+// isn't UTF-8, resets pointing at nothing, and blobs no commit uses.
+// The report is deterministic, so it also makes good regression output.
+
+// Upper bounds of the blob size histogram buckets; the last is open.
+var healthBuckets = []int64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20}
+
+// How many authors the report names
+const healthTopAuthors = 10
+
+type healthCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type healthReport struct {
+	Events       int           `json:"events"`
+	Blobs        int           `json:"blobs"`
+	Commits      int           `json:"commits"`
+	Tags         int           `json:"tags"`
+	Resets       int           `json:"resets"`
+	Passthroughs int           `json:"passthroughs"`
+	Branches     []healthCount `json:"branches"`
+	Earliest     string        `json:"earliest,omitempty"`
+	Latest       string        `json:"latest,omitempty"`
+	BlobSizes    []healthCount `json:"blob_sizes"`
+	TopAuthors   []healthCount `json:"top_authors"`
+	EmptyCommits []string      `json:"empty_commits"`
+	MixedEOL     []string      `json:"mixed_eol"`
+	Undecodable  []string      `json:"undecodable"`
+	Dangling     []string      `json:"dangling_resets"`
+	Unreferenced []string      `json:"unreferenced_blobs"`
+}
+
+// mixedEOL tells whether content has both CRLF and bare LF line endings.
+func mixedEOL(content []byte) bool {
+	crlf := bytes.Count(content, []byte("\r\n"))
+	return crlf > 0 && bytes.Count(content, []byte("\n")) > crlf
+}
+
+// sizeBucket names the histogram bucket a blob size falls in.
+func sizeBucket(size int64) int {
+	for i, bound := range healthBuckets {
+		if size < bound {
+			return i
+		}
+	}
+	return len(healthBuckets)
+}
+
+// bucketName is the label of a histogram bucket.
+func bucketName(i int) string {
+	human := func(n int64) string {
+		if n >= 1<<20 {
+			return fmt.Sprintf("%dMiB", n>>20)
+		}
+		return fmt.Sprintf("%dKiB", n>>10)
+	}
+	if i == len(healthBuckets) {
+		return ">=" + human(healthBuckets[i-1])
+	}
+	return "<" + human(healthBuckets[i])
+}
+
+// healthReport surveys the events in a selection.  Events with a
+// problem the report lists get Q bits.
+func (repo *Repository) healthReport(selection selectionSet, baton *Baton) *healthReport {
+	r := &healthReport{
+		BlobSizes:    make([]healthCount, len(healthBuckets)+1),
+		EmptyCommits: make([]string, 0),
+		MixedEOL:     make([]string, 0),
+		Undecodable:  make([]string, 0),
+		Dangling:     make([]string, 0),
+		Unreferenced: make([]string, 0),
+	}
+	for i := range r.BlobSizes {
+		r.BlobSizes[i].Name = bucketName(i)
+	}
+	branches := make(map[string]int)
+	branchOrder := make([]string, 0)
+	authors := make(map[string]int)
+	repo.clearColor(colorQSET)
+	baton.startProgress("surveying repository", uint64(selection.Size()))
+	count := 0
+	for it := selection.Iterator(); it.Next(); {
+		count++
+		baton.percentProgress(uint64(count))
+		r.Events++
+		switch e := repo.events[it.Value()].(type) {
+		case *Blob:
+			r.Blobs++
+			r.BlobSizes[sizeBucket(e.size)].Count++
+			if len(e.opset) == 0 {
+				r.Unreferenced = append(r.Unreferenced, e.mark)
+				e.addColor(colorQSET)
+			}
+			if mixedEOL(e.getContent()) {
+				r.MixedEOL = append(r.MixedEOL, e.mark)
+				e.addColor(colorQSET)
+			}
+		case *Commit:
+			r.Commits++
+			if _, ok := branches[e.Branch]; !ok {
+				branchOrder = append(branchOrder, e.Branch)
+			}
+			branches[e.Branch]++
+			who := &e.committer
+			if len(e.authors) > 0 {
+				who = &e.authors[0]
+			}
+			authors[who.who()]++
+			when := rfc3339(e.committer.date.timestamp)
+			if r.Earliest == "" || when < r.Earliest {
+				r.Earliest = when
+			}
+			if when > r.Latest {
+				r.Latest = when
+			}
+			if len(e.operations()) == 0 && len(e.parents()) <= 1 {
+				r.EmptyCommits = append(r.EmptyCommits, e.idMe())
+				e.addColor(colorQSET)
+			}
+			if !e.decodable() {
+				r.Undecodable = append(r.Undecodable, e.idMe())
+				e.addColor(colorQSET)
+			}
+		case *Tag:
+			r.Tags++
+			if !e.decodable() {
+				r.Undecodable = append(r.Undecodable, e.idMe())
+				e.addColor(colorQSET)
+			}
+		case *Reset:
+			r.Resets++
+			if strings.HasPrefix(e.committish, ":") && repo.markToEvent(e.committish) == nil {
+				r.Dangling = append(r.Dangling, e.ref+" -> "+e.committish)
+				e.addColor(colorQSET)
+			}
+		case *Passthrough:
+			r.Passthroughs++
+		}
+	}
+	baton.endProgress()
+	for _, branch := range branchOrder {
+		r.Branches = append(r.Branches, healthCount{branch, branches[branch]})
+	}
+	for who, n := range authors {
+		r.TopAuthors = append(r.TopAuthors, healthCount{who, n})
+	}
+	sort.SliceStable(r.TopAuthors, func(i, j int) bool {
+		if r.TopAuthors[i].Count != r.TopAuthors[j].Count {
+			return r.TopAuthors[i].Count > r.TopAuthors[j].Count
+		}
+		return r.TopAuthors[i].Name < r.TopAuthors[j].Name
+	})
+	if len(r.TopAuthors) > healthTopAuthors {
+		r.TopAuthors = r.TopAuthors[:healthTopAuthors]
+	}
+	return r
+}
+
+// writeJSON renders the report as a JSON object.
+func (r *healthReport) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// writeText renders the report for people.
+func (r *healthReport) writeText(w io.Writer) {
+	fmt.Fprintf(w, "events: %d (%d blobs, %d commits, %d tags, %d resets, %d passthroughs)\n",
+		r.Events, r.Blobs, r.Commits, r.Tags, r.Resets, r.Passthroughs)
+	if r.Earliest != "" {
+		fmt.Fprintf(w, "dates: %s to %s\n", r.Earliest, r.Latest)
+	}
+	counts := func(title string, list []healthCount) {
+		if len(list) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "%s:\n", title)
+		for _, item := range list {
+			fmt.Fprintf(w, "%8d  %s\n", item.Count, item.Name)
+		}
+	}
+	counts("commits per branch", r.Branches)
+	counts("blob sizes", r.BlobSizes)
+	counts("top authors", r.TopAuthors)
+	items := func(title string, list []string) {
+		fmt.Fprintf(w, "%s: %d\n", title, len(list))
+		for _, item := range list {
+			fmt.Fprintf(w, "    %s\n", item)
+		}
+	}
+	items("empty commits", r.EmptyCommits)
+	items("mixed-EOL blobs", r.MixedEOL)
+	items("undecodable metadata", r.Undecodable)
+	items("dangling resets", r.Dangling)
+	items("unreferenced blobs", r.Unreferenced)
+}
+
+// end
@@ -0,0 +1,284 @@
+/*
+ * Merging of per-directory ignore files across history
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A directory in a converted history may hold ignore files in more
+// than one dialect: a .cvsignore carried through a CVS-to-Subversion
+// lift next to the .gitignore made from svn:ignore, or a .hgignore
+// left over from an earlier conversion.  Renaming them all to the
+// preferred type's ignore file would make them collide, and the
+// dialects differ in more than syntax - CVS patterns apply only in
+// their own directory and are whitespace-separated, with a lone !
+// clearing the list so far.
+//
+// The merge pass works out, at each commit touching ignore files, what
+// a single ignore file in the preferred dialect would hold for each
+// directory involved, then replaces the fileops on the original files
+// with one modify or delete of the merged file.  The preferred type's
+// own file comes first in the merge, verbatim; the others follow,
+// translated line by line.  Directories holding only native ignore
+// files are left alone.
+
+// ignoreFileNames lists the ignore-file basenames we recognize.
+func ignoreFileNames() []string {
+	names := []string{".cvsignore"}
+	for name := range ignoremap {
+		if !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// ignoreSource reports the directory an ignore file governs and the
+// VCS whose dialect it is in.  The last return is false if the path
+// is not an ignore file.
+func ignoreSource(path string) (string, *VCS, bool) {
+	base := filepath.Base(path)
+	var vcs *VCS
+	if base == ".cvsignore" {
+		vcs = findVCS("cvs")
+	} else if vcs = ignoremap[base]; vcs == nil || strings.Contains(vcs.ignorename, "/") {
+		return "", nil, false
+	}
+	dir := filepath.Dir(path)
+	if dir == "." {
+		dir = ""
+	}
+	return dir, vcs, true
+}
+
+// translateIgnoreFile renders the content of an ignore file in the
+// dialect of preferred, reporting lines it couldn't translate; those
+// are commented out.
+func translateIgnoreFile(content string, source *VCS, preferred *VCS, id string) (string, []IgnoreProblem) {
+	if source.name == preferred.name {
+		return content, nil
+	}
+	type patternLine struct {
+		text   string
+		lineno int
+	}
+	lines := make([]patternLine, 0)
+	for i, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+		if source.name != "cvs" {
+			lines = append(lines, patternLine{line, i + 1})
+			continue
+		}
+		// CVS patterns are whitespace-separated, and a ! throws
+		// away all the patterns before it.
+		for _, pattern := range strings.Fields(line) {
+			if pattern == "!" {
+				lines = lines[:0]
+			} else {
+				lines = append(lines, patternLine{pattern, i + 1})
+			}
+		}
+	}
+	problems := make([]IgnoreProblem, 0)
+	reLatch := source.hasCapability(ignRE)
+	var translated strings.Builder
+	for _, line := range lines {
+		fixed, err := translateIgnoreLine(&reLatch, source, preferred, line.text)
+		if err != nil {
+			problems = append(problems, IgnoreProblem{id, line.text, line.lineno, err})
+		}
+		translated.WriteString(fixed + "\n")
+	}
+	return translated.String(), problems
+}
+
+// mergedIgnore is what a merged ignore file holds for a directory at
+// some commit.
+type mergedIgnore struct {
+	content string
+	present bool // some ignore file exists in the directory
+	foreign bool // some ignore file is not in the preferred dialect
+}
+
+// mergeIgnoreDir computes the merged ignore file for a directory as it
+// is in a commit's tree.
+func mergeIgnoreDir(commit *Commit, dir string, preferred *VCS) (mergedIgnore, []IgnoreProblem) {
+	var merged mergedIgnore
+	problems := make([]IgnoreProblem, 0)
+	names := ignoreFileNames()
+	// Native file first
+	for i, name := range names {
+		if name == preferred.ignorename {
+			copy(names[1:i+1], names[:i])
+			names[0] = name
+			break
+		}
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		content, ok := commit.blobByName(path)
+		if !ok {
+			continue
+		}
+		_, source, _ := ignoreSource(path)
+		text, issues := translateIgnoreFile(string(content), source, preferred, path)
+		if text != "" && !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		merged.content += text
+		merged.present = true
+		merged.foreign = merged.foreign || source.name != preferred.name
+		problems = append(problems, issues...)
+	}
+	return merged, problems
+}
+
+// mergeIgnores merges the ignore files of each directory into one in
+// the preferred dialect, all through history.  Returns the problems
+// found in translation and the number of commits modified; those
+// commits get Q bits.
+func (repo *Repository) mergeIgnores(preferred *VCS, baton *Baton) ([]IgnoreProblem, int) {
+	type ignorePlan struct {
+		drop  map[*FileOp]bool
+		ops   []*FileOp
+		blobs []*Blob
+	}
+	plans := make(map[*Commit]*ignorePlan)
+	problems := make([]IgnoreProblem, 0)
+	seen := make(map[string]bool)
+	commits := repo.commits(undefinedSelectionSet)
+	// Work everything out from the unmodified history first.
+	baton.startProgress("planning ignore merge", uint64(len(commits)))
+	for ci, commit := range commits {
+		baton.percentProgress(uint64(ci) + 1)
+		touched := newOrderedStringSet()
+		forced := newStringSet()
+		wiped := false
+		for _, op := range commit.operations() {
+			if op.op == deleteall {
+				wiped = true
+				continue
+			}
+			for _, path := range []string{op.Source, op.Path} {
+				if dir, _, ok := ignoreSource(path); ok && path != "" {
+					touched.Add(dir)
+					if op.op == opR || op.op == opC {
+						forced.Add(dir)
+					}
+				}
+			}
+		}
+		if wiped {
+			commit.manifest().iter(func(path string, _ interface{}) {
+				if dir, _, ok := ignoreSource(path); ok {
+					touched.Add(dir)
+				}
+			})
+		}
+		if len(touched) == 0 {
+			continue
+		}
+		var parent *Commit
+		if p, ok := commit.firstParent().(*Commit); ok && !wiped {
+			parent = p
+		}
+		sort.Strings(touched)
+		var plan *ignorePlan
+		for _, dir := range touched {
+			now, issues := mergeIgnoreDir(commit, dir, preferred)
+			var before mergedIgnore
+			if parent != nil {
+				before, _ = mergeIgnoreDir(parent, dir, preferred)
+			}
+			if !now.foreign && !before.foreign && !forced.Contains(dir) {
+				continue
+			}
+			// The same untranslatable line will be met at every
+			// commit until it's changed; report it once.
+			for _, issue := range issues {
+				if key := issue.mark + "\x00" + issue.line; !seen[key] {
+					seen[key] = true
+					issue.mark = commit.idMe() + " " + issue.mark
+					problems = append(problems, issue)
+				}
+			}
+			if plan == nil {
+				plan = &ignorePlan{drop: make(map[*FileOp]bool)}
+				plans[commit] = plan
+			}
+			for _, op := range commit.operations() {
+				for _, path := range []string{op.Source, op.Path} {
+					if d, _, ok := ignoreSource(path); ok && path != "" && d == dir {
+						plan.drop[op] = true
+					}
+				}
+			}
+			target := filepath.Join(dir, preferred.ignorename)
+			if now.present && (wiped || !before.present || now.content != before.content) {
+				blob := newBlob(repo)
+				blob.mark = repo.newmark()
+				blob.setContent([]byte(now.content), noOffset)
+				op := newFileOp(repo)
+				op.op, op.mode, op.ref, op.Path = opM, "100644", blob.mark, target
+				blob.appendOperation(op)
+				plan.blobs = append(plan.blobs, blob)
+				plan.ops = append(plan.ops, op)
+			} else if !now.present && before.present {
+				plan.ops = append(plan.ops, newFileOp(repo).construct(opD, target))
+			}
+		}
+	}
+	baton.endProgress()
+	if len(plans) == 0 {
+		return problems, 0
+	}
+
+	// Now rewrite the fileops, then the event list.
+	repo.clearColor(colorQSET)
+	orphans := make(map[*Blob]bool)
+	for commit, plan := range plans {
+		newops := make([]*FileOp, 0, len(commit.operations())+len(plan.ops))
+		for _, op := range commit.operations() {
+			if !plan.drop[op] {
+				newops = append(newops, op)
+			} else if op.op == opM && op.ref != "inline" {
+				if blob, ok := repo.markToEvent(op.ref).(*Blob); ok {
+					orphans[blob] = true
+				}
+			}
+		}
+		commit.setOperations(append(newops, plan.ops...))
+		commit.addColor(colorQSET)
+	}
+	events := make([]Event, 0, len(repo.events))
+	for _, event := range repo.events {
+		switch e := event.(type) {
+		case *Blob:
+			if orphans[e] && len(e.opset) == 0 {
+				continue
+			}
+		case *Commit:
+			if plan, ok := plans[e]; ok {
+				for _, blob := range plan.blobs {
+					events = append(events, blob)
+				}
+			}
+		}
+		events = append(events, event)
+	}
+	repo.events = events
+	repo.declareSequenceMutation("ignore merge")
+	repo.renumber(context.Background(), 1, nil)
+	return problems, len(plans)
+}
+
+// end
@@ -16,14 +16,12 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"container/heap"
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"html"
 	"io"
 	"io/ioutil"
 	"log"
@@ -39,6 +37,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 	"unicode/utf8"
@@ -173,6 +172,40 @@ func getsize(pathname string) int64 {
 	return st.Size()
 }
 
+// byteSize renders a byte count for humans.
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// checkFreeSpace fails early if an operation expected to write about
+// need bytes under dir would run its filesystem out of space, rather
+// than letting it die with ENOSPC part way through.  If the free space
+// can't be determined the check is skipped.
+func checkFreeSpace(dir string, need int64, legend string) error {
+	if control.flagOptions["nospacecheck"] {
+		return nil
+	}
+	avail, err := freeSpace(dir)
+	if err != nil {
+		warn("diskspace", "free space under %s could not be checked: %v", dir, err)
+		return nil
+	}
+	if need > avail {
+		return fmt.Errorf("%s needs about %s under %s, but only %s is available (set nospacecheck to try anyway)",
+			legend, byteSize(need), dir, byteSize(avail))
+	}
+	return nil
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -452,6 +485,36 @@ func init() {
 		engine:  newHgExtractor(),
 		basevcs: findVCS("hg"),
 	})
+	importers = append(importers, Importer{
+		name:    "bzr-extractor",
+		visible: true,
+		engine:  newBzrExtractor("bzr"),
+		basevcs: findVCS("bzr"),
+	})
+	importers = append(importers, Importer{
+		name:    "brz-extractor",
+		visible: true,
+		engine:  newBzrExtractor("brz"),
+		basevcs: findVCS("brz"),
+	})
+	importers = append(importers, Importer{
+		name:    "fossil-extractor",
+		visible: true,
+		engine:  newFossilExtractor(),
+		basevcs: findVCS("fossil"),
+	})
+	importers = append(importers, Importer{
+		name:    "darcs-extractor",
+		visible: true,
+		engine:  newDarcsExtractor(),
+		basevcs: findVCS("darcs"),
+	})
+	importers = append(importers, Importer{
+		name:    "p4-extractor",
+		visible: true,
+		engine:  newP4Extractor(),
+		basevcs: findVCS("p4"),
+	})
 }
 
 /*
@@ -505,10 +568,18 @@ var logtags = map[string]uint{
 
 // innerControl is all the control-block stuff used by this module.
 type innerControl struct {
-	lineSep     string
-	blobseq     blobidx
-	flagOptions map[string]bool
-	readLimit   uint64
+	lineSep         string
+	blobseq         blobidx
+	flagOptions     map[string]bool
+	readLimit       uint64
+	placeholders    map[string]string
+	codec           string // Compression codec for blob files, if not gzip
+	manifestLimit   int    // Most manifests kept memoized, 0 for no limit
+	workers         int    // Goroutines for parallel passes, 0 for GOMAXPROCS
+	queueDepth      int    // Buffering of work queues, 0 for the worker count
+	spillSize       int64  // Blob data larger than this isn't held in memory
+	emptyDir        string // Name of placeholders for empty directories, if any
+	emptyDirContent []byte
 }
 
 // whoami - ask various programs that keep track of who you are
@@ -786,28 +857,63 @@ func (msg *MessageBlock) filterHeaders(regexp *regexp.Regexp) {
 	}
 }
 
-func (msg *MessageBlock) String() string {
-	var b strings.Builder
-	fmt.Fprintln(&b, string(MessageBlockDivider))
+// emit writes a message block to w.
+func (msg *MessageBlock) emit(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.Write(MessageBlockDivider)
+	bw.WriteByte('\n')
 	for _, k := range msg.hdnames {
 		if v := msg.header[k]; v != "" {
-			fmt.Fprintf(&b, "%s: %s\n", k, v)
+			fmt.Fprintf(bw, "%s: %s\n", k, v)
 		}
 	}
-	b.WriteByte('\n')
-	scanner := bufio.NewScanner(strings.NewReader(msg.body))
-	for scanner.Scan() {
-		line := scanner.Text()
+	bw.WriteByte('\n')
+	for body := msg.body; body != ""; {
+		line := body
+		if nl := strings.IndexByte(body, '\n'); nl >= 0 {
+			line, body = body[:nl], body[nl+1:]
+		} else {
+			body = ""
+		}
+		line = strings.TrimSuffix(line, "\r")
 		// byte stuffing so we can protect instances of the delimiter
 		// within message bodies.
 		if strings.HasPrefix(line, ".") || strings.HasPrefix(line, string(MessageBlockDivider)) {
-			b.WriteByte('.')
+			bw.WriteByte('.')
 		}
-		fmt.Fprintln(&b, line)
+		bw.WriteString(line)
+		bw.WriteByte('\n')
 	}
+	return bw.Flush()
+}
+
+func (msg *MessageBlock) String() string {
+	var b strings.Builder
+	msg.emit(&b)
 	return b.String()
 }
 
+// msgboxReader reads the messages of a message-box one at a time.
+type msgboxReader struct {
+	r *bufio.Reader
+}
+
+func newMsgboxReader(r io.Reader) *msgboxReader {
+	return &msgboxReader{bufio.NewReader(r)}
+}
+
+// next returns the next message, or io.EOF after the last one.
+func (mr *msgboxReader) next() (*MessageBlock, error) {
+	return newMessageBlock(mr.r)
+}
+
+// messageCarrier is an event that msgout can write as a message
+// and msgin can update from one.
+type messageCarrier interface {
+	emitMessage(w io.Writer, modifiers orderedStringSet, eventnum int, filterRegexp *regexp.Regexp) error
+	consumeMessage(msg *MessageBlock) bool
+}
+
 /*
  * Time, date, and zone handling
  */
@@ -1054,6 +1160,33 @@ func (attr *Attribution) address() (string, string) {
 	return attr.fullname, attr.email
 }
 
+// conversionBot is the synthetic identity that placeholder names are
+// mapped to when the policy doesn't specify a replacement.
+const conversionBot = "Conversion Bot <conversion-bot@reposurgeon.invalid>"
+
+// defaultPlaceholders is the placeholder-identity policy at startup.
+// It deals with a cvs2svn artifact.
+var defaultPlaceholders = map[string]string{
+	"(no author)": "no-author",
+}
+
+var placeholderRE = regexp.MustCompile(`^\s*([^<]*?)\s*<([^>]*)>\s*$`)
+
+// placeholderIdentity maps tool-generated identities such as "root" or
+// "(no author)" according to the placeholder policy.  A replacement of
+// the form "Name <email>" replaces both fields; a bare name replaces
+// only the name.
+func placeholderIdentity(fullname string, email string) (string, string) {
+	replacement, ok := control.placeholders[fullname]
+	if !ok {
+		return fullname, email
+	}
+	if m := placeholderRE.FindStringSubmatch(replacement); m != nil {
+		return m[1], m[2]
+	}
+	return replacement, email
+}
+
 // newAttribution makes an Attribution from an author or committer line
 func newAttribution(attrline string) (*Attribution, error) {
 	attr := new(Attribution)
@@ -1069,10 +1202,7 @@ func newAttribution(attrline string) (*Attribution, error) {
 				fmt.Errorf("malformed attribution date '%s' in '%s': %v",
 					datestamp, attrline, err2)
 		}
-		// Deal with a cvs2svn artifact
-		if fullname == "(no author)" {
-			fullname = "no-author"
-		}
+		fullname, email = placeholderIdentity(fullname, email)
 		attr.fullname = fullname
 		attr.email = email
 		attr.date = parsed
@@ -1125,24 +1255,85 @@ func (attr *Attribution) who() string {
 
 // Remap changes the attribution fullname/email according to a map of author entries.
 func (attr *Attribution) remap(authors map[string]Contributor) bool {
-	matches := func(attr *Attribution, local string, ae Contributor) bool {
-		nlower := strings.ToLower(attr.fullname)
-		elower := strings.ToLower(attr.email)
-		return strings.HasPrefix(elower, local+"@") || elower == local || (attr.email == "" && nlower == local)
+	ae, ok := lookupContributor(authors, attr)
+	if !ok {
+		return false
+	}
+	changed := attr.fullname != ae.fullname || attr.email != ae.email
+	attr.fullname = ae.fullname
+	attr.email = ae.email
+	if ae.timezone != "" {
+		attr.date.setTZ(ae.timezone)
+	}
+	return changed
+}
+
+// lookupContributor finds the author-map entry for an attribution, if
+// any.  The local ID may match the address up to the @, or the entire
+// address, or the name if there is no address.
+func lookupContributor(authors map[string]Contributor, attr *Attribution) (Contributor, bool) {
+	elower := strings.ToLower(attr.email)
+	if at := strings.Index(elower, "@"); at != -1 {
+		if ae, ok := authors[elower[:at]]; ok {
+			return ae, true
+		}
 	}
+	if ae, ok := authors[elower]; ok {
+		return ae, true
+	}
+	if attr.email == "" {
+		if ae, ok := authors[strings.ToLower(attr.fullname)]; ok {
+			return ae, true
+		}
+	}
+	return Contributor{}, false
+}
+
+// authorRules are the wildcard entries of an authors file, for
+// identities no entry names exactly.
+type authorRules struct {
+	domains  map[string]string // lowercased old domain to new domain
+	timezone map[string]string // lowercased old domain to timezone, if any
+	names    []nameRule        // applied in order
+}
+
+type nameRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
 
+func newAuthorRules() authorRules {
+	return authorRules{
+		domains:  make(map[string]string),
+		timezone: make(map[string]string),
+	}
+}
+
+func (rules *authorRules) isEmpty() bool {
+	return len(rules.domains) == 0 && len(rules.names) == 0
+}
+
+// rewrite changes the attribution according to the wildcard rules of
+// an authors file: the address's domain is replaced if a domain rule
+// names it, and then each name rule is applied to the full name.
+func (attr *Attribution) rewrite(rules *authorRules) bool {
 	changed := false
-	for local, ae := range authors {
-		if matches(attr, local, ae) {
-			if attr.fullname != ae.fullname || attr.email != ae.email {
+	if at := strings.LastIndex(attr.email, "@"); at != -1 {
+		domain := strings.ToLower(attr.email[at+1:])
+		if newdomain, ok := rules.domains[domain]; ok {
+			if email := attr.email[:at+1] + newdomain; email != attr.email {
+				attr.email = email
 				changed = true
 			}
-			attr.fullname = ae.fullname
-			attr.email = ae.email
-			if ae.timezone != "" {
-				attr.date.setTZ(ae.timezone)
+			if tz := rules.timezone[domain]; tz != "" {
+				attr.date.setTZ(tz)
 			}
-			break
+		}
+	}
+	for _, rule := range rules.names {
+		if fullname := GoReplacer(rule.re, attr.fullname, rule.replacement); fullname != attr.fullname {
+			attr.fullname = fullname
+			changed = true
 		}
 	}
 	return changed
@@ -1183,7 +1374,7 @@ var nullGitHash gitHashType // Do not modify this!
 func newGitHash(b []byte) gitHashType {
 	var h gitHashType
 	if b != nil {
-		fmt.Sscan(string(b), "%x", &h)
+		hex.Decode(h[:], bytes.TrimSpace(b))
 	}
 	return h
 }
@@ -1297,13 +1488,16 @@ type Blob struct {
 	abspath   string
 	cookie    *Cookie // CVS/SVN cookie analyzed out of this file
 	repo      *Repository
-	opset     map[*FileOp]bool // Fileops associated with this blob
+	opset     []*FileOp // Fileops associated with this blob, each once
 	opsetLock sync.Mutex
 	start     int64 // Seek start if this blob refers into a dump
 	size      int64 // length start if this blob refers into a dump
 	blobseq   blobidx
 	hash      gitHashType
-	colors    colorSet // Scratch space for graph-coloring algorithms
+	oid       gitHashType // As recorded by original-oid, if any
+	mimetype  string      // Content type sniffed from the content, if done
+	colors    colorSet    // Scratch space for graph-coloring algorithms
+	uuid      string      // Stable identity of the event
 }
 
 const noOffset = -1
@@ -1311,7 +1505,6 @@ const noOffset = -1
 func newBlob(repo *Repository) *Blob {
 	b := new(Blob)
 	b.repo = repo
-	b.opset = make(map[*FileOp]bool)
 	b.start = noOffset
 	b.blobseq = control.blobseq
 	control.blobseq++
@@ -1350,8 +1543,11 @@ func (b *Blob) idMe() string {
 func (b *Blob) paths(_pathtype orderedStringSet) orderedStringSet {
 	lst := newOrderedStringSet()
 	seen := make(map[string]bool)
-	for op := range b.opset {
-		// The fileop is necessarily a M fileop
+	for _, op := range b.opset {
+		// Notes are in the opset too, but have no path
+		if op.op != opM {
+			continue
+		}
 		if !seen[op.Path] {
 			lst = append(lst, op.Path)
 			seen[op.Path] = true
@@ -1361,18 +1557,28 @@ func (b *Blob) paths(_pathtype orderedStringSet) orderedStringSet {
 	return lst
 }
 
+// appendOperation associates a fileop with this blob.  A fileop that
+// already is associated with it must not be appended again.
 func (b *Blob) appendOperation(op *FileOp) {
 	b.opsetLock.Lock()
-	b.opset[op] = true
+	b.opset = append(b.opset, op)
 	b.opsetLock.Unlock()
-	b.hash.invalidate()
 }
 
+// removeOperation dissociates a fileop from this blob, and tells
+// whether any fileops are left.  The search runs from the end, since
+// the fileop most recently associated is the likeliest to go first.
 func (b *Blob) removeOperation(op *FileOp) bool {
 	b.opsetLock.Lock()
-	delete(b.opset, op)
-	b.opsetLock.Unlock()
-	b.hash.invalidate()
+	defer b.opsetLock.Unlock()
+	for i := len(b.opset) - 1; i >= 0; i-- {
+		if b.opset[i] == op {
+			copy(b.opset[i:], b.opset[i+1:])
+			b.opset[len(b.opset)-1] = nil
+			b.opset = b.opset[:len(b.opset)-1]
+			break
+		}
+	}
 	return len(b.opset) > 0
 }
 
@@ -1433,17 +1639,13 @@ func (b *Blob) getContent() []byte {
 	if err != nil {
 		panic(fmt.Errorf("Blob read: %v", err))
 	}
-	defer closeOrDie(file)
-	if control.flagOptions["compress"] {
-		input, err2 := gzip.NewReader(file)
-		if err2 != nil {
-			panic(err.Error())
-		}
-		defer closeOrDie(input)
-		data, err = ioutil.ReadAll(input)
-	} else {
-		data, err = ioutil.ReadAll(file)
+	input, err := newBlobReader(file)
+	if err != nil {
+		file.Close()
+		panic(fmt.Errorf("Blob read: %v", err))
 	}
+	defer closeOrDie(input)
+	data, err = ioutil.ReadAll(input)
 	if err != nil {
 		panic(fmt.Errorf("Blob read: %v", err))
 	}
@@ -1470,14 +1672,12 @@ func (b *Blob) getContentStream() io.ReadCloser {
 	if err != nil {
 		panic(fmt.Errorf("Blob read: %v", err))
 	}
-	if control.flagOptions["compress"] {
-		input, err2 := gzip.NewReader(file)
-		if err2 != nil {
-			panic(err.Error())
-		}
-		return input
+	input, err := newBlobReader(file)
+	if err != nil {
+		file.Close()
+		panic(fmt.Errorf("Blob read: %v", err))
 	}
-	return file
+	return input
 }
 
 // setContent sets the content of the blob from a string.
@@ -1487,6 +1687,8 @@ func (b *Blob) setContent(text []byte, tell int64) {
 	b.start = tell
 	b.size = int64(len(text))
 	b.cookie = nil
+	b.hash.invalidate()
+	b.mimetype = ""
 	if b.hasfile() {
 		b.start = noOffset // Hell's to pay if you remove this!
 		file, err := os.OpenFile(filepath.Clean(b.getBlobfile(true)),
@@ -1494,14 +1696,14 @@ func (b *Blob) setContent(text []byte, tell int64) {
 		if err != nil {
 			panic(fmt.Errorf("Blob write: %v", err))
 		}
-		defer closeOrDie(file)
-		if control.flagOptions["compress"] {
-			output := gzip.NewWriter(file)
-
-			defer output.Close()
-			_, err = output.Write(text)
-		} else {
-			_, err = file.Write(text)
+		output, err := newBlobWriter(file)
+		if err != nil {
+			file.Close()
+			panic(fmt.Errorf("Blob writer: %v", err))
+		}
+		_, err = output.Write(text)
+		if cerr := output.Close(); err == nil {
+			err = cerr
 		}
 		if err != nil {
 			panic(fmt.Errorf("Blob writer: %v", err))
@@ -1512,25 +1714,27 @@ func (b *Blob) setContent(text []byte, tell int64) {
 // setContentFromStream sets the content of the blob from a reader stream.
 func (b *Blob) setContentFromStream(s io.ReadCloser) {
 	b.start = noOffset
+	b.cookie = nil
 	file, err := os.OpenFile(filepath.Clean(b.getBlobfile(true)),
 		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, userReadWriteMode)
 	if err != nil {
 		panic(fmt.Errorf("Blob write: %v", err))
 	}
-	defer closeOrDie(file)
-	var nBytes int64
-	if control.flagOptions["compress"] {
-		output := gzip.NewWriter(file)
-		defer output.Close()
-		nBytes, err = io.Copy(output, s)
-	} else {
-		nBytes, err = io.Copy(file, s)
+	output, err := newBlobWriter(file)
+	if err != nil {
+		file.Close()
+		panic(fmt.Errorf("Blob writer: %v", err))
+	}
+	nBytes, err := io.Copy(output, s)
+	if cerr := output.Close(); err == nil {
+		err = cerr
 	}
 	if err != nil {
 		panic(fmt.Errorf("Blob writer: %v", err))
 	}
 	b.size = nBytes
 	b.hash.invalidate()
+	b.mimetype = ""
 }
 
 // materialize stores this content as a separate file, if it isn't already.
@@ -1574,6 +1778,14 @@ func (b Blob) isCommit() bool {
 	return false
 }
 
+func (b *Blob) getUUID() string {
+	return b.uuid
+}
+
+func (b *Blob) setUUID(uuid string) {
+	b.uuid = uuid
+}
+
 // moveto changes the repo this blob is associated with."
 func (b *Blob) moveto(repo *Repository) {
 	if b.hasfile() {
@@ -1594,7 +1806,7 @@ func (b *Blob) moveto(repo *Repository) {
 		// is faster than copying from the seekstream span.
 		content := b.getContentStream()
 		b.repo = repo
-		b.setContentFromStream(content)
+		sharedBlobs.adopt(b, content)
 		closeOrDie(content)
 	}
 	b.hash.invalidate()
@@ -1602,25 +1814,22 @@ func (b *Blob) moveto(repo *Repository) {
 
 // clone makes a fresh (uncolored) copy of this blob, pointing at the same file."
 func (b *Blob) clone(repo *Repository) *Blob {
-	bpath := relpath(b.getBlobfile(false))
-	c := b // copy scalar fields
-	c.repo = repo
-	c.blobseq = control.blobseq
-	control.blobseq++
-	c.opsetLock.Lock()
-	// Different repo?  Then we can't copy the old fileop references,
-	// as they belong in a different event sequence.
-	if c.repo != b.repo {
-		c.opset = nil
-	} else {
-		c.opset = make(map[*FileOp]bool, len(b.opset))
-		for op := range b.opset {
-			c.opset[op] = true
-		}
-	}
-	c.opsetLock.Unlock()
-	c.colors.Clear()
+	c := newBlob(repo)
+	c.mark = b.mark
+	c.abspath = b.abspath
+	c.cookie = b.cookie
+	c.start = b.start
+	c.size = b.size
+	c.oid = b.oid
+	c.uuid = b.uuid
+	// Fileops keep their blob references when they move with their
+	// commits, as in a split; clones of whole repositories add
+	// references from the cloned fileops.
+	b.opsetLock.Lock()
+	c.opset = append(c.opset, b.opset...)
+	b.opsetLock.Unlock()
 	if b.hasfile() {
+		bpath := relpath(b.getBlobfile(false))
 		cpath := relpath(c.getBlobfile(false))
 		if logEnable(logSHUFFLE) {
 			logit("blob clone for %s calls os.Link(): %s (%v) -> %s (%v)",
@@ -1632,23 +1841,30 @@ func (b *Blob) clone(repo *Repository) *Blob {
 		if err := os.Link(bpath, cpath); err != nil {
 			panic(fmt.Errorf("Blob clone: %v", err))
 		}
-	} else {
-		if logEnable(logSHUFFLE) {
-			logit("%s blob %s is not materialized.", repo.name, b.mark)
-		}
+	} else if repo.seekstream != b.repo.seekstream {
+		content := b.getContentStream()
+		sharedBlobs.adopt(c, content)
+		closeOrDie(content)
+	} else if logEnable(logSHUFFLE) {
+		logit("%s blob %s is not materialized.", repo.name, b.mark)
 	}
-	b.hash.invalidate()
 	return c
 }
 
 func (b *Blob) gitHash() gitHashType {
 	if !b.hash.isValid() {
-		content := b.getContent()
-		b.hash = gitHashString(fmt.Sprintf("blob %d\x00", len(content)) + string(content))
+		b.hash = b.contentHash()
 	}
 	return b.hash
 }
 
+// contentHash computes the Git hash of the blob's content, ignoring
+// any hash already stored.
+func (b *Blob) contentHash() gitHashType {
+	content := b.getContent()
+	return gitHashString(fmt.Sprintf("blob %d\x00", len(content)) + string(content))
+}
+
 // Examples of embedded VCS headers:
 // RCS, CVS: $Revision: 1.4 $
 // SVN:      $Revision: 144 $
@@ -1718,8 +1934,17 @@ func (b Blob) String() string {
 // emailOut enables DoMsgout() to report blobs, if requested with --blobs.
 func (b *Blob) emailOut(modifiers orderedStringSet,
 	eventnum int, filterRegexp *regexp.Regexp) string {
+	var out strings.Builder
+	b.emitMessage(&out, modifiers, eventnum, filterRegexp)
+	return out.String()
+}
+
+// emitMessage writes this blob to w as a message block.
+func (b *Blob) emitMessage(w io.Writer, modifiers orderedStringSet,
+	eventnum int, filterRegexp *regexp.Regexp) error {
 	msg, _ := newMessageBlock(nil)
 	msg.setHeader("Event-Number", fmt.Sprintf("%d", eventnum+1))
+	msg.setUUIDHeader(b)
 	msg.setHeader("Event-Mark", b.mark)
 	msg.setPayload(b.getComment())
 
@@ -1727,7 +1952,12 @@ func (b *Blob) emailOut(modifiers orderedStringSet,
 		msg.filterHeaders(filterRegexp)
 	}
 
-	return msg.String()
+	return msg.emit(w)
+}
+
+// consumeMessage updates this blob from a message block.
+func (b *Blob) consumeMessage(msg *MessageBlock) bool {
+	return b.emailIn(msg, false)
 }
 
 // emailIn updates this blob from a parsed email message.
@@ -1755,6 +1985,7 @@ type Tag struct {
 	Comment    string
 	legacyID   string
 	colors     colorSet
+	uuid       string
 }
 
 func newTag(repo *Repository, name string, committish string, comment string) *Tag {
@@ -1862,6 +2093,9 @@ func (t *Tag) showlegacy() string {
 
 // tags enables DoTags() to report tags.
 func (t *Tag) tags(modifiers orderedStringSet, eventnum int, _cols int) string {
+	if reportFormat(modifiers) != "" {
+		return reportRecord(modifiers, tagsFields, []interface{}{eventnum + 1, "tag", t.tagname})
+	}
 	return fmt.Sprintf("%6d\ttag\t%s", eventnum+1, t.tagname)
 }
 
@@ -1880,11 +2114,20 @@ func utf8trunc(s string, maxlen int) string {
 	return out
 }
 
-// emailOut enables DoMsgout() to report tag metadata
-func (t *Tag) emailOut(modifiers orderedStringSet, eventnum int,
-	filterRegexp *regexp.Regexp) string {
+// emailOut enables DoMsgout() to report tag metadata.
+func (t *Tag) emailOut(modifiers orderedStringSet,
+	eventnum int, filterRegexp *regexp.Regexp) string {
+	var b strings.Builder
+	t.emitMessage(&b, modifiers, eventnum, filterRegexp)
+	return b.String()
+}
+
+// emitMessage writes the metadata of this tag to w as a message block.
+func (t *Tag) emitMessage(w io.Writer, modifiers orderedStringSet,
+	eventnum int, filterRegexp *regexp.Regexp) error {
 	msg, _ := newMessageBlock(nil)
 	msg.setHeader("Event-Number", fmt.Sprintf("%d", eventnum+1))
+	msg.setUUIDHeader(t)
 	msg.setHeader("Tag-Name", t.tagname)
 	msg.setHeader("Target-Mark", t.committish)
 	if t.tagger.isValid() {
@@ -1896,13 +2139,18 @@ func (t *Tag) emailOut(modifiers orderedStringSet, eventnum int,
 	check, _ := splitRuneFirst(t.Comment, '\n')
 	msg.setHeader("Check-Text", utf8trunc(check, 64))
 	msg.setPayload(t.Comment)
-	if t.Comment != "" && !strings.HasSuffix(t.Comment, "\n") && logEnable(logWARN) {
-		logit("in tag %s, comment was not LF-terminated.", t.tagname)
+	if t.Comment != "" && !strings.HasSuffix(t.Comment, "\n") {
+		warn("comment", "in tag %s, comment was not LF-terminated.", t.tagname)
 	}
 	if filterRegexp != nil {
 		msg.filterHeaders(filterRegexp)
 	}
-	return msg.String()
+	return msg.emit(w)
+}
+
+// consumeMessage updates this tag from a message block.
+func (t *Tag) consumeMessage(msg *MessageBlock) bool {
+	return t.emailIn(msg, false)
 }
 
 // emailIn updates this Tag from a parsed message block.
@@ -2018,8 +2266,11 @@ func branchname(tagname string) string {
 }
 
 // stamp enables DoStamp() to report action stamps
-func (t *Tag) stamp(_modifiers orderedStringSet, _eventnum int, cols int) string {
+func (t *Tag) stamp(modifiers orderedStringSet, _eventnum int, cols int) string {
 	firstLine, _ := splitRuneFirst(t.Comment, '\n')
+	if reportFormat(modifiers) != "" {
+		return reportRecord(modifiers, stampFields, []interface{}{t.tagger.actionStamp(), firstLine})
+	}
 	report := "<" + t.tagger.actionStamp() + "> " + firstLine
 	if cols > 0 && len(report) > cols {
 		report = report[:cols]
@@ -2061,6 +2312,14 @@ func (t Tag) isCommit() bool {
 	return false
 }
 
+func (t Tag) getUUID() string {
+	return t.uuid
+}
+
+func (t *Tag) setUUID(uuid string) {
+	t.uuid = uuid
+}
+
 // Reset represents a branch creation.
 type Reset struct {
 	ref        string
@@ -2069,6 +2328,7 @@ type Reset struct {
 	legacyID   string // Sometimes these are reduced Subversion commits
 	repo       *Repository
 	colors     colorSet
+	uuid       string
 }
 
 // nameToRef expands a name to Git-style reference path
@@ -2126,6 +2386,14 @@ func (reset Reset) isCommit() bool {
 	return false
 }
 
+func (reset Reset) getUUID() string {
+	return reset.uuid
+}
+
+func (reset *Reset) setUUID(uuid string) {
+	reset.uuid = uuid
+}
+
 // idMe IDs this reset for humans.
 func (reset *Reset) idMe() string {
 	return fmt.Sprintf("reset-%s@%d", reset.ref, reset.repo.eventToIndex(reset))
@@ -2166,6 +2434,9 @@ func (reset *Reset) moveto(repo *Repository) {
 
 // tags enables do_tags() to report resets."
 func (reset Reset) tags(modifiers orderedStringSet, eventnum int, _cols int) string {
+	if reportFormat(modifiers) != "" {
+		return reportRecord(modifiers, tagsFields, []interface{}{eventnum + 1, "reset", reset.ref})
+	}
 	return fmt.Sprintf("%6d\treset\t%s", eventnum+1, reset.ref)
 }
 
@@ -2263,6 +2534,11 @@ func (fileop *FileOp) construct(op optype, opargs ...string) *FileOp {
 	} else if op == 'N' {
 		fileop.ref = opargs[0]
 		fileop.Path = opargs[1]
+		if fileop.repo != nil && fileop.ref != "inline" {
+			if blob, ok := fileop.repo.markToEvent(fileop.ref).(*Blob); ok {
+				blob.appendOperation(fileop)
+			}
+		}
 	} else if op == 'R' {
 		fileop.Source = opargs[0]
 		fileop.Path = opargs[1]
@@ -2273,6 +2549,7 @@ func (fileop *FileOp) construct(op optype, opargs ...string) *FileOp {
 	} else {
 		panic(throw("parse", "unexpected fileop "+string(op)))
 	}
+	fileop.internPaths()
 	return fileop
 }
 
@@ -2395,6 +2672,7 @@ func (fileop *FileOp) parse(opline string) *FileOp {
 	} else {
 		panic(throw("parse", "Unexpected fileop while parsing %q", opline))
 	}
+	fileop.internPaths()
 	return fileop
 }
 
@@ -2403,7 +2681,7 @@ func (fileop *FileOp) forget() {
 	if fileop.repo == nil {
 		return
 	}
-	if fileop.op == opM && fileop.ref != "inline" {
+	if (fileop.op == opM || fileop.op == opN) && fileop.ref != "inline" {
 		if blob, ok := fileop.repo.markToEvent(fileop.ref).(*Blob); ok {
 			blob.removeOperation(fileop)
 		}
@@ -2485,9 +2763,9 @@ func (fileop FileOp) String() string {
 func (fileop *FileOp) clone(newRepo *Repository) *FileOp {
 	newop := newFileOp(newRepo)
 	newop.committish = stringCopy(fileop.committish)
-	newop.Source = stringCopy(fileop.Source)
-	newop.mode = stringCopy(fileop.mode)
-	newop.Path = stringCopy(fileop.Path)
+	newop.Source = newRepo.intern(fileop.Source)
+	newop.mode = newRepo.intern(fileop.mode)
+	newop.Path = newRepo.intern(fileop.Path)
 	newop.ref = stringCopy(fileop.ref)
 	newop.inline = make([]byte, len(fileop.inline))
 	copy(newop.inline, fileop.inline)
@@ -2509,6 +2787,7 @@ type Callout struct {
 	mark   string
 	branch string
 	colors colorSet
+	uuid   string
 }
 
 func newCallout(mark string) *Callout {
@@ -2579,6 +2858,14 @@ func (callout Callout) isCommit() bool {
 	return false
 }
 
+func (callout Callout) getUUID() string {
+	return callout.uuid
+}
+
+func (callout *Callout) setUUID(uuid string) {
+	callout.uuid = uuid
+}
+
 func (callout Callout) getColor() colorSet {
 	return callout.colors
 }
@@ -2628,8 +2915,10 @@ type Commit struct {
 	_parentNodes   []CommitLike  // list of parent nodes - sparse, may contain nils
 	_childNodes    []CommitLike  // list of child nodes - sparse, may contain nils
 	hash           gitHashType   // Git hash of the commit
+	recorded       *oidRecord    // What original-oid told us, if anything
 	colors         colorSet      // Flag used during deletion operations
 	implicitParent bool          // Whether the first parent was implicit
+	uuid           string        // Stable identity of the event
 }
 
 func (commit Commit) getMark() string {
@@ -2651,6 +2940,14 @@ func (commit Commit) isCommit() bool {
 	return true
 }
 
+func (commit Commit) getUUID() string {
+	return commit.uuid
+}
+
+func (commit *Commit) setUUID(uuid string) {
+	commit.uuid = uuid
+}
+
 func (commit Commit) getColor() colorSet {
 	return commit.colors
 }
@@ -2684,7 +2981,16 @@ func (commit *Commit) detach(event Event) bool {
 	return false
 }
 
+// attach records a tag or reset as pointing at this commit.  The
+// stream reader attaches what newTag and newReset already have, so an
+// event attached twice is recorded once; otherwise detaching it would
+// leave it behind.
 func (commit *Commit) attach(event Event) {
+	for _, el := range commit.attachments {
+		if el == event {
+			return
+		}
+	}
 	commit.attachments = append(commit.attachments, event)
 }
 
@@ -2826,8 +3132,12 @@ func (commit *Commit) hasProperties() bool {
 }
 
 // lister enables DoList() to report commits.
-func (commit *Commit) lister(_modifiers orderedStringSet, eventnum int, cols int) string {
+func (commit *Commit) lister(modifiers orderedStringSet, eventnum int, cols int) string {
 	topline, _ := splitRuneFirst(commit.Comment, '\n')
+	if reportFormat(modifiers) != "" {
+		return reportRecord(modifiers, listerFields, []interface{}{eventnum + 1,
+			commit.date().rfc3339(), commit.mark, commit.gitHash().hexify(), commit.legacyID, topline})
+	}
 	summary := fmt.Sprintf("%6d %s %6s %s ",
 		eventnum+1, commit.date().rfc3339(), commit.mark, commit.gitHash().short())
 	if commit.legacyID != "" {
@@ -2844,6 +3154,9 @@ func (commit *Commit) lister(_modifiers orderedStringSet, eventnum int, cols int
 // stamp enables DoStamp() to report action stamps.
 func (commit *Commit) stamp(modifiers orderedStringSet, _eventnum int, cols int) string {
 	firstLine, _ := splitRuneFirst(commit.Comment, '\n')
+	if reportFormat(modifiers) != "" {
+		return reportRecord(modifiers, stampFields, []interface{}{commit.actionStamp(), firstLine})
+	}
 	report := "<" + commit.actionStamp() + "> " + firstLine
 	if cols > 0 && len(report) > cols {
 		report = utf8trunc(report, cols)
@@ -2852,7 +3165,7 @@ func (commit *Commit) stamp(modifiers orderedStringSet, _eventnum int, cols int)
 }
 
 // tags enables DoTags() to report tag tip commits.
-func (commit *Commit) tags(_modifiers orderedStringSet, eventnum int, _cols int) string {
+func (commit *Commit) tags(modifiers orderedStringSet, eventnum int, _cols int) string {
 	if commit.Branch == "" || !strings.Contains(commit.Branch, "/tags/") {
 		return ""
 	}
@@ -2874,14 +3187,26 @@ func (commit *Commit) tags(_modifiers orderedStringSet, eventnum int, _cols int)
 			return ""
 		}
 	}
+	if reportFormat(modifiers) != "" {
+		return reportRecord(modifiers, tagsFields, []interface{}{eventnum + 1, "commit", commit.Branch})
+	}
 	return fmt.Sprintf("%6d\tcommit\t%s", eventnum+1, commit.Branch)
 }
 
 // emailOut enables DoMsgout() to report commit metadata.
 func (commit *Commit) emailOut(modifiers orderedStringSet,
 	eventnum int, filterRegexp *regexp.Regexp) string {
+	var b strings.Builder
+	commit.emitMessage(&b, modifiers, eventnum, filterRegexp)
+	return b.String()
+}
+
+// emitMessage writes the metadata of this commit to w as a message block.
+func (commit *Commit) emitMessage(w io.Writer, modifiers orderedStringSet,
+	eventnum int, filterRegexp *regexp.Regexp) error {
 	msg, _ := newMessageBlock(nil)
 	msg.setHeader("Event-Number", fmt.Sprintf("%d", eventnum+1))
+	msg.setUUIDHeader(commit)
 	msg.setHeader("Event-Mark", commit.mark)
 	msg.setHeader("Branch", commit.Branch)
 	msg.setHeader("Parents", strings.Join(commit.parentMarks(), " "))
@@ -2911,15 +3236,15 @@ func (commit *Commit) emailOut(modifiers orderedStringSet,
 	check, _ := splitRuneFirst(commit.Comment, '\n')
 	msg.setHeader("Check-Text", utf8trunc(check, 54))
 	msg.setPayload(commit.Comment)
-	if commit.Comment != "" && !strings.HasSuffix(commit.Comment, "\n") && logEnable(logWARN) {
-		logit("in commit %s, comment was not LF-terminated.", commit.mark)
+	if commit.Comment != "" && !strings.HasSuffix(commit.Comment, "\n") {
+		warn("comment", "in commit %s, comment was not LF-terminated.", commit.mark)
 	}
 
 	if filterRegexp != nil {
 		msg.filterHeaders(filterRegexp)
 	}
 
-	return msg.String()
+	return msg.emit(w)
 }
 
 // actionStamp controls how an action stamp is made.
@@ -2964,6 +3289,11 @@ func stringSliceEqual(a, b []string) bool {
 
 var authorRE = regexp.MustCompile("Author[0-9]*$")
 
+// consumeMessage updates this commit from a message block.
+func (commit *Commit) consumeMessage(msg *MessageBlock) bool {
+	return commit.emailIn(msg, false)
+}
+
 // emailIn updates this commit from a parsed email message.
 func (commit *Commit) emailIn(msg *MessageBlock, fill bool) bool {
 	modified := false
@@ -3094,7 +3424,10 @@ func (commit *Commit) emailIn(msg *MessageBlock, fill bool) bool {
 			newprops.set(propkey, quoted[1:len(quoted)-1])
 		}
 	}
-	propsModified := (!commit.hasProperties() && newprops.Len() == 0) || !reflect.DeepEqual(newprops, commit.properties)
+	propsModified := newprops.Len() > 0
+	if commit.hasProperties() {
+		propsModified = !reflect.DeepEqual(&newprops, commit.properties)
+	}
 	if propsModified {
 		commit.properties = &newprops
 		modified = true
@@ -3271,19 +3604,30 @@ func (commit *Commit) invalidateManifests() {
 	// Do a traversal of the descendant graph, depth-first because it is the
 	// most efficient with a slice as the queue.
 	stack := []CommitLike{commit}
+	// If the manifest cache has forgotten manifests to make room, a
+	// commit without one may still have descendants with one.
+	var visited map[*Commit]bool
+	if manifestsEvicted() {
+		visited = make(map[*Commit]bool)
+	}
 	for len(stack) > 0 {
 		var current CommitLike
 		// pop a CommitLike from the stack
 		stack, current = stack[:len(stack)-1], stack[len(stack)-1]
 		// remove the memoized manifest
 		if c, ok := current.(*Commit); ok {
-			if c._manifest == nil {
+			if visited != nil {
+				if visited[c] {
+					continue
+				}
+				visited[c] = true
+			} else if c._manifest == nil {
 				// Because manifests are always generated recursively backwards
 				// when one is requested and doesn't exist, if this commit's
 				// manifest cache is nil none of its children can need clearing.
 				continue
 			}
-			c._manifest = nil
+			c.forgetManifest()
 			// and add all children to the "todo" stack
 			for it := c.childIterator(); it.Next(); {
 				stack = append(stack, it.Value())
@@ -3342,6 +3686,7 @@ func (commit *Commit) setParents(parents []CommitLike) {
 		}
 	}
 	commit._parentNodes = parents
+	commit.repo.invalidateReachability()
 	for _, parent := range commit._parentNodes {
 		if parent != nil {
 			// add self to new parent's children cache
@@ -3369,6 +3714,7 @@ func (commit *Commit) setParentMarks(marks []string) {
 func (commit *Commit) addParentCommit(newparent *Commit) {
 	commit._parentNodes = append(commit._parentNodes, newparent)
 	newparent.addChild(commit)
+	commit.repo.invalidateReachability()
 	// Only invalidate when needed: the manifest will not change if the first
 	// parent is the same or the commit's first fileop is a deleteall cutting
 	// ties with any first parent.
@@ -3414,6 +3760,7 @@ func (commit *Commit) insertParent(idx int, mark string) bool {
 	case *Commit:
 		newparent.(*Commit).addChild(commit)
 	}
+	commit.repo.invalidateReachability()
 	commit.invalidateManifests()
 	return true
 }
@@ -3421,6 +3768,7 @@ func (commit *Commit) insertParent(idx int, mark string) bool {
 func (commit *Commit) removeParent(event CommitLike) {
 	// remove *all* occurrences of event in parents
 	commit._parentNodes = commitRemove(commit._parentNodes, event)
+	commit.repo.invalidateReachability()
 	// and all occurrences of self in event's children
 	if c2, ok := event.(*Commit); ok {
 		c2._childNodes = commitRemove(c2._childNodes, commit)
@@ -3438,6 +3786,7 @@ func (commit *Commit) replaceParent(e1, e2 *Commit) {
 			commit._parentNodes[i] = e2
 			e1.removeChild(commit)
 			e2.addChild(commit)
+			commit.repo.invalidateReachability()
 			commit.invalidateManifests()
 			return
 		}
@@ -3619,6 +3968,34 @@ func (commit *Commit) visible(argpath string) *Commit {
 	// unreachable
 }
 
+// visibleInParents reports whether a path is visible in any parent of
+// this commit.  Unlike visible(), which follows first parents only,
+// this is the right check for a fileop in a merge commit, which may
+// refer to a file brought in on another line of development.
+func (commit *Commit) visibleInParents(argpath string) bool {
+	for _, parent := range commit.parents() {
+		p, ok := parent.(*Commit)
+		if !ok {
+			continue
+		}
+		ops := p.operations()
+		touched := false
+		for i := len(ops) - 1; i >= 0; i-- {
+			if ops[i].Path == argpath {
+				if ops[i].op != opD {
+					return true
+				}
+				touched = true
+				break
+			}
+		}
+		if !touched && p.visible(argpath) != nil {
+			return true
+		}
+	}
+	return false
+}
+
 // manifest returns a map from all pathnames visible at this commit
 // to Fileop structures. The map contents is shared as much as
 // possible with manifests from previous commits to keep working-set
@@ -3626,6 +4003,7 @@ func (commit *Commit) visible(argpath string) *Commit {
 func (commit *Commit) manifest() *Manifest {
 	// yeah, baby this operation is *so* memoized...
 	if commit._manifest != nil {
+		commit.touchManifest()
 		return commit._manifest
 	}
 	// Git only inherits files from the first parent of a commit.
@@ -3637,6 +4015,7 @@ func (commit *Commit) manifest() *Manifest {
 	// known, remembering which commits need to have their manifest computed.
 	commitsToHandle := []*Commit{}
 	ancestor := commit
+walk:
 	for ancestor._manifest == nil {
 		commitsToHandle = append(commitsToHandle, ancestor)
 		if !ancestor.hasParents() {
@@ -3647,7 +4026,7 @@ func (commit *Commit) manifest() *Manifest {
 			ancestor = p
 		case *Callout:
 			croak("internal error: can't get through a callout")
-			break
+			break walk
 		default:
 			panic("manifest() found unexpected type in parent list")
 		}
@@ -3673,7 +4052,7 @@ func (commit *Commit) manifest() *Manifest {
 		pm := manifest.snapshot()
 		commit.applyFileOps(pm, false, false)
 		manifest = pmToManifest(pm)
-		commit._manifest = manifest
+		commit.setManifest(manifest)
 	}
 	return manifest
 }
@@ -3710,7 +4089,7 @@ func (repo *Repository) walkManifests(
 			if inheritingChildren == 0 {
 				// Forget the manifest right away as commit has no children
 				// inheriting from it.
-				commit._manifest = nil
+				commit.forgetManifest()
 			} else {
 				// Remember the number of children so that we can forget
 				// the manifest at the correct time.
@@ -3722,14 +4101,14 @@ func (repo *Repository) walkManifests(
 			childrenToHandle[firstParentIdx]--
 			if childrenToHandle[firstParentIdx] == 0 {
 				delete(childrenToHandle, firstParentIdx)
-				firstParent._manifest = nil // Forget the now unneeded manifest
+				firstParent.forgetManifest() // Forget the now unneeded manifest
 			}
 		}
 	}
 	// Cleanup remaining manifests
 	for index, val := range childrenToHandle {
 		if val >= 0 {
-			repo.events[index].(*Commit)._manifest = nil
+			repo.events[index].(*Commit).forgetManifest()
 		}
 	}
 }
@@ -3738,7 +4117,31 @@ func (repo *Repository) walkManifests(
 // https://www.git-scm.com/book/en/v2/Git-Internals-Git-Objects
 // https://stackoverflow.com/questions/14790681/what-is-the-internal-format-of-a-git-tree-object
 
+// treeHashLock guards the hashes cached in shared PathMaps, which
+// hashAll computes from several goroutines at once.
+var treeHashLock sync.Mutex
+
 func (manifest *Manifest) gitHash() gitHashType {
+	return manifest.hashWith((*Blob).gitHash,
+		func(pm *PathMap) (gitHashType, bool) {
+			treeHashLock.Lock()
+			defer treeHashLock.Unlock()
+			hash, ok := pm.info.(gitHashType)
+			return hash, ok
+		},
+		func(pm *PathMap, hash gitHashType) {
+			// The PathMap is immutable, we can cache its hash
+			treeHashLock.Lock()
+			pm.info = hash
+			treeHashLock.Unlock()
+		})
+}
+
+// hashWith computes the tree hash of a manifest taking blob hashes from
+// blobHash.  Hashes of shared subtrees are looked up with lookup and,
+// when computed, kept with store.
+func (manifest *Manifest) hashWith(blobHash func(*Blob) gitHashType,
+	lookup func(*PathMap) (gitHashType, bool), store func(*PathMap, gitHashType)) gitHashType {
 	type Element struct {
 		name string
 		mode string
@@ -3746,7 +4149,7 @@ func (manifest *Manifest) gitHash() gitHashType {
 	}
 	var innerHash func(pm *PathMap) gitHashType
 	innerHash = func(pm *PathMap) gitHashType {
-		if hash, ok := pm.info.(gitHashType); ok {
+		if hash, ok := lookup(pm); ok {
 			return hash
 		}
 		elements := []Element{}
@@ -3763,7 +4166,13 @@ func (manifest *Manifest) gitHash() gitHashType {
 				elements = append(elements, Element{
 					mode: op.mode,
 					name: name,
-					hash: blob.gitHash(),
+					hash: blobHash(blob),
+				})
+			} else if op.ref == "inline" {
+				elements = append(elements, Element{
+					mode: op.mode,
+					name: name,
+					hash: gitHashString(fmt.Sprintf("blob %d\x00", len(op.inline)) + string(op.inline)),
 				})
 			} else {
 				// The ref is not a blob mark. This is probably a git link,
@@ -3787,82 +4196,293 @@ func (manifest *Manifest) gitHash() gitHashType {
 		}
 		body := sb.String()
 		hash := gitHashString(fmt.Sprintf("tree %d\x00%s", len(body), body))
-		if pm.shared { // The PathMap is immutable, we can cache its hash
-			pm.info = hash
+		if pm.shared {
+			store(pm, hash)
 		}
 		return hash
 	}
 	return innerHash(&manifest.PathMap)
 }
 
+// freshHash computes the tree hash of a manifest from blob content,
+// storing no hashes in its blobs or subtrees.
+func (manifest *Manifest) freshHash() gitHashType {
+	return manifest.hashWith((*Blob).contentHash,
+		func(*PathMap) (gitHashType, bool) { return nullGitHash, false },
+		func(*PathMap, gitHashType) {})
+}
+
 func (commit *Commit) gitHash() gitHashType {
 	if !commit.hash.isValid() {
-		var sb strings.Builder
-		// Assumptin: Git running under DOS still uses plain \n as a
-		// line separator. If this isn't true these "\n"s need to be
-		// replaced by control.lineSep.
-		sb.WriteString("tree " + commit.manifest().gitHash().hexify() + "\n")
-		for it := commit.parentIterator(); it.Next(); {
-			parent := it.Value()
-			switch parent.(type) {
-			case *Commit:
-				sb.WriteString("parent " + parent.(*Commit).gitHash().hexify() + "\n")
-			case *Callout:
-				// Ignore this case
-			default:
-				panic("In gitHash method, unexpected type in child list")
-			}
-		}
-		// Git doesn't support multiple authors, so we'll probably see
-		// bogons if there's ever more than one generated in here.
-		// But this loop is uniform
-		for _, author := range commit.authors {
-			sb.WriteString("author " + author.String() + "\n")
-		}
-		sb.WriteString("committer " + commit.committer.String() + "\n")
-		sb.WriteString("\n")
-		sb.WriteString(commit.Comment)
-		body := sb.String()
-		commit.hash = gitHashString(fmt.Sprintf("commit %d\x00", len(body)) + body)
+		commit.hash = commit.hashWithTree(commit.manifest().gitHash())
 	}
 	return commit.hash
 }
 
-// canonicalize replaces fileops by a minimal set of D and M with same result.
-func (commit *Commit) canonicalize() {
-	// Discard everything before the last deleteall
-	commit.discardOpsBeforeLastDeleteAll()
-	ops := commit.operations()
-	if len(ops) == 0 {
-		return
-	}
-	// Fetch the tree state before us...
-	var previous PathMapLike
-	if !commit.hasParents() {
-		previous = &FlatPathMap{}
-	} else {
-		p := commit.firstParent()
-		switch p.(type) {
+// hashWithTree computes the commit hash given its tree hash.  Parent
+// hashes are computed if they aren't already known.
+func (commit *Commit) hashWithTree(tree gitHashType) gitHashType {
+	parents := make([]gitHashType, 0, len(commit._parentNodes))
+	for it := commit.parentIterator(); it.Next(); {
+		parent := it.Value()
+		switch parent.(type) {
 		case *Commit:
-			previous = p.(*Commit).manifest()
+			parents = append(parents, parent.(*Commit).gitHash())
 		case *Callout:
-			croak("internal error: can't get through a callout")
-			return
+			// Ignore this case
 		default:
-			panic("manifest() found unexpected type in parent list")
+			panic("In gitHash method, unexpected type in child list")
 		}
 	}
-	// And our tree state
-	current := commit.manifest()
-	newops := newOrderedFlatPathMap()
-	// Generate needed D fileops.
-	if commit.fileops[0].op == deleteall {
-		// There was a deleteall, all paths in previous can disappear
-		previous.iter(func(cpath string, _ interface{}) {
-			if _, found := current.get(cpath); !found {
-				fileop := newFileOp(commit.repo)
-				fileop.construct(opD, cpath)
-				newops.set(cpath, fileop)
+	return commit.hashWithParents(tree, parents)
+}
+
+// hashWithParents computes the commit hash given its tree and parent hashes.
+func (commit *Commit) hashWithParents(tree gitHashType, parents []gitHashType) gitHashType {
+	var sb strings.Builder
+	// Assumptin: Git running under DOS still uses plain \n as a
+	// line separator. If this isn't true these "\n"s need to be
+	// replaced by control.lineSep.
+	sb.WriteString("tree " + tree.hexify() + "\n")
+	for _, parent := range parents {
+		sb.WriteString("parent " + parent.hexify() + "\n")
+	}
+	sb.WriteString(commit.hashTrailer())
+	body := sb.String()
+	return gitHashString(fmt.Sprintf("commit %d\x00", len(body)) + body)
+}
+
+// hashTrailer returns the part of a Git commit object following the
+// tree and parent lines.
+func (commit *Commit) hashTrailer() string {
+	var sb strings.Builder
+	// Git doesn't support multiple authors, so we'll probably see
+	// bogons if there's ever more than one generated in here.
+	// But this loop is uniform
+	for _, author := range commit.authors {
+		sb.WriteString("author " + author.String() + "\n")
+	}
+	sb.WriteString("committer " + commit.committer.String() + "\n")
+	sb.WriteString("\n")
+	sb.WriteString(commit.Comment)
+	return sb.String()
+}
+
+// hashAll computes the Git hash of every blob and commit in the
+// repository that doesn't already have one, spreading the work over
+// worker goroutines unless the serial flag is on.  Blobs are
+// independent and are hashed first.  Manifests have to be built in
+// sequence, so trees are hashed in parallel batches as the manifest
+// walk produces them.  Commits are then scheduled topologically: each
+// becomes ready to hash when the last of its parents is done.
+func (repo *Repository) hashAll(baton *Baton) {
+	workers := workerCount()
+	blobs := newSelectionSet()
+	commits := make([]*Commit, 0)
+	position := make(map[*Commit]int)
+	for i, event := range repo.events {
+		switch e := event.(type) {
+		case *Blob:
+			if !e.hash.isValid() {
+				blobs.Add(i)
+			}
+		case *Commit:
+			if !e.hash.isValid() {
+				position[e] = len(commits)
+				commits = append(commits, e)
+			}
+		}
+	}
+
+	var count uint64
+	baton.startProgress("hash blobs", uint64(blobs.Size()))
+	repo.walkEvents(blobs, func(i int, event Event) bool {
+		event.(*Blob).gitHash()
+		baton.percentProgress(atomic.AddUint64(&count, 1))
+		return true
+	})
+	baton.endProgress()
+	if len(commits) == 0 {
+		return
+	}
+
+	type treeJob struct {
+		k        int
+		manifest *Manifest
+	}
+	trees := make([]gitHashType, len(commits))
+	batch := make([]treeJob, 0, workers*64)
+	count = 0
+	baton.startProgress("hash trees", uint64(len(commits)))
+	flush := func() {
+		var wg sync.WaitGroup
+		jobs := make(chan treeJob, len(batch))
+		for _, job := range batch {
+			jobs <- job
+		}
+		close(jobs)
+		wg.Add(workers)
+		for n := 0; n < workers; n++ {
+			go func() {
+				defer wg.Done()
+				for job := range jobs {
+					trees[job.k] = job.manifest.gitHash()
+				}
+			}()
+		}
+		wg.Wait()
+		count += uint64(len(batch))
+		baton.percentProgress(count)
+		batch = batch[:0]
+	}
+	repo.walkManifests(func(idx int, commit *Commit, _ int, _ *Commit) {
+		if k, ok := position[commit]; ok {
+			// Holding the manifest keeps it alive after the walk
+			// forgets it
+			batch = append(batch, treeJob{k, commit.manifest()})
+			if len(batch) == cap(batch) {
+				flush()
+			}
+		}
+	})
+	flush()
+	baton.endProgress()
+
+	pending := make([]int32, len(commits))
+	for k, commit := range commits {
+		for _, parent := range commit.parents() {
+			if p, ok := parent.(*Commit); ok {
+				if _, ok := position[p]; ok {
+					pending[k]++
+				}
+			}
+		}
+	}
+	ready := make(chan int, len(commits))
+	for k := range commits {
+		if pending[k] == 0 {
+			ready <- k
+		}
+	}
+	count = 0
+	baton.startProgress("hash commits", uint64(len(commits)))
+	var wg sync.WaitGroup
+	wg.Add(len(commits))
+	for n := 0; n < workers; n++ {
+		go func() {
+			for k := range ready {
+				commit := commits[k]
+				commit.hash = commit.hashWithTree(trees[k])
+				for _, child := range commit.children() {
+					if c, ok := child.(*Commit); ok {
+						if ck, ok := position[c]; ok && atomic.AddInt32(&pending[ck], -1) == 0 {
+							ready <- ck
+						}
+					}
+				}
+				baton.percentProgress(atomic.AddUint64(&count, 1))
+				wg.Done()
+			}
+		}()
+	}
+	wg.Wait()
+	close(ready)
+	baton.endProgress()
+}
+
+// equivalent tells whether two commits, possibly in different
+// repositories, record the same change: same attributions, same
+// comment, parents with the same action stamps, and the same tree.
+// Marks, branches, legacy IDs and properties are not compared. This is
+// much cheaper than comparing serializations because tree hashes are
+// memoized.
+func (commit *Commit) equivalent(other *Commit) bool {
+	return commit == other || len(commit.differences(other, true)) == 0
+}
+
+// differences lists the respects in which two commits fail to be
+// equivalent, among committer, authors, comment, parents and tree, in
+// that order.  With firstOnly it stops at the first one found, so the
+// tree hashes are computed only when everything else matches.
+func (commit *Commit) differences(other *Commit, firstOnly bool) []string {
+	found := make([]string, 0)
+	differ := func(field string) bool {
+		found = append(found, field)
+		return firstOnly
+	}
+	if !commit.committer.Equal(&other.committer) && differ("committer") {
+		return found
+	}
+	authors := len(commit.authors) == len(other.authors)
+	for i := 0; authors && i < len(commit.authors); i++ {
+		authors = commit.authors[i].Equal(&other.authors[i])
+	}
+	if !authors && differ("authors") {
+		return found
+	}
+	if commit.Comment != other.Comment && differ("comment") {
+		return found
+	}
+	stamp := func(parent CommitLike) string {
+		if c, ok := parent.(*Commit); ok {
+			return c.actionStamp()
+		}
+		return parent.callout()
+	}
+	parents := commit.parentCount() == other.parentCount()
+	if parents {
+		otherParents := other.parents()
+		for i, parent := range commit.parents() {
+			if stamp(parent) != stamp(otherParents[i]) {
+				parents = false
+				break
+			}
+		}
+	}
+	if !parents && differ("parents") {
+		return found
+	}
+	if commit.manifest().gitHash() != other.manifest().gitHash() {
+		differ("tree")
+	}
+	return found
+}
+
+// canonicalize replaces fileops by a minimal set of D and M with same result.
+func (commit *Commit) canonicalize() {
+	// Discard everything before the last deleteall
+	commit.discardOpsBeforeLastDeleteAll()
+	ops := commit.operations()
+	if len(ops) == 0 {
+		return
+	}
+	// Fetch the tree state before us...
+	var previous PathMapLike
+	if !commit.hasParents() {
+		previous = &FlatPathMap{}
+	} else {
+		p := commit.firstParent()
+		switch p.(type) {
+		case *Commit:
+			previous = p.(*Commit).manifest()
+		case *Callout:
+			croak("internal error: can't get through a callout")
+			return
+		default:
+			panic("manifest() found unexpected type in parent list")
+		}
+	}
+	// And our tree state
+	current := commit.manifest()
+	newops := newOrderedFlatPathMap()
+	// Generate needed D fileops.
+	if commit.fileops[0].op == deleteall {
+		// There was a deleteall, all paths in previous can disappear
+		previous.iter(func(cpath string, _ interface{}) {
+			if _, found := current.get(cpath); !found {
+				fileop := newFileOp(commit.repo)
+				fileop.construct(opD, cpath)
+				newops.set(cpath, fileop)
 			}
 		})
 	} else {
@@ -4245,6 +4865,7 @@ type Passthrough struct {
 	repo   *Repository
 	text   string
 	colors colorSet
+	uuid   string
 }
 
 func (p Passthrough) getColor() colorSet {
@@ -4285,18 +4906,36 @@ func (p *Passthrough) clone() *Passthrough {
 }
 
 // emailOut enables DoMsgout() to report these.
-func (p *Passthrough) emailOut(_modifiers orderedStringSet,
-	eventnum int, _filterRegexp *regexp.Regexp) string {
+func (p *Passthrough) emailOut(modifiers orderedStringSet,
+	eventnum int, filterRegexp *regexp.Regexp) string {
+	var b strings.Builder
+	p.emitMessage(&b, modifiers, eventnum, filterRegexp)
+	return b.String()
+}
+
+// emitMessage writes this passthrough to w as a message block.
+func (p *Passthrough) emitMessage(w io.Writer, _modifiers orderedStringSet,
+	eventnum int, _filterRegexp *regexp.Regexp) error {
 	msg, _ := newMessageBlock(nil)
 	msg.setHeader("Event-Number", fmt.Sprintf("%d", eventnum+1))
+	msg.setUUIDHeader(p)
 	msg.setPayload(p.text)
-	return msg.String()
+	return msg.emit(w)
 }
 
 func (p *Passthrough) emailIn(msg *MessageBlock) {
 	p.text = msg.getPayload()
 }
 
+// consumeMessage updates this passthrough from a message block.
+func (p *Passthrough) consumeMessage(msg *MessageBlock) bool {
+	if msg.getPayload() == p.text {
+		return false
+	}
+	p.emailIn(msg)
+	return true
+}
+
 // idMe IDs this passthrough for humans."
 func (p *Passthrough) idMe() string {
 	return fmt.Sprintf("passthrough@%d", p.repo.eventToIndex(p))
@@ -4329,6 +4968,94 @@ func (p Passthrough) isCommit() bool {
 	return false
 }
 
+func (p Passthrough) getUUID() string {
+	return p.uuid
+}
+
+func (p *Passthrough) setUUID(uuid string) {
+	p.uuid = uuid
+}
+
+// passthroughs returns the passthroughs in a selection.
+func (repo *Repository) passthroughs(selection selectionSet) []*Passthrough {
+	out := make([]*Passthrough, 0)
+	for it := selection.Iterator(); it.Next(); {
+		if p, ok := repo.events[it.Value()].(*Passthrough); ok {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// addPassthrough inserts a passthrough with the given text.  If front
+// is true it goes at the start of the stream; otherwise, if after is a
+// valid event index it goes immediately after that event, and failing
+// both it goes at the end (but before any terminating "done").
+func (repo *Repository) addPassthrough(text string, front bool, after int) *Passthrough {
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	p := newPassthrough(repo, text)
+	if front {
+		repo.insertEvent(p, 0, "passthrough insertion")
+	} else if after >= 0 && after < len(repo.events) {
+		repo.insertEvent(p, after+1, "passthrough insertion")
+	} else {
+		repo.addEvent(p)
+		repo.declareSequenceMutation("passthrough insertion")
+	}
+	return p
+}
+
+// deletePassthroughs removes the passthroughs in a selection, ignoring
+// other events.  Returns the count removed.
+func (repo *Repository) deletePassthroughs(selection selectionSet) int {
+	doomed := make(map[Event]bool)
+	for _, p := range repo.passthroughs(selection) {
+		doomed[p] = true
+	}
+	if len(doomed) == 0 {
+		return 0
+	}
+	kept := make([]Event, 0, len(repo.events)-len(doomed))
+	for _, event := range repo.events {
+		if !doomed[event] {
+			kept = append(kept, event)
+		}
+	}
+	repo.events = kept
+	repo.declareSequenceMutation("passthrough deletion")
+	return len(doomed)
+}
+
+// rewritePassthroughs runs the text of the passthroughs in a selection
+// through a hook, setting Q bits on those it changes.  A newline is
+// supplied if the result lacks one; a passthrough rewritten to empty
+// text is deleted.  Returns the counts of passthroughs modified and
+// deleted.
+func (repo *Repository) rewritePassthroughs(selection selectionSet, hook func(string) string) (int, int) {
+	repo.clearColor(colorQSET)
+	modified := 0
+	emptied := newSelectionSet()
+	for _, p := range repo.passthroughs(selection) {
+		text := hook(p.text)
+		if text == p.text {
+			continue
+		}
+		if strings.TrimSpace(text) == "" {
+			emptied.Add(repo.eventToIndex(p))
+			continue
+		}
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		p.text = text
+		p.addColor(colorQSET)
+		modified++
+	}
+	return modified, repo.deletePassthroughs(emptied)
+}
+
 // Generic extractor code begins here
 
 // capture runs a specified command, capturing the output.
@@ -4368,7 +5095,9 @@ type StreamParser struct {
 	ccount      int64
 	linebuffers [][]byte
 	lastcookie  Cookie
-	svnReader   // Opaque state of the Subversion dump reader
+	aliases     map[string]string // Marks made by alias or on tags
+	tolerant    bool              // Quarantine malformed constructs and read on
+	svnReader                     // Opaque state of the Subversion dump reader
 }
 
 // newSteamParser parses a fast-import stream or Subversion dump to a Repository.
@@ -4376,9 +5105,30 @@ func newStreamParser(repo *Repository) *StreamParser {
 	sp := new(StreamParser)
 	sp.repo = repo
 	sp.linebuffers = make([][]byte, 0)
+	sp.aliases = make(map[string]string)
 	return sp
 }
 
+// unalias returns the mark an alias stands for, or its argument if it
+// isn't one.  Aliases only exist in the stream; every reference to one
+// is rewritten to the mark of the object it names.  An alias is
+// resolved when it is made, so there are no chains to follow.
+func (sp *StreamParser) unalias(mark string) string {
+	if target, ok := sp.aliases[mark]; ok {
+		return target
+	}
+	return mark
+}
+
+// isQuery tells whether a line is a fast-import command that asks the
+// importer a question.  The answer goes back to the frontend over its
+// cat-blob-fd, so in a stored stream there is nothing to keep.
+func isQuery(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("ls ")) ||
+		bytes.HasPrefix(line, []byte("cat-blob ")) ||
+		bytes.HasPrefix(line, []byte("get-mark "))
+}
+
 func (sp *StreamParser) error(msg string) {
 	// Throw fatal error during parsing.
 	panic(throw("parse", "%d: %s", sp.importLine, msg))
@@ -4398,14 +5148,15 @@ func (sp *StreamParser) errorLocation() string {
 
 func (sp *StreamParser) warn(msg string) {
 	// Display a parse warning associated with a line but don't error out.
-	if logEnable(logWARN) {
+	// Repeats are judged without the location, which is always unique.
+	if control.warnings.note("parse", msg) && logEnable(logWARN) {
 		logit(sp.errorLocation() + msg)
 	}
 }
 
 func (sp *StreamParser) shout(msg string) {
 	// A gripe with line number
-	if logEnable(logSHOUT) {
+	if control.warnings.note("stream", msg) && logEnable(logSHOUT) {
 		shout(sp.errorLocation() + msg)
 	}
 
@@ -4530,6 +5281,74 @@ func (sp *StreamParser) fiReadData(line []byte) ([]byte, int64) {
 	return data, start
 }
 
+// lineCounter counts the newlines passing through a reader.
+type lineCounter struct {
+	r     io.Reader
+	lines int
+}
+
+func (lc *lineCounter) Read(p []byte) (int, error) {
+	n, err := lc.r.Read(p)
+	lc.lines += bytes.Count(p[:n], []byte("\n"))
+	return n, err
+}
+
+// fiSpillData reads the data section of a blob without holding it in
+// memory, if it is a counted one larger than the spill size.  The
+// content is left in a seekable input, or else copied straight to the
+// blob's file.  Otherwise nothing is read and false is returned.
+func (sp *StreamParser) fiSpillData(blob *Blob) bool {
+	if control.spillSize <= 0 {
+		return false
+	}
+	var line []byte
+	switch len(sp.linebuffers) {
+	case 0:
+		line = sp.fiReadline()
+		sp.pushback(line)
+	case 1:
+		line = sp.linebuffers[0]
+	default:
+		return false
+	}
+	if !bytes.HasPrefix(line, []byte("data ")) || bytes.HasPrefix(line, []byte("data <<")) {
+		return false
+	}
+	count, err := strconv.ParseInt(strings.TrimSpace(string(line[5:])), 10, 64)
+	if err != nil || count <= control.spillSize {
+		return false
+	}
+	sp.fiReadline()
+	start := sp.ccount
+	counter := &lineCounter{r: io.LimitReader(sp.fp, count)}
+	if sp.repo.seekstream != nil && !control.flagOptions["materialize"] {
+		var n int64
+		n, err = io.Copy(ioutil.Discard, counter)
+		if err == nil && n != count {
+			err = io.ErrUnexpectedEOF
+		}
+		blob.start = start
+		blob.size = count
+		blob.cookie = nil
+		blob.hash.invalidate()
+	} else {
+		blob.setContentFromStream(ioutil.NopCloser(counter))
+		if blob.size != count {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err != nil {
+		sp.error("bad read in data")
+	}
+	sp.ccount += count
+	sp.importLine += counter.lines
+	line = sp.readline()
+	if string(line) != "\n" {
+		sp.pushback(line) // Data commands optionally end with LF
+	}
+	return true
+}
+
 func (sp *StreamParser) fiParseFileop(fileop *FileOp) {
 	// Read a fast-import fileop
 	if fileop.ref[0] == ':' {
@@ -4562,6 +5381,7 @@ func matchesFastImportHeader(line []byte) bool {
 		"blob",
 		"commit",
 		"feature",
+		"option",
 		"reset",
 		"#",
 	}
@@ -4574,39 +5394,155 @@ func matchesFastImportHeader(line []byte) bool {
 	return false
 }
 
-func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesize int64) {
-	// Beginning of fast-import stream parsing
-	commitcount := 0
-	branchPosition := make(map[string]*Commit)
-	baton.startProgress("parse fast import stream", uint64(filesize))
+// In tolerant mode, a malformed construct in a fast-import stream
+// doesn't end the read.  Where something safe can stand in for what
+// is wrong it does: an empty placeholder blob for a blob reference
+// that can't be resolved, a placeholder committer for a commit without
+// one, and no parent instead of one that can't be found.  Otherwise
+// the event being read is abandoned and reading resumes at the next
+// line that can begin one.  Either way the problem goes into the
+// repository's quarantine report, so the salvage can be checked.
+
+// quarantine records a malformed construct met in tolerant mode.
+func (sp *StreamParser) quarantine(line int, msg string) {
+	msg = strings.ReplaceAll(msg, "\n", "")
+	sp.repo.quarantined = append(sp.repo.quarantined, fmt.Sprintf("line %d: %s", line, msg))
+	sp.warn(msg)
+}
+
+// beginsEvent tells whether a line can begin a top-level construct of
+// a fast-import stream.
+func beginsEvent(line []byte) bool {
+	for _, keyword := range []string{"blob\n", "commit ", "reset ", "tag ", "alias\n", "progress ", "feature ", "option ", "checkpoint", "done\n"} {
+		if bytes.HasPrefix(line, []byte(keyword)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resync skips to the next line that can begin an event.
+func (sp *StreamParser) resync() {
+	skipped := 0
+	for {
+		line := sp.fiReadline()
+		if len(line) == 0 {
+			break
+		} else if beginsEvent(line) {
+			sp.pushback(line)
+			break
+		}
+		skipped++
+	}
+	if skipped > 0 {
+		n := len(sp.repo.quarantined) - 1
+		sp.repo.quarantined[n] += fmt.Sprintf(" (%d lines skipped)", skipped)
+	}
+}
+
+// placeholderBlob makes an empty blob for a modification whose blob
+// mark can't be resolved.
+func (sp *StreamParser) placeholderBlob(fileop *FileOp) {
+	blob := newBlob(sp.repo)
+	blob.setMark(fileop.ref)
+	blob.setContent([]byte{}, noOffset)
+	blob.appendOperation(fileop)
+	sp.repo.addEvent(blob)
+	sp.quarantine(sp.importLine, fmt.Sprintf("ref %s could not be resolved; an empty placeholder blob was made", fileop.ref))
+}
+
+// placeholderCommitter gives a commit without a committer the
+// conversion bot, dated like its first author or else like the
+// previous commit on its branch.
+func (sp *StreamParser) placeholderCommitter(commit *Commit, previous *Commit, line int) {
+	date := "0 +0000"
+	if len(commit.authors) > 0 {
+		date = commit.authors[0].date.String()
+	} else if previous != nil {
+		date = previous.committer.date.String()
+	}
+	attrib, err := newAttribution(conversionBot + " " + date)
+	if err != nil {
+		sp.error(fmt.Sprintf("making placeholder committer: %v", err))
+	}
+	commit.committer = *attrib
+	sp.quarantine(line, fmt.Sprintf("commit %s has no committer; a placeholder was made", commit.mark))
+}
+
+// parseFastImportEvents reads events until the end of the stream or
+// the read limit, returning true.  In tolerant mode a parse error is
+// quarantined and false is returned, leaving the caller to skip to
+// the next event and carry on.
+func (sp *StreamParser) parseFastImportEvents(baton *Baton, commitcount *int, branchPosition map[string]*Commit) (finished bool) {
+	if sp.tolerant {
+		defer func() {
+			if e := catch("parse", recover()); e != nil {
+				sp.quarantine(sp.importLine, strings.TrimPrefix(e.message, fmt.Sprintf("%d: ", sp.importLine)))
+				finished = false
+			}
+		}()
+	}
 	for {
 		line := sp.fiReadline()
 		if len(line) == 0 {
 			break
 		} else if len(bytes.TrimSpace(line)) == 0 {
 			continue
-		} else if bytes.HasPrefix(line, []byte("progress")) {
+		} else if bytes.HasPrefix(line, []byte("progress")) || isQuery(line) {
 			continue
+		} else if string(line) == "done\n" {
+			// Whatever follows isn't part of the stream
+			sp.repo.addEvent(newPassthrough(sp.repo, string(line)))
+			break
+		} else if bytes.HasPrefix(line, []byte("alias")) {
+			var mark, target string
+			line = sp.fiReadline()
+			if bytes.HasPrefix(line, []byte("mark")) {
+				mark = string(bytes.TrimSpace(line[5:]))
+			} else {
+				sp.error("missing mark after alias")
+			}
+			line = sp.fiReadline()
+			if bytes.HasPrefix(line, []byte("to")) {
+				target = sp.unalias(string(bytes.TrimSpace(line[3:])))
+			} else {
+				sp.error("missing 'to' field in alias")
+			}
+			if mark == target {
+				sp.error(fmt.Sprintf("alias %s refers to itself", mark))
+			}
+			sp.aliases[mark] = target
 		} else if bytes.HasPrefix(line, []byte("blob")) {
 			blob := newBlob(sp.repo)
 			line = sp.fiReadline()
 			if bytes.HasPrefix(line, []byte("mark")) {
 				sp.repo.markseq++
 				blob.setMark(strings.TrimSpace(string(line[5:])))
+				delete(sp.aliases, blob.mark)
 			} else {
 				sp.error("missing mark after blob")
 			}
 			line = sp.fiReadline()
+			var oid gitHashType
 			if bytes.HasPrefix(line, []byte("original-oid")) {
-				blob.hash = newGitHash(bytes.Fields(line)[1])
+				oid = newGitHash(bytes.Fields(line)[1])
 			} else {
 				sp.pushback(line)
 			}
-			blobcontent, blobstart := sp.fiReadData([]byte{})
-			if control.flagOptions["materialize"] {
-				blob.setContent(blobcontent, noOffset)
-			} else {
-				blob.setContent(blobcontent, blobstart)
+			var blobcontent []byte
+			if !sp.fiSpillData(blob) {
+				var blobstart int64
+				blobcontent, blobstart = sp.fiReadData([]byte{})
+				if control.flagOptions["materialize"] {
+					blob.setContent(blobcontent, noOffset)
+				} else {
+					blob.setContent(blobcontent, blobstart)
+				}
+			}
+			// Set after the content, which invalidates the hash
+			if oid.isValid() {
+				blob.hash = oid
+				blob.oid = oid
 			}
 			if cookie := blob.parseCookie(string(blobcontent)); cookie != nil {
 				sp.lastcookie = *cookie
@@ -4620,24 +5556,26 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 			commitbegin := sp.importLine
 			commit := newCommit(sp.repo)
 			commit.setBranch(strings.Fields(string(line))[1])
+			var oid gitHashType
 			for {
 				line = sp.fiReadline()
 				if len(line) == 0 {
 					break
 				} else if bytes.HasPrefix(line, []byte("original-oid")) {
-					fmt.Sscan(string(bytes.Fields(line)[1]), "%x", commit.hash)
+					oid = newGitHash(bytes.Fields(line)[1])
 				} else if bytes.HasPrefix(line, []byte("#legacy-id")) {
 					// reposurgeon extension, expected to
 					// be immediately after "commit" if present
 					commit.legacyID = string(bytes.Fields(line)[1])
 					if sp.repo.vcs != nil {
-						sp.repo.legacyMap[strings.ToUpper(sp.repo.vcs.name)+":"+commit.legacyID] = commit
+						sp.repo.setLegacy(strings.ToUpper(sp.repo.vcs.name)+":"+commit.legacyID, commit)
 					} else {
-						sp.repo.legacyMap[commit.legacyID] = commit
+						sp.repo.setLegacy(commit.legacyID, commit)
 					}
 				} else if bytes.HasPrefix(line, []byte("mark")) {
 					sp.repo.markseq++
 					commit.setMark(string(bytes.TrimSpace(line[5:])))
+					delete(sp.aliases, commit.mark)
 				} else if bytes.HasPrefix(line, []byte("author")) {
 					attrib, err := newAttribution(string(line[7:]))
 					if err != nil {
@@ -4653,8 +5591,10 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 					commit.committer = *attrib
 					sp.repo.tzmap[attrib.email] = attrib.date.timestamp.Location()
 				} else if bytes.HasPrefix(line, []byte("property")) {
-					newprops := newOrderedMap()
-					commit.properties = &newprops
+					if !commit.hasProperties() {
+						newprops := newOrderedMap()
+						commit.properties = &newprops
+					}
 					fields := bytes.Split(line, []byte(" "))
 					if len(fields) < 3 {
 						sp.error("malformed property line")
@@ -4690,7 +5630,7 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 							for scanner.Scan() {
 								line := scanner.Text()
 								if line != "" {
-									sp.repo.legacyMap["CVS:"+line] = commit
+									sp.repo.setLegacy("CVS:"+line, commit)
 								}
 							}
 						}
@@ -4702,9 +5642,11 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 						commit.Comment = canonicalizeComment(commit.Comment)
 					}
 				} else if bytes.HasPrefix(line, []byte("from")) || bytes.HasPrefix(line, []byte("merge")) {
-					mark := string(bytes.Fields(line)[1])
+					mark := sp.unalias(string(bytes.Fields(line)[1]))
 					if isCallout(mark) {
 						commit.addCallout(mark)
+					} else if _, ok := sp.repo.markToEvent(mark).(*Commit); !ok && sp.tolerant {
+						sp.quarantine(sp.importLine, fmt.Sprintf("parent %s could not be resolved; it was dropped", mark))
 					} else {
 						commit.addParentByMark(mark)
 					}
@@ -4715,6 +5657,7 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 				} else if line[0] == opM {
 					fileop := newFileOp(sp.repo).parse(string(line))
 					if fileop.ref != "inline" {
+						fileop.ref = sp.unalias(fileop.ref)
 						ref := sp.repo.markToEvent(fileop.ref)
 						if ref != nil {
 							ref.(*Blob).appendOperation(fileop)
@@ -4725,7 +5668,11 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 							// submodule
 							// link.
 							if fileop.mode != "160000" {
-								sp.error(fmt.Sprintf("ref %s could not be resolved", fileop.ref))
+								if sp.tolerant && strings.HasPrefix(fileop.ref, ":") {
+									sp.placeholderBlob(fileop)
+								} else {
+									sp.error(fmt.Sprintf("ref %s could not be resolved", fileop.ref))
+								}
 							}
 						}
 					}
@@ -4757,7 +5704,12 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 					fileop := newFileOp(sp.repo).parse(string(line))
 					commit.appendOperation(fileop)
 					sp.fiParseFileop(fileop)
+					if blob, ok := sp.repo.markToEvent(fileop.ref).(*Blob); ok {
+						blob.appendOperation(fileop)
+					}
 					sp.repo.inlines++
+				} else if isQuery(line) {
+					continue
 				} else if len(bytes.TrimSpace(line)) == 0 {
 					// This handles slightly broken
 					// exporters like the bzr-fast-export
@@ -4787,7 +5739,9 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 			}
 			hasCommitter := !commit.committer.isEmpty()
 			hasMark := commit.mark != ""
-			if !(hasMark && hasCommitter) {
+			if hasMark && !hasCommitter && sp.tolerant {
+				sp.placeholderCommitter(commit, branchPosition[commit.Branch], commitbegin)
+			} else if !(hasMark && hasCommitter) {
 				sp.importLine = commitbegin
 				sp.error("missing required fields in commit")
 			}
@@ -4798,23 +5752,26 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 				commit.addParentCommit(p)
 				commit.implicitParent = true
 			}
+			if oid.isValid() {
+				// Set last, as adding parents and fileops invalidates it
+				commit.hash = oid
+				commit.record()
+			}
 			sp.repo.addEvent(commit)
 			branchPosition[commit.Branch] = commit
-			commitcount++
+			*commitcount++
 			baton.twirl()
 		} else if bytes.HasPrefix(line, []byte("reset")) {
 			reset := newReset(sp.repo, "", "", "")
 			reset.ref = string(bytes.TrimSpace(line[6:]))
 			line = sp.fiReadline()
 			if bytes.HasPrefix(line, []byte("from")) {
-				committish := string(bytes.TrimSpace(line[5:]))
+				committish := sp.unalias(string(bytes.TrimSpace(line[5:])))
 				reset.remember(sp.repo, committish)
 				if commit, ok := sp.repo.markToEvent(committish).(*Commit); ok {
 					branchPosition[reset.ref] = commit
 				} else {
-					if logEnable(logWARN) {
-						logit("non-mark committish in reset")
-					}
+					warn("reset", "non-mark committish in reset")
 					delete(branchPosition, reset.ref)
 				}
 			} else {
@@ -4836,12 +5793,22 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 				legacyID = string(bytes.Fields(line)[1])
 				line = sp.fiReadline()
 			}
+			// A tag's own mark is kept only as an alias for
+			// what it points at; tags don't have marks here.
+			tagmark := ""
+			if bytes.HasPrefix(line, []byte("mark")) {
+				tagmark = string(bytes.TrimSpace(line[5:]))
+				line = sp.fiReadline()
+			}
 			var referent string
 			if bytes.HasPrefix(line, []byte("from")) {
-				referent = string(bytes.TrimSpace(line[5:]))
+				referent = sp.unalias(string(bytes.TrimSpace(line[5:])))
 			} else {
 				sp.error(fmt.Sprintf("missing 'from' field in tag %q", tagname))
 			}
+			if tagmark != "" && tagmark != referent {
+				sp.aliases[tagmark] = referent
+			}
 			line = sp.fiReadline()
 			if bytes.HasPrefix(line, []byte("original-oid")) {
 				hash = newGitHash(bytes.Fields(line)[1])
@@ -4870,16 +5837,30 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 			sp.error("unexpected Subversion header in fast-import stream")
 		} else {
 			// Simply pass through any line we do not understand.
+			if bytes.HasPrefix(line, []byte("option")) {
+				sp.noteOption(string(line))
+			}
 			sp.repo.addEvent(newPassthrough(sp.repo, string(line)))
 		}
 		baton.percentProgress(uint64(sp.ccount))
-		if control.readLimit > 0 && uint64(commitcount) >= control.readLimit {
+		if control.readLimit > 0 && uint64(*commitcount) >= control.readLimit {
 			if logEnable(logSHOUT) {
 				shout("read limit %d reached", control.readLimit)
 			}
 			break
 		}
 	}
+	return true
+}
+
+func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesize int64) {
+	// Beginning of fast-import stream parsing
+	commitcount := 0
+	branchPosition := make(map[string]*Commit)
+	baton.startProgress("parse fast import stream", uint64(filesize))
+	for !sp.parseFastImportEvents(baton, &commitcount, branchPosition) {
+		sp.resync()
+	}
 	baton.endProgress()
 	if control.readLimit > 0 && uint64(commitcount) < control.readLimit {
 		panic(throw("parse", "EOF before readlimit."))
@@ -4940,6 +5921,19 @@ func (sp *StreamParser) fastImport(ctx context.Context, fp io.Reader, options st
 		source = sp.repo.seekstream.Name()
 	}
 	sp.source = source
+	sp.tolerant = options.Contains("--tolerant")
+	// Blob content is copied to disk only when forced to, so only then
+	// is there anything to check.  The stream size is an upper bound
+	// on the blob content it carries.
+	if control.flagOptions["materialize"] && filesize > 0 {
+		need := filesize
+		if codec := activeCodec(); codec != nil {
+			need /= codec.ratio
+		}
+		if err := checkFreeSpace(sp.repo.basedir, need, "blob materialization"); err != nil {
+			panic(throw("parse", "%v", err))
+		}
+	}
 	//baton.startProcess(fmt.Sprintf("reposurgeon: from %s", source), "")
 	sp.repo.legacyCount = 0
 	// First, determine the input type
@@ -5014,6 +6008,29 @@ type Event interface {
 	removeColor(colorType)
 	hasColor(colorType) bool
 	isCommit() bool
+	getUUID() string
+	setUUID(string)
+}
+
+// workerCount returns the number of goroutines a parallel pass should
+// use: one with the serial flag on, otherwise the number chosen with
+// "set workers", or by default as many as Go will run at once.
+func workerCount() int {
+	if control.flagOptions["serial"] {
+		return 1
+	}
+	if control.workers > 0 {
+		return control.workers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// queueDepth returns the buffering of a work queue feeding workers.
+func queueDepth(workers int) int {
+	if control.queueDepth > 0 {
+		return control.queueDepth
+	}
+	return workers
 }
 
 // walkEvents walks an event list applying a hook function.  Runs
@@ -5037,8 +6054,8 @@ func walkEvents(events []Event, hook func(int, Event) bool) {
 	}
 
 	var (
-		maxWorkers = runtime.GOMAXPROCS(0)
-		channel    = make(chan int, maxWorkers)
+		maxWorkers = workerCount()
+		channel    = make(chan int, queueDepth(maxWorkers))
 		done       = make(chan bool, maxWorkers)
 	)
 
@@ -5099,6 +6116,8 @@ type CommitLike interface {
 	removeColor(colorType)
 	hasColor(colorType) bool
 	isCommit() bool
+	getUUID() string
+	setUUID(string)
 }
 
 // Contributor - associate a username with a DVCS-style ID and timezone
@@ -5151,12 +6170,23 @@ type Repository struct {
 	writeLegacy bool
 	preserveSet orderedStringSet
 	legacyMap   map[string]*Commit // From anything that doesn't survive rebuild
+	legacyLog   *legacyJournal     // Append-only record of legacyMap changes
 	legacyCount int
 	timings     []TimeMark
 	assignments map[string]selectionSet
+	snapshots   []*repoSnapshot // Named structure records for review diffs
+	undo        *undoJournal    // Saved states for undo and redo
 	inlines     int
 	markseq     int
+	markAliases map[string]string // Marks before renumbering to marks now
+	eventseed   string            // What stable event IDs are made from
+	eventseq    int               // Serial of the last stable event ID made
+	oplog       []string          // Entries of the operations log
+	overrides   []*override       // Parents git shows in place of the real ones
+	quarantined []string          // What a tolerant read couldn't parse
+	mergeLinks  []*mergeLink      // Merges synthesized from Subversion mergeinfo
 	authormap   map[string]Contributor
+	authorrules authorRules
 	tzmap       map[string]*time.Location // most recent email address to timezone
 	aliases     map[ContributorID]ContributorID
 	events      []Event // A list of the events encountered, in order
@@ -5165,13 +6195,16 @@ type Repository struct {
 	realized       map[string]bool    // clear and remake this before each dump
 	branchPosition map[string]*Commit // clear and remake this before each dump
 	writeOptions   stringSet          // options requested on this write
+	optionPolicy   string             // which option lines to write
 	internals      orderedStringSet   // export code computes this itself
 	// These are rebuilt on demand */
 	_markToIndex     map[string]int
 	_markToIndexLen  int  // Cache is valid for events[:_markToIndexLen]
 	_markToIndexSawN bool // whether we saw a null mark blob/commit when caching
 	_markToIndexLock sync.Mutex
-	_namecache       map[string]selectionSet
+	_namecache       *nameCache
+	_interned        *stringInterner // Shared fileop path and mode strings
+	_reach           [2]*reachIndex  // descendants and ancestors
 }
 
 func newRepository(name string) *Repository {
@@ -5183,8 +6216,10 @@ func newRepository(name string) *Repository {
 	repo.assignments = make(map[string]selectionSet)
 	repo.timings = make([]TimeMark, 0)
 	repo.authormap = make(map[string]Contributor)
+	repo.authorrules = newAuthorRules()
 	repo.tzmap = make(map[string]*time.Location)
 	repo.aliases = make(map[ContributorID]ContributorID)
+	repo._interned = newStringInterner()
 	d, err := os.Getwd()
 	if err != nil {
 		panic(throw("command", "During repository creation: %v", err))
@@ -5201,7 +6236,17 @@ func (repo *Repository) clone() *Repository {
 	// vcs, sourcedir, seekstream, basedir, uuid, and writeLegacy got copied
 	newRepo.preserveSet = repo.preserveSet.Clone()
 	newRepo.legacyMap = make(map[string]*Commit) // temporary - do a copy someday
+	newRepo.legacyLog = nil
 	newRepo.legacyCount = 0
+	newRepo.snapshots = nil // they refer to the original's events
+	newRepo.undo = nil
+	newRepo._namecache = nil // it refers to the original's events
+	// so IDs made in the clone differ from the original's
+	newRepo.eventseed = repo.eventSeed() + "-clone"
+	newRepo.markAliases = make(map[string]string, len(repo.markAliases))
+	for key, value := range repo.markAliases {
+		newRepo.markAliases[key] = value
+	}
 	newRepo.timings = make([]TimeMark, len(repo.timings))
 	copy(newRepo.timings, repo.timings)
 	repo.assignments = make(map[string]selectionSet)
@@ -5213,6 +6258,14 @@ func (repo *Repository) clone() *Repository {
 	for key, value := range repo.authormap {
 		newRepo.authormap[key] = value
 	}
+	newRepo.authorrules = newAuthorRules()
+	for key, value := range repo.authorrules.domains {
+		newRepo.authorrules.domains[key] = value
+	}
+	for key, value := range repo.authorrules.timezone {
+		newRepo.authorrules.timezone[key] = value
+	}
+	newRepo.authorrules.names = append([]nameRule{}, repo.authorrules.names...)
 	newRepo.tzmap = make(map[string]*time.Location)
 	for key, value := range repo.tzmap {
 		newRepo.tzmap[key] = value
@@ -5276,6 +6329,14 @@ func (repo *Repository) clone() *Repository {
 			panic("unknown event type while cloning")
 		}
 	}
+	newRepo.overrides = make([]*override, 0, len(repo.overrides))
+	for _, g := range repo.liveOverrides() {
+		clone := &override{commit: newRepo.markToEvent(g.commit.mark).(*Commit), origin: g.origin}
+		for _, parent := range g.parents {
+			clone.parents = append(clone.parents, newRepo.markToEvent(parent.mark).(*Commit))
+		}
+		newRepo.overrides = append(newRepo.overrides, clone)
+	}
 	newRepo.declareSequenceMutation("cloning")
 	return &newRepo
 }
@@ -5295,6 +6356,10 @@ func (repo *Repository) subdir(name string) string {
 
 // cleanup releases disk storage associated with this repo
 func (repo *Repository) cleanup() {
+	if err := repo.closeLegacyJournal(); err != nil {
+		croak("%v", err)
+	}
+	sharedBlobs.release(repo)
 	nuke(repo.subdir(""),
 		fmt.Sprintf("reposurgeon: cleaning up %s", repo.subdir("")))
 }
@@ -5479,85 +6544,24 @@ func (repo *Repository) branchtipmap() map[string]*Commit {
 	return brmap
 }
 
-func (repo *Repository) branchrootmap() map[string]*Commit {
-	// Return a map of branchnames to root marks in this repo.
-	brmap := make(map[string]*Commit)
-	for _, commit := range repo.commits(undefinedSelectionSet) {
-		if _, ok := brmap[commit.Branch]; !ok {
-			brmap[commit.Branch] = commit
-		}
-	}
-	return brmap
-}
-
-func (repo *Repository) all() selectionSet {
-	// Return a set that selects the entire repository.
-	s := newSelectionSet()
-	for i := range repo.events {
-		s.Add(i)
-	}
-	return s
-}
-
-func (repo *Repository) _buildNamecache() {
-	// Avoid repeated O(n**2) lookups.
-	repo._namecache = make(map[string]selectionSet)
-	commitcount := 0
-	addOrAppend := func(index int, id string) {
-		if _, ok := repo._namecache[id]; !ok {
-			repo._namecache[id] = newSelectionSet(index)
-		} else {
-			requiredCopy := repo._namecache[id]
-			requiredCopy.Add(index)
-			repo._namecache[id] = requiredCopy
-		}
-	}
-	for i, event := range repo.events {
-		switch event.(type) {
-		case *Commit:
-			commitcount++
-			repo._namecache[fmt.Sprintf("#%d", commitcount)] = newSelectionSet(i)
-			commit := event.(*Commit)
-			legacyID := commit.legacyID
-			if legacyID != "" {
-				repo._namecache[legacyID] = newSelectionSet(i)
-			}
-
-			committerStamp := commit.committer.actionStamp()
-			var authorStamp string
-			if len(commit.authors) > 0 {
-				authorStamp = commit.authors[0].actionStamp()
-				if authorStamp == committerStamp {
-					continue
-				}
-				addOrAppend(i, authorStamp)
-			}
-			addOrAppend(i, committerStamp)
-			// Ugh. We can't do this yet, it messes up roundtripping
-			// of streams that didn't have OIDS.
-			//addOrAppend(i, commit.gitHash().hexify())
-			//addOrAppend(i, commit.gitHash().short())
-		case *Tag:
-			tag := event.(*Tag)
-			repo._namecache[tag.tagname] = newSelectionSet(i)
-			if tag.legacyID != "" {
-				repo._namecache[tag.legacyID] = newSelectionSet(i)
-			}
-		case *Reset:
-			reset := event.(*Reset)
-			repo._namecache["reset@"+filepath.Base(reset.ref)] = newSelectionSet(i)
-			if reset.committish != "" {
-				repo._namecache[filepath.Base(reset.ref)] = newSelectionSet(repo.markToIndex(reset.committish))
-			}
-			if reset.legacyID != "" {
-				repo._namecache[reset.legacyID] = newSelectionSet(i)
-			}
+func (repo *Repository) branchrootmap() map[string]*Commit {
+	// Return a map of branchnames to root marks in this repo.
+	brmap := make(map[string]*Commit)
+	for _, commit := range repo.commits(undefinedSelectionSet) {
+		if _, ok := brmap[commit.Branch]; !ok {
+			brmap[commit.Branch] = commit
 		}
 	}
+	return brmap
 }
 
-func (repo *Repository) invalidateNamecache() {
-	repo._namecache = nil
+func (repo *Repository) all() selectionSet {
+	// Return a set that selects the entire repository.
+	s := newSelectionSet()
+	for i := range repo.events {
+		s.Add(i)
+	}
+	return s
 }
 
 func (repo *Repository) named(ref string) selectionSet {
@@ -5568,12 +6572,15 @@ func (repo *Repository) named(ref string) selectionSet {
 	// more expensive in time than doing a single lookup. Avoid
 	// lots of O(n**2) searches by building a lookup cache, at the
 	// expense of increased working set for the hash table.
-	if repo._namecache == nil {
-		repo._buildNamecache()
-	}
-	if v, ok := repo._namecache[ref]; ok {
+	if v, ok := repo.lookupName(ref); ok {
 		return v
 	}
+	// A mark as it was before renumbering
+	if strings.HasPrefix(ref, ":") {
+		if i := repo.aliasedMark(ref); i >= 0 {
+			return newSelectionSet(i)
+		}
+	}
 	// No hit in the name cache or assignments? Then search branches.
 	for _, symbol := range repo.branchset() {
 		if ref == branchbase(symbol) {
@@ -5588,7 +6595,7 @@ func (repo *Repository) named(ref string) selectionSet {
 				}
 			}
 			if loc == -1 {
-				if v, ok := repo._namecache["reset@"+ref]; ok {
+				if v, ok := repo.lookupName("reset@" + ref); ok {
 					loc = repo.markToIndex(repo.events[v.Fetch(0)].(*Reset).committish)
 				}
 			}
@@ -5712,6 +6719,9 @@ func parseContributionLine(netwide string) (Contributor, *time.Location, error)
 	return Contributor{"", name, mail, timezone}, loc, err
 }
 
+// A name rule in an authors file: /REGEXP/ = REPLACEMENT
+var nameRuleRE = regexp.MustCompile(`^/(.*)/\s*=(.*)$`)
+
 func (repo *Repository) readAuthorMap(selection selectionSet, fp io.Reader) error {
 	// Read an author-mapping file and apply it to the repo.
 	scanner := bufio.NewScanner(fp)
@@ -5731,6 +6741,35 @@ func (repo *Repository) readAuthorMap(selection selectionSet, fp io.Reader) erro
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
+		if m := nameRuleRE.FindStringSubmatch(line); m != nil {
+			re, err := regexp.Compile(m[1])
+			if err != nil {
+				complain("bad name pattern: %v", err)
+				continue
+			}
+			repo.authorrules.names = append(repo.authorrules.names, nameRule{re, strings.TrimSpace(m[2])})
+			continue
+		}
+		if strings.HasPrefix(line, "*@") {
+			fields := strings.SplitN(line, "=", 2)
+			rhs := strings.Fields(strings.TrimSpace(fields[len(fields)-1]))
+			if len(fields) != 2 || len(rhs) == 0 || len(rhs) > 2 || !strings.HasPrefix(rhs[0], "*@") {
+				complain("domain rule must have the form *@OLD = *@NEW [TIMEZONE]")
+				continue
+			}
+			olddomain := strings.ToLower(strings.TrimSpace(fields[0])[2:])
+			repo.authorrules.domains[olddomain] = rhs[0][2:]
+			if len(rhs) == 2 {
+				if _, err := time.LoadLocation(rhs[1]); err != nil {
+					if _, err = locationFromZoneOffset(rhs[1]); err != nil {
+						complain("bad timezone %q in domain rule", rhs[1])
+						continue
+					}
+				}
+				repo.authorrules.timezone[olddomain] = rhs[1]
+			}
+			continue
+		}
 		if strings.Contains(line, "=") {
 			fields := strings.SplitN(line, "=", 3)
 			local := strings.TrimSpace(fields[0])
@@ -5770,19 +6809,26 @@ func (repo *Repository) readAuthorMap(selection selectionSet, fp io.Reader) erro
 		}
 	}
 
+	// Exact entries take precedence over the wildcard rules.
+	remap := func(attr *Attribution) bool {
+		if _, ok := lookupContributor(repo.authormap, attr); ok || repo.authorrules.isEmpty() {
+			return attr.remap(repo.authormap)
+		}
+		return attr.rewrite(&repo.authorrules)
+	}
 	repo.clearColor(colorQSET)
 	repo.walkEvents(selection, func(idx int, event Event) bool {
 		switch event.(type) {
 		case *Commit:
 			c := event.(*Commit)
-			c.committer.remap(repo.authormap)
+			remap(&c.committer)
 			for ai := range c.authors {
-				if c.authors[ai].remap(repo.authormap) {
+				if remap(&c.authors[ai]) {
 					c.addColor(colorQSET)
 				}
 			}
 		case *Tag:
-			event.(*Tag).tagger.remap(repo.authormap)
+			remap(&event.(*Tag).tagger)
 		}
 		return true
 	})
@@ -5842,7 +6888,8 @@ func (repo *Repository) readLegacyMap(fp io.Reader, baton *Baton) (int, int, err
 	}
 	commitMap := make(map[dyad][]*Commit)
 	repo.byCommit(func(commit *Commit) {
-		key := dyad{commit.committer.date.timestamp.String(), commit.committer.email}
+		// Normalize to UTC; zones differ depending on how the commit was read
+		key := dyad{commit.committer.date.timestamp.UTC().String(), commit.committer.email}
 		if _, ok := commitMap[key]; !ok {
 			commitMap[key] = make([]*Commit, 0)
 		}
@@ -5895,9 +6942,9 @@ func (repo *Repository) readLegacyMap(fp io.Reader, baton *Baton) (int, int, err
 		if err2 != nil {
 			return matched, unmatched, lineError(err2.Error())
 		}
-		whenWho := dyad{when.timestamp.String(), person}
-		if _, ok := commitMap[whenWho]; ok {
-			repo.legacyMap[legacy] = commitMap[whenWho][seq]
+		whenWho := dyad{when.timestamp.UTC().String(), person}
+		if group, ok := commitMap[whenWho]; ok && seq < len(group) {
+			repo.setLegacy(legacy, group[seq])
 			if strings.HasPrefix(legacy, "SVN:") {
 				commitMap[whenWho][seq].legacyID = legacy[4:]
 			}
@@ -5944,6 +6991,18 @@ func (repo *Repository) cleanLegacyMap() {
 			}
 		}
 	}
+	if repo.legacyLog != nil {
+		dropped := make([]string, 0)
+		for key := range repo.legacyMap {
+			if _, ok := newMap[key]; !ok {
+				dropped = append(dropped, key)
+			}
+		}
+		sort.Strings(dropped)
+		for _, key := range dropped {
+			repo.legacyLog.forget(key)
+		}
+	}
 	repo.legacyMap = newMap
 }
 
@@ -6034,13 +7093,32 @@ func defaultEmptyTagName(commit *Commit) string {
 	}
 }
 
-func (repo *Repository) tagifyEmpty(selection selectionSet, tipdeletes bool, tagifyMerges bool, canonicalize bool, nameFunc func(*Commit) string, legendFunc func(*Commit) string, createTags bool, baton *Baton) error {
+// treeSameCommits returns the selected commits whose tree is the same
+// as their first parent's, whatever fileops they carry.  Subversion
+// property changes, for example, leave fileops that change nothing git
+// can see.
+func (repo *Repository) treeSameCommits(selection selectionSet) map[*Commit]bool {
+	same := make(map[*Commit]bool)
+	repo.walkManifests(func(idx int, commit *Commit, _ int, parent *Commit) {
+		if parent == nil || (selection.isDefined() && selection.Size() > 0 && !selection.Contains(idx)) {
+			return
+		}
+		if commit.manifest().gitHash() == parent.manifest().gitHash() {
+			same[commit] = true
+		}
+	})
+	return same
+}
+
+func (repo *Repository) tagifyEmpty(selection selectionSet, tipdeletes bool, tagifyMerges bool, canonicalize bool, treeSame bool, nameFunc func(*Commit) string, legendFunc func(*Commit) string, createTags bool, baton *Baton) error {
 	// Turn into tags commits without (meaningful) fileops.
 	// Use a separate loop because delete() invalidates manifests.
 	// selection:     A selection set - tagifyEmpty() ignores non-commits
 	// tagifyMerges:  also tagify mutuiparent commits
 	// tipdeletes:    whether tipdeletes should be tagified
 	// canonicalize:  whether to canonicalize fileops first
+	// treeSame:      also tagify commits with fileops that leave the
+	//                tree the same as the first parent's
 	// nameFunc:      custom function for choosing the tag name; if it
 	//                returns an empty string, a default scheme is used
 	// legendFunc:    custom function for choosing the legend
@@ -6059,6 +7137,10 @@ func (repo *Repository) tagifyEmpty(selection selectionSet, tipdeletes bool, tag
 			return c.alldeletes(deleteall) && !c.hasChildren()
 		}
 	}
+	var sameTree map[*Commit]bool
+	if treeSame {
+		sameTree = repo.treeSameCommits(selection)
+	}
 	var errout error
 	deletia := newSelectionSet()
 	var deletiaMutex sync.Mutex
@@ -6068,11 +7150,15 @@ func (repo *Repository) tagifyEmpty(selection selectionSet, tipdeletes bool, tag
 			return
 		}
 		var name string
-		if len(commit.operations()) == 0 || isTipdelete(commit) {
+		if len(commit.operations()) == 0 || isTipdelete(commit) || sameTree[commit] {
 			if commit.hasParents() {
 				if commit.parentCount() > 1 && !tagifyMerges {
 					return
 				}
+				if sameTree[commit] && !isTipdelete(commit) {
+					// Its fileops change nothing, so it is empty
+					commit.setOperations(nil)
+				}
 				if nameFunc != nil {
 					name = nameFunc(commit)
 					if name == "" {
@@ -6137,8 +7223,23 @@ func (repo *Repository) tagifyEmpty(selection selectionSet, tipdeletes bool, tag
 
 // Read a stream file and use it to populate the repo.
 func (repo *Repository) fastImport(ctx context.Context, fp io.Reader, options stringSet, source string, baton *Baton) {
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, "--legacy-journal=") {
+			if err := repo.openLegacyJournal(option[len("--legacy-journal="):]); err != nil {
+				croak("%v", err)
+			}
+		}
+	}
 	newStreamParser(repo).fastImport(ctx, fp, options, source, baton)
 	repo.readtime = time.Now()
+	// Even if the read failed, the entries made so far get flushed
+	if len(repo.events) > 0 {
+		if _, err := repo.syncLegacyJournal(baton); err != nil {
+			croak("%v", err)
+		}
+	} else if repo.legacyLog != nil {
+		repo.closeLegacyJournal()
+	}
 }
 
 // Extract info about legacy references from CVS/SVN header cookies.
@@ -6247,7 +7348,7 @@ func (repo *Repository) exportStyle() orderedStringSet {
 }
 
 // Dump the repo object in Subversion dump or fast-export format.
-func (repo *Repository) fastExport(selection selectionSet,
+func (repo *Repository) fastExport(ctx context.Context, selection selectionSet,
 	fp io.Writer, options stringSet, target *VCS, baton *Baton) error {
 	repo.writeOptions = options
 	repo.preferred = target
@@ -6283,10 +7384,18 @@ func (repo *Repository) fastExport(selection selectionSet,
 	}
 	repo.realized = make(map[string]bool)          // Track what branches are made
 	repo.branchPosition = make(map[string]*Commit) // Track what branches are made
+	defer func() {
+		repo.realized = nil
+		repo.branchPosition = nil
+	}()
 	baton.startProgress("export", uint64(len(repo.events)))
+	defer baton.endProgress()
 	for it := selection.Iterator(); it.Next(); {
 		idx := it.Index()
 		ei := it.Value()
+		if ctx.Err() != nil {
+			return fmt.Errorf("export interrupted after %d of %d events", idx, selection.Size())
+		}
 		baton.twirl()
 		event := repo.events[ei]
 		if passthrough, ok := event.(*Passthrough); ok {
@@ -6300,6 +7409,9 @@ func (repo *Repository) fastExport(selection selectionSet,
 					continue
 				}
 			}
+			if opt, ok, _ := parseStreamOption(passthrough.text); ok && !repo.emitOption(opt, target) {
+				continue
+			}
 		}
 		if logEnable(logUNITE) {
 			if event.getMark() != "" {
@@ -6311,15 +7423,24 @@ func (repo *Repository) fastExport(selection selectionSet,
 		event.Save(fp)
 		baton.percentProgress(uint64(idx) + 1)
 	}
-	baton.endProgress()
-	repo.realized = nil
-	repo.branchPosition = nil
 	return nil
 }
 
-// Add a path to the preserve set, to be copied back on rebuild.
+// isGlob tells whether a preserve-set entry is a pattern rather than a path.
+func isGlob(filename string) bool {
+	return strings.ContainsAny(filename, "*?[")
+}
+
+// Add a path or glob pattern to the preserve set, to be copied back
+// on rebuild.  Patterns are matched when the rebuild happens, so they
+// need not match anything now.
 func (repo *Repository) preserve(filename string) error {
-	if exists(filename) {
+	if isGlob(filename) {
+		if _, err := filepath.Match(filename, ""); err != nil {
+			return fmt.Errorf("%s is not a valid pattern: %v", filename, err)
+		}
+		repo.preserveSet.Add(filename)
+	} else if exists(filename) {
 		repo.preserveSet.Add(filename)
 	} else {
 		return fmt.Errorf("%s doesn't exist", filename)
@@ -6327,6 +7448,25 @@ func (repo *Repository) preserve(filename string) error {
 	return nil
 }
 
+// expandPreserves returns the paths under a directory named by a
+// preserve set, glob patterns replaced by what they match there.
+func expandPreserves(dir string, preserves orderedStringSet) orderedStringSet {
+	paths := newOrderedStringSet()
+	for _, sub := range preserves {
+		if !isGlob(sub) {
+			paths.Add(sub)
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(dir, filepath.FromSlash(sub)))
+		for _, match := range matches {
+			if rel, err := filepath.Rel(dir, match); err == nil {
+				paths.Add(filepath.ToSlash(rel))
+			}
+		}
+	}
+	return paths
+}
+
 // Remove a path from the preserve set.
 func (repo *Repository) unpreserve(filename string) error {
 	if repo.preserveSet.Contains(filename) {
@@ -6426,7 +7566,8 @@ func (repo *Repository) filterAssignments(f func(Event) bool) {
 // Mark the repo event sequence modified.
 func (repo *Repository) declareSequenceMutation(warning string) {
 	repo.invalidateMarkToIndex()
-	repo._namecache = nil
+	repo.invalidateReachability()
+	repo.invalidateNamecache()
 	if len(repo.assignments) > 0 && warning != "" {
 		repo.assignments = nil
 		croak("assignments invalidated by " + warning)
@@ -6481,8 +7622,8 @@ func (repo *Repository) walkEvents(selection selectionSet, hook func(i int, even
 	}
 
 	var (
-		maxWorkers = runtime.GOMAXPROCS(0)
-		channel    = make(chan int, maxWorkers)
+		maxWorkers = workerCount()
+		channel    = make(chan int, queueDepth(maxWorkers))
 		done       = make(chan bool, maxWorkers)
 	)
 
@@ -6522,9 +7663,7 @@ func (repo *Repository) stampify(selection selectionSet) int {
 		// legend was matchobj.group(0) in Python
 		commit := getter(legend)
 		if commit == nil {
-			if logEnable(logWARN) {
-				logit("no commit matches %q", legend)
-			}
+			warn("legacy", "no commit matches %q", legend)
 			return legend // no replacement
 		}
 		text := commit.actionStamp()
@@ -6796,7 +7935,7 @@ func (repo *Repository) scavenge(legend string) {
 }
 
 // Delete a set of events, or rearrange it forward or backwards.
-func (repo *Repository) squash(selected selectionSet, policy orderedStringSet, baton *Baton) error {
+func (repo *Repository) squash(ctx context.Context, selected selectionSet, policy orderedStringSet, baton *Baton) error {
 	if logEnable(logDELETE) {
 		logit("Deletion list is %v", selected)
 	}
@@ -6837,14 +7976,10 @@ func (repo *Repository) squash(selected selectionSet, policy orderedStringSet, b
 				speak := fmt.Sprintf("warning: commit %s to be deleted has ", commit.mark)
 				// import-stream path separeator issue
 				if strings.Contains(commit.Branch, "/") && !strings.Contains(commit.Branch, "/heads/") {
-					if logEnable(logWARN) {
-						logit(speak + fmt.Sprintf("non-head branch attribute %s", commit.Branch))
-					}
+					warn("delete", "%snon-head branch attribute %s", speak, commit.Branch)
 				}
 				if !commit.alldeletes(opD, deleteall) {
-					if logEnable(logWARN) {
-						logit(speak + "non-delete fileops.")
-					}
+					warn("delete", "%snon-delete fileops.", speak)
 				}
 			}
 			if !delete {
@@ -6890,9 +8025,17 @@ func (repo *Repository) squash(selected selectionSet, policy orderedStringSet, b
 	if preserveRefs {
 		branchtipmap = repo.branchtipmap()
 	}
-	// Here are the deletions
+	// Here are the deletions.  Each event is dealt with completely
+	// before the next, so an interrupt is honored between them and
+	// the cleanup below still runs on what was done.
+	var interrupted error
+	var notes map[string][]*FileOp
 	repo.clearColor(colorDELETE)
 	for it := selected.Iterator(); it.Next(); {
+		if ctx.Err() != nil {
+			interrupted = fmt.Errorf("squash interrupted after %d of %d events", it.Index(), selected.Size())
+			break
+		}
 		var newTarget *Commit
 		event := repo.events[it.Value()]
 		switch event.(type) {
@@ -7132,6 +8275,21 @@ func (repo *Repository) squash(selected selectionSet, policy orderedStringSet, b
 						newTarget.mark, commit.legacyID))
 				}
 			}
+			// Notes follow the tags, unless where the tags went
+			// is itself going.
+			if repo.inlines > 0 {
+				if fileopsWerePushed && commit.hasNotes() {
+					// Copies of its notes went elsewhere
+					notes = nil
+				}
+				if notes == nil {
+					notes = repo.notesIndex()
+				}
+				if newTarget != nil && newTarget.hasColor(colorDELETE) {
+					newTarget = nil
+				}
+				repo.retargetNotes(notes, commit, newTarget)
+			}
 			// And forget the deleted event
 			commit.forget()
 		}
@@ -7165,23 +8323,31 @@ func (repo *Repository) squash(selected selectionSet, policy orderedStringSet, b
 	if logEnable(logDELETE) {
 		logit("Deletion is finished\n")
 	}
-	return nil
+	return interrupted
 }
 
 // Delete a set of events.
 func (repo *Repository) delete(selected selectionSet, policy orderedStringSet, baton *Baton) {
 	options := append(orderedStringSet{"--delete", "--quiet"}, policy...)
-	repo.squash(selected, options, baton)
+	repo.squash(context.Background(), selected, options, baton)
 }
 
 // Replace references to duplicate blobs according to the given dupMap,
 // which maps marks of duplicate blobs to canonical marks`
-func (repo *Repository) dedup(dupMap map[string]string, baton *Baton) {
+// Commits are rewritten independently, so an interrupt leaves those
+// not yet reached referring to their duplicates, which are then kept.
+func (repo *Repository) dedup(ctx context.Context, dupMap map[string]string, baton *Baton) error {
+	var skipped int64
 	walkEvents(repo.events, func(idx int, event Event) bool {
 		commit, ok := event.(*Commit)
 		if !ok {
 			return true
 		}
+		// Workers that quit early would stall walkEvents, so skip instead
+		if ctx.Err() != nil {
+			atomic.AddInt64(&skipped, 1)
+			return true
+		}
 		for _, fileop := range commit.operations() {
 			if fileop.op == opM && dupMap[fileop.ref] != "" {
 				fileop.ref = dupMap[fileop.ref]
@@ -7191,6 +8357,10 @@ func (repo *Repository) dedup(dupMap map[string]string, baton *Baton) {
 		return true
 	})
 	repo.gcBlobs()
+	if skipped > 0 {
+		return fmt.Errorf("interrupted with %d commits not rewritten", skipped)
+	}
+	return nil
 }
 
 // Garbage-collect blobs that no longer have references.
@@ -7341,7 +8511,7 @@ func (repo *Repository) expunge(selection selectionSet, expunge *regexp.Regexp,
 	}
 	repo.events = filtered
 	repo.invalidateMarkToIndex()
-	errout := repo.tagifyEmpty(undefinedSelectionSet, false, false, false, nil, nil, !notagify, baton)
+	errout := repo.tagifyEmpty(undefinedSelectionSet, false, false, false, false, nil, nil, !notagify, baton)
 	// And tell we changed the manifests and the event sequence.
 	//repo.invalidateManifests()
 	repo.declareSequenceMutation("expunge cleanup")
@@ -7448,7 +8618,7 @@ func (repo *Repository) resort() {
 					handle(n, o.ref)
 				} else if o.op == opN {
 					handle(n, o.ref)
-					handle(n, o.committish)
+					handle(n, o.Path)
 				}
 			}
 		case *Blob:
@@ -7563,51 +8733,82 @@ func (repo *Repository) reorderCommits(v selectionSet, bequiet bool) {
 		}
 		return true
 	}
-	for _, e := range sortedEvents[1:] {
-		if e.parentCount() > 1 {
-			croak("non-linear history detected, multiple parents at %s", e.idMe())
-			return
-		}
-	}
-	for _, e := range sortedEvents[:len(sortedEvents)-1] {
-		if e.childCount() > 1 {
-			croak("non-linear history detected, multiple children at %s", e.idMe())
-			return
-		}
+	// The range may be branchy, so contiguity means the selected
+	// commits form one connected piece of the commit graph.
+	slot := make(map[*Commit]int)
+	for i, e := range sortedEvents {
+		slot[e] = i
 	}
-	isChildOf := func(later, earlier *Commit) bool {
-		for it := later.parentIterator(); it.Next(); {
-			c := it.Value()
-			if c.getMark() == earlier.getMark() {
-				return true
+	reached := map[*Commit]bool{sortedEvents[0]: true}
+	stack := []*Commit{sortedEvents[0]}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		neighbors := make([]CommitLike, 0)
+		neighbors = append(neighbors, e.parents()...)
+		neighbors = append(neighbors, e.children()...)
+		for _, n := range neighbors {
+			if c, ok := n.(*Commit); ok && !reached[c] {
+				if _, in := slot[c]; in {
+					reached[c] = true
+					stack = append(stack, c)
+				}
 			}
 		}
-		return false
 	}
-	for i := 0; i < len(sortedEvents)-1; i++ {
-		if !isChildOf(sortedEvents[i+1], sortedEvents[i]) {
-			croak("selected commit range not contiguous")
-			return
-		}
+	if len(reached) != len(sortedEvents) {
+		croak("selected commit range not contiguous")
+		return
 	}
 	if commitSliceEqual(events, sortedEvents) {
 		croak("commits already in desired order")
 		return
 	}
-	lastEvent := sortedEvents[len(sortedEvents)-1]
-	events[0].setParents(sortedEvents[0].parents())
-	// replaceParent modifies the list that we're iterating over, so we walk backwards.
-	// Skipping nils explicitly here is slightly unclean, strictly speaking this should
-	// have been done with a dedicated reverse iterator so knowledge of how sparseness is
-	// implemented is confined to Commit methods.
-	children := lastEvent.children()
-	for i := len(children) - 1; i >= 0; i-- {
-		if children[i] != nil {
-			children[i].(*Commit).replaceParent(lastEvent, events[len(events)-1])
+	// The shape of the graph is preserved; the commits are permuted
+	// over it.  The commit taking the place of the Nth-oldest one in
+	// the range inherits its parents, its children, and its branch,
+	// with references to other commits in the range translated
+	// likewise.  Parent lists are all computed before any are
+	// changed, as a commit may be both a parent being moved and a
+	// child being relinked.
+	translate := func(parents []CommitLike) []CommitLike {
+		out := make([]CommitLike, len(parents))
+		for i, p := range parents {
+			out[i] = p
+			if c, ok := p.(*Commit); ok {
+				if k, in := slot[c]; in {
+					out[i] = events[k]
+				}
+			}
+		}
+		return out
+	}
+	relinked := make([]*Commit, 0)
+	relink := make(map[*Commit][]CommitLike)
+	for _, e := range sortedEvents {
+		for _, child := range e.children() {
+			if c, ok := child.(*Commit); ok {
+				if _, in := slot[c]; !in && relink[c] == nil {
+					relinked = append(relinked, c)
+					relink[c] = translate(c.parents())
+				}
+			}
+		}
+	}
+	branches := make([]string, len(sortedEvents))
+	newParents := make([][]CommitLike, len(sortedEvents))
+	for k, e := range sortedEvents {
+		branches[k] = e.Branch
+		newParents[k] = translate(e.parents())
+	}
+	for k, e := range events {
+		e.setParents(newParents[k])
+		if e.Branch != branches[k] {
+			e.setBranch(branches[k])
 		}
 	}
-	for i, e := range events[:len(events)-1] {
-		events[i+1].setParents([]CommitLike{e})
+	for _, c := range relinked {
+		c.setParents(relink[c])
 	}
 	fileopSliceEqual := func(a, b []*FileOp) bool {
 		if len(a) != len(b) {
@@ -7630,7 +8831,7 @@ func (repo *Repository) reorderCommits(v selectionSet, bequiet bool) {
 			} else if op.op == opR || op.op == opC {
 				path = op.Source
 			}
-			if path != "" && c.visible(path) == nil {
+			if path != "" && !c.visibleInParents(path) {
 				if !bequiet {
 					croak("%s '%c' fileop references non-existent '%s' after re-order", c.idMe(), op.op, path)
 				}
@@ -7641,9 +8842,7 @@ func (repo *Repository) reorderCommits(v selectionSet, bequiet bool) {
 		if !fileopSliceEqual(ops, c.operations()) {
 			c.setOperations(ops)
 			if !bequiet && len(ops) == 0 {
-				if logEnable(logWARN) {
-					logit("%s no fileops remain after re-order", c.idMe())
-				}
+				warn("reorder", "%s no fileops remain after re-order", c.idMe())
 			}
 		}
 	}
@@ -7651,17 +8850,19 @@ func (repo *Repository) reorderCommits(v selectionSet, bequiet bool) {
 }
 
 // Renumber the marks in a repo starting from a specified origin.
-func (repo *Repository) renumber(origin int, baton *Baton) {
-	markmap := make(map[string]int)
-	remark := func(m string, id string) string {
-		_, ok := markmap[m]
-		if ok {
-			return fmt.Sprintf(":%d", markmap[m])
-		}
-		panic(fmt.Sprintf("unknown mark %s in %s cannot be renumbered!", m, id))
+// The marks are all assigned before any is changed, and an interrupt
+// is only honored while assigning them.  With the stablemarks flag
+// set, marks are derived from content instead.
+func (repo *Repository) renumber(ctx context.Context, origin int, baton *Baton) error {
+	if control.flagOptions["stablemarks"] {
+		return repo.renumberStable(ctx, baton)
 	}
-	repo.markseq = 0
+	markmap := make(map[string]int)
+	markseq := 0
 	for _, event := range repo.events {
+		if ctx.Err() != nil {
+			return errors.New("interrupted before any marks were changed")
+		}
 		switch event.(type) {
 		case *Blob:
 			blob := event.(*Blob)
@@ -7670,8 +8871,8 @@ func (repo *Repository) renumber(origin int, baton *Baton) {
 			} else if !strings.HasPrefix(blob.mark, ":") {
 				panic("field not in mark format")
 			} else {
-				markmap[blob.mark] = origin + repo.markseq
-				repo.markseq++
+				markmap[blob.mark] = origin + markseq
+				markseq++
 			}
 		case *Commit:
 			commit := event.(*Commit)
@@ -7680,11 +8881,31 @@ func (repo *Repository) renumber(origin int, baton *Baton) {
 			} else if !strings.HasPrefix(commit.mark, ":") {
 				panic("field not in mark format")
 			} else {
-				markmap[commit.mark] = origin + repo.markseq
-				repo.markseq++
+				markmap[commit.mark] = origin + markseq
+				markseq++
 			}
 		}
 	}
+	repo.applyMarkmap(markmap, markseq, baton)
+	return nil
+}
+
+// applyMarkmap changes every mark in a repo to the number a map gives
+// it, and notes the next mark to be made after them.
+func (repo *Repository) applyMarkmap(markmap map[string]int, markseq int, baton *Baton) {
+	remark := func(m string, id string) string {
+		_, ok := markmap[m]
+		if ok {
+			return fmt.Sprintf(":%d", markmap[m])
+		}
+		panic(fmt.Sprintf("unknown mark %s in %s cannot be renumbered!", m, id))
+	}
+	repo.markseq = markseq
+	renumbered := make(map[string]string, len(markmap))
+	for mark, n := range markmap {
+		renumbered[mark] = fmt.Sprintf(":%d", n)
+	}
+	repo.noteMarkAliases(renumbered)
 	var old string
 	var newmark string
 	for idx, event := range repo.events {
@@ -7741,7 +8962,7 @@ func (repo *Repository) renumber(origin int, baton *Baton) {
 	}
 	for _, commit := range repo.commits(undefinedSelectionSet) {
 		for i, fileop := range commit.operations() {
-			if fileop.op == opM && strings.HasPrefix(fileop.ref, ":") {
+			if (fileop.op == opM || fileop.op == opN) && strings.HasPrefix(fileop.ref, ":") {
 				id := fmt.Sprintf("fileop %d of %s", i, commit.idMe())
 				newmark = remark(fileop.ref, id)
 				if logEnable(logUNITE) {
@@ -7749,6 +8970,14 @@ func (repo *Repository) renumber(origin int, baton *Baton) {
 				}
 				commit.fileops[i].ref = newmark
 			}
+			if fileop.op == opN && strings.HasPrefix(fileop.Path, ":") {
+				id := fmt.Sprintf("note %d of %s", i, commit.idMe())
+				newmark = remark(fileop.Path, id)
+				if logEnable(logUNITE) {
+					logit(fmt.Sprintf("renumbering %s -> %s in %q", fileop.Path, newmark, id))
+				}
+				commit.fileops[i].Path = newmark
+			}
 		}
 		if baton != nil {
 			baton.bumpcounter()
@@ -7932,7 +9161,7 @@ func (repo *Repository) graft(graftRepo *Repository, graftPoint int, prune bool)
 		delop.construct(deleteall)
 		graftroot.prependOperation(delop)
 	}
-	repo.renumber(1, nil)
+	repo.renumber(context.Background(), 1, nil)
 	// Resolve all callouts
 	unresolved := make([]string, 0)
 	for _, commit := range repo.commits(undefinedSelectionSet) {
@@ -7960,6 +9189,181 @@ func (repo *Repository) graft(graftRepo *Repository, graftPoint int, prune bool)
 	return nil
 }
 
+// splice replaces a linear range of commits with the commits read
+// from a fast-import fragment.  Root commits of the fragment are
+// parented on the parents of the first commit in the range; fragment
+// parents given as action-stamp callouts are resolved against the
+// commits outside the range.  The fragment must have exactly one tip,
+// which takes the place of the last commit in the range as parent of
+// its children and as target of its tags and resets, and must leave
+// the same tree.  Nothing is modified if validation fails.
+func (repo *Repository) splice(selection selectionSet, fragment *Repository) error {
+	span := repo.commits(selection)
+	if len(span) == 0 {
+		return errors.New("no commits to be replaced are selected")
+	}
+	inSpan := make(map[*Commit]bool)
+	for i, commit := range span {
+		inSpan[commit] = true
+		if i > 0 && (commit.parentCount() != 1 || commit.firstParent() != CommitLike(span[i-1])) {
+			return fmt.Errorf("%s is not the only parent of %s; selection is not a linear range",
+				span[i-1].idMe(), commit.idMe())
+		}
+		if i < len(span)-1 && commit.childCount() != 1 {
+			return fmt.Errorf("%s has other children outside the range", commit.idMe())
+		}
+	}
+	first, last := span[0], span[len(span)-1]
+	where := first.index()
+
+	// Validate the fragment and resolve its boundary parents.
+	var tip *Commit
+	survivors := make([]Event, 0, len(fragment.events))
+	resolved := make(map[*Commit][]CommitLike)
+	for _, event := range fragment.events {
+		switch ev := event.(type) {
+		case *Passthrough:
+			continue
+		case *Reset:
+			if ev.committish != "" {
+				return fmt.Errorf("splice fragment may not contain reset %s with a target", ev.ref)
+			}
+			continue
+		case *Tag:
+			return fmt.Errorf("splice fragment may not contain tag %s", ev.tagname)
+		case *Commit:
+			if !ev.hasChildren() {
+				if tip != nil {
+					return fmt.Errorf("splice fragment has multiple tips, %s and %s", tip.idMe(), ev.idMe())
+				}
+				tip = ev
+			}
+			parents := make([]CommitLike, 0)
+			if !ev.hasParents() {
+				parents = append(parents, first.parents()...)
+			}
+			for _, parent := range ev.parents() {
+				if _, ok := parent.(*Callout); !ok {
+					parents = append(parents, parent)
+					continue
+				}
+				attach := repo.named(strings.Trim(parent.getMark(), "<>"))
+				if attach.Size() != 1 {
+					return fmt.Errorf("callout %s in splice fragment does not resolve to a unique commit", parent.getMark())
+				}
+				target, ok := repo.events[attach.Fetch(0)].(*Commit)
+				if !ok || inSpan[target] {
+					return fmt.Errorf("callout %s in splice fragment does not resolve to a commit outside the range", parent.getMark())
+				} else if attach.Fetch(0) >= where {
+					return fmt.Errorf("callout %s in splice fragment resolves to a commit after the range start", parent.getMark())
+				}
+				parents = append(parents, target)
+			}
+			resolved[ev] = parents
+		}
+		survivors = append(survivors, event)
+	}
+	if tip == nil {
+		return errors.New("splice fragment contains no commits")
+	}
+	// The tip has to leave the tree as the last commit in the range
+	// did, or every commit after the range would silently change.
+	chain := make([]*Commit, 0)
+	var base *Commit
+	for commit := tip; commit != nil; {
+		chain = append(chain, commit)
+		parents, next := resolved[commit], (*Commit)(nil)
+		if len(parents) > 0 {
+			if p, ok := parents[0].(*Commit); ok {
+				if _, inFragment := resolved[p]; inFragment {
+					next = p
+				} else {
+					base = p
+				}
+			}
+		}
+		commit = next
+	}
+	manifest := newManifest()
+	if base != nil {
+		manifest = base.manifest()
+	}
+	pm := manifest.snapshot()
+	for i := len(chain) - 1; i >= 0; i-- {
+		chain[i].applyFileOps(pm, false, false)
+	}
+	if pmToManifest(pm).freshHash() != last.manifest().freshHash() {
+		return fmt.Errorf("tree of splice fragment tip %s differs from that of %s, which it replaces",
+			tip.idMe(), last.idMe())
+	}
+
+	// Errors aren't recoverable after this
+	for _, event := range survivors {
+		switch ev := event.(type) {
+		case *Blob:
+			ev.setMark(ev.mark + "-splice")
+		case *Commit:
+			ev.setMark(ev.mark + "-splice")
+			ev.setBranch(last.Branch)
+			for _, fileop := range ev.operations() {
+				if (fileop.op == opM || fileop.op == opN) && strings.HasPrefix(fileop.ref, ":") {
+					fileop.ref += "-splice"
+				}
+				if fileop.op == opN && strings.HasPrefix(fileop.Path, ":") {
+					fileop.Path += "-splice"
+				}
+			}
+		}
+		event.moveto(repo)
+	}
+	events := make([]Event, 0, len(repo.events)+len(survivors))
+	events = append(events, repo.events[:where]...)
+	events = append(events, survivors...)
+	events = append(events, repo.events[where:]...)
+	repo.events = events
+	repo.declareSequenceMutation("splice")
+	for commit, parents := range resolved {
+		commit.setParents(parents)
+	}
+	for key, commit := range fragment.legacyMap {
+		repo.setLegacy(key, commit)
+	}
+	repo.clearColor(colorQSET)
+	for _, event := range survivors {
+		event.addColor(colorQSET)
+	}
+	for _, child := range last.children() {
+		child.(*Commit).replaceParent(last, tip)
+	}
+	for _, commit := range span {
+		for _, attachment := range append([]Event{}, commit.attachments...) {
+			switch a := attachment.(type) {
+			case *Tag:
+				a.forget()
+				a.remember(repo, tip.mark)
+			case *Reset:
+				a.forget()
+				a.remember(repo, tip.mark)
+			}
+		}
+		for _, fileop := range commit.operations() {
+			if fileop.op == opM {
+				if blob, ok := repo.markToEvent(fileop.ref).(*Blob); ok {
+					blob.removeOperation(fileop)
+				}
+			}
+		}
+		commit.setParents(nil)
+		commit.addColor(colorDELETE)
+	}
+	repo.scavenge("splice")
+	repo.cleanLegacyMap()
+	repo.renumber(context.Background(), 1, nil)
+	fragment.events = nil
+	fragment.cleanup()
+	return nil
+}
+
 // Apply a hook to all paths, returning the set of modified paths.
 func (repo *Repository) pathWalk(selection selectionSet, hook func(string) string) orderedStringSet {
 	if hook == nil {
@@ -8004,6 +9408,7 @@ func (repo *Repository) splitCommit(where int, splitfunc func([]*FileOp) ([]*Fil
 		return errors.New("no-op commit split, repo unchanged")
 	}
 	newclone := commit.clone(repo)
+	newclone.uuid = ""
 	newclone.setParents(commit.parents())
 	// Now that parents & children are correct, invalidate the manifest
 	newclone.invalidateManifests()
@@ -8215,7 +9620,7 @@ func readRepo(source string, options stringSet, preferred *VCS, extractor Extrac
 			}
 		}
 		repo.hint(vcs.name, true)
-		repo.preserveSet = vcs.preserve
+		repo.preserveSet = vcs.preserve.Clone()
 		suppressBaton := control.flagOptions["progress"] && repo.exportStyle().Contains("export-progress")
 		commandControl := map[string]string{"basename": filepath.Base(repo.sourcedir)}
 		mapper := func(sub string) string {
@@ -8262,6 +9667,18 @@ func readRepo(source string, options stringSet, preferred *VCS, extractor Extrac
 			repo.readLegacyMap(rfp, baton)
 			closeOrDie(rfp)
 		}
+		// The operations log of the sessions that made this repository
+		if oplogPath := filepath.Join(vcs.subdirectory, oplogName); vcs.subdirectory != "" && exists(oplogPath) {
+			rfp, err := os.Open(filepath.Clean(oplogPath))
+			if err != nil {
+				return nil, err
+			}
+			err = repo.readOplog(rfp)
+			closeOrDie(rfp)
+			if err != nil {
+				return nil, err
+			}
+		}
 		if vcs.pathlister != "" {
 			registered := newOrderedStringSet()
 			stdout, cmd, err := readFromProcess(vcs.pathlister)
@@ -8313,6 +9730,9 @@ func readRepo(source string, options stringSet, preferred *VCS, extractor Extrac
 		/* BEWARE, ADHESION */
 		// Process the map generated by git-cvsimport -R.
 		if repo.vcs.name == "git" {
+			if err := repo.readGitOverrides(); err != nil {
+				return nil, err
+			}
 			if exists(".git/cvs-revisions") {
 				if logEnable(logSHOUT) {
 					shout("reading cvs-revisions map.")
@@ -8398,7 +9818,7 @@ func readRepo(source string, options stringSet, preferred *VCS, extractor Extrac
 	return repo, nil
 }
 
-func (repo *Repository) innerRebuildRepo(vcs *VCS, options stringSet, baton *Baton) error {
+func (repo *Repository) innerRebuildRepo(ctx context.Context, vcs *VCS, options stringSet, baton *Baton) error {
 	if vcs.initializer != "" {
 		runProcess(vcs.initializer, "repository initialization")
 	}
@@ -8406,15 +9826,62 @@ func (repo *Repository) innerRebuildRepo(vcs *VCS, options stringSet, baton *Bat
 	if err != nil {
 		return err
 	}
-	repo.fastExport(undefinedSelectionSet, tp, options, vcs, baton)
+	err = repo.fastExport(ctx, undefinedSelectionSet, tp, options, vcs, baton)
 	tp.Close()
 	cls.Wait()
-	return nil
+	return err
 }
 
-// Rebuild a repository from the captured state.
-func (repo *Repository) rebuildRepo(target string, options stringSet,
-	preferred *VCS, baton *Baton) error {
+// Assumed ratios of raw content size to compressed size, used in
+// disk-space preflight checks.  Deliberately pessimistic; source code
+// usually does much better.
+const (
+	blobCompressionRatio   = 2
+	packedCompressionRatio = 2
+)
+
+// rebuildSpaceEstimate returns a rough upper bound on the disk space a
+// rebuild will consume: compressed storage for all content, plus an
+// uncompressed checkout of the tip of the default branch.
+func (repo *Repository) rebuildSpaceEstimate() int64 {
+	opsize := func(op *FileOp) int64 {
+		if op.ref == "inline" {
+			return int64(len(op.inline))
+		}
+		if blob, ok := repo.markToEvent(op.ref).(*Blob); ok {
+			return blob.size
+		}
+		return 0
+	}
+	var content int64
+	var tip *Commit
+	for _, event := range repo.events {
+		switch e := event.(type) {
+		case *Blob:
+			content += e.size
+		case *Commit:
+			for _, op := range e.operations() {
+				if op.op == opM && op.ref == "inline" {
+					content += int64(len(op.inline))
+				}
+			}
+			if tip == nil || e.Branch == "refs/heads/master" || tip.Branch != "refs/heads/master" {
+				tip = e
+			}
+		}
+	}
+	need := content / packedCompressionRatio
+	if tip != nil {
+		tip.manifest().iter(func(_ string, v interface{}) {
+			need += opsize(v.(*FileOp))
+		})
+	}
+	return need
+}
+
+// rebuildTarget works out where a rebuild goes and what VCS it makes,
+// and checks the repository can be imported there.
+func (repo *Repository) rebuildTarget(target string, preferred *VCS) (string, *VCS, error) {
 	if target == "" && repo.sourcedir != "" {
 		target = repo.sourcedir
 	}
@@ -8422,29 +9889,47 @@ func (repo *Repository) rebuildRepo(target string, options stringSet,
 		var err error
 		target, err = filepath.Abs(target)
 		if err != nil {
-			return fmt.Errorf("while computing target: %v", err)
+			return "", nil, fmt.Errorf("while computing target: %v", err)
 		}
 	} else {
-		return errors.New("no default destination for rebuild")
+		return "", nil, errors.New("no default destination for rebuild")
 	}
 	vcs := preferred
 	if vcs == nil {
 		vcs = repo.vcs
 	}
 	if vcs == nil {
-		return errors.New("please prefer a repo type first")
+		return "", nil, errors.New("please prefer a repo type first")
 	}
 	if vcs.importer == "" {
-		return fmt.Errorf("%s repositories supported for read only",
+		return "", nil, fmt.Errorf("%s repositories supported for read only",
 			vcs.name)
 
 	}
+	// Better to find out now than when the importer chokes
+	if err := repo.preflightError(vcs); err != nil {
+		return "", nil, err
+	}
+	return target, vcs, nil
+}
+
+// Rebuild a repository from the captured state.
+func (repo *Repository) rebuildRepo(ctx context.Context, target string, options stringSet,
+	preferred *VCS, baton *Baton) error {
+	target, vcs, err := repo.rebuildTarget(target, preferred)
+	if err != nil {
+		return err
+	}
 	chdir := func(directory string, legend string) {
 		os.Chdir(directory)
 		if logEnable(logSHUFFLE) {
 			logit("changing directory to %s: %s", legend, directory)
 		}
 	}
+	// Staging happens beside the target, so that's where space is needed
+	if err := checkFreeSpace(filepath.Dir(target), repo.rebuildSpaceEstimate(), "rebuild"); err != nil {
+		return err
+	}
 	// Create a new empty directory to do the rebuild in
 	var staging string
 	if !exists(target) {
@@ -8476,9 +9961,14 @@ func (repo *Repository) rebuildRepo(target string, options stringSet,
 		}
 	}()
 
-	if err := repo.innerRebuildRepo(vcs, options, baton); err != nil {
+	if err := repo.innerRebuildRepo(ctx, vcs, options, baton); err != nil {
 		return err
 	}
+	if vcs.name == "git" {
+		if err := repo.emitGitOverrides(); err != nil {
+			return err
+		}
+	}
 
 	if repo.writeLegacy {
 		legacyfile := filepath.FromSlash(vcs.subdirectory + "/legacy-map")
@@ -8494,6 +9984,18 @@ func (repo *Repository) rebuildRepo(target string, options stringSet,
 			return err
 		}
 	}
+	if vcs.subdirectory != "" && len(repo.oplog) > 0 {
+		oplogfile := filepath.Join(vcs.subdirectory, oplogName)
+		wfp, err := os.OpenFile(filepath.Clean(oplogfile),
+			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, userReadWriteMode)
+		if err != nil {
+			return fmt.Errorf("operations log %s could not be written: %v", oplogfile, err)
+		}
+		defer closeOrDie(wfp)
+		if err = repo.writeOplog(wfp); err != nil {
+			return err
+		}
+	}
 	shouldCheckout := true
 	/* BEWARE, ADHESION */
 	if preferred.name == "git" {
@@ -8595,15 +10097,21 @@ func (repo *Repository) rebuildRepo(target string, options stringSet,
 		respond("modified repo moved to %s.", target)
 		// Critical region ends
 	}
-	if len(repo.preserveSet) > 0 {
-		preserveMe := repo.preserveSet
+	// A target that already existed keeps its own hooks and
+	// configuration even when the history came from elsewhere.
+	preserveMe := repo.preserveSet.Clone()
+	if staging != target {
+		preserveMe = preserveMe.Union(vcs.preserve)
+	}
+	if len(preserveMe) > 0 {
 		if repo.vcs != nil && repo.vcs.authormap != "" {
-			preserveMe = append(preserveMe, repo.vcs.authormap)
+			preserveMe.Add(repo.vcs.authormap)
 		}
+		preserveMe = expandPreserves(savedir, preserveMe)
 		if logEnable(logSHUFFLE) {
 			logit("Copy preservation set %v from backup %s to target %s", preserveMe, savedir, target)
 		}
-		for _, sub := range repo.preserveSet {
+		for _, sub := range preserveMe {
 			src := ljoin(savedir, sub)
 			dst := ljoin(target, sub)
 			// Beware of adding a target-noxesistence check here,
@@ -8670,135 +10178,171 @@ func canonicalizeInlineAddress(line string) (bool, string, string, string) {
 	return true, pre, fmt.Sprintf("<%s>", strings.TrimSpace(email)), post
 }
 
-func (repo *Repository) processChangelogs(selection selectionSet, pattern string, baton *Baton) (bool, int, int, int, int) {
-	cm, cd := 0, 0
-	var errLock sync.Mutex
-	errlines := make([]string, 0)
-
-	// Machinery for recognizing and skipping dates in
-	// ChangeLog attribution lines. To add more date formats,
-	// put Go time format specifications in the dateFormats
-	// literal. The third literal is the common case. The
-	// first two are malformations from the GCC history that
-	// might be found elsewhere; they need to be before YYYY-MM-DD
-	// to avoid false-matching on it.
-	var dateFormats = []string{
-		"2006-01-02 15:04 -0700",
-		"2006-01-02 15:04",
-		"2006-01-02",
-		"02-01-2006",
-		time.UnixDate,
-		time.ANSIC}
-	type dateSkipper struct {
-		format   string
-		fmtCount int
-		skipre   *regexp.Regexp
-	}
-	dateSkippers := make([]dateSkipper, 0)
-	for _, format := range dateFormats {
+// Machinery for recognizing and skipping dates in ChangeLog
+// attribution lines. To add more date formats, put Go time format
+// specifications in the changelogDateFormats literal. The third
+// literal is the common case. The first two are malformations from
+// the GCC history that might be found elsewhere; they need to be
+// before YYYY-MM-DD to avoid false-matching on it.
+var changelogDateFormats = []string{
+	"2006-01-02 15:04 -0700",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"02-01-2006",
+	time.UnixDate,
+	time.ANSIC}
+
+type dateSkipper struct {
+	format   string
+	fmtCount int
+	skipre   *regexp.Regexp
+}
+
+var changelogDateSkippers = func() []dateSkipper {
+	skippers := make([]dateSkipper, 0, len(changelogDateFormats))
+	for _, format := range changelogDateFormats {
 		var skip dateSkipper
 		skip.format = format
 		skip.fmtCount = len(strings.Fields(format))
 		skip.skipre = regexp.MustCompile(strings.Repeat(`\S+\s+`, skip.fmtCount))
-		dateSkippers = append(dateSkippers, skip)
+		skippers = append(skippers, skip)
+	}
+	return skippers
+}()
+
+// A changelogParser extracts an attribution, "Name <address>", from
+// an entry header line of a ChangeLog.  It returns "" for a line that
+// isn't a header, and an error for one that looks like a header but
+// can't be read.
+type changelogParser func(line string) (string, error)
+
+// parseChangelogHeader is the changelogParser for FSF-style entry
+// headers, a date followed by a name and address.
+func parseChangelogHeader(line string) (string, error) {
+	r, _ := utf8.DecodeRuneInString(line)
+	if len(line) <= 10 || unicode.IsSpace(r) {
+		return "", nil
+	}
+	garbled := fmt.Errorf("garbled attribution %q", line)
+	ok, pre, email, post := canonicalizeInlineAddress(line)
+	if !ok {
+		return "", garbled
+	}
+	// Regenerate cleaned up attribution
+	line = pre + email + post
+	// Scan for a date - it's not an attribution line without one.
+	fields := strings.Fields(line)
+	for _, item := range changelogDateSkippers {
+		if len(fields) >= item.fmtCount {
+			possibleDate := strings.Join(fields[:item.fmtCount], " ")
+			_, err := time.Parse(item.format, possibleDate)
+			if err != nil {
+				continue
+			}
+			m := item.skipre.FindStringIndex(line)
+			if m == nil {
+				continue
+			}
+			addr := strings.TrimSpace(line[m[1]:])
+			return wsRE.ReplaceAllLiteralString(addr, " "), nil
+		}
+	}
+	return "", garbled
+}
+
+// regexpChangelogParser makes a changelogParser from a regular
+// expression matching header lines.  The attribution is its first
+// parenthesized group, or the whole match if it has none.
+func regexpChangelogParser(re *regexp.Regexp) changelogParser {
+	return func(line string) (string, error) {
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			return "", nil
+		}
+		found := m[0]
+		if len(m) > 1 {
+			found = m[1]
+		}
+		ok, pre, email, post := canonicalizeInlineAddress(found)
+		if !ok {
+			return "", fmt.Errorf("garbled attribution %q", line)
+		}
+		return wsRE.ReplaceAllLiteralString(strings.TrimSpace(pre+email+post), " "), nil
 	}
+}
 
-	parseChangelogLine := func(line string, commit *Commit, filepath string, pos int) string {
-		// Parse an attribution line in a ChangeLog entry, get an email address
-		r, _ := utf8.DecodeRuneInString(line)
-		if len(line) <= 10 || unicode.IsSpace(r) {
+// parseChangelogCoAuthor parses a co-author line following an entry
+// header in a ChangeLog, returning "" if it isn't one.
+func parseChangelogCoAuthor(line string) string {
+	// A co-author must start with a letter after leading space
+	foundSpace := false
+	for _, r := range line {
+		if unicode.IsSpace(r) {
+			foundSpace = true
+		} else if foundSpace && unicode.IsLetter(r) {
+			break
+		} else {
+			// Neither a space, nor a letter after spaces
 			return ""
 		}
-		complain := func() {
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return ""
+	}
+	// Split the address
+	ok, pre, email, post := canonicalizeInlineAddress(line)
+	if !ok || post != "" {
+		return ""
+	}
+	// Trim spaces around the name, email is already trimmed
+	return fmt.Sprintf("%s %s", strings.TrimSpace(pre), email)
+}
+
+// changelogInference is what the ChangeLog changes in one commit say
+// about who wrote it.  Confidence is "high" when an entry header was
+// added by the commit, "medium" when only lines under an existing
+// header were, and "ambiguous" when more than one header is in play,
+// in which case the commit is left alone.
+type changelogInference struct {
+	commit     *Commit
+	header     string       // The attribution as the ChangeLog gives it
+	author     *Attribution // What it resolves to, nil if unusable
+	coAuthors  []string
+	confidence string
+}
+
+// inferChangelogAttributions reads the ChangeLog changes in the
+// selected commits and reports what they say about authorship,
+// without changing anything.  isChangeLog tells which files are
+// ChangeLogs; parser reads their entry headers.  Commits that change
+// nothing but ChangeLogs are skipped, being more likely log rotations
+// or typo fixes than real work.  Also returns the numbers of commits
+// and ChangeLog modifications examined.
+func (repo *Repository) inferChangelogAttributions(selection selectionSet, isChangeLog func(string) bool, parser changelogParser, baton *Baton) ([]changelogInference, int, int) {
+	var errLock sync.Mutex
+	errlines := make([]string, 0)
+	parseChangelogLine := func(line string, commit *Commit, filepath string) string {
+		attribution, err := parser(line)
+		if err != nil {
 			errLock.Lock()
 			id := commit.idMe()
 			if commit.legacyID != "" {
 				id += fmt.Sprintf(" <%s>", commit.legacyID)
 			}
 			errlines = append(errlines,
-				fmt.Sprintf("%s at %s has garbled attribution %q",
-					filepath, id, line))
+				fmt.Sprintf("%s at %s has %v", filepath, id, err))
 			errLock.Unlock()
 		}
-		ok, pre, email, post := canonicalizeInlineAddress(line)
-		if !ok {
-			complain()
-			return ""
-		}
-
-		// Regenerate cleaned up attribution
-		line = pre + email + post
-		// Scan for a date - it's not an attribution line without one.
-		fields := strings.Fields(line)
-		for _, item := range dateSkippers {
-			if len(fields) >= item.fmtCount {
-				possibleDate := strings.Join(fields[:item.fmtCount], " ")
-				_, err := time.Parse(item.format, possibleDate)
-				if err != nil {
-					continue
-				}
-				m := item.skipre.FindStringIndex(line)
-				if m == nil {
-					continue
-				}
-				addr := strings.TrimSpace(line[m[1]:])
-				return wsRE.ReplaceAllLiteralString(addr, " ")
-			}
-		}
-		complain()
-		return ""
-	}
-	parseCoAuthor := func(line string) string {
-		// Parse a co-author line in a Changelog
-		// A co-author must start with a letter after leading space
-		foundSpace := false
-		for _, r := range line {
-			if unicode.IsSpace(r) {
-				foundSpace = true
-			} else if foundSpace && unicode.IsLetter(r) {
-				break
-			} else {
-				// Neither a space, nor a letter after spaces
-				return ""
-			}
-		}
-		line = strings.TrimSpace(line)
-		if line == "" {
-			return ""
-		}
-		// Split the address
-		ok, pre, email, post := canonicalizeInlineAddress(line)
-		if !ok || post != "" {
-			return ""
-		}
-		// Trim spaces around the name, email is already trimmed
-		return fmt.Sprintf("%s %s", strings.TrimSpace(pre), email)
+		return attribution
 	}
 
 	baton.startProgress("processing changelogs", uint64(len(repo.events)))
-	attributions := make([]string, selection.Size())
-	allCoAuthors := make([][]string, selection.Size())
+	inferences := make([]*changelogInference, selection.Size())
 	evts := new(Safecounter) // shared between threads, for progression only
 	cc := new(Safecounter)
 	cl := new(Safecounter)
-	logpattern := "/ChangeLog$/"
-	if pattern != "" {
-		logpattern = pattern
-	}
-	if len(pattern) >= 2 && pattern[0] != pattern[len(pattern)-1] {
-		croak("regular expression requires matching start and end delimiters")
-		return false, 0, 0, 0, 0
-	}
-	clRe, err := regexp.Compile(logpattern[1 : len(logpattern)-1])
-	if err != nil {
-		croak("invalid regular expression for changelog matching: /%s/ (%v)", logpattern, err)
-		return false, 0, 0, 0, 0
-	}
-	isChangeLog := func(filename string) bool {
-		return clRe.MatchString(filepath.Base(filename))
-	}
 	repo.walkEvents(selection, func(eventRank int, event Event) bool {
-		event.removeColor(colorQSET)
 		commit, iscommit := event.(*Commit)
 		evts.bump()
 		defer baton.percentProgress(uint64(evts.value))
@@ -8820,6 +10364,7 @@ func (repo *Repository) processChangelogs(selection selectionSet, pattern string
 			return true
 		}
 		foundAttribution := ""
+		confidence := "medium"
 		coAuthors := make(map[string]bool, 0)
 		// Let's say an attribution is active when its <author><date> line is
 		// newly added, or if there is a new non-whitespace line added in the
@@ -8851,17 +10396,18 @@ func (repo *Repository) processChangelogs(selection selectionSet, pattern string
 						for pos := difflines.J1; pos < difflines.J2; pos++ {
 							diffline := now[pos]
 							if strings.TrimSpace(diffline) != "" {
-								attribution := parseChangelogLine(diffline, commit, op.Path, pos)
+								attribution := parseChangelogLine(diffline, commit, op.Path)
 								foundAt := 0
 								if attribution != "" {
 									// we found an active attribution line
 									foundAt = pos
+									confidence = "high"
 									goto attributionFound
 								} else if lastIsValid {
 									// this is not an attribution line, search for
 									// the last one since we are in its block
 									for j := lastUnchanged.J2 - 1; j >= lastUnchanged.J1; j-- {
-										attribution = parseChangelogLine(now[j], commit, op.Path, j)
+										attribution = parseChangelogLine(now[j], commit, op.Path)
 										if attribution != "" {
 											// this is the active attribution
 											// corresponding to the added chunk
@@ -8875,13 +10421,14 @@ func (repo *Repository) processChangelogs(selection selectionSet, pattern string
 								if foundAttribution != "" &&
 									foundAttribution != attribution {
 									// there is more than one active, skip the commit
+									inferences[eventRank] = &changelogInference{commit: commit, confidence: "ambiguous"}
 									return true
 								}
 								foundAttribution = attribution
 								lastIsValid = false // it is now irrelevant
 								// Now search for co-authors below the attribution
 								for i := foundAt + 1; i < len(now); i++ {
-									coAuthor := parseCoAuthor(now[i])
+									coAuthor := parseChangelogCoAuthor(now[i])
 									if coAuthor == "" {
 										break
 									}
@@ -8894,7 +10441,9 @@ func (repo *Repository) processChangelogs(selection selectionSet, pattern string
 				}
 			}
 		}
-		attributions[eventRank] = foundAttribution
+		if foundAttribution == "" {
+			return true
+		}
 		sorted := make([]string, len(coAuthors))
 		k := 0
 		for coAuthor := range coAuthors {
@@ -8902,52 +10451,85 @@ func (repo *Repository) processChangelogs(selection selectionSet, pattern string
 			k++
 		}
 		sort.Strings(sorted)
-		allCoAuthors[eventRank] = sorted
+		inferences[eventRank] = &changelogInference{
+			commit:     commit,
+			header:     foundAttribution,
+			coAuthors:  sorted,
+			confidence: confidence,
+		}
 		return true
 	})
 	baton.endProgress()
-	for it := selection.Iterator(); it.Next(); {
-		eventRank := it.Index()
-		eventID := it.Value()
-		commit, iscommit := repo.events[eventID].(*Commit)
-		attribution := attributions[eventRank]
-		if !iscommit || attribution == "" {
+	found := make([]changelogInference, 0)
+	for _, inference := range inferences {
+		if inference == nil {
 			continue
 		}
-		// Invalid addresses will cause fatal errors if they get into a
-		// fast-import stream. Filter out bogons...
-		matches := addressRE.FindAllStringSubmatch(strings.TrimSpace(attribution), -1)
-		if matches == nil {
-			if logEnable(logSHOUT) {
-				shout("invalid attribution %q in commit %s <%s>", attribution, commit.mark, commit.legacyID)
-			}
-			continue
+		if inference.header != "" {
+			inference.author = repo.changelogAuthor(inference.commit, inference.header)
 		}
-		cm++
-		newattr := commit.committer.clone()
-		newattr.email = matches[0][2]
-		newattr.fullname = matches[0][1]
-		newattr.date.setTZ("UTC")
-		// This assumes email addresses of contributors are unique.
-		// We could get wacky results if two people with different
-		// human names but identical email addresses were run through
-		// this code, but that outcome seems wildly unlikely.
-		if newattr.fullname == "" {
-			for _, mapentry := range repo.authormap {
-				if newattr.email == mapentry.email {
-					newattr.fullname = mapentry.fullname
-					break
-				}
-			}
+		found = append(found, *inference)
+	}
+	sort.Slice(errlines, func(i, j int) bool { return errlines[i] < errlines[j] })
+	// Sort is requirs to make message order deterministic
+	for _, line := range errlines {
+		if logEnable(logSHOUT) {
+			shout(line)
+		}
+	}
+	return found, cc.value, cl.value
+}
+
+// changelogAuthor resolves a ChangeLog attribution to an author for a
+// commit, or nil if it isn't a usable address.
+func (repo *Repository) changelogAuthor(commit *Commit, attribution string) *Attribution {
+	// Invalid addresses will cause fatal errors if they get into a
+	// fast-import stream. Filter out bogons...
+	matches := addressRE.FindAllStringSubmatch(strings.TrimSpace(attribution), -1)
+	if matches == nil {
+		if logEnable(logSHOUT) {
+			shout("invalid attribution %q in commit %s <%s>", attribution, commit.mark, commit.legacyID)
 		}
-		if tz, ok := repo.tzmap[newattr.email]; ok { //&& unicode.IsLetter(rune(tz.String()[0])) {
-			newattr.date.timestamp = newattr.date.timestamp.In(tz)
-		} else if zone := zoneFromEmail(newattr.email); zone != "" {
-			newattr.date.setTZ(zone)
+		return nil
+	}
+	newattr := commit.committer.clone()
+	newattr.email = matches[0][2]
+	newattr.fullname = matches[0][1]
+	newattr.date.setTZ("UTC")
+	// This assumes email addresses of contributors are unique.
+	// We could get wacky results if two people with different
+	// human names but identical email addresses were run through
+	// this code, but that outcome seems wildly unlikely.
+	if newattr.fullname == "" {
+		for _, mapentry := range repo.authormap {
+			if newattr.email == mapentry.email {
+				newattr.fullname = mapentry.fullname
+				break
+			}
 		}
-		if val, ok := repo.aliases[ContributorID{fullname: newattr.fullname, email: newattr.email}]; ok {
-			newattr.fullname, newattr.email = val.fullname, val.email
+	}
+	if tz, ok := repo.tzmap[newattr.email]; ok { //&& unicode.IsLetter(rune(tz.String()[0])) {
+		newattr.date.timestamp = newattr.date.timestamp.In(tz)
+	} else if zone := zoneFromEmail(newattr.email); zone != "" {
+		newattr.date.setTZ(zone)
+	}
+	if val, ok := repo.aliases[ContributorID{fullname: newattr.fullname, email: newattr.email}]; ok {
+		newattr.fullname, newattr.email = val.fullname, val.email
+	}
+	return newattr
+}
+
+// applyChangelogAttributions makes the authorship changes inferences
+// call for.  Returns the number of authorships filled and the number
+// changed, which get Q bits.
+func (repo *Repository) applyChangelogAttributions(inferences []changelogInference) (int, int) {
+	cm, cd := 0, 0
+	for _, inference := range inferences {
+		commit, newattr := inference.commit, inference.author
+		if newattr == nil {
+			continue
 		}
+		cm++
 		if len(commit.authors) == 0 {
 			commit.authors = append(commit.authors, *newattr)
 		} else {
@@ -8971,22 +10553,101 @@ func (repo *Repository) processChangelogs(selection selectionSet, pattern string
 			}
 		}
 		// Now fill-in the co-authors
-		if len(allCoAuthors[eventRank]) > 0 {
+		if len(inference.coAuthors) > 0 {
 			message := []string{commit.Comment}
-			message = append(message, allCoAuthors[eventRank]...)
+			message = append(message, inference.coAuthors...)
 			commit.Comment = strings.Join(message, "\nCo-Authored-By: ") + "\n"
 		}
 	}
 	repo.invalidateNamecache()
-	sort.Slice(errlines, func(i, j int) bool { return errlines[i] < errlines[j] })
-	// Sort is requirs to make message order deterministic
-	for _, line := range errlines {
-		if logEnable(logSHOUT) {
-			shout(line)
-		}
+	return cm, cd
+}
+
+// changelogMatcher makes a test for ChangeLog basenames from a
+// delimited pattern, "/ChangeLog$/" if it is empty.
+func changelogMatcher(pattern string) (func(string) bool, error) {
+	logpattern := "/ChangeLog$/"
+	if pattern != "" {
+		logpattern = pattern
+	}
+	if len(logpattern) < 2 || logpattern[0] != logpattern[len(logpattern)-1] {
+		return nil, errors.New("regular expression requires matching start and end delimiters")
+	}
+	clRe, err := regexp.Compile(logpattern[1 : len(logpattern)-1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression for changelog matching: %s (%v)", logpattern, err)
+	}
+	return func(filename string) bool {
+		return clRe.MatchString(filepath.Base(filename))
+	}, nil
+}
+
+// processChangelogs mines ChangeLogs in the selected commits for
+// authorship and applies what it finds, unless dryrun is set.  Returns
+// the inferences, the numbers of authorships filled and changed, and
+// the numbers of commits and ChangeLog modifications examined.
+func (repo *Repository) processChangelogs(selection selectionSet, pattern string, parser changelogParser, dryrun bool, baton *Baton) ([]changelogInference, int, int, int, int, error) {
+	isChangeLog, err := changelogMatcher(pattern)
+	if err != nil {
+		return nil, 0, 0, 0, 0, err
+	}
+	inferences, cc, cl := repo.inferChangelogAttributions(selection, isChangeLog, parser, baton)
+	if dryrun {
+		return inferences, 0, 0, cc, cl, nil
+	}
+	for it := selection.Iterator(); it.Next(); {
+		repo.events[it.Value()].removeColor(colorQSET)
 	}
+	cm, cd := repo.applyChangelogAttributions(inferences)
+	return inferences, cm, cd, cc, cl, nil
+}
+
+// transformBlobs passes the content of each blob in the selection
+// through a hook and replaces it with whatever the hook returns. Blobs
+// the hook leaves unaltered are not rewritten; altered ones get fresh
+// storage, size, and hash, and have their Q bits set.  The hook may be
+// called concurrently and must not share mutable state without locking.
+// Returns the count of blobs modified.
+func (repo *Repository) transformBlobs(selection selectionSet, hook func([]byte) []byte, baton *Baton) int {
+	altered := new(Safecounter)
+	repo.clearColor(colorQSET)
+	baton.startProgress("transforming blobs", uint64(selection.Size()))
+	repo.walkEvents(selection, func(idx int, event Event) bool {
+		if blob, ok := event.(*Blob); ok {
+			stream := blob.getContentStream()
+			content, err := ioutil.ReadAll(stream)
+			closeOrDie(stream)
+			if err != nil {
+				panic(fmt.Errorf("Blob read: %v", err))
+			}
+			modified := hook(content)
+			if !bytes.Equal(content, modified) {
+				blob.setContentFromStream(ioutil.NopCloser(bytes.NewReader(modified)))
+				blob.addColor(colorQSET)
+				altered.bump()
+			}
+		}
+		baton.percentProgress(uint64(idx))
+		return true
+	})
+	baton.endProgress()
+	return altered.value
+}
 
-	return true, cm, cc.value, cd, cl.value
+// blobCommandHook returns a transformBlobs hook that pipes content
+// through a shell command.  If the command fails the content is
+// returned unaltered and a warning is logged.
+func blobCommandHook(command string) func([]byte) []byte {
+	return func(content []byte) []byte {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdin = bytes.NewReader(content)
+		out, err := cmd.Output()
+		if err != nil {
+			warn("filter", "blob transform command %q failed: %v", command, err)
+			return content
+		}
+		return out
+	}
 }
 
 // Filter commit metadata (and possibly blobs) through a specified hook.
@@ -9193,9 +10854,69 @@ func (pa pathAction) String() string {
 	return fmt.Sprintf("[%s(%d) %s=%s]", pa.commit.idMe(), i, pa.attr, pa.newpath)
 }
 
+// sedExpression parses a sed-style substitution, s/REGEXP/REPLACEMENT/,
+// into a regexp and a replacement in GoReplacer's syntax.  Any
+// character may stand in for the slash; a backslash escapes it.  In
+// the replacement \1 through \9 refer to capture groups and & to the
+// whole match, as in sed.  The g flag is accepted and ignored, since
+// every match is always replaced.
+func sedExpression(expr string) (*regexp.Regexp, string, error) {
+	if len(expr) < 2 || expr[0] != 's' {
+		return nil, "", fmt.Errorf("%q is not a sed-style substitution", expr)
+	}
+	delim := expr[1]
+	parts := make([]string, 0, 3)
+	var field strings.Builder
+	for i := 2; i < len(expr); i++ {
+		c := expr[i]
+		if c == '\\' && i+1 < len(expr) && expr[i+1] == delim {
+			field.WriteByte(delim)
+			i++
+		} else if c == delim && len(parts) < 2 {
+			parts = append(parts, field.String())
+			field.Reset()
+		} else {
+			field.WriteByte(c)
+		}
+	}
+	if len(parts) < 2 {
+		return nil, "", fmt.Errorf("unterminated substitution %q", expr)
+	}
+	if flags := field.String(); flags != "" && flags != "g" {
+		return nil, "", fmt.Errorf("unsupported substitution flags %q", flags)
+	}
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, "", err
+	}
+	var repl strings.Builder
+	for i := 0; i < len(parts[1]); i++ {
+		c := parts[1][i]
+		switch {
+		case c == '\\' && i+1 < len(parts[1]) && parts[1][i+1] >= '0' && parts[1][i+1] <= '9':
+			fmt.Fprintf(&repl, "${%c}", parts[1][i+1])
+			i++
+		case c == '\\' && i+1 < len(parts[1]) && parts[1][i+1] == '\\':
+			repl.WriteString(`\\`)
+			i++
+		case c == '\\' && i+1 < len(parts[1]) && parts[1][i+1] == '&':
+			repl.WriteByte('&')
+			i++
+		case c == '&':
+			repl.WriteString("${0}")
+		case c == '$':
+			repl.WriteString("$$")
+		default:
+			repl.WriteByte(c)
+		}
+	}
+	return re, repl.String(), nil
+}
+
 // pathRename performs batch path renames by regular expression
 func (repo *Repository) pathRename(selection selectionSet, sourceRE *regexp.Regexp, targetPattern string, force bool) {
 	actions := make([]pathAction, 0)
+	touched := make([]*Commit, 0)
 	repo.clearColor(colorQSET)
 	for it := repo.commitIterator(selection); it.Next(); {
 		it.commit().removeColor(colorQSET)
@@ -9206,17 +10927,16 @@ func (repo *Repository) pathRename(selection selectionSet, sourceRE *regexp.Rege
 					if ok && oldpath != "" && sourceRE.MatchString(oldpath) {
 						newpath := GoReplacer(sourceRE, oldpath, targetPattern)
 						if !force && it.commit().visible(newpath) != nil {
-							if logEnable(logWARN) {
-								logit("rename of %s at %s failed, %s visible in ancestry", oldpath, it.commit().idMe(), newpath)
-							}
+							warn("rename", "rename of %s at %s failed, %s visible in ancestry", oldpath, it.commit().idMe(), newpath)
 							return
 						} else if !force && it.commit().paths(nil).Contains(newpath) {
-							if logEnable(logWARN) {
-								logit("rename of %s at %s failed, %s exists there", oldpath, it.commit().idMe(), newpath)
-							}
+							warn("rename", "rename of %s at %s failed, %s exists there", oldpath, it.commit().idMe(), newpath)
 							return
 						} else {
 							actions = append(actions, pathAction{fileop, it.commit(), attr, newpath})
+							if !it.commit().hasColor(colorQSET) {
+								touched = append(touched, it.commit())
+							}
 							it.commit().addColor(colorQSET)
 						}
 					}
@@ -9224,10 +10944,44 @@ func (repo *Repository) pathRename(selection selectionSet, sourceRE *regexp.Rege
 			}
 		}
 	}
+	if !force {
+		for _, commit := range touched {
+			if source, other, target := renameCollision(commit, sourceRE, targetPattern); target != "" {
+				warn("rename", "rename at %s failed, %s and %s would both become %s", commit.idMe(), source, other, target)
+				return
+			}
+		}
+	}
 	// All checks must pass before any renames
 	for _, action := range actions {
 		setAttr(action.fileop, action.attr, action.newpath)
 	}
+	for _, commit := range touched {
+		commit.invalidateManifests()
+	}
+}
+
+// renameCollision looks for two paths in the manifest of a commit that
+// a rename would map to the same target.  It returns them and the
+// target, or empty strings if there is no such pair.
+func renameCollision(commit *Commit, sourceRE *regexp.Regexp, targetPattern string) (string, string, string) {
+	paths := make([]string, 0)
+	commit.manifest().iter(func(path string, _ interface{}) {
+		paths = append(paths, path)
+	})
+	sort.Strings(paths)
+	sources := make(map[string]string, len(paths))
+	for _, path := range paths {
+		target := path
+		if sourceRE.MatchString(path) {
+			target = GoReplacer(sourceRE, path, targetPattern)
+		}
+		if earlier, ok := sources[target]; ok {
+			return earlier, path, target
+		}
+		sources[target] = path
+	}
+	return "", "", ""
 }
 
 // Delete branches as git does, by forgetting all commits reachable only from
@@ -9310,32 +11064,67 @@ func (repo *Repository) deleteBranch(shouldDelete func(string) bool, baton *Bato
 	// Actually delete the commits only reachable from wrong branches.
 	// --no-preserve-refs is to avoid creating new resets on wrong branches
 	repo.delete(selectionSet(deletia), orderedStringSet{"--no-preserve-refs"}, baton)
-	repo._buildNamecache()
+	repo.invalidateNamecache()
 }
 
 // readMessageBox modifies repo metadata by reading/merging in a mailbox stream.
+// A stream that can be rewound is read twice, once to validate the
+// updates and once to apply them, so the messages are never all in
+// memory at once.
 func (repo *Repository) readMessageBox(selection selectionSet, input io.ReadCloser,
 	create bool, emptyOnly bool, relax bool) (int, int, int) {
 	type updateBlock struct {
 		eventValid bool
-		update     *MessageBlock
 		event      Event // Not reliably nil when invalid, it's an interface
 	}
 	updateList := make([]updateBlock, 0)
-	r := bufio.NewReader(input)
-	if r == nil {
-		croak("reader creation failed")
-		return 1, 0, 0
+	var start int64 = -1
+	seeker, seekable := input.(io.Seeker)
+	if seekable && !create {
+		if offset, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			start = offset
+		}
 	}
-	for {
-		msg, err := newMessageBlock(r)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			croak("malformed message block: %v", err)
-			return 1, 0, 0
+	var held []*MessageBlock
+	if start < 0 {
+		mbox := newMsgboxReader(input)
+		for {
+			msg, err := mbox.next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				croak("malformed message block: %v", err)
+				return 1, 0, 0
+			}
+			held = append(held, msg)
+		}
+	}
+	// eachMessage calls visit on the messages in order until it
+	// returns false.
+	eachMessage := func(visit func(int, *MessageBlock) bool) error {
+		if start < 0 {
+			for i, msg := range held {
+				if !visit(i, msg) {
+					break
+				}
+			}
+			return nil
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		mbox := newMsgboxReader(input)
+		for i := 0; ; i++ {
+			msg, err := mbox.next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if !visit(i, msg) {
+				return nil
+			}
 		}
-		updateList = append(updateList, updateBlock{false, msg, nil})
 	}
 	// First, a validation pass
 	attributionByAuthor := make(map[string]Event)
@@ -9378,12 +11167,12 @@ func (repo *Repository) readMessageBox(selection selectionSet, input io.ReadClos
 	}
 	// Special case - event creation
 	if create {
-		for _, operation := range updateList {
-			if strings.Contains(operation.update.String(), "Tag-Name") {
+		for _, update := range held {
+			if strings.Contains(update.String(), "Tag-Name") {
 				blank := newTag(nil, "", "", "")
 				attrib, _ := newAttribution("")
 				blank.tagger = *attrib
-				blank.emailIn(operation.update, true)
+				blank.emailIn(update, true)
 				commits := repo.commits(undefinedSelectionSet)
 				if len(commits) == 0 {
 					panic(throw("command", "repository has no commits"))
@@ -9397,7 +11186,7 @@ func (repo *Repository) readMessageBox(selection selectionSet, input io.ReadClos
 				if commits := repo.commits(undefinedSelectionSet); len(commits) > 0 {
 					blank.addParentByMark(commits[len(commits)-1].mark)
 				}
-				blank.emailIn(operation.update, true)
+				blank.emailIn(update, true)
 				blank.mark = repo.newmark()
 				if blank.Branch == "" {
 					// Avoids crapping out on name lookup.
@@ -9405,7 +11194,7 @@ func (repo *Repository) readMessageBox(selection selectionSet, input io.ReadClos
 				}
 				// Grumble. Would be nice to allow multiple Content-Path headers
 				// producing a fileop each, but UpdateBlock doesn't allow it.
-				if path := operation.update.getHeader("Content-Path"); path != "" {
+				if path := update.getHeader("Content-Path"); path != "" {
 					path = filepath.Clean(path)
 					if cfp, err := os.Open(path); err != nil {
 						panic(throw("command", fmt.Sprintf("invalid content path %q in update", path)))
@@ -9425,7 +11214,7 @@ func (repo *Repository) readMessageBox(selection selectionSet, input io.ReadClos
 						if info.Mode()&0111 != 0 {
 							perms = "100755"
 						}
-						name := operation.update.getHeader("Content-Name")
+						name := update.getHeader("Content-Name")
 						if name == "" {
 							name = path
 						}
@@ -9452,7 +11241,8 @@ func (repo *Repository) readMessageBox(selection selectionSet, input io.ReadClos
 	warnCount := 0
 	var trialEvent Event
 	var ok bool
-	for i := range updateList {
+	err := eachMessage(func(i int, update *MessageBlock) bool {
+		updateList = append(updateList, updateBlock{})
 		trialmark := func(ok bool, event Event, format string, key string) {
 			if ok {
 				updateList[i].event = event
@@ -9465,8 +11255,11 @@ func (repo *Repository) readMessageBox(selection selectionSet, input io.ReadClos
 			}
 		}
 		updateList[i].eventValid = false
-		if updateList[i].update.getHeader("Event-Number") != "" {
-			eventnum, err := strconv.Atoi(updateList[i].update.getHeader("Event-Number"))
+		if event := repo.eventByID(update.getHeader("Event-UUID")); event != nil {
+			updateList[i].event = event
+			updateList[i].eventValid = true
+		} else if update.getHeader("Event-Number") != "" {
+			eventnum, err := strconv.Atoi(update.getHeader("Event-Number"))
 			if err != nil {
 				croak("msgin: event number garbled in update %d: %v", i+1, err)
 				errorCount++
@@ -9480,17 +11273,17 @@ func (repo *Repository) readMessageBox(selection selectionSet, input io.ReadClos
 					updateList[i].eventValid = true
 				}
 			}
-		} else if legacyID := updateList[i].update.getHeader("Legacy-ID"); legacyID != "" {
+		} else if legacyID := update.getHeader("Legacy-ID"); legacyID != "" {
 			trialEvent, ok = legacyIDMap[legacyID]
 			trialmark(ok, trialEvent, "msgin: no commit matches legacy-ID %s", legacyID)
-		} else if mark := updateList[i].update.getHeader("Event-Mark"); mark != "" {
+		} else if mark := update.getHeader("Event-Mark"); mark != "" {
 			trialEvent := repo.markToEvent(mark)
 			trialmark(trialEvent != nil, trialEvent, "msgin: no commit matches mark %s", mark)
-		} else if updateList[i].update.getHeader("Author") != "" && updateList[i].update.getHeader("Author-Date") != "" {
+		} else if update.getHeader("Author") != "" && update.getHeader("Author-Date") != "" {
 			blank := newCommit(repo)
 			attrib, _ := newAttribution("")
 			blank.authors = append(blank.authors, *attrib)
-			blank.emailIn(updateList[i].update, false)
+			blank.emailIn(update, false)
 			stamp := blank.actionStamp()
 			trialEvent, ok = attributionByAuthor[stamp]
 			trialmark(ok, trialEvent, "msgin: no commit matches stamp %s", stamp)
@@ -9498,11 +11291,11 @@ func (repo *Repository) readMessageBox(selection selectionSet, input io.ReadClos
 				croak("msgin: multiple events (%d) match %s", authorCounts[stamp], stamp)
 				errorCount++
 			}
-		} else if updateList[i].update.getHeader("Committer") != "" && updateList[i].update.getHeader("Committer-Date") != "" {
+		} else if update.getHeader("Committer") != "" && update.getHeader("Committer-Date") != "" {
 			blank := newCommit(repo)
 			attrib, _ := newAttribution("")
 			blank.committer = *attrib
-			blank.emailIn(updateList[i].update, false)
+			blank.emailIn(update, false)
 			stamp := blank.committer.actionStamp()
 			trialEvent, ok = attributionByCommitter[stamp]
 			trialmark(ok, trialEvent, "msgin: no commit matches stamp %s", stamp)
@@ -9510,11 +11303,11 @@ func (repo *Repository) readMessageBox(selection selectionSet, input io.ReadClos
 				croak(fmt.Sprintf("msgin: multiple events (%d) match %s", committerCounts[stamp], stamp))
 				errorCount++
 			}
-		} else if updateList[i].update.getHeader("Tagger") != "" && updateList[i].update.getHeader("Tagger-Date") != "" {
+		} else if update.getHeader("Tagger") != "" && update.getHeader("Tagger-Date") != "" {
 			blank := newTag(repo, "", "", "")
 			attrib, _ := newAttribution("")
 			blank.tagger = *attrib
-			blank.emailIn(updateList[i].update, false)
+			blank.emailIn(update, false)
 			stamp := blank.tagger.actionStamp()
 			trialEvent, ok = attributionByAuthor[stamp]
 			trialmark(ok, trialEvent, "msgin: no tag matches stamp %s", stamp)
@@ -9522,12 +11315,12 @@ func (repo *Repository) readMessageBox(selection selectionSet, input io.ReadClos
 				croak("msgin: multiple events match %s", stamp)
 				errorCount++
 			}
-		} else if tagname := updateList[i].update.getHeader("Tag-Name"); tagname != "" {
+		} else if tagname := update.getHeader("Tag-Name"); tagname != "" {
 			trialEvent, ok = nameMap[tagname]
 			trialmark(ok, trialEvent, "msgin: no tag matches name %s", tagname)
 		} else {
 			if !relax {
-				logit("no commit or tag matches update %d:\n%s", i+1, updateList[i].update.String())
+				logit("no commit or tag matches update %d:\n%s", i+1, update.String())
 			}
 			warnCount++
 		}
@@ -9540,6 +11333,11 @@ func (repo *Repository) readMessageBox(selection selectionSet, input io.ReadClos
 				errorCount++
 			}
 		}
+		return true
+	})
+	if err != nil {
+		croak("malformed message block: %v", err)
+		return errorCount + 1, warnCount, 0
 	}
 	if errorCount > 0 {
 		return errorCount, warnCount, 0
@@ -9547,118 +11345,68 @@ func (repo *Repository) readMessageBox(selection selectionSet, input io.ReadClos
 	// Now apply the updates
 	//repo.clearColor(colorQSET)
 	changeCount := 0
-	for i, change := range updateList {
-		if !change.eventValid || change.update == nil {
-			continue
+	bailed := false
+	err = eachMessage(func(i int, update *MessageBlock) bool {
+		change := updateList[i]
+		if !change.eventValid {
+			return true
 		}
-		check := strings.TrimSpace(change.update.getHeader("Check-Text"))
+		check := strings.TrimSpace(update.getHeader("Check-Text"))
 		if check != "" && !strings.HasPrefix(strings.TrimSpace(change.event.getComment()), check) {
 			seen := change.event.getComment()
 			croak("msgin: check text mismatch at %s (input %d of %d), expected %q saw %q", change.event.idMe(), i+1, len(updateList), check, seen[:min(len(check), len(seen))])
 			errorCount++
-			continue
+			return true
 		}
 		if emptyOnly {
-			if change.event.getComment() != change.update.getPayload() && !emptyComment(change.event.getComment()) {
+			if change.event.getComment() != update.getPayload() && !emptyComment(change.event.getComment()) {
 				croak("msgin: nonempty comment at %s (input %d of %d), bailing out", change.event.idMe(), i+1, len(updateList))
-				return errorCount + 1, warnCount, 0
+				bailed = true
+				return false
 			}
 		}
-
-		switch change.event.(type) {
-		case *Commit:
-			commit := change.event.(*Commit)
-			if commit.emailIn(change.update, false) {
-				changeCount++
-				change.event.addColor(colorQSET)
-			}
-		case *Tag:
-			tag := change.event.(*Tag)
-			if tag.emailIn(change.update, false) {
-				changeCount++
-				change.event.addColor(colorQSET)
-			}
-		case *Blob:
-			blob := change.event.(*Blob)
-			if blob.emailIn(change.update, false) {
-				changeCount++
-				change.event.addColor(colorQSET)
-			}
+		if carrier, ok := change.event.(messageCarrier); ok && carrier.consumeMessage(update) {
+			changeCount++
+			change.event.addColor(colorQSET)
 		}
+		return true
+	})
+	if err != nil {
+		croak("malformed message block: %v", err)
+		errorCount++
+	}
+	if bailed {
+		return errorCount + 1, warnCount, 0
 	}
 
 	return errorCount, warnCount, changeCount
 }
 
-func (repo *Repository) doGraph(selection selectionSet, output io.Writer) {
-	fmt.Fprint(output, "digraph {\n")
-	for it := selection.Iterator(); it.Next(); {
-		event := repo.events[it.Value()]
-		if commit, ok := event.(*Commit); ok {
-			for _, parent := range commit.parentMarks() {
-				if selection.Contains(repo.markToIndex(parent)) {
-					fmt.Fprintf(output, "\t%s -> %s;\n",
-						parent[1:], commit.mark[1:])
-				}
-			}
-		}
-		if tag, ok := event.(*Tag); ok {
-			fmt.Fprintf(output, "\t\"%s\" -> \"%s\" [style=dotted];\n",
-				tag.tagname, tag.committish[1:])
-			fmt.Fprintf(output, "\t{rank=same; \"%s\"; \"%s\"}\n",
-				tag.tagname, tag.committish[1:])
-		}
+func (repo *Repository) doCoalesce(selection selectionSet, timefuzz int, changelog bool, byAuthor bool, debug bool, baton *Baton) int {
+	// By author, runs are matched on the first author and the
+	// author date, and comments needn't match; squashing joins them.
+	who := "committer"
+	if byAuthor {
+		who = "author"
 	}
-	for it := selection.Iterator(); it.Next(); {
-		event := repo.events[it.Value()]
-		if commit, ok := event.(*Commit); ok {
-			firstline, _ := splitRuneFirst(commit.Comment, '\n')
-			if len(firstline) > 42 {
-				firstline = utf8trunc(firstline, 42)
-			}
-			summary := html.EscapeString(firstline)
-			cid := commit.mark
-			if commit.legacyID != "" {
-				cid = commit.showlegacy() + " &rarr; " + cid
-			}
-			fmt.Fprintf(output, "\t%s [shape=box,width=5,label=<<table cellspacing=\"0\" border=\"0\" cellborder=\"0\"><tr><td><font color=\"blue\">%s</font></td><td>%s</td></tr></table>>];\n",
-				commit.mark[1:], cid, summary)
-			newbranch := true
-			for _, cchild := range commit.children() {
-				if child, ok := cchild.(*Commit); ok && commit.Branch == child.Branch {
-					newbranch = false
-				}
-			}
-			if newbranch {
-				fmt.Fprintf(output, "\t\"%s\" [shape=oval,width=2];\n", commit.Branch)
-				fmt.Fprintf(output, "\t\"%s\" -> \"%s\" [style=dotted];\n", commit.mark[1:], commit.Branch)
-			}
-		}
-		if tag, ok := event.(*Tag); ok {
-			firstLine, _ := splitRuneFirst(tag.Comment, '\n')
-			if len(firstLine) >= graphCaptionLength {
-				firstLine = firstLine[:graphCaptionLength]
-			}
-			summary := html.EscapeString(firstLine)
-			fmt.Fprintf(output, "\t\"%s\" [label=<<table cellspacing=\"0\" border=\"0\" cellborder=\"0\"><tr><td><font color=\"blue\">%s</font></td><td>%s</td></tr></table>>];\n", tag.tagname, tag.tagname, summary)
+	attribution := func(commit *Commit) *Attribution {
+		if byAuthor && len(commit.authors) > 0 {
+			return &commit.authors[0]
 		}
+		return &commit.committer
 	}
-	fmt.Fprint(output, "}\n")
-}
-
-func (repo *Repository) doCoalesce(selection selectionSet, timefuzz int, changelog bool, debug bool, baton *Baton) int {
 	isChangelog := func(commit *Commit) bool {
 		return strings.Contains(commit.Comment, "empty log message") && len(commit.operations()) == 1 && commit.operations()[0].op == opM && strings.HasSuffix(commit.operations()[0].Path, "ChangeLog")
 	}
 	coalesceMatch := func(cthis *Commit, cnext *Commit) bool {
 		croakOnFail := logEnable(logDELETE) || debug
-		if cthis.committer.email != cnext.committer.email {
+		if attribution(cthis).email != attribution(cnext).email {
 			if croakOnFail {
-				croak("committer email mismatch at %s", cnext.idMe())
+				croak("%s email mismatch at %s", who, cnext.idMe())
 			}
 			return false
 		}
-		if cthis.committer.date.delta(cnext.committer.date) >= time.Duration(timefuzz)*time.Second {
+		if attribution(cthis).date.delta(attribution(cnext).date) >= time.Duration(timefuzz)*time.Second {
 			if croakOnFail {
 				croak("time fuzz exceeded at %s", cnext.idMe())
 			}
@@ -9667,7 +11415,7 @@ func (repo *Repository) doCoalesce(selection selectionSet, timefuzz int, changel
 		if changelog && !isChangelog(cthis) && isChangelog(cnext) {
 			return true
 		}
-		if cthis.Comment != cnext.Comment {
+		if !byAuthor && cthis.Comment != cnext.Comment {
 			if croakOnFail {
 				croak("comment mismatch at %s", cnext.idMe())
 			}
@@ -9675,6 +11423,7 @@ func (repo *Repository) doCoalesce(selection selectionSet, timefuzz int, changel
 		}
 		return true
 	}
+	repo.clearColor(colorQSET)
 	eligible := make(map[string][]string)
 	squashes := make([][]string, 0)
 	for it := repo.commitIterator(selection); it.Next(); {
@@ -9709,12 +11458,15 @@ func (repo *Repository) doCoalesce(selection selectionSet, timefuzz int, changel
 	}
 	for _, span := range squashes {
 		// Prevent lossage when last is a ChangeLog commit
-		repo.markToEvent(span[len(span)-1]).(*Commit).Comment = repo.markToEvent(span[0]).(*Commit).Comment
+		if !byAuthor {
+			repo.markToEvent(span[len(span)-1]).(*Commit).Comment = repo.markToEvent(span[0]).(*Commit).Comment
+		}
 		squashable := newSelectionSet()
 		for _, mark := range span[:len(span)-1] {
 			squashable.Add(repo.markToIndex(mark))
 		}
-		repo.squash(squashable, orderedStringSet{}, baton)
+		repo.squash(context.Background(), squashable, orderedStringSet{}, baton)
+		repo.markToEvent(span[len(span)-1]).addColor(colorQSET)
 	}
 	return len(squashes)
 }
@@ -10242,6 +11994,10 @@ func translateIgnoreLine(reLatch *bool, sourcetype *VCS, preferred *VCS, origina
 	// When translating from a system with unanchored matches to one with anchored matches, we need
 	// to prepend an anchor. Also if the target system switches to anchoring behavior on pathnames.
 	if preferred.hasCapability(ignLOOSE) && (!sourcetype.hasCapability(ignLOOSE) || medialSlash.MatchString(text)) {
+		// git anchors with a leading slash; ./ would be taken literally.
+		if preferred.name == "git" {
+			return "/" + strings.TrimPrefix(text, "/"), nil
+		}
 		return "./" + text, nil
 	}
 
@@ -10285,7 +12041,7 @@ func (repo *Repository) translateIgnores(preferred *VCS, defaults, translate, wr
 		if len(blob.opset) == 0 {
 			return false
 		}
-		for fop := range blob.opset {
+		for _, fop := range blob.opset {
 			if fop.isIgnore() == nil {
 				return false
 			}
@@ -10343,7 +12099,7 @@ func (repo *Repository) translateIgnores(preferred *VCS, defaults, translate, wr
 			newop := newFileOp(repo)
 			newop.construct(opM, "100644", ":insert", preferred.ignorename)
 			earliest.appendOperation(newop)
-			repo.renumber(1, nil)
+			repo.renumber(context.Background(), 1, nil)
 			respond(fmt.Sprintf("initial %s created.", preferred.ignorename))
 		}
 	}
@@ -10480,6 +12236,18 @@ func (rl *RepositoryList) repoByName(name string) *Repository {
 }
 
 // Remove a repo by name.
+// replace puts a repository in the place of another in the list.
+func (rl *RepositoryList) replace(old *Repository, repo *Repository) {
+	for i := range rl.repolist {
+		if rl.repolist[i] == old {
+			rl.repolist[i] = repo
+		}
+	}
+	if rl.repo == old {
+		rl.repo = repo
+	}
+}
+
 func (rl *RepositoryList) removeByName(name string) {
 	if rl.repo != nil && rl.repo.name == name {
 		rl.unchoose()
@@ -10676,18 +12444,101 @@ func (rl *RepositoryList) cut(early *Commit, late *Commit) bool {
 	return true
 }
 
-// Unite multiple repos into a union repo.
-func (rl *RepositoryList) unite(factors []*Repository, prune bool) {
+// uniteJoin is where the root of one factor of a unite goes onto a
+// commit of the first factor.  Basis is "tree" when the root's tree is
+// identical to the commit's, "stamp" when the root repeats a commit
+// whose parent it joins, and "date" when the commit is merely the last
+// one made before the root.
+type uniteJoin struct {
+	factor     *Repository
+	root       *Commit
+	parent     *Commit
+	basis      string
+	confidence string
+}
+
+// uniteJoins orders the factors of a unite by their earliest commits
+// and proposes where each factor after the first joins the first.
+// Without infer, every join is by date.
+func uniteJoins(factors []*Repository, infer bool) ([]uniteJoin, error) {
 	for _, x := range factors {
 		if len(x.commits(undefinedSelectionSet)) == 0 {
-			croak(fmt.Sprintf("empty factor %s", x.name))
-			return
+			return nil, fmt.Errorf("empty factor %s", x.name)
 		}
 	}
 	// Forward time order
 	sort.Slice(factors, func(i, j int) bool {
 		return factors[i].earliest().Before(factors[j].earliest())
 	})
+	commits := factors[0].commits(undefinedSelectionSet)
+	trees := make(map[gitHashType][]*Commit)
+	stamps := make(map[string]*Commit)
+	// Manifests can't be computed through a callout
+	treesKnown := true
+	for _, commit := range commits {
+		if _, ok := commit.firstParent().(*Callout); ok {
+			treesKnown = false
+		}
+	}
+	if infer {
+		for _, commit := range commits {
+			if treesKnown {
+				tree := commit.manifest().gitHash()
+				trees[tree] = append(trees[tree], commit)
+			}
+			if _, ok := stamps[commit.actionStamp()]; !ok {
+				stamps[commit.actionStamp()] = commit
+			}
+		}
+	}
+	joins := make([]uniteJoin, 0, len(factors)-1)
+	for _, factor := range factors[1:] {
+		root := factor.earliestCommit()
+		join := uniteJoin{factor: factor, root: root}
+		var candidates []*Commit
+		if infer {
+			candidates = trees[root.manifest().gitHash()]
+		}
+		if len(candidates) > 0 {
+			// The latest identical tree no later than the root,
+			// or failing that the latest of all
+			join.parent = candidates[len(candidates)-1]
+			for _, commit := range candidates {
+				if !commit.when().After(root.when()) {
+					join.parent = commit
+				}
+			}
+			join.basis, join.confidence = "tree", "high"
+		} else if repeated := stamps[root.actionStamp()]; infer && repeated != nil && repeated.hasParents() {
+			if parent, ok := repeated.firstParent().(*Commit); ok {
+				join.parent = parent
+				join.basis, join.confidence = "stamp", "medium"
+			}
+		}
+		if join.parent == nil {
+			// Get last commit from the first repo that is earlier
+			// or the same time as root from the second repo.
+			join.parent = factors[0].earliestCommit()
+			for _, event := range commits {
+				if event.when().After(root.when()) {
+					break
+				}
+				join.parent = event
+			}
+			join.basis, join.confidence = "date", "low"
+		}
+		joins = append(joins, join)
+	}
+	return joins, nil
+}
+
+// Unite multiple repos into a union repo.
+func (rl *RepositoryList) unite(factors []*Repository, prune bool, infer bool) {
+	joins, err := uniteJoins(factors, infer)
+	if err != nil {
+		croak("%v", err)
+		return
+	}
 	uname := ""
 	for _, x := range factors {
 		uname += "+" + x.name
@@ -10701,28 +12552,6 @@ func (rl *RepositoryList) unite(factors []*Repository, prune bool) {
 		persist = factor.uniquify(factor.name, persist)
 	}
 
-	roots := make([]*Commit, 0)
-	for _, x := range factors {
-		roots = append(roots, x.earliestCommit())
-	}
-	// Calculate commits in the first repo that will be
-	// parents for subsequent repos.
-	commits := factors[0].commits(undefinedSelectionSet)
-	parents := []*Commit{}
-	for _, root := range roots[1:] {
-		// Get last commit from the first repo that is earlier
-		// or the same time as root from the second repo.
-		mostRecent := roots[0]
-		for _, event := range commits {
-			if event.when().After(root.when()) {
-				break
-			} else {
-				mostRecent = event
-			}
-		}
-		parents = append(parents, mostRecent)
-	}
-
 	for _, factor := range factors {
 		union.absorb(factor)
 		rl.removeByName(factor.name)
@@ -10743,8 +12572,9 @@ func (rl *RepositoryList) unite(factors []*Repository, prune bool) {
 	//	return out
 	//}
 	// Graft each root to corresponding parent commit.
-	for idx, root := range roots[1:] {
-		root.addParentByMark(parents[idx].mark)
+	for _, join := range joins {
+		root := join.root
+		root.addParentByMark(join.parent.mark)
 		// We may not want files from the
 		// ancestral stock to persist in the
 		// grafted branch unless they have
@@ -10757,7 +12587,7 @@ func (rl *RepositoryList) unite(factors []*Repository, prune bool) {
 		}
 	}
 	// Renumber all events
-	union.renumber(1, nil)
+	union.renumber(context.Background(), 1, nil)
 	// Put the result on the load list
 	rl.repolist = append(rl.repolist, union)
 	rl.choose(union)
@@ -0,0 +1,65 @@
+/*
+ * Interning of fileop path and mode strings
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"sync"
+)
+
+// Every fileop carries its path and mode as strings of its own, cut
+// out of the line it was parsed from or built by whatever made it.  An
+// import of a big Subversion monorepo, where every branch copy expands
+// into a fileop per file, ends up holding the same few hundred
+// thousand paths millions of times over, and the same three or four
+// modes in every modification.  So the strings fileops are made with
+// are interned: each repository keeps one copy of each path and mode,
+// and the fileops share it.  Strings are immutable, so sharing is
+// invisible to everything else.
+//
+// Nothing is ever dropped from the table.  A path that goes out of use
+// costs one string for the life of the repository, which is cheap next
+// to what sharing saves.
+
+// stringInterner keeps one copy of each string it has been given.
+type stringInterner struct {
+	sync.Mutex
+	table map[string]string
+}
+
+func newStringInterner() *stringInterner {
+	return &stringInterner{table: make(map[string]string)}
+}
+
+// intern returns the repository's copy of a string, making one if it
+// hasn't one yet.  The copy is fresh, so a string cut out of a larger
+// one doesn't keep the larger one alive.
+func (repo *Repository) intern(s string) string {
+	if repo == nil || repo._interned == nil || s == "" {
+		return s
+	}
+	interned := repo._interned
+	interned.Lock()
+	defer interned.Unlock()
+	if t, ok := interned.table[s]; ok {
+		return t
+	}
+	s = stringCopy(s)
+	interned.table[s] = s
+	return s
+}
+
+// internPaths makes a fileop's path and mode strings the repository's
+// shared copies.
+func (fileop *FileOp) internPaths() {
+	repo := fileop.repo
+	fileop.Path = repo.intern(fileop.Path)
+	fileop.Source = repo.intern(fileop.Source)
+	fileop.mode = repo.intern(fileop.mode)
+}
+
+// end
@@ -0,0 +1,178 @@
+/*
+ * Rewriting issue-tracker references in comments
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A repository moving to a new forge usually takes its tickets along,
+// and the tickets are usually renumbered on the way, or move from
+// Bugzilla numbers to JIRA keys.  Every "#123" and "bug 456" in the
+// history then points at the wrong ticket.  This pass finds issue
+// references by a pattern, maps the ID in each through a table of old
+// and new IDs, a URL template, or both, and rewrites every comment of
+// the selected commits and tags in one sweep, reporting each change.
+// Each comment is rewritten in a single pass over its references, so a
+// table that maps 1 to 2 and 2 to 3 doesn't chain.
+
+// issuePatterns are the reference styles that can be named instead of
+// written out.
+var issuePatterns = map[string]string{
+	"hash": `(?:^|[^\w&])(?P<ref>#(?P<id>\d+))\b`,
+	"bug":  `(?i)\bbug:?[ \t]*#?(\d+)\b`,
+	"jira": `\b([A-Z][A-Z0-9]+-\d+)\b`,
+}
+
+// issueRewrite describes a rewrite of issue references.  The ID of a
+// reference is the text matched by the group of the pattern named
+// "id", or by its first group, or the whole match if it has no groups.
+// The reference is what the group named "ref" matches, or the whole
+// match, so a pattern can look at the text around a reference.
+type issueRewrite struct {
+	pattern  *regexp.Regexp
+	mapping  map[string]string // old ID to new; nil maps every ID to itself
+	template string            // replaces the whole reference, "" if none
+}
+
+// issueChange records one reference rewritten.
+type issueChange struct {
+	event  Event
+	before string
+	after  string
+}
+
+// readIssueMap reads a table of issue IDs, an old ID and a new one per
+// line, separated by whitespace.  Blank lines and lines beginning with
+// # are ignored.
+func readIssueMap(r io.Reader) (map[string]string, error) {
+	mapping := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	linecount := 0
+	for scanner.Scan() {
+		linecount++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad line syntax in issue map: line %d %q", linecount, line)
+		}
+		mapping[fields[0]] = fields[1]
+	}
+	return mapping, scanner.Err()
+}
+
+// span returns where a group of a match begins and ends.
+func span(m []int, group int) (int, int) {
+	return m[2*group], m[2*group+1]
+}
+
+// rewrite returns a comment with its references rewritten, the changes
+// made, and the IDs found that the table has no entry for.
+func (ir *issueRewrite) rewrite(comment string) (string, [][2]string, []string) {
+	changes := make([][2]string, 0)
+	unmapped := make([]string, 0)
+	var sb strings.Builder
+	last := 0
+	idGroup, refGroup := 0, 0
+	if ir.pattern.NumSubexp() > 0 {
+		idGroup = 1
+	}
+	if i := ir.pattern.SubexpIndex("id"); i > 0 {
+		idGroup = i
+	}
+	if i := ir.pattern.SubexpIndex("ref"); i > 0 {
+		refGroup = i
+	}
+	for _, m := range ir.pattern.FindAllStringSubmatchIndex(comment, -1) {
+		refStart, refEnd := span(m, refGroup)
+		start, end := span(m, idGroup)
+		if start < 0 {
+			continue
+		}
+		ref := comment[refStart:refEnd]
+		id := comment[start:end]
+		if ir.mapping != nil {
+			mapped, ok := ir.mapping[id]
+			if !ok {
+				unmapped = append(unmapped, id)
+				continue
+			}
+			id = mapped
+		}
+		var after string
+		if ir.template != "" {
+			after = strings.NewReplacer("{id}", id, "{ref}", ref).Replace(ir.template)
+		} else {
+			after = comment[refStart:start] + id + comment[end:refEnd]
+		}
+		if after != ref {
+			sb.WriteString(comment[last:refStart])
+			sb.WriteString(after)
+			last = refEnd
+			changes = append(changes, [2]string{ref, after})
+		}
+	}
+	sb.WriteString(comment[last:])
+	text := sb.String()
+	return text, changes, unmapped
+}
+
+// rewriteIssues rewrites the issue references in the comments of the
+// selected commits and tags, unless dryrun is set.  Changed events get
+// Q bits.  Returns the references rewritten, and the IDs with no entry
+// in the table, sorted.
+func (repo *Repository) rewriteIssues(selection selectionSet, ir *issueRewrite, dryrun bool) ([]issueChange, []string) {
+	repo.clearColor(colorQSET)
+	changes := make([]issueChange, 0)
+	missing := newOrderedStringSet()
+	for it := selection.Iterator(); it.Next(); {
+		event := repo.events[it.Value()]
+		var comment *string
+		switch event := event.(type) {
+		case *Commit:
+			comment = &event.Comment
+		case *Tag:
+			comment = &event.Comment
+		default:
+			continue
+		}
+		text, found, unmapped := ir.rewrite(*comment)
+		for _, id := range unmapped {
+			missing.Add(id)
+		}
+		if len(found) == 0 {
+			continue
+		}
+		for _, change := range found {
+			changes = append(changes, issueChange{event, change[0], change[1]})
+		}
+		event.addColor(colorQSET)
+		if dryrun {
+			continue
+		}
+		*comment = text
+		switch event := event.(type) {
+		case *Commit:
+			event.hash.invalidate()
+		case *Tag:
+			event.hash.invalidate()
+		}
+	}
+	sort.Strings(missing)
+	return changes, missing
+}
+
+// end
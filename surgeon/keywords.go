@@ -0,0 +1,219 @@
+/*
+ * Expansion and collapse of RCS/CVS/SVN $-keywords in file content
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// keywordRE matches a $-keyword in either its collapsed ($Id$) or
+// expanded ($Id: foo.c,v 1.2 ... $) form.  $Log$ is deliberately not
+// on the list; its expansion appends history text below the keyword
+// that can't be reliably recognized afterwards.
+var keywordRE = regexp.MustCompile(`\$(Id|Header|Revision|Rev|LastChangedRevision|LastChangedRev|Author|LastChangedBy|Date|LastChangedDate|RCSfile|Source|HeadURL|URL)(?::[^$\n]*)?\$`)
+
+// looksBinary applies git's heuristic: a NUL in the first 8000 bytes
+// means the content is not text and must not be keyword-processed.
+func looksBinary(content []byte) bool {
+	if len(content) > 8000 {
+		content = content[:8000]
+	}
+	return bytes.IndexByte(content, 0) != -1
+}
+
+// collapseKeywords reduces all expanded keywords to their bare form.
+func collapseKeywords(content []byte) []byte {
+	if looksBinary(content) {
+		return content
+	}
+	return keywordRE.ReplaceAll(content, []byte("$$$1$$"))
+}
+
+// expandKeywords fills in keywords as the originating VCS would have
+// when checking out path as of the given commit.  The revision comes
+// from the commit's legacy ID; a dot in it implies CVS/RCS expansion
+// style, otherwise Subversion style is used.  Content is returned
+// unaltered if the commit has no legacy ID.
+func expandKeywords(content []byte, commit *Commit, path string) []byte {
+	if commit.legacyID == "" || looksBinary(content) {
+		return content
+	}
+	rev := commit.legacyID
+	cvsStyle := strings.Contains(rev, ".")
+	var who string
+	if len(commit.authors) > 0 {
+		who = commit.authors[0].email
+	} else {
+		who = commit.committer.email
+	}
+	if i := strings.Index(who, "@"); i != -1 {
+		who = who[:i]
+	}
+	when := commit.date().timestamp.UTC()
+	var date string
+	if cvsStyle {
+		date = when.Format("2006/01/02 15:04:05")
+	} else {
+		date = when.Format("2006-01-02 15:04:05 +0000 (Mon, 02 Jan 2006)")
+	}
+	base := filepath.Base(path)
+	values := map[string]string{
+		"Revision": rev,
+		"Author":   who,
+		"Date":     date,
+		"RCSfile":  base,
+		"Source":   path,
+		"HeadURL":  path,
+	}
+	if cvsStyle {
+		values["RCSfile"] = base + ",v"
+		values["Source"] = path + ",v"
+		values["Id"] = fmt.Sprintf("%s,v %s %s %s Exp", base, rev, date, who)
+		values["Header"] = fmt.Sprintf("%s,v %s %s %s Exp", path, rev, date, who)
+	} else {
+		svnstamp := when.Format("2006-01-02 15:04:05Z")
+		values["Id"] = fmt.Sprintf("%s %s %s %s", base, rev, svnstamp, who)
+		values["Header"] = fmt.Sprintf("%s %s %s %s", path, rev, svnstamp, who)
+	}
+	aliases := map[string]string{
+		"Rev":                 "Revision",
+		"LastChangedRevision": "Revision",
+		"LastChangedRev":      "Revision",
+		"LastChangedBy":       "Author",
+		"LastChangedDate":     "Date",
+		"URL":                 "HeadURL",
+	}
+	return keywordRE.ReplaceAllFunc(content, func(m []byte) []byte {
+		keyword := string(keywordRE.FindSubmatch(m)[1])
+		canonical := keyword
+		if alias, ok := aliases[keyword]; ok {
+			canonical = alias
+		}
+		return []byte(fmt.Sprintf("$%s: %s $", keyword, values[canonical]))
+	})
+}
+
+// keywords collapses or expands $-keywords in the content of files
+// modified by the selected commits whose paths match pathRE.  Collapse
+// operates on the blobs directly where every use of a blob is to be
+// collapsed, since its result is independent of context; a blob also
+// used outside the selection or the pattern is copied first, and the
+// copy collapsed.  Expansion depends on the commit and path, so a blob
+// shared by more than one fileop is split into a fresh blob per
+// expansion.  Returns the count of blobs and inline contents altered.
+func (repo *Repository) keywords(selection selectionSet, pathRE *regexp.Regexp, expand bool, baton *Baton) int {
+	altered := 0
+	colored := make([]Event, 0)
+	blobs := newSelectionSet()
+	inserts := make(map[*Commit][]Event)
+	// Blobs to collapse, in order of first use, with their uses
+	type use struct {
+		commit *Commit
+		fileop *FileOp
+	}
+	collapsing := make([]*Blob, 0)
+	uses := make(map[*Blob][]use)
+	for _, commit := range repo.commits(selection) {
+		for _, fileop := range commit.operations() {
+			if fileop.op != opM || !pathRE.MatchString(fileop.Path) {
+				continue
+			}
+			if fileop.ref == "inline" {
+				var modified []byte
+				if expand {
+					modified = expandKeywords(fileop.inline, commit, fileop.Path)
+				} else {
+					modified = collapseKeywords(fileop.inline)
+				}
+				if !bytes.Equal(modified, fileop.inline) {
+					fileop.inline = modified
+					colored = append(colored, commit)
+					altered++
+				}
+				continue
+			}
+			blob, ok := repo.markToEvent(fileop.ref).(*Blob)
+			if !ok {
+				continue
+			}
+			if !expand {
+				if _, ok := uses[blob]; !ok {
+					collapsing = append(collapsing, blob)
+				}
+				uses[blob] = append(uses[blob], use{commit, fileop})
+				continue
+			}
+			content := blob.getContent()
+			modified := expandKeywords(content, commit, fileop.Path)
+			if bytes.Equal(content, modified) {
+				continue
+			}
+			if len(blob.opset) > 1 {
+				fresh := newBlob(repo)
+				fresh.mark = repo.newmark()
+				blob.removeOperation(fileop)
+				fileop.ref = fresh.mark
+				fresh.appendOperation(fileop)
+				inserts[commit] = append(inserts[commit], fresh)
+				blob = fresh
+			}
+			blob.setContent(modified, noOffset)
+			colored = append(colored, blob, commit)
+			altered++
+		}
+	}
+	for _, blob := range collapsing {
+		if len(uses[blob]) == len(blob.opset) {
+			blobs.Add(repo.eventToIndex(blob))
+			continue
+		}
+		content := blob.getContent()
+		modified := collapseKeywords(content)
+		if bytes.Equal(content, modified) {
+			continue
+		}
+		fresh := newBlob(repo)
+		fresh.mark = repo.newmark()
+		fresh.setContent(modified, noOffset)
+		for _, u := range uses[blob] {
+			blob.removeOperation(u.fileop)
+			u.fileop.ref = fresh.mark
+			fresh.appendOperation(u.fileop)
+			colored = append(colored, u.commit)
+		}
+		first := uses[blob][0].commit
+		inserts[first] = append(inserts[first], fresh)
+		colored = append(colored, fresh)
+		altered++
+	}
+	// transformBlobs clears Q bits, so it has to run before we set any
+	if blobs.Size() > 0 {
+		altered += repo.transformBlobs(blobs, collapseKeywords, baton)
+	} else {
+		repo.clearColor(colorQSET)
+	}
+	for _, event := range colored {
+		event.addColor(colorQSET)
+	}
+	if len(inserts) > 0 {
+		events := make([]Event, 0, len(repo.events)+len(inserts))
+		for _, event := range repo.events {
+			if commit, ok := event.(*Commit); ok {
+				events = append(events, inserts[commit]...)
+			}
+			events = append(events, event)
+		}
+		repo.events = events
+		repo.declareSequenceMutation("keyword expansion")
+	}
+	return altered
+}
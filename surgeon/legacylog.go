@@ -0,0 +1,227 @@
+/*
+ * Append-only journal of legacy-map changes
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// legacyJournal is an append-only log of changes to a repository's
+// legacy map.  The flat legacy-map file has to be rewritten whole;
+// journal entries are appended as legacy IDs are assigned, so a long
+// conversion that dies part way through leaves behind a record of the
+// references resolved so far, and a later session can pick them up by
+// replaying the log instead of re-scanning.
+//
+// Each line has the legacy-map format, a legacy cookie and an action
+// stamp separated by a tab.  A stamp of "-" records a deletion. Later
+// lines override earlier ones.  Stamps are those current when the
+// entry was made.
+type legacyJournal struct {
+	path    string
+	fp      *os.File
+	w       *bufio.Writer
+	logged  map[string]string // cookie to stamp as of the last entry
+	serials map[*Commit]string
+	seen    map[string]int
+}
+
+const legacyJournalHeader = "# reposurgeon legacy journal\n"
+
+// stamp returns the action stamp used to identify a commit in the
+// journal, with a serial suffix to disambiguate commits sharing one.
+// Serials are assigned in the order commits are first journaled, which
+// is event order when entries are made as a stream is read.
+func (lj *legacyJournal) stamp(commit *Commit) string {
+	if s, ok := lj.serials[commit]; ok {
+		return s
+	}
+	id := fmt.Sprintf("%s!%s", commit.committer.date.rfc3339(), commit.committer.email)
+	s := id
+	if lj.seen[id] > 0 {
+		s += fmt.Sprintf(":%d", lj.seen[id]+1)
+	}
+	lj.seen[id]++
+	lj.serials[commit] = s
+	return s
+}
+
+func (lj *legacyJournal) append(cookie string, stamp string) {
+	if lj.logged[cookie] == stamp {
+		return
+	}
+	fmt.Fprintf(lj.w, "%s\t%s\n", cookie, stamp)
+	if stamp == "-" {
+		delete(lj.logged, cookie)
+	} else {
+		lj.logged[cookie] = stamp
+	}
+}
+
+func (lj *legacyJournal) record(cookie string, commit *Commit) {
+	lj.append(cookie, lj.stamp(commit))
+}
+
+func (lj *legacyJournal) forget(cookie string) {
+	if _, ok := lj.logged[cookie]; ok {
+		lj.append(cookie, "-")
+	}
+}
+
+// load reads existing journal entries.  A truncated last line, as left
+// by a crash in mid-write, is ignored.
+func (lj *legacyJournal) load(r io.Reader) error {
+	br := bufio.NewReader(r)
+	linecount := 0
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		linecount++
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+		if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+			return fmt.Errorf("bad line syntax in legacy journal: line %d %q", linecount, line)
+		}
+		if fields[1] == "-" {
+			delete(lj.logged, fields[0])
+		} else {
+			lj.logged[fields[0]] = fields[1]
+		}
+	}
+}
+
+func (lj *legacyJournal) flush() error {
+	return lj.w.Flush()
+}
+
+func (lj *legacyJournal) close() error {
+	if err := lj.flush(); err != nil {
+		return err
+	}
+	return lj.fp.Close()
+}
+
+// openLegacyJournal attaches a journal at path to the repository,
+// creating it if need be.  Existing entries are loaded but not yet
+// applied; that's done by syncLegacyJournal, which can only resolve
+// entries for commits already read.
+func (repo *Repository) openLegacyJournal(path string) error {
+	if repo.legacyLog != nil {
+		if err := repo.closeLegacyJournal(); err != nil {
+			return err
+		}
+	}
+	fp, err := os.OpenFile(filepath.Clean(path), os.O_RDWR|os.O_CREATE|os.O_APPEND, userReadWriteMode)
+	if err != nil {
+		return fmt.Errorf("legacy journal %s could not be opened: %v", path, err)
+	}
+	lj := &legacyJournal{
+		path:    path,
+		fp:      fp,
+		w:       bufio.NewWriter(fp),
+		logged:  make(map[string]string),
+		serials: make(map[*Commit]string),
+		seen:    make(map[string]int),
+	}
+	if err = lj.load(fp); err != nil {
+		fp.Close()
+		return err
+	}
+	if info, err := fp.Stat(); err == nil && info.Size() == 0 {
+		lj.w.WriteString(legacyJournalHeader)
+	}
+	repo.legacyLog = lj
+	return nil
+}
+
+// syncLegacyJournal brings the legacy map and its journal into
+// agreement.  Journaled references that aren't in the map are resolved
+// against the commits in the repository; entries already in the map
+// take precedence.  Then any map entries the journal lacks are
+// appended, checkpointing the current state.  Returns the number of
+// references recovered from the journal.
+func (repo *Repository) syncLegacyJournal(baton *Baton) (int, error) {
+	lj := repo.legacyLog
+	if lj == nil {
+		return 0, nil
+	}
+	pending := make([]string, 0)
+	for cookie := range lj.logged {
+		if _, ok := repo.legacyMap[cookie]; !ok {
+			pending = append(pending, cookie)
+		}
+	}
+	sort.Strings(pending)
+	var replay strings.Builder
+	for _, cookie := range pending {
+		fmt.Fprintf(&replay, "%s\t%s\n", cookie, lj.logged[cookie])
+	}
+	// Detach while replaying so the entries aren't journaled twice
+	repo.legacyLog = nil
+	matched, _, err := repo.readLegacyMap(strings.NewReader(replay.String()), baton)
+	repo.legacyLog = lj
+	if err != nil {
+		return matched, err
+	}
+	keys := make([]string, 0, len(repo.legacyMap))
+	for cookie := range repo.legacyMap {
+		keys = append(keys, cookie)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ci := repo.eventToIndex(repo.legacyMap[keys[i]])
+		cj := repo.eventToIndex(repo.legacyMap[keys[j]])
+		return ci < cj || (ci == cj && keys[i] < keys[j])
+	})
+	for _, cookie := range keys {
+		if _, ok := lj.logged[cookie]; !ok {
+			lj.record(cookie, repo.legacyMap[cookie])
+		}
+	}
+	return matched, lj.flush()
+}
+
+// closeLegacyJournal flushes and detaches the repository's journal.
+func (repo *Repository) closeLegacyJournal() error {
+	if repo.legacyLog == nil {
+		return nil
+	}
+	err := repo.legacyLog.close()
+	repo.legacyLog = nil
+	return err
+}
+
+// setLegacy adds a reference to the legacy map, journaling it if there
+// is a journal.
+func (repo *Repository) setLegacy(cookie string, commit *Commit) {
+	repo.legacyMap[cookie] = commit
+	if repo.legacyLog != nil {
+		repo.legacyLog.record(cookie, commit)
+	}
+}
+
+// dropLegacy removes a reference from the legacy map.
+func (repo *Repository) dropLegacy(cookie string) {
+	delete(repo.legacyMap, cookie)
+	if repo.legacyLog != nil {
+		repo.legacyLog.forget(cookie)
+	}
+}
+
+// end
@@ -0,0 +1,171 @@
+/*
+ * Normalizing legacy references in comments to Legacy-ID trailers
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Histories that have been through other converters before reaching
+// reposurgeon often record where each commit came from in its comment,
+// each converter in its own way: git-svn appends a git-svn-id line,
+// svn2git scripts an "svn path=...; revision=N" line, some people a
+// hand-written "SVN revision: N", and commits imported from CVS may
+// carry an expanded $Id$ keyword.  None of these reach the legacy map,
+// so references to the old revisions can't be lifted.  This pass
+// finds such lines, replaces them with the canonical Legacy-ID trailer
+// that write --legacy produces, sets the commit's legacy ID, and
+// enters the reference in the legacy map, all in one sweep.  Lines
+// are only recognized when they consist of nothing but the reference,
+// so a revision mentioned in passing in the text is left alone.
+
+// legacyReference is a reference recognized in a comment: the legacy
+// ID of the commit and the key it goes into the legacy map under.
+type legacyReference struct {
+	legacyID string
+	cookie   string
+}
+
+// A legacyTrailerPattern recognizes one way of recording a legacy
+// reference on a line of its own.
+type legacyTrailerPattern struct {
+	re    *regexp.Regexp
+	parse func(repo *Repository, m []string) *legacyReference
+}
+
+func svnReference(m []string) *legacyReference {
+	return &legacyReference{m[1], "SVN:" + m[1]}
+}
+
+// keywordReference reads the payload of an expanded $Id$ keyword.
+// Subversion revisions are told from CVS ones by the absence of a dot.
+func keywordReference(repo *Repository, m []string) *legacyReference {
+	fields := strings.Fields(m[1])
+	if len(fields) < 2 {
+		return nil
+	}
+	path, rev := strings.TrimSuffix(fields[0], ",v"), fields[1]
+	if !strings.Contains(rev, ".") {
+		return &legacyReference{rev, "SVN:" + rev}
+	}
+	key := "CVS:" + path + ":" + rev
+	return &legacyReference{key, key}
+}
+
+var legacyTrailerPatterns = []legacyTrailerPattern{
+	// Already a trailer, though perhaps not spelled canonically
+	{regexp.MustCompile(`(?i)^legacy-id:\s*(\S+)$`),
+		func(repo *Repository, m []string) *legacyReference {
+			if strings.Contains(m[1], ":") || repo.vcs == nil {
+				return &legacyReference{m[1], m[1]}
+			}
+			return &legacyReference{m[1], strings.ToUpper(repo.vcs.name) + ":" + m[1]}
+		}},
+	{regexp.MustCompile(`^git-svn-id:\s*\S+@(\d+)(?:\s+[0-9a-fA-F-]+)?$`),
+		func(repo *Repository, m []string) *legacyReference { return svnReference(m) }},
+	{regexp.MustCompile(`^svn path=\S*; revision=(\d+)$`),
+		func(repo *Repository, m []string) *legacyReference { return svnReference(m) }},
+	{regexp.MustCompile(`(?i)^(?:svn|subversion)(?:\s+rev(?:ision)?)?\s*[:=]?\s*r?(\d+)$`),
+		func(repo *Repository, m []string) *legacyReference { return svnReference(m) }},
+	{regexp.MustCompile(`^` + dollarID.String() + `$`), keywordReference},
+	{regexp.MustCompile(`^` + dollarRevision.String() + `$`),
+		func(repo *Repository, m []string) *legacyReference {
+			if rev := strings.TrimSpace(m[1]); rev != "" && !strings.Contains(rev, ".") {
+				return &legacyReference{rev, "SVN:" + rev}
+			}
+			return nil
+		}},
+}
+
+// findLegacyReferences removes the lines of a comment that are legacy
+// references, returning the rest of it and the references in order.
+func (repo *Repository) findLegacyReferences(comment string) (string, []legacyReference) {
+	found := make([]legacyReference, 0)
+	kept := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimRight(comment, "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		var ref *legacyReference
+		for _, pattern := range legacyTrailerPatterns {
+			if m := pattern.re.FindStringSubmatch(trimmed); m != nil {
+				if ref = pattern.parse(repo, m); ref != nil {
+					break
+				}
+			}
+		}
+		if ref != nil {
+			found = append(found, *ref)
+		} else {
+			kept = append(kept, line)
+		}
+	}
+	if len(found) == 0 {
+		return comment, found
+	}
+	for len(kept) > 0 && strings.TrimSpace(kept[len(kept)-1]) == "" {
+		kept = kept[:len(kept)-1]
+	}
+	if len(kept) == 0 {
+		return "", found
+	}
+	return strings.Join(kept, "\n") + "\n", found
+}
+
+// normalizeLegacyTrailers turns the legacy references in the comments
+// of the selected commits into Legacy-ID trailers, setting legacy IDs
+// and filling the legacy map.  A commit whose comment disagrees with
+// the legacy ID it already has is left alone, as is a reference
+// already mapped to another commit; both are warned about.  Changed
+// commits get Q bits.  Returns the number of commits changed.
+func (repo *Repository) normalizeLegacyTrailers(selection selectionSet) int {
+	repo.clearColor(colorQSET)
+	changed := 0
+	for _, commit := range repo.commits(selection) {
+		body, refs := repo.findLegacyReferences(commit.Comment)
+		if len(refs) == 0 {
+			continue
+		}
+		legacyID := commit.legacyID
+		if legacyID == "" {
+			legacyID = refs[0].legacyID
+		}
+		consistent := true
+		for _, ref := range refs {
+			if other, ok := repo.legacyMap[ref.cookie]; ok && other != commit {
+				if logEnable(logWARN) {
+					logit("%s in %s is already the legacy ID of %s", ref.cookie, commit.idMe(), other.idMe())
+				}
+				consistent = false
+			}
+		}
+		if refs[0].legacyID != legacyID {
+			if logEnable(logWARN) {
+				logit("%s has legacy ID %s but its comment says %s", commit.idMe(), legacyID, refs[0].legacyID)
+			}
+			consistent = false
+		}
+		if !consistent {
+			continue
+		}
+		commit.legacyID = legacyID
+		for _, ref := range refs {
+			repo.setLegacy(ref.cookie, commit)
+		}
+		comment := joinTrailers(body, "Legacy-ID", []string{legacyID})
+		if comment != commit.Comment {
+			commit.Comment = comment
+			commit.hash.invalidate()
+			commit.addColor(colorQSET)
+			changed++
+		}
+	}
+	repo.invalidateNamecache()
+	return changed
+}
+
+// end
@@ -0,0 +1,198 @@
+/*
+ * Conversion between git mailmaps and author maps
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Many git projects keep a .mailmap file saying which names and
+// addresses in their history belong to whom.  Each line gives the
+// proper identity and then the one found in commits, either of which
+// may leave out the name or the address:
+//
+//	Proper Name <commit@email>
+//	<proper@email> <commit@email>
+//	Proper Name <proper@email> <commit@email>
+//	Proper Name <proper@email> Commit Name <commit@email>
+//
+// The first three match on the commit address alone and go into the
+// author map under it; the last matches only that name with that
+// address, as an alias does.  Going the other way, author-map entries
+// and aliases are written as lines of the third and fourth forms.
+// Names and addresses are compared without regard to case, as git
+// does.
+
+// A mailmapEntry is one line of a mailmap.  Empty fields were left out.
+type mailmapEntry struct {
+	properName  string
+	properEmail string
+	commitName  string
+	commitEmail string
+}
+
+// Each element of a mailmap line is a name, possibly empty, followed by
+// an address in angle brackets.
+var mailmapElementRE = regexp.MustCompile(`\s*([^<#]*?)\s*<([^>]*)>`)
+
+// parseMailmap reads the entries of a mailmap.  Ill-formed lines are
+// skipped with a warning.
+func parseMailmap(r io.Reader) []mailmapEntry {
+	entries := make([]mailmapEntry, 0)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		elements := mailmapElementRE.FindAllStringSubmatch(line, -1)
+		var entry mailmapEntry
+		switch len(elements) {
+		case 1:
+			entry = mailmapEntry{properName: elements[0][1], commitEmail: elements[0][2]}
+		case 2:
+			entry = mailmapEntry{properName: elements[0][1], properEmail: elements[0][2],
+				commitName: elements[1][1], commitEmail: elements[1][2]}
+		}
+		if entry.commitEmail == "" || (entry.properName == "" && entry.properEmail == "") {
+			if logEnable(logWARN) {
+				logit("mailmap line %d is ill-formed", lineno)
+			}
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// readMailmap applies a mailmap to the selected events, recording its
+// entries in the author map and aliases.  A name or address an entry
+// leaves out is kept from the attribution it applies to.  Q bits are
+// set on commits whose attributions change.  Returns the number of
+// entries read.
+func (repo *Repository) readMailmap(selection selectionSet, r io.Reader) int {
+	entries := parseMailmap(r)
+	byEmail := make(map[string]mailmapEntry)
+	byIdentity := make(map[ContributorID]mailmapEntry)
+	for _, entry := range entries {
+		email := strings.ToLower(entry.commitEmail)
+		if entry.commitName != "" {
+			byIdentity[ContributorID{strings.ToLower(entry.commitName), email}] = entry
+			if entry.properName != "" && entry.properEmail != "" {
+				repo.aliases[ContributorID{entry.commitName, entry.commitEmail}] = ContributorID{entry.properName, entry.properEmail}
+			}
+			continue
+		}
+		byEmail[email] = entry
+		if entry.properName != "" {
+			properEmail := entry.properEmail
+			if properEmail == "" {
+				properEmail = entry.commitEmail
+			}
+			repo.authormap[email] = Contributor{local: entry.commitEmail, fullname: entry.properName, email: properEmail}
+		}
+	}
+	remap := func(attr *Attribution) bool {
+		email := strings.ToLower(attr.email)
+		entry, ok := byIdentity[ContributorID{strings.ToLower(attr.fullname), email}]
+		if !ok {
+			if entry, ok = byEmail[email]; !ok {
+				return false
+			}
+		}
+		original := attr.who()
+		if entry.properName != "" {
+			attr.fullname = entry.properName
+		}
+		if entry.properEmail != "" {
+			attr.email = entry.properEmail
+		}
+		return attr.who() != original
+	}
+	repo.clearColor(colorQSET)
+	repo.walkEvents(selection, func(idx int, event Event) bool {
+		switch e := event.(type) {
+		case *Commit:
+			changed := remap(&e.committer)
+			for ai := range e.authors {
+				changed = remap(&e.authors[ai]) || changed
+			}
+			if changed {
+				e.addColor(colorQSET)
+			}
+		case *Tag:
+			remap(&e.tagger)
+		}
+		return true
+	})
+	// Email addresses have changed.
+	repo.invalidateNamecache()
+	return len(entries)
+}
+
+// tipMailmap returns the .mailmap in the tip of master, or of the last
+// commit if there is no master.
+func (repo *Repository) tipMailmap() ([]byte, error) {
+	tip := repo.branchtipmap()["refs/heads/master"]
+	if tip == nil {
+		commits := repo.commits(undefinedSelectionSet)
+		if len(commits) == 0 {
+			return nil, fmt.Errorf("repository has no commits")
+		}
+		tip = commits[len(commits)-1]
+	}
+	content, ok := tip.blobByName(".mailmap")
+	if !ok {
+		return nil, fmt.Errorf("there is no .mailmap in %s", tip.idMe())
+	}
+	return content, nil
+}
+
+// readTipMailmap applies the .mailmap found in the repository itself.
+func (repo *Repository) readTipMailmap(selection selectionSet) (int, error) {
+	content, err := repo.tipMailmap()
+	if err != nil {
+		return 0, err
+	}
+	return repo.readMailmap(selection, bytes.NewReader(content)), nil
+}
+
+// writeMailmap writes the author map and aliases as a mailmap, sorted
+// by the address matched.
+func (repo *Repository) writeMailmap(w io.Writer) error {
+	type keyedLine struct {
+		key  string
+		line string
+	}
+	lines := make([]keyedLine, 0, len(repo.authormap)+len(repo.aliases))
+	for key, c := range repo.authormap {
+		lines = append(lines, keyedLine{key, fmt.Sprintf("%s <%s> <%s>", c.fullname, c.email, key)})
+	}
+	for alias, principal := range repo.aliases {
+		lines = append(lines, keyedLine{strings.ToLower(alias.email) + " " + alias.fullname,
+			fmt.Sprintf("%s <%s> %s <%s>", principal.fullname, principal.email, alias.fullname, alias.email)})
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].key < lines[j].key })
+	for _, kl := range lines {
+		if _, err := fmt.Fprintln(w, kl.line); err != nil {
+			return fmt.Errorf("in writeMailmap: %v", err)
+		}
+	}
+	return nil
+}
+
+// end
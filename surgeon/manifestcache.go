@@ -0,0 +1,125 @@
+/*
+ * Bounded memoization of commit manifests
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A manifest, once computed, is kept with its commit so the next
+// request for it, or for a child's, is cheap.  Manifests share
+// structure with their first parents', but on a repository with
+// hundreds of thousands of commits the ones an interactive session
+// accumulates by looking at trees all over the DAG can still run to
+// gigabytes.  walkManifests forgets as it goes, but only within its
+// own traversal.  So the number of manifests kept memoized can be
+// bounded; past the bound the least recently used is forgotten, to be
+// recomputed from its nearest memoized ancestor if it is wanted again.
+//
+// Forgetting a manifest whose descendants' are still memoized breaks
+// the rule invalidateManifests relies on to stop early, that a commit
+// without a memoized manifest has no descendant with one.  Once that
+// has happened invalidation visits every descendant, until the cache
+// has been emptied and the rule holds again.
+
+// manifestCache keeps the memoized manifests in order of use, most
+// recent first, when their number is bounded.
+type manifestCache struct {
+	sync.Mutex
+	order   *list.List
+	entries map[*Commit]*list.Element
+	evicted bool // Some manifest was forgotten to make room
+}
+
+var manifests = manifestCache{
+	order:   list.New(),
+	entries: make(map[*Commit]*list.Element),
+}
+
+// evictOldest forgets the least recently used manifest.  The caller
+// holds the lock.
+func (cache *manifestCache) evictOldest() {
+	oldest := cache.order.Remove(cache.order.Back()).(*Commit)
+	delete(cache.entries, oldest)
+	oldest._manifest = nil
+	cache.evicted = true
+}
+
+// setManifest memoizes a manifest for a commit, forgetting the least
+// recently used ones if that puts the cache over its bound.
+func (commit *Commit) setManifest(manifest *Manifest) {
+	commit._manifest = manifest
+	limit := control.manifestLimit
+	if limit <= 0 && manifests.order.Len() == 0 {
+		return
+	}
+	manifests.Lock()
+	defer manifests.Unlock()
+	if elt, ok := manifests.entries[commit]; ok {
+		manifests.order.MoveToFront(elt)
+	} else {
+		manifests.entries[commit] = manifests.order.PushFront(commit)
+	}
+	for limit > 0 && manifests.order.Len() > limit {
+		manifests.evictOldest()
+	}
+}
+
+// touchManifest notes a use of a commit's memoized manifest.
+func (commit *Commit) touchManifest() {
+	if manifests.order.Len() == 0 {
+		return
+	}
+	manifests.Lock()
+	defer manifests.Unlock()
+	if elt, ok := manifests.entries[commit]; ok {
+		manifests.order.MoveToFront(elt)
+	}
+}
+
+// forgetManifest drops a commit's memoized manifest.
+func (commit *Commit) forgetManifest() {
+	commit._manifest = nil
+	if manifests.order.Len() == 0 {
+		return
+	}
+	manifests.Lock()
+	defer manifests.Unlock()
+	if elt, ok := manifests.entries[commit]; ok {
+		manifests.order.Remove(elt)
+		delete(manifests.entries, commit)
+	}
+	if manifests.order.Len() == 0 {
+		manifests.evicted = false
+	}
+}
+
+// trimManifests forgets the least recently used manifests until no
+// more than limit are memoized; with a limit of zero, forgets all the
+// cache knows of.
+func trimManifests(limit int) {
+	manifests.Lock()
+	defer manifests.Unlock()
+	for manifests.order.Len() > limit {
+		manifests.evictOldest()
+	}
+	if manifests.order.Len() == 0 {
+		manifests.evicted = false
+	}
+}
+
+// manifestsEvicted tells whether invalidation can't stop at commits
+// without a memoized manifest.
+func manifestsEvicted() bool {
+	manifests.Lock()
+	defer manifests.Unlock()
+	return manifests.evicted
+}
+
+// end
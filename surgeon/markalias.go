@@ -0,0 +1,82 @@
+/*
+ * Mark aliases kept across renumbering
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// When marks are renumbered, anything that recorded the old ones - a
+// script that saved a mark from one command to use in a later one, a
+// note in a lift log - stops meaning what it did, or worse, quietly
+// means another event.  So renumbering keeps an alias table from each
+// mark as it was before the first renumbering to the mark its event
+// has now.  In a selection, <:1234> looks the mark up in that table,
+// while a bare :1234 is always the current mark.  Marks of events that
+// have since been deleted stay in the table, pointing nowhere, so they
+// can't come to mean an event that later took their number.  Until
+// the repository is first renumbered the table is empty and old marks
+// are current ones.
+
+// noteMarkAliases updates the alias table for a renumbering, given as
+// a map from every mark in use to its new mark.
+func (repo *Repository) noteMarkAliases(markmap map[string]string) {
+	aliases := make(map[string]string, len(repo.markAliases)+len(markmap))
+	current := make(map[string]bool, len(repo.markAliases))
+	for old, mark := range repo.markAliases {
+		aliases[old] = markmap[mark] // Empty if the event is gone
+		current[mark] = true
+	}
+	// Events made since the last renumbering have no older mark
+	for mark, renumbered := range markmap {
+		if _, ok := aliases[mark]; !ok && !current[mark] {
+			aliases[mark] = renumbered
+		}
+	}
+	repo.markAliases = aliases
+}
+
+// aliasedMark returns the index of the event a mark meant before
+// renumbering, or -1 if there is no such event.
+func (repo *Repository) aliasedMark(mark string) int {
+	if repo.markAliases == nil {
+		return repo.markToIndex(mark)
+	}
+	if current := repo.markAliases[mark]; current != "" {
+		return repo.markToIndex(current)
+	}
+	return -1
+}
+
+// writeMarkAliases writes the alias table as lines of an old mark and
+// the current one, in order of old mark.  Marks of deleted events are
+// left out.
+func (repo *Repository) writeMarkAliases(w io.Writer) error {
+	old := make([]string, 0, len(repo.markAliases))
+	for mark, current := range repo.markAliases {
+		if current != "" && repo.markToIndex(current) >= 0 {
+			old = append(old, mark)
+		}
+	}
+	sort.Slice(old, func(i, j int) bool {
+		if ni, nj := markNumber(old[i]), markNumber(old[j]); ni != nj {
+			return ni < nj
+		}
+		return old[i] < old[j]
+	})
+	for _, mark := range old {
+		if _, err := fmt.Fprintf(w, "%s %s\n", mark, repo.markAliases[mark]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// end
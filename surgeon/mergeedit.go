@@ -0,0 +1,231 @@
+/*
+ * Flattening and recreating merges
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// A merge can be taken apart in two ways.  Dropping all parents but
+// the first keeps the merge commit's tree but loses the history of
+// the side branch.  Flattening keeps that history: the side branch's
+// commits are replayed, in order, on top of the first parent, and the
+// merge commit becomes their linear successor, with its fileops
+// recomputed so its tree is what it was.  Only the intermediate trees
+// of the replayed commits change, and only at paths both lines of
+// development touched; those are reported as conflicts.
+//
+// Going the other way, a merge link added between two commits leaves
+// the child's tree alone, so whatever the second parent's side changed
+// at a path the first parent's side also changed is silently dropped
+// unless the child's own fileops deal with it.  Those paths are
+// reported too.
+
+// ancestry returns a commit and all its commit ancestors.
+func (commit *Commit) ancestry() map[*Commit]bool {
+	seen := map[*Commit]bool{commit: true}
+	stack := []*Commit{commit}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, parent := range current.parents() {
+			if p, ok := parent.(*Commit); ok && !seen[p] {
+				seen[p] = true
+				stack = append(stack, p)
+			}
+		}
+	}
+	return seen
+}
+
+// mergeBase returns the nearest common ancestor of two commits, or nil
+// if they have none.
+func mergeBase(a, b *Commit) *Commit {
+	inA := a.ancestry()
+	seen := map[*Commit]bool{b: true}
+	queue := []*Commit{b}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if inA[current] {
+			return current
+		}
+		for _, parent := range current.parents() {
+			if p, ok := parent.(*Commit); ok && !seen[p] {
+				seen[p] = true
+				queue = append(queue, p)
+			}
+		}
+	}
+	return nil
+}
+
+// sameEntry tells whether two manifest entries have the same content.
+func sameEntry(x, y *FileOp) bool {
+	return x.mode == y.mode && x.ref == y.ref && (x.ref != "inline" || bytes.Equal(x.inline, y.inline))
+}
+
+// manifestMap returns a manifest as a map.
+func manifestMap(manifest *Manifest) map[string]*FileOp {
+	entries := make(map[string]*FileOp)
+	manifest.iter(func(path string, pentry interface{}) {
+		entries[path] = pentry.(*FileOp)
+	})
+	return entries
+}
+
+// manifestEntries returns the manifest of a commit as a map, empty for
+// a nil commit.
+func manifestEntries(commit *Commit) map[string]*FileOp {
+	if commit == nil {
+		return make(map[string]*FileOp)
+	}
+	return manifestMap(commit.manifest())
+}
+
+// manifestChanges returns the paths whose content differs between two
+// manifests, mapped to their entries in the second (nil if deleted).
+func manifestChanges(from, to map[string]*FileOp) map[string]*FileOp {
+	changes := make(map[string]*FileOp)
+	for path, entry := range to {
+		if old, ok := from[path]; !ok || !sameEntry(old, entry) {
+			changes[path] = entry
+		}
+	}
+	for path := range from {
+		if _, ok := to[path]; !ok {
+			changes[path] = nil
+		}
+	}
+	return changes
+}
+
+// mergeConflicts returns the sorted paths that the lines of
+// development leading to two commits both changed, with different
+// results, since their merge base.
+func mergeConflicts(first, second *Commit) []string {
+	base := manifestEntries(mergeBase(first, second))
+	ours := manifestChanges(base, manifestEntries(first))
+	theirs := manifestChanges(base, manifestEntries(second))
+	conflicts := make([]string, 0)
+	for path, mine := range ours {
+		other, ok := theirs[path]
+		if !ok {
+			continue
+		}
+		if (mine == nil) != (other == nil) || (mine != nil && !sameEntry(mine, other)) {
+			conflicts = append(conflicts, path)
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// unresolvedConflicts returns the conflicts between the first parent
+// of a merge and another parent that the merge's fileops don't touch.
+func (commit *Commit) unresolvedConflicts(other *Commit) []string {
+	first, ok := commit.firstParent().(*Commit)
+	if !ok {
+		return nil
+	}
+	touched := make(map[string]bool)
+	for _, op := range commit.operations() {
+		if op.op == deleteall {
+			return nil
+		}
+		touched[op.Path] = true
+		touched[op.Source] = true
+	}
+	unresolved := make([]string, 0)
+	for _, path := range mergeConflicts(first, other) {
+		if !touched[path] {
+			unresolved = append(unresolved, path)
+		}
+	}
+	return unresolved
+}
+
+// flattenMerge replays the side branch of a two-parent merge on top of
+// its first parent and makes the merge its linear successor.  Returns
+// the replayed commits and the paths both lines of development
+// changed.
+func (repo *Repository) flattenMerge(merge *Commit) ([]*Commit, []string, error) {
+	if len(merge.parents()) != 2 {
+		return nil, nil, fmt.Errorf("%s is not a two-parent merge", merge.idMe())
+	}
+	first, ok1 := merge.parents()[0].(*Commit)
+	second, ok2 := merge.parents()[1].(*Commit)
+	if !ok1 || !ok2 {
+		return nil, nil, fmt.Errorf("%s has a callout parent", merge.idMe())
+	}
+	mainline := first.ancestry()
+	// Walk the side branch back to where it forked
+	side := make([]*Commit, 0)
+	for c := second; !mainline[c]; {
+		for _, op := range c.operations() {
+			if op.op == deleteall {
+				return nil, nil, fmt.Errorf("can't replay the deleteall in %s", c.idMe())
+			}
+		}
+		side = append([]*Commit{c}, side...)
+		if len(c.parents()) != 1 {
+			return nil, nil, fmt.Errorf("side branch commit %s is not linear", c.idMe())
+		}
+		parent, ok := c.parents()[0].(*Commit)
+		if !ok {
+			return nil, nil, fmt.Errorf("side branch commit %s has a callout parent", c.idMe())
+		}
+		c = parent
+	}
+	for i, c := range side {
+		var next CommitLike = merge
+		if i < len(side)-1 {
+			next = side[i+1]
+		}
+		for _, child := range c.children() {
+			if child != next {
+				return nil, nil, fmt.Errorf("side branch commit %s has other descendants", c.idMe())
+			}
+		}
+	}
+	conflicts := mergeConflicts(first, second)
+	target := manifestEntries(merge)
+	if len(side) == 0 {
+		merge.setParents([]CommitLike{first})
+		return side, conflicts, nil
+	}
+	side[0].setParents([]CommitLike{first})
+	merge.setParents([]CommitLike{side[len(side)-1]})
+	side[0].invalidateManifests()
+	// Recompute the merge's fileops so its tree is unchanged
+	changes := manifestChanges(manifestEntries(side[len(side)-1]), target)
+	paths := make([]string, 0, len(changes))
+	for path := range changes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	ops := make([]*FileOp, 0, len(paths))
+	for _, path := range paths {
+		if entry := changes[path]; entry == nil {
+			ops = append(ops, newFileOp(repo).construct(opD, path))
+		} else {
+			op := newFileOp(repo).construct(opM, entry.mode, entry.ref, path)
+			if entry.ref == "inline" {
+				op.inline = entry.inline
+			}
+			ops = append(ops, op)
+		}
+	}
+	merge.setOperations(ops)
+	repo.resort()
+	return side, conflicts, nil
+}
+
+// end
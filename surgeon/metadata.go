@@ -0,0 +1,402 @@
+/*
+ * JSON representation of repository metadata
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// These types define the JSON shape of the events.  Field names are
+// chosen to be stable for external tools; don't rename them casually.
+
+type jsonAttribution struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Date  string `json:"date"`
+}
+
+type jsonFileOp struct {
+	Op     string `json:"op"`
+	Mode   string `json:"mode,omitempty"`
+	Ref    string `json:"ref,omitempty"`
+	Source string `json:"source,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+type jsonEvent struct {
+	Type       string            `json:"type"`
+	Index      int               `json:"index"`
+	UUID       string            `json:"uuid,omitempty"`
+	Mark       string            `json:"mark,omitempty"`
+	Branch     string            `json:"branch,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	Target     string            `json:"target,omitempty"`
+	LegacyID   string            `json:"legacy_id,omitempty"`
+	Stamp      string            `json:"stamp,omitempty"`
+	Committer  *jsonAttribution  `json:"committer,omitempty"`
+	Authors    []jsonAttribution `json:"authors,omitempty"`
+	Tagger     *jsonAttribution  `json:"tagger,omitempty"`
+	Comment    *string           `json:"comment,omitempty"`
+	Parents    []string          `json:"parents,omitempty"`
+	FileOps    []jsonFileOp      `json:"fileops,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Size       *int64            `json:"size,omitempty"`
+}
+
+func newJSONAttribution(attr *Attribution) *jsonAttribution {
+	return &jsonAttribution{Name: attr.fullname, Email: attr.email, Date: attr.date.rfc3339()}
+}
+
+// jsonify returns the JSON form of an event, or nil for event types
+// (passthroughs) that have no useful metadata.
+func (repo *Repository) jsonify(i int, event Event) *jsonEvent {
+	switch e := event.(type) {
+	case *Blob:
+		return &jsonEvent{Type: "blob", Index: i + 1, UUID: e.uuid, Mark: e.mark, Size: &e.size}
+	case *Commit:
+		out := &jsonEvent{
+			Type:      "commit",
+			Index:     i + 1,
+			UUID:      e.uuid,
+			Mark:      e.mark,
+			Branch:    e.Branch,
+			LegacyID:  e.legacyID,
+			Stamp:     e.actionStamp(),
+			Committer: newJSONAttribution(&e.committer),
+			Comment:   &e.Comment,
+			Parents:   make([]string, 0),
+			FileOps:   make([]jsonFileOp, 0),
+		}
+		for j := range e.authors {
+			out.Authors = append(out.Authors, *newJSONAttribution(&e.authors[j]))
+		}
+		for _, parent := range e.parents() {
+			out.Parents = append(out.Parents, parent.getMark())
+		}
+		for _, fileop := range e.operations() {
+			op := jsonFileOp{Op: string(rune(fileop.op)), Path: fileop.Path}
+			switch fileop.op {
+			case opM, opN:
+				op.Mode = fileop.mode
+				op.Ref = fileop.ref
+			case opR, opC:
+				op.Source = fileop.Source
+			case deleteall:
+				op.Op = "deleteall"
+			}
+			out.FileOps = append(out.FileOps, op)
+		}
+		if e.hasProperties() {
+			out.Properties = make(map[string]string)
+			for _, key := range e.properties.keys {
+				out.Properties[key] = e.properties.get(key)
+			}
+		}
+		return out
+	case *Tag:
+		return &jsonEvent{
+			Type:     "tag",
+			Index:    i + 1,
+			UUID:     e.uuid,
+			Name:     e.tagname,
+			Target:   e.committish,
+			LegacyID: e.legacyID,
+			Tagger:   newJSONAttribution(&e.tagger),
+			Comment:  &e.Comment,
+		}
+	case *Reset:
+		return &jsonEvent{
+			Type:     "reset",
+			Index:    i + 1,
+			UUID:     e.uuid,
+			Name:     e.ref,
+			Target:   e.committish,
+			LegacyID: e.legacyID,
+		}
+	}
+	return nil
+}
+
+// exportMetadata writes the metadata of the selected events as JSON.
+// Format "json" emits one array; "ndjson" emits one object per line,
+// which is easier for streaming consumers to handle.  Blob content is
+// not included, only blob marks and sizes.
+func (repo *Repository) exportMetadata(selection selectionSet, w io.Writer, format string) error {
+	if format != "json" && format != "ndjson" {
+		return fmt.Errorf("unknown metadata format %q", format)
+	}
+	repo.identifyEvents()
+	if format == "json" {
+		if _, err := io.WriteString(w, "[\n"); err != nil {
+			return err
+		}
+	}
+	first := true
+	for it := selection.Iterator(); it.Next(); {
+		out := repo.jsonify(it.Value(), repo.events[it.Value()])
+		if out == nil {
+			continue
+		}
+		text, err := json.Marshal(out)
+		if err != nil {
+			return err
+		}
+		if format == "json" && !first {
+			if _, err = io.WriteString(w, ",\n"); err != nil {
+				return err
+			}
+		}
+		first = false
+		if _, err = w.Write(text); err != nil {
+			return err
+		}
+		if format == "ndjson" {
+			if _, err = io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+	}
+	if format == "json" {
+		if !first {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, "]\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toAttribution converts a JSON attribution to the internal form.  An
+// empty date keeps the date of the attribution being replaced.
+func (ja *jsonAttribution) toAttribution(old *Attribution) (*Attribution, error) {
+	attr := old.clone()
+	attr.fullname = ja.Name
+	attr.email = ja.Email
+	if ja.Date != "" {
+		date, err := newDate(ja.Date)
+		if err != nil {
+			return nil, fmt.Errorf("malformed date %q: %v", ja.Date, err)
+		}
+		attr.date = date
+	}
+	return attr, nil
+}
+
+// readMetadata reads either a JSON array or newline-delimited objects.
+func readMetadata(r io.Reader) ([]jsonEvent, error) {
+	br := bufio.NewReader(r)
+	for {
+		c, err := br.Peek(1)
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(string(c)) != "" {
+			break
+		}
+		br.ReadByte()
+	}
+	dec := json.NewDecoder(br)
+	dec.DisallowUnknownFields()
+	var edits []jsonEvent
+	if c, _ := br.Peek(1); c[0] == '[' {
+		err := dec.Decode(&edits)
+		return edits, err
+	}
+	for {
+		var edit jsonEvent
+		if err := dec.Decode(&edit); err == io.EOF {
+			break
+		} else if err != nil {
+			return edits, err
+		}
+		edits = append(edits, edit)
+	}
+	return edits, nil
+}
+
+// locate finds the event a JSON edit applies to: by stable ID if it
+// names an event, then by mark, then by action stamp for commits or
+// name for tags. Event numbers are deliberately not used, as they are
+// not stable across surgery.
+func (repo *Repository) locate(edit *jsonEvent) (Event, error) {
+	if event := repo.eventByID(edit.UUID); event != nil {
+		return event, nil
+	}
+	if edit.Mark != "" {
+		if event := repo.markToEvent(edit.Mark); event != nil {
+			return event, nil
+		}
+		return nil, fmt.Errorf("no event has mark %s", edit.Mark)
+	}
+	if edit.Stamp != "" {
+		matches := repo.named(edit.Stamp)
+		if matches.Size() != 1 {
+			return nil, fmt.Errorf("action stamp %s does not match a unique event", edit.Stamp)
+		}
+		return repo.events[matches.Fetch(0)], nil
+	}
+	if edit.Type == "tag" && edit.Name != "" {
+		for _, event := range repo.events {
+			if tag, ok := event.(*Tag); ok && tag.tagname == edit.Name {
+				return tag, nil
+			}
+		}
+		return nil, fmt.Errorf("no tag is named %s", edit.Name)
+	}
+	return nil, errors.New("edit has no mark, stamp, or tag name to match on")
+}
+
+// importMetadata applies attribute edits from a JSON document in the
+// form emitted by exportMetadata.  Only comments, attributions, and
+// branch fields are changed; other fields are used for matching or
+// ignored, and records with none of those are skipped.  With dryrun
+// set, no changes are made and a report of the events that would
+// change, and which fields, is written to w.  Returns the count of
+// events (that would be) modified.
+func (repo *Repository) importMetadata(r io.Reader, w io.Writer, dryrun bool) (int, error) {
+	edits, err := readMetadata(r)
+	if err != nil {
+		return 0, fmt.Errorf("while reading JSON: %v", err)
+	}
+	type change struct {
+		event  Event
+		fields []string
+		apply  func()
+	}
+	changes := make([]change, 0)
+	// Validate everything before changing anything, so an error
+	// part way through doesn't leave a half-applied edit.
+	for i := range edits {
+		edit := &edits[i]
+		// Records of blobs and resets, as exportMetadata writes
+		// them, have nothing to edit.
+		if edit.Committer == nil && edit.Authors == nil && edit.Tagger == nil &&
+			edit.Comment == nil && edit.Branch == "" {
+			continue
+		}
+		event, err := repo.locate(edit)
+		if err != nil {
+			return 0, fmt.Errorf("edit %d: %v", i+1, err)
+		}
+		var c change
+		c.event = event
+		switch e := event.(type) {
+		case *Commit:
+			if edit.Tagger != nil {
+				return 0, fmt.Errorf("edit %d: %s has no tagger", i+1, e.idMe())
+			}
+			var committer *Attribution
+			var authors []Attribution
+			if edit.Committer != nil {
+				if committer, err = edit.Committer.toAttribution(&e.committer); err != nil {
+					return 0, fmt.Errorf("edit %d: %v", i+1, err)
+				}
+				if !committer.Equal(&e.committer) {
+					c.fields = append(c.fields, "committer")
+				}
+			}
+			if edit.Authors != nil {
+				// An empty list is applied too; it leaves the
+				// committer as the author.
+				authors = make([]Attribution, 0, len(edit.Authors))
+				differs := len(edit.Authors) != len(e.authors)
+				for j := range edit.Authors {
+					old := &e.committer
+					if j < len(e.authors) {
+						old = &e.authors[j]
+					}
+					author, err := edit.Authors[j].toAttribution(old)
+					if err != nil {
+						return 0, fmt.Errorf("edit %d: %v", i+1, err)
+					}
+					differs = differs || !author.Equal(old)
+					authors = append(authors, *author)
+				}
+				if differs {
+					c.fields = append(c.fields, "authors")
+				}
+			}
+			if edit.Comment != nil && *edit.Comment != e.Comment {
+				c.fields = append(c.fields, "comment")
+			}
+			if edit.Branch != "" && edit.Branch != e.Branch {
+				c.fields = append(c.fields, "branch")
+			}
+			c.apply = func() {
+				if committer != nil {
+					e.committer = *committer
+				}
+				if authors != nil {
+					e.authors = authors
+				}
+				if edit.Comment != nil {
+					e.Comment = *edit.Comment
+				}
+				if edit.Branch != "" {
+					e.setBranch(edit.Branch)
+				}
+				e.hash.invalidate()
+			}
+		case *Tag:
+			if edit.Committer != nil || edit.Authors != nil || edit.Branch != "" {
+				return 0, fmt.Errorf("edit %d: %s has only a tagger and comment", i+1, e.idMe())
+			}
+			var tagger *Attribution
+			if edit.Tagger != nil {
+				if tagger, err = edit.Tagger.toAttribution(&e.tagger); err != nil {
+					return 0, fmt.Errorf("edit %d: %v", i+1, err)
+				}
+				if !tagger.Equal(&e.tagger) {
+					c.fields = append(c.fields, "tagger")
+				}
+			}
+			if edit.Comment != nil && *edit.Comment != e.Comment {
+				c.fields = append(c.fields, "comment")
+			}
+			c.apply = func() {
+				if tagger != nil {
+					e.tagger = *tagger
+				}
+				if edit.Comment != nil {
+					e.Comment = *edit.Comment
+				}
+				e.hash.invalidate()
+			}
+		default:
+			return 0, fmt.Errorf("edit %d: %s has no editable metadata", i+1, event.idMe())
+		}
+		if len(c.fields) > 0 {
+			changes = append(changes, c)
+		}
+	}
+	if dryrun {
+		for _, c := range changes {
+			fmt.Fprintf(w, "%s: %s\n", c.event.idMe(), strings.Join(c.fields, ", "))
+		}
+		return len(changes), nil
+	}
+	repo.clearColor(colorQSET)
+	for _, c := range changes {
+		c.apply()
+		c.event.addColor(colorQSET)
+	}
+	if len(changes) > 0 {
+		repo.invalidateNamecache()
+	}
+	return len(changes), nil
+}
@@ -0,0 +1,177 @@
+/*
+ * File mode audit and repair
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Systems without an executable bit, or with one nobody set, leave
+// scripts behind as 100644 files; checkouts on filesystems without
+// symbolic links turn links into files and back; and a file's mode can
+// flip back and forth over its history as it passes through such
+// checkouts, each flip a spurious change.  This pass looks for all
+// three, plus symbolic links that point outside the tree, which are
+// worth knowing about before the repository is published.  The repairs
+// offered are making scripts executable and pinning the mode of the
+// files matching a pattern throughout a selection.
+
+// regularModes are the modes of ordinary files, the only ones repair
+// and pinning change.
+var regularModes = newOrderedStringSet("100644", "100755")
+
+// symlinkEscapes tells whether a symbolic link at a path to a target
+// leads outside the tree.
+func symlinkEscapes(linkpath string, target string) bool {
+	if path.IsAbs(target) {
+		return true
+	}
+	resolved := path.Join(path.Dir(linkpath), target)
+	return resolved == ".." || strings.HasPrefix(resolved, "../")
+}
+
+// modeContent returns the content of the file a modification creates.
+func (repo *Repository) modeContent(fileop *FileOp) []byte {
+	if fileop.ref == "inline" {
+		return fileop.inline
+	}
+	if blob, ok := repo.markToEvent(fileop.ref).(*Blob); ok {
+		return blob.getContent()
+	}
+	return nil
+}
+
+// isShebangScript tells whether a modification creates a script that
+// isn't executable.  Results for blobs are remembered in seen.
+func (repo *Repository) isShebangScript(fileop *FileOp, seen map[string]bool) bool {
+	if fileop.op != opM || fileop.mode != "100644" {
+		return false
+	}
+	if fileop.ref == "inline" {
+		return bytes.HasPrefix(fileop.inline, []byte("#!"))
+	}
+	shebang, ok := seen[fileop.ref]
+	if !ok {
+		shebang = bytes.HasPrefix(repo.modeContent(fileop), []byte("#!"))
+		seen[fileop.ref] = shebang
+	}
+	return shebang
+}
+
+// modeAudit reports, for each selected commit, the scripts it adds or
+// changes without an executable bit and the symbolic links it makes
+// that lead out of the tree, then the paths whose mode changes more
+// than once across the selection.  Commits with problems get Q bits.
+// Returns the number of problems found.
+func (repo *Repository) modeAudit(w io.Writer, selection selectionSet) int {
+	repo.clearColor(colorQSET)
+	seen := make(map[string]bool)
+	lastMode := make(map[string]string)
+	changes := make(map[string]int)
+	var scripts, escapes int
+	for _, commit := range repo.commits(selection) {
+		notes := make([]string, 0)
+		for _, fileop := range commit.operations() {
+			if fileop.op != opM {
+				continue
+			}
+			if last, ok := lastMode[fileop.Path]; ok && last != fileop.mode {
+				changes[fileop.Path]++
+			}
+			lastMode[fileop.Path] = fileop.mode
+			if repo.isShebangScript(fileop, seen) {
+				notes = append(notes, fmt.Sprintf("%s (script not executable)", fileop.Path))
+				scripts++
+			} else if fileop.mode == "120000" {
+				target := string(repo.modeContent(fileop))
+				if symlinkEscapes(fileop.Path, target) {
+					notes = append(notes, fmt.Sprintf("%s (link to %s leaves the tree)", fileop.Path, target))
+					escapes++
+				}
+			}
+		}
+		if len(notes) > 0 {
+			commit.addColor(colorQSET)
+			fmt.Fprintf(w, "%s:\n", commit.idMe())
+			for _, note := range notes {
+				fmt.Fprintf(w, "\t%s\n", note)
+			}
+		}
+	}
+	flapping := make([]string, 0)
+	for name, n := range changes {
+		if n > 1 {
+			flapping = append(flapping, name)
+		}
+	}
+	sort.Strings(flapping)
+	fmt.Fprintf(w, "%d scripts not executable, %d links leaving the tree, %d paths changing mode more than once\n",
+		scripts, escapes, len(flapping))
+	for _, name := range flapping {
+		fmt.Fprintf(w, "\t%s (%d changes)\n", name, changes[name])
+	}
+	return scripts + escapes + len(flapping)
+}
+
+// setModes gives the modifications of ordinary files in the selected
+// commits that pass a test the mode chosen for them.  Altered commits
+// get Q bits.  Returns the number of fileops changed.
+func (repo *Repository) setModes(selection selectionSet, choose func(*FileOp) string) int {
+	repo.clearColor(colorQSET)
+	changed := 0
+	for _, commit := range repo.commits(selection) {
+		altered := false
+		for _, fileop := range commit.operations() {
+			if fileop.op != opM || !regularModes.Contains(fileop.mode) {
+				continue
+			}
+			if mode := choose(fileop); mode != "" && mode != fileop.mode {
+				fileop.mode = mode
+				altered = true
+				changed++
+			}
+		}
+		if altered {
+			commit.invalidateManifests()
+			commit.addColor(colorQSET)
+		}
+	}
+	return changed
+}
+
+// modeRepair makes the non-executable scripts in the selected commits
+// executable.  Returns the number of fileops changed.
+func (repo *Repository) modeRepair(selection selectionSet) int {
+	seen := make(map[string]bool)
+	return repo.setModes(selection, func(fileop *FileOp) string {
+		if repo.isShebangScript(fileop, seen) {
+			return "100755"
+		}
+		return ""
+	})
+}
+
+// modePin gives every ordinary file matching a path pattern in the
+// selected commits the same mode.  Returns the number of fileops
+// changed.
+func (repo *Repository) modePin(selection selectionSet, pathRE *regexp.Regexp, mode string) int {
+	return repo.setModes(selection, func(fileop *FileOp) string {
+		if pathRE.MatchString(fileop.Path) {
+			return mode
+		}
+		return ""
+	})
+}
+
+// end
@@ -0,0 +1,314 @@
+/*
+ * Name cache: resolution of legacy IDs, tag and reset names, action
+ * stamps and commit ordinals to events
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Resolving a name by searching the event list is O(n), so names are
+// looked up in a cache.  The cache used to map names to event indices,
+// which every insertion or deletion shifts, so it was thrown away on
+// any change to the event sequence and rebuilt, formatting two action
+// stamps per commit, on the next lookup.  A script that deletes events
+// one at a time and names the next each time paid for a rebuild per
+// command.
+//
+// Now the cache maps names to the events themselves, which stay put.
+// A change only marks the cache stale; the next lookup brings it up to
+// date in one pass that records event positions and compares what
+// each event's names are made from with what it was when they were
+// made.  Only events that were inserted, deleted, or altered have their
+// names worked out again, so after an insertion, a deletion or a
+// renumbering of marks the pass costs a map lookup per event.  On
+// first use every event is new, which is the full build.
+//
+// Where several events claim a name only one can have, the last in
+// event order gets it.  The name of a branch that a reset sets is
+// resolved through the reset's committish at lookup time, so it
+// follows the reset when a deletion moves it.
+
+// nameClaim is an event's claim to a name.  A claim through a reset's
+// target names the commit the reset points at.
+type nameClaim struct {
+	event  Event
+	target bool
+}
+
+// stampKey is what an action stamp is made from.
+type stampKey struct {
+	when  int64
+	email string
+}
+
+// nameKey is what the names of an event are made from.
+type nameKey struct {
+	uuid      string
+	legacyID  string
+	name      string // Tag name or reset ref
+	authored  bool
+	author    stampKey
+	committer stampKey
+}
+
+// nameEntry records the names an event was given.
+type nameEntry struct {
+	key    nameKey
+	names  []string
+	stamps []string
+	group  string
+	seen   uint64
+}
+
+// nameCache holds the names of a repository's events.
+type nameCache struct {
+	names      map[string][]nameClaim // event IDs, legacy IDs, tag names and reset names
+	stamps     map[string][]*Commit   // commits by author and committer stamp
+	groups     map[string][]*Commit   // commits by action stamp, for STAMP#n
+	entries    map[Event]*nameEntry
+	positions  map[Event]int // nil when the cache is stale
+	ordinals   []int         // indices of commits
+	generation uint64
+}
+
+func newNameCache() *nameCache {
+	return &nameCache{
+		names:   make(map[string][]nameClaim),
+		stamps:  make(map[string][]*Commit),
+		groups:  make(map[string][]*Commit),
+		entries: make(map[Event]*nameEntry),
+	}
+}
+
+// nameKeyOf returns what the names of an event are made from, and
+// whether it has any.
+func nameKeyOf(event Event) (nameKey, bool) {
+	key := nameKey{uuid: event.getUUID()}
+	switch event := event.(type) {
+	case *Commit:
+		key.legacyID = event.legacyID
+		key.committer = stampKey{event.committer.date.timestamp.Unix(), event.committer.email}
+		if len(event.authors) > 0 {
+			key.authored = true
+			key.author = stampKey{event.authors[0].date.timestamp.Unix(), event.authors[0].email}
+		}
+		return key, true
+	case *Tag:
+		key.legacyID, key.name = event.legacyID, event.tagname
+		return key, true
+	case *Reset:
+		key.legacyID, key.name = event.legacyID, event.ref
+		return key, true
+	}
+	return key, key.uuid != ""
+}
+
+// add records the names of an event.
+func (cache *nameCache) add(event Event, key nameKey) *nameEntry {
+	entry := &nameEntry{key: key}
+	claim := func(name string, target bool) {
+		cache.names[name] = append(cache.names[name], nameClaim{event, target})
+		entry.names = append(entry.names, name)
+	}
+	if key.uuid != "" {
+		claim(key.uuid, false)
+	}
+	switch event := event.(type) {
+	case *Commit:
+		if event.legacyID != "" {
+			claim(event.legacyID, false)
+		}
+		stamps := []string{event.committer.actionStamp()}
+		if len(event.authors) > 0 {
+			// Neither is recorded when they're the same.
+			if authorStamp := event.authors[0].actionStamp(); authorStamp != stamps[0] {
+				stamps = append(stamps, authorStamp)
+			} else {
+				stamps = nil
+			}
+		}
+		for _, stamp := range stamps {
+			cache.stamps[stamp] = append(cache.stamps[stamp], event)
+		}
+		entry.stamps = stamps
+		entry.group = event.actionStamp()
+		cache.groups[entry.group] = append(cache.groups[entry.group], event)
+	case *Tag:
+		claim(event.tagname, false)
+		if event.legacyID != "" {
+			claim(event.legacyID, false)
+		}
+	case *Reset:
+		claim("reset@"+filepath.Base(event.ref), false)
+		claim(filepath.Base(event.ref), true)
+		if event.legacyID != "" {
+			claim(event.legacyID, false)
+		}
+	}
+	cache.entries[event] = entry
+	return entry
+}
+
+// dropCommit removes a commit from a list in a table of commits.
+func dropCommit(table map[string][]*Commit, name string, commit *Commit) {
+	kept := table[name][:0]
+	for _, c := range table[name] {
+		if c != commit {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == 0 {
+		delete(table, name)
+	} else {
+		table[name] = kept
+	}
+}
+
+// drop forgets the names of an event.
+func (cache *nameCache) drop(event Event, entry *nameEntry) {
+	for _, name := range entry.names {
+		kept := cache.names[name][:0]
+		for _, claim := range cache.names[name] {
+			if claim.event != event {
+				kept = append(kept, claim)
+			}
+		}
+		if len(kept) == 0 {
+			delete(cache.names, name)
+		} else {
+			cache.names[name] = kept
+		}
+	}
+	if commit, ok := event.(*Commit); ok {
+		for _, stamp := range entry.stamps {
+			dropCommit(cache.stamps, stamp, commit)
+		}
+		dropCommit(cache.groups, entry.group, commit)
+	}
+	delete(cache.entries, event)
+}
+
+// sync brings a stale cache up to date with the event list.
+func (cache *nameCache) sync(events []Event) {
+	if cache.positions != nil {
+		return
+	}
+	cache.generation++
+	cache.positions = make(map[Event]int, len(events))
+	cache.ordinals = cache.ordinals[:0]
+	for i, event := range events {
+		cache.positions[event] = i
+		if _, ok := event.(*Commit); ok {
+			cache.ordinals = append(cache.ordinals, i)
+		}
+		key, ok := nameKeyOf(event)
+		if !ok {
+			continue
+		}
+		entry, ok := cache.entries[event]
+		if ok && entry.key != key {
+			cache.drop(event, entry)
+			ok = false
+		}
+		if !ok {
+			entry = cache.add(event, key)
+		}
+		entry.seen = cache.generation
+	}
+	for event, entry := range cache.entries {
+		if entry.seen != cache.generation {
+			cache.drop(event, entry)
+		}
+	}
+}
+
+// position returns the index of an event, or -1 if it's no longer in
+// the repository.
+func (cache *nameCache) position(event Event) int {
+	if i, ok := cache.positions[event]; ok {
+		return i
+	}
+	return -1
+}
+
+// ordinalSuffix parses the N of a name ending in #N.  N is a positive
+// decimal number without leading zeros, as the names are made.
+func ordinalSuffix(digits string) (int, bool) {
+	if digits == "" || digits[0] == '0' || strings.Trim(digits, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(digits)
+	return n, err == nil
+}
+
+// lookupName resolves a name through the name cache.
+func (repo *Repository) lookupName(ref string) (selectionSet, bool) {
+	if repo._namecache == nil {
+		repo._namecache = newNameCache()
+	}
+	cache := repo._namecache
+	if cache.positions == nil {
+		// Events made since the last sync may need identifiers.
+		repo.identifyEvents()
+	}
+	cache.sync(repo.events)
+	// Commits sharing an action stamp are named STAMP#1, STAMP#2...
+	// in event order.
+	if hash := strings.LastIndex(ref, "#"); hash > 0 {
+		if n, ok := ordinalSuffix(ref[hash+1:]); ok {
+			indices := make([]int, 0)
+			for _, commit := range cache.groups[ref[:hash]] {
+				indices = append(indices, cache.position(commit))
+			}
+			if len(indices) > 1 && n <= len(indices) {
+				sort.Ints(indices)
+				return newSelectionSet(indices[n-1]), true
+			}
+		}
+	}
+	best := -1
+	for _, claim := range cache.names[ref] {
+		if !claim.target {
+			best = max(best, cache.position(claim.event))
+		} else if committish := claim.event.(*Reset).committish; committish != "" {
+			best = max(best, repo.markToIndex(committish))
+		}
+	}
+	// Commits are also named #1, #2... in event order.
+	if strings.HasPrefix(ref, "#") {
+		if n, ok := ordinalSuffix(ref[1:]); ok && n <= len(cache.ordinals) {
+			best = max(best, cache.ordinals[n-1])
+		}
+	}
+	if best >= 0 {
+		return newSelectionSet(best), true
+	}
+	if commits, ok := cache.stamps[ref]; ok {
+		indices := make([]int, 0, len(commits))
+		for _, commit := range commits {
+			indices = append(indices, cache.position(commit))
+		}
+		sort.Ints(indices)
+		return newSelectionSet(indices...), true
+	}
+	return undefinedSelectionSet, false
+}
+
+// invalidateNamecache marks the name cache stale, after a change to
+// the event sequence or to what events are named by.
+func (repo *Repository) invalidateNamecache() {
+	if repo._namecache != nil {
+		repo._namecache.positions = nil
+	}
+}
+
+// end
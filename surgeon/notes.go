@@ -0,0 +1,224 @@
+/*
+ * Git notes: pairing notes with the commits they annotate
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Git keeps notes, text attached to commits after the fact, on
+// branches of their own under refs/notes/.  In a stream each note is
+// an N fileop in a commit on such a branch, naming the commit it
+// annotates by mark and its content by blob mark or inline data.
+// Nothing else ties a note to its commit, so edits that know nothing
+// of notes leave them pointing at marks that are gone or renumbered.
+//
+// So a note's blob counts as used, like a file's, and marks in N
+// fileops are renumbered along with everything else.  When squash or
+// delete removes an annotated commit its notes go where its tags go,
+// to the commit that absorbs it, or are dropped with it.  A target
+// that already has a note on the same notes branch ends up with two,
+// and as in git fast-import the later one wins.
+
+// notesPrefix is the namespace of notes refs.
+const notesPrefix = "refs/notes/"
+
+// isNotesRef tells whether a ref holds notes.
+func isNotesRef(ref string) bool {
+	return strings.HasPrefix(ref, notesPrefix)
+}
+
+// hasNotes tells whether a commit holds notes on other commits.
+func (commit *Commit) hasNotes() bool {
+	for _, fileop := range commit.operations() {
+		if fileop.op == opN {
+			return true
+		}
+	}
+	return false
+}
+
+// notesIndex maps the mark of each annotated commit to the N fileops
+// naming it, in event order.  Notes in commits on their way out are
+// left out.
+func (repo *Repository) notesIndex() map[string][]*FileOp {
+	index := make(map[string][]*FileOp)
+	for _, commit := range repo.commits(undefinedSelectionSet) {
+		if commit.hasColor(colorDELETE) {
+			continue
+		}
+		for _, fileop := range commit.operations() {
+			if fileop.op == opN {
+				index[fileop.Path] = append(index[fileop.Path], fileop)
+			}
+		}
+	}
+	return index
+}
+
+// noteContent returns the text of a note.
+func (repo *Repository) noteContent(fileop *FileOp) []byte {
+	if fileop.ref == "inline" {
+		return fileop.inline
+	}
+	if blob, ok := repo.markToEvent(fileop.ref).(*Blob); ok {
+		return blob.getContent()
+	}
+	return nil
+}
+
+// noteHolders maps each N fileop to the commit holding it.
+func (repo *Repository) noteHolders() map[*FileOp]*Commit {
+	holders := make(map[*FileOp]*Commit)
+	for _, commit := range repo.commits(undefinedSelectionSet) {
+		for _, fileop := range commit.operations() {
+			if fileop.op == opN {
+				holders[fileop] = commit
+			}
+		}
+	}
+	return holders
+}
+
+// dropNote removes an N fileop from the commit holding it.
+func (repo *Repository) dropNote(holder *Commit, fileop *FileOp) {
+	ops := make([]*FileOp, 0, len(holder.fileops))
+	for _, op := range holder.fileops {
+		if op != fileop {
+			ops = append(ops, op)
+		}
+	}
+	holder.setOperations(ops)
+	repo.inlines--
+}
+
+// retargetNotes points the notes on a commit at another, or with a nil
+// target drops them.  The index is kept up to date.  Returns the number
+// of notes affected.
+func (repo *Repository) retargetNotes(index map[string][]*FileOp, commit *Commit, target *Commit) int {
+	notes := index[commit.mark]
+	if len(notes) == 0 {
+		return 0
+	}
+	delete(index, commit.mark)
+	var holders map[*FileOp]*Commit
+	for _, fileop := range notes {
+		if target != nil {
+			if logEnable(logDELETE) {
+				logit("moving note on %s to %s", commit.mark, target.mark)
+			}
+			fileop.Path = target.mark
+			index[target.mark] = append(index[target.mark], fileop)
+		} else {
+			if holders == nil {
+				holders = repo.noteHolders()
+			}
+			if holder := holders[fileop]; holder != nil && !holder.hasColor(colorDELETE) {
+				repo.dropNote(holder, fileop)
+			}
+		}
+	}
+	return len(notes)
+}
+
+// listNotes reports the notes on the selected commits, one line each:
+// the annotated commit, the notes ref, and the first line of the note.
+// Returns the number of notes listed.
+func (repo *Repository) listNotes(w io.Writer, selection selectionSet) int {
+	index := repo.notesIndex()
+	holders := repo.noteHolders()
+	count := 0
+	for _, commit := range repo.commits(selection) {
+		for _, fileop := range index[commit.mark] {
+			summary := strings.SplitN(strings.TrimSpace(string(repo.noteContent(fileop))), "\n", 2)[0]
+			fmt.Fprintf(w, "%s %s %q\n", commit.idMe(), holders[fileop].Branch, summary)
+			count++
+		}
+	}
+	return count
+}
+
+// foldNotes appends the notes on the selected commits to their
+// comments, set off the way git log shows them: a "Notes:" line, or
+// "Notes (NAME):" for notes not under refs/notes/commits, followed by
+// the note indented four spaces.  If ref is not empty only notes on it
+// are folded.  With remove, the folded notes are deleted from their
+// notes commits, along with any they hide.  Annotated commits get Q
+// bits.  Returns the number of notes folded.
+func (repo *Repository) foldNotes(selection selectionSet, ref string, remove bool) int {
+	index := repo.notesIndex()
+	holders := repo.noteHolders()
+	repo.clearColor(colorQSET)
+	folded := 0
+	doomed := make([]*FileOp, 0)
+	for _, commit := range repo.commits(selection) {
+		// Where a ref has more than one note on a commit, the
+		// last is the one git shows.
+		latest := make(map[string]*FileOp)
+		for _, fileop := range index[commit.mark] {
+			if ref == "" || holders[fileop].Branch == ref {
+				latest[holders[fileop].Branch] = fileop
+				doomed = append(doomed, fileop)
+			}
+		}
+		notes := make([]*FileOp, 0, len(latest))
+		for _, fileop := range index[commit.mark] {
+			if latest[holders[fileop].Branch] == fileop {
+				notes = append(notes, fileop)
+			}
+		}
+		if len(notes) == 0 {
+			continue
+		}
+		// Notes on different refs are folded in ref order.
+		sort.SliceStable(notes, func(i, j int) bool {
+			return holders[notes[i]].Branch < holders[notes[j]].Branch
+		})
+		for _, fileop := range notes {
+			header := "Notes:"
+			if branch := holders[fileop].Branch; branch != notesPrefix+"commits" {
+				header = fmt.Sprintf("Notes (%s):", strings.TrimPrefix(branch, notesPrefix))
+			}
+			var text strings.Builder
+			text.WriteString(header + "\n")
+			for _, line := range strings.Split(strings.TrimRight(string(repo.noteContent(fileop)), "\n"), "\n") {
+				if line == "" {
+					text.WriteString("\n")
+				} else {
+					text.WriteString("    " + line + "\n")
+				}
+			}
+			if !strings.HasSuffix(commit.Comment, "\n") && commit.Comment != "" {
+				commit.Comment += "\n"
+			}
+			if commit.Comment != "" {
+				commit.Comment += "\n"
+			}
+			commit.Comment += text.String()
+			folded++
+		}
+		commit.hash.invalidate()
+		commit.addColor(colorQSET)
+	}
+	if remove {
+		orphans := make(map[*Blob]bool)
+		for _, fileop := range doomed {
+			repo.dropNote(holders[fileop], fileop)
+			if blob, ok := repo.markToEvent(fileop.ref).(*Blob); ok && len(blob.opset) == 0 {
+				orphans[blob] = true
+			}
+		}
+		repo.dropBlobs(orphans)
+	}
+	return folded
+}
+
+// end
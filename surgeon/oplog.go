@@ -0,0 +1,193 @@
+/*
+ * Operations log: an audit trail of the surgery done on a repository
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A big conversion is done over weeks, in many sessions, by a lift
+// script that changes as problems turn up.  Knowing afterwards what was
+// actually done to get the repository that was shipped is the
+// difference between a conversion that can be reproduced and one that
+// can't.  So every command that may alter a repository gets a line in
+// its operations log: when it started, how long it took, how many
+// events were selected, how many were added and deleted, and the
+// command itself.  The log is kept in the scratch directory as it
+// grows, so it survives a crash, and written into the metadata
+// directory of a rebuilt repository, from which a later read picks it
+// up again so the trail continues across sessions.
+
+// oplogName is the name of the log in scratch and metadata directories.
+const oplogName = "reposurgeon-oplog"
+
+const oplogHeader = "# start\telapsed\tselected\tadded\tdeleted\tcommand"
+
+// oplogReadOnly names the commands that never alter a repository's
+// events, so aren't logged.  Macro and script invocations aren't
+// either; the commands they run are.
+var oplogReadOnly = newStringSet("help", "eof", "quit", "exit", "shell",
+	"resolve", "assign", "unassign", "history", "profile", "checkpoint",
+	"show", "count", "health", "list", "lint", "prefer", "sourcetype",
+	"gc", "compact", "choose", "drop", "preserve", "unpreserve", "write",
+	"view", "graph", "rebuild", "msgout", "jsonout", "checkout", "diff",
+	"set", "clear", "define", "do", "undefine", "script", "version",
+	"log", "warnings", "print", "hash", "drift", "verify", "oplog", "eval", "archive",
+	"snapshot")
+
+// pendingOp is what is known of a command before it runs.
+type pendingOp struct {
+	line     string
+	verb     string
+	start    time.Time
+	repo     *Repository
+	before   []Event
+	selected int
+	journal  int // Journal position before, see forgetUndo
+}
+
+// oplogged tells whether a command line is one the log records.
+func oplogged(line string) bool {
+	fields := strings.Fields(line)
+	return len(fields) > 0 && !strings.HasPrefix(fields[0], "#") && !oplogReadOnly.Contains(fields[0])
+}
+
+// beginOp notes the state of a repository before a command that may
+// alter it.  rest is what follows the selection set, if any.
+func beginOp(line string, rest string, repo *Repository, selection selectionSet) *pendingOp {
+	if !oplogged(rest) {
+		return nil
+	}
+	op := &pendingOp{line: strings.TrimSpace(line), verb: strings.Fields(rest)[0], start: time.Now(), repo: repo}
+	if repo != nil {
+		op.before = append([]Event(nil), repo.events...)
+		op.journal = repo.journalSeq()
+	}
+	if selection.isDefined() {
+		op.selected = selection.Size()
+	}
+	return op
+}
+
+// finish logs a command in the repository chosen after it ran, which
+// for a read is the one it made.
+func (op *pendingOp) finish(repo *Repository) {
+	if repo == nil {
+		return
+	}
+	before := op.before
+	if repo != op.repo {
+		before = nil
+	}
+	added, deleted := eventChanges(before, repo.events)
+	entry := fmt.Sprintf("%s\t%.3fs\t%d\t%d\t%d\t%s", op.start.UTC().Format(time.RFC3339),
+		time.Since(op.start).Seconds(), op.selected, added, deleted, op.line)
+	if err := repo.appendOplog(entry); err != nil && logEnable(logWARN) {
+		logit("operations log: %v", err)
+	}
+}
+
+// settleJournal forgets the undo journal of a repository that a command
+// may have altered without saving its state first.  Undo and redo move
+// through the journal themselves.
+func (op *pendingOp) settleJournal(repo *Repository) {
+	if repo == nil || repo != op.repo || op.verb == "undo" || op.verb == "redo" {
+		return
+	}
+	if repo.journalSeq() == op.journal {
+		repo.forgetUndo()
+	}
+}
+
+// eventChanges counts the events added and deleted between two states
+// of an event list.  Most commands leave the list as it was, which is
+// checked for first since it needs no maps.
+func eventChanges(before []Event, after []Event) (int, int) {
+	if len(before) == len(after) {
+		same := true
+		for i := range before {
+			if before[i] != after[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return 0, 0
+		}
+	}
+	was := make(map[Event]bool, len(before))
+	for _, event := range before {
+		was[event] = true
+	}
+	added := 0
+	for _, event := range after {
+		if was[event] {
+			delete(was, event)
+		} else {
+			added++
+		}
+	}
+	return added, len(was)
+}
+
+// appendOplog adds an entry to the operations log.  The log file in the
+// scratch directory is written whole when it doesn't exist yet, since
+// the entries may have been read with the repository.
+func (repo *Repository) appendOplog(entry string) error {
+	repo.oplog = append(repo.oplog, entry)
+	dir := repo.subdir("")
+	if err := os.MkdirAll(dir, userReadWriteSearchMode); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, oplogName)
+	lines := []string{entry}
+	if !exists(path) {
+		lines = append([]string{oplogHeader}, repo.oplog...)
+	}
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, userReadWriteMode)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(fp, strings.Join(lines, "\n"))
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readOplog loads entries left by earlier sessions.
+func (repo *Repository) readOplog(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" && !strings.HasPrefix(line, "#") {
+			repo.oplog = append(repo.oplog, line)
+		}
+	}
+	return scanner.Err()
+}
+
+// writeOplog writes the operations log with its header.
+func (repo *Repository) writeOplog(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, oplogHeader); err != nil {
+		return err
+	}
+	for _, entry := range repo.oplog {
+		if _, err := fmt.Fprintln(w, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// end
@@ -0,0 +1,255 @@
+/*
+ * Git replace refs and grafts as topology overrides
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Git lets a repository pretend a commit has parents other than the
+// ones it was made with, either by a replacement commit under
+// refs/replace/ (what "git replace --graft" makes) or by a line in
+// the older .git/info/grafts file.  Both are local: they aren't part
+// of the history, don't travel in a fast-export stream, and git
+// fast-export quietly applies them, losing the real parent links.
+//
+// When reading a git repository reposurgeon exports the history as
+// it really is and records each replacement or graft as a topology
+// override on the commit, the parents git shows in place of its own.
+// Only the parent links of a replacement commit are kept, which is
+// all a graft changes.  Overrides can be baked into real parent
+// links, keeping each commit's tree; those left alone are written
+// back as replace refs when the repository is rebuilt as git.
+
+// An override is a commit and the parents git shows for it instead
+// of its own.  origin says where it was found.
+type override struct {
+	commit  *Commit
+	parents []*Commit
+	origin  string
+}
+
+// gitGraftFile is where git looks for old-style grafts.
+const gitGraftFile = ".git/info/grafts"
+
+// readGitOverrides records the replace refs and grafts of the git
+// repository in the current directory as overrides on the commits
+// they apply to.  Those naming commits not in the repository are
+// skipped with a warning.
+func (repo *Repository) readGitOverrides() error {
+	index := repo.hashIndex()
+	add := func(origin string, hash string, parents []string) {
+		commit, ok := index[hash]
+		if !ok {
+			if logEnable(logWARN) {
+				logit("%s names %s, which is not a commit of this repository", origin, hash)
+			}
+			return
+		}
+		g := &override{commit: commit, parents: make([]*Commit, 0, len(parents)), origin: origin}
+		for _, hash := range parents {
+			parent, ok := index[hash]
+			if !ok {
+				if logEnable(logWARN) {
+					logit("%s gives %s the parent %s, which is not a commit of this repository", origin, commit.idMe(), hash)
+				}
+				return
+			}
+			g.parents = append(g.parents, parent)
+		}
+		repo.overrides = append(repo.overrides, g)
+	}
+
+	refs, err := captureFromProcess("git for-each-ref --format='%(refname) %(objecttype) %(objectname)' refs/replace/", control.baton)
+	if err != nil {
+		return fmt.Errorf("while listing replace refs: %v", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(refs), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[1] != "commit" {
+			if logEnable(logWARN) {
+				logit("%s replaces a %s, which reposurgeon can't represent", fields[0], fields[1])
+			}
+			continue
+		}
+		content, err := captureFromProcess("git --no-replace-objects cat-file commit "+fields[2], control.baton)
+		if err != nil {
+			return fmt.Errorf("while reading %s: %v", fields[0], err)
+		}
+		parents := make([]string, 0)
+		for _, header := range strings.Split(content, "\n") {
+			if header == "" {
+				break
+			}
+			if strings.HasPrefix(header, "parent ") {
+				parents = append(parents, strings.TrimPrefix(header, "parent "))
+			}
+		}
+		add(fields[0], strings.TrimPrefix(fields[0], "refs/replace/"), parents)
+	}
+
+	if exists(gitGraftFile) {
+		fp, err := os.Open(gitGraftFile)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		scanner := bufio.NewScanner(fp)
+		for lineno := 1; scanner.Scan(); lineno++ {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			add(fmt.Sprintf("%s:%d", gitGraftFile, lineno), fields[0], fields[1:])
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// liveOverrides returns the overrides that still apply, forgetting those
+// whose commit or a parent has been deleted.
+func (repo *Repository) liveOverrides() []*override {
+	live := repo.overrides[:0]
+	for _, g := range repo.overrides {
+		ok := g.commit.repo == repo
+		for _, parent := range g.parents {
+			ok = ok && parent.repo == repo
+		}
+		if ok {
+			live = append(live, g)
+		} else if logEnable(logWARN) {
+			logit("dropping the override from %s, as a commit it names has been deleted", g.origin)
+		}
+	}
+	repo.overrides = live
+	return live
+}
+
+// overridesOf returns the overrides on the selected commits.
+func (repo *Repository) overridesOf(selection selectionSet) []*override {
+	selected := make(map[*Commit]bool)
+	for _, commit := range repo.commits(selection) {
+		selected[commit] = true
+	}
+	found := make([]*override, 0)
+	for _, g := range repo.liveOverrides() {
+		if selected[g.commit] {
+			found = append(found, g)
+		}
+	}
+	return found
+}
+
+// bakeOverrides makes the overrides on the selected commits real parent
+// links and forgets them.  Each commit keeps its tree.  An override
+// that would make a commit its own ancestor is left in place with a
+// warning.  Changed commits get Q bits.  Returns the number baked.
+func (repo *Repository) bakeOverrides(selection selectionSet) int {
+	repo.clearColor(colorQSET)
+	bake := make(map[*override]bool)
+	for _, g := range repo.overridesOf(selection) {
+		bake[g] = true
+	}
+	baked, resort := 0, false
+	kept := make([]*override, 0)
+	for _, g := range repo.overrides {
+		if !bake[g] {
+			kept = append(kept, g)
+			continue
+		}
+		parents := make([]CommitLike, len(g.parents))
+		cycle := false
+		for i, parent := range g.parents {
+			parents[i] = parent
+			cycle = cycle || parent == g.commit || parent.descendedFrom(g.commit)
+		}
+		if cycle {
+			if logEnable(logWARN) {
+				logit("the override from %s would make %s its own ancestor", g.origin, g.commit.idMe())
+			}
+			kept = append(kept, g)
+			continue
+		}
+		// Recreate the state of the tree, which the new first
+		// parent would otherwise change
+		f := newFileOp(repo)
+		f.construct(deleteall)
+		newops := []*FileOp{f}
+		g.commit.manifest().iter(func(path string, pentry interface{}) {
+			entry := pentry.(*FileOp)
+			f = newFileOp(repo)
+			f.construct(opM, entry.mode, entry.ref, path)
+			if entry.ref == "inline" {
+				f.inline = entry.inline
+			}
+			newops = append(newops, f)
+		})
+		g.commit.setOperations(newops)
+		g.commit.simplify()
+		for _, parent := range g.parents {
+			resort = resort || repo.eventToIndex(parent) > repo.eventToIndex(g.commit)
+		}
+		g.commit.setParents(parents)
+		g.commit.addColor(colorQSET)
+		baked++
+	}
+	repo.overrides = kept
+	if resort {
+		repo.resort()
+	}
+	return baked
+}
+
+// emitGitOverrides turns the overrides back into replace refs in the git
+// repository just rebuilt in the current directory, using the marks
+// file the importer wrote.
+func (repo *Repository) emitGitOverrides() error {
+	overrides := repo.liveOverrides()
+	if len(overrides) == 0 {
+		return nil
+	}
+	fp, err := os.Open(".git/marks")
+	if err != nil {
+		return fmt.Errorf("overrides can't be written without the marks file: %v", err)
+	}
+	defer fp.Close()
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 {
+			hashes[fields[0]] = fields[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, g := range overrides {
+		command := "git replace --force --graft " + hashes[g.commit.mark]
+		for _, parent := range g.parents {
+			command += " " + hashes[parent.mark]
+		}
+		if strings.Contains(command, "  ") || strings.HasSuffix(command, " ") {
+			return fmt.Errorf("the marks file doesn't cover the override from %s", g.origin)
+		}
+		if err := runProcess(command, "writing replace refs"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// end
@@ -0,0 +1,520 @@
+/*
+ * Applying patches as new commits
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The patches command carries changes out of a repository being
+// edited; this carries them in.  A fix that was never committed
+// upstream, or one mailed to a list, often belongs in the history being
+// rebuilt, and there is no working tree to apply it in.  So the patch
+// is applied to content taken from the manifest of the commit it goes
+// onto, and each patch becomes a commit with a blob for every file it
+// changes.
+//
+// Input is either a mailbox as git format-patch writes it, a message
+// to a patch, or a plain unified diff.  Messages give the author, the
+// date and the comment; a plain diff gets the invoking user and a date
+// just after its parent's.  Hunks must apply exactly, though they may
+// have moved, as patch allows; there's no fuzz, since a hunk that
+// applies wrongly would be buried in history where nobody will notice.
+// Binary patches can't be applied.
+
+// mboxFromRE matches the line that begins each message of a mailbox
+// made by git format-patch.
+var mboxFromRE = regexp.MustCompile(`^From [0-9a-f]{40} `)
+
+// patchPrefixRE matches the tag format-patch puts before a subject.
+var patchPrefixRE = regexp.MustCompile(`^\[[^\]]*PATCH[^\]]*\]\s*`)
+
+// hunkHeaderRE matches the header of a hunk.
+var hunkHeaderRE = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// patchHunk is a hunk of a unified diff.  Its lines keep their prefix
+// character and their newline, which is missing where a file ends
+// without one.
+type patchHunk struct {
+	oldStart int
+	oldLines int
+	lines    []string
+}
+
+// side returns the lines a hunk expects to find, or those it leaves.
+func (hunk *patchHunk) side(leaves bool) []string {
+	drop := byte('+')
+	if leaves {
+		drop = '-'
+	}
+	text := make([]string, 0, len(hunk.lines))
+	for _, line := range hunk.lines {
+		if line[0] != drop {
+			text = append(text, line[1:])
+		}
+	}
+	return text
+}
+
+// filePatch is the change a diff makes to one file.  A path is empty
+// where the diff has /dev/null.
+type filePatch struct {
+	oldPath string
+	newPath string
+	oldMode string
+	newMode string
+	copied  bool
+	binary  bool
+	hunks   []*patchHunk
+}
+
+// mailPatch is a patch with what its message says about it.  A plain
+// diff has no author.
+type mailPatch struct {
+	author  *Attribution
+	comment string
+	files   []*filePatch
+}
+
+// diffPath strips the prefix from a path named in a diff, as patch -p1
+// does, or returns the empty string for /dev/null.
+func diffPath(name string) string {
+	if tab := strings.IndexByte(name, '\t'); tab >= 0 {
+		name = name[:tab]
+	}
+	name = strings.TrimSpace(name)
+	if name == "/dev/null" {
+		return ""
+	}
+	if slash := strings.IndexByte(name, '/'); slash >= 0 {
+		return name[slash+1:]
+	}
+	return name
+}
+
+// gitDiffPaths gets the paths from a diff --git line, which are
+// needed when a change has no hunks to name them.
+func gitDiffPaths(rest string) (string, string) {
+	if n := (len(rest) - 1) / 2; len(rest)%2 == 1 && rest[n] == ' ' && diffPath(rest[:n]) == diffPath(rest[n+1:]) {
+		return diffPath(rest[:n]), diffPath(rest[n+1:])
+	}
+	if i := strings.LastIndex(rest, " b/"); i >= 0 {
+		return diffPath(rest[:i]), diffPath(rest[i+1:])
+	}
+	return "", ""
+}
+
+// parseDiff parses the file changes in the text of a diff, skipping
+// anything that isn't one, such as a diffstat or a signature.
+func parseDiff(lines []string) ([]*filePatch, error) {
+	files := make([]*filePatch, 0)
+	var current *filePatch
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r\n")
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			current = new(filePatch)
+			current.oldPath, current.newPath = gitDiffPaths(line[len("diff --git "):])
+			files = append(files, current)
+		case current != nil && strings.HasPrefix(line, "new file mode "):
+			current.oldPath, current.newMode = "", line[len("new file mode "):]
+		case current != nil && strings.HasPrefix(line, "deleted file mode "):
+			current.newPath, current.oldMode = "", line[len("deleted file mode "):]
+		case current != nil && strings.HasPrefix(line, "old mode "):
+			current.oldMode = line[len("old mode "):]
+		case current != nil && strings.HasPrefix(line, "new mode "):
+			current.newMode = line[len("new mode "):]
+		case current != nil && (strings.HasPrefix(line, "rename from ") || strings.HasPrefix(line, "copy from ")):
+			current.oldPath = line[strings.Index(line, " from ")+len(" from "):]
+			current.copied = strings.HasPrefix(line, "copy ")
+		case current != nil && (strings.HasPrefix(line, "rename to ") || strings.HasPrefix(line, "copy to ")):
+			current.newPath = line[strings.Index(line, " to ")+len(" to "):]
+		case current != nil && (strings.HasPrefix(line, "Binary files ") || line == "GIT binary patch"):
+			current.binary = true
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			oldPath, newPath := diffPath(line[4:]), diffPath(strings.TrimRight(lines[i+1], "\r\n")[4:])
+			if current == nil || len(current.hunks) > 0 {
+				// A plain diff has no header line before this,
+				// and can't rename, so where the names differ
+				// the second is the file, as in diff -u foo.orig
+				// foo.
+				current = new(filePatch)
+				files = append(files, current)
+				if oldPath != "" && newPath != "" {
+					oldPath = newPath
+				}
+			}
+			current.oldPath, current.newPath = oldPath, newPath
+			i++
+		case current != nil && strings.HasPrefix(line, "@@ "):
+			m := hunkHeaderRE.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("malformed hunk header %q", line)
+			}
+			count := func(s string) int {
+				if s == "" {
+					return 1
+				}
+				n, _ := strconv.Atoi(s)
+				return n
+			}
+			hunk := &patchHunk{oldLines: count(m[2])}
+			hunk.oldStart, _ = strconv.Atoi(m[1])
+			oldLeft, newLeft := hunk.oldLines, count(m[4])
+			for oldLeft > 0 || newLeft > 0 {
+				i++
+				if i >= len(lines) {
+					return nil, fmt.Errorf("hunk %q is cut short", line)
+				}
+				text := lines[i]
+				if text == "\n" || text == "\r\n" {
+					// Mailers can strip the space from an empty
+					// context line.
+					text = " " + text
+				}
+				switch text[0] {
+				case ' ':
+					oldLeft--
+					newLeft--
+				case '-':
+					oldLeft--
+				case '+':
+					newLeft--
+				default:
+					return nil, fmt.Errorf("hunk %q is cut short", line)
+				}
+				if oldLeft < 0 || newLeft < 0 {
+					return nil, fmt.Errorf("hunk %q is longer than its header says", line)
+				}
+				hunk.lines = append(hunk.lines, text)
+				if i+1 < len(lines) && strings.HasPrefix(lines[i+1], `\ `) {
+					last := len(hunk.lines) - 1
+					hunk.lines[last] = strings.TrimSuffix(hunk.lines[last], "\n")
+					i++
+				}
+			}
+			current.hunks = append(current.hunks, hunk)
+		}
+	}
+	for _, file := range files {
+		if file.oldPath == "" && file.newPath == "" {
+			return nil, errors.New("a file change names no path")
+		}
+	}
+	return files, nil
+}
+
+// parseMailPatch parses a format-patch message into a patch.
+func parseMailPatch(text string) (*mailPatch, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("bad From header: %v", err)
+	}
+	when, err := msg.Header.Date()
+	if err != nil {
+		return nil, fmt.Errorf("bad Date header: %v", err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	subject = patchPrefixRE.ReplaceAllString(strings.TrimSpace(subject), "")
+	content, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	body := len(lines)
+	for i, line := range lines {
+		if strings.TrimRight(line, "\r\n") == "---" || strings.HasPrefix(line, "diff --git ") ||
+			strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ ") {
+			body = i
+			break
+		}
+	}
+	patch := new(mailPatch)
+	patch.author, _ = newAttribution("")
+	patch.author.fullname, patch.author.email = from.Name, from.Address
+	if patch.author.fullname == "" {
+		patch.author.fullname = from.Address
+	}
+	patch.author.date.timestamp = when
+	patch.comment = subject + "\n"
+	if rest := strings.TrimSpace(strings.Join(lines[:body], "")); rest != "" {
+		patch.comment += "\n" + rest + "\n"
+	}
+	if patch.files, err = parseDiff(lines[body:]); err != nil {
+		return nil, fmt.Errorf("in %q: %v", subject, err)
+	}
+	return patch, nil
+}
+
+// parsePatches parses a mailbox of patches, or a plain diff, whose
+// comment is whatever comes before the first file change.
+func parsePatches(text string) ([]*mailPatch, error) {
+	lines := strings.SplitAfter(text, "\n")
+	starts := make([]int, 0)
+	for i, line := range lines {
+		if mboxFromRE.MatchString(line) {
+			starts = append(starts, i)
+		}
+	}
+	patches := make([]*mailPatch, 0, len(starts))
+	if len(starts) == 0 {
+		files, err := parseDiff(lines)
+		if err != nil {
+			return nil, err
+		}
+		patch := &mailPatch{files: files}
+		for i, line := range lines {
+			if strings.HasPrefix(line, "diff ") || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "Index: ") {
+				if preamble := strings.TrimSpace(strings.Join(lines[:i], "")); preamble != "" {
+					patch.comment = preamble + "\n"
+				}
+				break
+			}
+		}
+		patches = append(patches, patch)
+	}
+	for n, start := range starts {
+		end := len(lines)
+		if n+1 < len(starts) {
+			end = starts[n+1]
+		}
+		patch, err := parseMailPatch(strings.Join(lines[start+1:end], ""))
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, patch)
+	}
+	for _, patch := range patches {
+		if len(patch.files) == 0 {
+			return nil, errors.New("a patch changes no files")
+		}
+	}
+	return patches, nil
+}
+
+// applyHunks applies the hunks of a file change to content.
+func applyHunks(path string, content []byte, hunks []*patchHunk) ([]byte, error) {
+	lines, _ := patchLines(content)
+	result := make([]string, 0, len(lines))
+	cursor, offset := 0, 0
+	for n, hunk := range hunks {
+		old := hunk.side(false)
+		want := hunk.oldStart - 1 + offset
+		if hunk.oldLines == 0 {
+			want++
+		}
+		matches := func(at int) bool {
+			if at < cursor || at+len(old) > len(lines) {
+				return false
+			}
+			for i, line := range old {
+				if lines[at+i] != line {
+					return false
+				}
+			}
+			return true
+		}
+		at := -1
+		for delta := 0; at < 0 && (want-delta >= cursor || want+delta <= len(lines)); delta++ {
+			if matches(want - delta) {
+				at = want - delta
+			} else if matches(want + delta) {
+				at = want + delta
+			}
+		}
+		if at < 0 {
+			return nil, fmt.Errorf("hunk %d of %s doesn't apply", n+1, path)
+		}
+		offset = at - (hunk.oldStart - 1)
+		if hunk.oldLines == 0 {
+			offset--
+		}
+		result = append(result, lines[cursor:at]...)
+		result = append(result, hunk.side(true)...)
+		cursor = at + len(old)
+	}
+	result = append(result, lines[cursor:]...)
+	return []byte(strings.Join(result, "")), nil
+}
+
+// patchedFile is a file as the patches applied so far leave it.  Its
+// ref is that of the blob it came from, until its content changes.
+type patchedFile struct {
+	mode    string
+	ref     string
+	content []byte
+}
+
+// patchTree tracks the tree that patches are applied to, starting from
+// a commit's manifest.
+type patchTree struct {
+	repo     *Repository
+	manifest *Manifest
+	files    map[string]*patchedFile // nil for deleted
+}
+
+// get returns a file of the tree, or nil if it isn't there.
+func (tree *patchTree) get(path string) *patchedFile {
+	if file, ok := tree.files[path]; ok {
+		return file
+	}
+	entry, ok := tree.manifest.get(path)
+	if !ok {
+		return nil
+	}
+	fileop := entry.(*FileOp)
+	if fileop.mode == gitlinkMode {
+		return &patchedFile{mode: fileop.mode, ref: fileop.ref}
+	}
+	file := &patchedFile{mode: fileop.mode, ref: fileop.ref, content: tree.repo.modeContent(fileop)}
+	if fileop.ref == "inline" {
+		file.ref = ""
+	}
+	return file
+}
+
+// apply applies a patch to the tree, returning the files it leaves
+// changed, nil for deletions, in the order the patch names them.
+func (tree *patchTree) apply(patch *mailPatch) ([]string, map[string]*patchedFile, error) {
+	paths := make([]string, 0)
+	changed := make(map[string]*patchedFile)
+	set := func(path string, file *patchedFile) {
+		if _, ok := changed[path]; !ok {
+			paths = append(paths, path)
+		}
+		changed[path] = file
+		tree.files[path] = file
+	}
+	for _, fp := range patch.files {
+		name := fp.newPath
+		if name == "" {
+			name = fp.oldPath
+		}
+		if fp.binary {
+			return nil, nil, fmt.Errorf("the binary change to %s can't be applied", name)
+		}
+		var old *patchedFile
+		if fp.oldPath != "" {
+			if old = tree.get(fp.oldPath); old == nil {
+				return nil, nil, fmt.Errorf("%s is not in the tree", fp.oldPath)
+			}
+			if old.mode == gitlinkMode {
+				return nil, nil, fmt.Errorf("%s is a submodule", fp.oldPath)
+			}
+		} else if tree.get(fp.newPath) != nil {
+			return nil, nil, fmt.Errorf("%s is already in the tree", fp.newPath)
+		}
+		if fp.newPath == "" {
+			set(fp.oldPath, nil)
+			continue
+		}
+		file := &patchedFile{mode: "100644"}
+		if old != nil {
+			file.mode, file.ref, file.content = old.mode, old.ref, old.content
+		}
+		if fp.newMode != "" {
+			file.mode = fp.newMode
+		}
+		if len(fp.hunks) > 0 {
+			content, err := applyHunks(name, file.content, fp.hunks)
+			if err != nil {
+				return nil, nil, err
+			}
+			file.ref, file.content = "", content
+		}
+		if fp.oldPath != "" && fp.oldPath != fp.newPath && !fp.copied {
+			set(fp.oldPath, nil)
+		}
+		set(fp.newPath, file)
+	}
+	return paths, changed, nil
+}
+
+// applyPatches makes commits of patches, on top of a commit.  The
+// commits go on the named branch, or on the branch of the commit they
+// go onto if that is empty; in that case the commit must be the
+// branch's tip.  Returns the commits made, which get Q bits.  Nothing
+// is changed if an error is returned.
+func (repo *Repository) applyPatches(patches []*mailPatch, onto *Commit, branch string) ([]*Commit, error) {
+	if branch == "" {
+		if repo.branchtipmap()[onto.Branch] != onto {
+			return nil, fmt.Errorf("%s is not the tip of %s; name a branch for the commits", onto.idMe(), onto.Branch)
+		}
+		branch = onto.Branch
+	}
+	// Apply everything before anything is made, so a patch that
+	// fails leaves the repository as it was.
+	tree := &patchTree{repo: repo, manifest: onto.manifest(), files: make(map[string]*patchedFile)}
+	paths := make([][]string, len(patches))
+	changes := make([]map[string]*patchedFile, len(patches))
+	for i, patch := range patches {
+		var err error
+		if paths[i], changes[i], err = tree.apply(patch); err != nil {
+			return nil, fmt.Errorf("patch %d: %v", i+1, err)
+		}
+	}
+	repo.clearColor(colorQSET)
+	made := make([]*Commit, 0, len(patches))
+	parent := onto
+	for i, patch := range patches {
+		ops := make([]*FileOp, 0, len(paths[i]))
+		for _, path := range paths[i] {
+			file := changes[i][path]
+			if file == nil {
+				ops = append(ops, newFileOp(repo).construct(opD, path))
+				continue
+			}
+			if file.ref == "" {
+				blob := newBlob(repo)
+				blob.mark = repo.freshMark() // Not in the event list yet
+				blob.setContent(file.content, noOffset)
+				repo.addEvent(blob)
+				file.ref = blob.mark
+			}
+			ops = append(ops, newFileOp(repo).construct(opM, file.mode, file.ref, path))
+		}
+		commit := newCommit(repo)
+		attr, _ := newAttribution("")
+		commit.committer = *attr
+		commit.committer.fullname, commit.committer.email = whoami()
+		if patch.author != nil {
+			commit.authors = append(commit.authors, *patch.author)
+			commit.committer.date = patch.author.date.clone()
+		} else {
+			commit.committer.date.timestamp = parent.committer.date.timestamp.Add(time.Second)
+		}
+		commit.Comment = patch.comment
+		commit.Branch = branch
+		commit.mark = repo.freshMark()
+		commit.setOperations(ops)
+		commit.setParents([]CommitLike{parent})
+		repo.addEvent(commit)
+		commit.addColor(colorQSET)
+		made = append(made, commit)
+		parent = commit
+	}
+	repo.declareSequenceMutation("")
+	return made, nil
+}
+
+// end
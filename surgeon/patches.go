@@ -0,0 +1,260 @@
+/*
+ * Rendering commits as patches in the format of git format-patch
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	difflib "github.com/ianbruene/go-difflib/difflib"
+)
+
+// A change found in the middle of a conversion often needs to be looked
+// at by someone who won't read a stream, or carried to another
+// repository that can't import one: a fix to be upstreamed, a commit
+// lost from a branch.  Git's answer is format-patch, a mailbox message
+// per commit with the author, date and comment in its headers and the
+// change as a diff that "git am" applies.  This renders commits the
+// same way, taking content from their manifests and their first
+// parents', so nothing is checked out.
+//
+// Unlike the diff command's output, these diffs are meant to apply, so
+// they follow git's conventions exactly: a/ and b/ prefixes, mode
+// lines, index lines with blob hashes, and a marker where a file ends
+// without a newline.  Binary changes are only noted, as git does
+// without --binary, and merges are skipped, as git skips them.
+
+// patchSignature ends each patch, as git ends them with its version.
+const patchSignature = "-- \nreposurgeon\n\n"
+
+// Characters that don't survive into a patch file name
+var patchSlugRE = regexp.MustCompile(`[^A-Za-z0-9_.]+`)
+
+// patchSlug makes the part of a patch file name from a summary line,
+// as git does.
+func patchSlug(summary string) string {
+	slug := strings.Trim(patchSlugRE.ReplaceAllString(summary, "-"), "-.")
+	if len(slug) > 52 {
+		slug = strings.TrimRight(slug[:52], "-.")
+	}
+	return slug
+}
+
+// mailHeader encodes a header value as RFC 2047 if it isn't ASCII.
+func mailHeader(value string) string {
+	for _, r := range value {
+		if r >= 0x80 {
+			return mime.QEncoding.Encode("UTF-8", value)
+		}
+	}
+	return value
+}
+
+// patchLines splits content into lines, keeping their newlines, and
+// tells whether the last one lacks one.
+func patchLines(content []byte) ([]string, bool) {
+	if len(content) == 0 {
+		return nil, false
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1], false
+	}
+	return lines, true
+}
+
+// hunkRange formats one side of a hunk header.
+func hunkRange(start, stop int) string {
+	length := stop - start
+	switch length {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+// writeHunks writes the unified diff of two texts, three lines of
+// context to a hunk.
+func writeHunks(w io.Writer, from []byte, to []byte) {
+	a, aPartial := patchLines(from)
+	b, bPartial := patchLines(to)
+	line := func(prefix string, text string, partial bool) {
+		fmt.Fprint(w, prefix+text)
+		if partial {
+			fmt.Fprint(w, "\n\\ No newline at end of file\n")
+		}
+	}
+	matcher := difflib.NewMatcherWithJunk(a, b, false, nil)
+	for _, group := range matcher.GetGroupedOpCodes(3) {
+		first, last := group[0], group[len(group)-1]
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(first.I1, last.I2), hunkRange(first.J1, last.J2))
+		for _, code := range group {
+			if code.Tag == 'e' {
+				// Equal lines end alike, so a missing newline
+				// is missing on both sides.
+				for i := code.I1; i < code.I2; i++ {
+					line(" ", a[i], aPartial && i == len(a)-1)
+				}
+				continue
+			}
+			if code.Tag == 'r' || code.Tag == 'd' {
+				for i := code.I1; i < code.I2; i++ {
+					line("-", a[i], aPartial && i == len(a)-1)
+				}
+			}
+			if code.Tag == 'r' || code.Tag == 'i' {
+				for j := code.J1; j < code.J2; j++ {
+					line("+", b[j], bPartial && j == len(b)-1)
+				}
+			}
+		}
+	}
+}
+
+// entryContent returns the content of a manifest entry, which for a
+// submodule is what git shows of it.
+func (repo *Repository) entryContent(entry *FileOp) []byte {
+	if entry == nil {
+		return nil
+	}
+	if entry.mode == "160000" {
+		return []byte("Subproject commit " + entry.ref + "\n")
+	}
+	return repo.modeContent(entry)
+}
+
+// entryHash returns the abbreviated hash git would give the content of
+// a manifest entry.
+func (repo *Repository) entryHash(entry *FileOp) string {
+	if entry == nil {
+		return "0000000"
+	}
+	if entry.mode == "160000" {
+		return entry.ref[:min(7, len(entry.ref))]
+	}
+	if blob, ok := repo.markToEvent(entry.ref).(*Blob); ok {
+		return blob.gitHash().hexify()[:7]
+	}
+	content := repo.modeContent(entry)
+	return gitHashString(fmt.Sprintf("blob %d\x00", len(content)) + string(content)).hexify()[:7]
+}
+
+// writeFilePatch writes the diff of one path between two manifest
+// entries, either of which may be nil.
+func (repo *Repository) writeFilePatch(w io.Writer, path string, from *FileOp, to *FileOp) {
+	fmt.Fprintf(w, "diff --git a/%s b/%s\n", path, path)
+	fromName, toName := "a/"+path, "b/"+path
+	mode := ""
+	switch {
+	case from == nil:
+		fmt.Fprintf(w, "new file mode %s\n", to.mode)
+		fromName = "/dev/null"
+	case to == nil:
+		fmt.Fprintf(w, "deleted file mode %s\n", from.mode)
+		toName = "/dev/null"
+	case from.mode != to.mode:
+		fmt.Fprintf(w, "old mode %s\nnew mode %s\n", from.mode, to.mode)
+	default:
+		mode = " " + to.mode
+	}
+	fromText, toText := repo.entryContent(from), repo.entryContent(to)
+	if from != nil && to != nil && bytes.Equal(fromText, toText) {
+		return
+	}
+	fmt.Fprintf(w, "index %s..%s%s\n", repo.entryHash(from), repo.entryHash(to), mode)
+	if classifyContent(fromText).binary || classifyContent(toText).binary {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", fromName, toName)
+		return
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", fromName, toName)
+	writeHunks(w, fromText, toText)
+}
+
+// writePatch writes a commit as a mailbox message, numbered n of total
+// (or unnumbered if total is 1), with the change from its first parent.
+func (repo *Repository) writePatch(w io.Writer, commit *Commit, n int, total int) {
+	author := commit.committer
+	if len(commit.authors) > 0 {
+		author = commit.authors[0]
+	}
+	summary, body := splitRuneFirst(strings.TrimSpace(commit.Comment), '\n')
+	prefix := "[PATCH]"
+	if total > 1 {
+		prefix = fmt.Sprintf("[PATCH %d/%d]", n, total)
+	}
+	fmt.Fprintf(w, "From %s Mon Sep 17 00:00:00 2001\n", commit.gitHash().hexify())
+	fmt.Fprintf(w, "From: %s <%s>\n", mailHeader(author.fullname), author.email)
+	fmt.Fprintf(w, "Date: %s\n", author.date.timestamp.Format(time.RFC1123Z))
+	fmt.Fprintf(w, "Subject: %s\n\n", mailHeader(prefix+" "+summary))
+	if strings.TrimSpace(body) != "" {
+		fmt.Fprintf(w, "%s\n", strings.TrimSpace(body))
+	}
+	fmt.Fprint(w, "---\n\n")
+	var parent *Commit
+	if commit.hasParents() {
+		parent, _ = commit.firstParent().(*Commit)
+	}
+	before, after := manifestEntries(parent), manifestEntries(commit)
+	changes := manifestChanges(before, after)
+	paths := make([]string, 0, len(changes))
+	for path := range changes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		repo.writeFilePatch(w, path, before[path], changes[path])
+	}
+	fmt.Fprint(w, patchSignature)
+}
+
+// writePatches renders the selected commits other than merges as
+// patches, either to one mailbox or, if dir is not empty, to a file
+// each in that directory named as git names them.  Returns the number
+// of patches written.
+func (repo *Repository) writePatches(w io.Writer, selection selectionSet, dir string) (int, error) {
+	commits := make([]*Commit, 0)
+	for _, commit := range repo.commits(selection) {
+		if len(commit.parents()) <= 1 {
+			commits = append(commits, commit)
+		}
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, userReadWriteSearchMode); err != nil {
+			return 0, err
+		}
+	}
+	for i, commit := range commits {
+		if dir == "" {
+			repo.writePatch(w, commit, i+1, len(commits))
+			continue
+		}
+		summary, _ := splitRuneFirst(strings.TrimSpace(commit.Comment), '\n')
+		name := filepath.Join(dir, fmt.Sprintf("%04d-%s.patch", i+1, patchSlug(summary)))
+		fp, err := os.Create(name)
+		if err != nil {
+			return i, err
+		}
+		repo.writePatch(fp, commit, i+1, len(commits))
+		if err := fp.Close(); err != nil {
+			return i, err
+		}
+	}
+	return len(commits), nil
+}
+
+// end
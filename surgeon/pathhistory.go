@@ -0,0 +1,140 @@
+/*
+ * History of a single path
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Before expunging a file it is worth knowing where it has been: which
+// commits created it, changed it, moved it and removed it, under
+// whatever names it had.  Names are found by following renames and
+// copies backwards from the path asked about, so the history covers
+// the file's earlier lives.  Whether a modification created the file
+// or changed it, and whether a deletion found anything to delete, is
+// read from the manifests of the commit and its first parent.
+
+// pathChange is one commit's effect on a path.  Action is "added",
+// "modified", "renamed", "copied" or "deleted"; source is the name a
+// renamed or copied file had before, and path the name after.
+type pathChange struct {
+	commit *Commit
+	action string
+	path   string
+	source string
+}
+
+// underPath tells whether a path is a directory or the path itself,
+// returning the rest of the path below it.
+func underPath(path string, dir string) (string, bool) {
+	if path == dir {
+		return "", true
+	}
+	if strings.HasPrefix(path, dir+"/") {
+		return path[len(dir):], true
+	}
+	return "", false
+}
+
+// pathNames returns every name a path had, following renames and
+// copies backwards through the repository, in sorted order.
+func (repo *Repository) pathNames(path string) []string {
+	names := map[string]bool{path: true}
+	for i := len(repo.events) - 1; i >= 0; i-- {
+		commit, ok := repo.events[i].(*Commit)
+		if !ok {
+			continue
+		}
+		for _, op := range commit.operations() {
+			if op.op != opR && op.op != opC {
+				continue
+			}
+			for name := range names {
+				if rest, ok := underPath(name, op.Path); ok {
+					names[op.Source+rest] = true
+				}
+			}
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// pathHistory returns, in commit order, the changes the selected
+// commits made to a path under any of its names.
+func (repo *Repository) pathHistory(path string, selection selectionSet) []pathChange {
+	names := repo.pathNames(path)
+	named := make(map[string]bool, len(names))
+	for _, name := range names {
+		named[name] = true
+	}
+	changes := make([]pathChange, 0)
+	repo.walkManifests(func(idx int, commit *Commit, _ int, parent *Commit) {
+		if !selection.Contains(idx) {
+			return
+		}
+		had := func(name string) bool {
+			if parent == nil {
+				return false
+			}
+			_, ok := parent.manifest().get(name)
+			return ok
+		}
+		// A deleteall usually comes with modifications putting most
+		// of the tree back, which aren't deletions
+		gone := func(name string) bool {
+			_, ok := commit.manifest().get(name)
+			return had(name) && !ok
+		}
+		for _, op := range commit.operations() {
+			switch op.op {
+			case opM:
+				if named[op.Path] {
+					action := "modified"
+					if !had(op.Path) {
+						action = "added"
+					}
+					changes = append(changes, pathChange{commit, action, op.Path, ""})
+				}
+			case opR, opC:
+				action := "renamed"
+				if op.op == opC {
+					action = "copied"
+				}
+				for _, name := range names {
+					if rest, ok := underPath(name, op.Path); ok && had(op.Source+rest) {
+						changes = append(changes, pathChange{commit, action, name, op.Source + rest})
+					} else if rest, ok := underPath(name, op.Source); ok && had(name) && !named[op.Path+rest] {
+						// Moved away to a name it never had before
+						changes = append(changes, pathChange{commit, action, op.Path + rest, name})
+					}
+				}
+			case opD:
+				for _, name := range names {
+					if _, ok := underPath(name, op.Path); ok && gone(name) {
+						changes = append(changes, pathChange{commit, "deleted", name, ""})
+					}
+				}
+			case deleteall:
+				for _, name := range names {
+					if gone(name) {
+						changes = append(changes, pathChange{commit, "deleted", name, ""})
+					}
+				}
+			}
+		}
+	})
+	return changes
+}
+
+// end
@@ -0,0 +1,111 @@
+/*
+ * Removal of phantom file lifetimes left by CVS conversions
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// CVS records a file first added on a branch as a dead 1.1 revision on
+// trunk, and files added in error were often removed again in the very
+// next commit.  Converters faithfully turn these into deletes of files
+// that never existed, or into a file that lives for exactly one commit.
+// Neither is history anyone wants to see, so removePhantoms finds and
+// drops them:
+//
+// - a D of a path not visible through any parent of its commit;
+//
+// - an M creating a path in a commit whose only child deletes it, when
+//   nothing else in either commit touches the path.
+
+type phantom struct {
+	commit *Commit
+	op     *FileOp
+}
+
+// findPhantoms returns the fileops to drop, in event order, and the
+// count of phantoms they make up, writing a line for each to w.
+func (repo *Repository) findPhantoms(selection selectionSet, w io.Writer) ([]phantom, int) {
+	doomed := make([]phantom, 0)
+	found := 0
+	touches := func(commit *Commit, path string) []*FileOp {
+		ops := make([]*FileOp, 0)
+		for _, op := range commit.operations() {
+			if op.Path == path || ((op.op == opR || op.op == opC) && op.Source == path) {
+				ops = append(ops, op)
+			}
+		}
+		return ops
+	}
+	for _, commit := range repo.commits(selection) {
+		for _, op := range commit.operations() {
+			if op.op != opD {
+				continue
+			}
+			if !commit.visibleInParents(op.Path) {
+				fmt.Fprintf(w, "%s: deletion of never-existing %s\n", commit.idMe(), op.Path)
+				doomed = append(doomed, phantom{commit, op})
+				found++
+				continue
+			}
+			if commit.parentCount() != 1 || len(touches(commit, op.Path)) != 1 {
+				continue
+			}
+			parent, ok := commit.firstParent().(*Commit)
+			if !ok || parent.childCount() != 1 || !selection.Contains(repo.eventToIndex(parent)) {
+				continue
+			}
+			ops := touches(parent, op.Path)
+			if len(ops) != 1 || ops[0].op != opM || parent.visibleInParents(op.Path) {
+				continue
+			}
+			fmt.Fprintf(w, "%s: %s added and deleted in %s\n", parent.idMe(), op.Path, commit.idMe())
+			doomed = append(doomed, phantom{parent, ops[0]}, phantom{commit, op})
+			found++
+		}
+	}
+	return doomed, found
+}
+
+// removePhantoms drops phantom fileops in the selection, as found by
+// findPhantoms, and any blobs left unreferenced.  Returns the count of
+// phantoms removed and of commits left with no fileops.
+func (repo *Repository) removePhantoms(selection selectionSet, w io.Writer) (int, int) {
+	doomed, found := repo.findPhantoms(selection, w)
+	repo.clearColor(colorQSET)
+	if len(doomed) == 0 {
+		return 0, 0
+	}
+	drop := make(map[*FileOp]bool)
+	commits := make([]*Commit, 0)
+	for _, p := range doomed {
+		drop[p.op] = true
+		if !p.commit.hasColor(colorQSET) {
+			p.commit.addColor(colorQSET)
+			commits = append(commits, p.commit)
+		}
+	}
+	emptied := 0
+	for _, commit := range commits {
+		kept := make([]*FileOp, 0)
+		for _, op := range commit.operations() {
+			if !drop[op] {
+				kept = append(kept, op)
+			}
+		}
+		commit.setOperations(kept)
+		if len(kept) == 0 {
+			emptied++
+		}
+	}
+	repo.scavenge("phantom removal")
+	return found, emptied
+}
+
+// end
@@ -0,0 +1,147 @@
+/*
+ * Checking a repository against what a target VCS can import
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Streams can carry things not every importer accepts: several
+// authors on a commit, commit properties, notes, text that isn't
+// UTF-8.  Some importers choke on these at the end of a long rebuild,
+// after the staging directory has been made and partly filled; others
+// quietly drop them.  This pass looks for them before anything on disk
+// is touched, going by the extensions and style flags of the target
+// VCS, so the fatal ones can be fixed first and the lossy ones known
+// about.
+
+// preflightProblem is one kind of construct a target can't take,
+// with the events that use it.
+type preflightProblem struct {
+	what   string
+	fatal  bool
+	hint   string
+	events []string
+}
+
+// preflightSample is how many events of each kind are named in a report.
+const preflightSample = 5
+
+func (p *preflightProblem) String() string {
+	sample := p.events
+	if len(sample) > preflightSample {
+		sample = sample[:preflightSample]
+	}
+	text := fmt.Sprintf("%s (%d): %s", p.what, len(p.events), strings.Join(sample, " "))
+	if len(p.events) > len(sample) {
+		text += " ..."
+	}
+	if p.hint != "" {
+		text += " (" + p.hint + ")"
+	}
+	return text
+}
+
+// maxRefComponent is the longest a component of a ref name can be and
+// still be a file name on common filesystems.
+const maxRefComponent = 255
+
+// preflight returns what in the repository a VCS can't import, fatal
+// problems first.
+func (repo *Repository) preflight(vcs *VCS) []*preflightProblem {
+	authors := &preflightProblem{what: "commits with multiple authors", fatal: true,
+		hint: fmt.Sprintf("%s keeps one; see \"help coauthors\"", vcs.name)}
+	notes := &preflightProblem{what: "commits with notes", fatal: true}
+	encoding := &preflightProblem{what: "events with text that is not UTF-8", fatal: true}
+	refs := &preflightProblem{what: "refs with a component over 255 bytes", fatal: true}
+	properties := &preflightProblem{what: "commits with properties",
+		hint: fmt.Sprintf("%s can't store them, so they will be dropped", vcs.name)}
+	overrides := &preflightProblem{what: "commits with topology overrides",
+		hint: fmt.Sprintf("%s has no replace refs; see \"help overrides\"", vcs.name)}
+	if vcs.name != "git" {
+		for _, g := range repo.liveOverrides() {
+			overrides.events = append(overrides.events, g.commit.idMe())
+		}
+	}
+	utf8only := vcs.styleflags.Contains("utf8-only")
+	for _, event := range repo.events {
+		switch e := event.(type) {
+		case *Commit:
+			if len(e.authors) > 1 && !vcs.extensions.Contains("multiple-authors") {
+				authors.events = append(authors.events, e.idMe())
+			}
+			if e.hasProperties() && len(e.properties.keys) > 0 && !vcs.extensions.Contains("commit-properties") {
+				properties.events = append(properties.events, e.idMe())
+			}
+			if !vcs.extensions.Contains("notes") {
+				for _, op := range e.operations() {
+					if op.op == opN {
+						notes.events = append(notes.events, e.idMe())
+						break
+					}
+				}
+			}
+			if utf8only {
+				valid := utf8.ValidString(e.Comment) && utf8.ValidString(e.committer.fullname)
+				for _, author := range e.authors {
+					valid = valid && utf8.ValidString(author.fullname)
+				}
+				if !valid {
+					encoding.events = append(encoding.events, e.idMe())
+				}
+			}
+		case *Tag:
+			if utf8only && !(utf8.ValidString(e.Comment) && utf8.ValidString(e.tagger.fullname)) {
+				encoding.events = append(encoding.events, e.idMe())
+			}
+		}
+	}
+	for _, name := range repo.refNames() {
+		for _, component := range strings.Split(name, "/") {
+			if len(component) > maxRefComponent {
+				refs.events = append(refs.events, name)
+				break
+			}
+		}
+	}
+	problems := make([]*preflightProblem, 0)
+	for _, p := range []*preflightProblem{authors, notes, encoding, refs, properties, overrides} {
+		if len(p.events) > 0 {
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// preflightError checks the repository against a VCS, warning about
+// what will be lost and returning an error describing what can't be
+// imported at all, or nil if there is nothing.
+func (repo *Repository) preflightError(vcs *VCS) error {
+	fatal := make([]string, 0)
+	for _, p := range repo.preflight(vcs) {
+		if p.fatal {
+			fatal = append(fatal, p.String())
+		} else if logEnable(logWARN) {
+			logit("%s", p.String())
+		}
+	}
+	if vcs.name == "git" {
+		if err := repo.gitRefError(); err != nil {
+			fatal = append(fatal, err.Error())
+		}
+	}
+	if len(fatal) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s can't import this repository:\n  %s",
+		vcs.name, strings.Join(fatal, "\n  "))
+}
+
+// end
@@ -0,0 +1,123 @@
+/*
+ * Bulk editing of commit properties
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"regexp"
+)
+
+// Commit properties come from Subversion revision properties and from
+// the property extension of fast-import streams (bzr and cvs-fast-export
+// emit them).  A conversion often wants to change them wholesale: drop
+// every svn:mergeinfo, rename a key some tool invented, or carry a
+// file's content into a property before writing a dump.  A propertyEdit
+// describes one such change, to be applied to every commit in a
+// selection.
+
+type propertyEdit struct {
+	verb    string         // set, delete, rename, or rewrite
+	keyRE   *regexp.Regexp // keys to operate on; unused by set
+	valueRE *regexp.Regexp // values to operate on; nil matches any
+	name    string         // set: key to set; rename: replacement key
+	value   string         // set: new value; rewrite: replacement value
+	path    string         // set: take the value from this file instead
+}
+
+// matches reports whether a property is one the edit operates on.
+func (pe *propertyEdit) matches(key string, value string) bool {
+	return pe.keyRE.MatchString(key) && (pe.valueRE == nil || pe.valueRE.MatchString(value))
+}
+
+// apply performs the edit on one commit's properties, returning the
+// edited properties (nil if none are left) and the number of
+// properties changed.
+func (pe *propertyEdit) apply(commit *Commit) (*OrderedMap, int) {
+	var props OrderedMap
+	if commit.hasProperties() {
+		props = *copyOrderedMap(commit.properties)
+	} else {
+		props = newOrderedMap()
+	}
+	changed := 0
+	switch pe.verb {
+	case "set":
+		value := pe.value
+		if pe.path != "" {
+			content, ok := commit.blobByName(pe.path)
+			if !ok {
+				break
+			}
+			value = string(content)
+		}
+		if !props.has(pe.name) || props.get(pe.name) != value {
+			props.set(pe.name, value)
+			changed++
+		}
+	case "delete":
+		for _, key := range append([]string{}, props.keys...) {
+			if pe.matches(key, props.get(key)) {
+				props.delete(key)
+				changed++
+			}
+		}
+	case "rename":
+		// Keys keep their places.  A renamed property replaces any
+		// existing one of the same name.
+		renamed := newOrderedMap()
+		taken := newStringSet()
+		for _, key := range props.keys {
+			if newkey := GoReplacer(pe.keyRE, key, pe.name); newkey != key {
+				taken.Add(newkey)
+				changed++
+			}
+		}
+		for _, key := range props.keys {
+			newkey := GoReplacer(pe.keyRE, key, pe.name)
+			if newkey == key && taken.Contains(key) {
+				continue
+			}
+			renamed.set(newkey, props.get(key))
+		}
+		props = renamed
+	case "rewrite":
+		for _, key := range props.keys {
+			value := props.get(key)
+			if pe.keyRE.MatchString(key) && pe.valueRE.MatchString(value) {
+				if newvalue := GoReplacer(pe.valueRE, value, pe.value); newvalue != value {
+					props.set(key, newvalue)
+					changed++
+				}
+			}
+		}
+	}
+	if props.Len() == 0 {
+		return nil, changed
+	}
+	return &props, changed
+}
+
+// editProperties applies a property edit to the commits in a
+// selection, setting Q bits on those changed.  Returns the number of
+// properties and of commits changed.
+func (repo *Repository) editProperties(selection selectionSet, edit *propertyEdit) (int, int) {
+	properties, commits := 0, 0
+	repo.clearColor(colorQSET)
+	for it := repo.commitIterator(selection); it.Next(); {
+		commit := it.commit()
+		props, changed := edit.apply(commit)
+		if changed > 0 {
+			commit.properties = props
+			commit.addColor(colorQSET)
+			properties += changed
+			commits++
+		}
+	}
+	return properties, commits
+}
+
+// end
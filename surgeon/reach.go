@@ -0,0 +1,226 @@
+/*
+ * Reachability index over the commit graph
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"sort"
+)
+
+// A reachIndex answers "is v reachable from u" and "everything
+// reachable from u" without walking the graph.  It uses interval
+// labeling: a depth-first search numbers commits in postorder, so the
+// subtree of a spanning-tree node is one contiguous run of numbers.
+// Each commit then carries a sorted list of disjoint intervals covering
+// everything it reaches, which is its own subtree plus whatever its
+// non-tree edges lead to.  On typical version-control histories, which
+// are long chains with occasional merges, the lists stay short and
+// adjacent intervals coalesce, so a membership test is a binary search
+// over a handful of entries and a closure is a few slice copies.
+//
+// There are two indexes, one following children (descendants) and one
+// following parents (ancestors).  Both are built on demand and thrown
+// away whenever the topology changes.
+
+type reachInterval struct {
+	lo, hi int32 // inclusive postorder numbers
+}
+
+type reachIndex struct {
+	commits []*Commit // by postorder number
+	post    map[*Commit]int32
+	cover   [][]reachInterval // by postorder number
+}
+
+const (
+	reachDescendants = iota
+	reachAncestors
+)
+
+func reachStep(direction int) func(*Commit) []CommitLike {
+	if direction == reachDescendants {
+		return func(c *Commit) []CommitLike { return c.children() }
+	}
+	return func(c *Commit) []CommitLike { return c.parents() }
+}
+
+// newReachIndex builds an index over commits.  Any order gives a
+// correct index, but topological order in the direction of travel
+// starts the search at roots and so yields the largest tree subtrees
+// and the shortest interval lists.
+func newReachIndex(commits []*Commit, step func(*Commit) []CommitLike) *reachIndex {
+	n := len(commits)
+	ri := &reachIndex{
+		commits: make([]*Commit, 0, n),
+		post:    make(map[*Commit]int32, n),
+		cover:   make([][]reachInterval, n),
+	}
+	low := make([]int32, n)
+	visited := make(map[*Commit]bool, n)
+	type frame struct {
+		commit *Commit
+		next   []CommitLike
+		low    int32
+	}
+	// Iterative, since histories can be far deeper than the stack
+	for _, root := range commits {
+		if visited[root] {
+			continue
+		}
+		visited[root] = true
+		stack := []frame{{root, step(root), int32(len(ri.commits))}}
+		for len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if len(top.next) > 0 {
+				c, ok := top.next[0].(*Commit)
+				top.next = top.next[1:]
+				if ok && !visited[c] {
+					visited[c] = true
+					stack = append(stack, frame{c, step(c), int32(len(ri.commits))})
+				}
+				continue
+			}
+			p := int32(len(ri.commits))
+			ri.post[top.commit] = p
+			ri.commits = append(ri.commits, top.commit)
+			low[p] = top.low
+			stack = stack[:len(stack)-1]
+		}
+	}
+	// In a DAG everything a commit reaches is finished before it is,
+	// so covers can be computed in postorder.
+	for p, commit := range ri.commits {
+		intervals := []reachInterval{{low[p], int32(p)}}
+		for _, x := range step(commit) {
+			if c, ok := x.(*Commit); ok {
+				intervals = append(intervals, ri.cover[ri.post[c]]...)
+			}
+		}
+		ri.cover[p] = coalesceIntervals(intervals)
+	}
+	return ri
+}
+
+// coalesceIntervals sorts intervals and merges overlapping or adjacent ones.
+func coalesceIntervals(intervals []reachInterval) []reachInterval {
+	if len(intervals) <= 1 {
+		return intervals
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].lo < intervals[j].lo })
+	out := make([]reachInterval, 0, len(intervals))
+	cur := intervals[0]
+	for _, iv := range intervals[1:] {
+		if iv.lo <= cur.hi+1 {
+			if iv.hi > cur.hi {
+				cur.hi = iv.hi
+			}
+		} else {
+			out = append(out, cur)
+			cur = iv
+		}
+	}
+	return append(out, cur)
+}
+
+// reaches tells whether to is reachable from from.  A commit reaches
+// itself.
+func (ri *reachIndex) reaches(from *Commit, to *Commit) bool {
+	pf, ok1 := ri.post[from]
+	pt, ok2 := ri.post[to]
+	if !ok1 || !ok2 {
+		return false
+	}
+	cover := ri.cover[pf]
+	i := sort.Search(len(cover), func(i int) bool { return cover[i].hi >= pt })
+	return i < len(cover) && cover[i].lo <= pt
+}
+
+// closure returns all commits reachable from any of the given ones,
+// including themselves.
+func (ri *reachIndex) closure(from []*Commit) []*Commit {
+	intervals := make([]reachInterval, 0)
+	for _, c := range from {
+		if p, ok := ri.post[c]; ok {
+			intervals = append(intervals, ri.cover[p]...)
+		}
+	}
+	out := make([]*Commit, 0)
+	for _, iv := range coalesceIntervals(intervals) {
+		out = append(out, ri.commits[iv.lo:iv.hi+1]...)
+	}
+	return out
+}
+
+// reachable returns the selection plus every commit reachable from a
+// commit in it in the given direction.
+func (repo *Repository) reachable(selection selectionSet, direction int) selectionSet {
+	result := newSelectionSet(selection.Values()...)
+	commits := repo.commits(selection)
+	if len(commits) == 0 {
+		return result
+	}
+	ri := repo.reachability(direction)
+	for _, c := range commits {
+		// A commit added without any change to parent links
+		if _, ok := ri.post[c]; !ok {
+			repo.invalidateReachability()
+			ri = repo.reachability(direction)
+			break
+		}
+	}
+	reached := make(map[*Commit]bool)
+	for _, c := range ri.closure(commits) {
+		reached[c] = true
+	}
+	// Report them breadth-first from the selection, as a walk of the
+	// graph would find them.
+	step := reachStep(direction)
+	queue := commits
+	for len(queue) != 0 {
+		popped := queue[0]
+		queue = queue[1:]
+		for _, x := range step(popped) {
+			c, ok := x.(*Commit)
+			if !ok || !reached[c] {
+				continue
+			}
+			delete(reached, c)
+			ind := repo.eventToIndex(c)
+			if !result.Contains(ind) {
+				result.Add(ind)
+				queue = append(queue, c)
+			}
+		}
+	}
+	return result
+}
+
+// reachability returns the repository's index for the given direction,
+// building it if need be.
+func (repo *Repository) reachability(direction int) *reachIndex {
+	if repo._reach[direction] == nil {
+		commits := repo.commits(undefinedSelectionSet)
+		if direction == reachAncestors {
+			for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
+				commits[i], commits[j] = commits[j], commits[i]
+			}
+		}
+		repo._reach[direction] = newReachIndex(commits, reachStep(direction))
+	}
+	return repo._reach[direction]
+}
+
+// invalidateReachability discards the reachability indexes.  Must be
+// called on any change to parent/child links or to the set of commits.
+func (repo *Repository) invalidateReachability() {
+	if repo != nil {
+		repo._reach[reachDescendants] = nil
+		repo._reach[reachAncestors] = nil
+	}
+}
+
+// end
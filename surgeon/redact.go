@@ -0,0 +1,121 @@
+/*
+ * Redaction of file content, leaving tombstones in its place
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Deleting a path removes it from history altogether, which is right
+// for debris but wrong for a file that belonged there and merely held
+// something it shouldn't have: a leaked key, a document under a
+// takedown notice.  Deletion changes the shape of every tree the file
+// was in, and later commits that touch it can go wrong.  Redaction
+// keeps every fileop where it was and replaces only the content, with
+// a tombstone saying what was there, so the trees keep their shape and
+// anyone who finds the tombstone can tell what it stands for.
+
+// redactTemplate is the default text of a tombstone.
+const redactTemplate = "This file was redacted.\nOriginal blob: {hash}\nOriginal size: {size} bytes\n"
+
+// tombstone expands a tombstone template for content of a given blob
+// hash and size.
+func tombstone(template string, hash string, size int64) []byte {
+	return []byte(strings.NewReplacer("{hash}", hash, "{size}", fmt.Sprint(size)).Replace(template))
+}
+
+// redact replaces the content of files modified by the selected commits
+// that match a pattern with tombstones.  If byContent is true the
+// pattern is matched against content, otherwise against paths.  Each
+// redacted blob gets one tombstone blob, put before the first commit
+// using it, so a blob shared with files that don't match is left alone
+// for them; blobs with no references left are removed.  Submodule
+// links are never touched.  Altered commits get Q bits.  Returns the
+// number of fileops redacted.
+func (repo *Repository) redact(selection selectionSet, pattern *regexp.Regexp, byContent bool, template string, baton *Baton) int {
+	repo.clearColor(colorQSET)
+	matches := make(map[string]bool)
+	tombstones := make(map[string]*Blob)
+	inserts := make(map[*Commit][]Event)
+	orphans := make(map[*Blob]bool)
+	commits := repo.commits(selection)
+	redacted := 0
+	baton.startProgress("redacting", uint64(len(commits)))
+	for i, commit := range commits {
+		altered := false
+		for _, fileop := range commit.operations() {
+			if fileop.op != opM || fileop.mode == "160000" {
+				continue
+			}
+			if fileop.ref == "inline" {
+				if byContent && !pattern.Match(fileop.inline) || !byContent && !pattern.MatchString(fileop.Path) {
+					continue
+				}
+				hash := gitHashString(fmt.Sprintf("blob %d\x00", len(fileop.inline)) + string(fileop.inline))
+				fileop.inline = tombstone(template, hash.hexify(), int64(len(fileop.inline)))
+				altered = true
+				redacted++
+				continue
+			}
+			blob, ok := repo.markToEvent(fileop.ref).(*Blob)
+			if !ok {
+				continue
+			}
+			if byContent {
+				match, seen := matches[blob.mark]
+				if !seen {
+					match = pattern.Match(blob.getContent())
+					matches[blob.mark] = match
+				}
+				if !match {
+					continue
+				}
+			} else if !pattern.MatchString(fileop.Path) {
+				continue
+			}
+			fresh, ok := tombstones[blob.mark]
+			if !ok {
+				fresh = newBlob(repo)
+				fresh.mark = repo.newmark()
+				fresh.setContent(tombstone(template, blob.gitHash().hexify(), blob.size), noOffset)
+				tombstones[blob.mark] = fresh
+				inserts[commit] = append(inserts[commit], fresh)
+			}
+			if !blob.removeOperation(fileop) {
+				orphans[blob] = true
+			}
+			fileop.ref = fresh.mark
+			fresh.appendOperation(fileop)
+			altered = true
+			redacted++
+		}
+		if altered {
+			commit.invalidateManifests()
+			commit.addColor(colorQSET)
+		}
+		baton.percentProgress(uint64(i) + 1)
+	}
+	baton.endProgress()
+	if len(inserts) > 0 {
+		events := make([]Event, 0, len(repo.events)+len(tombstones))
+		for _, event := range repo.events {
+			if commit, ok := event.(*Commit); ok {
+				events = append(events, inserts[commit]...)
+			}
+			events = append(events, event)
+		}
+		repo.events = events
+		repo.declareSequenceMutation("redaction")
+	}
+	repo.dropBlobs(orphans)
+	return redacted
+}
+
+// end
@@ -0,0 +1,374 @@
+/*
+ * Ref naming policy: bulk renaming, collision handling, validity checks
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Ref names arrive from every exporter in whatever shape it likes:
+// remote-tracking branches under refs/remotes, tags without their
+// refs/ prefix, names that were fine in Subversion but that git will
+// refuse.  Unite and uniquify add collisions of their own.  Most of
+// these problems otherwise surface as an importer failure at the end
+// of a long rebuild.
+//
+// A ref policy is a small script of rules applied to every ref name in
+// the repository at once - commit branches, reset refs, and annotated
+// tags, which are treated as refs/tags/NAME:
+//
+//	map PATTERN REPLACEMENT    rewrite names matching a regexp
+//	sanitize                   repair names git would reject
+//	collisions {fail|suffix}   what to do when names collide
+//
+// Map rules are applied in order, each to the result of the last.
+// The whole renaming is worked out before any of it is done, so a
+// policy that would produce a collision changes nothing unless told
+// to resolve collisions by suffixing.
+
+type refMap struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+type refPolicy struct {
+	maps     []refMap
+	sanitize bool
+	suffix   bool // resolve collisions by suffixing rather than failing
+}
+
+// parseRefPolicy reads policy rules.  Blank lines and lines beginning
+// with # are ignored.
+func parseRefPolicy(r io.Reader) (*refPolicy, error) {
+	policy := new(refPolicy)
+	scanner := bufio.NewScanner(r)
+	linecount := 0
+	for scanner.Scan() {
+		linecount++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch {
+		case fields[0] == "map" && len(fields) == 3:
+			re, err := regexp.Compile(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("bad pattern in ref policy line %d: %v", linecount, err)
+			}
+			policy.maps = append(policy.maps, refMap{re, fields[2]})
+		case fields[0] == "sanitize" && len(fields) == 1:
+			policy.sanitize = true
+		case fields[0] == "collisions" && len(fields) == 2 && (fields[1] == "fail" || fields[1] == "suffix"):
+			policy.suffix = fields[1] == "suffix"
+		default:
+			return nil, fmt.Errorf("bad line syntax in ref policy: line %d %q", linecount, line)
+		}
+	}
+	return policy, scanner.Err()
+}
+
+// gitRefProblem says what, if anything, makes a ref name unacceptable
+// to git, following the rules of git check-ref-format.
+func gitRefProblem(ref string) string {
+	if ref == "@" {
+		return "is \"@\""
+	}
+	if strings.HasSuffix(ref, "/") || strings.HasSuffix(ref, ".") {
+		return "ends with a slash or dot"
+	}
+	for _, bad := range []string{"..", "@{", "//"} {
+		if strings.Contains(ref, bad) {
+			return fmt.Sprintf("contains %q", bad)
+		}
+	}
+	for _, c := range ref {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return fmt.Sprintf("contains %q", c)
+		}
+	}
+	for _, component := range strings.Split(ref, "/") {
+		if strings.HasPrefix(component, ".") {
+			return "has a component beginning with a dot"
+		}
+		if strings.HasSuffix(component, ".lock") {
+			return "has a component ending with .lock"
+		}
+	}
+	return ""
+}
+
+var refBadChars = regexp.MustCompile(`[\x00-\x20\x7f~^:?*\[\\]+`)
+
+// sanitizeRef repairs a ref name so git will accept it.
+func sanitizeRef(ref string) string {
+	ref = refBadChars.ReplaceAllString(ref, "_")
+	ref = strings.ReplaceAll(ref, "@{", "@_")
+	for strings.Contains(ref, "..") || strings.Contains(ref, "//") {
+		ref = strings.ReplaceAll(ref, "..", ".")
+		ref = strings.ReplaceAll(ref, "//", "/")
+	}
+	components := strings.Split(strings.TrimRight(ref, "/."), "/")
+	for i, component := range components {
+		if strings.HasPrefix(component, ".") {
+			component = "_" + component[1:]
+		}
+		if strings.HasSuffix(component, ".lock") {
+			component = strings.TrimSuffix(component, ".lock") + "_lock"
+		}
+		components[i] = component
+	}
+	ref = strings.Join(components, "/")
+	if ref == "@" || ref == "" {
+		ref = "_"
+	}
+	return ref
+}
+
+// refNames returns every ref name in the repository, sorted.
+func (repo *Repository) refNames() []string {
+	names := newOrderedStringSet()
+	for _, event := range repo.events {
+		switch e := event.(type) {
+		case *Commit:
+			names.Add(e.Branch)
+		case *Reset:
+			names.Add(e.ref)
+		case *Tag:
+			names.Add("refs/tags/" + e.tagname)
+		}
+	}
+	sort.Strings(names)
+	return []string(names)
+}
+
+type refProblem struct {
+	ref     string
+	problem string
+	fatal   bool // git would refuse the ref, so a rebuild would fail
+}
+
+// refConflicts finds pairs of names that can't coexist.  A ref that is
+// also a directory of others can't be stored by git at all.  Names
+// differing only in case collide on case-insensitive filesystems, and
+// a branch and tag with the same short name make that name ambiguous.
+// Names must be sorted.
+func refConflicts(names []string) []refProblem {
+	problems := make([]refProblem, 0)
+	folded := make(map[string]string)
+	short := make(map[string]string)
+	for i, name := range names {
+		for _, other := range names[i+1:] {
+			if !strings.HasPrefix(other, name) {
+				break
+			}
+			if other[len(name)] == '/' {
+				problems = append(problems, refProblem{name, "is also a directory of " + other, true})
+				break
+			}
+		}
+		if prior, ok := folded[strings.ToLower(name)]; ok {
+			problems = append(problems, refProblem{name, "differs only in case from " + prior, false})
+		} else {
+			folded[strings.ToLower(name)] = name
+		}
+		for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+			if strings.HasPrefix(name, prefix) {
+				s := strings.TrimPrefix(name, prefix)
+				if prior, ok := short[s]; ok {
+					problems = append(problems, refProblem{name, "has the same short name as " + prior, false})
+				} else {
+					short[s] = name
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// checkRefs reports every ref name git would refuse or that conflicts
+// with another.
+func (repo *Repository) checkRefs() []refProblem {
+	names := repo.refNames()
+	problems := make([]refProblem, 0)
+	for _, name := range names {
+		if p := gitRefProblem(name); p != "" {
+			problems = append(problems, refProblem{name, p, true})
+		} else if !strings.HasPrefix(name, "refs/") {
+			problems = append(problems, refProblem{name, "is not under refs/", false})
+		}
+	}
+	problems = append(problems, refConflicts(names)...)
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].ref < problems[j].ref })
+	return problems
+}
+
+// gitRefError returns an error describing the refs git would refuse,
+// or nil if there are none.
+func (repo *Repository) gitRefError() error {
+	fatal := make([]string, 0)
+	for _, p := range repo.checkRefs() {
+		if p.fatal {
+			fatal = append(fatal, p.ref+" "+p.problem)
+		}
+	}
+	if len(fatal) == 0 {
+		return nil
+	}
+	return fmt.Errorf("git would refuse these refs (see \"help refpolicy\"):\n  %s",
+		strings.Join(fatal, "\n  "))
+}
+
+// planRefPolicy works out the renaming a policy calls for, as a map
+// from old names to new ones covering only the names that change.
+func (repo *Repository) planRefPolicy(policy *refPolicy) (map[string]string, error) {
+	names := repo.refNames()
+	renames := make(map[string]string)
+	for _, name := range names {
+		newname := name
+		for _, m := range policy.maps {
+			if m.pattern.MatchString(newname) {
+				newname = GoReplacer(m.pattern, newname, m.replacement)
+			}
+		}
+		if policy.sanitize {
+			newname = sanitizeRef(newname)
+		}
+		renames[name] = newname
+	}
+	// Annotated tags can't leave the tag namespace
+	for _, event := range repo.events {
+		if tag, ok := event.(*Tag); ok {
+			name := "refs/tags/" + tag.tagname
+			if !strings.HasPrefix(renames[name], "refs/tags/") {
+				return nil, fmt.Errorf("policy would move annotated tag %s to %s", name, renames[name])
+			}
+		}
+	}
+	// Names taken, in the order claimed: refs keeping their names
+	// first, then renamed ones in order of their old names.  A suffix
+	// never lands on a name some ref is headed for.
+	taken := make(map[string]string)
+	wanted := make(map[string]bool)
+	for _, newname := range renames {
+		wanted[newname] = true
+	}
+	suffixed := func(name string) string {
+		for n := 2; ; n++ {
+			candidate := fmt.Sprintf("%s-%d", name, n)
+			if _, ok := taken[candidate]; !ok && !wanted[candidate] {
+				return candidate
+			}
+		}
+	}
+	final := make(map[string]string)
+	collisions := make([]string, 0)
+	claim := func(name string) {
+		newname := renames[name]
+		if owner, ok := taken[newname]; ok {
+			if !policy.suffix {
+				collisions = append(collisions, fmt.Sprintf("%s and %s would both be %s", owner, name, newname))
+				return
+			}
+			newname = suffixed(newname)
+		}
+		taken[newname] = name
+		final[name] = newname
+	}
+	for _, name := range names {
+		if renames[name] == name {
+			claim(name)
+		}
+	}
+	for _, name := range names {
+		if renames[name] != name {
+			claim(name)
+		}
+	}
+	if len(collisions) > 0 {
+		return nil, errors.New(strings.Join(collisions, "; "))
+	}
+	// Refs that would be directories of other refs
+	result := make([]string, 0, len(final))
+	for _, newname := range final {
+		result = append(result, newname)
+	}
+	sort.Strings(result)
+	for _, p := range refConflicts(result) {
+		if !p.fatal {
+			continue
+		}
+		if !policy.suffix {
+			collisions = append(collisions, fmt.Sprintf("%s %s", p.ref, p.problem))
+			continue
+		}
+		old := taken[p.ref]
+		if old != p.ref {
+			candidate := suffixed(p.ref)
+			taken[candidate] = old
+			final[old] = candidate
+			continue
+		}
+		// A ref keeping its name has first claim, so move the
+		// renamed refs beneath it to a suffixed directory.
+		dir := ""
+		for _, newname := range result {
+			if owner := taken[newname]; strings.HasPrefix(newname, p.ref+"/") && owner != newname {
+				if dir == "" {
+					dir = suffixed(p.ref)
+				}
+				candidate := dir + strings.TrimPrefix(newname, p.ref)
+				taken[candidate] = owner
+				final[owner] = candidate
+			}
+		}
+		if dir == "" {
+			candidate := suffixed(p.ref)
+			taken[candidate] = old
+			final[old] = candidate
+		}
+	}
+	if len(collisions) > 0 {
+		return nil, errors.New(strings.Join(collisions, "; "))
+	}
+	for old, newname := range final {
+		if old == newname {
+			delete(final, old)
+		}
+	}
+	return final, nil
+}
+
+// renameRefs applies a renaming to commits, resets and tags.
+func (repo *Repository) renameRefs(renames map[string]string) {
+	for _, event := range repo.events {
+		switch e := event.(type) {
+		case *Commit:
+			if newname, ok := renames[e.Branch]; ok {
+				e.setBranch(newname)
+			}
+		case *Reset:
+			if newname, ok := renames[e.ref]; ok {
+				e.ref = newname
+			}
+		case *Tag:
+			if newname, ok := renames["refs/tags/"+e.tagname]; ok {
+				e.tagname = strings.TrimPrefix(newname, "refs/tags/")
+			}
+		}
+	}
+	repo.invalidateNamecache()
+}
+
+// end
@@ -0,0 +1,101 @@
+/*
+ * Preview of the tree changes a reparent would make
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A commit inherits its tree from its first parent, so changing that
+// parent changes what the commit's fileops apply to.  Unless the tree
+// is pinned with a deleteall, as reparent does by default, a file the
+// old parent had and the new one doesn't, or has with other content,
+// silently takes on a different meaning in the commit and in every
+// descendant inheriting from it, down to the first that starts over
+// with a deleteall of its own.  That can be worked out without
+// changing anything, by replaying each affected commit's fileops on
+// the tree its first parent would have.
+
+// reparentPreview reports, without changing anything, the paths whose
+// content would differ in a commit and its descendants if the commit
+// were given a new parent list.  With pinned true the commit keeps its
+// tree, as a reparent without --rebase arranges, so nothing differs.
+// Commits whose trees would change get Q bits.  Returns the number of
+// commits affected.
+func (repo *Repository) reparentPreview(w io.Writer, child *Commit, parents []CommitLike, pinned bool) int {
+	repo.clearColor(colorQSET)
+	replay := func(commit *Commit, inherited *Manifest) *Manifest {
+		pm := inherited.snapshot()
+		commit.applyFileOps(pm, false, false)
+		return pmToManifest(pm)
+	}
+	cutsTies := func(commit *Commit) bool {
+		return len(commit.fileops) > 0 && commit.fileops[0].op == deleteall
+	}
+	if pinned || cutsTies(child) {
+		fmt.Fprintf(w, "no commits would change\n")
+		return 0
+	}
+	inherited := newManifest()
+	if len(parents) > 0 {
+		parent, ok := parents[0].(*Commit)
+		if !ok {
+			croak("can't preview a reparent onto a callout")
+			return 0
+		}
+		inherited = parent.manifest()
+	}
+	// Descendants follow their ancestors in event order, so one pass
+	// over the events after the commit sees each first parent's new
+	// tree before its children need it.
+	after := map[*Commit]*Manifest{child: replay(child, inherited)}
+	affected := 0
+	report := func(commit *Commit) {
+		before := manifestMap(commit.manifest())
+		changes := manifestChanges(before, manifestMap(after[commit]))
+		if len(changes) == 0 {
+			return
+		}
+		commit.addColor(colorQSET)
+		affected++
+		fmt.Fprintf(w, "%s:\n", commit.idMe())
+		paths := make([]string, 0, len(changes))
+		for path := range changes {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			how := "changes"
+			if _, ok := before[path]; !ok {
+				how = "appears"
+			} else if changes[path] == nil {
+				how = "vanishes"
+			}
+			fmt.Fprintf(w, "\t%s (%s)\n", path, how)
+		}
+	}
+	report(child)
+	for _, event := range repo.events[repo.eventToIndex(child)+1:] {
+		commit, ok := event.(*Commit)
+		if !ok || !commit.hasParents() || cutsTies(commit) {
+			continue
+		}
+		parent, ok := commit.firstParent().(*Commit)
+		if !ok || after[parent] == nil {
+			continue
+		}
+		after[commit] = replay(commit, after[parent])
+		report(commit)
+	}
+	fmt.Fprintf(w, "%d commits would change\n", affected)
+	return affected
+}
+
+// end
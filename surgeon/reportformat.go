@@ -0,0 +1,89 @@
+/*
+ * CSV and JSON serializations of the list reports
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The commits, tags and stamps listings are columnated for people and
+// truncated to the screen width, which makes them awkward to feed to
+// anything else.  With a "csv" or "json" modifier the report methods
+// emit each event as a record instead: a CSV row under a header line,
+// or a JSON object on a line of its own.  Records are never truncated.
+
+// Fields of the records made by the report methods, in column order
+var (
+	listerFields = []string{"event", "date", "mark", "hash", "legacy", "summary"}
+	tagsFields   = []string{"event", "type", "name"}
+	stampFields  = []string{"stamp", "summary"}
+)
+
+// reportFormat returns the serialization chosen by a set of report
+// modifiers, or "" for the columnated text.
+func reportFormat(modifiers orderedStringSet) string {
+	for _, format := range []string{"csv", "json"} {
+		if modifiers.Contains(format) {
+			return format
+		}
+	}
+	return ""
+}
+
+// reportHeader returns the line that goes before a serialized report
+// with the given fields, or "" if there is none.
+func reportHeader(modifiers orderedStringSet, fields []string) string {
+	if reportFormat(modifiers) != "csv" {
+		return ""
+	}
+	return reportRecord(modifiers, fields, stringsToValues(fields))
+}
+
+func stringsToValues(s []string) []interface{} {
+	values := make([]interface{}, len(s))
+	for i, v := range s {
+		values[i] = v
+	}
+	return values
+}
+
+// reportRecord serializes one record of a report.  The values go with
+// the fields in order.
+func reportRecord(modifiers orderedStringSet, fields []string, values []interface{}) string {
+	var b strings.Builder
+	switch reportFormat(modifiers) {
+	case "csv":
+		row := make([]string, len(values))
+		for i, v := range values {
+			row[i] = fmt.Sprint(v)
+		}
+		w := csv.NewWriter(&b)
+		w.Write(row)
+		w.Flush()
+		return strings.TrimSuffix(b.String(), "\n")
+	case "json":
+		b.WriteString("{")
+		for i, field := range fields {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			value, err := json.Marshal(values[i])
+			if err != nil {
+				panic(fmt.Errorf("in reportRecord: %v", err))
+			}
+			fmt.Fprintf(&b, "%q: %s", field, value)
+		}
+		b.WriteString("}")
+	}
+	return b.String()
+}
+
+// end
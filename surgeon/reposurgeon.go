@@ -9,7 +9,6 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -37,7 +36,6 @@ import (
 	"unicode/utf8"
 	"unsafe" // Actually safe - only uses Sizeof
 
-	difflib "github.com/ianbruene/go-difflib/difflib"
 	terminfo "github.com/xo/terminfo"
 	kommandant "gitlab.com/ianbruene/kommandant"
 	term "golang.org/x/term"
@@ -56,13 +54,18 @@ type Control struct {
 	signals    chan os.Signal
 	logmutex   sync.Mutex
 	// The abort flag
-	abortScript  bool
-	abortLock    sync.Mutex
+	abortScript bool
+	abortLock   sync.Mutex
+	// Cancelled on SIGINT, so long operations can stop cleanly
+	interrupt    context.Context
+	cancel       context.CancelFunc
 	listOptions  map[string]orderedStringSet
 	profileNames map[string]string
 	startTime    time.Time
 	baton        *Baton
 	GCPercent    int
+	warnings     warningRegistry
+	progressFd   int // Descriptor for machine-readable progress, or -1
 }
 
 func (ctx *Control) isInteractive() bool {
@@ -72,6 +75,10 @@ func (ctx *Control) isInteractive() bool {
 func (ctx *Control) init() {
 	ctx.flagOptions = make(map[string]bool)
 	ctx.listOptions = make(map[string]orderedStringSet)
+	ctx.placeholders = make(map[string]string)
+	for k, v := range defaultPlaceholders {
+		ctx.placeholders[k] = v
+	}
 	ctx.signals = make(chan os.Signal, 1)
 	ctx.logmask = (logWARN << 1) - 1
 	batonLogFunc := func(s string) {
@@ -84,16 +91,21 @@ func (ctx *Control) init() {
 	baton := newBaton(control.isInteractive(), batonLogFunc)
 	ctx.logfp = baton
 	ctx.baton = baton
+	ctx.resetInterrupt()
 	signal.Notify(control.signals, os.Interrupt)
 	go func() {
 		for {
 			<-control.signals
 			control.setAbort(true)
+			control.abortLock.Lock()
+			control.cancel()
+			control.abortLock.Unlock()
 		}
 	}()
 	ctx.startTime = time.Now()
 	control.lineSep = "\n"
 	control.GCPercent = 100 // Golang's starting value
+	control.progressFd = -1
 }
 
 var control Control
@@ -110,6 +122,26 @@ func (ctx *Control) setAbort(cond bool) {
 	ctx.abortScript = cond
 }
 
+// interruptible returns a context that is cancelled if the user
+// interrupts the current command.  Unlike the abort flag, which any
+// croak sets, it means only that; long passes check it between units
+// of work and stop where the repository is still consistent.
+func (ctx *Control) interruptible() context.Context {
+	ctx.abortLock.Lock()
+	defer ctx.abortLock.Unlock()
+	return ctx.interrupt
+}
+
+// resetInterrupt makes a fresh interrupt context for a new command.
+func (ctx *Control) resetInterrupt() {
+	ctx.abortLock.Lock()
+	defer ctx.abortLock.Unlock()
+	if ctx.cancel != nil {
+		ctx.cancel()
+	}
+	ctx.interrupt, ctx.cancel = context.WithCancel(context.Background())
+}
+
 /*
  * Logging and responding
  */
@@ -132,7 +164,10 @@ func nuke(directory string, legend string) {
 
 func croak(msg string, args ...interface{}) {
 	content := fmt.Sprintf(msg, args...)
-	control.baton.printLogString("reposurgeon: " + content + control.lineSep)
+	// Never held back as a repeat, but can be suppressed
+	if control.warnings.note("error", "") {
+		control.baton.printLogString("reposurgeon: " + content + control.lineSep)
+	}
 	if !control.flagOptions["relax"] {
 		control.setAbort(true)
 	}
@@ -153,9 +188,119 @@ func logit(msg string, args ...interface{}) {
 }
 
 func shout(msg string, args ...interface{}) {
-	logit(msg, args...)
+	content := fmt.Sprintf(msg, args...)
+	if !control.warnings.note("notice", "") {
+		return
+	}
+	logit("%s", content)
 	if _, ok := control.logfp.(*os.File); ok {
-		control.baton.printLogString(fmt.Sprintf("reposurgeon: "+msg, args...) + control.lineSep)
+		control.baton.printLogString("reposurgeon: " + content + control.lineSep)
+	}
+}
+
+// warningRegistry tallies warnings by category so the signal from a
+// long conversion doesn't scroll away.  Exact repeats of a warning are
+// shown only once, and whole categories can be suppressed; either way
+// they are still counted.
+type warningRegistry struct {
+	sync.Mutex
+	counts     map[string]int
+	hidden     map[string]int
+	seen       map[string]bool
+	suppressed map[string]bool
+}
+
+// note records a warning and reports whether it should be shown.
+// Warnings with the same category and key are repeats, except that
+// one with an empty key is never a repeat.
+func (wr *warningRegistry) note(category string, key string) bool {
+	wr.Lock()
+	defer wr.Unlock()
+	if wr.counts == nil {
+		wr.counts = make(map[string]int)
+		wr.hidden = make(map[string]int)
+		wr.seen = make(map[string]bool)
+	}
+	wr.counts[category]++
+	if wr.suppressed[category] {
+		wr.hidden[category]++
+		return false
+	}
+	if key == "" {
+		return true
+	}
+	key = category + "\x00" + key
+	if wr.seen[key] {
+		wr.hidden[category]++
+		return false
+	}
+	wr.seen[key] = true
+	return true
+}
+
+func (wr *warningRegistry) suppress(category string, on bool) {
+	wr.Lock()
+	defer wr.Unlock()
+	if wr.suppressed == nil {
+		wr.suppressed = make(map[string]bool)
+	}
+	if on {
+		wr.suppressed[category] = true
+	} else {
+		delete(wr.suppressed, category)
+	}
+}
+
+// clear forgets counts and seen warnings, but not suppressions.
+func (wr *warningRegistry) clear() {
+	wr.Lock()
+	defer wr.Unlock()
+	wr.counts = nil
+	wr.hidden = nil
+	wr.seen = nil
+}
+
+// totals returns the total number of warnings and how many were hidden.
+func (wr *warningRegistry) totals() (int, int) {
+	wr.Lock()
+	defer wr.Unlock()
+	total, hidden := 0, 0
+	for category, n := range wr.counts {
+		total += n
+		hidden += wr.hidden[category]
+	}
+	return total, hidden
+}
+
+// report writes a summary table of warnings by category.
+func (wr *warningRegistry) report(w io.Writer) {
+	wr.Lock()
+	defer wr.Unlock()
+	categories := make([]string, 0, len(wr.counts))
+	for category := range wr.counts {
+		categories = append(categories, category)
+	}
+	for category := range wr.suppressed {
+		if _, ok := wr.counts[category]; !ok {
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
+	fmt.Fprintf(w, "%-24s %8s %8s\n", "category", "count", "hidden")
+	for _, category := range categories {
+		legend := category
+		if wr.suppressed[category] {
+			legend += " (suppressed)"
+		}
+		fmt.Fprintf(w, "%-24s %8d %8d\n", legend, wr.counts[category], wr.hidden[category])
+	}
+}
+
+// warn logs a warning of the given category through the registry.
+func warn(category string, msg string, args ...interface{}) {
+	content := fmt.Sprintf(msg, args...)
+	if control.warnings.note(category, content) && logEnable(logWARN) {
+		logit("%s", content)
 	}
 }
 
@@ -332,10 +477,12 @@ func (lp *LineParse) parse() error {
 					lp.outfile = tok[match[2*2+0]:match[2*2+1]]
 					if lp.outfile != "" && lp.outfile != "-" {
 						info, err := os.Stat(lp.outfile)
+						regular := false
 						if err == nil {
 							if info.Mode().IsDir() {
 								panic(throw("command", "can't redirect output to %s, which is a directory", lp.outfile))
 							}
+							regular = info.Mode().IsRegular()
 						}
 						// flush the outfile, if it happens to be a file
 						// that reposurgeon has already opened
@@ -354,7 +501,11 @@ func (lp *LineParse) parse() error {
 							// already exists we ensure that any
 							// seekstreams pointing to it will
 							// continue to get valid data.
-							os.Remove(lp.outfile)
+							// Devices such as /dev/null are
+							// left where they are.
+							if regular {
+								os.Remove(lp.outfile)
+							}
 						}
 						lp.stdout, err = os.OpenFile(filepath.Clean(lp.outfile), mode, userReadWriteMode)
 						if err != nil {
@@ -556,6 +707,9 @@ type Reposurgeon struct {
 	extractor    Extractor
 	startTime    time.Time
 	logHighwater int
+	pendingOps   []*pendingOp // Commands begun, innermost last
+	interlock    sync.Mutex   // Held while a command runs, for the query server
+	server       *queryServer // Answering queries, if any
 }
 
 func newReposurgeon() *Reposurgeon {
@@ -666,6 +820,11 @@ func (rs *Reposurgeon) PreCmd(line string) string {
 	if len(trimmed) != 0 {
 		rs.history = append(rs.history, trimmed)
 	}
+	// PostCmd pops this whether or not the command is logged
+	if len(rs.pendingOps) == 0 {
+		rs.interlock.Lock()
+	}
+	rs.pendingOps = append(rs.pendingOps, nil)
 	if control.flagOptions["echo"] {
 		control.baton.printLogString(trimmed + control.lineSep)
 	}
@@ -695,9 +854,11 @@ func (rs *Reposurgeon) PreCmd(line string) string {
 
 	rs.logHighwater = control.logcounter
 	rs.buildPrompt()
+	rs.pendingOps[len(rs.pendingOps)-1] = beginOp(trimmed, rest, rs.chosen(), rs.selection)
 
 	if len(rs.callstack) == 0 {
 		control.setAbort(false)
+		control.resetInterrupt()
 	}
 	control.baton.start = time.Now()
 	return rest
@@ -705,6 +866,16 @@ func (rs *Reposurgeon) PreCmd(line string) string {
 
 // PostCmd is the hook executed after each command handler
 func (rs *Reposurgeon) PostCmd(stop bool, lineIn string) bool {
+	if n := len(rs.pendingOps); n > 0 {
+		if op := rs.pendingOps[n-1]; op != nil {
+			op.finish(rs.chosen())
+			op.settleJournal(rs.chosen())
+		}
+		rs.pendingOps = rs.pendingOps[:n-1]
+		if n == 1 {
+			rs.interlock.Unlock()
+		}
+	}
 	if control.logcounter > rs.logHighwater {
 		respond("%d new log message(s)", control.logcounter-rs.logHighwater)
 	}
@@ -973,6 +1144,8 @@ func (rs *Reposurgeon) DoResolve(line string) bool {
 func (rs *Reposurgeon) HelpAssign() {
 	rs.helpOutput(`
 SELECTION assign [--singleton] [NAME]
+assign --save [>OUTFILE]
+assign --load [<INFILE]
 
 Compute a leading selection set and assign it to a symbolic name,
 which must follow the assign keyword. It is an error to assign to a
@@ -989,6 +1162,16 @@ if the selection set is not a singleton.
 Use this to optimize out location and selection computations
 that would otherwise be performed repeatedly, e.g. in macro calls.
 
+Assignments last only as long as the session.  With --save, they
+are written out in a form that will still mean the same events in a
+later session, even after the events have been renumbered or
+reordered: each event is named by its action stamp if it is a commit
+(with an ordinal suffix if other commits share the stamp), by its
+name if it is a tag, by reset@ and its branch if it is a reset, and
+otherwise by its mark.  With --load, such a file is read back;
+names already in use are an error, and event names that no longer
+identify exactly one event are dropped with a warning.
+
 Example:
 
 ----
@@ -1001,14 +1184,31 @@ Example:
 
 // CompleteAssign is a completion hook over assign options
 func (rs *Reposurgeon) CompleteAssign(text string) []string {
-	return []string{"--singleton"}
+	return []string{"--singleton", "--save", "--load"}
 }
 
 // DoAssign is the handler for the "assign" command,
 func (rs *Reposurgeon) DoAssign(line string) bool {
-	parse := rs.newLineParse(line, "assign", parseREPO, nil)
+	parse := rs.newLineParse(line, "assign", parseREPO, orderedStringSet{"stdin", "stdout"})
 	defer parse.Closem()
 	repo := rs.chosen()
+	if parse.options.Contains("--save") {
+		unnamed, err := repo.writeAssignments(parse.stdout)
+		if err != nil {
+			croak("writing assignments: %v", err)
+		} else if unnamed > 0 && logEnable(logWARN) {
+			logit("%d events without names were left out", unnamed)
+		}
+		return false
+	} else if parse.options.Contains("--load") {
+		count, err := repo.readAssignments(parse.stdin)
+		if err != nil {
+			croak("reading assignments: %v", err)
+			return false
+		}
+		respond("%d assignments loaded.", count)
+		return false
+	}
 	if !rs.selection.isDefined() {
 		if len(parse.args) > 0 {
 			croak("No selection")
@@ -1112,6 +1312,37 @@ func (rs *Reposurgeon) DoHistory(line string) bool {
 	return false
 }
 
+// HelpOplog says "Shut up, golint!"
+func (rs *Reposurgeon) HelpOplog() {
+	rs.helpOutput(`
+oplog [>OUTFILE]
+
+Dump the operations log of the chosen repository: a line for each
+command run on it that may have altered it, giving the time it started
+in UTC, how long it took, the size of its explicit selection set (0 if
+none was given), the numbers of events it added and deleted, and the
+command itself, separated by tabs.  Inspection commands such as list
+and write aren't logged; neither are script and macro invocations,
+whose commands are logged instead.
+
+The log is kept in the repository's scratch directory as it grows.  A
+rebuild writes it into the metadata directory of the repository made,
+as reposurgeon-oplog (for git, .git/reposurgeon-oplog), and reading
+that repository later picks it up again, so the log covers every
+session of a conversion done in stages.
+`)
+}
+
+// DoOplog is the handler for the "oplog" command.
+func (rs *Reposurgeon) DoOplog(line string) bool {
+	parse := rs.newLineParse(line, "oplog", parseREPO|parseNOSELECT|parseNOARGS|parseNOOPTS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if err := rs.chosen().writeOplog(parse.stdout); err != nil {
+		croak("oplog: %v", err)
+	}
+	return false
+}
+
 func storeProfileName(subject string, name string) {
 	if control.profileNames == nil {
 		control.profileNames = make(map[string]string)
@@ -1503,10 +1734,156 @@ func (rs *Reposurgeon) DoCount(lineIn string) bool {
 	return false
 }
 
+// HelpHealth says "Shut up, golint!"
+func (rs *Reposurgeon) HelpHealth() {
+	rs.helpOutput(`
+[SELECTION] health [--json] [>OUTFILE]
+
+Survey the selection, defaulting to the whole repository, and report
+statistics useful before surgery: event counts by type, the date
+range of the commits, commit counts per branch, a histogram of blob
+sizes, and the ten most frequent authors.
+
+The report also lists defects that cause trouble later: commits with
+no fileops that are not merges, blobs mixing CRLF and bare LF line
+endings, commits and tags whose metadata is not decodable as UTF-8,
+resets pointing at marks that don't exist, and blobs that no fileop
+refers to.
+
+With --json, the report is a JSON object instead of text.
+
+This command sets Q bits: true on events in a list of defects, false
+otherwise.
+`)
+}
+
+// CompleteHealth is a completion hook over health options
+func (rs *Reposurgeon) CompleteHealth(text string) []string {
+	return []string{"--json"}
+}
+
+// DoHealth reports statistics and defects of a repository.
+func (rs *Reposurgeon) DoHealth(line string) bool {
+	parse := rs.newLineParse(line, "health", parseALLREPO|parseNOARGS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	report := rs.chosen().healthReport(rs.selection, control.baton)
+	if parse.options.Contains("--json") {
+		if err := report.writeJSON(parse.stdout); err != nil {
+			croak("health: %v", err)
+		}
+	} else {
+		report.writeText(parse.stdout)
+	}
+	return false
+}
+
+// HelpServe says "Shut up, golint!"
+func (rs *Reposurgeon) HelpServe() {
+	rs.helpOutput(`
+serve [--stop] [SOCKET]
+
+Answer read-only queries about the selected repository on a Unix
+socket at the path SOCKET, so that other programs - review dashboards,
+converters - can look at the repository while the session goes on.
+With no argument, report where queries are being answered; with
+--stop, stop answering them.  Only one socket is served at a time.
+
+Requests are lines of text; each gets a line of JSON in reply, of the
+form {"ok":true,"result":...} or {"ok":false,"error":"..."}.  These
+requests are understood:
+
+----
+select SELECTION     1-origin numbers of the events in the selection
+metadata SELECTION   the events in the selection, as jsonout shows them
+manifest LOCATION    the files in the tree of one commit, in path order,
+                     each with its path, mode and blob mark
+----
+
+Selections are in the language of the interpreter and are evaluated
+as the interpreter would evaluate them against the repository served.
+Queries are answered between commands, never during one, so a client
+asking while a long operation runs waits for it to finish.  The socket
+goes away when the session ends.
+`)
+}
+
+// CompleteServe is a completion hook over serve options
+func (rs *Reposurgeon) CompleteServe(text string) []string {
+	return []string{"--stop"}
+}
+
+// DoServe starts or stops the query server.
+func (rs *Reposurgeon) DoServe(line string) bool {
+	parse := rs.newLineParse(line, "serve", parseNOSELECT, nil)
+	defer parse.Closem()
+	if parse.options.Contains("--stop") {
+		if rs.server == nil {
+			croak("no queries are being answered.")
+			return false
+		}
+		rs.server.stop()
+		rs.server = nil
+		return false
+	}
+	if len(parse.args) == 0 {
+		if rs.server == nil {
+			respond("no queries are being answered.")
+		} else {
+			respond("answering queries about %s at %s.", rs.server.name, rs.server.path)
+		}
+		return false
+	}
+	if rs.server != nil {
+		croak("already answering queries at %s.", rs.server.path)
+		return false
+	}
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	server, err := rs.startServer(repo, parse.args[0])
+	if err != nil {
+		croak("serve: %v", err)
+		return false
+	}
+	rs.server = server
+	return false
+}
+
+// HelpRepair says "Shut up, golint!"
+func (rs *Reposurgeon) HelpRepair() {
+	rs.helpOutput(`
+repair [>OUTFILE]
+
+Bring the resets of the repository back into line with its DAG after
+heavy surgery.  Resets whose target is a mark that no longer exists
+are removed.  Each childless commit that no ref would point at after
+import - one that is not the last commit of its branch and has no tag
+or reset attached - gets a new reset, named after its branch and
+mark, so the importer doesn't drop it.
+
+Each change is reported on a line of its own.  The repair can be
+reverted with "undo".
+
+This command sets Q bits: true on added resets and the commits they
+point at, false otherwise.
+`)
+}
+
+// DoRepair removes dangling resets and adds resets for unreferenced tips.
+func (rs *Reposurgeon) DoRepair(line string) bool {
+	parse := rs.newLineParse(line, "repair", parseREPO|parseNOSELECT|parseNOARGS|parseNOOPTS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	changes := rs.chosen().repairTips(parse.stdout, control.baton)
+	respond("%d changes.", changes)
+	return false
+}
+
 // HelpList says "Shut up, golint!"
 func (rs *Reposurgeon) HelpList() {
 	rs.helpOutput(`
-[SELECTION] list [--decode=CODEC] [commits|tags|stamps|inspect|index|manifest|paths|names|stats|sizes] [PATTERN] [>OUTFILE]
+[SELECTION] list [--decode=CODEC] [--csv|--json] [commits|tags|stamps|inspect|index|manifest|paths|history|names|stats|sizes|quarantine|merges] [PATTERN] [>OUTFILE]
 
 Requires a loaded repository. Takes a selection set, defaulting to all
 
@@ -1525,6 +1902,14 @@ With "stamps", display full action stamps corresponding to selected
 commits.  The stamp is followed by the first line of the commit
 message.
 
+The commits, tags and stamps listings take --csv or --json to emit one
+record per event instead of columnated text, untruncated, for feeding to
+spreadsheets or scripts.  With --csv there is a header line naming the
+fields; with --json each record is a JSON object on a line of its own.
+The fields are event, date, mark, hash, legacy and summary for commits,
+with the full hash; event, type and name for tags; stamp and summary for
+stamps.
+
 With "inspect", dump a fast-import stream representing selected events
 to standard output.  Just like a write, except (1) the progress meter
 is disabled, and (2) there is an identifying header before each event
@@ -1547,6 +1932,14 @@ regular expressions.
 
 With "paths", list all paths touched by fileops on selected commits.
 
+With "history", which takes a path argument instead of a pattern, list
+the selected commits that added, modified, renamed, copied or deleted
+the file at that path, oldest first.  Renames and copies are followed
+backwards, so the file is also tracked under the names it had before.
+Each line gives the event number, the mark, what happened, and the
+path, followed for a rename or copy by the name it came from.  Useful
+for seeing where a file has been before expunging it.
+
 With "names", list all known symbolic names of branches, and of tags
 in the selection set.  Tells you what things are legal within angle
 brackets and parentheses.
@@ -1560,6 +1953,16 @@ it).  Not an exact measure of storage size: intended mainly as a way
 to get information on how to efficiently partition a repository that
 has become large enough to be unwieldy.
 
+With "quarantine", report what a "read --tolerant" of the repository
+couldn't parse, one problem per line, and how it was handled.
+
+With "merges", report the merge parents that reading a Subversion
+repository synthesized from mergeinfo into the selected commits, one
+per line: the commit, the parent, a confidence score from 0 to 1, and
+whether the link was made or skipped for scoring under the
+--merge-threshold read option.  A full merge of a branch scores 1, a
+cherry-pick of part of one less.
+
 With the --decode option, the CODEC argument must name one of the
 codecs known to the Go standard codecs library; see the dcumentation
 of the transcode command for details. Transcode the output to UTF-8
@@ -1572,22 +1975,43 @@ prompt.
 
 // CompleteList is a completion hook over list modes
 func (rs *Reposurgeon) CompleteList(text string) []string {
-	return []string{"commits", "tags", "stamps", "inspect", "index", "manifest", "paths", "names", "stats", "sizes"}
+	return []string{"--csv", "--json", "commits", "tags", "stamps", "inspect", "index", "manifest", "paths", "history", "names", "stats", "sizes", "quarantine", "merges"}
 }
 
 // DoList generates a human-friendly listing of events.
 func (rs *Reposurgeon) DoList(lineIn string) bool {
-	parse := rs.newLineParse(lineIn, "list", parseREPO|parseALLREPO|parseNOOPTS, orderedStringSet{"stdout"})
+	parse := rs.newLineParse(lineIn, "list", parseREPO|parseALLREPO, orderedStringSet{"stdout"})
 	defer parse.Closem()
 	w := screenwidth()
 	modifiers := orderedStringSet{}
+	for _, opt := range parse.options {
+		if opt != "--csv" && opt != "--json" {
+			croak("list takes no options other than --csv and --json.")
+			return false
+		}
+		modifiers.Add(strings.TrimPrefix(opt, "--"))
+	}
+	if len(modifiers) > 1 {
+		croak("list takes only one of --csv and --json.")
+		return false
+	}
 
 	mode := "commits"
 	if len(parse.args) > 0 {
 		mode = parse.args[0]
 	}
+	if len(modifiers) > 0 && mode != "commits" && mode != "tags" && mode != "stamps" {
+		croak("only the commits, tags and stamps listings can be serialized.")
+		return false
+	}
+	header := func(fields []string) {
+		if h := reportHeader(modifiers, fields); h != "" {
+			fmt.Fprintln(parse.stdout, h)
+		}
+	}
 	switch mode {
 	case "commits":
+		header(listerFields)
 		f := func(p *LineParse, i int, e Event) string {
 			c, ok := e.(*Commit)
 			if ok {
@@ -1597,6 +2021,7 @@ func (rs *Reposurgeon) DoList(lineIn string) bool {
 		}
 		rs.reportSelect(parse, f)
 	case "tags":
+		header(tagsFields)
 		f := func(p *LineParse, i int, e Event) string {
 			// this is pretty stupid; pretend you didn't see it
 			switch v := e.(type) {
@@ -1612,6 +2037,7 @@ func (rs *Reposurgeon) DoList(lineIn string) bool {
 		}
 		rs.reportSelect(parse, f)
 	case "stamps":
+		header(stampFields)
 		f := func(p *LineParse, i int, e Event) string {
 			// this is pretty stupid; pretend you didn't see it
 			switch v := e.(type) {
@@ -1721,6 +2147,19 @@ func (rs *Reposurgeon) DoList(lineIn string) bool {
 		}
 		sort.Strings(allpaths)
 		fmt.Fprint(parse.stdout, strings.Join(allpaths, control.lineSep)+control.lineSep)
+	case "history":
+		if len(parse.args) != 2 {
+			croak("list history needs a path.")
+			return false
+		}
+		repo := rs.chosen()
+		for _, change := range repo.pathHistory(parse.args[1], rs.selection) {
+			fmt.Fprintf(parse.stdout, "%6d %6s %-8s %s", repo.eventToIndex(change.commit)+1, change.commit.mark, change.action, change.path)
+			if change.source != "" {
+				fmt.Fprintf(parse.stdout, " <- %s", change.source)
+			}
+			fmt.Fprint(parse.stdout, control.lineSep)
+		}
 	case "names":
 		branches := rs.chosen().branchset()
 		//sortbranches.Sort()
@@ -1813,6 +2252,12 @@ func (rs *Reposurgeon) DoList(lineIn string) bool {
 			sz(val, key)
 		}
 		sz(total, "")
+	case "quarantine":
+		for _, problem := range rs.chosen().quarantined {
+			fmt.Fprint(parse.stdout, problem+control.lineSep)
+		}
+	case "merges":
+		rs.chosen().reportMerges(parse.stdout, rs.selection)
 	default:
 		croak("unknown subcommand '%s' in list command.", mode)
 	}
@@ -1821,7 +2266,40 @@ func (rs *Reposurgeon) DoList(lineIn string) bool {
 
 // CompleteLint is a completion hook over lint option abbreviations
 func (rs *Reposurgeon) CompleteLint(text string) []string {
-	return []string{"--d", "--c", "--r", "--a", "--u", "--i", "--o"}
+	return []string{"--d", "--c", "--r", "--a", "--u", "--i", "--o", "--m"}
+}
+
+// HelpEval says "Shut up, golint!"
+func (rs *Reposurgeon) HelpEval() {
+	rs.helpOutput(`
+[SELECTION] eval {EXPRESSION} [>OUTFILE]
+
+Evaluate an event expression (see "help expressions") on each selected
+event, defaulting to all, and show the event number and the value.
+Strings are shown quoted.  Useful for checking an expression before
+using it in a selection or a map.
+`)
+}
+
+// DoEval is the handler for the "eval" command.
+func (rs *Reposurgeon) DoEval(line string) bool {
+	node, rest := compileBracedExpr(line)
+	parse := rs.newLineParse(rest, "eval", parseALLREPO|parseNOOPTS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if len(parse.args) > 0 {
+		croak("eval: unexpected %q after the expression", parse.args[0])
+		return false
+	}
+	repo := rs.chosen()
+	values := repo.exprValues(rs.selection, node)
+	for it := rs.selection.Iterator(); it.Next(); {
+		value := values[it.Index()]
+		if s, ok := value.(string); ok {
+			value = strconv.Quote(s)
+		}
+		fmt.Fprintf(parse.stdout, "%6d %s\n", it.Value()+1, exprString(value))
+	}
+	return false
 }
 
 // HelpLint says "Shut up, golint!"
@@ -1835,7 +2313,8 @@ disconnected commits, (3) parentless commits, (4) the existence of
 multiple roots, (5) committer and author IDs that don't look
 well-formed as DVCS IDs, (6) multiple child links with identical
 branch labels descending from the same commit, (7) time and
-action-stamp collisions.
+action-stamp collisions, (8) comments that break a comment policy,
+(9) merge topologies that trouble downstream tools.
 
 The options and output format of this command are unstable; they may
 change without notice as more sanity checks are added.
@@ -1852,8 +2331,36 @@ Options to issue only partial reports are supported:
  --attributions  --a     report on anomalies in usernames and attributions
  --uniqueness    --u     report on collisions among action stamps
  --cvsignores    --i     report if .cvsignore files are present
+ --comments      --m     report on comments breaking the comment policy
+ --topology      --t     report on octopus, criss-cross and redundant merges
 ----
 
+The comment policy applies to commit and tag comments.  It reports
+comments that are empty (including the CVS empty-log-message marker),
+that don't end with a linefeed, that have lines longer than 72
+characters, and that contain separator lines - rows of four or more of
+one of the characters "-=*#~_+", as some CVS and Subversion tools
+wrote between entries.  Each problem is reported on its own line,
+prefixed by the ID of the event.  The option --width=N changes the
+line limit (0 means none).  With --legacy-trailers, an event with a
+legacy ID whose comment lacks the Legacy-ID trailer written by "write
+--legacy" is reported too.  Any of these options implies --comments.
+
+The option --fix repairs the problems that can be repaired
+mechanically: separator lines are removed, a linefeed is added where
+one is missing, and missing Legacy-ID trailers are appended.  Long
+lines and empty comments are only reported.
+
+The topology report lists merges with more parents than a limit,
+which is 2 unless the option --max-parents=N says otherwise (0 means
+none); commits whose parent list names a parent more than once;
+merges with a parent that is an ancestor of another, which add
+nothing to the first-parent line; and criss-cross merges, whose
+parents have more than one best common ancestor, so that three-way
+merge tools have no single base.  Each category ends with a line
+giving its commits as a selection, ready for the command that will
+repair them.  Giving --max-parents implies --topology.
+
 `)
 }
 
@@ -1868,6 +2375,29 @@ func (rs *Reposurgeon) DoLint(line string) (StopOut bool) {
 	checkAttributions := parse.options.Empty() || parse.options.Contains("--names") || parse.options.Contains("--n")
 	checkCvsignores := parse.options.Contains("--cvsignores") || parse.options.Contains("--c")
 	checkUniques := parse.options.Empty() || parse.options.Contains("--uniqueness") || parse.options.Contains("--u")
+	policy := commentPolicy{width: defaultCommentWidth, legacy: parse.options.Contains("--legacy-trailers")}
+	width, haveWidth := parse.OptVal("--width")
+	if haveWidth {
+		n, err := strconv.Atoi(width)
+		if err != nil || n < 0 {
+			croak("lint: ill-formed --width value %q", width)
+			return false
+		}
+		policy.width = n
+	}
+	repair := parse.options.Contains("--fix")
+	checkComments := parse.options.Contains("--comments") || parse.options.Contains("--m") || haveWidth || policy.legacy || repair
+	maxParents := 2
+	limit, haveLimit := parse.OptVal("--max-parents")
+	if haveLimit {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			croak("lint: ill-formed --max-parents value %q", limit)
+			return false
+		}
+		maxParents = n
+	}
+	checkTopology := parse.options.Contains("--topology") || parse.options.Contains("--t") || haveLimit
 
 	var lintmutex sync.Mutex
 	unmapped := regexp.MustCompile("^[^@]*$|^[^@]*@" + rs.chosen().uuid + "$")
@@ -2027,6 +2557,29 @@ func (rs *Reposurgeon) DoLint(line string) (StopOut bool) {
 	if cvsignores > 0 {
 		fmt.Fprintf(parse.stdout, "%d .cvsignore operations in Q set.\n", cvsignores)
 	}
+	if checkTopology {
+		selection := rs.selection
+		if !selection.isDefined() {
+			selection = rs.chosen().all()
+		}
+		rs.chosen().topologyLint(parse.stdout, selection, maxParents)
+	}
+	if checkComments {
+		selection := rs.selection
+		if !selection.isDefined() {
+			selection = rs.chosen().all()
+		}
+		reports, fixed := rs.chosen().lintComments(selection, policy, repair)
+		if len(reports) > 0 {
+			fmt.Fprintf(parse.stdout, "%d comment policy problems in Q set.\n", len(reports))
+		}
+		for _, item := range reports {
+			fmt.Fprintf(parse.stdout, "%s\n", item)
+		}
+		if repair {
+			fmt.Fprintf(parse.stdout, "%d comments fixed.\n", fixed)
+		}
+	}
 
 	return false
 }
@@ -2056,6 +2609,12 @@ the preferred type rather than its original type (if it had one).
 If no preferred type has been explicitly selected, reading in a
 repository (but not a fast-import stream) will implicitly set reposurgeon's
 preference to the type of that repository.
+
+The argument may also name an extractor: hg-extractor, bzr-extractor,
+brz-extractor, fossil-extractor, darcs-extractor or p4-extractor.  A
+repository of that type will then be read by running its own
+command-line tools revision by revision, rather than through an
+exporter; bzr and brz then don't need the fast-export plugin.
 `)
 }
 
@@ -2218,6 +2777,41 @@ func (rs *Reposurgeon) DoGc(line string) bool {
 	return false
 }
 
+// HelpCompact says "Shut up, golint!"
+func (rs *Reposurgeon) HelpCompact() {
+	rs.helpOutput(`
+compact [>OUTFILE]
+
+Reclaim memory and disk left behind by large deletions in the chosen
+repository.  Deletion is done in place for speed, so after a squash or
+expunge of most of a repository the event list, parent and child links
+and fileop lists keep their old capacity, and the blob store keeps the
+files of deleted blobs scattered over its directory fan-out.
+
+This command reallocates those lists to fit, renumbers the surviving
+blob files into a dense range of directories, and removes the files of
+deleted blobs and any directories left empty.  Nothing visible changes:
+event numbers, marks, and content are as they were.  It is a good idea
+to run "gc" first, so unreferenced blobs are deleted.
+
+Counts of what was compacted are reported. In interactive mode the
+memory and disk space reclaimed follows.
+`)
+}
+
+// DoCompact is the handler for the "compact" command.
+func (rs *Reposurgeon) DoCompact(line string) bool {
+	parse := rs.newLineParse(line, "compact", parseREPO|parseNOSELECT|parseNOOPTS|parseNOARGS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	r := rs.chosen().compact(control.baton)
+	fmt.Fprintf(parse.stdout, "%d event slots, %d link slots, %d fileop slots released.\n",
+		r.eventSlots, r.linkSlots, r.opSlots)
+	fmt.Fprintf(parse.stdout, "%d blob files renumbered, %d orphaned blob files and %d directories removed.\n",
+		r.blobsMoved, r.orphans, r.directories)
+	respond("%d bytes of memory and %d bytes of disk reclaimed.", r.memory, r.disk)
+	return false
+}
+
 // HelpChoose says "Shut up, golint!"
 func (rs *Reposurgeon) HelpChoose() {
 	rs.helpOutput(`
@@ -2338,6 +2932,8 @@ func (rs *Reposurgeon) DoDrop(line string) bool {
 func (rs *Reposurgeon) HelpRename() {
 	rs.helpOutput(`
 [SELECTION] rename {repo | path PATTERN [--force] | {path|branch|tag|reset} [--not] PATTERN}} NEW-NAME
+[SELECTION] rename path s/REGEXP/REPLACEMENT/ [--force]
+[SELECTION] rename tag s/REGEXP/REPLACEMENT/
 
 With "repo", renames the currently chosen repo; requires a NEW-NAME
 argument.  Won't do it if there is already one by the new name.
@@ -2353,9 +2949,25 @@ renaming
 With "path", rename a path in every fileop of every selected commit.
 The default selection set is all commits. The pattern expression to
 matched against paths; Ordinarily, if the target path already exists
-in the fileops, or is visible in the ancestry of the commit, this
-command throws an error.  With the --force option, these checks are
-skipped.
+in the fileops, or is visible in the ancestry of the commit, or if
+two paths in the manifest of a commit would be renamed to the same
+target, this command throws an error.  With the --force option, these
+checks are skipped.
+
+A path rename may also be given as a single sed-style substitution,
+s/REGEXP/REPLACEMENT/, with any character standing in for the slash.
+In the replacement \1 through \9 are capture groups and & is the
+whole match, as in sed.  Renames apply to the paths of all fileops
+and to the sources of R and C fileops.  For example
+
+rename path s:^src/(.*)\.c$:lib/\1.c:
+
+Tags can be renamed in bulk the same way, every tag the REGEXP
+matches at once.  Nothing is renamed if two tags would end up with the
+same name, or a tag would take the name of one that isn't being
+renamed.  For example
+
+rename tag s/^release_([0-9]+)_([0-9]+)$/v\1.\2/
 
 With "rename", rename objects that match by name. 
 
@@ -2410,12 +3022,22 @@ func (rs *Reposurgeon) DoRename(line string) bool {
 			croak("missing source pattern in path rename command")
 			return false
 		}
-		sourceRE := parse.getPattern(parse.args[1], "path")
-		if len(parse.args) < 3 {
+		var sourceRE *regexp.Regexp
+		var targetPattern string
+		if len(parse.args) == 2 && strings.HasPrefix(parse.args[1], "s") {
+			var err error
+			sourceRE, targetPattern, err = sedExpression(parse.args[1])
+			if err != nil {
+				croak("in path rename: %v", err)
+				return false
+			}
+		} else if len(parse.args) < 3 {
 			croak("no target specified in path rename")
 			return false
+		} else {
+			sourceRE = parse.getPattern(parse.args[1], "path")
+			targetPattern = parse.args[2]
 		}
-		targetPattern := parse.args[2]
 		force := parse.options.Contains("--force")
 		rs.chosen().pathRename(rs.selection, sourceRE, targetPattern, force)
 	case "branch":
@@ -2539,7 +3161,19 @@ func (rs *Reposurgeon) DoRename(line string) bool {
 			croak("missing tag pattern")
 			return false
 		}
-		sourceRE := parse.getPattern(parse.args[1], "text")
+		var sourceRE *regexp.Regexp
+		var newname string
+		substitution := len(parse.args) == 2 && strings.HasPrefix(parse.args[1], "s")
+		if substitution {
+			var err error
+			sourceRE, newname, err = sedExpression(parse.args[1])
+			if err != nil {
+				croak("in tag rename: %v", err)
+				return false
+			}
+		} else {
+			sourceRE = parse.getPattern(parse.args[1], "text")
+		}
 
 		repo := rs.chosen()
 		repo.clearColor(colorQSET)
@@ -2558,35 +3192,27 @@ func (rs *Reposurgeon) DoRename(line string) bool {
 		}
 
 		// Validate the operation
-		if len(parse.args) < 3 {
-			croak("missing new tag name.")
-			return false
-		}
-		newname := parse.args[2]
-
-		if repo.named(newname).isDefined() {
-			croak("something is already named %s", newname)
-			return false
-		}
-
-		// Do it
-		control.baton.startProcess("tag rename", "")
-		for i, tag := range tags {
-			possible := GoReplacer(sourceRE, tag.tagname, newname)
-			if i > 0 && possible == tags[i-1].tagname {
-				croak("tag name collision, not renaming.")
+		if !substitution {
+			if len(parse.args) < 3 {
+				croak("missing new tag name.")
+				return false
+			}
+			newname = parse.args[2]
+			if repo.named(newname).isDefined() {
+				croak("something is already named %s", newname)
 				return false
 			}
-			tag.tagname = possible
-			tag.addColor(colorQSET)
-			control.baton.twirl()
 		}
-		if n := repo.countColor(colorQSET); n == 0 {
+
+		// Do it
+		n, err := repo.renameTags(tags, sourceRE, newname)
+		if err != nil {
+			croak("tag name collision, not renaming: %v", err)
+		} else if n == 0 {
 			croak("no tag names matched %s", sourceRE)
 		} else {
 			respond("%d objects modified", n)
 		}
-		control.baton.endProcess()
 	case "reset":
 		parse.flagcheck(parseREPO | parseALLREPO)
 		if len(parse.args) < 2 {
@@ -2662,6 +3288,14 @@ bare tokens or double-quoted strings, which may contain whitespace;
 the double quotes are stripped before interpretation. The current
 preserve list is displayed afterwards.
 
+An argument containing *, ? or [ is a glob pattern, as in a shell.
+It is matched against the backup directory when the rebuild happens,
+so it need not match anything when it is added.  Each repository type
+also has default preservations for its hooks and configuration, such
+as .git/hooks, .git/config, .git/description and .git/info/exclude
+under git; these are restored whenever a rebuild replaces an existing
+repository, even one whose history was read from a stream.
+
 This command is included for completeness, but most version-control
 systems (and all those that reposurgeon can rebuild) have a path-list
 list and that makes it unnecessary. The path-list command is used with
@@ -2674,7 +3308,10 @@ everything that should be preserved.
 func (rs *Reposurgeon) DoPreserve(line string) bool {
 	parse := rs.newLineParse(line, "preserve", parseREPO|parseNOSELECT|parseNOOPTS, nil)
 	for _, filename := range parse.args {
-		rs.chosen().preserve(filename)
+		if err := rs.chosen().preserve(filename); err != nil {
+			croak("%v", err)
+			return false
+		}
 	}
 	respond("preserving %s.", rs.chosen().preservable())
 	return false
@@ -2701,7 +3338,10 @@ for why this command is almost never mecessary.
 func (rs *Reposurgeon) DoUnpreserve(line string) bool {
 	parse := rs.newLineParse(line, "unpreserve", parseREPO|parseNOSELECT|parseNOOPTS, nil)
 	for _, filename := range parse.args {
-		rs.chosen().unpreserve(filename)
+		if err := rs.chosen().unpreserve(filename); err != nil {
+			croak("%v", err)
+			return false
+		}
 	}
 	respond("preserving %s.", rs.chosen().preservable())
 	return false
@@ -2714,7 +3354,7 @@ func (rs *Reposurgeon) DoUnpreserve(line string) bool {
 // HelpRead says "Shut up, golint!"
 func (rs *Reposurgeon) HelpRead() {
 	rs.helpOutput(`
-read [--quiet] [<INFILE | - | DIRECTORY]
+read [--quiet] [--tolerant] [--legacy-journal=PATH] [<INFILE | - | DIRECTORY]
 
 A read command with no arguments is treated as 'read .', operating on the
 current directory.
@@ -2758,6 +3398,18 @@ used to read in the repository, notably the warning fronm the CVS
 reader about missing commit-ids. It's best to not use this for early
 testing, adding it only when you're sure you have a clean read.
 
+The "--legacy-journal=PATH" option attaches a legacy-reference journal
+to the repository before it is read; see "legacy journal".
+
+The "--tolerant" option salvages what it can from a damaged
+fast-import stream instead of abandoning the read at the first
+malformed line.  A blob mark that can't be resolved gets an empty
+placeholder blob, a commit without a committer gets the conversion
+bot as a placeholder, and a parent that can't be found is dropped.
+Anything else malformed is skipped up to the next line that can begin
+an event, losing the event it was part of.  Each such problem is
+recorded, and "list quarantine" reports them with their line numbers.
+
 This command has a few additional options specific to reading
 Subversion repositories and stream files; they are described in
 the manual section on working with Subversion.
@@ -2766,7 +3418,7 @@ the manual section on working with Subversion.
 
 // CompleteRead is a completion hook over read options
 func (rs *Reposurgeon) CompleteRead(text string) []string {
-	return []string{"--no-automatic-ignores", "--preserve", "--quiet", "--user-ignores"}
+	return []string{"--branchmap=", "--legacy-journal=", "--merge-threshold=", "--no-automatic-ignores", "--preserve", "--property-sidecar=", "--quiet", "--user-ignores"}
 }
 
 // DoRead reads in a repository for surgery.
@@ -2820,6 +3472,13 @@ func (rs *Reposurgeon) DoRead(line string) bool {
 			}
 		}
 		rs.chosen().rename(rs.uniquify(filepath.Base(name)))
+		if control.flagOptions["stablemarks"] {
+			rs.chosen().renumberStable(context.Background(), nil)
+		}
+		rs.chosen().identifyEvents()
+		if n := len(rs.chosen().quarantined); n > 0 && logEnable(logWARN) {
+			logit("%d malformed constructs quarantined; see \"list quarantine\".", n)
+		}
 	}
 	if control.isInteractive() && !control.flagOptions["quiet"] {
 		rs.DoChoose("")
@@ -2831,6 +3490,8 @@ func (rs *Reposurgeon) DoRead(line string) bool {
 func (rs *Reposurgeon) HelpWrite() {
 	rs.helpOutput(`
 [SELECTION] write [--legacy] [--noincremental] [--callout] [>OUTFILE|-|DIRECTORY]
+[SELECTION] write --split=yearly|monthly|DATE[,DATE...] [--legacy] PREFIX
+write --format=svn [>OUTFILE|-]
 
 Dump selected events as a fast-import stream representing the
 edited repository; the default selection set is all events. Where to
@@ -2873,6 +3534,34 @@ but unlikely to lead to good results if it is loaded by an importer.
 Property extensions will be be omitted from the output if the
 importer for the preferred repository type cannot digest them.
 
+With --split, the selected events are written as several streams,
+cut where the committer dates cross into a new year, a new month, or
+past one of a comma-separated list of cut dates (YYYY-MM-DD, midnight
+UTC, or any date form reposurgeon reads).  The streams go to files
+named PREFIX-001.fi, PREFIX-002.fi and so on, in the order they should
+be loaded, so an enormous history can be imported a piece at a time
+and a failed piece retried alone.  A piece is a run of consecutive
+commits, so a commit dated out of order stays with its neighbours.
+Parents in earlier pieces are written as callouts, as with --callout,
+for "graft" or "callouts resolve" to reattach, and there are no
+incremental resets, as with --noincremental, so each piece can be read
+on its own.  Each piece carries the blobs its commits use and the tags
+and resets pointing at them, and is headed by any passthroughs
+preceding the first commit.
+
+With --format=svn, write the whole repository as a Subversion dump
+instead, suitable for loading with "svnadmin load". Each commit
+becomes a revision in a standard trunk/branches/tags layout: the
+master branch (or main, if there is no master) goes to trunk, other
+branches to branches/, and tags and tag branches to tags/. Annotated
+tags, and resets pointing a ref at an existing commit, become
+directory copies. Merge parents are recorded as svn:mergeinfo,
+executable and symlink modes as svn:executable and svn:special, and
+commit properties as revision properties. Committers read from
+Subversion get their login back as svn:author; others are written as
+"Name <address>". Gitlinks cannot be represented and are dropped with
+a warning. A selection set is not allowed.
+
 Note: to examine small groups of commits without the progress
 meter, use "list inspect".
 `)
@@ -2880,23 +3569,53 @@ meter, use "list inspect".
 
 // CompleteWrite is a completion hook over write options
 func (rs *Reposurgeon) CompleteWrite(text string) []string {
-	return []string{"--caallout", "--legacy", "--noincremental"}
+	return []string{"--caallout", "--format=svn", "--legacy", "--noincremental", "--split="}
 }
 
 // DoWrite streams out the results of repo surgery.
 func (rs *Reposurgeon) DoWrite(line string) bool {
 	parse := rs.newLineParse(line, "write", parseREPO, orderedStringSet{"stdout"})
 	defer parse.Closem()
+	if format, ok := parse.OptVal("--format"); ok {
+		if format != "svn" {
+			croak("unknown write format %q", format)
+			return false
+		}
+		if rs.selection.isDefined() {
+			croak("a Subversion dump must contain the whole repository")
+			return false
+		}
+		if len(parse.args) > 0 && parse.args[0] != "-" {
+			croak("a Subversion dump can only be written to standard output or a redirect")
+			return false
+		}
+		rs.chosen().svnDump(parse.stdout, control.baton)
+		return false
+	}
+	if spec, ok := parse.OptVal("--split"); ok {
+		if parse.redirected || len(parse.args) != 1 {
+			croak("a split write needs a file name prefix, and no redirect")
+			return false
+		}
+		names, err := rs.chosen().splitExport(control.interruptible(), rs.selection, spec, parse.args[0], parse.options.toStringSet(), rs.preferred, control.baton)
+		if err != nil {
+			croak(err.Error())
+		}
+		respond("%d streams written.", len(names))
+		return false
+	}
 	// This is slightly asymmetrical with the read side, which
 	// interprets an empty argument list as '.'
 	if parse.redirected || len(parse.args) == 0 {
-		rs.chosen().fastExport(rs.selection, parse.stdout, parse.options.toStringSet(), rs.preferred, control.baton)
+		if err := rs.chosen().fastExport(control.interruptible(), rs.selection, parse.stdout, parse.options.toStringSet(), rs.preferred, control.baton); err != nil {
+			croak(err.Error())
+		}
 	} else {
 		if strings.HasSuffix(parse.args[0], "/") && !exists(parse.args[0]) {
 			os.Mkdir(filepath.FromSlash(parse.args[0]), userReadWriteSearchMode)
 		}
 		if isdir(parse.args[0]) {
-			err := rs.chosen().rebuildRepo(parse.args[0], parse.options.toStringSet(), rs.preferred, control.baton)
+			err := rs.chosen().rebuildRepo(control.interruptible(), parse.args[0], parse.options.toStringSet(), rs.preferred, control.baton)
 			if err != nil {
 				croak(err.Error())
 			}
@@ -2950,7 +3669,7 @@ func (rs *Reposurgeon) DoView(line string) bool {
 				} else {
 					defer os.Chdir(cwd)
 					git := findVCS("git")
-					repo.innerRebuildRepo(git, nullStringSet, control.baton)
+					repo.innerRebuildRepo(control.interruptible(), git, nullStringSet, control.baton)
 					runProcess(git.checkout, "view checkout")
 					runShellProcess("TZ=UTC "+git.viewer, "viewer")
 				}
@@ -3081,7 +3800,7 @@ func (rs *Reposurgeon) DoStrip(line string) bool {
 // HelpGraph says "Shut up, golint!"
 func (rs *Reposurgeon) HelpGraph() {
 	rs.helpOutput(`
-[SELECTION] graph [>OUTFILE]
+[SELECTION] graph [--format=dot|mermaid] [--collapse] [>OUTFILE]
 
 Emit a visualization of the commit graph in the DOT markup language
 used by the graphviz tool suite.  This can be fed as input to the main
@@ -3095,8 +3814,21 @@ graph | dot -Tpng | display
 ----
 
 You can substitute in your own preferred image viewer, of course.
-`)
-}
+
+With --format=mermaid, the graph is instead a mermaid flowchart, which
+many web forges and documentation tools render directly.
+
+Each branch is drawn in its own color, with an oval (or rounded box)
+naming it at its tip.  Annotated tags are shown with their first
+comment line, linked to the commits they point at.
+
+With --collapse, runs of two or more commits that each have one
+parent and one child on the same branch, and no tag or reset attached,
+are drawn as a single node giving the length of the run and its first
+and last marks.  This keeps the branching structure of a long history
+readable, and is handy for a before-and-after look at surgery.
+`)
+}
 
 // Most comment characters we want to fit in a commit box
 const graphCaptionLength = 32
@@ -3111,16 +3843,22 @@ const graphCaptionLength = 32
 
 // DoGraph dumps a commit graph.
 func (rs *Reposurgeon) DoGraph(line string) bool {
-	parse := rs.newLineParse(line, "graph", parseALLREPO|parseNOARGS|parseNOOPTS, orderedStringSet{"stdout"})
+	parse := rs.newLineParse(line, "graph", parseALLREPO|parseNOARGS, orderedStringSet{"stdout"})
 	defer parse.Closem()
-	rs.chosen().doGraph(rs.selection, parse.stdout)
+	format := graphFormats[0]
+	if val, present := parse.OptVal("--format"); present {
+		format = val
+	}
+	if err := rs.chosen().exportGraph(rs.selection, format, parse.options.Contains("--collapse"), parse.stdout); err != nil {
+		croak("%v", err)
+	}
 	return false
 }
 
 // HelpRebuild says "Shut up, golint!"
 func (rs *Reposurgeon) HelpRebuild() {
 	rs.helpOutput(`
-rebuild [DIRECTORY]
+rebuild [--dry-run] [DIRECTORY] [>OUTFILE]
 
 Rebuild a repository from the state held by reposurgeon.  This command
 does not take a selection set.
@@ -3134,6 +3872,21 @@ repository's preservation list are copied back from the backup directory
 after repo rebuild. The default preserve list depends on the
 repository type, and can be displayed with the "preserve" command.
 
+Before anything is created or backed up, the repository is checked
+against what the target system can import: several authors on a
+commit, notes, non-UTF-8 text for importers that need UTF-8, and ref
+names git would refuse or too long to be file names stop the rebuild
+with a list of the offending events; commit properties the target
+can't store draw a warning that they will be dropped.
+
+With --dry-run, the rebuild is done in a scratch directory instead and
+the target is left alone.  The result and the target are both read
+back and compared: commit counts, the commit each ref points at, and
+the trees of up to twenty commits sampled across the history, matched
+by action stamp.  A line beginning with + describes a ref or commit
+only the rebuild has, - one only the target has, and ~ one that
+differs.
+
 If reposurgeon has a nonempty legacy map, it will be written to a file
 named "legacy-map" in the repository subdirectory as though by a
 "legacy write" command. (This will normally be the case for
@@ -3143,13 +3896,18 @@ Subversion and CVS conversions.)
 
 // DoRebuild rebuilds a live repository from the edited state.
 func (rs *Reposurgeon) DoRebuild(line string) bool {
-	parse := rs.newLineParse(line, "rebuild", parseREPO|parseNOSELECT|parseNOOPTS, nil)
+	parse := rs.newLineParse(line, "rebuild", parseREPO|parseNOSELECT, orderedStringSet{"stdout"})
 	defer parse.Closem()
 	dir := "."
 	if len(parse.args) != 0 {
 		dir = parse.args[0]
 	}
-	err := rs.chosen().rebuildRepo(dir, parse.options.toStringSet(), rs.preferred, control.baton)
+	var err error
+	if parse.options.Contains("--dry-run") {
+		err = rs.chosen().dryRunRebuild(control.interruptible(), parse.stdout, dir, rs.preferred, parse.options.toStringSet(), control.baton)
+	} else {
+		err = rs.chosen().rebuildRepo(control.interruptible(), dir, parse.options.toStringSet(), rs.preferred, control.baton)
+	}
 	if err != nil {
 		croak(err.Error())
 	}
@@ -3179,6 +3937,10 @@ syntax.
 
 Blobs may be included in the output with the option --blobs.
 
+Each message has an Event-UUID header giving the stable identifier of
+its event, which survives renumbering and reordering; see "help
+selection" for how to refer to an event by it.
+
 With the --decode option, the CODEC argument must name one of the
 codecs known to the Go standard codecs library; see the dcumentation
 of the transcode command for details. Transcode the output to UTF-8
@@ -3209,25 +3971,40 @@ func (rs *Reposurgeon) DoMsgout(line string) bool {
 	} else if s, present := parse.OptVal("--filter"); present {
 		filterRegexp = parse.getPattern(s, "text")
 	}
-	f := func(p *LineParse, i int, e Event) string {
-		// this is pretty stupid; pretend you didn't see it
-		switch v := e.(type) {
-		case *Passthrough:
-			return parse.decode(v.emailOut(orderedStringSet{}, i, filterRegexp), e.idMe())
-		case *Commit:
-			return parse.decode(v.emailOut(orderedStringSet{}, i, filterRegexp), e.idMe())
-		case *Tag:
-			return parse.decode(v.emailOut(orderedStringSet{}, i, filterRegexp), e.idMe())
-		case *Blob:
-			if parse.options.Contains("--blobs") {
-				return parse.decode(v.emailOut(orderedStringSet{}, i, filterRegexp), e.idMe())
-			}
-			return ""
-		default:
-			return ""
+	repo := rs.chosen()
+	selection := rs.selection
+	if !selection.isDefined() {
+		selection = repo.all()
+	}
+	_, decoding := parse.OptVal("--decode")
+	repo.identifyEvents()
+	// Each message goes straight to the output, so a selection of
+	// any size never has to be held in memory.
+	w := bufio.NewWriter(parse.stdout)
+	for it := selection.Iterator(); it.Next(); {
+		i := it.Value()
+		e := repo.events[i]
+		carrier, ok := e.(messageCarrier)
+		if _, isBlob := e.(*Blob); !ok || (isBlob && !parse.options.Contains("--blobs")) {
+			continue
+		}
+		var err error
+		if decoding {
+			var b strings.Builder
+			carrier.emitMessage(&b, orderedStringSet{}, i, filterRegexp)
+			_, err = w.WriteString(parse.decode(b.String(), e.idMe()))
+		} else {
+			err = carrier.emitMessage(w, orderedStringSet{}, i, filterRegexp)
+		}
+		if err != nil {
+			croak("msgout: %v", err)
+			break
+		}
+		if control.getAbort() {
+			break
 		}
 	}
-	rs.reportSelect(parse, f)
+	w.Flush()
 	return false
 }
 
@@ -3242,9 +4019,14 @@ If there is an argument, it will be taken as the name of a message-box
 file to read from; if no argument, or one of '-', reads from standard
 input. Supports < redirection.  Ordinarily takes no selection set.
 
-Users should be aware that modifying an Event-Number or Event-Mark field
-will change which event the update from that message is applied to.  This
-is unlikely to have good results.
+Users should be aware that modifying an Event-UUID, Event-Number or
+Event-Mark field will change which event the update from that message
+is applied to.  This is unlikely to have good results.
+
+A message with an Event-UUID header naming an event in the repository
+is applied to that event, whatever its Event-Number says, so a message
+box written before events were inserted, deleted or reordered still
+lands where it should.
 
 The header CheckText, if present, is examined to see if the comment
 text of the associated event begins with it. If not, the item
@@ -3280,6 +4062,13 @@ The --relax option suppresses warnings about message blocks not matching
 any object, but leaves fatal errors due to ill-formed mailbox elements and
 multiple matches unsuppressed.
 
+A message with only Event-Number and Event-UUID headers, as msgout
+writes for a passthrough, replaces the text of that passthrough.
+
+When the input is a file rather than a pipe, it is read twice, once to
+check every update and once to apply them, so that a mailbox covering a
+very large selection need not be held in memory.
+
 This operation sets Q bits; true where an object was modified by it, false 
 otherwise.
 `)
@@ -3305,6 +4094,86 @@ func (rs *Reposurgeon) DoMsgin(line string) bool {
 	return false
 }
 
+// HelpJsonout says "Shut up, golint!"
+func (rs *Reposurgeon) HelpJsonout() {
+	rs.helpOutput(`
+[SELECTION] jsonout [--ndjson]
+
+Emit the metadata of the selected events as JSON, for consumption by
+external analysis tools that would rather not parse import streams.
+The default selection is all events.
+
+Commits are represented with their mark, branch, legacy ID, action
+stamp, committer and authors, comment, parent marks, a summary of their
+fileops (without inline content), and properties.  Tags and resets are
+represented with their name, target mark, and (for tags) tagger and
+comment.  Blobs are represented only by mark and size. Every object has
+a "type" field, the 1-origin event number in an "index" field, and the
+event's stable identifier, which survives renumbering and reordering,
+in a "uuid" field.
+
+Normally the output is a single JSON array.  With --ndjson it is one
+object per line instead, which is more convenient for streaming
+consumers.
+`)
+}
+
+// DoJsonout generates a JSON dump of event metadata.
+func (rs *Reposurgeon) DoJsonout(line string) bool {
+	parse := rs.newLineParse(line, "jsonout", parseALLREPO|parseNOARGS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	format := "json"
+	if parse.options.Contains("--ndjson") {
+		format = "ndjson"
+	}
+	if err := rs.chosen().exportMetadata(rs.selection, parse.stdout, format); err != nil {
+		croak("jsonout: %v", err)
+	}
+	return false
+}
+
+// HelpJsonin says "Shut up, golint!"
+func (rs *Reposurgeon) HelpJsonin() {
+	rs.helpOutput(`
+jsonin [--dry-run] [<INFILE] [>OUTFILE]
+
+Accept a JSON document in the format emitted by jsonout (either a
+single array or one object per line) and apply the attribute changes it
+describes: commit comments, committer and author attributions, branch
+fields, and tag comments and taggers. This is the complement of
+jsonout, in the same way msgin is the complement of msgout.
+
+Each object is matched to an event by its "uuid" field if that names an
+event, otherwise by its "mark" field if present,
+otherwise by its "stamp" field (an action stamp, which must identify a
+unique commit), otherwise for tags by its "name" field. Event numbers
+in the "index" field are ignored, as they are not stable under surgery.
+Fields that are absent leave the corresponding attribute unchanged; an
+attribution with an empty date keeps its old date. Other fields are
+ignored. All edits are checked before any are applied, so a malformed
+document changes nothing.
+
+With --dry-run, no changes are made; instead, each event that would be
+altered is listed along with the fields that would change.
+
+Events modified by this command get their Q bits set.
+`)
+}
+
+// DoJsonin applies metadata edits from a JSON document.
+func (rs *Reposurgeon) DoJsonin(line string) bool {
+	parse := rs.newLineParse(line, "jsonin", parseREPO|parseNOARGS, orderedStringSet{"stdin", "stdout"})
+	defer parse.Closem()
+	dryrun := parse.options.Contains("--dry-run")
+	count, err := rs.chosen().importMetadata(parse.stdin, parse.stdout, dryrun)
+	if err != nil {
+		croak("jsonin: %v", err)
+	} else if !dryrun {
+		respond("%d events modified.", count)
+	}
+	return false
+}
+
 // HelpFilter says "Shut up, golint!"
 func (rs *Reposurgeon) HelpFilter() {
 	rs.helpOutput(`
@@ -3385,6 +4254,35 @@ func GoReplacer(re *regexp.Regexp, fromString, toString string) string {
 	return out
 }
 
+// shellFilter makes a filter running content through a shell command,
+// with substitutions made in the command first.
+func shellFilter(command string) func(string, string, map[string]string) (string, error) {
+	return func(content string, id string, substitutions map[string]string) (string, error) {
+		newcontent, err := runShellFilter(command, content, substitutions)
+		if err != nil {
+			warn("filter", "%s at %s", err, id)
+			return content, err
+		}
+		return newcontent, nil
+	}
+}
+
+// runShellFilter runs content through a shell command, with
+// substitutions made in the command first.
+func runShellFilter(command string, content string, substitutions map[string]string) (string, error) {
+	substituted := command
+	for k, v := range substitutions {
+		substituted = strings.Replace(substituted, k, v, -1)
+	}
+	cmd := exec.Command("sh", "-c", substituted)
+	cmd.Stdin = strings.NewReader(content)
+	newcontent, err := cmd.Output()
+	if err != nil {
+		return content, fmt.Errorf("filter command %q failed - %s", substituted, err)
+	}
+	return string(newcontent), nil
+}
+
 // newFilterCommand - Initialize a filter from the command line.
 func newFilterCommand(lp *LineParse) *filterCommand {
 	fc := new(filterCommand)
@@ -3410,25 +4308,8 @@ func newFilterCommand(lp *LineParse) *filterCommand {
 	// These verb tests simulate normal handling of doublequotes
 	// around the subcommand.
 	if verb == `shell` || verb == `"shell"` {
-		command := strings.TrimSpace(fields[1])
 		fc.attributes = newOrderedStringSet("c", "a", "C")
-		fc.sub = func(content string, id string, substitutions map[string]string) (string, error) {
-			substituted := command
-			for k, v := range substitutions {
-				substituted = strings.Replace(substituted, k, v, -1)
-			}
-			cmd := exec.Command("sh", "-c", substituted)
-			cmd.Stdin = strings.NewReader(content)
-			newcontent, err := cmd.Output()
-			if err == nil {
-				content = string(newcontent)
-			} else {
-				if logEnable(logWARN) {
-					logit("filter command %q failed at %s - %s", substituted, id, err)
-				}
-			}
-			return string(content), err
-		}
+		fc.sub = shellFilter(strings.TrimSpace(fields[1]))
 		return fc
 	}
 	lp.parse()
@@ -3530,6 +4411,79 @@ func (rs *Reposurgeon) DoFilter(line string) (StopOut bool) {
 	return false
 }
 
+// HelpBlobs says "Shut up, golint!"
+func (rs *Reposurgeon) HelpBlobs() {
+	rs.helpOutput(`
+[SELECTION] blobs census [>OUTFILE]
+[SELECTION] blobs filter <RULEFILE
+
+Work with the content types of the selected blobs, defaulting to all
+of them.  The type of a blob is sniffed from the first 512 bytes of its
+content, as web browsers do, giving a media type such as text/plain,
+text/xml, image/jpeg or application/zip, or application/octet-stream if
+nothing is recognized.  It is remembered until the content changes.
+The mimetype field of event expressions holds it, so that for example
+{mimetype =~ "^image/"} selects images.
+
+With "census", report for each type the number of blobs and their
+total size in bytes, the most numerous first.
+
+With "filter", read a table of rules and run each blob through the
+shell command of the first rule its type matches, in one pass.  Each
+line of the table is a glob matching types, such as image/jpeg or
+text/*, then the command; a command of "-" leaves the blobs of the
+types it matches alone.  Blank lines and lines beginning with # are
+ignored.  Commands are used as with "filter shell", content going in
+on standard input and coming back on standard output, and %PATHS% in
+a command is replaced by the paths that reference the blob.  Inline
+content is not filtered.
+
+Filter sets Q bits; blobs modified get true, all other events false.
+
+----
+# Strip metadata from photographs and reindent XML
+blobs filter <<EOF
+image/jpeg exiftool -all= -
+text/xml xmllint --format -
+EOF
+----
+`)
+}
+
+// CompleteBlobs is a completion hook over blobs subcommands
+func (rs *Reposurgeon) CompleteBlobs(text string) []string {
+	return []string{"census", "filter"}
+}
+
+// DoBlobs reports and filters blobs by content type.
+func (rs *Reposurgeon) DoBlobs(line string) bool {
+	parse := rs.newLineParse(line, "blobs", parseALLREPO|parseNOOPTS|parseNEEDARG, orderedStringSet{"stdin", "stdout"})
+	defer parse.Closem()
+	repo := rs.chosen()
+	switch parse.args[0] {
+	case "census":
+		if len(parse.args) > 1 || parse.infile != "" {
+			croak("blobs census takes no arguments and no input redirect")
+			return false
+		}
+		repo.blobTypeCensus(parse.stdout, rs.selection)
+	case "filter":
+		if len(parse.args) > 1 || parse.infile == "" || parse.outfile != "" {
+			croak("blobs filter takes no arguments and requires an input redirect")
+			return false
+		}
+		rules, err := readBlobTypeRules(parse.stdin)
+		if err != nil {
+			croak("%v", err)
+			return false
+		}
+		respond("%d blobs modified.", repo.filterByType(rs.selection, rules))
+	default:
+		croak("blobs requires a census or filter verb")
+	}
+	return false
+}
+
 // HelpTranscode says "Shut up, golint!"
 func (rs *Reposurgeon) HelpTranscode() {
 	rs.helpOutput(`
@@ -3588,9 +4542,7 @@ func (rs *Reposurgeon) DoTranscode(line string) bool {
 	transcode := func(txt string, id string, _ map[string]string) string {
 		out, err := decoder.Bytes([]byte(txt))
 		if err != nil {
-			if logEnable(logWARN) {
-				logit("decode error during transcoding of %s: %v", id, err)
-			}
+			warn("transcode", "decode error during transcoding of %s: %v", id, err)
 			return txt
 		}
 		return string(out)
@@ -3603,6 +4555,137 @@ func (rs *Reposurgeon) DoTranscode(line string) bool {
 	return false
 }
 
+// HelpKeywords says "Shut up, golint!"
+func (rs *Reposurgeon) HelpKeywords() {
+	rs.helpOutput(`
+[SELECTION] keywords {collapse|expand} [PATH-PATTERN]
+
+Process RCS/CVS/Subversion $-keywords ($Id$, $Revision$, $Date$,
+$Author$, $Header$, $HeadURL$, $RCSfile$, $Source$, and the Subversion
+LastChanged aliases) in the content of files modified by the selected
+commits. The default selection is all commits. If a PATH-PATTERN is
+given, only files whose paths match it are processed.
+
+"keywords collapse" reduces expanded keywords to their bare form, so
+that "$Id: foo.c,v 1.2 2004/03/01 12:00:00 fred Exp $" becomes "$Id$".
+This is the usual way to stop keyword expansions from showing up as
+spurious content changes after conversion.
+
+"keywords expand" fills in keywords the way the originating VCS would
+have on checkout, using the commit's legacy ID as the revision; a
+legacy ID containing a dot is taken to mean CVS/RCS expansion style,
+otherwise Subversion style is used.  Commits with no legacy ID are left
+alone. A blob shared by several file modifications that expand
+differently is split into a separate blob for each.
+
+$Log$ is not processed. Content that looks binary (has a NUL byte
+near its start) is never modified.
+
+This command sets Q bits; blobs and commits actually modified by the
+command get true, all other events get false.
+
+----
+# Collapse keywords in all C sources
+keywords collapse /\.[ch]$/
+----
+`)
+}
+
+// DoKeywords is the handler for the "keywords" command.
+func (rs *Reposurgeon) DoKeywords(line string) bool {
+	parse := rs.newLineParse(line, "keywords", parseALLREPO|parseNOOPTS|parseNEEDARG, nil)
+	var expand bool
+	switch parse.args[0] {
+	case "collapse":
+		expand = false
+	case "expand":
+		expand = true
+	default:
+		croak("keywords requires a collapse or expand verb.")
+		return false
+	}
+	pathRE := regexp.MustCompile("")
+	if len(parse.args) > 1 {
+		pathRE = parse.getPattern(parse.args[1], "path")
+	}
+	altered := rs.chosen().keywords(rs.selection, pathRE, expand, control.baton)
+	respond("%d file modifications altered.", altered)
+	return false
+}
+
+// HelpEol says "Shut up, golint!"
+func (rs *Reposurgeon) HelpEol() {
+	rs.helpOutput(`
+[SELECTION] eol {audit|normalize [lf|crlf]} [PATH-PATTERN] [>OUTFILE]
+
+Classify the content of files modified by the selected commits as
+binary or text, and deal with their line endings. The default
+selection is all commits. If a PATH-PATTERN is given, only files whose
+paths match it are looked at. Content is binary if it has a NUL byte
+near its start, as git judges it; everything else is text.
+
+"eol audit" lists, for each commit, the files it modifies whose text
+mixes CR-LF and bare LF line endings or is not valid UTF-8, then
+summarizes the classes of all the content it saw and lists every path
+that had mixed line endings anywhere. It sets Q bits: true on commits
+with mixed files, false on all other events.
+
+"eol normalize" rewrites the line endings of text content to LF or
+CR-LF. With no convention given, CR-LF is used if the crlf option is
+set and LF otherwise. Binary content and lone CRs are left alone. A
+blob is rewritten everywhere it is used, even by commits outside the
+selection. If the canonicalize option is set, the comments of the
+selected commits are canonicalized too. This sets Q bits: true on
+blobs and commits actually modified, false on all other events.
+
+----
+# See where the line endings go wrong, then fix the sources
+eol audit
+eol normalize lf /\.[ch]$/
+----
+`)
+}
+
+// CompleteEol is a completion hook over eol verbs
+func (rs *Reposurgeon) CompleteEol(text string) []string {
+	return []string{"audit", "crlf", "lf", "normalize"}
+}
+
+// DoEol is the handler for the "eol" command.
+func (rs *Reposurgeon) DoEol(line string) bool {
+	parse := rs.newLineParse(line, "eol", parseALLREPO|parseNOOPTS|parseNEEDARG, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	verb, args := parse.args[0], parse.args[1:]
+	sep := control.lineSep
+	if verb == "normalize" && len(args) > 0 {
+		switch args[0] {
+		case "lf":
+			sep, args = "\n", args[1:]
+		case "crlf":
+			sep, args = "\r\n", args[1:]
+		}
+	}
+	pathRE := regexp.MustCompile("")
+	if len(args) > 1 {
+		croak("eol takes at most one path pattern.")
+		return false
+	} else if len(args) == 1 {
+		pathRE = parse.getPattern(args[0], "path")
+	}
+	repo := rs.chosen()
+	switch verb {
+	case "audit":
+		repo.eolAudit(parse.stdout, rs.selection, pathRE)
+	case "normalize":
+		altered := repo.eolNormalize(rs.selection, pathRE, sep,
+			control.flagOptions["canonicalize"], control.baton)
+		respond("%d contents altered.", altered)
+	default:
+		croak("eol requires an audit or normalize verb.")
+	}
+	return false
+}
+
 // HelpSetfield says "Shut up, golint!"
 func (rs *Reposurgeon) HelpSetfield() {
 	rs.helpOutput(`
@@ -3694,6 +4777,225 @@ func (rs *Reposurgeon) DoSetfield(line string) bool {
 	return false
 }
 
+// HelpMap says "Shut up, golint!"
+func (rs *Reposurgeon) HelpMap() {
+	rs.helpOutput(`
+{SELECTION} map FIELD {EXPRESSION}
+
+Set FIELD of each selected event to the value of an event expression
+(see "help expressions") evaluated on that event.  The values are all
+computed before any is set.  FIELD is one of comment, branch (of a
+commit or reset), tagname, legacy, author, authoremail, committer, or
+committeremail; events without the field are left alone.  Author and
+committer fields of a tag set its tagger.  For example, to
+lowercase the email addresses of all committers:
+
+----
+=C map committeremail {lower(committeremail)}
+----
+
+Clears all Q bits, then sets them on events that are actually
+modified.
+`)
+}
+
+// CompleteMap is a completion hook over the settable fields.
+func (rs *Reposurgeon) CompleteMap(text string) []string {
+	fields := make([]string, 0, len(exprSetters))
+	for field := range exprSetters {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// DoMap is the handler for the "map" command.
+func (rs *Reposurgeon) DoMap(line string) bool {
+	line = strings.TrimLeft(line, " \t")
+	i := strings.IndexAny(line, " \t{")
+	if i == -1 {
+		croak("map requires a field and an expression")
+		return false
+	}
+	field := line[:i]
+	if _, ok := exprSetters[field]; !ok {
+		croak("map: %q is not a field map can set", field)
+		return false
+	}
+	node, rest := compileBracedExpr(line[i:])
+	parse := rs.newLineParse(rest, "map", parseREPO|parseNEEDSELECT|parseNOREDIRECT|parseNOOPTS, nil)
+	defer parse.Closem()
+	if len(parse.args) > 0 {
+		croak("map: unexpected %q after the expression", parse.args[0])
+		return false
+	}
+	changed := rs.chosen().exprMap(rs.selection, field, node)
+	respond("%d events modified", changed)
+	return false
+}
+
+// HelpProperty says "Shut up, golint!"
+func (rs *Reposurgeon) HelpProperty() {
+	rs.helpOutput(`
+[SELECTION] property list [KEY-PATTERN] [>OUTFILE]
+[SELECTION] property set NAME {VALUE|--from-path=PATH}
+[SELECTION] property delete KEY-PATTERN [VALUE-PATTERN]
+[SELECTION] property rename KEY-PATTERN NEWNAME
+[SELECTION] property rewrite KEY-PATTERN VALUE-PATTERN REPLACEMENT
+[SELECTION] property extract [KEY-PATTERN]
+[SELECTION] property embed KEY-PATTERN
+
+Inspect and edit commit properties in bulk. Properties come from
+Subversion revision properties other than svn:log, svn:author, and
+svn:date, and from the property extension of fast-import streams;
+they are written to Subversion dumps and to streams for VCSes that
+support them. The selection defaults to all commits.
+
+A KEY-PATTERN or VALUE-PATTERN is a regular expression if it is
+delimited by a punctuation character other than single quote, as in
+/svn:.*/, and otherwise must match the whole key or value exactly.
+
+With "list", show the event number, key, and quoted value of each
+property, or only of those whose keys match KEY-PATTERN. Supports >
+redirection.
+
+With "set", give every selected commit the property NAME with value
+VALUE, a token that may be a double-quoted string with C-style
+escapes. With --from-path=PATH the value is instead the content of
+PATH in each commit's tree; commits without that file are left alone.
+
+With "delete", remove properties whose keys match KEY-PATTERN and, if
+VALUE-PATTERN is given, whose values match it.
+
+With "rename", change every key that KEY-PATTERN matches, replacing
+the match with NEWNAME, which may use ${1}-style references to
+groups. A property keeps its place; a renamed property replaces any
+other of the same name.
+
+With "rewrite", replace the matches of VALUE-PATTERN in the values of
+properties whose keys match KEY-PATTERN with REPLACEMENT, which may
+also refer to groups.
+
+With "extract", move trailers such as "Reviewed-by: J. Random Hacker
+<jrh@example.com>" or "Change-Id: I1234" out of comments into
+properties named by their keys, so selections and edits can get at
+them and targets that keep properties keep them.  Only trailers whose
+keys match KEY-PATTERN are moved, all of them if it is omitted.  The
+trailers of a comment are the lines of its last paragraph, if every
+line there is either "Key: value" or an indented continuation of the
+line before; the summary paragraph never counts.  Several trailers
+with the same key become one property whose value is their values a
+line each.  A property of the same name already present is replaced.
+
+With "embed", do the opposite: move properties whose keys match
+KEY-PATTERN, and could be trailer keys, into trailers at the end of
+the comment, one per line of the value.
+
+Sets Q bits: true on commits whose properties were changed, false on
+all other events.
+
+----
+# Drop merge tracking left over from Subversion
+property delete svn:mergeinfo
+# Record each commit's ignore patterns for an svn dump
+property set svn:ignore --from-path=.gitignore
+----
+`)
+}
+
+// CompleteProperty is a completion hook over property subcommands
+func (rs *Reposurgeon) CompleteProperty(text string) []string {
+	return []string{"delete", "embed", "extract", "list", "rename", "rewrite", "set"}
+}
+
+// DoProperty is the handler for the "property" command.
+func (rs *Reposurgeon) DoProperty(line string) bool {
+	verb, rest := splitRuneFirst(strings.TrimSpace(line), ' ')
+	rest = strings.TrimSpace(rest)
+	switch verb {
+	case "list":
+		parse := rs.newLineParse(rest, "property list", parseALLREPO|parseNOOPTS, orderedStringSet{"stdout"})
+		defer parse.Closem()
+		if len(parse.args) > 1 {
+			croak("property list takes at most one key pattern")
+			return false
+		}
+		keyRE := regexp.MustCompile("")
+		if len(parse.args) == 1 {
+			keyRE = parse.getPattern(parse.args[0], "text")
+		}
+		repo := rs.chosen()
+		for it := repo.commitIterator(rs.selection); it.Next(); {
+			commit := it.commit()
+			if !commit.hasProperties() {
+				continue
+			}
+			for _, key := range commit.properties.keys {
+				if keyRE.MatchString(key) {
+					fmt.Fprintf(parse.stdout, "%6d %s %s\n", it.Value()+1, key, strconv.Quote(commit.properties.get(key)))
+				}
+			}
+		}
+		return false
+	case "set", "delete", "rename", "rewrite":
+		parse := rs.newLineParse(rest, "property "+verb, parseALLREPO|parseNOREDIRECT, nil)
+		edit := &propertyEdit{verb: verb}
+		wantArgs := map[string]int{"set": 2, "delete": 1, "rename": 2, "rewrite": 3}[verb]
+		if path, present := parse.OptVal("--from-path"); verb == "set" && present && path != "" {
+			wantArgs = 1
+			edit.path = path
+		} else if len(parse.options) > 0 {
+			croak("property %s takes no options", verb)
+			return false
+		}
+		if len(parse.args) != wantArgs && !(verb == "delete" && len(parse.args) == 2) {
+			croak("wrong number of arguments to property %s", verb)
+			return false
+		}
+		switch verb {
+		case "set":
+			edit.name = parse.args[0]
+			if edit.path == "" {
+				value, err := stringEscape(parse.args[1])
+				if err != nil {
+					croak("bad escape in property value: %v", err)
+					return false
+				}
+				edit.value = value
+			}
+		case "delete":
+			edit.keyRE = parse.getPattern(parse.args[0], "text")
+			if len(parse.args) == 2 {
+				edit.valueRE = parse.getPattern(parse.args[1], "text")
+			}
+		case "rename":
+			edit.keyRE = parse.getPattern(parse.args[0], "text")
+			edit.name = parse.args[1]
+		case "rewrite":
+			edit.keyRE = parse.getPattern(parse.args[0], "text")
+			edit.valueRE = parse.getPattern(parse.args[1], "text")
+			edit.value = parse.args[2]
+		}
+		properties, commits := rs.chosen().editProperties(rs.selection, edit)
+		respond("%d properties changed in %d commits", properties, commits)
+	case "extract", "embed":
+		parse := rs.newLineParse(rest, "property "+verb, parseALLREPO|parseNOREDIRECT|parseNOOPTS, nil)
+		if len(parse.args) > 1 || verb == "embed" && len(parse.args) == 0 {
+			croak("wrong number of arguments to property %s", verb)
+			return false
+		}
+		keyRE := regexp.MustCompile("")
+		if len(parse.args) == 1 {
+			keyRE = parse.getPattern(parse.args[0], "text")
+		}
+		trailers, commits := rs.chosen().trailerProperties(rs.selection, keyRE, verb == "embed")
+		respond("%d trailers moved in %d commits", trailers, commits)
+	default:
+		croak("property requires a list, set, delete, rename, rewrite, extract, or embed subcommand")
+	}
+	return false
+}
+
 // HelpSetperm says "Shut up, golint!"
 func (rs *Reposurgeon) HelpSetperm() {
 	rs.helpOutput(`
@@ -3745,52 +5047,469 @@ func (rs *Reposurgeon) DoSetperm(line string) bool {
 	return false
 }
 
-// HelpAppend says "Shut up, golint!"
-func (rs *Reposurgeon) HelpAppend() {
+// HelpModes says "Shut up, golint!"
+func (rs *Reposurgeon) HelpModes() {
 	rs.helpOutput(`
-SELECTION append [--rstrip] [--legacy] TEXT
+[SELECTION] modes audit [>OUTFILE]
+[SELECTION] modes repair
+[SELECTION] modes pin PATH-PATTERN MODE
 
-Append text to the comments of commits and tags in the specified
-selection set. The text is the first token of the command and may be a
-double-quoted string containing whitespace. C-style escape sequences
-in TEXT are interpreted.
+Check and fix file modes in the selected commits, defaulting to all.
 
-If the option --rstrip is given, the comment is right-stripped before
-the new text is appended. If the option --legacy is given, the string
-%LEGACY% in the append payload is replaced with the commit's legacy-ID
-before it is appended.
+With "audit", list for each commit the files it adds or modifies that
+begin with "#!" but don't have mode 100755, and the symbolic links it
+makes whose targets are absolute or climb out of the tree.  Then list
+the paths whose mode changes more than once over the selection, which
+usually means a checkout without an executable bit or without links
+has been flipping it.  Commits with problems get Q bits.
 
-Sets Q bits: true for each commit and tag modified, false otherwise.
+With "repair", give the scripts an audit finds mode 100755.
 
-Example:
----------
-=C append --legacy "\nLegacy-Id: %LEGACY%"
----------
+With "pin", give every ordinary file whose path matches PATH-PATTERN
+the mode MODE, 100644 or 100755, which stops a mode from flipping.
+PATH-PATTERN is a literal path or, delimited as in /\.sh$/, a regular
+expression.  Symbolic links and submodules are never changed.
+
+Repair and pin clear all Q bits, then set them on altered commits.
 `)
 }
 
-// CompleteAppend is a completion hook over append options
-func (rs *Reposurgeon) CompleteAppend(text string) []string {
-	return []string{"--legacy", "--rstrip"}
+// CompleteModes is a completion hook over mode subcommands.
+func (rs *Reposurgeon) CompleteModes(text string) []string {
+	return []string{"audit", "pin", "repair"}
 }
 
-// DoAppend appends a specified line to comments in the specified selection set.
-func (rs *Reposurgeon) DoAppend(line string) bool {
-	parse := rs.newLineParse(line, "append", parseREPO|parseNEEDSELECT, nil)
+// DoModes audits and repairs file modes.
+func (rs *Reposurgeon) DoModes(line string) bool {
+	parse := rs.newLineParse(line, "modes", parseALLREPO|parseNOOPTS|parseNEEDARG, orderedStringSet{"stdout"})
 	defer parse.Closem()
-	if len(parse.args) == 0 {
-		croak("missing append text")
+	repo := rs.chosen()
+	verb, args := parse.args[0], parse.args[1:]
+	if verb != "audit" && parse.redirected {
+		croak("modes %s takes no redirection.", verb)
 		return false
 	}
-	text, err := stringEscape(parse.args[0])
-	if err != nil {
-		croak(err.Error())
+	switch verb {
+	case "audit":
+		if len(args) > 0 {
+			croak("modes audit takes no arguments.")
+			return false
+		}
+		repo.modeAudit(parse.stdout, rs.selection)
+	case "repair":
+		if len(args) > 0 {
+			croak("modes repair takes no arguments.")
+			return false
+		}
+		respond("%d modes changed.", repo.modeRepair(rs.selection))
+	case "pin":
+		if len(args) != 2 {
+			croak("modes pin requires a path pattern and a mode.")
+			return false
+		}
+		if !regularModes.Contains(args[1]) {
+			croak("modes pin requires mode 100644 or 100755.")
+			return false
+		}
+		pathRE := parse.getPattern(args[0], "path")
+		respond("%d modes changed.", repo.modePin(rs.selection, pathRE, args[1]))
+	default:
+		croak("modes requires an audit, repair, or pin verb.")
+	}
+	return false
+}
+
+// HelpNotes says "Shut up, golint!"
+func (rs *Reposurgeon) HelpNotes() {
+	rs.helpOutput(`
+[SELECTION] notes list [>OUTFILE]
+[SELECTION] notes fold [--ref=REF] [--delete]
+
+Operate on git notes, the text git attaches to commits after the fact
+and keeps on branches under refs/notes/.  Each note is an N fileop in
+a commit on such a branch naming the commit it annotates.  The
+selection, defaulting to all commits, is of annotated commits.
+
+Notes follow the commits they annotate through the repository's
+surgery.  When squash or delete removes an annotated commit its notes
+move to the commit its tags move to, or are dropped with it if the
+tags would be; renumbering renumbers the marks in notes.
+
+With "list", show each note on a selected commit: the commit, the
+notes ref, and the first line of the note.
+
+With "fold", append each note on a selected commit to its comment,
+as git log shows it: a line "Notes:", or "Notes (NAME):" for notes
+not on refs/notes/commits, followed by the note indented four spaces.
+With --ref, fold only notes on that ref, given in full or by its name
+under refs/notes/.  With --delete, remove the folded notes from their
+notes commits, which leaves a notes branch with nothing to say to be
+deleted by the usual means.  All Q bits are cleared, then set on
+commits whose comments changed.
+`)
+}
+
+// CompleteNotes is a completion hook over notes subcommands.
+func (rs *Reposurgeon) CompleteNotes(text string) []string {
+	return []string{"fold", "list"}
+}
+
+// DoNotes lists notes and folds them into comments.
+func (rs *Reposurgeon) DoNotes(line string) bool {
+	parse := rs.newLineParse(line, "notes", parseALLREPO|parseNEEDARG, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	repo := rs.chosen()
+	verb, args := parse.args[0], parse.args[1:]
+	if len(args) > 0 {
+		croak("notes %s takes no arguments.", verb)
 		return false
 	}
-	rs.chosen().clearColor(colorQSET)
-	for it := rs.selection.Iterator(); it.Next(); {
-		event := rs.chosen().events[it.Value()]
-		switch event.(type) {
+	switch verb {
+	case "list":
+		if len(parse.options) > 0 {
+			croak("notes list takes no options.")
+			return false
+		}
+		repo.listNotes(parse.stdout, rs.selection)
+	case "fold":
+		if parse.redirected {
+			croak("notes fold takes no redirection.")
+			return false
+		}
+		ref, _ := parse.OptVal("--ref")
+		if ref != "" && !isNotesRef(ref) {
+			ref = notesPrefix + ref
+		}
+		n := repo.foldNotes(rs.selection, ref, parse.options.Contains("--delete"))
+		respond("%d notes folded.", n)
+	default:
+		croak("notes requires a list or fold verb.")
+	}
+	return false
+}
+
+// HelpSubmodule says "Shut up, golint!"
+func (rs *Reposurgeon) HelpSubmodule() {
+	rs.helpOutput(`
+[SELECTION] submodule list [PATH] [>OUTFILE]
+[SELECTION] submodule remap [<MAPFILE]
+[SELECTION] submodule embed PATH REPO
+[SELECTION] submodule collapse PATH REPO
+
+Operate on submodule links (gitlinks): M fileops with mode 160000 whose
+ref is the hash of a commit in another repository.  Reposurgeon
+otherwise passes these through unexamined.  The selection set defaults
+to all commits.
+
+"list" reports each gitlink in the selection, optionally only those at
+PATH, as the commit's event number, mark, path and target hash.
+
+"remap" rewrites gitlink targets through a map read from standard
+input, for when the submodule's own history has been rewritten.  Each
+line holds an old and a new hash separated by whitespace; blank lines
+and lines beginning with # are ignored.  Gitlinks whose target is not
+in the map are left alone.
+
+"embed" expands each gitlink at PATH into the files of the commit it
+points at, which must be in the loaded repository REPO, found by
+computed hash or by recorded original-oid.  The gitlink becomes a
+delete of PATH followed by the whole tree of the target commit, with
+its blobs copied in.  Gitlinks whose target is not found are warned
+about and left alone.
+
+"collapse" does the reverse: in each commit that changes anything
+under the directory PATH, the fileops there are replaced by a single
+gitlink to the earliest commit in REPO whose tree matches the
+directory's contents, or by a delete if the directory is gone.
+Commits with no matching commit in REPO, or that rename or copy files
+out of PATH, are warned about and left alone.  Blobs no longer
+referenced can be removed afterwards with "gc".
+
+None of these edit .gitmodules, which should be made to agree.
+`)
+}
+
+// CompleteSubmodule is a completion hook across submodule verbs
+func (rs *Reposurgeon) CompleteSubmodule(text string) []string {
+	return []string{"collapse", "embed", "list", "remap"}
+}
+
+// DoSubmodule is the handler for the "submodule" command.
+func (rs *Reposurgeon) DoSubmodule(line string) bool {
+	parse := rs.newLineParse(line, "submodule", parseALLREPO|parseNEEDARG|parseNOOPTS, orderedStringSet{"stdin", "stdout"})
+	defer parse.Closem()
+	repo := rs.chosen()
+	verb, args := parse.args[0], parse.args[1:]
+	switch verb {
+	case "list":
+		if len(args) > 1 {
+			croak("submodule list takes at most one path")
+			return false
+		}
+		path := ""
+		if len(args) == 1 {
+			path = args[0]
+		}
+		for _, link := range repo.gitlinks(rs.selection, path) {
+			fmt.Fprintf(parse.stdout, "%6d %6s %s %s\n",
+				repo.eventToIndex(link.commit)+1, link.commit.mark, link.op.Path, link.op.ref)
+		}
+	case "remap":
+		if len(args) != 0 {
+			croak("submodule remap reads its map from standard input")
+			return false
+		}
+		mapping, err := readGitlinkMap(parse.stdin)
+		if err != nil {
+			croak("%v", err)
+			return false
+		}
+		changed := repo.remapGitlinks(rs.selection, mapping)
+		respond("%d gitlinks remapped.", changed)
+	case "embed", "collapse":
+		if len(args) != 2 {
+			croak("submodule %s requires a path and a repository name", verb)
+			return false
+		}
+		path := strings.Trim(args[0], "/")
+		source := rs.repoByName(args[1])
+		if source == repo {
+			croak("submodule %s needs a different repository", verb)
+			return false
+		}
+		if verb == "embed" {
+			n := repo.embedSubmodule(rs.selection, path, source)
+			respond("%d gitlinks embedded.", n)
+		} else {
+			n := repo.collapseSubtree(rs.selection, path, source)
+			respond("%d commits collapsed to gitlinks.", n)
+		}
+	default:
+		croak("submodule requires a list, remap, embed, or collapse subcommand")
+	}
+	return false
+}
+
+// HelpPassthrough says "Shut up, golint!"
+func (rs *Reposurgeon) HelpPassthrough() {
+	rs.helpOutput(`
+[SELECTION] passthrough {list | add [--front] TEXT | delete | rewrite FILTER-SPEC}
+
+Inspect and edit passthroughs - feature lines, option lines, comments,
+"done", and other stream lines that reposurgeon carries through a
+read and write unaltered. Passthroughs are matched with the usual
+selection syntax; "=P" selects all of them, and a text search with
+the "p" modifier matches against their text, e.g. "/^feature/p".
+
+With "list", show the event number and text of each passthrough in
+the selection, by default all passthroughs. Supports > redirection.
+
+With "add", insert a passthrough with the given text, which may be a
+double-quoted string (necessary if it contains a "#" or whitespace)
+and in which C-style escapes are interpreted. A trailing newline is
+supplied if missing. With --front the passthrough goes at the start
+of the stream, where feature and option lines belong. Otherwise, with
+a selection, it goes immediately after the last selected event; with
+no selection it goes at the end of the stream, before any terminating
+"done".
+
+With "delete", remove the passthroughs in the selection, which must be
+given explicitly. Other selected events are ignored.
+
+With "rewrite", run the text of the passthroughs in the selection, by
+default all of them, through a filter specified as for the "filter"
+command: "regex /FROM/TO/", "replace /FROM/TO/", or "shell COMMAND".
+A passthrough rewritten to empty text is deleted.
+
+"rewrite" sets Q bits; passthroughs modified get true, all other
+events get false.
+
+----
+# Add a feature declaration to the front of the stream
+passthrough add --front "feature done"
+# Remove comments left by an exporter
+/^# exported by/p passthrough delete
+----
+`)
+}
+
+// CompletePassthrough is a completion hook over passthrough subcommands
+func (rs *Reposurgeon) CompletePassthrough(text string) []string {
+	return []string{"add", "delete", "list", "rewrite"}
+}
+
+// DoPassthrough is the handler for the "passthrough" command.
+func (rs *Reposurgeon) DoPassthrough(line string) bool {
+	verb, rest := splitRuneFirst(strings.TrimSpace(line), ' ')
+	rest = strings.TrimSpace(rest)
+	switch verb {
+	case "list":
+		parse := rs.newLineParse(rest, "passthrough list", parseALLREPO|parseNOARGS|parseNOOPTS, orderedStringSet{"stdout"})
+		defer parse.Closem()
+		repo := rs.chosen()
+		for _, p := range repo.passthroughs(rs.selection) {
+			fmt.Fprintf(parse.stdout, "%6d %q\n", repo.eventToIndex(p)+1, p.text)
+		}
+	case "add":
+		parse := rs.newLineParse(rest, "passthrough add", parseREPO|parseNEEDARG|parseNOREDIRECT, nil)
+		if len(parse.args) != 1 {
+			croak("passthrough add requires exactly one text argument")
+			return false
+		}
+		text, err := stringEscape(parse.args[0])
+		if err != nil {
+			croak("while adding passthrough: %v", err)
+			return false
+		}
+		repo := rs.chosen()
+		after := -1
+		if rs.selection.isDefined() && rs.selection.Size() > 0 {
+			after = rs.selection.Max()
+		}
+		repo.addPassthrough(text, parse.options.Contains("--front"), after)
+	case "delete":
+		rs.newLineParse(rest, "passthrough delete", parseREPO|parseNEEDSELECT|parseNOARGS|parseNOOPTS|parseNOREDIRECT, nil)
+		count := rs.chosen().deletePassthroughs(rs.selection)
+		respond("%d passthroughs deleted.", count)
+	case "rewrite":
+		parse := rs.newLineParse(rest, "passthrough rewrite", parseALLREPO|parseNEEDARG|parseNOREDIRECT, nil)
+		filterhook := newFilterCommand(parse)
+		if filterhook == nil {
+			return false
+		}
+		repo := rs.chosen()
+		hook := func(text string) string {
+			return filterhook.do(text, "passthrough", map[string]string{})
+		}
+		modified, deleted := repo.rewritePassthroughs(rs.selection, hook)
+		respond("%d passthroughs modified, %d deleted.", modified, deleted)
+	default:
+		croak("passthrough requires a list, add, delete, or rewrite subcommand")
+	}
+	return false
+}
+
+// HelpOption says "Shut up, golint!"
+func (rs *Reposurgeon) HelpOption() {
+	rs.helpOutput(`
+[SELECTION] option list [>OUTFILE]
+option policy [target|keep|strip] [>OUTFILE]
+
+Inspect stream option lines and control which of them are written.
+An option line has the form "option VCS NAME[=VALUE]" and is meant
+for the importer of the named VCS. Option lines are kept as
+passthroughs, so they can also be edited with "passthrough".
+
+With "list", show the event number, VCS, name and value of each option
+line in the selection, by default all of them. Supports > redirection.
+
+With "policy", set which option lines are written. Under "target",
+the default, only the options addressed to the VCS being written for
+are emitted: the target of a rebuild or, for a write, the preferred
+type (see "prefer"). If no type is known, all are emitted.
+"keep" always emits all option lines, as older versions of reposurgeon
+did; "strip" never emits any. With no argument, report the policy; this
+supports > redirection.
+
+When a stream is read, an option line for a VCS other than git is
+taken as a weak hint about the stream's source type. Options addressed
+to reposurgeon itself set parser switches; the only one at present is
+"option reposurgeon sourcetype=VCS", which acts like a "#reposurgeon
+sourcetype" comment.
+`)
+}
+
+// CompleteOption is a completion hook over option subcommands
+func (rs *Reposurgeon) CompleteOption(text string) []string {
+	return []string{"list", "policy"}
+}
+
+// DoOption is the handler for the "option" command.
+func (rs *Reposurgeon) DoOption(line string) bool {
+	verb, rest := splitRuneFirst(strings.TrimSpace(line), ' ')
+	rest = strings.TrimSpace(rest)
+	switch verb {
+	case "list":
+		parse := rs.newLineParse(rest, "option list", parseALLREPO|parseNOARGS|parseNOOPTS, orderedStringSet{"stdout"})
+		defer parse.Closem()
+		repo := rs.chosen()
+		events, opts := repo.options(rs.selection)
+		for i, opt := range opts {
+			fmt.Fprintf(parse.stdout, "%6d %s %s", repo.eventToIndex(events[i])+1, opt.vcs, opt.name)
+			if opt.value != "" {
+				fmt.Fprintf(parse.stdout, " %s", opt.value)
+			}
+			fmt.Fprintln(parse.stdout)
+		}
+	case "policy":
+		parse := rs.newLineParse(rest, "option policy", parseREPO|parseNOSELECT|parseNOOPTS, orderedStringSet{"stdout"})
+		defer parse.Closem()
+		repo := rs.chosen()
+		if len(parse.args) == 0 {
+			policy := repo.optionPolicy
+			if policy == "" {
+				policy = optionPolicies[0]
+			}
+			fmt.Fprintln(parse.stdout, policy)
+			return false
+		}
+		if len(parse.args) != 1 || !newOrderedStringSet(optionPolicies...).Contains(parse.args[0]) {
+			croak("option policy must be one of %s", strings.Join(optionPolicies, ", "))
+			return false
+		}
+		repo.optionPolicy = parse.args[0]
+	default:
+		croak("option requires a list or policy subcommand")
+	}
+	return false
+}
+
+// HelpAppend says "Shut up, golint!"
+func (rs *Reposurgeon) HelpAppend() {
+	rs.helpOutput(`
+SELECTION append [--rstrip] [--legacy] TEXT
+
+Append text to the comments of commits and tags in the specified
+selection set. The text is the first token of the command and may be a
+double-quoted string containing whitespace. C-style escape sequences
+in TEXT are interpreted.
+
+If the option --rstrip is given, the comment is right-stripped before
+the new text is appended. If the option --legacy is given, the string
+%LEGACY% in the append payload is replaced with the commit's legacy-ID
+before it is appended.
+
+Sets Q bits: true for each commit and tag modified, false otherwise.
+
+Example:
+---------
+=C append --legacy "\nLegacy-Id: %LEGACY%"
+---------
+`)
+}
+
+// CompleteAppend is a completion hook over append options
+func (rs *Reposurgeon) CompleteAppend(text string) []string {
+	return []string{"--legacy", "--rstrip"}
+}
+
+// DoAppend appends a specified line to comments in the specified selection set.
+func (rs *Reposurgeon) DoAppend(line string) bool {
+	parse := rs.newLineParse(line, "append", parseREPO|parseNEEDSELECT, nil)
+	defer parse.Closem()
+	if len(parse.args) == 0 {
+		croak("missing append text")
+		return false
+	}
+	text, err := stringEscape(parse.args[0])
+	if err != nil {
+		croak(err.Error())
+		return false
+	}
+	rs.chosen().clearColor(colorQSET)
+	for it := rs.selection.Iterator(); it.Next(); {
+		event := rs.chosen().events[it.Value()]
+		switch event.(type) {
 		case *Commit:
 			commit := event.(*Commit)
 			if parse.options.Contains("--rstrip") {
@@ -3904,7 +5623,10 @@ oytherwise.
 // DoSquash squashes events in the specified selection set.
 func (rs *Reposurgeon) DoSquash(line string) bool {
 	parse := rs.newLineParse(line, "squash", parseREPO|parseNEEDSELECT, nil)
-	rs.chosen().squash(rs.selection, parse.options, control.baton)
+	rs.chosen().checkpointUndo("squash", control.baton)
+	if err := rs.chosen().squash(control.interruptible(), rs.selection, parse.options, control.baton); err != nil {
+		croak(err.Error())
+	}
 	return false
 }
 
@@ -3998,7 +5720,10 @@ func (rs *Reposurgeon) DoDelete(line string) bool {
 	case "commit":
 		parse.flagcheck(parseNEEDSELECT)
 		parse.options.Add("--delete")
-		repo.squash(rs.selection, parse.options, control.baton)
+		repo.checkpointUndo("delete", control.baton)
+		if err := repo.squash(control.interruptible(), rs.selection, parse.options, control.baton); err != nil {
+			croak(err.Error())
+		}
 		return false
 	case "path":
 		parse.flagcheck(parseREPO | parseALLREPO)
@@ -4006,6 +5731,7 @@ func (rs *Reposurgeon) DoDelete(line string) bool {
 			croak("required expunge pattern argument is missing.")
 			return false
 		}
+		repo.checkpointUndo("delete path", control.baton)
 		err := rs.chosen().expunge(rs.selection, parse.getPattern(parse.args[1], "path"),
 			!parse.options.Contains("--not"), parse.options.Contains("--notagify"), control.baton)
 		if err != nil {
@@ -4033,6 +5759,7 @@ func (rs *Reposurgeon) DoDelete(line string) bool {
 			return false
 		}
 
+		repo.checkpointUndo("delete tag", control.baton)
 		control.baton.startProcess("tag deletion", "")
 		for _, tag := range tags {
 			// the order here in important
@@ -4054,6 +5781,7 @@ func (rs *Reposurgeon) DoDelete(line string) bool {
 			return branchRE.MatchString(branch) == !parse.options.Contains("--not")
 		}
 		before := len(repo.branchset())
+		repo.checkpointUndo("delete branch", control.baton)
 		repo.deleteBranch(shouldDelete, control.baton)
 		respond("%d branches deleted", before-len(repo.branchset()))
 	case "reset":
@@ -4076,6 +5804,7 @@ func (rs *Reposurgeon) DoDelete(line string) bool {
 			croak("no resets match %s", sourceRE.String())
 			return false
 		}
+		repo.checkpointUndo("delete reset", control.baton)
 		var tip *Commit
 		for _, commit := range repo.commits(undefinedSelectionSet) {
 			if sourceRE.MatchString(commit.Branch) {
@@ -4111,7 +5840,7 @@ func (rs *Reposurgeon) CompleteCoalesce(text string) []string {
 // HelpCoalesce says "Shut up, golint!"
 func (rs *Reposurgeon) HelpCoalesce() {
 	rs.helpOutput(`
-[SELECTION] coalesce [--changelog] [--debug] [TIMEFUZZ]
+[SELECTION] coalesce [--changelog] [--author] [--debug] [TIMEFUZZ]
 
 Scan the selection set (defaulting to all) for runs of commits with
 identical comments close to each other in time (this is a common form
@@ -4135,6 +5864,15 @@ commit before them by content, and will coalesce with it if the committer
 matches and the commit separation is small enough.  This option handles
 a convention used by Free Software Foundation projects.
 
+With the --author option, runs are found by author rather than by
+comment: consecutive commits on a branch with the same first author (or
+committer, for a commit without an author), each within TIMEFUZZ seconds
+of the one before by author date, are merged whatever their comments
+say.  The comments are joined in order, leaving out empty log messages,
+and the fileops are canonicalized as squash does.  This condenses the
+noisy histories left by save-on-every-keystroke editors, autosave bots
+and CVS lifts of work committed a file at a time.
+
 With  the --debug option, show messages about mismatches.
 
 Sets Q bits: true on commits that result from coalescence, false otherwise.
@@ -4143,7 +5881,7 @@ Sets Q bits: true on commits that result from coalescence, false otherwise.
 
 // DoCoalesce coalesces events in the specified selection set.
 func (rs *Reposurgeon) DoCoalesce(line string) bool {
-	parse := rs.newLineParse(line, "coalesce", parseALLREPO|parseNOARGS, nil)
+	parse := rs.newLineParse(line, "coalesce", parseALLREPO, nil)
 	defer parse.Closem()
 	repo := rs.chosen()
 	timefuzz := 90
@@ -4156,7 +5894,7 @@ func (rs *Reposurgeon) DoCoalesce(line string) bool {
 			return false
 		}
 	}
-	modified := repo.doCoalesce(rs.selection, timefuzz, changelog, parse.options.Contains("--debug"), control.baton)
+	modified := repo.doCoalesce(rs.selection, timefuzz, changelog, parse.options.Contains("--author"), parse.options.Contains("--debug"), control.baton)
 	respond("%d spans coalesced.", modified)
 	return false
 }
@@ -4442,26 +6180,102 @@ func (rs *Reposurgeon) DoRemove(pline string) bool {
 	return false
 }
 
+// HelpPhantoms says "Shut up, golint!"
+func (rs *Reposurgeon) HelpPhantoms() {
+	rs.helpOutput(`
+[SELECTION] phantoms [--dry-run] [>OUTFILE]
+
+Remove phantom file lifetimes, typically debris from CVS conversions.
+CVS records a file first added on a branch as a dead 1.1 revision on
+trunk, and files added in error were often removed in the very next
+commit; converters turn these into confusing deletes of files that
+never existed and files that live for a single commit. Two patterns
+are removed:
+
+1. A delete of a path that is not visible through any parent of the
+commit.
+
+2. A modify that creates a path in a commit whose only child deletes
+it, when neither commit touches the path otherwise. Both fileops are
+removed.
+
+The selection defaults to all commits; both commits of a pair must be
+selected. A line is reported for each phantom found. With --dry-run,
+only the report is made. Blobs left unreferenced are removed. Commits
+left with no fileops are counted but kept; "tagify" can deal with
+them.
+
+Sets Q bits: true for each commit modified, false otherwise.
+`)
+}
+
+// DoPhantoms is the handler for the "phantoms" command.
+func (rs *Reposurgeon) DoPhantoms(line string) bool {
+	parse := rs.newLineParse(line, "phantoms", parseALLREPO|parseNOARGS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	repo := rs.chosen()
+	if parse.options.Contains("--dry-run") {
+		_, found := repo.findPhantoms(rs.selection, parse.stdout)
+		respond("%d phantoms found.", found)
+		return false
+	}
+	found, emptied := repo.removePhantoms(rs.selection, parse.stdout)
+	respond("%d phantoms removed, %d commits left empty.", found, emptied)
+	return false
+}
+
 // HelpRenumber says "Shut up, golint!"
 func (rs *Reposurgeon) HelpRenumber() {
 	rs.helpOutput(`
-renumber
+renumber [--stable]
+renumber --aliases [>OUTFILE]
 
 Renumber the marks in a repository, from :1 up to <n> where <n> is the
 count of the last mark. Just in case an importer ever cares about mark
 ordering or gaps in the sequence.
 
+With --stable, or with the stablemarks flag set, each mark is instead
+derived from what its event is: a blob's from its hash, a commit's
+from its action stamp.  Marks are then large numbers in no particular
+order, but the same event gets the same mark however the repository
+was read or what was added or deleted around it, so streams written
+by two runs of a conversion can be diffed usefully.
+
 A side effect of this command is to clean up stray "done"
 passthroughs that may have entered the repository via graft
 operations.  After a renumber, the repository will have at most
 one "done", and it will be at the end of the events.
+
+Renumbering, by this command or by another operation that renumbers
+(such as graft or unite), remembers each mark it changes.  In a
+selection, a mark in angle brackets such as <:42> names the event that
+had that mark before renumbering, while a bare :42 always names the
+event that has it now.  Old marks are those from before the first
+renumbering, and a mark whose event has been deleted names nothing.
+With --aliases, nothing is renumbered; instead the table of old marks
+is written out, one line per surviving event giving the old mark and
+the current one.
 `)
 }
 
 // DoRenumber is he handler for the "renumber" command.
 func (rs *Reposurgeon) DoRenumber(line string) bool {
-	rs.newLineParse(line, "renumber", parseREPO|parseNOSELECT|parseNOARGS|parseNOOPTS, nil)
-	rs.repo.renumber(1, nil)
+	parse := rs.newLineParse(line, "renumber", parseREPO|parseNOSELECT|parseNOARGS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if parse.options.Contains("--aliases") {
+		if err := rs.repo.writeMarkAliases(parse.stdout); err != nil {
+			croak("renumber: %v", err)
+		}
+		return false
+	}
+	rs.repo.checkpointUndo("renumber", control.baton)
+	renumber := func() error { return rs.repo.renumber(control.interruptible(), 1, nil) }
+	if parse.options.Contains("--stable") {
+		renumber = func() error { return rs.repo.renumberStable(control.interruptible(), nil) }
+	}
+	if err := renumber(); err != nil {
+		croak("renumber: %v", err)
+	}
 	return false
 }
 
@@ -4494,7 +6308,156 @@ func (rs *Reposurgeon) DoDedup(line string) bool {
 		}
 		control.baton.twirl()
 	}
-	rs.chosen().dedup(dupMap, control.baton)
+	if err := rs.chosen().dedup(control.interruptible(), dupMap, control.baton); err != nil {
+		croak("dedup: %v", err)
+	}
+	return false
+}
+
+// HelpInfer says "Shut up, golint!"
+func (rs *Reposurgeon) HelpInfer() {
+	rs.helpOutput(`
+[SELECTION] infer copies
+[SELECTION] infer renames [--similarity=PERCENT]
+
+Rewrite fileops of the selected commits, defaulting to all, to say
+more economically what they do.
+
+With "copies", each modification that creates a file the first parent
+doesn't have, with the same content and mode as a file the first
+parent does have, becomes a C op from that file.  A source with the
+same basename as the new file is preferred, then the first in path
+order.  A file changed earlier in the same commit is never a source,
+and commits with a deleteall are left alone.  Blobs with no references
+left are removed, which can shrink streams made from Subversion dumps
+considerably.
+
+With "renames", pair each deletion of a file with an addition of a
+file with the same content and mode in the same commit, and replace
+the pair with an R op, so that tools following the history of a file
+through renames can find it.  A C op from the deleted file counts as
+such an addition.  With --similarity, a deletion that has no exact
+match is paired with the addition of text most like it, if at least
+PERCENT of the lines of the two are shared; the addition is then kept,
+after the R op, to supply the new content.  Pairs whose paths other
+fileops of the commit touch are left alone.  Running "infer copies"
+first finds renames to copies of other files too.
+
+Clears all Q bits, then sets them on altered commits.
+`)
+}
+
+// CompleteInfer is a completion hook over inference modes.
+func (rs *Reposurgeon) CompleteInfer(text string) []string {
+	return []string{"copies", "renames"}
+}
+
+// DoInfer rewrites fileops to express copies and renames.
+func (rs *Reposurgeon) DoInfer(line string) bool {
+	parse := rs.newLineParse(line, "infer", parseALLREPO|parseNEEDARG, nil)
+	defer parse.Closem()
+	repo := rs.chosen()
+	switch parse.args[0] {
+	case "copies":
+		if len(parse.args) > 1 || len(parse.options) > 0 {
+			croak("infer copies takes no further arguments.")
+			return false
+		}
+		rewritten := repo.inferCopies(rs.selection, control.baton)
+		respond("%d copies inferred.", rewritten)
+	case "renames":
+		if len(parse.args) > 1 {
+			croak("infer renames takes no further arguments.")
+			return false
+		}
+		similarity := 0
+		if val, ok := parse.OptVal("--similarity"); ok {
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 || n > 100 {
+				croak("infer renames: --similarity wants a percentage from 1 to 100.")
+				return false
+			}
+			similarity = n
+		}
+		renamed := repo.inferRenames(rs.selection, similarity, control.baton)
+		respond("%d renames inferred.", renamed)
+	default:
+		croak("infer requires a copies or renames verb.")
+	}
+	return false
+}
+
+// HelpRedact says "Shut up, golint!"
+func (rs *Reposurgeon) HelpRedact() {
+	rs.helpOutput(`
+[SELECTION] redact {path|content} PATTERN [TEMPLATE]
+
+Replace the content of files modified by the selected commits,
+defaulting to all, with tombstones.  With "path" the files redacted are
+those whose paths match PATTERN; with "content", those whose content
+does; a PATTERN that isn't a delimited regular expression must match the
+whole path or content.  Unlike "delete path", which removes a file from
+history, this leaves every fileop where it was, so trees keep their
+shape and later commits touching the file still make sense.
+
+A tombstone is made from TEMPLATE, a string with backslash escapes
+in which {hash} is replaced by the git hash of the content redacted
+and {size} by its length in bytes.  The default template is
+
+----
+This file was redacted.
+Original blob: {hash}
+Original size: {size} bytes
+----
+
+Each redacted blob gets a single tombstone blob.  A blob also used by
+files that aren't redacted keeps its content for them; one left with
+no references is removed.  Submodule links are never redacted.
+
+Clears all Q bits, then sets them on altered commits.
+
+----
+# Remove a leaked key wherever it was committed
+redact content /BEGIN RSA PRIVATE KEY/
+redact path /^secrets\.txt$/ "Removed at the owner's request.\n"
+----
+`)
+}
+
+// CompleteRedact is a completion hook over redaction modes.
+func (rs *Reposurgeon) CompleteRedact(text string) []string {
+	return []string{"path", "content"}
+}
+
+// DoRedact replaces file content with tombstones.
+func (rs *Reposurgeon) DoRedact(line string) bool {
+	parse := rs.newLineParse(line, "redact", parseALLREPO|parseNOOPTS|parseNEEDARG|parseNOREDIRECT, nil)
+	verb := parse.args[0]
+	if verb != "path" && verb != "content" {
+		croak("redact requires a path or content verb.")
+		return false
+	}
+	if len(parse.args) < 2 || len(parse.args) > 3 {
+		croak("redact %s requires a pattern and an optional template.", verb)
+		return false
+	}
+	ptype := "path"
+	if verb == "content" {
+		ptype = "text"
+	}
+	pattern := parse.getPattern(parse.args[1], ptype)
+	template := redactTemplate
+	if len(parse.args) == 3 {
+		var err error
+		if template, err = stringEscape(parse.args[2]); err != nil {
+			croak("redact: %v", err)
+			return false
+		}
+	}
+	repo := rs.chosen()
+	repo.checkpointUndo("redact", control.baton)
+	redacted := repo.redact(rs.selection, pattern, verb == "content", template, control.baton)
+	respond("%d file modifications redacted.", redacted)
 	return false
 }
 
@@ -4521,6 +6484,8 @@ modified timestamp.
 func (rs *Reposurgeon) DoTimeoffset(line string) bool {
 	parse := rs.newLineParse(line, "timeoffset", parseALLREPO|parseNOOPTS, nil)
 	defer parse.Closem()
+	// Unlike a timeshift offset, a sign here belongs to the leading
+	// field only, so -1:00:30 is 3570 seconds back.
 	offsetOf := func(hhmmss string) (int, error) {
 		h := "0"
 		m := "0"
@@ -4610,44 +6575,168 @@ func (rs *Reposurgeon) DoTimeoffset(line string) bool {
 	return false
 }
 
-// HelpDivide says "Shut up, golint!"
-func (rs *Reposurgeon) HelpDivide() {
+// HelpTimeshift says "Shut up, golint!"
+func (rs *Reposurgeon) HelpTimeshift() {
 	rs.helpOutput(`
-SELECTION divide
-
-Attempt to partition a repo by cutting the parent-child link
-between two specified commits (they must be adjacent). Does not take a
-general selection-set argument.  It is only necessary to specify the
-parent commit, unless it has multiple children in which case the child
-commit must follow (separate it with a comma).
-
-If the repo was named 'foo', you will normally end up with two repos
-named 'foo-early' and 'foo-late'.  But if the commit graph would
-remain connected through another path after the cut, the behavior
-changes.  In this case, if the parent and child were on the same
-branch 'qux', the branch segments are renamed 'qux-early' and
-'qux-late', but the repo is not divided.
+[SELECTION] timeshift {offset OFFSET|clamp|localize [ZONE]} [--dry-run] [>OUTFILE]
+[SELECTION] timeshift retrodate [--dry-run] <INFILE [>OUTFILE]
+
+Rewrite the dates of the commits and tags in a selection, which
+defaults to all of them.
+
+With "offset", move every committer, author and tagger date by OFFSET,
+in the form [+-]ss, [+-]mm:ss or [+-]hh:mm:ss; the sign applies to the
+whole offset.  This repairs a server clock that was wrong by a fixed
+amount.
+
+With "clamp", walk the commits in order and bump each by one second
+at a time until no two share the date their action stamps are made
+from (the first author date, or the committer date if there are no
+authors).  This goes further than "timequake", which only separates
+parents from children with identical action stamps.
+
+With "localize", express each date in ZONE, which may be an IANA zone
+name such as America/New_York or a [+-]hhmm literal.  With no ZONE,
+each date is expressed in the zone of its email address, as given
+by an authors file or the stream, or failing that guessed from the
+address's country domain; a zone of zero offset from the stream is
+taken to mean none was recorded.  Dates with no known zone are left
+alone.  The instant a date denotes never changes, only how it is
+written.
+
+With "retrodate", read a map of dates, as from the file timestamps of
+the tarballs or CVS repository a history was rebuilt from, and
+replace the committer and author dates of the commits it names.  Each
+line holds a key and a date in any form reposurgeon reads (RFC3339 or
+Git's seconds and offset), separated by whitespace; blank lines and
+lines beginning with # are ignored.  A key that is the legacy ID of a
+selected commit dates that commit.  Any other key is a path, and every
+selected commit modifying that path takes its date; a commit modifying
+several such paths takes the latest.  Keys matching no commit are
+reported.  Tags are not changed, and neither is the order of events.
+
+Reports each commit the operation would put before its parent in
+committer-date order, then the number of events changed.  With
+--dry-run, reports without changing anything.
+
+Clears Q bits, then sets the Q bit for every tag or commit whose dates
+changed.
 `)
 }
 
-// DoDivide is the command handler for the "divide" command.
-func (rs *Reposurgeon) DoDivide(line string) bool {
-	rs.newLineParse(line, "divide", parseREPO|parseNOARGS|parseNOOPTS, nil)
-	if rs.selection.Size() == 0 {
-		croak("one or possibly two arguments specifying a link are required")
-		return false
-	}
-	earlyEvent := rs.chosen().events[rs.selection.Fetch(0)]
-	earlyCommit, ok := earlyEvent.(*Commit)
-	if !ok {
-		croak("first element of selection is not a commit")
+// CompleteTimeshift is a completion hook across timeshift modes
+func (rs *Reposurgeon) CompleteTimeshift(text string) []string {
+	return timeshiftModes
+}
+
+// DoTimeshift rewrites dates across a selection.
+func (rs *Reposurgeon) DoTimeshift(line string) bool {
+	parse := rs.newLineParse(line, "timeshift", parseALLREPO, orderedStringSet{"stdin", "stdout"})
+	defer parse.Closem()
+	if len(parse.args) == 0 {
+		croak("timeshift requires a mode, one of %s", strings.Join(timeshiftModes, ", "))
 		return false
 	}
-	possibles := earlyCommit.children()
-	var late Event
-	var lateCommit *Commit
-	if rs.selection.Size() == 1 {
-		if len(possibles) > 1 {
+	mode := parse.args[0]
+	var offset time.Duration
+	var zone *time.Location
+	var dates map[*Commit]time.Time
+	repo := rs.chosen()
+	switch mode {
+	case "offset":
+		if len(parse.args) != 2 {
+			croak("timeshift offset requires an offset")
+			return false
+		}
+		seconds, err := parseClockOffset(parse.args[1])
+		if err != nil {
+			croak("%v", err)
+			return false
+		}
+		offset = time.Duration(seconds) * time.Second
+	case "clamp":
+		if len(parse.args) != 1 {
+			croak("timeshift clamp takes no arguments")
+			return false
+		}
+	case "localize":
+		if len(parse.args) > 2 {
+			croak("timeshift localize takes at most one zone")
+			return false
+		}
+		if len(parse.args) == 2 {
+			var err error
+			if zone, err = parseZone(parse.args[1]); err != nil {
+				croak("unknown zone %q", parse.args[1])
+				return false
+			}
+		}
+	case "retrodate":
+		if len(parse.args) != 1 || parse.infile == "" {
+			croak("timeshift retrodate takes no arguments and requires an input redirect")
+			return false
+		}
+		mapping, err := readRetrodates(parse.stdin)
+		if err != nil {
+			croak("%v", err)
+			return false
+		}
+		var unused []string
+		dates, unused = repo.retrodates(rs.selection, mapping)
+		for _, key := range unused {
+			fmt.Fprintf(parse.stdout, "%s matches no commit\n", key)
+		}
+	default:
+		croak("unknown timeshift mode %q, must be one of %s", mode, strings.Join(timeshiftModes, ", "))
+		return false
+	}
+	changed, inverted := repo.timeshift(rs.selection, mode, offset, zone, dates, parse.options.Contains("--dry-run"))
+	for _, pair := range inverted {
+		fmt.Fprintf(parse.stdout, "%s now precedes parent %s\n", pair.child.idMe(), pair.parent.idMe())
+	}
+	fmt.Fprintf(parse.stdout, "%d events changed\n", changed)
+	repo.invalidateNamecache()
+	return false
+}
+
+// HelpDivide says "Shut up, golint!"
+func (rs *Reposurgeon) HelpDivide() {
+	rs.helpOutput(`
+SELECTION divide
+
+Attempt to partition a repo by cutting the parent-child link
+between two specified commits (they must be adjacent). Does not take a
+general selection-set argument.  It is only necessary to specify the
+parent commit, unless it has multiple children in which case the child
+commit must follow (separate it with a comma).
+
+If the repo was named 'foo', you will normally end up with two repos
+named 'foo-early' and 'foo-late'.  But if the commit graph would
+remain connected through another path after the cut, the behavior
+changes.  In this case, if the parent and child were on the same
+branch 'qux', the branch segments are renamed 'qux-early' and
+'qux-late', but the repo is not divided.
+`)
+}
+
+// DoDivide is the command handler for the "divide" command.
+func (rs *Reposurgeon) DoDivide(line string) bool {
+	rs.newLineParse(line, "divide", parseREPO|parseNOARGS|parseNOOPTS, nil)
+	if rs.selection.Size() == 0 {
+		croak("one or possibly two arguments specifying a link are required")
+		return false
+	}
+	earlyEvent := rs.chosen().events[rs.selection.Fetch(0)]
+	earlyCommit, ok := earlyEvent.(*Commit)
+	if !ok {
+		croak("first element of selection is not a commit")
+		return false
+	}
+	possibles := earlyCommit.children()
+	var late Event
+	var lateCommit *Commit
+	if rs.selection.Size() == 1 {
+		if len(possibles) > 1 {
 			croak("commit has multiple children, one must be specified")
 			return false
 		} else if len(possibles) == 1 {
@@ -4710,6 +6799,7 @@ func (rs *Reposurgeon) DoDivide(line string) bool {
 func (rs *Reposurgeon) HelpSplit() {
 	rs.helpOutput(`
 [SELECTION] split [ --path ] PATH-OR-INDEX
+[SELECTION] split --dir [<BUCKET-MAP]
 
 Split a specified commit in two, the opposite of squash.
 
@@ -4731,13 +6821,26 @@ by an index argument - are moved forward from the original commit
 into the new one.  Legal indices are 2-n, where n is the number of
 file operations in the original commit.
 
+With --dir, the commit is instead split into as many commits as
+there are top-level directories among the paths of its file
+operations, in order of first appearance; files at the root of the
+tree count as one directory.  If a map is given on standard input,
+each line of it is a path prefix and a bucket name; file operations
+whose paths match a prefix (the longest matching one) go into that
+bucket's commit, and others are grouped by top-level directory as
+before.  A rename or copy from one bucket to another is replaced by a
+modification of the target that uses the source's blob and, for a
+rename, a deletion of the source.  New commits after the first get
+legacy IDs suffixed '.split', '.split2' and so on.
+
 Sets Q bits on the split commits; clears all others.
 `)
 }
 
 // DoSplit splits a commit.
 func (rs *Reposurgeon) DoSplit(line string) bool {
-	parse := rs.newLineParse(line, "split", parseREPO, nil)
+	parse := rs.newLineParse(line, "split", parseREPO, orderedStringSet{"stdin"})
+	defer parse.Closem()
 	if rs.selection.Size() != 1 {
 		croak("selection of a single commit required for this command")
 		return false
@@ -4749,6 +6852,23 @@ func (rs *Reposurgeon) DoSplit(line string) bool {
 		croak("selection doesn't point at a commit")
 		return false
 	}
+	if parse.options.Contains("--dir") {
+		var buckets *bucketMap
+		if parse.redirected {
+			var err error
+			if buckets, err = readBucketMap(parse.stdin); err != nil {
+				croak("%v", err)
+				return false
+			}
+		}
+		count, err := rs.chosen().splitCommitByBucket(where, buckets.bucket)
+		if err != nil {
+			croak(err.Error())
+			return false
+		}
+		respond("new commits are events %d through %d.", where+1, where+count)
+		return false
+	}
 	if len(parse.args) < 1 {
 		croak("split command required a fileop identifier")
 		return false
@@ -4784,7 +6904,7 @@ func (rs *Reposurgeon) CompleteUnite(text string) []string {
 // HelpUnite says "Shut up, golint!"
 func (rs *Reposurgeon) HelpUnite() {
 	rs.helpOutput(`
-unite [--prune] [REPO-NAME...]
+unite [--prune] [--infer [--confirm]] [REPO-NAME...] [>OUTFILE]
 
 Unite named repositories into one.  Repos need to be loaded (read) first.
 They will be processed and removed from the load list.  The union repo
@@ -4805,13 +6925,28 @@ inherited if all repos share the same type, otherwise no type will be set.
 With the option --prune, at each join generate D ops for every
 file that doesn't have a modify operation in the root commit of the
 branch being grafted on.
+
+Joining by date is a guess; when one repository was started from a
+copy of another, better evidence is usually to be had.  With --infer,
+each grafted root is instead matched against the commits of the
+oldest repo.  If a commit there has a tree identical to the root's,
+the root joins the latest such commit no later than itself, with high
+confidence.  Failing that, if the root has the same action stamp as a
+commit there - it is a second recording of that commit - it joins
+that commit's parent, with medium confidence.  Otherwise the join is
+by date, with low confidence.
+
+With --infer alone nothing is changed; instead a report is written
+with a line per grafted repo giving its root, the commit it would
+join, the basis and the confidence.  Give --confirm as well to do the
+unite with those joins.
 `)
 }
 
 // DoUnite melds repos together.
 func (rs *Reposurgeon) DoUnite(line string) bool {
 	rs.unchoose()
-	parse := rs.newLineParse(line, "unite", parseNOSELECT, nil)
+	parse := rs.newLineParse(line, "unite", parseNOSELECT, orderedStringSet{"stdout"})
 	defer parse.Closem()
 	factors := make([]*Repository, 0)
 	for _, name := range parse.args {
@@ -4826,7 +6961,20 @@ func (rs *Reposurgeon) DoUnite(line string) bool {
 		croak("unite requires two or more repo name arguments")
 		return false
 	}
-	rs.unite(factors, parse.options.Contains("--prune"))
+	infer := parse.options.Contains("--infer")
+	if infer && !parse.options.Contains("--confirm") {
+		joins, err := uniteJoins(factors, true)
+		if err != nil {
+			croak("%v", err)
+			return false
+		}
+		for _, join := range joins {
+			fmt.Fprintf(parse.stdout, "%s %s joins %s %s by %s (%s confidence)\n",
+				join.factor.name, join.root.mark, factors[0].name, join.parent.mark, join.basis, join.confidence)
+		}
+		return false
+	}
+	rs.unite(factors, parse.options.Contains("--prune"), infer)
 	if control.isInteractive() && !control.flagOptions["quiet"] {
 		rs.DoChoose("")
 	}
@@ -4894,6 +7042,312 @@ func (rs *Reposurgeon) DoGraft(line string) bool {
 	return false
 }
 
+// HelpCompare says "Shut up, golint!"
+func (rs *Reposurgeon) HelpCompare() {
+	rs.helpOutput(`
+compare [--tree] REPO-NAME [>OUTFILE]
+
+Compare the commits of the chosen repository with those of the loaded
+repository named by REPO-NAME, as when checking a new conversion
+against the last one before cutover.  Commits are paired by action
+stamp, commits sharing a stamp in the order they occur; with --tree
+they are paired by the hash of the tree they have instead, which finds
+commits whose attributions or dates differ.
+
+A commit only in the chosen repository is listed after "-", one only
+in REPO-NAME after "+", each with its mark, action stamp and the first
+line of its comment.  A pair that differs is listed after "~" with the
+marks of both commits and what differs: committer, authors, comment,
+branch, tree (not with --tree), and parents, which are compared
+through the pairing.  A count of each kind of difference follows.
+
+All Q bits in the chosen repository are cleared, then set on commits
+that differ or have no partner.
+`)
+}
+
+// CompleteCompare is a completion hook across repo names
+func (rs *Reposurgeon) CompleteCompare(text string) []string {
+	return rs.CompleteChoose(text)
+}
+
+// DoCompare compares the commit graphs of two loaded repositories.
+func (rs *Reposurgeon) DoCompare(line string) bool {
+	parse := rs.newLineParse(line, "compare", parseREPO|parseNOSELECT, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if len(parse.args) != 1 {
+		croak("compare requires a repository argument.")
+		return false
+	}
+	other := rs.repoByName(parse.args[0])
+	if other == rs.chosen() {
+		croak("a repository can't be compared with itself.")
+		return false
+	}
+	rs.chosen().compareRepos(parse.stdout, other, parse.options.Contains("--tree"))
+	return false
+}
+
+// HelpTransplant says "Shut up, golint!"
+func (rs *Reposurgeon) HelpTransplant() {
+	rs.helpOutput(`
+[SELECTION] transplant [--branch=NAME] REPO-NAME PARENT
+
+Copy the selected commits of the chosen repository into the loaded
+repository named by REPO-NAME, as a cherry-pick would: each copy has
+the fileops of its original and goes on top of the commit of REPO-NAME
+identified by PARENT, either a mark or an action stamp.  When a run of
+commits is selected, a copy whose original's parent was also copied
+is parented on that copy instead; other parents are dropped.
+
+The blobs the fileops refer to are copied too.  Copies of commits and
+blobs get new marks in REPO-NAME, and the legacy IDs of the commits
+come with them unless REPO-NAME already uses them.
+
+The copies go on the branch named by --branch, or else on the branch
+of PARENT, which must then be the tip of that branch.
+
+Neither repository is otherwise modified, and the chosen repository
+stays chosen.  Sets Q bits in REPO-NAME: true on the copies, false
+otherwise.
+`)
+}
+
+// DoTransplant copies commits from the chosen repo into another.
+func (rs *Reposurgeon) DoTransplant(line string) bool {
+	parse := rs.newLineParse(line, "transplant", parseREPO, nil)
+	defer parse.Closem()
+	if len(parse.args) != 2 {
+		croak("transplant requires a repository name and a parent.")
+		return false
+	}
+	target := rs.repoByName(parse.args[0])
+	if target == rs.chosen() {
+		croak("can't transplant commits into the repository they come from.")
+		return false
+	}
+	onto, err := target.transplantParent(parse.args[1])
+	if err != nil {
+		croak("transplant: %v", err)
+		return false
+	}
+	selection := rs.selection
+	if !selection.isDefined() {
+		croak("transplant requires a selection set.")
+		return false
+	}
+	branch, _ := parse.OptVal("--branch")
+	copies, err := target.transplant(rs.chosen(), selection, onto, branch)
+	if err != nil {
+		croak("transplant: %v", err)
+		return false
+	}
+	if control.isInteractive() {
+		respond("%d commits transplanted into %s.", len(copies), target.name)
+	}
+	return false
+}
+
+// HelpCallouts says "Shut up, golint!"
+func (rs *Reposurgeon) HelpCallouts() {
+	rs.helpOutput(`
+[SELECTION] callouts [list] [>OUTFILE]
+[SELECTION] callouts resolve [--gitlink=PATH] [REPO-NAME] [<STAMP-MAP]
+
+Callouts are parents given by action stamp rather than mark, as
+written by "write --callout" for a segment of a repository.  The
+selection set defaults to all commits.
+
+With "list" or no subcommand, list the callout parents of the selected
+commits, one per line: event number, mark, and the action stamp.
+
+With "resolve", replace callout parents where possible.  A stamp that
+names exactly one commit of the chosen repository - as it may after
+a unite - makes that commit the parent.  Otherwise the stamp is looked
+up in the repository named by REPO-NAME, if given, or in a map read
+from standard input whose lines are an action stamp and a commit hash.
+If the hash found that way is the git hash or original-oid of a commit
+of the chosen repository, that commit becomes the parent.  If it
+isn't, and --gitlink is given, the callout is removed and a gitlink
+to the hash is added at PATH in the child's fileops; a child left
+parentless by this becomes a root commit.  Anything else is reported
+as unresolved.
+
+Sets Q bits: true on commits whose parents were changed, false
+otherwise.
+`)
+}
+
+// CompleteCallouts is a completion hook over callouts subcommands
+func (rs *Reposurgeon) CompleteCallouts(text string) []string {
+	return []string{"list", "resolve", "--gitlink="}
+}
+
+// DoCallouts lists and resolves callout parents.
+func (rs *Reposurgeon) DoCallouts(line string) bool {
+	parse := rs.newLineParse(line, "callouts", parseALLREPO, orderedStringSet{"stdin", "stdout"})
+	defer parse.Closem()
+	repo := rs.chosen()
+	verb := "list"
+	if len(parse.args) > 0 {
+		verb = parse.args[0]
+	}
+	switch verb {
+	case "list":
+		for _, ref := range repo.calloutParents(rs.selection) {
+			fmt.Fprintf(parse.stdout, "%6d %6s %s\n", repo.eventToIndex(ref.commit)+1, ref.commit.mark, ref.stamp)
+		}
+	case "resolve":
+		var lookup func(string) string
+		if len(parse.args) > 1 {
+			other := rs.repoByName(parse.args[1])
+			lookup = func(stamp string) string {
+				if commit := other.stampCommit(stamp); commit != nil {
+					return commit.gitHash().hexify()
+				}
+				return ""
+			}
+		} else if parse.redirected {
+			mapping, err := readStampMap(parse.stdin)
+			if err != nil {
+				croak("%v", err)
+				return false
+			}
+			lookup = func(stamp string) string { return mapping[stamp] }
+		}
+		gitlink, _ := parse.OptVal("--gitlink")
+		parented, linked, unresolved := repo.resolveCallouts(rs.selection, lookup, gitlink)
+		for _, stamp := range unresolved {
+			if logEnable(logWARN) {
+				logit("unresolved callout %s", stamp)
+			}
+		}
+		respond("%d callouts became parents, %d became gitlinks.", parented, linked)
+	default:
+		croak("unknown callouts subcommand %q", verb)
+	}
+	return false
+}
+
+// HelpOverrides says "Shut up, golint!"
+func (rs *Reposurgeon) HelpOverrides() {
+	rs.helpOutput(`
+[SELECTION] overrides [list|bake] [>OUTFILE]
+
+List or bake topology overrides.  Git can make a commit appear to
+have parents other than its own, with a replace ref made by "git
+replace --graft" or with a line in the older .git/info/grafts file.
+Neither is part of the history, and git fast-export silently applies
+them.  When reading a git repository reposurgeon instead reads the
+history as it really is, and records each replacement or graft as an
+override on its commit: the parents git would show in place of the
+real ones.  Only the parent links of a replacement are kept.
+
+With "list", or no subcommand, the overrides on the selected commits
+are listed, one per line: the event number and mark of the commit,
+the marks of the parents it is shown with, and where the override
+came from.
+
+With "bake", the overrides on the selected commits become real parent
+links and are forgotten.  Each commit keeps its tree, as with
+"reparent".  An override that would make a commit its own ancestor is
+left in place with a warning.  Sets Q bits: true for each commit
+changed, false otherwise.
+
+Overrides still present when the repository is rebuilt as git are
+written back as replace refs.  Other systems have no such thing, and
+rebuilding as one of them warns that they will be lost.  An override
+whose commit or parent is deleted is dropped.
+
+Takes a selection set, defaulting to all commits.
+`)
+}
+
+// CompleteOverrides is a completion hook over overrides subcommands
+func (rs *Reposurgeon) CompleteOverrides(text string) []string {
+	return []string{"bake", "list"}
+}
+
+// DoOverrides is the handler for the "overrides" command.
+func (rs *Reposurgeon) DoOverrides(line string) bool {
+	parse := rs.newLineParse(line, "overrides", parseALLREPO|parseNOOPTS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	repo := rs.chosen()
+	verb := "list"
+	if len(parse.args) > 0 {
+		verb = parse.args[0]
+	}
+	switch verb {
+	case "list":
+		for _, g := range repo.overridesOf(rs.selection) {
+			marks := make([]string, len(g.parents))
+			for i, parent := range g.parents {
+				marks[i] = parent.mark
+			}
+			fmt.Fprintf(parse.stdout, "%6d %6s -> [%s] %s\n", repo.eventToIndex(g.commit)+1, g.commit.mark, strings.Join(marks, " "), g.origin)
+		}
+	case "bake":
+		respond("%d overrides baked.", repo.bakeOverrides(rs.selection))
+	default:
+		croak("unknown overrides subcommand %q", verb)
+	}
+	return false
+}
+
+// HelpSplice says "Shut up, golint!"
+func (rs *Reposurgeon) HelpSplice() {
+	rs.helpOutput(`
+SELECTION splice <FRAGMENT
+
+Replace a range of commits with replacement commits read from a
+fast-import stream fragment.  This is the tool for redoing a stretch of
+history that was badly converted, using a better dump of the same span.
+
+The selection must be a linear range of commits: each commit after the
+first has the previous one as its only parent, and each commit before
+the last has the next one as its only child.
+
+The fragment may contain blobs and commits; resets without a target and
+passthroughs are ignored, and tags are not allowed.  Commits in the
+fragment with no parents are given the parents of the first commit in
+the range. A fragment commit may also name a parent outside the range
+with an action-stamp callout in its "from" or "merge" line. The
+fragment must have exactly one commit without children; it replaces
+the last commit in the range as the parent of that commit's children,
+and tags and resets pointing into the range are moved to it.  Its tree
+must be the same as that of the last commit in the range, so that the
+commits after the range are unchanged; if it isn't, nothing is done.
+The spliced-in commits are put on the branch of the last commit in
+the range, whatever branch the fragment names.
+
+The replaced commits and any blobs only they referenced are deleted,
+and the repository is renumbered. This command sets Q bits; the
+spliced-in events get true, all other events get false.
+
+----
+# Redo a badly converted month from a better export
+<2011-02-01T08:00:00Z!esr@thyrsus.com>..<2011-02-28T17:30:00Z!esr@thyrsus.com> splice <feb.fi
+----
+`)
+}
+
+// DoSplice replaces a commit range with a stream fragment.
+func (rs *Reposurgeon) DoSplice(line string) bool {
+	parse := rs.newLineParse(line, "splice", parseREPO|parseNEEDSELECT|parseNOOPTS|parseNOARGS, []string{"stdin"})
+	defer parse.Closem()
+	if !parse.redirected {
+		croak("splice requires a fragment on standard input.")
+		return false
+	}
+	fragment := newRepository(rs.chosen().name + "-fragment")
+	fragment.fastImport(context.TODO(), parse.stdin, nullStringSet, "splice fragment", control.baton)
+	if err := rs.chosen().splice(rs.selection, fragment); err != nil {
+		fragment.cleanup()
+		croak("%v", err)
+	}
+	return false
+}
+
 // HelpDebranch says "Shut up, golint!"
 func (rs *Reposurgeon) HelpDebranch() {
 	rs.helpOutput(`
@@ -5028,7 +7482,7 @@ func (rs *Reposurgeon) CompleteTagify(text string) []string {
 // HelpTagify says "Shut up, golint!"
 func (rs *Reposurgeon) HelpTagify() {
 	rs.helpOutput(`
-[SELECTION] tagify [ --tagify-merges | --canonicalize | --tipdeletes ]
+[SELECTION] tagify [ --tagify-merges | --canonicalize | --tipdeletes | --tree-same | --collapse ]
 
 Search for empty commits and turn them into tags. May be useful in
 cleaning up Subversion conversions that had previously been lifted with
@@ -5046,7 +7500,7 @@ is generated from the legacy ID of the deleted commit, or from its
 mark, or from its index in the repository, with a disambiguation
 suffix if needed.
 
-tagify currently recognizes three options: first is '--canonicalize' which
+tagify currently recognizes five options: first is '--canonicalize' which
 makes tagify try harder to detect trivial commits by first removing all
 fileops of the selected commits which have no actual effect when processed by
 fast-import. For example, file modification ops that don't actually change the
@@ -5063,7 +7517,18 @@ The third option is '--tagify-merges' that makes reposurgeon also
 tagify merge commits that have no fileops.  When this is done the
 merge link is moved to the tagified commit's parent.
 
-This command cleaes all Q bits, then seta the Q bits of all tags it creates.
+The fourth option is '--tree-same', which makes tagify also consider
+commits that have fileops but whose tree is the same as their first
+parent's, compared by git tree hash.  This catches no-op commits left
+by Subversion property changes, and modifications that put back the
+content a file already had.
+
+The fifth option is '--collapse', which deletes the commits it would
+tagify without making tags for them; their children are reparented
+onto their parents as usual.
+
+This command clears all Q bits, then sets the Q bits of all tags it
+creates.
 `)
 }
 
@@ -5078,9 +7543,10 @@ func (rs *Reposurgeon) DoTagify(line string) bool {
 		parse.options.Contains("--tipdeletes"),
 		parse.options.Contains("--tagify-merges"),
 		parse.options.Contains("--canonicalize"),
+		parse.options.Contains("--tree-same"),
 		nil,
 		nil,
-		true,
+		!parse.options.Contains("--collapse"),
 		control.baton)
 	if err != nil {
 		control.baton.printLogString(err.Error())
@@ -5103,6 +7569,12 @@ This command will throw an error if you try to make a merge link to a
 parentless (e.g. root) commit, as that would produce an invalid
 fast-import stream.
 
+The manifests of the child and its descendants are recomputed.  If
+the two parents both changed a path since their common ancestor, with
+different results, and the child's own file operations don't touch
+that path, the new parent's version of it is not in the child's tree;
+each such path is reported as a conflict in a warning.
+
 If the command succeeds, all Q bits are cleared, then the Q bits
 of the two commits are set. 
 `)
@@ -5125,12 +7597,18 @@ func (rs *Reposurgeon) DoMerge(line string) bool {
 		return false
 	}
 	repo.clearColor(colorQSET)
-	if late.mark < early.mark {
+	if repo.eventToIndex(late) < repo.eventToIndex(early) {
 		late, early = early, late
 	}
 	late.addParentCommit(early)
+	late.invalidateManifests()
 	early.addColor(colorQSET)
 	late.addColor(colorQSET)
+	if logEnable(logWARN) {
+		for _, path := range late.unresolvedConflicts(early) {
+			logit("merge conflict at %s: %s differs between parents", late.idMe(), path)
+		}
+	}
 	//earlyID = fmt.Sprintf("%s (%s)", early.mark, early.Branch)
 	//lateID = fmt.Sprintf("%s (%s)", late.mark, late.Branch)
 	//respond("%s added as a parent of %s", earlyID, lateID)
@@ -5140,7 +7618,7 @@ func (rs *Reposurgeon) DoMerge(line string) bool {
 // HelpUnmerge says "Shut up, golint!"
 func (rs *Reposurgeon) HelpUnmerge() {
 	rs.helpOutput(`
-SELECTION unmerge
+SELECTION unmerge [--flatten]
 
 Linearizes a commit. Takes a selection set argument, which must resolve to a
 single commit, and removes all its parents except for the first. It is
@@ -5150,14 +7628,31 @@ commit's first parent, but doesn't need you to find the first parent yourself,
 saving time and avoiding errors when nearby surgery would make a manual first
 parent argument stale.
 
+With --flatten, the history of the second parent is kept instead of
+dropped.  The commit must have exactly two parents, and the commits
+reachable from the second parent but not the first must form a single
+line with no other descendants.  Those commits are replayed, in order,
+on top of the first parent, and the unmerged commit becomes the child
+of the last of them; its file operations are recomputed so its tree
+is unchanged.  Paths changed differently on both sides since they
+forked are reported in warnings, since the intermediate trees of the
+replayed commits differ from the originals there.  The replayed
+commits keep their branch names.
+
 If the command succeeds, all Q bits are cleared, then the Q bits
-of the unmerged commit is set. 
+of the unmerged commit (and, with --flatten, of the replayed commits)
+are set. 
 `)
 }
 
+// CompleteUnmerge is a completion hook over unmerge options
+func (rs *Reposurgeon) CompleteUnmerge(text string) []string {
+	return []string{"--flatten"}
+}
+
 // DoUnmerge says "Shut up, golint!"
 func (rs *Reposurgeon) DoUnmerge(line string) bool {
-	rs.newLineParse(line, "unmerge", parseREPO|parseALLREPO|parseNOARGS|parseNOOPTS, nil)
+	parse := rs.newLineParse(line, "unmerge", parseREPO|parseALLREPO|parseNOARGS, nil)
 	if rs.selection.Size() != 1 {
 		croak("unmerge requires a single commit.")
 		return false
@@ -5167,6 +7662,21 @@ func (rs *Reposurgeon) DoUnmerge(line string) bool {
 	event := rs.chosen().events[rs.selection.Fetch(0)]
 	if commit, ok := event.(*Commit); !ok {
 		croak("unmerge target is not a commit.")
+	} else if parse.options.Contains("--flatten") {
+		replayed, conflicts, err := repo.flattenMerge(commit)
+		if err != nil {
+			croak("%v", err)
+			return false
+		}
+		if logEnable(logWARN) {
+			for _, path := range conflicts {
+				logit("replay conflict at %s: %s changed on both sides", commit.idMe(), path)
+			}
+		}
+		for _, c := range replayed {
+			c.addColor(colorQSET)
+		}
+		commit.addColor(colorQSET)
 	} else {
 		commit.setParents(commit.parents()[:1])
 		commit.addColor(colorQSET)
@@ -5177,7 +7687,7 @@ func (rs *Reposurgeon) DoUnmerge(line string) bool {
 // HelpReparent says "Shut up, golint!"
 func (rs *Reposurgeon) HelpReparent() {
 	rs.helpOutput(`
-SELECTION reparent [--use-order] [--rebase]
+SELECTION reparent [--use-order] [--rebase] [--preview]
 
 Changes the parent list of a commit.  Takes a selection set, zero or
 more option arguments, and an optional policy argument.
@@ -5240,21 +7750,33 @@ prepended so that the manifest stays unchanged even when the first
 parent has been changed. The --rebase flag inhibits the default
 behavior -- no 'deleteall' is issued and the tree contents of all
 descendants can be modified as a result.
+
+With "--preview", nothing is changed.  Instead, for the commit to
+modify and each descendant inheriting its tree from it, down to any
+that begin with a deleteall, the paths whose content would differ
+after the reparent are listed, each marked as one that appears,
+vanishes, or changes.  Commits that would change get Q bits.  Without
+--rebase the tree is kept, so the preview reports no changes; use
+both to see what a rebase would do before doing it.  This
+command supports > redirection.
 `)
 }
 
 // CompleteReoarent is a completion hook over reparent options
 func (rs *Reposurgeon) CompleteReoarent(text string) []string {
-	return []string{"--use-order", "--rebase"}
+	return []string{"--use-order", "--rebase", "--preview"}
 }
 
 // DoReparent is the ommand handler for the "reparent" command.
 func (rs *Reposurgeon) DoReparent(line string) bool {
-	parse := rs.newLineParse(line, "reparent", parseREPO, nil)
+	parse := rs.newLineParse(line, "reparent", parseREPO, orderedStringSet{"stdout"})
 	defer parse.Closem()
 	repo := rs.chosen()
-	for _, commit := range repo.commits(undefinedSelectionSet) {
-		commit.invalidateManifests()
+	preview := parse.options.Contains("--preview")
+	if !preview {
+		for _, commit := range repo.commits(undefinedSelectionSet) {
+			commit.invalidateManifests()
+		}
 	}
 	useOrder := parse.options.Contains("--use-order")
 	// Determine whether an event resort might be needed.  it is
@@ -5296,6 +7818,10 @@ func (rs *Reposurgeon) DoReparent(line string) bool {
 			}
 		}
 	}
+	if preview {
+		repo.reparentPreview(parse.stdout, child, parents, !parse.options.Contains("--rebase"))
+		return false
+	}
 	if !parse.options.Contains("--rebase") {
 		// Recreate the state of the tree
 		f := newFileOp(repo)
@@ -5351,19 +7877,26 @@ Selected commits are re-arranged in the order specified; for instance:
 ":7,:5,:9,:3 reorder". The specified commit range must be contiguous; each
 commit must be accounted for after re-ordering. Thus, for example, ':5' can
 not be omitted from ":7,:5,:9,:3 reorder". (To drop a commit, use the 'delete'
-or 'squash' command.) The selected commits must represent a linear history,
-however, the lowest numbered commit being re-ordered may have multiple
-parents, and the highest numbered may have multiple children.
-
-Re-ordered commits and their immediate descendants are inspected for
-elementary fileops inconsistencies. Warns if re-ordering results in a commit
-trying to delete, rename, or copy a file before it was ever created. Likewise,
-warns if all of a commit's fileops become no-ops after re-ordering. Other
-fileops inconsistencies may arise from re-ordering, both within the range of
-affected commits and beyond; for instance, moving a commit which renames a
-file ahead of a commit which references the original name. Such anomalies can
-be discovered via manual inspection and repaired with the 'add' and 'remove'
-(and possibly 'path') commands. Warnings can be suppressed with '--quiet'.
+or 'squash' command.)
+
+The selected commits need not represent a linear history; the range
+may include branches and merges, so long as the selected commits form
+one connected piece of the commit graph. The shape of the graph is
+kept and the commits are permuted over it: the commit placed Nth in
+the new order takes the parents, children, and branch of the Nth
+commit of the range in event order. For a linear range this simply
+rewrites the chain in the new order.
+
+Re-ordered commits and their immediate descendants are inspected for elementary
+fileops inconsistencies. Warns if re-ordering results in a commit trying to
+delete, rename, or copy a file before it was ever created; a file is taken to
+exist if it is visible through any parent, not only the first. Likewise, warns
+if all of a commit's fileops become no-ops after re-ordering. Other fileops
+inconsistencies may arise from re-ordering, both within the range of affected
+commits and beyond; for instance, moving a commit which renames a file ahead of
+a commit which references the original name. Such anomalies can be discovered
+via manual inspection and repaired with the 'add' and 'remove' (and possibly
+'path') commands. Warnings can be suppressed with '--quiet'.
 
 In addition to adjusting their parent/child relationships, re-ordering commits
 also re-orders the underlying events since ancestors must appear before
@@ -5391,6 +7924,7 @@ func (rs *Reposurgeon) DoReorder(line string) bool {
 	}
 	_, quiet := parse.OptVal("--quiet")
 
+	repo.checkpointUndo("reorder", control.baton)
 	repo.reorderCommits(rs.selection, quiet)
 	return false
 }
@@ -5526,6 +8060,64 @@ func (rs *Reposurgeon) DoMove(line string) bool {
 	return false
 }
 
+// HelpTags says "Shut up, golint!"
+func (rs *Reposurgeon) HelpTags() {
+	rs.helpOutput(`
+{SELECTION} tags retarget
+[SELECTION] tags dedupe
+
+Bulk surgery on annotated tags.  To rename tags in bulk, see "rename
+tag".
+
+With "retarget", every tag on a selected commit is moved to the
+nearest ancestor of that commit that is not selected, first parents
+being searched ahead of the others.  Requires an explicit selection
+set.  This is the way to keep the tags on commits about to be deleted;
+a delete takes the tags on the commits it removes with it.  Tags with
+no unselected ancestor to go to, or that point at something that is
+not a commit, are left alone with a warning.  Sets Q bits: true on
+tags moved and the commits they were moved to, false otherwise.
+
+With "dedupe", selected tags that point at the same commit, or at
+commits recording the same change (see "@eqv" in "help functions"),
+are merged into the earliest of them, and the rest deleted.  Comments of the
+deleted tags that differ from those already kept are appended to the
+kept tag's comment, separated by blank lines.  The default selection
+is all events.  Sets Q bits: true on the tags kept, false otherwise.
+
+----
+# Keep the tags of a run of junk commits, then delete them
+/junk/ tags retarget
+/junk/ delete
+----
+`)
+}
+
+// CompleteTags is a completion hook over tags verbs
+func (rs *Reposurgeon) CompleteTags(text string) []string {
+	return []string{"dedupe", "retarget"}
+}
+
+// DoTags performs bulk surgery on annotated tags.
+func (rs *Reposurgeon) DoTags(line string) bool {
+	parse := rs.newLineParse(line, "tags", parseREPO|parseNOOPTS|parseNEEDARG, nil)
+	repo := rs.chosen()
+	switch verb := parse.args[0]; verb {
+	case "retarget":
+		parse.flagcheck(parseNEEDSELECT)
+		moved := repo.retargetTags(rs.selection)
+		respond("%d tags moved.", moved)
+	case "dedupe":
+		parse.flagcheck(parseALLREPO)
+		repo.checkpointUndo("tags dedupe", control.baton)
+		deleted := repo.dedupeTags(rs.selection, control.baton)
+		respond("%d duplicate tags deleted.", deleted)
+	default:
+		croak("tags requires a retarget or dedupe verb.")
+	}
+	return false
+}
+
 // HelpBranchlift says "Shut up, golint!"
 func (rs *Reposurgeon) HelpBranchlift() {
 	rs.helpOutput(`
@@ -5618,10 +8210,61 @@ func (rs *Reposurgeon) DoBranchlift(line string) bool {
 	return false
 }
 
+// HelpEmptydirs says "Shut up, golint!"
+func (rs *Reposurgeon) HelpEmptydirs() {
+	rs.helpOutput(`
+[SELECTION] emptydirs strip [NAME [CONTENT]]
+
+Placeholder files keep directories that would otherwise be empty in
+git trees; "set emptydir" makes Subversion reads put them in.  The
+strip subcommand takes them out of the selected commits, defaulting
+to all: modifications of files called NAME that give them CONTENT,
+and deletions of such files.  NAME and CONTENT default to those set
+with "set emptydir", or to .gitkeep and nothing.  CONTENT may be a
+double-quoted string with backslash escapes and gets a trailing
+newline if it lacks one.  A file called NAME with other content, such
+as a .gitignore with patterns in it, is left alone.  Placeholder blobs
+nothing refers to afterwards are removed.
+
+Sets Q bits: true on commits that lost placeholders, false otherwise.
+`)
+}
+
+// CompleteEmptydirs is a completion hook for the emptydirs command.
+func (rs *Reposurgeon) CompleteEmptydirs(text string) []string {
+	return []string{"strip"}
+}
+
+// DoEmptydirs manages placeholder files for empty directories.
+func (rs *Reposurgeon) DoEmptydirs(line string) bool {
+	parse := rs.newLineParse(line, "emptydirs", parseALLREPO|parseNOOPTS, nil)
+	defer parse.Closem()
+	if len(parse.args) == 0 || parse.args[0] != "strip" || len(parse.args) > 3 {
+		croak("emptydirs requires the strip subcommand, then an optional name and content.")
+		return false
+	}
+	name, content := emptyDirPolicy()
+	if len(parse.args) > 1 {
+		name, content = parse.args[1], nil
+	}
+	if len(parse.args) > 2 {
+		text, err := stringEscape(parse.args[2])
+		if err != nil {
+			croak("while reading placeholder content: %v", err)
+			return false
+		}
+		content = placeholderText(text)
+	}
+	removed := rs.chosen().stripEmptyDirs(rs.selection, name, content)
+	respond("%d placeholder fileops removed.", removed)
+	return false
+}
+
 // HelpIgnores says "Shut up, golint!"
 func (rs *Reposurgeon) HelpIgnores() {
 	rs.helpOutput(`
 ignores [--translate] [--defaults]
+ignores --merge
 
 Intelligent handling of ignore-pattern files.
 
@@ -5629,6 +8272,20 @@ This command fails if no repository has been selected, or no preferred
 write type has been set for the repository.  It does not take a
 selection set.
 
+If --merge is present, the ignore files of each directory, in whatever
+dialects they are - .cvsignore, .gitignore, .hgignore and so on - are
+merged into a single ignore file for the preferred type, all through
+history.  At each commit that changes ignore patterns, the fileops on
+the old files are replaced with a modification (or deletion) of the
+merged one.  The preferred type's own file comes first, unchanged; the
+others are translated as by --translate.  CVS patterns, which are
+whitespace-separated and apply only to their own directory, are
+anchored there.  Directories with only native ignore files are left
+alone.  The preferred type must keep ignore files per directory, so
+this doesn't work for bzr or darcs; --merge can't be combined with the
+other options.  Subversion's svn:ignore properties become .gitignore
+files as a dump is read, so they take part as git ignore files.
+
 If --translate is present, the command will fail if the loaded
 repository has no source type; otherwise, translation of each ignore
 file is attempted. Pattern lines it can't translate get commented out;
@@ -5656,7 +8313,7 @@ is set.
 
 // CompleteIgnores is a completion hook over ignore options
 func (rs *Reposurgeon) CompleteIgnores(text string) []string {
-	return []string{"--rename", "--translate", "--defaults"}
+	return []string{"--defaults", "--merge", "--rename", "--translate"}
 }
 
 // DoIgnores manipulates ignore patterns in the repo.
@@ -5671,6 +8328,22 @@ func (rs *Reposurgeon) DoIgnores(line string) bool {
 		return false
 	}
 	repo := rs.chosen()
+	if parse.options.Contains("--merge") {
+		if len(parse.options) > 1 {
+			croak("--merge can't be combined with other ignores options")
+			return false
+		}
+		if strings.Contains(rs.preferred.ignorename, "/") || rs.preferred.hasCapability(ignBZR) {
+			croak("%s has no per-directory ignore files to merge into", rs.preferred.name)
+			return false
+		}
+		problems, changecount := repo.mergeIgnores(rs.preferred, control.baton)
+		for _, issue := range problems {
+			respond("%s, line %d = %q: %s", issue.mark, issue.lineno, issue.line, issue.err)
+		}
+		respond(fmt.Sprintf("%d commits modified.", changecount))
+		return false
+	}
 	if parse.options.Contains("--defaults") {
 		if rs.preferred.styleflags.Contains("import-defaults") {
 			croak("importer already set default ignores")
@@ -5695,6 +8368,110 @@ func (rs *Reposurgeon) DoIgnores(line string) bool {
 	return false
 }
 
+// HelpRefpolicy says "Shut up, golint!"
+func (rs *Reposurgeon) HelpRefpolicy() {
+	rs.helpOutput(`
+refpolicy check [>OUTFILE]
+refpolicy apply [--dry-run] [<POLICYFILE] [>OUTFILE]
+
+Check and normalize ref names in bulk: branch names on commits and
+resets, and annotated tags, which are treated as refs/tags/NAME.
+
+"check" reports ref names that git would refuse - by the rules of git
+check-ref-format, or because a ref is also a directory of other refs,
+as refs/heads/a and refs/heads/a/b are - and names that are merely
+troublesome: refs not under refs/, names differing only in case, and
+branches and tags sharing a short name.  Each line gives the ref and
+the problem.  A rebuild to git runs the same check and refuses to
+start if any ref would be rejected, rather than failing in the
+importer.
+
+"apply" reads a ref policy from standard input and renames refs by
+it.  Policy lines are:
+
+map PATTERN REPLACEMENT::
+   Rewrite names matching the regular expression PATTERN.  REPLACEMENT
+   may contain back-references (${1} etc.).  Map rules are applied in
+   order, each to the result of the last.
+
+sanitize::
+   Repair names git would refuse, replacing forbidden characters with
+   underscores and removing empty or dot-led components.
+
+collisions {fail|suffix}::
+   When two refs would end up with the same name, or one would be a
+   directory of another, either fail (the default) or rename the
+   later-claimed one by appending -2, -3 and so on.  Refs keeping
+   their names have first claim, and no suffix takes a name some
+   other ref is being renamed to.  A renamed ref that would sit
+   under one keeping its name moves to a suffixed directory.
+
+Blank lines and lines beginning with # are ignored.  All renames are
+worked out before any are made, so a policy that fails changes nothing.
+An annotated tag may not be moved out of refs/tags/.  Each rename is
+reported as old and new names; with --dry-run, nothing is changed.
+
+For example, to turn remote-tracking branches into local ones and put
+prefixless tags where they belong:
+
+----
+refpolicy apply <<EOF
+map ^refs/remotes/origin/(.*)$ refs/heads/${1}
+map ^tags/(.*)$ refs/tags/${1}
+sanitize
+collisions suffix
+EOF
+----
+`)
+}
+
+// CompleteRefpolicy is a completion hook across refpolicy verbs
+func (rs *Reposurgeon) CompleteRefpolicy(text string) []string {
+	return []string{"apply", "check", "--dry-run"}
+}
+
+// DoRefpolicy is the handler for the "refpolicy" command.
+func (rs *Reposurgeon) DoRefpolicy(line string) bool {
+	parse := rs.newLineParse(line, "refpolicy", parseREPO|parseNOSELECT|parseNEEDARG, orderedStringSet{"stdin", "stdout"})
+	defer parse.Closem()
+	repo := rs.chosen()
+	switch parse.args[0] {
+	case "check":
+		for _, p := range repo.checkRefs() {
+			severity := "warning"
+			if p.fatal {
+				severity = "error"
+			}
+			fmt.Fprintf(parse.stdout, "%s: %s %s\n", severity, p.ref, p.problem)
+		}
+	case "apply":
+		policy, err := parseRefPolicy(parse.stdin)
+		if err != nil {
+			croak("%v", err)
+			return false
+		}
+		renames, err := repo.planRefPolicy(policy)
+		if err != nil {
+			croak("ref policy not applied: %v", err)
+			return false
+		}
+		olds := make([]string, 0, len(renames))
+		for old := range renames {
+			olds = append(olds, old)
+		}
+		sort.Strings(olds)
+		for _, old := range olds {
+			fmt.Fprintf(parse.stdout, "%s -> %s\n", old, renames[old])
+		}
+		if !parse.options.Contains("--dry-run") {
+			repo.renameRefs(renames)
+		}
+	default:
+		croak("refpolicy requires a check or apply subcommand")
+	}
+	return false
+}
+
 // HelpAttribute says "Shut up, golint!"
 // FIXME: Odd syntax
 func (rs *Reposurgeon) HelpAttribute() {
@@ -5893,7 +8670,7 @@ func (rs *Reposurgeon) DoAttribute(line string) bool {
 // HelpAuthors says "Shut up, golint!"
 func (rs *Reposurgeon) HelpAuthors() {
 	rs.helpOutput(`
-[SELECTION] authors {read <INFILE | write >OUTFILE}
+[SELECTION] authors {read [--mailmap] [<INFILE] | write [--mailmap] >OUTFILE}
 
 Apply or dump author-map information for the specified selection
 set, defaulting to all events.
@@ -5923,6 +8700,26 @@ as is.  This accommodates people with past addresses (possibly at
 different locations) unifying such aliases in metadata so searches
 and statistical aggregation will work better.
 
+An authors file may also contain wildcard rules for identities no
+entry matches. A domain rule moves every address at one domain to
+another, keeping the part before the @, and may give a timezone as
+entries do:
+
+--------
+*@oldcorp.com = *@newcorp.com Europe/Berlin
+--------
+
+A name rule is a regular expression between slashes; each full name
+it matches is rewritten with the replacement, which may contain
+back-references (${1} etc.):
+
+--------
+/^(\w+), (\w+)$/ = ${2} ${1}
+--------
+
+Domain rules are applied first, then name rules in the order they
+appear.
+
 An authors file may have comment lines beginning with #; these
 are ignored.
 
@@ -5947,12 +8744,32 @@ part to the right of an equals sign will need editing.
 
 You can also use 'write' after 'read' to dump a list of the name mappings
 reposurgeon currently knows about.
+
+With the --mailmap option, the file is in the syntax of a git
+.mailmap instead.  Each line gives a proper name and address followed
+by the address, and optionally the name, found in commits; either part
+of the proper identity may be left out, and is then kept as found.
+
+--------
+Fred J. Foonly <foonly@foo.com> <fred@oldhost>
+Fred J. Foonly <foonly@foo.com> Fred <fred@laptop.local>
+--------
+
+'authors read --mailmap' applies such a file, matching names and
+addresses without regard to case as git does.  Lines that match on
+the address alone are added to the author map; lines that also give
+a name are added as aliases.  Without a redirect it reads the .mailmap
+in the tip commit of master (or the last commit if there is no
+master).  'authors write --mailmap' writes the author map and aliases
+in mailmap form.  Author-map entries keyed by a bare local ID become
+lines matching that exact address, which is how git-cvsimport and
+cvs2git leave them.
 `)
 }
 
 // CompleteAuthors is a completion hook over authors modes
 func (rs *Reposurgeon) CompleteAuthors(text string) []string {
-	return []string{"read", "write"}
+	return []string{"read", "write", "--mailmap"}
 }
 
 // DoAuthors applies or dumps author-mapping file.
@@ -5964,40 +8781,317 @@ func (rs *Reposurgeon) DoAuthors(line string) bool {
 	if strings.HasPrefix(line, "write") {
 		line = strings.TrimSpace(line[5:])
 		parse := rs.newLineParse(line,
-			"authors write", parseREPO|parseNEEDREDIRECT|parseNOOPTS, orderedStringSet{"stdout"})
+			"authors write", parseREPO|parseNEEDREDIRECT, orderedStringSet{"stdout"})
 		defer parse.Closem()
-		rs.chosen().writeAuthorMap(selection, parse.stdout)
+		if parse.options.Contains("--mailmap") {
+			if err := rs.chosen().writeMailmap(parse.stdout); err != nil {
+				croak("%v", err)
+			}
+		} else {
+			rs.chosen().writeAuthorMap(selection, parse.stdout)
+		}
 	} else if strings.HasPrefix(line, "read") {
 		line = strings.TrimSpace(line[4:])
 		parse := rs.newLineParse(line,
-			"authors read", parseREPO|parseNEEDREDIRECT|parseNOOPTS, orderedStringSet{"stdin"})
+			"authors read", parseREPO|parseNEEDREDIRECT, orderedStringSet{"stdin"})
 		defer parse.Closem()
-		rs.chosen().readAuthorMap(selection, parse.stdin)
+		if !parse.options.Contains("--mailmap") {
+			rs.chosen().readAuthorMap(selection, parse.stdin)
+		} else if parse.redirected {
+			respond("%d mailmap entries read.", rs.chosen().readMailmap(selection, parse.stdin))
+		} else if count, err := rs.chosen().readTipMailmap(selection); err != nil {
+			croak("%v", err)
+		} else {
+			respond("%d mailmap entries read.", count)
+		}
 	} else {
 		croak("ill-formed authors command")
 	}
 	return false
 }
 
+// HelpIssues says "Shut up, golint!"
+func (rs *Reposurgeon) HelpIssues() {
+	rs.helpOutput(`
+[SELECTION] issues [--dry-run] PATTERN [TEMPLATE] [<MAPFILE] [>OUTFILE]
+
+Rewrite references to issue-tracker tickets in the comments of the
+selected commits and tags, which default to all of them, as when the
+tickets have been renumbered in a move to another tracker.
+
+PATTERN finds the references.  It is a regular expression, delimited
+as in /Issue #(\d+)/, whose first group, or whole match if it has no
+groups, is the ticket ID.  A group named "id" is the ID whatever its
+place, and if there is a group named "ref", the reference is what it
+matches rather than the whole match, so the expression can look at
+the text around the reference without rewriting it.  Or PATTERN is
+the name of one of these styles:
+
+----
+ hash    "#123", but not after a letter, digit or &, as in "page#3"
+ bug     "bug 456", "Bug: 456" or "bug #456"
+ jira    JIRA keys such as "PROJ-789", the whole key being the ID
+----
+
+With an input redirect, MAPFILE is a table of ticket IDs, each line
+an old ID and the new one separated by whitespace; blank lines and
+lines beginning with # are ignored.  The ID in each reference is
+replaced by its new one, and references to IDs not in the table are
+left alone and reported.
+
+With TEMPLATE, each reference is replaced as a whole by the template,
+with {id} replaced by the ticket ID (mapped, if there is a table) and
+{ref} by the reference as it was.  For example, "{ref}
+<https://tracker.example.org/{id}>" keeps the reference and adds a
+link.  A table, a template, or both are required.
+
+Every comment is rewritten in one pass, so a table mapping 1 to 2 and
+2 to 3 turns #1 into #2 and #2 into #3.  Each reference changed is
+reported with the event it is in, followed by a count and the IDs not
+in the table.  With --dry-run, the report is made but nothing is
+changed.
+
+Clears Q bits, then sets them on the events with references changed.
+
+----
+# Bugzilla numbers became JIRA keys
+issues /[Bb]ug (\d+)/ "{id}" <bugzilla-to-jira.map
+----
+`)
+}
+
+// CompleteIssues is a completion hook over reference styles
+func (rs *Reposurgeon) CompleteIssues(text string) []string {
+	return []string{"--dry-run", "bug", "hash", "jira"}
+}
+
+// DoIssues rewrites issue references in comments.
+func (rs *Reposurgeon) DoIssues(line string) bool {
+	parse := rs.newLineParse(line, "issues", parseALLREPO, orderedStringSet{"stdin", "stdout"})
+	defer parse.Closem()
+	if len(parse.args) < 1 || len(parse.args) > 2 || len(parse.args) == 1 && parse.infile == "" {
+		croak("issues requires a pattern and a template, a map file redirect, or both")
+		return false
+	}
+	ir := new(issueRewrite)
+	if expr, ok := issuePatterns[parse.args[0]]; ok {
+		ir.pattern = regexp.MustCompile(expr)
+	} else if len(parse.args[0]) < 3 || !unicode.IsPunct(rune(parse.args[0][0])) {
+		croak("issues requires a reference style or a delimited regular expression, not %q", parse.args[0])
+		return false
+	} else {
+		ir.pattern = parse.getPattern(parse.args[0], "text")
+	}
+	if len(parse.args) == 2 {
+		template, err := stringEscape(parse.args[1])
+		if err != nil {
+			croak("bad escape in issue template: %v", err)
+			return false
+		}
+		ir.template = template
+	}
+	if parse.infile != "" {
+		mapping, err := readIssueMap(parse.stdin)
+		if err != nil {
+			croak("%v", err)
+			return false
+		}
+		ir.mapping = mapping
+	}
+	changes, missing := rs.chosen().rewriteIssues(rs.selection, ir, parse.options.Contains("--dry-run"))
+	for _, change := range changes {
+		fmt.Fprintf(parse.stdout, "%s: %q -> %q\n", change.event.idMe(), change.before, change.after)
+	}
+	fmt.Fprintf(parse.stdout, "%d references rewritten\n", len(changes))
+	for _, id := range missing {
+		fmt.Fprintf(parse.stdout, "%s not in the issue map\n", id)
+	}
+	return false
+}
+
+// HelpCoauthors says "Shut up, golint!"
+func (rs *Reposurgeon) HelpCoauthors() {
+	rs.helpOutput(`
+[SELECTION] coauthors {trailers|authors|VCS}
+
+Move co-authors between author lines and comment trailers.  A
+fast-import stream can give a commit more than one author; bzr keeps
+them all, but git silently keeps only the first.  The convention
+understood by git tooling is instead a "Co-authored-by: Name <address>"
+trailer in the last paragraph of the comment for each further author.
+
+With "trailers", every author of a commit after the first becomes a
+co-author trailer.  With "authors", co-author trailers become authors
+after the first, carrying the first author's date; a trailer without a
+usable address stays where it is.  Given the name of a version-control
+system instead, the direction is chosen by whether that system can
+record multiple authors - "authors" if it can, "trailers" if not.
+With no argument, the preferred type is used that way.
+
+Either way, co-author trailers already present are respelled in the
+canonical form "Co-authored-by" and duplicates, including repeats of
+the main author, are dropped.
+
+Takes a selection set, defaulting to all commits.
+
+Sets Q bits: true for each commit changed, false otherwise.
+`)
+}
+
+// CompleteCoauthors is a completion hook over coauthors modes
+func (rs *Reposurgeon) CompleteCoauthors(text string) []string {
+	modes := []string{"authors", "trailers"}
+	for _, vcs := range vcstypes {
+		modes = append(modes, vcs.name)
+	}
+	return modes
+}
+
+// DoCoauthors is the handler for the "coauthors" command.
+func (rs *Reposurgeon) DoCoauthors(line string) bool {
+	parse := rs.newLineParse(line, "coauthors", parseALLREPO|parseNOOPTS, nil)
+	target := rs.preferred
+	var toAuthors bool
+	if len(parse.args) > 1 {
+		croak("coauthors takes at most one argument")
+		return false
+	} else if len(parse.args) == 1 && parse.args[0] == "trailers" {
+		toAuthors = false
+	} else if len(parse.args) == 1 && parse.args[0] == "authors" {
+		toAuthors = true
+	} else {
+		if len(parse.args) == 1 {
+			target = nil
+			for i := range vcstypes {
+				if vcstypes[i].name == parse.args[0] {
+					target = &vcstypes[i]
+				}
+			}
+			if target == nil {
+				croak("unknown version-control system %s", parse.args[0])
+				return false
+			}
+		}
+		if target == nil {
+			croak("no preferred type has been set")
+			return false
+		}
+		toAuthors = target.extensions.Contains("multiple-authors")
+	}
+	changed := rs.chosen().normalizeCoauthors(rs.selection, toAuthors)
+	respond("%d commits changed.", changed)
+	return false
+}
+
 //
 // Reference lifting
 //
 
+// HelpCodeowners says "Shut up, golint!"
+func (rs *Reposurgeon) HelpCodeowners() {
+	rs.helpOutput(`
+[SELECTION] codeowners [--depth=N] [--window=DAYS] [--top=N] [>OUTFILE]
+
+Draft a CODEOWNERS file from the history.  For the root and each
+directory prefix down to the given depth (default 1), the authors of
+commits touching paths under it are ranked by the number of such
+commits, and the top few (default 3) are listed as owners by email
+address.  Ties go to the author who worked there most recently.
+
+Takes a selection set of commits, defaulting to all.  To draft owners
+from one branch only, select it with a branch search, e.g.
+"/^refs.heads.main$/b".  With --window, only commits made within that
+many days of the newest selected commit are counted.
+
+Entries are written shallowest first, as CODEOWNERS files are matched
+last-wins, and each is preceded by a comment giving the counts it was
+drawn from.  The result is a draft: review it, and map addresses to
+forge user names where needed, before committing it.
+`)
+}
+
+// DoCodeowners is the handler for the "codeowners" command.
+func (rs *Reposurgeon) DoCodeowners(line string) bool {
+	parse := rs.newLineParse(line, "codeowners", parseALLREPO, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	intopt := func(name string, dflt int) (int, bool) {
+		val, present := parse.OptVal(name)
+		if !present {
+			return dflt, true
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			croak("%s option must be a nonnegative integer", name)
+			return 0, false
+		}
+		return n, true
+	}
+	depth, ok1 := intopt("--depth", 1)
+	days, ok2 := intopt("--window", 0)
+	top, ok3 := intopt("--top", 3)
+	if !(ok1 && ok2 && ok3) {
+		return false
+	}
+	window := time.Duration(days) * 24 * time.Hour
+	writeCodeOwners(parse.stdout, rs.chosen().codeOwners(rs.selection, depth, window, top))
+	return false
+}
+
 // HelpLegacy says "Shut up, golint!"
 func (rs *Reposurgeon) HelpLegacy() {
 	rs.helpOutput(`
-legacy {read [<INFILE] | write [>OUTFILE]}
+legacy {read [<INFILE] | write [>OUTFILE] | journal [PATH|off]}
+[SELECTION] legacy trailers
+
+Apply or list legacy-reference information. Except for 'trailers',
+does not take a selection set. The 'read' variant reads from standard
+input or a <-redirected filename; the 'write' variant writes to
+standard output or a >-redirected filename.
+
+The 'journal' variant attaches an append-only journal file to the
+repository. Legacy references recorded in the journal that are not
+yet known are resolved against the repository's commits, the journal
+is brought up to date with the current references, and from then on
+every change to them is appended to it as it is made. Unlike a
+legacy-map file, which has to be rewritten whole, the journal can be
+updated cheaply during long conversions and picked up again by a later
+session. The journal format is that of the legacy-map file, except
+that an action stamp of "-" records a deletion and later lines
+override earlier ones. With 'off', the journal is flushed and
+detached; with no argument, the path of the current journal is
+reported.
+
+A journal can also be attached before a stream or repository is read
+with the --legacy-journal=PATH option of the read command, so that
+legacy IDs are journaled as they are assigned.
+
+The 'trailers' variant gathers legacy references left in comments by
+earlier conversions, in whatever form they took, and turns them into
+the "Legacy-ID:" trailers that "write --legacy" produces.  The
+commit's legacy ID is set from the reference and the reference is
+entered in the legacy map, so it can be lifted like any other.  Lines
+recognized, when they consist of nothing but the reference, are:
+
+----
+Legacy-ID: 1234                     (in any capitalization)
+git-svn-id: URL@1234 UUID           (git-svn)
+svn path=/trunk/; revision=1234     (svn2git scripts)
+SVN revision: 1234                  (or "svn r1234", "Subversion: 1234")
+$Id: file.c,v 1.8 ... $             (CVS, or Subversion without the dot)
+$Revision: 1234 $                   (Subversion)
+----
 
-Apply or list legacy-reference information. Does not take a
-selection set. The 'read' variant reads from standard input or a
-<-redirected filename; the 'write' variant writes to standard
-output or a >-redirected filename.
+A commit whose comment names a legacy ID other than the one it
+already has is left alone, as is a reference that already belongs to
+another commit; both are warned about.  Takes a selection set,
+defaulting to all commits.  Sets Q bits: true for each commit whose
+comment was changed, false otherwise.
 `)
 }
 
 // CompleteLegacy is a completion hook over legacy modes
 func (rs *Reposurgeon) CompleteLegacy(text string) []string {
-	return []string{"read", "write"}
+	return []string{"read", "write", "journal", "trailers"}
 }
 
 // DoLegacy apply a reference-mapping file.
@@ -6014,6 +9108,34 @@ func (rs *Reposurgeon) DoLegacy(line string) bool {
 			"legacy read", parseREPO|parseNEEDREDIRECT|parseNOOPTS, []string{"stdin"})
 		defer parse.Closem()
 		rs.chosen().readLegacyMap(parse.stdin, control.baton)
+	} else if strings.HasPrefix(line, "trailers") {
+		line = strings.TrimSpace(line[8:])
+		parse := rs.newLineParse(line, "legacy trailers", parseALLREPO|parseNOOPTS|parseNOARGS, nil)
+		defer parse.Closem()
+		changed := rs.chosen().normalizeLegacyTrailers(rs.selection)
+		respond("%d comments changed.", changed)
+	} else if strings.HasPrefix(line, "journal") {
+		line = strings.TrimSpace(line[7:])
+		parse := rs.newLineParse(line, "legacy journal", parseREPO|parseNOOPTS, nil)
+		defer parse.Closem()
+		repo := rs.chosen()
+		if len(parse.args) == 0 {
+			if repo.legacyLog == nil {
+				respond("no legacy journal is attached.")
+			} else {
+				respond("legacy journal is %s.", repo.legacyLog.path)
+			}
+		} else if parse.args[0] == "off" {
+			if err := repo.closeLegacyJournal(); err != nil {
+				croak("%v", err)
+			}
+		} else if err := repo.openLegacyJournal(parse.args[0]); err != nil {
+			croak("%v", err)
+		} else if count, err := repo.syncLegacyJournal(control.baton); err != nil {
+			croak("%v", err)
+		} else {
+			respond("%d legacy references recovered from journal.", count)
+		}
 	} else {
 		croak("ill-formed legacy command")
 	}
@@ -6056,6 +9178,78 @@ func (rs *Reposurgeon) DoStampify(line string) bool {
 	return false
 }
 
+// HelpBoilerplate says "Shut up, golint!"
+func (rs *Reposurgeon) HelpBoilerplate() {
+	rs.helpOutput(`
+[SELECTION] boilerplate [--dry-run] [--list] [<PATTERNFILE] [>OUTFILE]
+
+Strip boilerplate left by converters and exporters from the comments
+of commits and tags in the selection, by default all of them. Each
+kind of boilerplate is recognized by a named regular expression;
+everything a pattern matches is removed, and runs of blank lines left
+behind are squeezed to one. The built-in patterns are:
+
+cvs2svn::
+   The "This commit was manufactured by cvs2svn" paragraph.
+
+git-svn-id::
+   git-svn's record of the Subversion URL and revision.
+
+cvs-empty::
+   CVS's "*** empty log message ***", in several languages.
+
+no-message::
+   Placeholders such as "(no message)" and "<empty log message>".
+
+More patterns may be given on standard input, one per line: a name,
+a space, and a regular expression in Go syntax, matched in multiline
+mode so that ^ and $ match at line boundaries. Blank lines and lines
+beginning with # are ignored. User patterns are applied after the
+built-in ones.
+
+For each pattern, the number of matches removed is reported, followed
+by the number of comments changed. With --dry-run, nothing is changed.
+With --list, the patterns are listed instead.
+
+Sets Q bits: true on commits and tags whose comments were (or with
+--dry-run, would be) changed, false on all other events.
+
+----
+# Also drop a trailer left by an old mirror script
+boilerplate <<EOF
+mirror ^Mirrored from https://svn\.example\.org/.*$\n?
+EOF
+----
+`)
+}
+
+// DoBoilerplate strips exporter boilerplate from comments.
+func (rs *Reposurgeon) DoBoilerplate(line string) bool {
+	parse := rs.newLineParse(line, "boilerplate", parseALLREPO|parseNOARGS, orderedStringSet{"stdin", "stdout"})
+	defer parse.Closem()
+	patterns := boilerplateLibrary
+	if parse.infile != "" {
+		user, err := parseBoilerplatePatterns(parse.stdin)
+		if err != nil {
+			croak("%v", err)
+			return false
+		}
+		patterns = append(append([]boilerplatePattern{}, boilerplateLibrary...), user...)
+	}
+	if parse.options.Contains("--list") {
+		for _, p := range patterns {
+			fmt.Fprintf(parse.stdout, "%s %s\n", p.name, p.re.String())
+		}
+		return false
+	}
+	hits, changed := rs.chosen().dropBoilerplate(rs.selection, patterns, parse.options.Contains("--dry-run"))
+	for i, p := range patterns {
+		fmt.Fprintf(parse.stdout, "%s %d\n", p.name, hits[i])
+	}
+	fmt.Fprintf(parse.stdout, "%d comments changed\n", changed)
+	return false
+}
+
 // HelpGitify says "Shut up, golint!"
 func (rs *Reposurgeon) HelpGitify() {
 	rs.helpOutput(`
@@ -6153,75 +9347,249 @@ func (rs *Reposurgeon) DoCheckout(line string) bool {
 	return false
 }
 
+// HelpArchive says "Shut up, golint!"
+func (rs *Reposurgeon) HelpArchive() {
+	rs.helpOutput(`
+SELECTION archive [--format=tgz|tar|zip] [--prefix=PREFIX] >OUTFILE
+
+Write the tree of a commit as an archive file, which is easier to
+look at elsewhere than a checkout and leaves nothing behind in the
+scratch directory.  The selection set must resolve to a singleton
+commit, and output must be redirected.
+
+The format defaults to tar if the output file name ends in .tar, zip
+if it ends in .zip, and gzipped tar otherwise.  File modes and
+symbolic links are kept; a submodule becomes an empty directory.
+Every entry has the commit date, so the same commit always gives the
+same archive.  With --prefix, PREFIX goes in front of every path; to
+put the files in a directory, end it with a slash.
+`)
+}
+
+// DoArchive writes the tree of a commit as a tar or zip archive.
+func (rs *Reposurgeon) DoArchive(line string) bool {
+	parse := rs.newLineParse(line, "archive", parseREPO|parseNOARGS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if rs.selection.Size() != 1 {
+		croak("a singleton selection set is required.")
+		return false
+	}
+	commit, ok := rs.chosen().events[rs.selection.Fetch(0)].(*Commit)
+	if !ok {
+		croak("not a commit.")
+		return false
+	}
+	if parse.outfile == "" || parse.outfile == "-" {
+		croak("archive output must be redirected to a file.")
+		return false
+	}
+	format := "tgz"
+	if strings.HasSuffix(parse.outfile, ".tar") {
+		format = "tar"
+	} else if strings.HasSuffix(parse.outfile, ".zip") {
+		format = "zip"
+	}
+	if val, ok := parse.OptVal("--format"); ok {
+		format = val
+	}
+	if !newStringSet(archiveFormats...).Contains(format) {
+		croak("archive format must be one of %s.", strings.Join(archiveFormats, ", "))
+		return false
+	}
+	prefix, _ := parse.OptVal("--prefix")
+	if err := commit.archive(parse.stdout, format, prefix); err != nil {
+		croak("archive: %v", err)
+	}
+	return false
+}
+
 // HelpDiff says "Shut up, golint!"
 func (rs *Reposurgeon) HelpDiff() {
 	rs.helpOutput(`
-SELECTION diff [>OUTFILE]
+SELECTION diff [PATH...] [>OUTFILE]
 
 Display the difference between commits. Takes a selection-set argument which
-must resolve to exactly two commits.
+must resolve to exactly two commits, or to one commit, which is compared
+with its first parent (a root commit is compared with an empty tree).
+File content is taken from the commits' manifests, so nothing is checked
+out.  With PATH arguments, only those paths are compared, and any
+that is in neither commit is reported as such.
+
+Paths only in the first commit are reported as removed, those only in
+the second as added, and changed content as a unified diff.  Binary
+content is not diffed.  If the line endings of a file change between
+LF, CRLF and mixed, that is reported on a line of its own, and the
+diff is taken with both versions normalized to LF, so that a file
+whose only change is its line endings doesn't show every line as
+changed.
 `)
 }
 
 // DoDiff displays a diff between versions.
 func (rs *Reposurgeon) DoDiff(line string) bool {
-	parse := rs.newLineParse(line, "diff", parseREPO|parseNOARGS|parseNOOPTS, orderedStringSet{"stdout"})
+	parse := rs.newLineParse(line, "diff", parseREPO|parseNOOPTS, orderedStringSet{"stdout"})
 	defer parse.Closem()
 	repo := rs.chosen()
-	if rs.selection.Size() != 2 {
+	var lower, upper *Commit
+	ok1, ok2 := false, false
+	switch rs.selection.Size() {
+	case 1:
+		upper, ok2 = repo.events[rs.selection.Fetch(0)].(*Commit)
+		ok1 = ok2
+		if ok2 && upper.hasParents() {
+			lower, ok1 = upper.firstParent().(*Commit)
+		}
+	case 2:
+		lower, ok1 = repo.events[rs.selection.Fetch(0)].(*Commit)
+		upper, ok2 = repo.events[rs.selection.Fetch(1)].(*Commit)
+	}
+	if !ok1 || !ok2 {
 		if logEnable(logWARN) {
-			logit("a pair of commits is required.")
+			logit("a pair of commits or a single commit is required.")
 		}
 		return false
 	}
-	lower, ok1 := repo.events[rs.selection.Fetch(0)].(*Commit)
-	upper, ok2 := repo.events[rs.selection.Fetch(1)].(*Commit)
-	if !ok1 || !ok2 {
-		if logEnable(logWARN) {
-			logit("a pair of commits is required.")
+	dir1 := manifestEntries(lower)
+	dir2 := manifestEntries(upper)
+	allpaths := newOrderedStringSet(parse.args...)
+	if len(parse.args) == 0 {
+		for path := range dir1 {
+			allpaths = append(allpaths, path)
+		}
+		for path := range dir2 {
+			if _, ok := dir1[path]; !ok {
+				allpaths = append(allpaths, path)
+			}
 		}
+	}
+	sort.Strings(allpaths)
+	for _, path := range allpaths {
+		_, in1 := dir1[path]
+		_, in2 := dir2[path]
+		if in1 && in2 {
+			fromtext, _ := lower.blobByName(path)
+			totext, _ := upper.blobByName(path)
+			contentDiff(parse.stdout, path, fromtext, totext, lower.mark, upper.mark)
+		} else if in1 {
+			fmt.Fprintf(parse.stdout, "%s: removed\n", path)
+		} else if in2 {
+			fmt.Fprintf(parse.stdout, "%s: added\n", path)
+		} else {
+			fmt.Fprintf(parse.stdout, "%s: in neither commit\n", path)
+		}
+	}
+	return false
+}
+
+// HelpPatches says "Shut up, golint!"
+func (rs *Reposurgeon) HelpPatches() {
+	rs.helpOutput(`
+[SELECTION] patches [DIRECTORY] [>OUTFILE]
+
+Render the selected commits, defaulting to all, as patches in the
+form git format-patch makes, for review or to be applied elsewhere
+with "git am".  Each patch is a mailbox message with the commit's
+first author, or its committer, in From, the author date in Date, the
+first line of the comment in Subject, numbered as [PATCH n/m] when
+there are several, and the rest of the comment as the message body.
+The diff that follows is against the commit's first parent, or an
+empty tree for a root, with content taken from manifests so nothing
+is checked out.  Binary changes are noted but not included, and merge
+commits are skipped.
+
+Without DIRECTORY the patches are written one after another, making a
+single mailbox.  With DIRECTORY, which is created if need be, each
+patch goes in a file of its own there, named as git names them, such
+as 0001-Fix-the-frobnicator.patch.
+`)
+}
+
+// DoPatches renders commits as format-patch style patches.
+func (rs *Reposurgeon) DoPatches(line string) bool {
+	parse := rs.newLineParse(line, "patches", parseALLREPO|parseNOOPTS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if len(parse.args) > 1 {
+		croak("patches takes at most one directory argument")
+		return false
+	}
+	dir := ""
+	if len(parse.args) == 1 {
+		dir = parse.args[0]
+	}
+	n, err := rs.chosen().writePatches(parse.stdout, rs.selection, dir)
+	if err != nil {
+		croak("patches: %v", err)
+		return false
+	}
+	if dir != "" {
+		respond("%d patches written to %s.", n, dir)
+	}
+	return false
+}
+
+// HelpApply says "Shut up, golint!"
+func (rs *Reposurgeon) HelpApply() {
+	rs.helpOutput(`
+SELECTION apply [--branch=NAME] [<PATCHFILE]
+
+Apply patches read from standard input as new commits on top of the
+selected commit, which must be a single one.  The input may be a
+mailbox of patches as git format-patch or the patches command writes
+them, or a plain unified diff.  Each message becomes a commit with its
+sender as author, its date as author and committer date, and its
+subject and body as the comment; the invoking user is the committer.
+A plain diff becomes one commit by the invoking user, dated a second
+after its parent, with whatever precedes the diff as its comment.
+
+Patches are applied to content taken from the manifest of the commit
+they go onto, as patch -p1 would, and each file they change gets a new
+blob.  Hunks may have moved but must otherwise apply exactly; if any
+patch fails, or changes a binary file, nothing is changed.
+
+The new commits go on the branch named by --branch or, without it, on
+the selected commit's branch, which the selected commit must then be
+the tip of.
+
+Sets Q bits: true on the commits made, false otherwise.
+`)
+}
+
+// DoApply applies patches as new commits.
+func (rs *Reposurgeon) DoApply(line string) bool {
+	parse := rs.newLineParse(line, "apply", parseREPO, orderedStringSet{"stdin"})
+	defer parse.Closem()
+	if len(parse.args) > 0 {
+		croak("apply takes no arguments")
+		return false
+	}
+	repo := rs.chosen()
+	if rs.selection.Size() != 1 {
+		croak("apply requires a single commit.")
+		return false
+	}
+	onto, ok := repo.events[rs.selection.Fetch(0)].(*Commit)
+	if !ok {
+		croak("apply requires a single commit.")
+		return false
+	}
+	content, err := ioutil.ReadAll(parse.stdin)
+	if err != nil {
+		croak("apply: %v", err)
+		return false
+	}
+	patches, err := parsePatches(string(content))
+	if err != nil {
+		croak("apply: %v", err)
+		return false
+	}
+	branch, _ := parse.OptVal("--branch")
+	made, err := repo.applyPatches(patches, onto, branch)
+	if err != nil {
+		croak("apply: %v", err)
 		return false
 	}
-	dir1 := newOrderedStringSet()
-	lower.manifest().iter(func(name string, _ interface{}) {
-		dir1.Add(name)
-	})
-	dir2 := newOrderedStringSet()
-	upper.manifest().iter(func(name string, _ interface{}) {
-		dir2.Add(name)
-	})
-	allpaths := dir1.Union(dir2)
-	sort.Strings(allpaths)
-	for _, path := range allpaths {
-		if dir1.Contains(path) && dir2.Contains(path) {
-			fromtext, _ := lower.blobByName(path)
-			totext, _ := upper.blobByName(path)
-			// Don't list identical files
-			if !bytes.Equal(fromtext, totext) {
-				lines0 := difflib.SplitLines(string(fromtext))
-				lines1 := difflib.SplitLines(string(totext))
-				file0 := path + " (" + lower.mark + ")"
-				file1 := path + " (" + upper.mark + ")"
-				diff := difflib.UnifiedDiff{
-					A:        lines0,
-					B:        lines1,
-					FromFile: file0,
-					ToFile:   file1,
-					Context:  3,
-				}
-				text, _ := difflib.GetUnifiedDiffString(diff)
-				fmt.Fprint(parse.stdout, text)
-			}
-		} else if dir1.Contains(path) {
-			fmt.Fprintf(parse.stdout, "%s: removed\n", path)
-		} else if dir2.Contains(path) {
-			fmt.Fprintf(parse.stdout, "%s: added\n", path)
-		} else {
-			if logEnable(logWARN) {
-				logit("internal error - missing path in diff")
-			}
-			return false
-		}
+	if control.isInteractive() {
+		respond("%d patches applied.", len(made))
 	}
 	return false
 }
@@ -6250,7 +9618,8 @@ in repository read and write time in order to reduce the amount of
 disk space required while editing; this may be useful for large
 repositories. No effect if the edit input was a dump stream; in that
 case, reposurgeon doesn't make on-disk blob copies at all (it points
-into sections of the input stream instead).
+into sections of the input stream instead). The codec is gzip unless
+another is chosen with "set codec".
 `},
 	{"echo",
 		`Echo commands before executing them. Setting this in test scripts may 
@@ -6270,6 +9639,11 @@ anything up to and including making demons fly out of your nose.
 		`Force creation of content blobs on disk when reading a stream file,
 even when it is randomly accessible and the metadata could point at extents in the file.
 Use in regression-test loads to exercise handling of materialized blobs.
+`},
+	{"nospacecheck",
+		`Skip the free-space checks made before a rebuild or before
+materializing blobs. The checks use deliberately pessimistic estimates,
+so this may be needed when space is tight but known to be sufficient.
 `},
 	{"progress",
 		`Enable fancy progress messages even when not on a tty.
@@ -6282,6 +9656,12 @@ Use in regression-test loads to exercise handling of materialized blobs.
 `},
 	{"serial",
 		`Disable parallelism in code. Use for generating test loads.
+`},
+	{"stablemarks",
+		`Derive marks from content rather than from read order: a blob's
+from its hash, a commit's from its action stamp.  Every read ends by
+renumbering this way, and so does every later renumbering, so two
+runs of a conversion over equivalent input write the same marks.
 `},
 }
 
@@ -6303,7 +9683,7 @@ func getOptionNames() []string {
 // HelpSet says "Shut up, golint!"
 func (rs *Reposurgeon) HelpSet() {
 	rs.helpOutput(fmt.Sprintf(`
-set {flag[s] [%s]+ | logfile [PATH] | readlimit [limit]}
+set {flag[s] [%s]+ | logfile [PATH] | codec [CODEC] | readlimit [limit] | workers [N] | queue [N] | spill [BYTES] | manifests [N] | progressfd [FD] | placeholder [NAME [IDENTITY]] | emptydir [NAME [CONTENT]]}
 
 "set flag" sets one or more (tab-completed) options to control
 reposurgeon's behavior.  With no arguments, displays the state of all
@@ -6314,12 +9694,77 @@ standard error.  This command, with a nonempty PATH argument, directs
 them to the specified file instead. The PATH may be a bare token or a
 double-quoted string. Without an argument, reports what logfile is set.
 
+"set codec" chooses the codec on-disk blob copies are compressed with
+when the compress flag is on: gzip (the default), zstd, or lz4.  zstd
+and lz4 are much faster than gzip, and need the zstd or lz4 program.
+The codec can't be changed while repositories are loaded with
+compression on.  Without an argument, reports the codec.
+
 "set readlimit" sets a maximum number of commits to read from a stream.
 If the limit is reached before EOF it will be logged. Mainly useful
 for benchmarking.  Without arguments, report the read limit; 0 means
 there is none.
 
-`, strings.Join(getOptionNames(), "|")))
+"set workers" sets the number of goroutines used by the passes that
+walk events in parallel, such as hashing.  The default, 0, means as
+many as the Go runtime will run at once (GOMAXPROCS, normally the
+number of CPUs).  The serial flag overrides it.  On a shared machine a
+small number keeps reposurgeon from competing for every CPU.
+
+"set queue" sets how many work items may wait in the queue feeding
+those goroutines.  The default, 0, means one per worker.
+
+"set spill" sets a blob size in bytes above which blob data read from
+an import stream is not held in memory at all: it is left in place in
+a seekable input file, or copied straight to the blob's disk file.
+The default, 0, means every blob is buffered in memory while it is
+read.  Keyword-expansion cookies are not looked for in spilled blobs.
+
+"set manifests" bounds the number of commit manifests (the file trees
+of commits) kept in memory once computed.  Past the bound the least
+recently used is forgotten and recomputed from its nearest remembered
+ancestor if it is needed again.  Manifests share most of their
+structure, but an interactive session that looks at trees all over a
+big repository can still accumulate gigabytes of them; a bound of a
+few thousand keeps that in check at some cost in speed.  The default,
+0, means no bound.  The bound counts manifests computed after it was
+set; lowering it forgets the excess at once.
+
+Without an argument, each of these four reports its value.
+
+"set progressfd" sends machine-readable progress reports to an open
+file descriptor, for a program wrapping reposurgeon to draw its own
+progress bars.  Each long-running phase, such as parsing a stream or
+exporting one, reports one line of JSON as it starts, about once a
+second while it runs, and as it ends.  The fields are "phase" (the
+phase's name), "event" ("start", "progress" or "end"), "count" and
+"expected" (items done and in all), "percent", "rate" (items per
+second), "elapsed" (seconds) and "eta" (estimated seconds left, or -1
+before there is an estimate).  For example, with "3>progress.log" in a
+shell command line, "set progressfd 3".  Without an argument, reports
+the descriptor, or -1 if there is none.
+
+"set placeholder" declares a placeholder identity, such as "(no author)",
+"root", "build", or "cvs2svn", left in attributions by conversion tools
+or by commits made without a real user. Whenever an attribution with
+that name is parsed it is replaced by IDENTITY, which may be a bare name
+(replacing only the name field) or a full "Name <email>" (replacing
+both).  With NAME but no IDENTITY, the placeholder is mapped to the
+synthetic identity "%s".  The policy is
+applied as attributions are parsed, so it must be set before the
+repository is read.  With no arguments, lists the policy. Initially
+"(no author)" is mapped to "no-author".
+
+"set emptydir" makes Subversion reads keep empty directories, which git
+can't represent, by putting a placeholder file called NAME (.gitkeep
+if no name is given) in each directory within a branch while it has
+nothing else in it.  The placeholder holds CONTENT, which may be a
+double-quoted string with backslash escapes and gets a trailing
+newline if it lacks one, or nothing.  It must be set before the
+repository is read.  With no arguments, reports the placeholder name
+if one is set.  See also "emptydirs strip".
+
+`, strings.Join(getOptionNames(), "|"), conversionBot))
 }
 
 // CompleteSet is a completion hook across the set of flag options that are not set.
@@ -6330,8 +9775,16 @@ func (rs *Reposurgeon) CompleteSet(text string) []string {
 			out = append(out, x[0])
 		}
 	}
+	out = append(out, "codec")
+	out = append(out, "emptydir")
 	out = append(out, "logfile")
+	out = append(out, "manifests")
+	out = append(out, "placeholder")
+	out = append(out, "progressfd")
+	out = append(out, "queue")
 	out = append(out, "readlimit")
+	out = append(out, "spill")
+	out = append(out, "workers")
 	sort.Strings(out)
 	return out
 }
@@ -6341,7 +9794,11 @@ func performOptionSideEffect(opt string, val bool) {
 		control.baton.setInteractivity(val)
 	}
 	if opt == "crlf" {
-		control.lineSep = "\r\n"
+		if val {
+			control.lineSep = "\r\n"
+		} else {
+			control.lineSep = "\n"
+		}
 	}
 }
 
@@ -6391,6 +9848,24 @@ func (rs *Reposurgeon) DoSet(line string) bool {
 				respond("logfile stdout")
 			}
 		}
+	case "codec":
+		if len(parse.args) < 2 {
+			if control.codec == "" {
+				respond("codec gzip")
+			} else {
+				respond("codec %s", control.codec)
+			}
+			return false
+		}
+		if err := checkCodec(parse.args[1]); err != nil {
+			croak("%v", err)
+			return false
+		}
+		if control.flagOptions["compress"] && len(rs.repolist) > 0 {
+			croak("the codec can't be changed while compressed repositories are loaded")
+			return false
+		}
+		control.codec = parse.args[1]
 	case "readlimit":
 		if len(parse.args) < 2 {
 			respond("readlimit %d\n", control.readLimit)
@@ -6403,8 +9878,101 @@ func (rs *Reposurgeon) DoSet(line string) bool {
 			}
 		}
 		control.readLimit = lim
+	case "workers", "queue", "spill", "manifests":
+		if len(parse.args) < 2 {
+			switch mode {
+			case "workers":
+				respond("workers %d", control.workers)
+			case "queue":
+				respond("queue %d", control.queueDepth)
+			case "spill":
+				respond("spill %d", control.spillSize)
+			case "manifests":
+				respond("manifests %d", control.manifestLimit)
+			}
+			return false
+		}
+		n, err := strconv.ParseInt(parse.args[1], 10, 64)
+		if err != nil || n < 0 {
+			croak("set %s needs a nonnegative integer, not %q.", mode, parse.args[1])
+			return false
+		}
+		switch mode {
+		case "workers":
+			control.workers = int(n)
+		case "queue":
+			control.queueDepth = int(n)
+		case "spill":
+			control.spillSize = n
+		case "manifests":
+			control.manifestLimit = int(n)
+			if n > 0 {
+				trimManifests(int(n))
+			}
+		}
+	case "progressfd":
+		if len(parse.args) < 2 {
+			respond("progressfd %d", control.progressFd)
+			return false
+		}
+		fd, err := strconv.Atoi(parse.args[1])
+		if err != nil || fd < 0 {
+			croak("set progressfd needs a file descriptor, not %q.", parse.args[1])
+			return false
+		}
+		fp := os.NewFile(uintptr(fd), "progress")
+		if _, err := fp.Stat(); err != nil {
+			croak("file descriptor %d is not open: %v", fd, err)
+			return false
+		}
+		control.progressFd = fd
+		control.baton.setReporter(fp)
+	case "placeholder":
+		fallthrough
+	case "placeholders":
+		switch len(parse.args) {
+		case 1:
+			names := make([]string, 0, len(control.placeholders))
+			for name := range control.placeholders {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Printf("\t%q = %q\n", name, control.placeholders[name])
+			}
+		case 2:
+			control.placeholders[parse.args[1]] = conversionBot
+		case 3:
+			control.placeholders[parse.args[1]] = parse.args[2]
+		default:
+			croak("set placeholder takes at most a name and an identity.")
+		}
+	case "emptydir":
+		switch len(parse.args) {
+		case 1:
+			if control.emptyDir != "" {
+				respond("emptydir %s", control.emptyDir)
+			}
+			return false
+		case 2:
+			control.emptyDir, control.emptyDirContent = parse.args[1], nil
+		case 3:
+			content, err := stringEscape(parse.args[2])
+			if err != nil {
+				croak("while setting placeholder content: %v", err)
+				return false
+			}
+			control.emptyDir, control.emptyDirContent = parse.args[1], placeholderText(content)
+		default:
+			croak("set emptydir takes at most a name and content.")
+			return false
+		}
+		if strings.Contains(control.emptyDir, "/") {
+			croak("a placeholder name can't contain a slash.")
+			control.emptyDir, control.emptyDirContent = "", nil
+		}
 	default:
-		croak(`"set" needs a "flag" or "flags" or "readlimit" subcommand.`)
+		croak(`"set" needs a "flag" or "flags" or "codec" or "readlimit" or "workers" or "queue" or "spill" or "manifests" or "progressfd" or "placeholder" or "emptydir" subcommand.`)
 	}
 	return false
 }
@@ -6412,7 +9980,7 @@ func (rs *Reposurgeon) DoSet(line string) bool {
 // HelpClear says "Shut up, golint!"
 func (rs *Reposurgeon) HelpClear() {
 	rs.helpOutput(fmt.Sprintf(`
-clear {flag[s] [%s]+ | readlimit [limit]}
+clear {flag[s] [%s]+ | codec | readlimit | workers | queue | spill | progressfd | placeholder [NAME]+ | emptydir}
 
 "clear flag[s]" clears (tab-completed) boolean options to control reposurgeon's
 behavior.  With no arguments, displays the state of all flags.
@@ -6420,7 +9988,22 @@ Do "help options" to see the available options.
 
 "clear logfile" redirects logging output to the default, stdout.
 
+"clear codec" restores the default blob compression codec, gzip.
+
 "clear readlimit" removes any readlimit that has been set.
+
+"clear workers", "clear queue", "clear spill" and "clear manifests"
+restore the defaults; clearing manifests also forgets every manifest
+the bound was keeping.
+
+"clear progressfd" stops machine-readable progress reports.
+
+"clear placeholder" removes the named placeholder identities from the
+placeholder policy; with no names, it empties the policy entirely so
+that no attribution is remapped.
+
+"clear emptydir" stops Subversion reads from making placeholders for
+empty directories.
 `, strings.Join(getOptionNames(), "|")))
 }
 
@@ -6432,7 +10015,15 @@ func (rs *Reposurgeon) CompleteClear(text string) []string {
 			out = append(out, x[0])
 		}
 	}
+	out = append(out, "codec")
+	out = append(out, "emptydir")
+	out = append(out, "manifests")
+	out = append(out, "placeholder")
+	out = append(out, "progressfd")
+	out = append(out, "queue")
 	out = append(out, "readlimit")
+	out = append(out, "spill")
+	out = append(out, "workers")
 	sort.Strings(out)
 	return out
 }
@@ -6443,14 +10034,43 @@ func (rs *Reposurgeon) DoClear(line string) bool {
 	switch mode := parse.args[0]; mode {
 	case "logfile":
 		control.logfp = control.baton
+	case "codec":
+		if control.flagOptions["compress"] && len(rs.repolist) > 0 {
+			croak("the codec can't be changed while compressed repositories are loaded")
+			return false
+		}
+		control.codec = ""
 	case "readlimit":
 		control.readLimit = 0
+	case "workers":
+		control.workers = 0
+	case "queue":
+		control.queueDepth = 0
+	case "spill":
+		control.spillSize = 0
+	case "manifests":
+		control.manifestLimit = 0
+		trimManifests(0)
+	case "progressfd":
+		control.progressFd = -1
+		control.baton.setReporter(nil)
+	case "placeholder":
+		fallthrough
+	case "placeholders":
+		if len(parse.args) == 1 {
+			control.placeholders = make(map[string]string)
+		}
+		for _, name := range parse.args[1:] {
+			delete(control.placeholders, name)
+		}
+	case "emptydir":
+		control.emptyDir, control.emptyDirContent = "", nil
 	case "flags":
 		fallthrough
 	case "flag":
 		tweakFlagOptions(parse.args[1:], false)
 	default:
-		croak(`"clear" needs a "flag" or "flags" or "readlimit" subcommand.`)
+		croak(`"clear" needs a "flag" or "flags" or "codec" or "readlimit" or "workers" or "queue" or "spill" or "manifests" or "progressfd" or "placeholder" or "emptydir" subcommand.`)
 	}
 	return false
 }
@@ -6623,7 +10243,12 @@ func (rs *Reposurgeon) DoDo(ctx context.Context, line string) bool {
 			}
 			// Call the base method so RecoverableExceptions
 			// won't be caught; we want them to abort macros.
-			rs.cmd.OneCmd(ctx, expansion)
+			// PostCmd still has to run, even then, to release
+			// what PreCmd took.
+			func() {
+				defer rs.cmd.PostCmd(ctx, false, expansion)
+				rs.cmd.OneCmd(ctx, expansion)
+			}()
 		}
 	} else if scriptfp, err := os.Open(filepath.Clean(name)); err == nil {
 		rs.callstack = append(rs.callstack, parse.args)
@@ -6656,12 +10281,20 @@ func (rs *Reposurgeon) DoDo(ctx context.Context, line string) bool {
 
 			// Simulate shell here-document processing
 			if len(scriptline) > 0 && scriptline[0] != '#' && strings.Contains(scriptline, "<<") {
-				heredoc, err := ioutil.TempFile("", "reposurgeon-")
+				// The file gets a fixed name, as a repository read
+				// from it is named after it and that name goes into
+				// its stable event identifiers.
+				heredir, err := ioutil.TempDir("", "reposurgeon-")
+				if err != nil {
+					croak("script failure on '%s': %s", name, err)
+					return false
+				}
+				defer os.RemoveAll(heredir)
+				heredoc, err := os.Create(filepath.Join(heredir, "heredoc"))
 				if err != nil {
 					croak("script failure on '%s': %s", name, err)
 					return false
 				}
-				defer os.Remove(heredoc.Name())
 
 				stuff := strings.Split(scriptline, "<<")
 				scriptline = stuff[0]
@@ -6865,10 +10498,58 @@ func (rs *Reposurgeon) DoTimequake(line string) bool {
 // Changelog processing
 //
 
+// HelpDisambiguate says "Shut up, golint!"
+func (rs *Reposurgeon) HelpDisambiguate() {
+	rs.helpOutput(`
+[SELECTION] disambiguate [--suffix] [>OUTFILE]
+
+Make the action stamps of the commits in the selection set (defaulting
+to all commits) usable as unique IDs.  Unlike 'timequake', this finds
+every collision in the repository, not just those between parent
+and child.
+
+By default, each commit sharing its action stamp with an earlier
+commit is bumped forward a second at a time until its stamp is
+unique.  (Action stamps have one-second resolution, so a smaller bump
+would not separate them.)  A committer date equal to the author date
+moves with it.  If a legacy journal is attached, entries for the
+commits moved are rewritten with their new stamps.  Each commit
+moved is reported with its old and new stamps.
+
+With --suffix, no dates are changed.  Instead each commit after the
+first sharing a stamp is reported with the reference that names it
+uniquely, the stamp with an ordinal suffix: <STAMP#2>, <STAMP#3>
+and so on, in event order.  These references are always available.
+
+Clears Q bits, then sets the Q bit on each colliding commit in the
+selection.
+`)
+}
+
+// DoDisambiguate is the handler for the "disambiguate" command.
+func (rs *Reposurgeon) DoDisambiguate(line string) bool {
+	parse := rs.newLineParse(line, "disambiguate", parseALLREPO|parseNOARGS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	repo := rs.chosen()
+	if parse.options.Contains("--suffix") {
+		collisions := repo.stampCollisions(rs.selection)
+		repo.clearColor(colorQSET)
+		for _, collision := range collisions {
+			collision.commit.addColor(colorQSET)
+			fmt.Fprintf(parse.stdout, "%s <%s>\n", collision.commit.mark, collision.suffixedStamp())
+		}
+		return false
+	}
+	for _, collision := range repo.bumpCollisions(rs.selection) {
+		fmt.Fprintf(parse.stdout, "%s <%s> -> <%s>\n", collision.commit.mark, collision.stamp, collision.commit.actionStamp())
+	}
+	return false
+}
+
 // HelpChangelogs says "Shut up, golint!"
 func (rs *Reposurgeon) HelpChangelogs() {
 	rs.helpOutput(`
-[SELECTION] changelogs [BASENAME-PATTERN]
+[SELECTION] changelogs [--dry-run] [--header=PATTERN] [BASENAME-PATTERN] [>OUTFILE]
 
 Mine ChangeLog files for authorship data.
 
@@ -6880,7 +10561,10 @@ for more information about regular expressions.
 
 This command assumes that changelogs are in the format used by FSF
 projects: entry header lines begin with YYYY-MM-DD and are followed by
-a fullname/address.
+a fullname/address.  Other conventions can be read by giving a
+--header pattern matching entry header lines; the attribution is its
+first parenthesized group, or the whole match if it has none, and must
+contain an address.
 
 When a ChangeLog file modification is found in a clique, the entry
 header at or before the section changed since its last revision is
@@ -6898,21 +10582,58 @@ attribution header is discarded and the committer date is used.
 However, if the name is an author-map alias with an associated timezone,
 that zone is used.
 
+With --dry-run, nothing is changed; instead a report is written of
+what would be.  Each commit a ChangeLog says something about gets a
+line with its event number, its mark, a confidence, and the author it
+would get, followed by any co-authors.  The confidence is "high" when
+the commit added the entry header, "medium" when it only added lines
+under an existing one, and "ambiguous" when entries by more than one
+author were changed, in which case the commit is left alone.  An
+author marked "(invalid)" has no usable address and is also skipped.
+This is useful for tuning --header and the basename pattern before
+committing to them.
+
 Sets Q bits: true if the event is a commit with authorship modified
-by this command, false otherwise.
+by this command, false otherwise.  A dry run leaves Q bits alone.
 `)
 }
 
 // DoChangelogs mines repository changelogs for authorship data.
 func (rs *Reposurgeon) DoChangelogs(line string) bool {
-	parse := rs.newLineParse(line, "changelogs", parseALLREPO|parseNOOPTS, nil)
+	parse := rs.newLineParse(line, "changelogs", parseALLREPO, orderedStringSet{"stdout"})
+	defer parse.Closem()
 	pattern := ""
 	if len(parse.args) > 0 {
 		pattern = parse.args[0]
 	}
-	ok, cm, cc, cd, cl := rs.chosen().processChangelogs(rs.selection, pattern, control.baton)
-	if ok {
+	parser := changelogParser(parseChangelogHeader)
+	if header, ok := parse.OptVal("--header"); ok {
+		parser = regexpChangelogParser(parse.getPattern(header, "text"))
+	}
+	dryrun := parse.options.Contains("--dry-run")
+	repo := rs.chosen()
+	inferences, cm, cd, cc, cl, err := repo.processChangelogs(rs.selection, pattern, parser, dryrun, control.baton)
+	if err != nil {
+		croak("%v", err)
+		return false
+	}
+	if !dryrun {
 		respond("fills %d of %d authorships, changing %d, from %d ChangeLogs.", cm, cc, cd, cl)
+		return false
+	}
+	for _, inference := range inferences {
+		author := inference.header
+		if inference.author != nil {
+			author = inference.author.who()
+		} else if author != "" {
+			author += " (invalid)"
+		}
+		report := fmt.Sprintf("%6d %6s %-9s %s",
+			repo.eventToIndex(inference.commit)+1, inference.commit.mark, inference.confidence, author)
+		fmt.Fprintln(parse.stdout, strings.TrimRight(report, " "))
+		for _, coAuthor := range inference.coAuthors {
+			fmt.Fprintf(parse.stdout, "%23s Co-Authored-By: %s\n", "", coAuthor)
+		}
 	}
 	return false
 }
@@ -7134,6 +10855,262 @@ func (rs *Reposurgeon) DoClone(line string) bool {
 	return false
 }
 
+// HelpSession says "Shut up, golint!"
+func (rs *Reposurgeon) HelpSession() {
+	rs.helpOutput(`
+session {save FILE | restore FILE [NAME]}
+
+Save the state of the selected repository to a session file, or make
+a repository from one, so a long editing session can be resumed after
+a crash or a mistake.
+
+"save" records the events with their marks, parents, fileops and
+metadata, the legacy map, named selections, and the stream file blobs
+still refer into.  Blob content is not copied: blobs that have their
+own files get hard links to them in a directory named FILE.blobs.
+Saving to the same FILE again replaces the earlier session.
+
+"restore" makes a repository from a session file and selects it.  The
+repository gets the name it had when saved unless NAME is given.  The
+stream file it was read from must be unchanged, and blob compression
+must be set as it was when the session was saved.
+
+A legacy journal is not reattached by a restore, and neither are the
+snapshots taken with the "snapshot" command.
+`)
+}
+
+// CompleteSession is a completion hook over session subcommands
+func (rs *Reposurgeon) CompleteSession(text string) []string {
+	return []string{"save", "restore"}
+}
+
+// DoSession saves and restores repository state.
+func (rs *Reposurgeon) DoSession(line string) bool {
+	parse := rs.newLineParse(line, "session", parseNOSELECT|parseNEEDARG|parseNOOPTS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	verb, args := parse.args[0], parse.args[1:]
+	switch verb {
+	case "save":
+		if rs.chosen() == nil {
+			croak("no repo has been chosen.")
+			return false
+		}
+		if len(args) != 1 {
+			croak("session save requires a filename")
+			return false
+		}
+		linked, err := rs.chosen().saveSession(args[0], control.baton)
+		if err != nil {
+			croak("session save: %v", err)
+			return false
+		}
+		respond("%d events saved, %d blob files linked", len(rs.chosen().events), linked)
+	case "restore":
+		if len(args) < 1 || len(args) > 2 {
+			croak("session restore requires a filename and optionally a name")
+			return false
+		}
+		name := ""
+		if len(args) == 2 {
+			name = args[1]
+		}
+		repo, err := restoreSession(args[0], name, rs.reponames(), control.baton)
+		if err != nil {
+			croak("session restore: %v", err)
+			return false
+		}
+		rs.repolist = append(rs.repolist, repo)
+		rs.choose(repo)
+		respond("%s: %d events restored", repo.name, len(repo.events))
+	default:
+		croak("session requires a save or restore subcommand")
+	}
+	return false
+}
+
+// HelpUndo says "Shut up, golint!"
+func (rs *Reposurgeon) HelpUndo() {
+	rs.helpOutput(`
+undo [list]
+
+Undo the last squash, delete, reorder, or renumber on the selected
+repository, putting it back as it was before.  Up to five operations
+can be undone in turn.
+
+Before each of those operations the state of the repository is saved
+in its scratch directory in the format of the "session" command, so
+blob content is shared rather than copied.  The legacy journal stays
+attached, but snapshots taken with the "snapshot" command are lost by
+an undo or redo, as are selection indices.
+
+Any other command that may alter the repository, such as "setfield"
+or "filter", empties the journal, because restoring a state saved
+before it would silently revert that command too.  Commands that only
+look at the repository, such as "list" or "write", leave it alone.
+
+With "list", show the operations that can be undone and redone, most
+recent first.
+`)
+}
+
+// CompleteUndo is a completion hook over undo modes
+func (rs *Reposurgeon) CompleteUndo(text string) []string {
+	return []string{"list"}
+}
+
+// DoUndo reverts the last journaled operation.
+func (rs *Reposurgeon) DoUndo(line string) bool {
+	parse := rs.newLineParse(line, "undo", parseREPO|parseNOSELECT|parseNOOPTS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	repo := rs.chosen()
+	if len(parse.args) > 0 {
+		if parse.args[0] != "list" {
+			croak("unknown undo mode %q", parse.args[0])
+			return false
+		}
+		if j := repo.undo; j != nil {
+			for i := len(j.redo) - 1; i >= 0; i-- {
+				fmt.Fprintf(parse.stdout, "redo  %s\n", j.redo[i].label)
+			}
+			for i := len(j.undo) - 1; i >= 0; i-- {
+				fmt.Fprintf(parse.stdout, "undo  %s\n", j.undo[i].label)
+			}
+		}
+		return false
+	}
+	restored, label, err := repo.stepJournal(true, control.baton)
+	if err != nil {
+		croak("undo: %v", err)
+		return false
+	}
+	rs.replace(repo, restored)
+	respond("undid %s", label)
+	return false
+}
+
+// HelpRedo says "Shut up, golint!"
+func (rs *Reposurgeon) HelpRedo() {
+	rs.helpOutput(`
+redo
+
+Redo an operation just undone with "undo".  Any new squash, delete,
+reorder, or renumber forgets what could have been redone.
+`)
+}
+
+// DoRedo reapplies the last undone operation.
+func (rs *Reposurgeon) DoRedo(line string) bool {
+	rs.newLineParse(line, "redo", parseREPO|parseNOSELECT|parseNOARGS|parseNOOPTS, nil)
+	repo := rs.chosen()
+	restored, label, err := repo.stepJournal(false, control.baton)
+	if err != nil {
+		croak("redo: %v", err)
+		return false
+	}
+	rs.replace(repo, restored)
+	respond("redid %s", label)
+	return false
+}
+
+// HelpSnapshot says "Shut up, golint!"
+func (rs *Reposurgeon) HelpSnapshot() {
+	rs.helpOutput(`
+snapshot {take NAME | list | drop NAME | diff NAME [NAME]}
+
+Manage named snapshots of the selected repository's structure, so the
+cumulative effect of a block of surgical operations can be reviewed
+before committing to a rebuild. A snapshot records the identity and
+metadata of every event - marks, branches, parents, attributions,
+comments, fileops, tag and reset targets, passthrough text - but not
+blob content, so it is cheap to take.
+
+With "take", record a snapshot under NAME, replacing any existing
+snapshot of that name. With "list", show the snapshots of the
+repository in the order taken, with the event count of each. With
+"drop", discard the named snapshot.
+
+With "diff", compare two snapshots, or with one name, compare that
+snapshot to the current state. Events are matched by identity, not
+by event number or mark, so renumbering and reordering don't confuse
+the comparison. Each event added is reported with "+", each deleted
+with "-", and each modified with "~" followed by its changed fields;
+multi-line fields such as comments and fileops are shown as lines
+removed and added. A summary line ends the report, counting events
+whose relative position changed as moved. Supports > redirection.
+
+Checkpoints live in memory with the repository and are discarded
+with it; they are not copied by "clone".
+
+----
+snapshot take before-expunge
+expunge /^doc/
+snapshot diff before-expunge
+----
+`)
+}
+
+// CompleteSnapshot is a completion hook across snapshot subcommands and names
+func (rs *Reposurgeon) CompleteSnapshot(text string) []string {
+	out := []string{"diff", "drop", "list", "take"}
+	if rs.chosen() != nil {
+		out = append(out, rs.chosen().snapshotNames()...)
+	}
+	return out
+}
+
+// DoSnapshot is the handler for the "snapshot" command.
+func (rs *Reposurgeon) DoSnapshot(line string) bool {
+	parse := rs.newLineParse(line, "snapshot", parseREPO|parseNOSELECT|parseNEEDARG|parseNOOPTS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	repo := rs.chosen()
+	verb, args := parse.args[0], parse.args[1:]
+	switch verb {
+	case "take":
+		if len(args) != 1 {
+			croak("snapshot take requires a name")
+			return false
+		}
+		repo.takeSnapshot(args[0])
+	case "list":
+		for _, cp := range repo.snapshots {
+			fmt.Fprintf(parse.stdout, "%-20s %8d events  %s\n",
+				cp.name, len(cp.digests), cp.taken.Format(time.RFC3339))
+		}
+	case "drop":
+		if len(args) != 1 {
+			croak("snapshot drop requires a name")
+			return false
+		}
+		if !repo.dropSnapshot(args[0]) {
+			croak("no snapshot named %s", args[0])
+		}
+	case "diff":
+		if len(args) < 1 || len(args) > 2 {
+			croak("snapshot diff requires one or two names")
+			return false
+		}
+		before := repo.findSnapshot(args[0])
+		if before == nil {
+			croak("no snapshot named %s", args[0])
+			return false
+		}
+		var after *repoSnapshot
+		if len(args) == 2 {
+			if after = repo.findSnapshot(args[1]); after == nil {
+				croak("no snapshot named %s", args[1])
+				return false
+			}
+		} else {
+			after = repo.captureSnapshot("current")
+		}
+		diffSnapshots(parse.stdout, before, after)
+	default:
+		croak("snapshot requires a take, list, drop, or diff subcommand")
+	}
+	return false
+}
+
 // HelpIncorporate says "Shut up, golint!"
 func (rs *Reposurgeon) HelpIncorporate() {
 	rs.helpOutput(`
@@ -7344,6 +11321,7 @@ First, these ways of constructing singleton sets:
 :345       event with mark 345
 <456>      commit with legacy-ID 456 (probably a Subversion revision)
 <foo>      the tag named 'foo', or failing that the tip commit of branch foo
+<UUID>     event with this stable identifier, as msgout and jsonout show it
 ----
 
 You can select commits and tags by date, or by date and committer:
@@ -7372,6 +11350,12 @@ More ways to construct event sets:
            any one; c=match against checkout paths, DMRCN=match only against
            given fileop types (no-op when used with 'c').
 [~/bar/]   all commits and blobs touching any file not matching bar
+{ops>500}  all commits with more than 500 fileops.  Metrics are ops
+           (number of fileops), bytes (total size of blobs modified),
+           and parents; comparisons are <, <=, =, !=, >=, and >.
+{author =~ "esr" && ops > 10}
+           all events for which an event expression is true; see
+           "help expressions".
 =B         all blobs
 =C         all commits
 =D         all commits in which every fileop is a D or deleteall
@@ -7530,6 +11514,7 @@ functions are defined:
 | @chn() | all children of commits in the argument set
 | @dsc() | all commits descended from the argument set (argument set included)
 | @anc() | all commits ancestral to the argument set (argument set included)
+| @eqv() | all commits equivalent to a commit in the argument set (same attributions, comment, parent stamps and tree)
 | @pre() | events before the argument set
 | @suc() | events after the argument set
 | @srt() | sort the argument set by event number.
@@ -7559,6 +11544,57 @@ Do set negation with prefix "~"; it has higher precedence than
 `)
 }
 
+// HelpExpressions says "Shut up, golint!"
+func (rs *Reposurgeon) HelpExpressions() {
+	rs.helpOutputMisc(`
+Event expressions are a small language for computing values from the
+fields of events.  Written in braces, an expression is a selection
+atom matching the events for which it is true; the "map" command sets
+a field of each selected event to the value of one, and "eval" shows
+their values.  They are evaluated in parallel.
+
+----
+{type == "commit" && author =~ "(?i)raymond"}
+{ops > 100 || parents >= 2}
+{type == "tag" && !(tagname =~ "^v[0-9]")}
+----
+
+Values are strings, integers, and the booleans true and false.
+Strings are double-quoted with Go escapes.  Operators, loosest
+binding first:
+
+----
+||                  or
+&&                  and
+!                   not
+== != < <= > >=     comparison; = is a synonym for ==
+=~ !~               match, or fail to match, a regexp given as a string
++                   addition of integers, concatenation of anything else
+----
+
+Two integers compare numerically, anything else by string form.  A
+string is true if not empty and an integer if not zero.  Parentheses
+group.
+
+Fields are type (commit, tag, reset, blob, passthrough or callout),
+mark, branch (of a commit or reset), tagname, target (the committish of
+a tag or reset), comment, summary (the first line of the comment),
+legacy, author, authoremail, authordate, authortime, committer,
+committeremail, date, time, parents, children, ops, bytes, size (of a
+blob), and mimetype (of a blob, sniffed from its content as by "blobs
+census").  The author fields of a commit come from its first
+author; those and the committer fields of a tag come from its tagger.
+The date fields are RFC3339 and the time fields are seconds since the
+Unix epoch.  A field an event doesn't have is the empty string, or 0
+for a number.
+
+Functions are lower(), upper(), trim(), len() of a string, and
+sub(VALUE, "REGEXP", REPLACEMENT), which replaces every match of the
+regular expression with the replacement, expanding $1-style group
+references.
+`)
+}
+
 // HelpRegexp says "Shut up, golint!"
 func (rs *Reposurgeon) HelpRegexp() {
 	rs.helpOutputMisc(`
@@ -7692,6 +11728,67 @@ breakout:
 	return false
 }
 
+// HelpWarnings says "Shut up, golint!"
+func (rs *Reposurgeon) HelpWarnings() {
+	rs.helpOutput(`
+warnings [summary | clear | suppress CATEGORY... | unsuppress CATEGORY...]
+
+Warnings are tallied by category as they are issued. Exact repeats of
+a warning are shown only the first time, and suppressed categories are
+not shown at all, but both are still counted. If any warnings were
+held back, a summary table is printed when reposurgeon exits (unless
+the "quiet" flag is set).
+
+With no argument or "summary", print the table of warning counts by
+category, with the number held back in each. "clear" resets the
+counts and forgets which warnings have been seen, so repeats will be
+shown again. "suppress" stops the named categories from being shown;
+"unsuppress" undoes that.
+
+Categories include ancestry, branch-name, comment, delete, diskspace,
+filter, layout, legacy, link-detection, mergeinfo, parse, rename,
+reorder, reset, stream, and transcode.  Error messages are counted
+under "error" and other unconditional messages under "notice"; these
+are never held back as repeats.
+`)
+}
+
+// CompleteWarnings is a completion hook over warnings subcommands
+func (rs *Reposurgeon) CompleteWarnings(text string) []string {
+	return []string{"clear", "summary", "suppress", "unsuppress"}
+}
+
+// DoWarnings reports on and controls the warnings registry.
+func (rs *Reposurgeon) DoWarnings(line string) bool {
+	parse := rs.newLineParse(line, "warnings", parseNOSELECT|parseNOOPTS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	verb := "summary"
+	if len(parse.args) > 0 {
+		verb = parse.args[0]
+	}
+	switch verb {
+	case "summary":
+		if len(parse.args) > 1 {
+			croak("warnings summary takes no arguments")
+			break
+		}
+		control.warnings.report(parse.stdout)
+	case "clear":
+		control.warnings.clear()
+	case "suppress", "unsuppress":
+		if len(parse.args) < 2 {
+			croak("warnings %s requires one or more categories", verb)
+			break
+		}
+		for _, category := range parse.args[1:] {
+			control.warnings.suppress(category, verb == "suppress")
+		}
+	default:
+		croak("unknown warnings subcommand %q", verb)
+	}
+	return false
+}
+
 // HelpPrint says "Shut up, golint!"
 func (rs *Reposurgeon) HelpPrint() {
 	rs.helpOutput(`
@@ -7727,6 +11824,11 @@ With the option --bare, omit the event number; list only the hash.
 With the option --tree, generate a tree hash for the specified commit rather
 than the commit hash. This option is not expected to be useful for anything
 but verifying the hash code itself.
+
+When more than one commit is selected, all hashes in the repository
+not already known are computed first in bulk, on parallel threads
+unless the "serial" flag is set. This is much faster than computing
+them one at a time on large repositories.
 `)
 }
 
@@ -7735,6 +11837,9 @@ func (rs *Reposurgeon) DoHash(line string) bool {
 	parse := rs.newLineParse(line, "hash", parseALLREPO, orderedStringSet{"stdout"})
 	defer parse.Closem()
 	repo := rs.chosen()
+	if !parse.options.Contains("--tree") && len(repo.commits(rs.selection)) > 1 {
+		repo.hashAll(control.baton)
+	}
 	for it := rs.selection.Iterator(); it.Next(); {
 		eventid := it.Value()
 		event := repo.events[eventid]
@@ -7764,6 +11869,69 @@ func (rs *Reposurgeon) DoHash(line string) bool {
 	return false
 }
 
+// HelpDrift says "Shut up, golint!"
+func (rs *Reposurgeon) HelpDrift() {
+	rs.helpOutput(`
+[SELECTION] drift [>OUTFILE]
+
+Check recomputed Git hashes against the object IDs recorded by
+original-oid lines when the repository was read, as in a stream made
+by "git fast-export --show-original-ids".  Takes a selection set,
+defaulting to all; only blobs and commits with a recorded ID are
+checked.  All hashes are recomputed, not taken from the stream.
+
+For each event whose hash no longer matches, one line of JSON is
+written giving its event number, mark, kind, recorded and computed
+hashes, and a list of causes.  A blob can only drift because its
+content changed.  A commit may drift because of its parents (a parent
+was added, removed or reordered, or has itself drifted), its metadata
+(attributions or comment), or its content.  A commit's record also has
+a "tree" field saying whether its tree is "same" or "changed"; this
+can only be determined when parents and metadata are as they were
+read, and is "unknown" otherwise.
+
+In interactive mode a count of checked and drifted events follows.
+`)
+}
+
+// DoDrift is the handler for the "drift" command.
+func (rs *Reposurgeon) DoDrift(line string) bool {
+	parse := rs.newLineParse(line, "drift", parseALLREPO|parseNOOPTS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	checked, drifted := rs.chosen().driftReport(rs.selection, parse.stdout, control.baton)
+	respond("%d of %d events have drifted from their recorded hashes.", drifted, checked)
+	return false
+}
+
+// HelpVerify says "Shut up, golint!"
+func (rs *Reposurgeon) HelpVerify() {
+	rs.helpOutput(`
+[SELECTION] verify [>OUTFILE]
+
+Check the stored content of blobs for damage, such as a content file
+left truncated by an interrupted session.  Takes a selection set,
+defaulting to all; events other than blobs are ignored.  Each blob's
+content is read back from its file, or from the input stream if it
+was never copied out, and its size checked against the size recorded
+when it was stored.  If the blob was read with an original-oid, its
+hash is checked against that too.  Blobs are checked in parallel
+unless the "serial" flag is set.
+
+Each damaged blob is reported on a line giving its event number, mark,
+and what is wrong.  In interactive mode a count follows.  This is a
+cheap check worth making before a long export.
+`)
+}
+
+// DoVerify is the handler for the "verify" command.
+func (rs *Reposurgeon) DoVerify(line string) bool {
+	parse := rs.newLineParse(line, "verify", parseALLREPO|parseNOOPTS|parseNOARGS, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	checked, damaged := rs.chosen().verifyBlobs(rs.selection, parse.stdout, control.baton)
+	respond("%d of %d blobs damaged.", damaged, checked)
+	return false
+}
+
 func main() {
 	ctx := context.Background()
 	// need to have at least one task for the trace viewer to show any logs/regions
@@ -7777,6 +11945,9 @@ func main() {
 
 	defer func() {
 		maybePanic := recover()
+		if rs.server != nil {
+			rs.server.stop()
+		}
 		saveAllProfiles()
 		files, err := ioutil.ReadDir(".")
 		if err == nil {
@@ -7842,6 +12013,12 @@ func main() {
 breakout:
 	interpreter.PostLoop(ctx)
 	r.End()
+	// If warnings were held back, the summary is the only record of them
+	if _, hidden := control.warnings.totals(); hidden > 0 && !control.flagOptions["quiet"] {
+		var summary strings.Builder
+		control.warnings.report(&summary)
+		control.baton.printLogString("reposurgeon: warning summary:" + control.lineSep + summary.String())
+	}
 	// Fall through to defer hook.
 }
 
@@ -1,20 +1,30 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
+	"unsafe"
 
 	shlex "github.com/anmitsu/go-shlex"
+	"gitlab.com/ianbruene/kommandant"
 )
 
 func TestMain(m *testing.M) {
@@ -172,6 +182,7 @@ func TestIgnoreTranslation(t *testing.T) {
 		{`foo\?bar`, `git`, `bzr`, `#foo\?bar`, false},
 		// Check for forced anchoring
 		{`foobar`, `cvs`, `hg`, `./foobar`, false},
+		{`foobar`, `cvs`, `git`, `/foobar`, false},
 	}
 	var reLatch bool
 	for testnum, item := range tests {
@@ -337,6 +348,13 @@ func TestOrderedStringSet(t *testing.T) {
 	if sum[0] != "a" || sum[1] != "b" || sum[2] != "c" || sum[4] != "e" || len(sum) != 5 {
 		t.Errorf("unexpected result of set union: %v", sum)
 	}
+	// The union mustn't share storage with its receiver.
+	roomy := append(make(orderedStringSet, 0, 4), "c", "a")
+	joined := roomy.Union(newOrderedStringSet("b"))
+	sort.Strings(joined)
+	if roomy[0] != "c" || roomy[1] != "a" {
+		t.Errorf("set union altered its receiver: %v", roomy)
+	}
 
 	ts10 := ts8.Clone()
 	if !ts10.Equal(ts8) {
@@ -926,6 +944,28 @@ func TestRemapAttribution(t *testing.T) {
 	}
 }
 
+func TestRewriteAttribution(t *testing.T) {
+	rules := newAuthorRules()
+	rules.domains["oldcorp.com"] = "newcorp.com"
+	rules.names = append(rules.names, nameRule{regexp.MustCompile(`^(\w+), (\w+)$`), "${2} ${1}"})
+
+	attr, _ := newAttribution("Hacker, Random <jrh@OldCorp.com> 1456976347 -0500")
+	assertTrue(t, attr.rewrite(&rules))
+	assertEqual(t, attr.email, "jrh@newcorp.com")
+	assertEqual(t, attr.fullname, "Random Hacker")
+	assertTrue(t, !attr.rewrite(&rules))
+
+	// Exact entries are looked up by local ID, address, or bare name
+	authormap := map[string]Contributor{
+		"jrh": {fullname: "J. Random Hacker", email: "jrh@foobar.com"},
+	}
+	_, ok := lookupContributor(authormap, attr)
+	assertTrue(t, ok)
+	other, _ := newAttribution("Fred <fred@foobar.com> 1456976347 -0500")
+	_, ok = lookupContributor(authormap, other)
+	assertTrue(t, !ok)
+}
+
 func TestBlobfile(t *testing.T) {
 	repo := newRepository("fubar")
 	defer repo.cleanup()
@@ -945,6 +985,70 @@ func TestBlobfile(t *testing.T) {
 	nuke("foo", "")
 }
 
+func TestBlobStore(t *testing.T) {
+	repo1 := newRepository("store1")
+	repo2 := newRepository("store2")
+	defer repo1.cleanup()
+	defer repo2.cleanup()
+	const sampleContent = "Abracadabra!"
+	blob1 := newBlob(repo1)
+	blob1.size = int64(len(sampleContent))
+	sharedBlobs.adopt(blob1, strings.NewReader(sampleContent))
+	blob2 := newBlob(repo2)
+	blob2.size = int64(len(sampleContent))
+	sharedBlobs.adopt(blob2, strings.NewReader(sampleContent))
+	assertEqual(t, string(blob1.getContent()), sampleContent)
+	assertEqual(t, string(blob2.getContent()), sampleContent)
+
+	// One copy of the content, used by both repositories
+	hash := gitHashString(fmt.Sprintf("blob %d\x00%s", len(sampleContent), sampleContent))
+	entry := sharedBlobs.path(hash)
+	assertIntEqual(t, sharedBlobs.refs[hash], 2)
+	info1, _ := os.Stat(blob1.getBlobfile(false))
+	info2, _ := os.Stat(blob2.getBlobfile(false))
+	assertTrue(t, os.SameFile(info1, info2))
+
+	repo1.cleanup()
+	assertIntEqual(t, sharedBlobs.refs[hash], 1)
+	assertTrue(t, exists(entry))
+	repo2.cleanup()
+	assertTrue(t, !exists(entry))
+}
+
+func TestBlobCodecs(t *testing.T) {
+	saveCompress, saveCodec := control.flagOptions["compress"], control.codec
+	defer func() {
+		control.flagOptions["compress"], control.codec = saveCompress, saveCodec
+	}()
+	control.flagOptions["compress"] = true
+	filename := fmt.Sprintf("%s/rs-codec-%d", os.TempDir(), os.Getpid())
+	defer os.Remove(filename)
+	content := strings.Repeat("All work and no play makes Jack a dull boy.\n", 100)
+	for _, name := range codecNames() {
+		if checkCodec(name) != nil {
+			t.Logf("skipping codec %s", name)
+			continue
+		}
+		control.codec = name
+		file, err := os.Create(filename)
+		assertTrue(t, err == nil)
+		w, err := newBlobWriter(file)
+		assertTrue(t, err == nil)
+		io.WriteString(w, content)
+		assertTrue(t, w.Close() == nil)
+		assertTrue(t, getsize(filename) < int64(len(content)))
+		file, err = os.Open(filename)
+		assertTrue(t, err == nil)
+		r, err := newBlobReader(file)
+		assertTrue(t, err == nil)
+		var out bytes.Buffer
+		io.Copy(&out, r)
+		assertTrue(t, r.Close() == nil)
+		assertEqual(t, out.String(), content)
+	}
+	assertTrue(t, checkCodec("bogus") != nil)
+}
+
 func TestBlobColor(t *testing.T) {
 	repo := newRepository("fubar")
 	defer repo.cleanup()
@@ -1772,7 +1876,7 @@ func TestFastImportParse2(t *testing.T) {
 
 	// Check roundtripping via fastExport
 	var a strings.Builder
-	//if err := repo.fastExport(repo.all(), &a, nullStringSet, nil, control.baton); err != nil {
+	//if err := repo.fastExport(context.Background(), repo.all(), &a, nullStringSet, nil, control.baton); err != nil {
 	//	t.Fatalf("unexpected error: %v", err)
 	//}
 	//assertEqual(t, rawdump, a.String())
@@ -1803,7 +1907,7 @@ data 0
 	a.Reset()
 	singleton := newSelectionSet(4)
 	// Check partial export - Event 4 is the second commit
-	if err := repo.fastExport(singleton, &a, nullStringSet, nil, control.baton); err != nil {
+	if err := repo.fastExport(context.Background(), singleton, &a, nullStringSet, nil, control.baton); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	assertEqual(t, onecommit, a.String())
@@ -1878,7 +1982,7 @@ func TestDelete(t *testing.T) {
 	thirdcommit := repo.markToIndex(":6")
 	repo.delete(newSelectionSet(thirdcommit), nil, control.baton)
 	var a strings.Builder
-	if err := repo.fastExport(repo.all(), &a, nullStringSet, nil, control.baton); err != nil {
+	if err := repo.fastExport(context.Background(), repo.all(), &a, nullStringSet, nil, control.baton); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
@@ -1927,6 +2031,65 @@ data 0
 	assertEqual(t, a.String(), dtrimmed)
 }
 
+func TestTransformBlobs(t *testing.T) {
+	repo := newRepository("test")
+	defer repo.cleanup()
+	sp := newStreamParser(repo)
+	r := strings.NewReader(rawdump)
+	sp.fastImport(context.TODO(), r, nullStringSet, "synthetic test load", control.baton)
+
+	blob1 := repo.markToEvent(":1").(*Blob)
+	blob3 := repo.markToEvent(":3").(*Blob)
+	oldhash := blob3.gitHash()
+	upcase := func(content []byte) []byte {
+		if bytes.Contains(content, []byte("modified")) {
+			return bytes.ToUpper(content)
+		}
+		return content
+	}
+	sel := newSelectionSet(repo.markToIndex(":1"), repo.markToIndex(":3"))
+	assertIntEqual(t, repo.transformBlobs(sel, upcase, control.baton), 1)
+	assertEqual(t, string(blob1.getContent()), "This is a sample file.\n")
+	expected := "THIS IS A SAMPLE FILE.\n\nTHIS IS OUR FIRST LINE OF MODIFIED CONTENT.\n"
+	assertEqual(t, string(blob3.getContent()), expected)
+	assertIntEqual(t, int(blob3.size), len(expected))
+	assertTrue(t, blob3.gitHash() != oldhash)
+	assertTrue(t, blob3.colors.Contains(colorQSET))
+	assertTrue(t, !blob1.colors.Contains(colorQSET))
+
+	sel = newSelectionSet(repo.markToIndex(":1"))
+	assertIntEqual(t, repo.transformBlobs(sel, blobCommandHook("tr a-z A-Z"), control.baton), 1)
+	assertEqual(t, string(blob1.getContent()), "THIS IS A SAMPLE FILE.\n")
+	assertIntEqual(t, repo.transformBlobs(sel, blobCommandHook("exit 1"), control.baton), 0)
+	assertEqual(t, string(blob1.getContent()), "THIS IS A SAMPLE FILE.\n")
+}
+
+func TestCommitEquivalent(t *testing.T) {
+	load := func() *Repository {
+		repo := newRepository("test")
+		sp := newStreamParser(repo)
+		r := strings.NewReader(rawdump)
+		sp.fastImport(context.TODO(), r, nullStringSet, "synthetic test load", control.baton)
+		return repo
+	}
+	repo1 := load()
+	defer repo1.cleanup()
+	repo2 := load()
+	defer repo2.cleanup()
+
+	c4 := repo1.markToEvent(":4").(*Commit)
+	c6 := repo1.markToEvent(":6").(*Commit)
+	other := repo2.markToEvent(":4").(*Commit)
+	assertTrue(t, c4.equivalent(c4))
+	assertTrue(t, c4.equivalent(other))
+	assertTrue(t, !c4.equivalent(c6))
+	other.Comment = "Something else.\n"
+	assertTrue(t, !c4.equivalent(other))
+	other.Comment = c4.Comment
+	other.setParents(nil)
+	assertTrue(t, !c4.equivalent(other))
+}
+
 func TestResort(t *testing.T) {
 	repo := newRepository("test")
 	defer repo.cleanup()
@@ -1944,7 +2107,7 @@ func TestResort(t *testing.T) {
 	//repo.resort()
 
 	var a strings.Builder
-	if err := repo.fastExport(repo.all(), &a, nullStringSet, nil, control.baton); err != nil {
+	if err := repo.fastExport(context.Background(), repo.all(), &a, nullStringSet, nil, control.baton); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	//assertEqual(t, "", a.String())
@@ -2034,10 +2197,10 @@ this is a test tag
 	sp.fastImport(context.TODO(), r, nullStringSet, "synthetic test load", control.baton)
 
 	//verbose = debugUNITE
-	repo.renumber(1, nil)
+	repo.renumber(context.Background(), 1, nil)
 
 	var a strings.Builder
-	if err := repo.fastExport(repo.all(), &a, nullStringSet, nil, control.baton); err != nil {
+	if err := repo.fastExport(context.Background(), repo.all(), &a, nullStringSet, nil, control.baton); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
@@ -2183,6 +2346,46 @@ func TestBranchSplit(t *testing.T) {
 	}
 }
 
+func TestBranchRules(t *testing.T) {
+	rules, err := parseBranchRules(strings.NewReader(`# a layout per project
+*/trunk refs/heads/$1
+/([^/]+)/branches/([^/]+)/ $1-$2
+*/tags/* refs/tags/$1-$2
+releases
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := new(svnReader)
+	sp.initialize()
+	sp.branchRules = rules
+	type splitTestEntry struct {
+		raw    string
+		branch string
+		path   string
+	}
+	var splitTestTable = []splitTestEntry{
+		{"proj/trunk/README", "proj/trunk", "README"},
+		{"proj/branches/fix/src/a.c", "proj/branches/fix", "src/a.c"},
+		{"proj/tags/1.0/README", "proj/tags/1.0", "README"},
+		{"releases/README", "releases", "README"},
+		{"trunk/README", "", "trunk/README"},
+		{"proj/README", "", "proj/README"},
+	}
+	for _, tst := range splitTestTable {
+		b, p := sp.splitSVNBranchPath(tst.raw)
+		assertEqual(t, b, tst.branch)
+		assertEqual(t, p, tst.path)
+	}
+	assertEqual(t, sp.branchRef("proj/trunk"), "refs/heads/proj")
+	assertEqual(t, sp.branchRef("proj/branches/fix"), "refs/heads/proj-fix")
+	assertEqual(t, sp.branchRef("proj/tags/1.0"), "refs/tags/proj-1.0")
+	assertEqual(t, sp.branchRef("releases"), "")
+	if _, err := parseBranchRules(strings.NewReader("a b c\n")); err == nil {
+		t.Error("a rule with too many fields was accepted")
+	}
+}
+
 func TestContainingDir(t *testing.T) {
 	type testcase struct {
 		path string
@@ -2481,9 +2684,1327 @@ TAG o123-o123
 	}
 }
 
+func TestReachIndex(t *testing.T) {
+	// 1-2-3-4-7-8, with a side branch 2-5-6 merged at 7
+	// and a second root 9 merged at 8.
+	repo := newRepository("test")
+	defer repo.cleanup()
+	parents := map[int][]int{2: {1}, 3: {2}, 4: {3}, 5: {2}, 6: {5}, 7: {4, 6}, 8: {7, 9}}
+	commits := make(map[int]*Commit)
+	for _, i := range []int{1, 2, 3, 4, 5, 6, 9, 7, 8} {
+		commit := newCommit(repo)
+		commit.setMark(fmt.Sprintf(":%d", i))
+		repo.addEvent(commit)
+		commits[i] = commit
+		plist := make([]CommitLike, 0)
+		for _, p := range parents[i] {
+			plist = append(plist, commits[p])
+		}
+		commit.setParents(plist)
+	}
+	down := repo.reachability(reachDescendants)
+	up := repo.reachability(reachAncestors)
+	for i, from := range commits {
+		for j, to := range commits {
+			want := i == j || to.descendedFrom(from)
+			assertBool(t, down.reaches(from, to), want)
+			assertBool(t, up.reaches(to, from), want)
+		}
+	}
+	marks := func(sel selectionSet) string {
+		out := make([]string, 0)
+		for _, c := range repo.commits(sel) {
+			out = append(out, c.mark)
+		}
+		return strings.Join(out, " ")
+	}
+	five := newSelectionSet(repo.eventToIndex(commits[5]))
+	assertEqual(t, marks(repo.reachable(five, reachDescendants)), ":5 :6 :7 :8")
+	assertEqual(t, marks(repo.reachable(five, reachAncestors)), ":5 :2 :1")
+	// Relinking must invalidate the index
+	commits[6].setParents([]CommitLike{commits[3]})
+	assertEqual(t, marks(repo.reachable(five, reachDescendants)), ":5")
+}
+
+func TestHashAll(t *testing.T) {
+	rawdump := `blob
+mark :1
+data 4
+one
+
+commit refs/heads/master
+mark :2
+committer A <a@example.com> 1500000000 +0000
+data 4
+one
+M 100644 :1 README
+M 100644 :1 sub/dir/file
+
+blob
+mark :3
+data 4
+two
+
+commit refs/heads/master
+mark :4
+committer A <a@example.com> 1500000100 +0000
+data 4
+two
+from :2
+M 100644 :3 README
+
+commit refs/heads/side
+mark :5
+committer A <a@example.com> 1500000200 +0000
+data 5
+side
+from :2
+M 100644 :3 sub/dir/other
+
+commit refs/heads/master
+mark :6
+committer A <a@example.com> 1500000300 +0000
+data 6
+merge
+from :4
+merge :5
+M 100644 :3 sub/dir/other
+
+`
+	load := func() *Repository {
+		repo := newRepository("test")
+		sp := newStreamParser(repo)
+		sp.fastImport(context.TODO(), strings.NewReader(rawdump), nullStringSet, "synthetic test load", nil)
+		return repo
+	}
+	one := load()
+	defer one.cleanup()
+	two := load()
+	defer two.cleanup()
+	two.hashAll(nil)
+	for i := range one.events {
+		switch e := one.events[i].(type) {
+		case *Blob:
+			assertEqual(t, two.events[i].(*Blob).hash.hexify(), e.gitHash().hexify())
+		case *Commit:
+			assertEqual(t, two.events[i].(*Commit).hash.hexify(), e.gitHash().hexify())
+		}
+	}
+}
+
 func TestFindBinary(t *testing.T) {
 	assertTrue(t, findBinary("sh"))
 	assertTrue(t, !findBinary("fubbleboz"))
 }
 
+func TestWarningRegistry(t *testing.T) {
+	var wr warningRegistry
+	assertTrue(t, wr.note("a", "one"))
+	assertTrue(t, !wr.note("a", "one"))
+	assertTrue(t, wr.note("b", "one"))
+	wr.suppress("b", true)
+	assertTrue(t, !wr.note("b", "two"))
+	total, hidden := wr.totals()
+	assertIntEqual(t, total, 4)
+	assertIntEqual(t, hidden, 2)
+	var out bytes.Buffer
+	wr.report(&out)
+	expected := "category                    count   hidden\n" +
+		"a                               2        1\n" +
+		"b (suppressed)                  2        1\n"
+	assertEqual(t, out.String(), expected)
+	wr.clear()
+	wr.suppress("b", false)
+	assertTrue(t, wr.note("a", "one"))
+	assertTrue(t, wr.note("b", "two"))
+}
+
+func TestFreeSpace(t *testing.T) {
+	assertEqual(t, byteSize(512), "512B")
+	assertEqual(t, byteSize(1536), "1.5KiB")
+	assertEqual(t, byteSize(3<<30), "3.0GiB")
+	avail, err := freeSpace(".")
+	assertTrue(t, err == nil && avail > 0)
+	assertTrue(t, checkFreeSpace(".", 1, "test") == nil)
+	assertTrue(t, checkFreeSpace(".", avail+(1<<40), "test") != nil)
+	// An unstattable directory skips the check rather than failing
+	assertTrue(t, checkFreeSpace("/nonexistent/fubbleboz", 1<<62, "test") == nil)
+}
+
+func TestParseStreamOption(t *testing.T) {
+	opt, ok, err := parseStreamOption("option reposurgeon sourcetype=hg\n")
+	assertTrue(t, ok && err == nil)
+	assertEqual(t, opt.vcs, "reposurgeon")
+	assertEqual(t, opt.name, "sourcetype")
+	assertEqual(t, opt.value, "hg")
+	assertEqual(t, opt.String(), "option reposurgeon sourcetype=hg")
+	opt, ok, err = parseStreamOption("option git quiet\n")
+	assertTrue(t, ok && err == nil)
+	assertEqual(t, opt.String(), "option git quiet")
+	_, ok, err = parseStreamOption("option malformed\n")
+	assertTrue(t, ok && err != nil)
+	_, ok, _ = parseStreamOption("feature done\n")
+	assertTrue(t, !ok)
+}
+
+func TestHealthReport(t *testing.T) {
+	rawdump := `blob
+mark :1
+data 4
+one
+
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 100 +0000
+data 7
+First.
+M 100644 :1 README
+
+commit refs/heads/master
+mark :3
+committer J. Random Hacker <jrh@example.com> 200 +0000
+data 7
+Empty.
+from :2
+
+`
+	repo := newRepository("test")
+	defer repo.cleanup()
+	sp := newStreamParser(repo)
+	sp.fastImport(context.TODO(), strings.NewReader(rawdump), nullStringSet, "synthetic test load", control.baton)
+	repo.addEvent(newReset(repo, "refs/heads/gone", ":99", ""))
+
+	report := repo.healthReport(repo.all(), control.baton)
+	assertIntEqual(t, report.Commits, 2)
+	assertIntEqual(t, report.Resets, 1)
+	assertEqual(t, report.Earliest, "1970-01-01T00:01:40Z")
+	assertEqual(t, report.Latest, "1970-01-01T00:03:20Z")
+	assertEqual(t, strings.Join(report.EmptyCommits, " "), "commit@:3")
+	assertEqual(t, strings.Join(report.Dangling, " "), "refs/heads/gone -> :99")
+	assertIntEqual(t, len(report.Unreferenced), 0)
+	assertIntEqual(t, report.BlobSizes[0].Count, 1)
+
+	assertTrue(t, mixedEOL([]byte("a\r\nb\n")))
+	assertTrue(t, !mixedEOL([]byte("a\r\nb\r\n")))
+	assertTrue(t, !mixedEOL([]byte("a\nb\n")))
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	rawdump := `blob
+mark :1
+data 4
+one
+
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 100 +0000
+data 7
+First.
+M 100644 :1 README
+
+commit refs/heads/master
+mark :3
+committer J. Random Hacker <jrh@example.com> 200 +0000
+data 8
+Second.
+from :2
+
+`
+	repo := newRepository("saved")
+	defer repo.cleanup()
+	sp := newStreamParser(repo)
+	sp.fastImport(context.TODO(), strings.NewReader(rawdump), nullStringSet, "synthetic test load", control.baton)
+	repo.legacyMap["SVN:7"] = repo.markToEvent(":3").(*Commit)
+	repo.assignments["pair"] = newSelectionSet(1, 2)
+
+	filename := fmt.Sprintf("%s/rs-session-%d", os.TempDir(), os.Getpid())
+	defer os.Remove(filename)
+	defer os.RemoveAll(sessionBlobDir(filename))
+	linked, err := repo.saveSession(filename, control.baton)
+	assertTrue(t, err == nil)
+	assertIntEqual(t, linked, 1)
+
+	_, err = restoreSession(filename, "", newOrderedStringSet("saved"), control.baton)
+	assertTrue(t, err != nil)
+	restored, err := restoreSession(filename, "restored", newOrderedStringSet("saved"), control.baton)
+	assertTrue(t, err == nil)
+	defer restored.cleanup()
+	assertEqual(t, restored.name, "restored")
+	assertIntEqual(t, len(restored.events), len(repo.events))
+	assertEqual(t, restored.legacyMap["SVN:7"].mark, ":3")
+	assertEqual(t, fmt.Sprint(restored.assignments["pair"].Values()), "[1 2]")
+	second := restored.markToEvent(":3").(*Commit)
+	assertEqual(t, second.Comment, "Second.\n")
+	assertEqual(t, strings.Join(second.parentMarks(), " "), ":2")
+	assertEqual(t, string(restored.markToEvent(":1").(*Blob).getContent()), "one\n")
+}
+
+func TestParseClockOffset(t *testing.T) {
+	var tests = []struct {
+		literal string
+		seconds int
+	}{
+		{"5", 5},
+		{"+5", 5},
+		{"-5", -5},
+		{"2:03", 123},
+		{"-1:00:30", -3630},
+	}
+	for _, item := range tests {
+		seconds, err := parseClockOffset(item.literal)
+		assertTrue(t, err == nil)
+		assertIntEqual(t, seconds, item.seconds)
+	}
+	_, err := parseClockOffset("1:2:3:4")
+	assertTrue(t, err != nil)
+	_, err = parseClockOffset("1:x")
+	assertTrue(t, err != nil)
+}
+
+func TestSedExpression(t *testing.T) {
+	re, repl, err := sedExpression(`s:^src/(.*)\.c$:lib/\1-&.c:g`)
+	assertTrue(t, err == nil)
+	assertEqual(t, repl, "lib/${1}-${0}.c")
+	assertEqual(t, GoReplacer(re, "src/main.c", repl), "lib/main-src/main.c.c")
+	_, repl, err = sedExpression(`s/a\/b/\&$x/`)
+	assertTrue(t, err == nil)
+	assertEqual(t, repl, "&$$x")
+	_, _, err = sedExpression("s/a/b")
+	assertTrue(t, err != nil)
+	_, _, err = sedExpression("s/a/b/x")
+	assertTrue(t, err != nil)
+}
+
+func TestBucketMap(t *testing.T) {
+	bm, err := readBucketMap(strings.NewReader("# comment\nsrc/ code\nsrc/doc/ docs\n\n"))
+	assertTrue(t, err == nil)
+	assertEqual(t, bm.bucket("src/main.c"), "code")
+	assertEqual(t, bm.bucket("src/doc/index.adoc"), "docs")
+	assertEqual(t, bm.bucket("tests/run.sh"), "tests")
+	assertEqual(t, bm.bucket("README"), "")
+	var none *bucketMap
+	assertEqual(t, none.bucket("src/doc/index.adoc"), "src")
+	_, err = readBucketMap(strings.NewReader("src/\n"))
+	assertTrue(t, err != nil)
+}
+
+func TestMessageBoxStreaming(t *testing.T) {
+	load := func() *Repository {
+		repo := newRepository("test")
+		sp := newStreamParser(repo)
+		sp.fastImport(context.TODO(), strings.NewReader(rawdump), nullStringSet, "synthetic test load", control.baton)
+		return repo
+	}
+	repo := load()
+	defer repo.cleanup()
+	var box strings.Builder
+	for i, event := range repo.events {
+		if commit, ok := event.(*Commit); ok {
+			var one strings.Builder
+			assertTrue(t, commit.emitMessage(&one, nullOrderedStringSet, i, nil) == nil)
+			assertEqual(t, one.String(), commit.emailOut(nullOrderedStringSet, i, nil))
+			box.WriteString(one.String())
+		}
+	}
+	edited := strings.Replace(box.String(), "\n\nSecond revision.\n", "\n\nSecond revision, amended.\n", 1)
+	mr := newMsgboxReader(strings.NewReader(edited))
+	count := 0
+	for {
+		_, err := mr.next()
+		if err == io.EOF {
+			break
+		}
+		assertTrue(t, err == nil)
+		count++
+	}
+	assertIntEqual(t, count, len(repo.commits(undefinedSelectionSet)))
+	// Rewindable and unrewindable input must come out the same
+	for _, input := range []io.ReadCloser{
+		&plainCloser{strings.NewReader(edited)},
+		&seekableCloser{strings.NewReader(edited)},
+	} {
+		repo := load()
+		errs, _, _ := repo.readMessageBox(undefinedSelectionSet, input, false, false, false)
+		assertIntEqual(t, errs, 0)
+		assertEqual(t, repo.markToEvent(":2").(*Commit).Comment, "First revision.\n")
+		assertEqual(t, repo.markToEvent(":4").(*Commit).Comment, "Second revision, amended.\n")
+		repo.cleanup()
+	}
+}
+
+// plainCloser makes a reader look like a pipe.
+type plainCloser struct {
+	io.Reader
+}
+
+func (plainCloser) Close() error { return nil }
+
+// seekableCloser makes a strings.Reader look like an open file.
+type seekableCloser struct {
+	*strings.Reader
+}
+
+func (seekableCloser) Close() error { return nil }
+
+func TestCommentPolicy(t *testing.T) {
+	assertTrue(t, isSeparatorLine("  ----  "))
+	assertTrue(t, !isSeparatorLine("---"))
+	assertTrue(t, !isSeparatorLine("--=="))
+	policy := commentPolicy{width: 12, legacy: true}
+	found, fixable := policy.problems("=====\nshort\nmuch too long\n", "7")
+	assertIntEqual(t, len(found), 3)
+	assertTrue(t, fixable)
+	assertEqual(t, policy.fix("=====\nshort", "7"), "short\n\nLegacy-ID: 7\n")
+	found, fixable = policy.problems("short\n\nLegacy-ID: 7\n", "7")
+	assertIntEqual(t, len(found), 0)
+	assertTrue(t, !fixable)
+}
+
+func TestMarkAliases(t *testing.T) {
+	repo := newRepository("test")
+	defer repo.cleanup()
+	repo.noteMarkAliases(map[string]string{":1": ":1", ":3": ":2", ":4": ":3"})
+	// :2 of the second renumbering is the old :3; :4 is new since
+	repo.noteMarkAliases(map[string]string{":1": ":1", ":2": ":2", ":4": ":3"})
+	assertEqual(t, repo.markAliases[":3"], ":2")
+	assertEqual(t, repo.markAliases[":4"], "")
+	assertEqual(t, repo.markAliases[":1"], ":1")
+	_, ok := repo.markAliases[":2"]
+	assertTrue(t, !ok)
+	assertIntEqual(t, len(repo.markAliases), 3)
+}
+
+func TestProgressReport(t *testing.T) {
+	var out bytes.Buffer
+	baton := newBaton(false, func(string) {})
+	baton.setReporter(&out)
+	baton.startProgress("testing", 4)
+	baton.percentProgress(4)
+	baton.endProgress()
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assertIntEqual(t, len(lines), 3)
+	assertTrue(t, strings.HasPrefix(lines[0], `{"phase":"testing","event":"start","count":0,"expected":4,"percent":0,`))
+	assertTrue(t, strings.Contains(lines[0], `"eta":-1}`))
+	assertTrue(t, strings.Contains(lines[2], `"event":"end","count":4,"expected":4,"percent":100,`))
+	baton.setReporter(nil)
+	baton.startProgress("quiet", 1)
+	assertIntEqual(t, len(strings.Split(strings.TrimSpace(out.String()), "\n")), 3)
+}
+
+func TestUnderPath(t *testing.T) {
+	rest, ok := underPath("doc/guide.txt", "doc")
+	assertTrue(t, ok)
+	assertEqual(t, rest, "/guide.txt")
+	rest, ok = underPath("doc", "doc")
+	assertTrue(t, ok)
+	assertEqual(t, rest, "")
+	_, ok = underPath("docs/guide.txt", "doc")
+	assertTrue(t, !ok)
+}
+
+func TestChangelogHeader(t *testing.T) {
+	who, err := parseChangelogHeader("2001-01-01  Fred Foonly  <fred@example.com>")
+	assertTrue(t, err == nil)
+	assertEqual(t, who, "Fred Foonly <fred@example.com>")
+	who, err = parseChangelogHeader("\t* foo.c: New file.")
+	assertTrue(t, err == nil)
+	assertEqual(t, who, "")
+	_, err = parseChangelogHeader("Fred Foonly <fred@example.com> wrote:")
+	assertTrue(t, err != nil)
+	parser := regexpChangelogParser(regexp.MustCompile(`^(.*) wrote:$`))
+	who, err = parser("Fred  Foonly (fred@example.com) wrote:")
+	assertTrue(t, err == nil)
+	assertEqual(t, who, "Fred Foonly <fred@example.com>")
+}
+
+func TestCoauthorTrailers(t *testing.T) {
+	body, found := splitCoauthors("Summary.\n\nSigned-off-by: A <a@x.org>\nco-authored-by: B  B <b@x.org>\n")
+	assertEqual(t, body, "Summary.\n\nSigned-off-by: A <a@x.org>\n")
+	assertIntEqual(t, len(found), 1)
+	assertEqual(t, found[0], "B B <b@x.org>")
+	assertEqual(t, joinCoauthors(body, found),
+		"Summary.\n\nSigned-off-by: A <a@x.org>\nCo-authored-by: B B <b@x.org>\n")
+	assertEqual(t, joinCoauthors("Summary.\n", found),
+		"Summary.\n\nCo-authored-by: B B <b@x.org>\n")
+	// Only the last paragraph holds trailers
+	body, found = splitCoauthors("Co-authored-by: B <b@x.org>\n\nSummary.\n")
+	assertIntEqual(t, len(found), 0)
+	assertEqual(t, body, "Co-authored-by: B <b@x.org>\n\nSummary.\n")
+	// ...and only if it is a trailer block
+	body, found = splitCoauthors("Summary.\n\nWith help from\nCo-authored-by: B <b@x.org>\n")
+	assertIntEqual(t, len(found), 0)
+	assertEqual(t, body, "Summary.\n\nWith help from\nCo-authored-by: B <b@x.org>\n")
+}
+
+func TestLegacyReferences(t *testing.T) {
+	repo := newRepository("test")
+	defer repo.cleanup()
+	body, refs := repo.findLegacyReferences("Fix.\n\ngit-svn-id: svn://x/trunk@42 0123abcd-0000\n")
+	assertEqual(t, body, "Fix.\n")
+	assertIntEqual(t, len(refs), 1)
+	assertEqual(t, refs[0].cookie, "SVN:42")
+	_, refs = repo.findLegacyReferences("$Id: foo.c,v 1.8 1992/05/30 10:05:43 jsp Exp $\n")
+	assertEqual(t, refs[0].legacyID, "CVS:foo.c:1.8")
+	_, refs = repo.findLegacyReferences("Reverts r41.\n")
+	assertIntEqual(t, len(refs), 0)
+}
+
+func TestBzrLogParse(t *testing.T) {
+	log := `------------------------------------------------------------
+revno: 2 [merge]
+revision-id: esr@thyrsus.com-20200102120000-bbbb
+parent: esr@thyrsus.com-20200101120000-aaaa
+parent: jrh@example.com-20200101130000-cccc
+committer: Eric S. Raymond <esr@thyrsus.com>
+branch nick: trunk
+timestamp: Thu 2020-01-02 12:00:00 +0000
+message:
+  Merge the feature.
+  
+  Second paragraph.
+    ------------------------------------------------------------
+    revno: 1.1.1
+    revision-id: jrh@example.com-20200101130000-cccc
+    parent: esr@thyrsus.com-20200101120000-aaaa
+    author: J. Random Hacker <jrh@example.com>, Fred Foonly <fred@example.com>
+    committer: Eric S. Raymond <esr@thyrsus.com>
+    branch nick: feature
+    timestamp: Wed 2020-01-01 13:00:00 -0500
+    message:
+      The feature.
+------------------------------------------------------------
+revno: 1
+revision-id: esr@thyrsus.com-20200101120000-aaaa
+committer: Eric S. Raymond <esr@thyrsus.com>
+branch nick: trunk
+timestamp: Wed 2020-01-01 12:00:00 +0000
+message:
+  ------------------------------------------------------------
+  Initial.
+`
+	revisions, err := parseBzrLog(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIntEqual(t, len(revisions), 3)
+	assertEqual(t, revisions[0].message, "Merge the feature.\n\nSecond paragraph.\n")
+	assertIntEqual(t, len(revisions[0].parents), 2)
+	assertIntEqual(t, revisions[1].depth, 1)
+	assertEqual(t, revisions[1].revid, "jrh@example.com-20200101130000-cccc")
+	assertEqual(t, revisions[1].timestamp, "2020-01-01T13:00:00-05:00")
+	assertIntEqual(t, len(revisions[1].authors), 2)
+	assertEqual(t, revisions[1].authors[1], "Fred Foonly <fred@example.com>")
+	assertEqual(t, revisions[1].message, "The feature.\n")
+	assertEqual(t, revisions[2].message, strings.Repeat("-", 60)+"\nInitial.\n")
+	assertIntEqual(t, len(revisions[2].parents), 0)
+}
+
+func TestFossilManifest(t *testing.T) {
+	manifest := `B 7bb5d1f3cb4de2a72ad0aab85d4b5a0b27e5a1a8
+C Fix\sthe\sbuild.
+D 2020-01-01T12:00:00.000
+F Make\sfile 0123456789abcdef0123456789abcdef01234567
+F bin/run 1111111111111111111111111111111111111111 x
+F old.c
+P 7bb5d1f3cb4de2a72ad0aab85d4b5a0b27e5a1a8
+U esr
+Z 0123456789abcdef0123456789abcdef
+`
+	baseline, files := parseFossilManifest(manifest)
+	assertEqual(t, baseline, "7bb5d1f3cb4de2a72ad0aab85d4b5a0b27e5a1a8")
+	assertIntEqual(t, len(files), 3)
+	assertEqual(t, files["Make file"], "0123456789abcdef0123456789abcdef01234567")
+	assertEqual(t, files["bin/run"], "1111111111111111111111111111111111111111 x")
+	assertEqual(t, files["old.c"], "")
+	assertEqual(t, fossilDecode(`a\\b\nc`), "a\\b\nc")
+}
+
+func TestDarcsLogParse(t *testing.T) {
+	log := `<changelog>
+<patch author='Fred Foonly &lt;fred@example.com&gt;' date='20200102120000' local_date='Thu Jan  2 12:00:00 UTC 2020' inverted='False' hash='20200102120000-abcde-2222'>
+	<name>TAG 1.0</name>
+	<summary>
+	</summary>
+</patch>
+<patch author='Fred Foonly &lt;fred@example.com&gt;' date='20200101130000' local_date='Wed Jan  1 13:00:00 UTC 2020' inverted='False' hash='20200101130000-abcde-1111'>
+	<name>Rearrange things</name>
+	<comment>Ignore-this: 0123456789abcdef
+Longer explanation.</comment>
+	<summary>
+	<modify_file>
+	./src/main.c<removed_lines num='1'/><added_lines num='2'/>
+	</modify_file>
+	<move from="./doc" to="./manual"/>
+	<remove_file>
+	./junk
+	</remove_file>
+	</summary>
+</patch>
+</changelog>
+`
+	patches, err := parseDarcsLog(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIntEqual(t, len(patches), 2)
+	assertEqual(t, patches[0].tagName(), "1.0")
+	assertEqual(t, patches[1].tagName(), "")
+	assertEqual(t, patches[1].Author, "Fred Foonly <fred@example.com>")
+	assertEqual(t, patches[1].Comment, "Longer explanation.")
+	changes := patches[1].Summary.Changes
+	assertIntEqual(t, len(changes), 3)
+	assertEqual(t, changes[0].XMLName.Local, "modify_file")
+	assertEqual(t, changes[0].Path, "src/main.c")
+	assertEqual(t, changes[1].From, "doc")
+	assertEqual(t, changes[1].To, "manual")
+	assertEqual(t, changes[2].Path, "junk")
+}
+
+func TestP4Extractor(t *testing.T) {
+	described := `... change 1234
+... user fred
+... client fred-ws
+... time 1577880000
+... desc Fix the build.
+
+Second paragraph.
+
+... status submitted
+... depotFile0 //depot/proj/main/src/a.c
+... action0 edit
+... type0 text
+... rev0 3
+... depotFile1 //depot/proj/rel-1.0/run
+... action1 branch
+... type1 text+x
+... rev1 1
+`
+	records, err := parseP4Tagged(strings.NewReader(described))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIntEqual(t, len(records), 1)
+	assertEqual(t, records[0]["desc"], "Fix the build.\n\nSecond paragraph.")
+	assertEqual(t, records[0]["depotFile1"], "//depot/proj/rel-1.0/run")
+	listed, _ := parseP4Tagged(strings.NewReader("... change 2\n... desc Two\n\n... change 1\n... desc One\n\n"))
+	assertIntEqual(t, len(listed), 2)
+	assertEqual(t, listed[1]["desc"], "One")
+
+	assertIntEqual(t, p4Perms("text"), 0644)
+	assertIntEqual(t, p4Perms("text+kx"), 0755)
+	assertIntEqual(t, p4Perms("kxtext"), 0755)
+	assertIntEqual(t, p4Perms("symlink"), 0120000)
+
+	pe := newP4Extractor()
+	config := `P4PORT=ssl:perforce:1666
+REPOSURGEON_DEPOT=//depot/proj/...
+REPOSURGEON_BRANCH=//depot/proj/main master
+REPOSURGEON_BRANCH=//depot/proj/rel-1.0 rel-1.0
+`
+	if err := pe.configure(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	branch, path := pe.branchOf("//depot/proj/rel-1.0/run")
+	assertEqual(t, branch, "rel-1.0")
+	assertEqual(t, path, "run")
+	branch, path = pe.branchOf("//depot/proj/README")
+	assertEqual(t, branch, "master")
+	assertEqual(t, path, "README")
+}
+
+func TestPreflight(t *testing.T) {
+	repo := newRepository("preflight")
+	defer repo.cleanup()
+	commit := newCommit(repo)
+	commit.setMark(":1")
+	commit.setBranch("refs/heads/master")
+	commit.Comment = "caf\xe9\n"
+	attrib, _ := newAttribution("Fred Foonly <fred@example.com> 1000000000 +0000")
+	commit.committer = *attrib
+	commit.authors = []Attribution{*attrib, *attrib}
+	repo.addEvent(commit)
+	git := findVCS("git")
+	problems := repo.preflight(git)
+	assertIntEqual(t, len(problems), 1)
+	assertTrue(t, problems[0].fatal)
+	assertEqual(t, problems[0].events[0], commit.idMe())
+	problems = repo.preflight(findVCS("bzr"))
+	assertIntEqual(t, len(problems), 1)
+	assertEqual(t, problems[0].what, "events with text that is not UTF-8")
+}
+
+func TestInterruptedPasses(t *testing.T) {
+	stream := `blob
+mark :1
+data 4
+one
+
+commit refs/heads/master
+mark :2
+committer Fred Foonly <fred@example.com> 1000000000 +0000
+data 6
+First
+M 100644 :1 README
+
+commit refs/heads/master
+mark :3
+committer Fred Foonly <fred@example.com> 1000000100 +0000
+data 7
+Second
+from :2
+
+`
+	repo := newRepository("interrupt")
+	defer repo.cleanup()
+	repo.fastImport(context.TODO(), strings.NewReader(stream), nullStringSet, "synthetic test load", control.baton)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var a strings.Builder
+	if err := repo.fastExport(ctx, repo.all(), &a, nullStringSet, nil, control.baton); err == nil {
+		t.Error("export ignored the interrupt")
+	}
+	assertEqual(t, a.String(), "")
+	if err := repo.squash(ctx, newSelectionSet(1, 2), orderedStringSet{"--delete"}, control.baton); err == nil {
+		t.Error("squash ignored the interrupt")
+	}
+	assertIntEqual(t, len(repo.events), 3)
+	if err := repo.renumber(ctx, 1, nil); err == nil {
+		t.Error("renumber ignored the interrupt")
+	}
+	assertEqual(t, repo.events[2].getMark(), ":3")
+}
+
+func TestParseMailmap(t *testing.T) {
+	entries := parseMailmap(strings.NewReader(`# A comment
+Proper Name <commit@example.com>
+<proper@example.com> <commit@example.com>
+Proper Name <proper@example.com> <commit@example.com>
+Proper Name <proper@example.com> Commit Name <commit@example.com>  # trailing
+no address here
+`))
+	expected := []mailmapEntry{
+		{"Proper Name", "", "", "commit@example.com"},
+		{"", "proper@example.com", "", "commit@example.com"},
+		{"Proper Name", "proper@example.com", "", "commit@example.com"},
+		{"Proper Name", "proper@example.com", "Commit Name", "commit@example.com"},
+	}
+	assertIntEqual(t, len(entries), len(expected))
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Errorf("entry %d: expected %v, saw %v", i, expected[i], entries[i])
+		}
+	}
+}
+
+func TestClassifyContent(t *testing.T) {
+	tests := []struct {
+		content string
+		binary  bool
+		utf8    bool
+		eol     eolStyle
+	}{
+		{"", false, true, eolNone},
+		{"no newline", false, true, eolNone},
+		{"a\nb\n", false, true, eolLF},
+		{"a\r\nb\r\n", false, true, eolCRLF},
+		{"a\r\nb\n", false, true, eolMixed},
+		{"caf\xe9\n", false, false, eolLF},
+		{"GIF\x00\r\nb\n", true, false, eolNone},
+	}
+	for _, test := range tests {
+		class := classifyContent([]byte(test.content))
+		if class.binary != test.binary || class.utf8 != test.utf8 || class.eol != test.eol {
+			t.Errorf("classifyContent(%q) = %+v", test.content, class)
+		}
+	}
+	assertEqual(t, string(normalizeEOL([]byte("a\r\nb\nc\r"), "\n")), "a\nb\nc\r")
+	assertEqual(t, string(normalizeEOL([]byte("a\r\nb\n"), "\r\n")), "a\r\nb\r\n")
+	assertEqual(t, string(normalizeEOL([]byte("\x00a\r\nb\n"), "\n")), "\x00a\r\nb\n")
+}
+
+func TestReportRecord(t *testing.T) {
+	fields := []string{"event", "summary"}
+	values := []interface{}{3, `Fix "this", then that`}
+	csvMods := orderedStringSet{"csv"}
+	assertEqual(t, reportHeader(csvMods, fields), "event,summary")
+	assertEqual(t, reportRecord(csvMods, fields, values), `3,"Fix ""this"", then that"`)
+	jsonMods := orderedStringSet{"json"}
+	assertEqual(t, reportHeader(jsonMods, fields), "")
+	assertEqual(t, reportRecord(jsonMods, fields, values), `{"event": 3, "summary": "Fix \"this\", then that"}`)
+}
+
+func TestEventChanges(t *testing.T) {
+	a, b, c := &Blob{}, &Blob{}, &Blob{}
+	for _, item := range []struct {
+		before  []Event
+		after   []Event
+		added   int
+		deleted int
+	}{
+		{[]Event{a, b}, []Event{a, b}, 0, 0},
+		{nil, []Event{a, b}, 2, 0},
+		{[]Event{a, b, c}, []Event{a, c}, 0, 1},
+		{[]Event{a, b}, []Event{c, a}, 1, 1},
+	} {
+		added, deleted := eventChanges(item.before, item.after)
+		if added != item.added || deleted != item.deleted {
+			t.Errorf("eventChanges: expected %d/%d, saw %d/%d",
+				item.added, item.deleted, added, deleted)
+		}
+	}
+	for _, item := range []struct {
+		line   string
+		logged bool
+	}{
+		{"list", false},
+		{"# comment", false},
+		{"", false},
+		{"delete", true},
+		{"squash --pushback", true},
+	} {
+		if oplogged(item.line) != item.logged {
+			t.Errorf("oplogged(%q): expected %v", item.line, item.logged)
+		}
+	}
+}
+
+func TestCompileExpr(t *testing.T) {
+	commit := &Commit{mark: ":3", Branch: "refs/heads/master", Comment: "Fix the frobnicator.\nDetails.\n"}
+	commit.committer = Attribution{fullname: "J. Random Hacker", email: "jrh@example.com"}
+	for _, item := range []struct {
+		expr string
+		want string
+		rest string
+	}{
+		{`type`, "commit", ""},
+		{`mark + "/" + branch`, ":3/refs/heads/master", ""},
+		{`summary`, "Fix the frobnicator.", ""},
+		{`2 + 3 == 5 && parents < 1`, "true", ""},
+		{`"10" < "9"`, "true", ""},
+		{`10 < 9`, "false", ""},
+		{`!(author =~ "Random") || tagname`, "false", ""},
+		{`lower(authoremail) != "jrh@example.com"`, "false", ""},
+		{`sub(author, "\\.", "") + len(comment)}rest`, "J Random Hacker30", "}rest"},
+		{`upper(summary) ) x`, "FIX THE FROBNICATOR.", ") x"},
+	} {
+		node, rest := compileExpr(item.expr)
+		assertEqual(t, exprString(node(commit)), item.want)
+		assertEqual(t, rest, item.rest)
+	}
+}
+
+func TestTouches(t *testing.T) {
+	touched := []string{"src/alpha.c", "lib"}
+	for _, item := range []struct {
+		path string
+		want bool
+	}{
+		{"src/alpha.c", true},
+		{"src/alpha.cc", false},
+		{"lib/beta.c", true},
+		{"library/beta.c", false},
+	} {
+		if touches(touched, item.path) != item.want {
+			t.Errorf("touches(%q): expected %v", item.path, item.want)
+		}
+	}
+}
+
+func TestLineSimilarity(t *testing.T) {
+	for _, item := range []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"", "", 100},
+		{"a\nb\n", "a\nb\n", 100},
+		{"a\nb\n", "c\nd\n", 0},
+		{"a\nb\nc\nd\n", "a\nb\nc\ne\n", 75},
+		{"a\na\n", "a\n", 66},
+	} {
+		if got := lineSimilarity([]byte(item.a), []byte(item.b)); got != item.want {
+			t.Errorf("lineSimilarity(%q, %q): expected %d, saw %d", item.a, item.b, item.want, got)
+		}
+	}
+}
+
+func TestArchive(t *testing.T) {
+	repo := newRepository("fubar")
+	defer repo.cleanup()
+	commit := newCommit(repo)
+	repo.addEvent(commit)
+	for _, item := range [][]string{
+		{"100755", "bin/run", "#!/bin/sh\n"},
+		{"120000", "bin/link", "run"},
+		{"100644", "README", "Read me.\n"},
+	} {
+		fileop := newFileOp(repo).construct(opM, item[0], "inline", item[1])
+		fileop.inline = []byte(item[2])
+		commit.appendOperation(fileop)
+	}
+	expected := "README 644 Read me.\n|bin/link 777 ->run|bin/run 755 #!/bin/sh\n|"
+
+	var tarred bytes.Buffer
+	if err := commit.archive(&tarred, "tar", "x/"); err != nil {
+		t.Fatal(err)
+	}
+	var seen strings.Builder
+	tr := tar.NewReader(&tarred)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(tr)
+		if header.Typeflag == tar.TypeSymlink {
+			content = []byte("->" + header.Linkname)
+		}
+		fmt.Fprintf(&seen, "%s %o %s|", strings.TrimPrefix(header.Name, "x/"), header.Mode, content)
+	}
+	assertEqual(t, seen.String(), expected)
+
+	var zipped bytes.Buffer
+	if err := commit.archive(&zipped, "zip", ""); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(zipped.Bytes()), int64(zipped.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen.Reset()
+	for _, file := range zr.File {
+		fp, _ := file.Open()
+		content, _ := ioutil.ReadAll(fp)
+		fp.Close()
+		if file.Mode()&os.ModeSymlink != 0 {
+			content = append([]byte("->"), content...)
+		}
+		fmt.Fprintf(&seen, "%s %o %s|", file.Name, file.Mode().Perm(), content)
+	}
+	assertEqual(t, seen.String(), expected)
+}
+
+func TestSymlinkEscapes(t *testing.T) {
+	for _, item := range []struct {
+		link   string
+		target string
+		want   bool
+	}{
+		{"doc/readme", "README", false},
+		{"doc/readme", "../README", false},
+		{"doc/readme", "../../README", true},
+		{"readme", "..", true},
+		{"a/b/c", "../../x/../y", false},
+		{"words", "/usr/share/dict/words", true},
+	} {
+		if symlinkEscapes(item.link, item.target) != item.want {
+			t.Errorf("symlinkEscapes(%q, %q): expected %v", item.link, item.target, item.want)
+		}
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	assertEqual(t, string(tombstone("{hash} {size} {hash}", "abc", 42)), "abc 42 abc")
+	assertEqual(t, string(tombstone(redactTemplate, "abc", 0)),
+		"This file was redacted.\nOriginal blob: abc\nOriginal size: 0 bytes\n")
+	assertEqual(t, string(tombstone("{other}", "abc", 1)), "{other}")
+}
+
+func TestManifestLimit(t *testing.T) {
+	control.manifestLimit = 2
+	defer func() {
+		control.manifestLimit = 0
+		trimManifests(0)
+	}()
+	rs := newReposurgeon()
+	rs.DoRead("<../test/implicit.fi")
+	repo := rs.chosen()
+	memoized := func() int {
+		num := 0
+		for _, commit := range repo.commits(undefinedSelectionSet) {
+			if commit._manifest != nil {
+				num++
+			}
+		}
+		return num
+	}
+	commits := repo.commits(undefinedSelectionSet)
+	tip := commits[len(commits)-1]
+	tip.manifest()
+	assertTrue(t, memoized() == 2)
+	assertTrue(t, manifestsEvicted())
+	// An ancestor whose manifest was forgotten must still pass
+	// invalidation on to the tip.
+	ancestor := tip
+	for i := 0; i < 3; i++ {
+		ancestor = ancestor.firstParent().(*Commit)
+	}
+	assertTrue(t, ancestor._manifest == nil)
+	fileop := newFileOp(repo).construct(opM, "100644", "inline", "manifest-limit")
+	fileop.inline = []byte("test\n")
+	ancestor.appendOperation(fileop)
+	if _, ok := tip.manifest().get("manifest-limit"); !ok {
+		t.Error("stale manifest survived invalidation")
+	}
+	trimManifests(0)
+	assertTrue(t, memoized() == 0)
+	assertTrue(t, !manifestsEvicted())
+}
+
+// nameTable resolves every name the repository's name cache or a fresh
+// one knows, plus the extra names given, through the repository's
+// current name cache.
+func nameTable(repo *Repository, extra ...string) map[string]string {
+	candidates := append([]string{}, extra...)
+	gather := func(cache *nameCache) {
+		for name := range cache.names {
+			candidates = append(candidates, name)
+		}
+		for name := range cache.stamps {
+			candidates = append(candidates, name)
+		}
+		for name, commits := range cache.groups {
+			for n := 1; n <= len(commits)+1; n++ {
+				candidates = append(candidates, fmt.Sprintf("%s#%d", name, n))
+			}
+		}
+		for n := 1; n <= len(cache.ordinals)+1; n++ {
+			candidates = append(candidates, fmt.Sprintf("#%d", n))
+		}
+	}
+	current := repo._namecache
+	if current != nil {
+		gather(current)
+	}
+	repo._namecache = nil
+	repo.lookupName("")
+	gather(repo._namecache)
+	if current != nil {
+		repo._namecache = current
+	}
+	table := make(map[string]string)
+	for _, name := range candidates {
+		if v, ok := repo.lookupName(name); ok {
+			table[name] = v.String()
+		}
+	}
+	return table
+}
+
+func TestNamecacheSync(t *testing.T) {
+	rs := newReposurgeon()
+	rs.DoRead("<../test/simple.fi")
+	repo := rs.chosen()
+	check := func(legend string, extra ...string) {
+		synced := nameTable(repo, extra...)
+		repo._namecache = nil
+		fresh := nameTable(repo, extra...)
+		if !reflect.DeepEqual(synced, fresh) {
+			for name, v := range fresh {
+				if synced[name] != v {
+					t.Errorf("after %s, %q resolves to %s, not %s", legend, name, synced[name], v)
+				}
+			}
+			for name, v := range synced {
+				if _, ok := fresh[name]; !ok {
+					t.Errorf("after %s, %q resolves to %s, not nothing", legend, name, v)
+				}
+			}
+		}
+	}
+	check("reading")
+	commits := repo.commits(undefinedSelectionSet)
+	commits[2].authors[0].date.timestamp = commits[2].authors[0].date.timestamp.Add(time.Hour)
+	commits[10].legacyID = "r10"
+	commits[11].committer.date.timestamp = commits[11].committer.date.timestamp.Add(time.Hour)
+	var tag *Tag
+	for _, event := range repo.events {
+		if t, ok := event.(*Tag); ok {
+			tag = t
+		}
+	}
+	oldname := tag.tagname
+	tag.tagname = "renamed"
+	repo.invalidateNamecache()
+	check("alteration", oldname)
+	repo.delete(newSelectionSet(repo.eventToIndex(commits[2])), nil, control.baton)
+	check("deletion")
+	repo.insertEvent(newPassthrough(repo, "# inserted\n"), 0, "insertion")
+	check("insertion")
+}
+
+func benchmarkNamecache(b *testing.B, rebuild bool) {
+	rs := newReposurgeon()
+	rs.DoRead("<../test/simple.fi")
+	repo := rs.chosen()
+	passthrough := newPassthrough(repo, "# inserted\n")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%2 == 0 {
+			repo.insertEvent(passthrough, 0, "")
+		} else {
+			repo.events = repo.events[1:]
+			repo.declareSequenceMutation("")
+		}
+		if rebuild {
+			repo._namecache = nil
+		}
+		repo.named("#50")
+	}
+}
+
+// BenchmarkNamecacheSync measures a name lookup after each change to
+// the event sequence, as a script deleting one event at a time does.
+func BenchmarkNamecacheSync(b *testing.B) {
+	benchmarkNamecache(b, false)
+}
+
+// BenchmarkNamecacheRebuild does the same, building the name cache
+// afresh for each lookup as was once done.
+func BenchmarkNamecacheRebuild(b *testing.B) {
+	benchmarkNamecache(b, true)
+}
+
+func TestSelectionSetHybrid(t *testing.T) {
+	// Check the set against a plain slice through runs of adds and
+	// removes that take it across the hash threshold in and out of
+	// ascending order.
+	rng := rand.New(rand.NewSource(1))
+	for run := 0; run < 20; run++ {
+		s := newSelectionSet()
+		model := make([]int, 0)
+		span := 10 + rng.Intn(4*hashThreshold)
+		for step := 0; step < 300; step++ {
+			x := rng.Intn(span)
+			if run%2 == 0 {
+				// Mostly ascending, as selections are.
+				x = len(model) + rng.Intn(3)
+			}
+			pos := -1
+			for i, v := range model {
+				if v == x {
+					pos = i
+				}
+			}
+			if rng.Intn(4) == 0 {
+				if s.Remove(x) != (pos >= 0) {
+					t.Fatalf("run %d: Remove(%d) disagrees with model", run, x)
+				}
+				if pos >= 0 {
+					model = append(model[:pos], model[pos+1:]...)
+				}
+			} else {
+				s.Add(x)
+				if pos < 0 {
+					model = append(model, x)
+				}
+			}
+			if !reflect.DeepEqual(s.Values(), model) {
+				t.Fatalf("run %d: set %v, expected %v", run, s, model)
+			}
+			for y := -1; y <= span+3; y++ {
+				want := false
+				for _, v := range model {
+					want = want || v == y
+				}
+				if s.Contains(y) != want {
+					t.Fatalf("run %d: Contains(%d) of %v is %v", run, y, s, !want)
+				}
+			}
+			if len(model) > 0 {
+				min, max := model[0], model[0]
+				for _, v := range model {
+					if v < min {
+						min = v
+					}
+					if v > max {
+						max = v
+					}
+				}
+				if s.Min() != min || s.Max() != max {
+					t.Fatalf("run %d: bounds of %v are %d, %d", run, s, s.Min(), s.Max())
+				}
+			}
+		}
+		other := newSelectionSet()
+		for i := 0; i <= span+300; i += 2 {
+			other.Add(i)
+		}
+		for _, v := range s.Subtract(other).Values() {
+			if v%2 == 0 {
+				t.Errorf("run %d: %d survived subtraction", run, v)
+			}
+		}
+		for _, v := range s.Intersection(other).Values() {
+			if v%2 != 0 {
+				t.Errorf("run %d: %d survived intersection", run, v)
+			}
+		}
+		union := s.Union(other)
+		assertIntEqual(t, union.Size(), s.Size()+other.Size()-s.Intersection(other).Size())
+		s.Sort()
+		assertTrue(t, sort.IntsAreSorted(s.Values()))
+	}
+}
+
+// BenchmarkSelectionSubtract takes a scattered selection from one
+// covering the whole of a large repository.
+func BenchmarkSelectionSubtract(b *testing.B) {
+	all := newSelectionSet()
+	for i := 0; i < 100000; i++ {
+		all.Add(i)
+	}
+	some := newSelectionSet()
+	for i := 99999; i >= 0; i -= 7 {
+		some.Add(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		all.Subtract(some)
+	}
+}
+
+func TestEventID(t *testing.T) {
+	load := func(name string) *Repository {
+		repo := newRepository(name)
+		sp := newStreamParser(repo)
+		sp.fastImport(context.TODO(), strings.NewReader(rawdump), nullStringSet, "synthetic test load", nil)
+		return repo
+	}
+	a := load("alpha")
+	defer a.cleanup()
+	b := load("beta")
+	defer b.cleanup()
+	again := load("alpha")
+	defer again.cleanup()
+	first := a.newEventID()
+	assertEqual(t, first, again.newEventID())
+	assertTrue(t, regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$").MatchString(first))
+	assertTrue(t, a.newEventID() != first)
+	// Same roots, different repositories
+	assertTrue(t, b.newEventID() != first)
+	assertTrue(t, newRepository("alpha").newEventID() != first)
+}
+
+func TestQueryServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rs-serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rs := newReposurgeon()
+	rs.DoRead("<../test/simple.fi")
+	server, err := rs.startServer(rs.chosen(), filepath.Join(dir, "socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.stop()
+	conn, err := net.Dial("unix", filepath.Join(dir, "socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	replies := bufio.NewScanner(conn)
+	ask := func(request string) string {
+		fmt.Fprintln(conn, request)
+		if !replies.Scan() {
+			t.Fatalf("no reply to %q", request)
+		}
+		return replies.Text()
+	}
+	assertEqual(t, ask("select :2,:4"), `{"ok":true,"result":[3,5]}`)
+	assertEqual(t, ask("select =T & :2"), `{"ok":true,"result":[]}`)
+	assertEqual(t, ask("manifest :4"), `{"ok":true,"result":[{"path":"rs","mode":"100755","ref":":3"}]}`)
+	assertTrue(t, strings.HasPrefix(ask("metadata :4"), `{"ok":true,"result":[{"type":"commit","index":5,"uuid":`))
+	assertEqual(t, ask("manifest :3"), `{"ok":false,"error":"manifest needs a single commit"}`)
+	assertEqual(t, ask("frobnicate :3"), `{"ok":false,"error":"unknown request \"frobnicate\""}`)
+	// A query waits while a command runs.
+	rs.interlock.Lock()
+	fmt.Fprintln(conn, "select :2")
+	answered := make(chan string)
+	go func() {
+		replies.Scan()
+		answered <- replies.Text()
+	}()
+	select {
+	case <-answered:
+		t.Error("query answered while a command ran")
+	case <-time.After(50 * time.Millisecond):
+	}
+	rs.interlock.Unlock()
+	assertEqual(t, <-answered, `{"ok":true,"result":[3]}`)
+	// A macro leaves nothing held once it is done.
+	interpreter := kommandant.NewKommandant(rs)
+	ctx := context.Background()
+	for _, line := range []string{"define hello print hi", "do hello"} {
+		line = interpreter.PreCmd(ctx, line)
+		interpreter.PostCmd(ctx, interpreter.OneCmd(ctx, line), line)
+	}
+	assertIntEqual(t, len(rs.pendingOps), 0)
+	fmt.Fprintln(conn, "select :2")
+	go func() {
+		replies.Scan()
+		answered <- replies.Text()
+	}()
+	select {
+	case reply := <-answered:
+		assertEqual(t, reply, `{"ok":true,"result":[3]}`)
+	case <-time.After(5 * time.Second):
+		t.Error("query not answered after a macro ran")
+	}
+}
+
+func TestFileopInterning(t *testing.T) {
+	data := func(s string) uintptr {
+		return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+	}
+	rs := newReposurgeon()
+	rs.DoRead("<../test/simple.fi")
+	repo := rs.chosen()
+	paths := make(map[string]uintptr)
+	modes := make(map[string]uintptr)
+	shared := 0
+	for _, commit := range repo.commits(repo.all()) {
+		for _, fileop := range commit.operations() {
+			if p, ok := paths[fileop.Path]; ok {
+				assertTrue(t, p == data(fileop.Path))
+				shared++
+			}
+			paths[fileop.Path] = data(fileop.Path)
+			if fileop.mode != "" {
+				if m, ok := modes[fileop.mode]; ok {
+					assertTrue(t, m == data(fileop.mode))
+				}
+				modes[fileop.mode] = data(fileop.mode)
+			}
+		}
+	}
+	assertTrue(t, shared > 0)
+	// A substring is interned as a copy of its own.
+	line := "M 100755 :1 reposurgeon"
+	assertTrue(t, data(repo.intern(line[12:])) != data(line[12:]))
+	assertTrue(t, data(repo.intern(line[12:])) == paths["reposurgeon"])
+}
+
+func TestBlobOpset(t *testing.T) {
+	repo := newRepository("test")
+	defer repo.cleanup()
+	blob := newBlob(repo)
+	blob.setMark(":1")
+	repo.addEvent(blob)
+	ops := make([]*FileOp, 3)
+	for i := range ops {
+		ops[i] = newFileOp(repo).construct(opM, "100644", ":1", fmt.Sprintf("f%d", i))
+	}
+	assertIntEqual(t, len(blob.opset), 3)
+	assertTrue(t, blob.removeOperation(ops[1]))
+	assertTrue(t, reflect.DeepEqual(blob.opset, []*FileOp{ops[0], ops[2]}))
+	assertTrue(t, blob.removeOperation(ops[1]))
+	assertTrue(t, blob.removeOperation(ops[0]))
+	assertTrue(t, !blob.removeOperation(ops[2]))
+	assertTrue(t, blob.paths(nil).Equal(orderedStringSet{}))
+}
+
 // end
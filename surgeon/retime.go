@@ -0,0 +1,310 @@
+/*
+ * Bulk rewriting of commit and tag dates
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dates in a conversion go wrong in a handful of standard ways: a
+// server clock that was off by a fixed amount, a batch of commits
+// sharing one timestamp because a tool made them all at once, every
+// date in UTC because the source VCS never recorded zones, or dates
+// that are simply wrong, as in a history rebuilt from tarballs dated
+// by when they were unpacked, and have to be supplied from somewhere
+// else.  The timeshift operation repairs each of these over a
+// selection.
+// Shifting dates can put a commit before its parent, which confuses
+// tools that expect time to flow along the graph, so every pair a
+// timeshift would newly invert is reported.
+
+// Timeshift modes
+var timeshiftModes = []string{"offset", "clamp", "localize", "retrodate"}
+
+// parseClockOffset parses an offset in the form [+-]ss, [+-]mm:ss or
+// [+-]hh:mm:ss, returning seconds.  The sign applies to the whole
+// offset.
+func parseClockOffset(hhmmss string) (int, error) {
+	sign := 1
+	if strings.HasPrefix(hhmmss, "-") {
+		sign = -1
+		hhmmss = hhmmss[1:]
+	} else {
+		hhmmss = strings.TrimPrefix(hhmmss, "+")
+	}
+	h := "0"
+	m := "0"
+	var s string
+	if strings.Count(hhmmss, ":") == 0 {
+		s = hhmmss
+	} else if strings.Count(hhmmss, ":") == 1 {
+		fields := strings.SplitN(hhmmss, ":", 3)
+		m = fields[0]
+		s = fields[1]
+	} else if strings.Count(hhmmss, ":") == 2 {
+		fields := strings.SplitN(hhmmss, ":", 4)
+		h = fields[0]
+		m = fields[1]
+		s = fields[2]
+	} else {
+		return 0, errors.New("too many colons")
+	}
+	hn, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, errors.New("bad literal in hour field")
+	}
+	mn, err1 := strconv.Atoi(m)
+	if err1 != nil {
+		return 0, errors.New("bad literal in minute field")
+	}
+	sn, err2 := strconv.Atoi(s)
+	if err2 != nil {
+		return 0, errors.New("bad literal in seconds field")
+	}
+	return sign * (hn*3600 + mn*60 + sn), nil
+}
+
+var zoneLiteral = regexp.MustCompile(`^[+-][0-9][0-9][0-9][0-9]$`)
+
+// parseZone accepts an IANA zone name or a [+-]hhmm literal.
+func parseZone(name string) (*time.Location, error) {
+	if zoneLiteral.MatchString(name) {
+		hours, _ := strconv.Atoi(name[1:3])
+		minutes, _ := strconv.Atoi(name[3:5])
+		offset := hours*3600 + minutes*60
+		if name[0] == '-' {
+			offset = -offset
+		}
+		return time.FixedZone(name, offset), nil
+	}
+	return time.LoadLocation(name)
+}
+
+// stampDate returns the date a commit's action stamp is made from,
+// the one bump() moves.
+func (commit *Commit) stampDate() time.Time {
+	if len(commit.authors) > 0 {
+		return commit.authors[0].date.timestamp
+	}
+	return commit.committer.date.timestamp
+}
+
+// readRetrodates reads a retrodating map: lines each holding a key and
+// a date in any form reposurgeon reads, separated by whitespace.  Blank
+// lines and lines beginning with # are ignored.
+func readRetrodates(r io.Reader) (map[string]time.Time, error) {
+	mapping := make(map[string]time.Time)
+	scanner := bufio.NewScanner(r)
+	linecount := 0
+	for scanner.Scan() {
+		linecount++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("bad line syntax in date map: line %d %q", linecount, line)
+		}
+		key, text := line[:i], strings.TrimSpace(line[i+1:])
+		date, err := newDate(text)
+		if err != nil {
+			return nil, fmt.Errorf("bad date %q in date map: line %d", text, linecount)
+		}
+		mapping[key] = date.timestamp
+	}
+	return mapping, scanner.Err()
+}
+
+// retrodates matches the keys of a retrodating map to the selected
+// commits.  A key that is a commit's legacy ID gives that commit its
+// date.  Otherwise a key is a path, and a commit modifying it takes
+// its date; a commit modifying several such paths takes the latest,
+// since it can't be older than the newest file it brought in.  Returns
+// the dates for the commits matched and the keys that matched none.
+func (repo *Repository) retrodates(selection selectionSet, mapping map[string]time.Time) (map[*Commit]time.Time, []string) {
+	dates := make(map[*Commit]time.Time)
+	used := make(map[string]bool)
+	for _, commit := range repo.commits(selection) {
+		if when, ok := mapping[commit.legacyID]; ok && commit.legacyID != "" {
+			dates[commit] = when
+			used[commit.legacyID] = true
+			continue
+		}
+		for _, fileop := range commit.operations() {
+			if fileop.op != opM {
+				continue
+			}
+			if when, ok := mapping[fileop.Path]; ok {
+				used[fileop.Path] = true
+				if latest, seen := dates[commit]; !seen || when.After(latest) {
+					dates[commit] = when
+				}
+			}
+		}
+	}
+	unused := make([]string, 0)
+	for key := range mapping {
+		if !used[key] {
+			unused = append(unused, key)
+		}
+	}
+	sort.Strings(unused)
+	return dates, unused
+}
+
+// inversion is a commit dated before one of its parents.
+type inversion struct {
+	child, parent *Commit
+}
+
+// inversions lists the commits of the repository committed before a
+// parent was.
+func (repo *Repository) inversions() map[inversion]bool {
+	found := make(map[inversion]bool)
+	for _, commit := range repo.commits(undefinedSelectionSet) {
+		for _, p := range commit.parents() {
+			if parent, ok := p.(*Commit); ok && commit.committer.date.Before(parent.committer.date) {
+				found[inversion{commit, parent}] = true
+			}
+		}
+	}
+	return found
+}
+
+// timeshift rewrites the dates of the commits and tags in a selection.
+// In "offset" mode every date is moved by the offset.  In "clamp" mode
+// commits are bumped a second at a time until no two share the date
+// their action stamps are made from.  In "localize" mode each date is
+// expressed in zone, or if zone is nil in the zone of its email
+// address as known from the authors file, the stream, or the address's
+// country domain; the instant is not changed.  In "retrodate" mode the
+// committer and author dates of each commit in dates are replaced with
+// its date there.  Event order is never changed.  Returns the number
+// of events changed and the parent and child pairs the change puts out
+// of order, in event order.  With dryrun, nothing is changed.
+func (repo *Repository) timeshift(selection selectionSet, mode string, offset time.Duration, zone *time.Location,
+	dates map[*Commit]time.Time, dryrun bool) (int, []inversion) {
+	before := repo.inversions()
+	saved := make(map[*Date]time.Time)
+	save := func(date *Date) {
+		if _, ok := saved[date]; !ok {
+			saved[date] = date.timestamp
+		}
+	}
+	zoneOf := func(email string, when time.Time) *time.Location {
+		if zone != nil {
+			return zone
+		}
+		// A zero offset usually means the source recorded no zone
+		if loc, ok := repo.tzmap[email]; ok {
+			if _, offset := when.In(loc).Zone(); offset != 0 {
+				return loc
+			}
+		}
+		if name := zoneFromEmail(email); name != "" {
+			if loc, err := time.LoadLocation(name); err == nil {
+				return loc
+			}
+		}
+		return nil
+	}
+	shift := func(attr *Attribution) {
+		save(&attr.date)
+		switch mode {
+		case "offset":
+			attr.date.timestamp = attr.date.timestamp.Add(offset)
+		case "localize":
+			if loc := zoneOf(attr.email, attr.date.timestamp); loc != nil {
+				attr.date.timestamp = attr.date.timestamp.In(loc)
+			}
+		}
+	}
+	changed := func(dates ...*Date) bool {
+		for _, date := range dates {
+			if old := saved[date]; !old.Equal(date.timestamp) || old.Format("-0700") != date.timestamp.Format("-0700") {
+				return true
+			}
+		}
+		return false
+	}
+	count := 0
+	stamps := make(map[int64]bool)
+	repo.clearColor(colorQSET)
+	for it := selection.Iterator(); it.Next(); {
+		switch e := repo.events[it.Value()].(type) {
+		case *Commit:
+			commitDates := []*Date{&e.committer.date}
+			for i := range e.authors {
+				commitDates = append(commitDates, &e.authors[i].date)
+			}
+			if mode == "clamp" {
+				for _, date := range commitDates {
+					save(date)
+				}
+				for stamps[e.stampDate().Unix()] {
+					e.bump(1)
+				}
+				stamps[e.stampDate().Unix()] = true
+			} else if mode == "retrodate" {
+				if when, ok := dates[e]; ok {
+					for _, date := range commitDates {
+						save(date)
+						date.timestamp = when
+					}
+				}
+			} else {
+				shift(&e.committer)
+				for i := range e.authors {
+					shift(&e.authors[i])
+				}
+			}
+			if changed(commitDates...) {
+				e.hash.invalidate()
+				e.addColor(colorQSET)
+				count++
+			}
+		case *Tag:
+			if mode != "clamp" && mode != "retrodate" && e.tagger.isValid() {
+				shift(&e.tagger)
+				if changed(&e.tagger.date) {
+					e.hash.invalidate()
+					e.addColor(colorQSET)
+					count++
+				}
+			}
+		}
+	}
+	after := repo.inversions()
+	inverted := make([]inversion, 0)
+	for _, commit := range repo.commits(undefinedSelectionSet) {
+		for _, p := range commit.parents() {
+			if parent, ok := p.(*Commit); ok {
+				if pair := (inversion{commit, parent}); after[pair] && !before[pair] {
+					inverted = append(inverted, pair)
+				}
+			}
+		}
+	}
+	if dryrun {
+		for date, timestamp := range saved {
+			date.timestamp = timestamp
+		}
+	}
+	return count, inverted
+}
+
+// end
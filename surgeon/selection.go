@@ -20,20 +20,40 @@ import (
 	"strings"
 	"unicode"
 	"unicode/utf8"
-
-	orderedset "github.com/emirpasic/gods/sets/linkedhashset"
 )
 
-type selectionSet struct{ set *orderedset.Set }
+// A selection set keeps its members in the order they were added,
+// which is not always event order.  Sets are often a handful of events
+// and often the whole repository, and the whole-repository ones get
+// Contains() called on them once per member of another set, so the
+// representation is a hybrid: a slice of members, searched by
+// bisection while it stays in ascending order, as selections mostly
+// are; a small unordered set is scanned, and a large one is given a
+// hash index from members to their positions.
+
+// hashThreshold is the size above which an unordered set is indexed.
+const hashThreshold = 32
+
+// indexSet is the representation of a selection set.
+type indexSet struct {
+	values []int
+	sorted bool        // values are ascending
+	index  map[int]int // member to position, for large unordered sets
+}
+
+type selectionSet struct{ set *indexSet }
 
-type selectionSetIt struct{ orderedset.Iterator }
+type selectionSetIt struct {
+	set *indexSet
+	i   int
+}
 
 func newSelectionSet(x ...int) selectionSet {
-	s := orderedset.New()
+	s := selectionSet{&indexSet{sorted: true}}
 	for _, i := range x {
 		s.Add(i)
 	}
-	return selectionSet{s}
+	return s
 }
 
 func (s selectionSet) isDefined() bool {
@@ -42,37 +62,76 @@ func (s selectionSet) isDefined() bool {
 
 var undefinedSelectionSet selectionSet // Do not add to this, havoc would ensue
 
-func (s selectionSet) Fetch(idx int) int {
-	it := s.set.Iterator()
-	for it.Next() {
-		if idx == 0 {
-			break
+// position returns the position of a member in the set, or -1.
+func (set *indexSet) position(x int) int {
+	if set.sorted {
+		if i := sort.SearchInts(set.values, x); i < len(set.values) && set.values[i] == x {
+			return i
+		}
+		return -1
+	}
+	if set.index != nil {
+		if i, ok := set.index[x]; ok {
+			return i
 		}
-		idx--
+		return -1
 	}
-	return it.Value().(int)
+	for i, v := range set.values {
+		if v == x {
+			return i
+		}
+	}
+	return -1
+}
+
+// reindex builds the hash index of a set if it needs one.
+func (set *indexSet) reindex() {
+	set.index = nil
+	if set.sorted || len(set.values) <= hashThreshold {
+		return
+	}
+	set.index = make(map[int]int, len(set.values))
+	for i, v := range set.values {
+		set.index[v] = i
+	}
+}
+
+func (s selectionSet) Fetch(idx int) int {
+	return s.set.values[idx]
+}
+
+// Next advances an iterator, returning false when there are no more
+// members.
+func (x *selectionSetIt) Next() bool {
+	x.i++
+	return x.i < len(x.set.values)
 }
 
+// Index returns the position of the current member.
+func (x *selectionSetIt) Index() int {
+	return x.i
+}
+
+// Value returns the current member.
 func (x *selectionSetIt) Value() int {
-	return x.Iterator.Value().(int)
+	return x.set.values[x.i]
 }
 
 func (s selectionSet) Size() int {
 	if s.set == nil {
 		return 0
 	}
-	return s.set.Size()
+	return len(s.set.values)
 }
 
 func (s selectionSet) Iterator() selectionSetIt {
-	return selectionSetIt{Iterator: s.set.Iterator()}
+	return selectionSetIt{set: s.set, i: -1}
 }
 
 func (s selectionSet) Values() []int {
 	v := make([]int, s.Size())
-	it := s.Iterator()
-	for it.Next() {
-		v[it.Index()] = it.Value()
+	if s.set != nil {
+		copy(v, s.set.values)
 	}
 	return v
 }
@@ -87,52 +146,76 @@ func (s selectionSet) Clone() selectionSet {
 }
 
 func (s selectionSet) Contains(x int) bool {
-	return s.set != nil && s.set.Contains(x)
+	return s.set != nil && s.set.position(x) >= 0
 }
 
 func (s *selectionSet) Remove(x int) bool {
-	if s.Contains(x) {
-		s.set.Remove(x)
-		return true
+	if s.set == nil {
+		return false
 	}
-	return false
+	set := s.set
+	i := set.position(x)
+	if i < 0 {
+		return false
+	}
+	set.values = append(set.values[:i], set.values[i+1:]...)
+	if set.index != nil {
+		delete(set.index, x)
+		for j := i; j < len(set.values); j++ {
+			set.index[set.values[j]] = j
+		}
+	}
+	return true
 }
 
 func (s *selectionSet) Add(x int) {
 	if s.set == nil {
-		s.set = orderedset.New(x)
+		s.set = &indexSet{sorted: true}
+	}
+	set := s.set
+	if set.position(x) >= 0 {
 		return
 	}
-	s.set.Add(x)
+	set.values = append(set.values, x)
+	n := len(set.values)
+	if set.sorted && n > 1 && set.values[n-2] > x {
+		set.sorted = false
+		set.reindex()
+	} else if set.index != nil {
+		set.index[x] = n - 1
+	} else if !set.sorted && n == hashThreshold+1 {
+		set.reindex()
+	}
 }
 
 func (s selectionSet) Subtract(other selectionSet) selectionSet {
-	p := orderedset.New()
-	it := s.set.Iterator()
+	p := newSelectionSet()
+	it := s.Iterator()
 	for it.Next() {
-		if !other.set.Contains(it.Value()) {
+		if !other.Contains(it.Value()) {
 			p.Add(it.Value())
 		}
 	}
-
-	return selectionSet{p}
+	return p
 }
 
 func (s selectionSet) Intersection(other selectionSet) selectionSet {
-	p := orderedset.New()
-	it := s.set.Iterator()
+	p := newSelectionSet()
+	it := s.Iterator()
 	for it.Next() {
-		if other.set.Contains(it.Value()) {
+		if other.Contains(it.Value()) {
 			p.Add(it.Value())
 		}
 	}
-	return selectionSet{p}
+	return p
 }
 
 func (s selectionSet) Union(other selectionSet) selectionSet {
-	p := orderedset.New(s.set.Values()...)
-	p.Add(other.set.Values()...)
-	return selectionSet{p}
+	p := newSelectionSet(s.set.values...)
+	for _, v := range other.set.values {
+		p.Add(v)
+	}
+	return p
 }
 
 func (s selectionSet) EqualWithOrdering(other selectionSet) bool {
@@ -150,6 +233,9 @@ func (s selectionSet) EqualWithOrdering(other selectionSet) bool {
 }
 
 func (s selectionSet) Min() int {
+	if s.set != nil && s.set.sorted && len(s.set.values) > 0 {
+		return s.set.values[0]
+	}
 	var min = math.MaxInt32
 	for it := s.Iterator(); it.Next(); {
 		v := it.Value()
@@ -160,15 +246,29 @@ func (s selectionSet) Min() int {
 	return min
 }
 
+func (s selectionSet) Max() int {
+	if s.set != nil && s.set.sorted && len(s.set.values) > 0 {
+		return s.set.values[len(s.set.values)-1]
+	}
+	var max = -1
+	for it := s.Iterator(); it.Next(); {
+		v := it.Value()
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
+
 func (s *selectionSet) Sort() {
-	v := s.set.Values()
-	sort.Slice(v, func(i, j int) bool { return v[i].(int) < v[j].(int) })
-	s.set = orderedset.New(v...)
+	sort.Ints(s.set.values)
+	s.set.sorted = true
+	s.set.index = nil
 }
 
 func (s *selectionSet) Pop() int {
-	x := (*s).Values()[(*s).Size()-1]
-	(*s).Remove(x)
+	x := s.set.values[len(s.set.values)-1]
+	s.Remove(x)
 	return x
 }
 
@@ -234,7 +334,8 @@ var unclean = regexp.MustCompile("^[^\n]*\n[^\n]|^.{51,}\n|\n.{73,}")
 func (rs *Reposurgeon) parseSelectionSet(line string) (machine selEvaluator, rest string) {
 	s := strings.TrimLeft(line, " \t")
 	i := strings.IndexAny(s, " \t")
-	if i > 0 && rs.isNamed(s[:i]) {
+	// A bare mark stays a mark even if it is also an old one
+	if i > 0 && !markRE.MatchString(s[:i]) && rs.isNamed(s[:i]) {
 		line = "<" + s[:i] + ">" + s[i:]
 	}
 
@@ -776,6 +877,58 @@ func (rs *Reposurgeon) evalTextSearch(state selEvalState,
 	return matchers
 }
 
+// Commit metrics for selection by comparison.  None of them needs a
+// manifest or blob content.
+var selMetrics = map[string]func(*Commit) int64{
+	"ops":     func(c *Commit) int64 { return int64(len(c.operations())) },
+	"parents": func(c *Commit) int64 { return int64(c.parentCount()) },
+	"bytes": func(c *Commit) int64 {
+		var total int64
+		for _, op := range c.operations() {
+			if op.op != opM {
+				continue
+			}
+			if op.ref == "inline" {
+				total += int64(len(op.inline))
+			} else if blob, ok := c.repo.markToEvent(op.ref).(*Blob); ok {
+				total += blob.size
+			}
+		}
+		return total
+	},
+}
+
+// Select the commits whose metric compares as given with a number.
+func (rs *Reposurgeon) evalMetric(state selEvalState,
+	preselection selectionSet, metric string, cmp string, n int64) selectionSet {
+	measure, ok := selMetrics[metric]
+	if !ok {
+		panic(throw("command", "no such metric %q", metric))
+	}
+	compare := map[string]func(int64) bool{
+		"<":  func(v int64) bool { return v < n },
+		"<=": func(v int64) bool { return v <= n },
+		"=":  func(v int64) bool { return v == n },
+		"!=": func(v int64) bool { return v != n },
+		">=": func(v int64) bool { return v >= n },
+		">":  func(v int64) bool { return v > n },
+	}[cmp]
+	matchers := newSelectionSet()
+	events := rs.chosen().events
+	for it := preselection.Iterator(); it.Next(); {
+		if commit, ok := events[it.Value()].(*Commit); ok && compare(measure(commit)) {
+			matchers.Add(it.Value())
+		}
+	}
+	return matchers
+}
+
+// Select the events for which an event expression is true.
+func (rs *Reposurgeon) evalPredicate(state selEvalState,
+	preselection selectionSet, predicate exprNode) selectionSet {
+	return rs.chosen().exprSelect(preselection, predicate)
+}
+
 func (rs *Reposurgeon) functions() map[string]selEvaluator {
 	return map[string]selEvaluator{
 		"chn": func(state selEvalState, subarg selectionSet) selectionSet {
@@ -790,6 +943,9 @@ func (rs *Reposurgeon) functions() map[string]selEvaluator {
 		"anc": func(state selEvalState, subarg selectionSet) selectionSet {
 			return rs.ancHandler(state, subarg)
 		},
+		"eqv": func(state selEvalState, subarg selectionSet) selectionSet {
+			return rs.eqvHandler(state, subarg)
+		},
 	}
 }
 
@@ -801,8 +957,7 @@ func (rs *Reposurgeon) chnHandler(state selEvalState, subarg selectionSet) selec
 
 // All descendants of a selection set, recursively.
 func (rs *Reposurgeon) dscHandler(state selEvalState, subarg selectionSet) selectionSet {
-	return rs.accumulateCommits(subarg,
-		func(c *Commit) []CommitLike { return c.children() }, true)
+	return rs.chosen().reachable(subarg, reachDescendants)
 }
 
 // All parents of a selection set.
@@ -813,8 +968,25 @@ func (rs *Reposurgeon) parHandler(state selEvalState, subarg selectionSet) selec
 
 // All ancestors of a selection set, recursively.
 func (rs *Reposurgeon) ancHandler(state selEvalState, subarg selectionSet) selectionSet {
-	return rs.accumulateCommits(subarg,
-		func(c *Commit) []CommitLike { return c.parents() }, true)
+	return rs.chosen().reachable(subarg, reachAncestors)
+}
+
+// All commits equivalent to some commit in the selection set.
+func (rs *Reposurgeon) eqvHandler(state selEvalState, subarg selectionSet) selectionSet {
+	repo := rs.chosen()
+	targets := repo.commits(subarg)
+	hits := newSelectionSet()
+	for i, event := range repo.events {
+		if commit, ok := event.(*Commit); ok {
+			for _, target := range targets {
+				if commit.equivalent(target) {
+					hits.Add(i)
+					break
+				}
+			}
+		}
+	}
+	return hits
 }
 
 type selEvalState interface {
@@ -844,6 +1016,7 @@ type selParser interface {
 	evalPolyrange(selEvalState, selectionSet, []selEvaluator) selectionSet
 	parseAtom() selEvaluator
 	parseTextSearch() selEvaluator
+	parseMetric() selEvaluator
 	parseFuncall() selEvaluator
 }
 
@@ -1048,7 +1221,10 @@ func (p *SelectionParser) parseTerm() selEvaluator {
 			if term == nil {
 				term = p.imp().parseTextSearch()
 				if term == nil {
-					term = p.imp().parseFuncall()
+					term = p.imp().parseMetric()
+					if term == nil {
+						term = p.imp().parseFuncall()
+					}
 				}
 			}
 		}
@@ -1292,6 +1468,38 @@ func (p *SelectionParser) parseTextSearch() selEvaluator {
 	}
 }
 
+var metricRE = regexp.MustCompile(`^\{([a-z]+)(<=|>=|!=|<|>|=)([0-9]+)\}`)
+
+// parseMetric parses a comparison of a structural metric with a number,
+// or failing that an event expression, in braces
+func (p *SelectionParser) parseMetric() selEvaluator {
+	p.eatWS()
+	type metricSearcher interface {
+		evalMetric(selEvalState, selectionSet, string, string, int64) selectionSet
+		evalPredicate(selEvalState, selectionSet, exprNode) selectionSet
+	}
+	searcher, ok := p.subclass.(metricSearcher)
+	if !ok || p.peek() != '{' {
+		return nil
+	}
+	m := metricRE.FindStringSubmatch(p.line)
+	if m == nil {
+		var predicate exprNode
+		predicate, p.line = compileBracedExpr(p.line)
+		return func(x selEvalState, s selectionSet) selectionSet {
+			return searcher.evalPredicate(x, s, predicate)
+		}
+	}
+	n, err := strconv.ParseInt(m[3], 10, 64)
+	if err != nil {
+		panic(throw("command", "bad number in metric comparison: %v", err))
+	}
+	p.line = p.line[len(m[0]):]
+	return func(x selEvalState, s selectionSet) selectionSet {
+		return searcher.evalMetric(x, s, m[1], m[2], n)
+	}
+}
+
 // parseFuncall parses a function call
 func (p *SelectionParser) parseFuncall() selEvaluator {
 	p.eatWS()
@@ -0,0 +1,201 @@
+/*
+ * Read-only query server
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A conversion is often reviewed while it is still being done: someone
+// looks over the DAG in a dashboard, a converter checks what a commit
+// will turn into, while the person doing the surgery keeps the session
+// open.  Writing the repository out for them after every change is
+// slow, and a stream is no help to a tool that wants to ask one
+// question.  So a session can answer questions about a repository on a
+// Unix socket, with the interpreter's own selection language.
+//
+// The protocol is a line per request and a line of JSON per reply.  A
+// request is a verb and its argument:
+//
+//	select SELECTION     the 1-origin numbers of the events selected
+//	metadata SELECTION   the events selected, as jsonout shows them
+//	manifest LOCATION    the files in the tree of one commit
+//
+// A reply is {"ok":true,"result":...} or {"ok":false,"error":"..."}.
+// Nothing a query does alters the repository.  Queries and commands
+// take turns: the interpreter holds the session lock from the start of
+// a command to its end, so a query never sees surgery half done, and
+// queries are answered one at a time between commands.
+
+// queryServer answers queries about one repository on a Unix socket.
+type queryServer struct {
+	rs       *Reposurgeon
+	name     string // Name of the repository served
+	path     string
+	listener net.Listener
+	conns    map[net.Conn]bool
+	lock     sync.Mutex // Guards conns
+}
+
+// queryReply is the JSON form of an answer.
+type queryReply struct {
+	OK     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+// queryFile is a file in a manifest reply.
+type queryFile struct {
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+	Ref  string `json:"ref"`
+}
+
+// startServer begins answering queries about a repository on a socket
+// at path.
+func (rs *Reposurgeon) startServer(repo *Repository, path string) (*queryServer, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(path, 0600)
+	server := &queryServer{rs: rs, name: repo.name, path: path, listener: listener,
+		conns: make(map[net.Conn]bool)}
+	go server.accept()
+	return server, nil
+}
+
+// accept hands each connection to a goroutine of its own until the
+// listener is closed.
+func (server *queryServer) accept() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.lock.Lock()
+		server.conns[conn] = true
+		server.lock.Unlock()
+		go server.converse(conn)
+	}
+}
+
+// converse answers the requests on one connection until the client
+// closes it or the server stops.
+func (server *queryServer) converse(conn net.Conn) {
+	defer func() {
+		server.lock.Lock()
+		delete(server.conns, conn)
+		server.lock.Unlock()
+		conn.Close()
+	}()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), 1<<20)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		request := strings.TrimSpace(scanner.Text())
+		if request == "" {
+			continue
+		}
+		if err := encoder.Encode(server.answer(request)); err != nil {
+			return
+		}
+	}
+}
+
+// answer evaluates one request with the interpreter locked out.
+func (server *queryServer) answer(request string) (reply queryReply) {
+	rs := server.rs
+	rs.interlock.Lock()
+	defer rs.interlock.Unlock()
+	chosen := rs.repo
+	defer func() {
+		rs.repo = chosen
+		if e := catch("command", recover()); e != nil {
+			reply = queryReply{Error: e.message}
+		}
+	}()
+	rs.repo = rs.repoByName(server.name)
+	verb, arg := request, ""
+	if i := strings.IndexAny(request, " \t"); i >= 0 {
+		verb, arg = request[:i], strings.TrimSpace(request[i+1:])
+	}
+	if arg == "" {
+		return queryReply{Error: fmt.Sprintf("%s needs an argument", verb)}
+	}
+	var result interface{}
+	switch verb {
+	case "select":
+		indices := make([]int, 0)
+		for it := server.evaluate(arg).Iterator(); it.Next(); {
+			indices = append(indices, it.Value()+1)
+		}
+		result = indices
+	case "metadata":
+		events := make([]*jsonEvent, 0)
+		repo := rs.chosen()
+		repo.identifyEvents()
+		for it := server.evaluate(arg).Iterator(); it.Next(); {
+			if out := repo.jsonify(it.Value(), repo.events[it.Value()]); out != nil {
+				events = append(events, out)
+			}
+		}
+		result = events
+	case "manifest":
+		selection := server.evaluate(arg)
+		if selection.Size() != 1 {
+			return queryReply{Error: "manifest needs a single commit"}
+		}
+		commit, ok := rs.chosen().events[selection.Fetch(0)].(*Commit)
+		if !ok {
+			return queryReply{Error: "manifest needs a single commit"}
+		}
+		manifest := commit.manifest()
+		paths := manifest.pathnames()
+		sort.Strings(paths)
+		files := make([]queryFile, 0, len(paths))
+		for _, path := range paths {
+			v, _ := manifest.get(path)
+			fileop := v.(*FileOp)
+			files = append(files, queryFile{path, fileop.mode, fileop.ref})
+		}
+		result = files
+	default:
+		return queryReply{Error: fmt.Sprintf("unknown request %q", verb)}
+	}
+	return queryReply{OK: true, Result: result}
+}
+
+// evaluate resolves a selection in the repository served.
+func (server *queryServer) evaluate(text string) selectionSet {
+	machine, rest := server.rs.parseSelectionSet(text)
+	if machine == nil || strings.TrimSpace(rest) != "" {
+		panic(throw("command", "malformed selection %q", text))
+	}
+	return server.rs.evalSelectionSet(machine, server.rs.chosen())
+}
+
+// stop closes the socket and every connection.  A query already
+// waiting for the session lock is still answered, into the void.
+func (server *queryServer) stop() {
+	server.listener.Close()
+	server.lock.Lock()
+	for conn := range server.conns {
+		conn.Close()
+	}
+	server.lock.Unlock()
+}
+
+// end
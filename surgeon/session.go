@@ -0,0 +1,503 @@
+/*
+ * Saving and restoring the in-memory state of a repository
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Surgery on a multi-gigabyte repository can take hours, and a crash
+// or a mistaken command late in the session throws all of it away.  A
+// session file records everything needed to put the repository back
+// as it was: the events with their marks, parent links and fileops,
+// the legacy map, named selections, and where each blob's content is.
+//
+// Blob content is not copied.  A blob still backed by a span of the
+// stream it was read from is recorded by offset and length, and the
+// restore reopens the stream; the stream's size is recorded too, so a
+// file changed in the meantime is caught.  A blob with its own file in
+// the scratch directory gets a hard link to that file in a directory
+// beside the session file, named after the session file with .blobs
+// added, because scratch directories don't outlive the process that
+// made them.  The restore links those files into the new repository's
+// scratch directory.
+//
+// The session file itself is a gzipped gob of the types below.  Caches
+// that are rebuilt on demand aren't saved, nor is anything that belongs
+// to the interpreter rather than the repository.
+
+const sessionMagic = "reposurgeon session"
+const sessionVersion = 1
+
+type sessionAttribution struct {
+	Name  string
+	Email string
+	Date  time.Time
+}
+
+func newSessionAttribution(attr *Attribution) sessionAttribution {
+	return sessionAttribution{attr.fullname, attr.email, attr.date.timestamp}
+}
+
+func (sa sessionAttribution) attribution() Attribution {
+	return Attribution{fullname: sa.Name, email: sa.Email, date: Date{timestamp: sa.Date}}
+}
+
+type sessionFileOp struct {
+	Op         byte
+	Mode       string
+	Path       string
+	Source     string
+	Ref        string
+	Committish string
+	Inline     []byte
+}
+
+// sessionEvent holds any event; Kind says which fields are meaningful.
+type sessionEvent struct {
+	Kind       byte // 'b'lob, 'c'ommit, 't'ag, 'r'eset, 'p'assthrough, call'o'ut
+	UUID       string
+	Mark       string
+	Name       string // Branch, tag name, reset ref, or passthrough text
+	Target     string // Tag or reset committish
+	Comment    string
+	LegacyID   string
+	Hash       gitHashType
+	Committer  sessionAttribution
+	Authors    []sessionAttribution
+	Parents    []string
+	Implicit   bool
+	FileOps    []sessionFileOp
+	PropKeys   []string
+	PropValues []string
+	Recorded   *[3]gitHashType // original-oid, parent and metadata digests
+	// Blobs only
+	Start      int64
+	Size       int64
+	OID        gitHashType
+	CookiePath string
+	CookieRev  string
+}
+
+// sessionImage is the whole content of a session file.
+type sessionImage struct {
+	Magic       string
+	Version     int
+	Name        string
+	Readtime    time.Time
+	VCS         string
+	Preferred   string
+	Stronghint  bool
+	Sourcedir   string
+	Seekstream  string // Absolute path of the stream blobs refer into
+	StreamSize  int64
+	Codec       string // Codec blob files are compressed with, if any
+	UUID        string
+	WriteLegacy bool
+	Preserve    []string
+	LegacyMap   map[string]int // Cookie to event index
+	LegacyCount int
+	Assignments map[string][]int
+	Inlines     int
+	Markseq     int
+	MarkAliases map[string]string
+	EventSeed   string
+	EventSeq    int
+	Overrides   []sessionOverride
+	Events      []sessionEvent
+}
+
+// sessionOverride is a topology override, by event index.
+type sessionOverride struct {
+	Commit  int
+	Parents []int
+	Origin  string
+}
+
+// sessionBlobDir is where a session file keeps links to blob files.
+func sessionBlobDir(filename string) string {
+	return filename + ".blobs"
+}
+
+// linkOrCopy makes dst a hard link to src, falling back to a copy when
+// the two are on different filesystems.
+func linkOrCopy(src string, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(filepath.Clean(src))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(filepath.Clean(dst), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, userReadWriteMode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// saveSession writes the state of the repository to a session file.
+// Returns the number of blob files linked beside it.
+func (repo *Repository) saveSession(filename string, baton *Baton) (int, error) {
+	image := sessionImage{
+		Magic:       sessionMagic,
+		Version:     sessionVersion,
+		Name:        repo.name,
+		Readtime:    repo.readtime,
+		Stronghint:  repo.stronghint,
+		Sourcedir:   repo.sourcedir,
+		UUID:        repo.uuid,
+		WriteLegacy: repo.writeLegacy,
+		Preserve:    repo.preserveSet.Clone(),
+		LegacyMap:   make(map[string]int),
+		LegacyCount: repo.legacyCount,
+		Assignments: make(map[string][]int),
+		Inlines:     repo.inlines,
+		Markseq:     repo.markseq,
+		MarkAliases: repo.markAliases,
+		EventSeed:   repo.eventseed,
+		EventSeq:    repo.eventseq,
+		Events:      make([]sessionEvent, len(repo.events)),
+	}
+	if repo.vcs != nil {
+		image.VCS = repo.vcs.name
+	}
+	if codec := activeCodec(); codec != nil {
+		image.Codec = codec.name
+	}
+	if repo.preferred != nil {
+		image.Preferred = repo.preferred.name
+	}
+	if repo.seekstream != nil {
+		path, err := filepath.Abs(repo.seekstream.Name())
+		if err != nil {
+			return 0, err
+		}
+		image.Seekstream = path
+		image.StreamSize = getsize(path)
+	}
+	for cookie, commit := range repo.legacyMap {
+		if i := repo.eventToIndex(commit); i >= 0 {
+			image.LegacyMap[cookie] = i
+		}
+	}
+	for name, selection := range repo.assignments {
+		image.Assignments[name] = selection.Values()
+	}
+	for _, g := range repo.liveOverrides() {
+		so := sessionOverride{Commit: repo.eventToIndex(g.commit), Origin: g.origin}
+		for _, parent := range g.parents {
+			so.Parents = append(so.Parents, repo.eventToIndex(parent))
+		}
+		image.Overrides = append(image.Overrides, so)
+	}
+	blobdir := sessionBlobDir(filename)
+	if err := os.RemoveAll(blobdir); err != nil {
+		return 0, err
+	}
+	linked := 0
+	baton.startProgress("saving session", uint64(len(repo.events)))
+	defer baton.endProgress()
+	for i, event := range repo.events {
+		baton.percentProgress(uint64(i) + 1)
+		se := &image.Events[i]
+		se.UUID = event.getUUID()
+		switch e := event.(type) {
+		case *Blob:
+			se.Kind = 'b'
+			se.Mark = e.mark
+			se.Hash = e.hash
+			se.OID = e.oid
+			se.Size = e.size
+			se.Start = noOffset
+			if e.cookie != nil {
+				se.CookiePath, se.CookieRev = e.cookie.path, e.cookie.rev
+			}
+			if !e.hasfile() {
+				se.Start = e.start
+				continue
+			}
+			if linked == 0 {
+				if err := os.MkdirAll(blobdir, userReadWriteSearchMode); err != nil {
+					return linked, err
+				}
+			}
+			if err := linkOrCopy(e.getBlobfile(false), filepath.Join(blobdir, fmt.Sprintf("%d", i))); err != nil {
+				return linked, err
+			}
+			linked++
+		case *Commit:
+			se.Kind = 'c'
+			se.Mark = e.mark
+			se.Name = e.Branch
+			se.Comment = e.Comment
+			se.LegacyID = e.legacyID
+			se.Hash = e.hash
+			se.Committer = newSessionAttribution(&e.committer)
+			for j := range e.authors {
+				se.Authors = append(se.Authors, newSessionAttribution(&e.authors[j]))
+			}
+			se.Parents = e.parentMarks()
+			se.Implicit = e.implicitParent
+			for _, op := range e.operations() {
+				se.FileOps = append(se.FileOps, sessionFileOp{
+					Op: byte(op.op), Mode: op.mode, Path: op.Path, Source: op.Source,
+					Ref: op.ref, Committish: op.committish, Inline: op.inline,
+				})
+			}
+			if e.properties != nil {
+				for _, key := range e.properties.keys {
+					se.PropKeys = append(se.PropKeys, key)
+					se.PropValues = append(se.PropValues, e.properties.get(key))
+				}
+			}
+			if e.recorded != nil {
+				se.Recorded = &[3]gitHashType{e.recorded.oid, e.recorded.parents, e.recorded.metadata}
+			}
+		case *Tag:
+			se.Kind = 't'
+			se.Name = e.tagname
+			se.Target = e.committish
+			se.Comment = e.Comment
+			se.LegacyID = e.legacyID
+			se.Hash = e.hash
+			se.Committer = newSessionAttribution(&e.tagger)
+		case *Reset:
+			se.Kind = 'r'
+			se.Name = e.ref
+			se.Target = e.committish
+			se.LegacyID = e.legacyID
+		case *Passthrough:
+			se.Kind = 'p'
+			se.Name = e.text
+		case *Callout:
+			se.Kind = 'o'
+			se.Mark = e.mark
+			se.Name = e.branch
+		default:
+			return linked, fmt.Errorf("can't save event %s", event.idMe())
+		}
+	}
+	// Write under a temporary name, so an interrupted save doesn't
+	// destroy an earlier session file.
+	tmp := filename + ".tmp"
+	fp, err := os.OpenFile(filepath.Clean(tmp), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, userReadWriteMode)
+	if err != nil {
+		return linked, err
+	}
+	zw := gzip.NewWriter(fp)
+	err = gob.NewEncoder(zw).Encode(&image)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return linked, err
+	}
+	return linked, os.Rename(tmp, filename)
+}
+
+// restoreSession makes a repository from a session file.  It gets the
+// name the repository had when saved unless a name is given; taken
+// lists names that can't be used.
+func restoreSession(filename string, name string, taken orderedStringSet, baton *Baton) (*Repository, error) {
+	fp, err := os.Open(filepath.Clean(filename))
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	zr, err := gzip.NewReader(fp)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a session file", filename)
+	}
+	var image sessionImage
+	if err = gob.NewDecoder(zr).Decode(&image); err != nil || image.Magic != sessionMagic {
+		return nil, fmt.Errorf("%s is not a session file", filename)
+	}
+	if image.Version != sessionVersion {
+		return nil, fmt.Errorf("%s has session format version %d, expected %d", filename, image.Version, sessionVersion)
+	}
+	codec := ""
+	if active := activeCodec(); active != nil {
+		codec = active.name
+	}
+	if image.Codec != codec {
+		return nil, errors.New("blob compression must be set as it was when the session was saved")
+	}
+
+	if name == "" {
+		name = image.Name
+	}
+	if taken.Contains(name) {
+		return nil, fmt.Errorf("there is already a repo named %s", name)
+	}
+	repo := newRepository(name)
+	repo.readtime = image.Readtime
+	if image.VCS != "" {
+		repo.vcs = findVCS(image.VCS)
+	}
+	if image.Preferred != "" {
+		repo.preferred = findVCS(image.Preferred)
+	}
+	repo.stronghint = image.Stronghint
+	repo.sourcedir = image.Sourcedir
+	repo.uuid = image.UUID
+	repo.writeLegacy = image.WriteLegacy
+	repo.preserveSet = newOrderedStringSet(image.Preserve...)
+	repo.legacyCount = image.LegacyCount
+	repo.inlines = image.Inlines
+	repo.markseq = image.Markseq
+	repo.markAliases = image.MarkAliases
+	repo.eventseed = image.EventSeed
+	repo.eventseq = image.EventSeq
+	if image.Seekstream != "" {
+		if getsize(image.Seekstream) != image.StreamSize {
+			return nil, fmt.Errorf("stream %s has changed since the session was saved", image.Seekstream)
+		}
+		if repo.seekstream, err = os.Open(image.Seekstream); err != nil {
+			return nil, err
+		}
+	}
+
+	failed := true
+	defer func() {
+		if failed {
+			repo.cleanup()
+		}
+	}()
+	blobdir := sessionBlobDir(filename)
+	baton.startProgress("restoring session", uint64(len(image.Events)))
+	defer baton.endProgress()
+	for i := range image.Events {
+		baton.percentProgress(uint64(i) + 1)
+		se := &image.Events[i]
+		switch se.Kind {
+		case 'b':
+			blob := newBlob(repo)
+			blob.mark = se.Mark
+			blob.hash = se.Hash
+			blob.oid = se.OID
+			blob.size = se.Size
+			if se.CookiePath != "" || se.CookieRev != "" {
+				blob.cookie = &Cookie{path: se.CookiePath, rev: se.CookieRev}
+			}
+			blob.start = se.Start
+			blob.uuid = se.UUID
+			if blob.hasfile() {
+				if err = linkOrCopy(filepath.Join(blobdir, fmt.Sprintf("%d", i)), blob.getBlobfile(true)); err != nil {
+					return nil, err
+				}
+			}
+			repo.addEvent(blob)
+		case 'c':
+			commit := newCommit(repo)
+			commit.mark = se.Mark
+			commit.Branch = se.Name
+			commit.Comment = se.Comment
+			commit.legacyID = se.LegacyID
+			commit.committer = se.Committer.attribution()
+			for _, author := range se.Authors {
+				commit.authors = append(commit.authors, author.attribution())
+			}
+			for _, sop := range se.FileOps {
+				op := newFileOp(repo)
+				op.op = optype(sop.Op)
+				op.mode, op.Path, op.Source = sop.Mode, sop.Path, sop.Source
+				op.internPaths()
+				op.ref, op.committish, op.inline = sop.Ref, sop.Committish, sop.Inline
+				if (op.op == opM || op.op == opN) && op.ref != "inline" {
+					if blob, ok := repo.markToEvent(op.ref).(*Blob); ok {
+						blob.appendOperation(op)
+					}
+				}
+				commit.fileops = append(commit.fileops, op)
+			}
+			for _, mark := range se.Parents {
+				if isCallout(mark) {
+					commit.addCallout(mark)
+				} else if parent, ok := repo.markToEvent(mark).(*Commit); ok {
+					commit.addParentCommit(parent)
+				} else {
+					return nil, fmt.Errorf("session file refers to missing parent %s", mark)
+				}
+			}
+			commit.implicitParent = se.Implicit
+			if len(se.PropKeys) > 0 {
+				props := newOrderedMap()
+				for j, key := range se.PropKeys {
+					props.set(key, se.PropValues[j])
+				}
+				commit.properties = &props
+			}
+			if se.Recorded != nil {
+				commit.recorded = &oidRecord{se.Recorded[0], se.Recorded[1], se.Recorded[2]}
+			}
+			commit.hash = se.Hash
+			commit.uuid = se.UUID
+			repo.addEvent(commit)
+		case 't':
+			tag := newTag(repo, se.Name, se.Target, se.Comment)
+			tag.tagger = se.Committer.attribution()
+			tag.legacyID = se.LegacyID
+			tag.hash = se.Hash
+			tag.uuid = se.UUID
+			repo.addEvent(tag)
+		case 'r':
+			reset := newReset(repo, se.Name, se.Target, se.LegacyID)
+			reset.uuid = se.UUID
+			repo.addEvent(reset)
+		case 'p':
+			passthrough := newPassthrough(repo, se.Name)
+			passthrough.uuid = se.UUID
+			repo.addEvent(passthrough)
+		case 'o':
+			callout := newCallout(se.Mark)
+			callout.branch = se.Name
+			callout.uuid = se.UUID
+			repo.addEvent(callout)
+		default:
+			return nil, fmt.Errorf("session file has unknown event type %q", se.Kind)
+		}
+	}
+	for cookie, i := range image.LegacyMap {
+		if commit, ok := repo.events[i].(*Commit); ok {
+			repo.legacyMap[cookie] = commit
+		}
+	}
+	for name, indices := range image.Assignments {
+		repo.assignments[name] = newSelectionSet(indices...)
+	}
+	for _, so := range image.Overrides {
+		g := &override{origin: so.Origin}
+		g.commit, _ = repo.events[so.Commit].(*Commit)
+		for _, i := range so.Parents {
+			parent, _ := repo.events[i].(*Commit)
+			g.parents = append(g.parents, parent)
+		}
+		repo.overrides = append(repo.overrides, g)
+	}
+	failed = false
+	return repo, nil
+}
+
+// end
@@ -199,8 +199,9 @@ func (s orderedStringSet) Intersection(other orderedStringSet) orderedStringSet
 }
 
 func (s orderedStringSet) Union(other orderedStringSet) orderedStringSet {
-	var union orderedStringSet
-	union = s[:]
+	// A copy, so appending can't write into the receiver's storage
+	union := make(orderedStringSet, len(s), len(s)+len(other))
+	copy(union, s)
 	for _, item := range other {
 		if !s.Contains(item) {
 			union = append(union, item)
@@ -0,0 +1,248 @@
+/*
+ * Named snapshots of repository structure, for review diffs
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A snapshot is a lightweight record of a repository's structure at
+// some point in a session: for each event, its identity and the
+// metadata fields surgery might change.  Blob content is not copied,
+// and strings are shared with the live events, so snapshots are
+// cheap enough to take freely.  Events are matched between two
+// snapshots by object identity, which survives renumbering, resorts,
+// and changes to every field; an event that was deleted and recreated
+// shows as a deletion plus an addition.
+
+type eventDigest struct {
+	event  Event
+	id     string            // idMe() at the time of capture
+	fields map[string]string // field name to value
+}
+
+type repoSnapshot struct {
+	name    string
+	taken   time.Time
+	digests []eventDigest // in event order
+}
+
+// digestFields are reported in this order.
+var digestFields = []string{"mark", "branch", "ref", "name", "target", "parents",
+	"committer", "authors", "tagger", "legacy-id", "properties", "comment",
+	"size", "fileops", "text"}
+
+func digestEvent(event Event) eventDigest {
+	d := eventDigest{event: event, id: event.idMe(), fields: make(map[string]string)}
+	switch e := event.(type) {
+	case *Blob:
+		d.fields["mark"] = e.mark
+		d.fields["size"] = fmt.Sprintf("%d", e.size)
+	case *Commit:
+		d.fields["mark"] = e.mark
+		d.fields["branch"] = e.Branch
+		d.fields["parents"] = strings.Join(e.parentMarks(), " ")
+		d.fields["committer"] = e.committer.String()
+		authors := make([]string, len(e.authors))
+		for i := range e.authors {
+			authors[i] = e.authors[i].String()
+		}
+		d.fields["authors"] = strings.Join(authors, ", ")
+		d.fields["legacy-id"] = e.legacyID
+		d.fields["comment"] = e.Comment
+		if e.hasProperties() {
+			d.fields["properties"] = e.properties.vcString()
+		}
+		ops := make([]string, 0, len(e.operations()))
+		for _, op := range e.operations() {
+			ops = append(ops, strings.TrimSuffix(op.String(), "\n"))
+		}
+		d.fields["fileops"] = strings.Join(ops, "\n")
+	case *Tag:
+		d.fields["name"] = e.tagname
+		d.fields["target"] = e.committish
+		d.fields["tagger"] = e.tagger.String()
+		d.fields["legacy-id"] = e.legacyID
+		d.fields["comment"] = e.Comment
+	case *Reset:
+		d.fields["ref"] = e.ref
+		d.fields["target"] = e.committish
+	case *Passthrough:
+		d.fields["text"] = e.text
+	}
+	return d
+}
+
+// captureSnapshot records the current structure of the repository.
+func (repo *Repository) captureSnapshot(name string) *repoSnapshot {
+	cp := &repoSnapshot{name: name, taken: time.Now(), digests: make([]eventDigest, len(repo.events))}
+	for i, event := range repo.events {
+		cp.digests[i] = digestEvent(event)
+	}
+	return cp
+}
+
+// takeSnapshot captures a snapshot and keeps it under a name,
+// replacing any snapshot of that name.
+func (repo *Repository) takeSnapshot(name string) *repoSnapshot {
+	cp := repo.captureSnapshot(name)
+	repo.dropSnapshot(name)
+	repo.snapshots = append(repo.snapshots, cp)
+	return cp
+}
+
+func (repo *Repository) findSnapshot(name string) *repoSnapshot {
+	for _, cp := range repo.snapshots {
+		if cp.name == name {
+			return cp
+		}
+	}
+	return nil
+}
+
+func (repo *Repository) dropSnapshot(name string) bool {
+	for i, cp := range repo.snapshots {
+		if cp.name == name {
+			repo.snapshots = append(repo.snapshots[:i], repo.snapshots[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// diffSnapshots writes a structural report of the changes between
+// two snapshots to w: events added, deleted, and modified, with old
+// and new values of each modified field.  Multi-line fields are shown
+// line by line, lines removed with "-" and added with "+".  Returns
+// the count of events reported.
+func diffSnapshots(w io.Writer, before *repoSnapshot, after *repoSnapshot) int {
+	old := make(map[Event]*eventDigest, len(before.digests))
+	for i := range before.digests {
+		old[before.digests[i].event] = &before.digests[i]
+	}
+	present := make(map[Event]bool, len(after.digests))
+	for i := range after.digests {
+		present[after.digests[i].event] = true
+	}
+	added, deleted, modified := 0, 0, 0
+	for i := range before.digests {
+		d := &before.digests[i]
+		if !present[d.event] {
+			fmt.Fprintf(w, "- %s\n", d.id)
+			deleted++
+		}
+	}
+	// Relative order of surviving events, for detecting moves
+	rank := make(map[Event]int)
+	for _, d := range before.digests {
+		if present[d.event] {
+			rank[d.event] = len(rank)
+		}
+	}
+	moved := 0
+	last := -1
+	for i := range after.digests {
+		d := &after.digests[i]
+		was, ok := old[d.event]
+		if !ok {
+			fmt.Fprintf(w, "+ %s\n", d.id)
+			added++
+			continue
+		}
+		if rank[d.event] < last {
+			moved++
+		} else {
+			last = rank[d.event]
+		}
+		changes := make([]string, 0)
+		for _, field := range digestFields {
+			a, b := was.fields[field], d.fields[field]
+			if a == b {
+				continue
+			}
+			if !strings.Contains(a, "\n") && !strings.Contains(b, "\n") && len(a) < 80 && len(b) < 80 {
+				changes = append(changes, fmt.Sprintf("    %s: %q -> %q\n", field, a, b))
+				continue
+			}
+			changes = append(changes, fmt.Sprintf("    %s:\n", field))
+			changes = append(changes, lineDelta(a, b)...)
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		if was.id != d.id {
+			fmt.Fprintf(w, "~ %s (was %s)\n", d.id, was.id)
+		} else {
+			fmt.Fprintf(w, "~ %s\n", d.id)
+		}
+		for _, line := range changes {
+			io.WriteString(w, line)
+		}
+		modified++
+	}
+	fmt.Fprintf(w, "%d added, %d deleted, %d modified", added, deleted, modified)
+	if moved > 0 {
+		fmt.Fprintf(w, ", %d moved", moved)
+	}
+	fmt.Fprintln(w)
+	return added + deleted + modified
+}
+
+// lineDelta reports the lines of a missing from b and of b missing
+// from a, as indented "-" and "+" lines.  Order within each group
+// follows the source; repeated lines are counted.
+func lineDelta(a string, b string) []string {
+	split := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	}
+	al, bl := split(a), split(b)
+	count := make(map[string]int)
+	for _, line := range bl {
+		count[line]++
+	}
+	out := make([]string, 0)
+	for _, line := range al {
+		if count[line] > 0 {
+			count[line]--
+		} else {
+			out = append(out, fmt.Sprintf("    -%s\n", line))
+		}
+	}
+	count = make(map[string]int)
+	for _, line := range al {
+		count[line]++
+	}
+	for _, line := range bl {
+		if count[line] > 0 {
+			count[line]--
+		} else {
+			out = append(out, fmt.Sprintf("    +%s\n", line))
+		}
+	}
+	return out
+}
+
+// snapshotNames returns the names of the repository's snapshots,
+// sorted, for completion.
+func (repo *Repository) snapshotNames() []string {
+	names := make([]string, 0, len(repo.snapshots))
+	for _, cp := range repo.snapshots {
+		names = append(names, cp.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// end
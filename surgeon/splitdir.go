@@ -0,0 +1,203 @@
+/*
+ * Splitting commits by directory
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// A commit that touches several unrelated parts of a tree - typically
+// the result of a conversion from a system with per-directory commits
+// batched together, or of a monorepo import - can be split into one
+// commit per part.  Each fileop is put in a bucket, by default the
+// top-level directory of its path, and the commit becomes a chain of
+// commits, one per bucket in order of first appearance.
+//
+// A rename or copy whose source and target land in different buckets
+// can't stay a rename or copy, because the fragment holding it would
+// then depend on a path that belongs to another fragment.  Such an op
+// is rewritten as a modification of the target referencing the same
+// blob as the source, plus (for a rename) a deletion of the source in
+// the source's bucket.  No content is copied; the fragments share the
+// blob.
+
+// bucketMap assigns paths to buckets by longest matching prefix.
+type bucketMap struct {
+	prefixes []string
+	buckets  map[string]string
+}
+
+// readBucketMap reads lines of the form "PREFIX BUCKET".  Blank lines
+// and lines beginning with # are ignored.
+func readBucketMap(r io.Reader) (*bucketMap, error) {
+	bm := &bucketMap{buckets: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
+	linecount := 0
+	for scanner.Scan() {
+		linecount++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad line syntax in bucket map: line %d %q", linecount, line)
+		}
+		if _, ok := bm.buckets[fields[0]]; !ok {
+			bm.prefixes = append(bm.prefixes, fields[0])
+		}
+		bm.buckets[fields[0]] = fields[1]
+	}
+	// Longest first, so the first match is the most specific
+	sort.SliceStable(bm.prefixes, func(i, j int) bool {
+		return len(bm.prefixes[i]) > len(bm.prefixes[j])
+	})
+	return bm, scanner.Err()
+}
+
+// topDirectory returns the first component of a path, or the empty
+// string for a path at the root of the tree.
+func topDirectory(path string) string {
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// bucket returns the bucket of a path.  Paths no prefix matches are
+// bucketed by top-level directory.  A nil map buckets every path that
+// way.
+func (bm *bucketMap) bucket(path string) string {
+	if bm != nil {
+		for _, prefix := range bm.prefixes {
+			if strings.HasPrefix(path, prefix) {
+				return bm.buckets[prefix]
+			}
+		}
+	}
+	return topDirectory(path)
+}
+
+// uncrossOperations returns the fileops of a commit with every R or C
+// op whose source and target are in different buckets replaced by M
+// and D ops with the same effect.
+func (commit *Commit) uncrossOperations(bucket func(string) string) ([]*FileOp, error) {
+	// What each path touched so far in this commit holds; nil if deleted
+	local := make(map[string]*FileOp)
+	lookup := func(path string) (*FileOp, error) {
+		if entry, ok := local[path]; ok {
+			if entry == nil {
+				return nil, fmt.Errorf("source %s is deleted before it is used", path)
+			}
+			return entry, nil
+		}
+		if commit.hasParents() {
+			if parent, ok := commit.firstParent().(*Commit); ok {
+				if value, ok := parent.manifest().get(path); ok {
+					return value.(*FileOp), nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("source %s is not in the tree", path)
+	}
+	ops := make([]*FileOp, 0, len(commit.operations()))
+	made := make([]*FileOp, 0) // New ops, to be forgotten on failure
+	for _, op := range commit.operations() {
+		switch op.op {
+		case deleteall:
+			return nil, errors.New("cannot split a commit containing a deleteall by directory")
+		case opM:
+			local[op.Path] = op
+		case opD:
+			local[op.Path] = nil
+		case opR, opC:
+			source, err := lookup(op.Source)
+			if err != nil {
+				for _, modify := range made {
+					modify.forget()
+				}
+				return nil, fmt.Errorf("at %s: %v", commit.idMe(), err)
+			}
+			if bucket(op.Source) != bucket(op.Path) {
+				modify := newFileOp(commit.repo).construct(opM, source.mode, source.ref, op.Path)
+				if source.ref == "inline" {
+					modify.inline = source.inline
+				}
+				ops = append(ops, modify)
+				made = append(made, modify)
+				local[op.Path] = modify
+				if op.op == opR {
+					ops = append(ops, newFileOp(commit.repo).construct(opD, op.Source))
+					local[op.Source] = nil
+				}
+				continue
+			}
+			local[op.Path] = source
+			if op.op == opR {
+				local[op.Source] = nil
+			}
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// splitCommitByBucket splits a commit into a chain of commits, one
+// per bucket of its fileops.  Returns the number of commits the
+// original became.
+func (repo *Repository) splitCommitByBucket(where int, bucket func(string) string) (int, error) {
+	commit, ok := repo.events[where].(*Commit)
+	if !ok {
+		return 0, fmt.Errorf("split location %s is not a commit", repo.events[where].idMe())
+	}
+	ops, err := commit.uncrossOperations(bucket)
+	if err != nil {
+		return 0, err
+	}
+	buckets := newOrderedStringSet()
+	for _, op := range ops {
+		buckets.Add(bucket(op.Path))
+	}
+	if len(buckets) < 2 {
+		return 0, errors.New("no-op commit split, repo unchanged")
+	}
+	commit.setOperations(ops)
+	for k := 1; k < len(buckets); k++ {
+		err := repo.splitCommit(where+k-1,
+			func(ops []*FileOp) ([]*FileOp, []*FileOp, error) {
+				var this, rest []*FileOp
+				for _, op := range ops {
+					if bucket(op.Path) == buckets[k-1] {
+						this = append(this, op)
+					} else {
+						rest = append(rest, op)
+					}
+				}
+				return this, rest, nil
+			})
+		if err != nil {
+			return 0, err
+		}
+	}
+	repo.clearColor(colorQSET)
+	for k := range buckets {
+		fragment := repo.events[where+k].(*Commit)
+		if k > 1 && commit.legacyID != "" {
+			fragment.legacyID = fmt.Sprintf("%s.split%d", commit.legacyID, k)
+		}
+		fragment.addColor(colorQSET)
+	}
+	return len(buckets), nil
+}
+
+// end
@@ -0,0 +1,162 @@
+/*
+ * Splitting an export into streams by date
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A history of a few hundred thousand commits is one import stream
+// many gigabytes long, and an importer that dies two thirds of the way
+// through it has to start again from the top.  Cut into a stream per
+// year or month it can be loaded a piece at a time, and a failed piece
+// retried on its own.
+//
+// A piece is a run of consecutive commits, ending where the committer
+// dates cross a boundary.  Cutting the event list rather than sorting
+// commits by date keeps every commit's parents in its own piece or an
+// earlier one; a commit dated out of order stays with its neighbours.
+// Parents in earlier pieces are written as callouts, which "graft" and
+// "callouts resolve" know how to reattach, and never as incremental
+// resets from a branch the piece doesn't have, which would stop it
+// loading on its own.  Blobs go with the commits
+// that use them, so a blob used in several pieces is written in each,
+// and tags and resets go with the commits they point at.  Passthroughs
+// before the first commit, such as feature declarations, head every
+// piece.
+
+// splitPeriod returns a function telling which period a commit's date
+// falls in, for a split specification: "yearly", "monthly", or a comma
+// separated list of cut dates.  Periods never decrease with date.
+func splitPeriod(spec string) (func(time.Time) int, error) {
+	switch spec {
+	case "yearly":
+		return func(t time.Time) int { return t.UTC().Year() }, nil
+	case "monthly":
+		return func(t time.Time) int { return t.UTC().Year()*12 + int(t.UTC().Month()) - 1 }, nil
+	}
+	cuts := make([]time.Time, 0)
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if t, err := time.Parse("2006-01-02", field); err == nil {
+			cuts = append(cuts, t)
+		} else if date, err := newDate(field); err == nil && field != "" {
+			cuts = append(cuts, date.timestamp)
+		} else {
+			return nil, fmt.Errorf("%q is neither yearly, monthly nor a cut date", field)
+		}
+	}
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i].Before(cuts[j]) })
+	return func(t time.Time) int {
+		return sort.Search(len(cuts), func(i int) bool { return t.Before(cuts[i]) })
+	}, nil
+}
+
+// splitSelection partitions the selected events into pieces at the
+// period boundaries of a split specification.  Blobs are left out; the
+// export pulls them in with the commits that use them.
+func (repo *Repository) splitSelection(selection selectionSet, spec string) ([]selectionSet, error) {
+	period, err := splitPeriod(spec)
+	if err != nil {
+		return nil, err
+	}
+	if !selection.isDefined() {
+		selection = repo.all()
+	}
+	pieces := []selectionSet{newSelectionSet()}
+	home := make(map[*Commit]int)
+	preamble := newSelectionSet()
+	current, seen := 0, false
+	for it := selection.Iterator(); it.Next(); {
+		i := it.Value()
+		last := len(pieces) - 1
+		switch event := repo.events[i].(type) {
+		case *Blob:
+			continue
+		case *Commit:
+			p := period(event.committer.date.timestamp)
+			if seen && p > current && pieces[last].Size() > preamble.Size() {
+				pieces = append(pieces, preamble.Clone())
+				last++
+			}
+			if !seen || p > current {
+				current, seen = p, true
+			}
+			home[event] = last
+			pieces[last].Add(i)
+		case *Tag:
+			if commit, ok := repo.markToEvent(event.committish).(*Commit); ok {
+				if piece, ok := home[commit]; ok {
+					pieces[piece].Add(i)
+					continue
+				}
+			}
+			pieces[last].Add(i)
+		case *Reset:
+			if commit, ok := repo.markToEvent(event.committish).(*Commit); ok {
+				if piece, ok := home[commit]; ok {
+					pieces[piece].Add(i)
+					continue
+				}
+			}
+			pieces[last].Add(i)
+		case *Passthrough:
+			if !seen {
+				preamble.Add(i)
+			}
+			pieces[last].Add(i)
+		default:
+			pieces[last].Add(i)
+		}
+	}
+	for _, piece := range pieces {
+		piece.Sort()
+	}
+	return pieces, nil
+}
+
+// splitExport writes the selected events as a stream per period of a
+// split specification, to files named by a prefix and the number of
+// the piece.  Returns the names of the files written.
+func (repo *Repository) splitExport(ctx context.Context, selection selectionSet, spec string,
+	prefix string, options stringSet, target *VCS, baton *Baton) ([]string, error) {
+	pieces, err := repo.splitSelection(selection, spec)
+	if err != nil {
+		return nil, err
+	}
+	width := len(fmt.Sprint(len(pieces)))
+	if width < 3 {
+		width = 3
+	}
+	options = options.Union(newStringSet("--callout", "--noincremental"))
+	names := make([]string, 0, len(pieces))
+	for i, piece := range pieces {
+		name := fmt.Sprintf("%s-%0*d.fi", prefix, width, i+1)
+		fp, err := os.Create(filepath.Clean(name))
+		if err != nil {
+			return names, err
+		}
+		err = repo.fastExport(ctx, piece, fp, options, target, baton)
+		if cerr := fp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// end
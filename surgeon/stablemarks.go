@@ -0,0 +1,102 @@
+/*
+ * Marks derived from content, for reproducible conversions
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Marks are handed out in the order events are read, and renumbering
+// hands them out again in event order, so one commit more or one blob
+// fewer early in a conversion shifts the mark of everything after it.
+// Two runs of a conversion pipeline over equivalent input then export
+// streams that differ on nearly every line, and a diff between them
+// says nothing about what really changed.
+//
+// A stable mark is derived from what an event is instead: a blob's
+// from its hash, a commit's from its action stamp.  Each is the first
+// five bytes of the SHA-1 of that key, read as a number, which gives
+// marks of up to thirteen digits; fast-import takes any number that
+// fits in its integers.  Keys are numbered in sorted order, and where
+// two keys come to the same number, or two events share a key, the
+// later takes the next free number, so only events that collide move.
+
+// stableMarkBytes is how many bytes of a key's hash make its mark.
+const stableMarkBytes = 5
+
+// stableMark returns the number a stable mark key hashes to.
+func stableMark(key string) int {
+	sum := sha1.Sum([]byte(key))
+	var buf [8]byte
+	copy(buf[8-stableMarkBytes:], sum[:stableMarkBytes])
+	n := int(binary.BigEndian.Uint64(buf[:]))
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// stableMarkKey returns what the stable mark of an event is derived
+// from, or "" if it has no mark.
+func stableMarkKey(event Event) string {
+	switch event := event.(type) {
+	case *Blob:
+		if event.mark != "" {
+			return "blob " + event.gitHash().hexify()
+		}
+	case *Commit:
+		if event.mark != "" {
+			return "commit " + event.actionStamp()
+		}
+	}
+	return ""
+}
+
+// renumberStable renumbers the marks in a repo with marks derived from
+// content.  As with renumber, an interrupt is only honored while the
+// marks are being worked out.
+func (repo *Repository) renumberStable(ctx context.Context, baton *Baton) error {
+	type keyed struct {
+		key  string
+		mark string
+	}
+	keys := make([]keyed, 0, len(repo.events))
+	for _, event := range repo.events {
+		if ctx.Err() != nil {
+			return errors.New("interrupted before any marks were changed")
+		}
+		if key := stableMarkKey(event); key != "" {
+			if !strings.HasPrefix(event.getMark(), ":") {
+				panic("field not in mark format")
+			}
+			keys = append(keys, keyed{key, event.getMark()})
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].key < keys[j].key })
+	markmap := make(map[string]int, len(keys))
+	used := make(map[int]bool, len(keys))
+	highest := 0
+	for _, k := range keys {
+		n := stableMark(k.key)
+		for used[n] {
+			n++
+		}
+		used[n] = true
+		markmap[k.mark] = n
+		highest = max(highest, n)
+	}
+	repo.applyMarkmap(markmap, highest, baton)
+	return nil
+}
+
+// end
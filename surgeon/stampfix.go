@@ -0,0 +1,99 @@
+/*
+ * Automatic resolution of action-stamp collisions
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+)
+
+// Action stamps are the portable way to name a commit, but nothing
+// makes them unique: CVS and Subversion conversions routinely produce
+// commits by the same person in the same second, on different branches
+// where timequake can't reach them.  There are two ways out.  One is to
+// bump the later commits of each colliding set forward a second at a
+// time (stamps have one-second resolution, so nothing finer will do)
+// until each has a stamp of its own.  The other leaves the dates alone
+// and names each commit after the first with an ordinal suffix, the
+// <STAMP#N> form the selection language already understands.
+
+// stampCollision is a commit whose action stamp an earlier commit has.
+type stampCollision struct {
+	commit  *Commit
+	stamp   string // stamp before any change
+	ordinal int    // 1-origin position among commits sharing the stamp
+}
+
+// stampCollisions finds the commits whose action stamps are shared
+// with earlier commits, in event order.  Ordinals are as the name cache
+// assigns them in STAMP#N references.
+func (repo *Repository) stampCollisions(selection selectionSet) []stampCollision {
+	counts := make(map[string]int)
+	collisions := make([]stampCollision, 0)
+	for _, commit := range repo.commits(undefinedSelectionSet) {
+		stamp := commit.actionStamp()
+		counts[stamp]++
+		if counts[stamp] > 1 && selection.Contains(repo.eventToIndex(commit)) {
+			collisions = append(collisions, stampCollision{commit, stamp, counts[stamp]})
+		}
+	}
+	return collisions
+}
+
+// bumpCollisions moves each colliding commit in the selection forward
+// by whole seconds until its action stamp is unique in the repository.
+// The legacy journal, if any, is brought up to date with the new
+// stamps.  Sets Q bits on the commits moved and returns them.
+func (repo *Repository) bumpCollisions(selection selectionSet) []stampCollision {
+	collisions := repo.stampCollisions(selection)
+	taken := make(map[string]bool)
+	for _, commit := range repo.commits(undefinedSelectionSet) {
+		taken[commit.actionStamp()] = true
+		taken[commit.committer.actionStamp()] = true
+	}
+	cookies := make(map[*Commit][]string)
+	if repo.legacyLog != nil {
+		for cookie, commit := range repo.legacyMap {
+			cookies[commit] = append(cookies[commit], cookie)
+		}
+	}
+	repo.clearColor(colorQSET)
+	for _, collision := range collisions {
+		commit := collision.commit
+		// Keep a committer date that matched the author date with it
+		together := len(commit.authors) > 0 && commit.authors[0].date.Equal(commit.committer.date)
+		for taken[commit.actionStamp()] {
+			commit.bump(1)
+		}
+		if together {
+			commit.committer.date.timestamp = commit.authors[0].date.timestamp
+		}
+		taken[commit.actionStamp()] = true
+		taken[commit.committer.actionStamp()] = true
+		commit.addColor(colorQSET)
+		if lj := repo.legacyLog; lj != nil && len(cookies[commit]) > 0 {
+			delete(lj.serials, commit)
+			for _, cookie := range cookies[commit] {
+				lj.record(cookie, commit)
+			}
+		}
+	}
+	if repo.legacyLog != nil {
+		if err := repo.legacyLog.flush(); err != nil {
+			croak("while journaling legacy references: %v", err)
+		}
+	}
+	repo.invalidateNamecache()
+	return collisions
+}
+
+// suffixedStamp is the reference naming a colliding commit uniquely.
+func (sc *stampCollision) suffixedStamp() string {
+	return fmt.Sprintf("%s#%d", sc.stamp, sc.ordinal)
+}
+
+// end
@@ -0,0 +1,138 @@
+/*
+ * Stream option lines: parsing, dialect hints, write policy
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// An option line in a fast-import stream has the form
+//
+//	option VCS NAME[=VALUE]
+//
+// and is addressed to the importer for VCS; git fast-import acts on
+// "option git" lines and ignores all others.  Some exporters emit
+// options of their own (bzr does), and reposurgeon used to pass them
+// all through blindly, so a bzr stream rebuilt into hg handed hg a
+// line it had no use for.
+//
+// Option lines are still kept as passthroughs, so they keep their
+// place in the stream and can be edited with the passthrough command,
+// but they are parsed as they are read: an option naming a VCS we
+// know hints at the stream's source type, and options addressed to
+// reposurgeon itself set parser switches.  On write, an option policy
+// decides which of them are emitted.
+
+type streamOption struct {
+	vcs   string
+	name  string
+	value string // empty if the option has no =VALUE part
+}
+
+// String reports an option in stream syntax, without the trailing newline.
+func (o streamOption) String() string {
+	s := "option " + o.vcs + " " + o.name
+	if o.value != "" {
+		s += "=" + o.value
+	}
+	return s
+}
+
+// parseStreamOption parses passthrough text as an option line.  The
+// second return is false if the text is not an option line at all;
+// the error is non-nil if it is one but is malformed.
+func parseStreamOption(text string) (streamOption, bool, error) {
+	var opt streamOption
+	fields := strings.Fields(text)
+	if len(fields) == 0 || fields[0] != "option" {
+		return opt, false, nil
+	}
+	if len(fields) != 3 {
+		return opt, true, fmt.Errorf("option line should be \"option VCS NAME[=VALUE]\": %q", strings.TrimSpace(text))
+	}
+	opt.vcs = fields[1]
+	opt.name = fields[2]
+	if i := strings.IndexByte(opt.name, '='); i != -1 {
+		opt.name, opt.value = opt.name[:i], opt.name[i+1:]
+	}
+	return opt, true, nil
+}
+
+// knownVCS reports whether a name is one of our VCS types.
+func knownVCS(name string) bool {
+	for _, vcs := range vcstypes {
+		if vcs.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// noteOption acts on an option line as it is read.  An option for a
+// VCS other than git is a weak hint about where the stream came from;
+// git options say nothing, since any exporter may emit them for the
+// benefit of git fast-import.  Options addressed to reposurgeon are:
+//
+//	option reposurgeon sourcetype=VCS   as "#reposurgeon sourcetype VCS"
+func (sp *StreamParser) noteOption(text string) {
+	opt, _, err := parseStreamOption(text)
+	if err != nil {
+		sp.warn(err.Error())
+		return
+	}
+	switch {
+	case opt.vcs == "reposurgeon":
+		switch opt.name {
+		case "sourcetype":
+			if !knownVCS(opt.value) {
+				sp.warn(fmt.Sprintf("unknown source type %q in option line", opt.value))
+				return
+			}
+			sp.repo.hint(opt.value, true)
+		default:
+			sp.warn(fmt.Sprintf("unrecognized reposurgeon option %q", opt.name))
+		}
+	case opt.vcs != "git" && knownVCS(opt.vcs):
+		sp.repo.hint(opt.vcs, false)
+	}
+}
+
+// Option write policies
+var optionPolicies = []string{"target", "keep", "strip"}
+
+// emitOption says whether an option line should be written.  Under
+// the default "target" policy, when writing for a known VCS only that
+// VCS's options go out; a plain write keeps them all.  "keep" and
+// "strip" keep or drop every option regardless.
+func (repo *Repository) emitOption(opt streamOption, target *VCS) bool {
+	switch repo.optionPolicy {
+	case "keep":
+		return true
+	case "strip":
+		return false
+	default:
+		return target == nil || opt.vcs == target.name
+	}
+}
+
+// options returns the option passthroughs in a selection with their
+// parsed forms.  Malformed option lines are skipped.
+func (repo *Repository) options(selection selectionSet) ([]*Passthrough, []streamOption) {
+	events := make([]*Passthrough, 0)
+	opts := make([]streamOption, 0)
+	for _, p := range repo.passthroughs(selection) {
+		if opt, ok, err := parseStreamOption(p.text); ok && err == nil {
+			events = append(events, p)
+			opts = append(opts, opt)
+		}
+	}
+	return events, opts
+}
+
+// end
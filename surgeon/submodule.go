@@ -0,0 +1,271 @@
+/*
+ * Submodule (gitlink) management
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// A git submodule appears in a fast-import stream as a gitlink, an M
+// fileop with mode 160000 whose ref is the hash of a commit in another
+// repository.  Reposurgeon passes these through untouched; the
+// operations here let them be listed, repointed when the submodule's
+// own history has been rewritten, expanded into the subproject's files
+// when it is loaded as a second repository, or created from a
+// directory whose contents match commits in such a repository.
+//
+// None of these touch .gitmodules, which has to be edited to agree.
+
+const gitlinkMode = "160000"
+
+type gitlink struct {
+	commit *Commit
+	op     *FileOp
+}
+
+// gitlinks returns the gitlink fileops of the selected commits, in
+// event order.  If path is not empty only those at that path are
+// returned.
+func (repo *Repository) gitlinks(selection selectionSet, path string) []gitlink {
+	links := make([]gitlink, 0)
+	for _, commit := range repo.commits(selection) {
+		for _, op := range commit.operations() {
+			if op.op == opM && op.mode == gitlinkMode && (path == "" || op.Path == path) {
+				links = append(links, gitlink{commit, op})
+			}
+		}
+	}
+	return links
+}
+
+// readGitlinkMap reads a hash mapping: lines of old and new commit
+// hash separated by whitespace, as written by git filter-repo's
+// commit-map or by "hash" with a little editing.  Blank lines and
+// lines beginning with # are ignored.
+func readGitlinkMap(r io.Reader) (map[string]string, error) {
+	mapping := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	linecount := 0
+	for scanner.Scan() {
+		linecount++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad line syntax in gitlink map: line %d %q", linecount, line)
+		}
+		for _, h := range fields {
+			if _, err := hex.DecodeString(h); err != nil || len(h) != 2*len(nullGitHash) {
+				return nil, fmt.Errorf("bad hash %q in gitlink map: line %d", h, linecount)
+			}
+		}
+		mapping[strings.ToLower(fields[0])] = strings.ToLower(fields[1])
+	}
+	return mapping, scanner.Err()
+}
+
+// remapGitlinks rewrites gitlink targets in the selection through a
+// hash mapping.  Returns the number of gitlinks changed.
+func (repo *Repository) remapGitlinks(selection selectionSet, mapping map[string]string) int {
+	changed := 0
+	for _, link := range repo.gitlinks(selection, "") {
+		if target, ok := mapping[strings.ToLower(link.op.ref)]; ok && target != link.op.ref {
+			link.op.ref = target
+			link.commit.invalidateManifests()
+			changed++
+		}
+	}
+	return changed
+}
+
+// commitsByHash indexes a repository's commits by Git hash, both as
+// computed and as recorded by original-oid.
+func (repo *Repository) commitsByHash() map[string]*Commit {
+	repo.hashAll(nil)
+	index := make(map[string]*Commit)
+	for _, commit := range repo.commits(undefinedSelectionSet) {
+		index[commit.gitHash().hexify()] = commit
+		if commit.recorded != nil {
+			index[commit.recorded.oid.hexify()] = commit
+		}
+	}
+	return index
+}
+
+// embedSubmodule replaces gitlinks at path in the selection with the
+// files of the commits they point at in source.  Each gitlink becomes
+// a delete of the path followed by the full tree of its target, so the
+// result is right whatever was there before.  Blobs are copied into
+// the repository.  Returns the number of gitlinks expanded; those
+// whose target isn't in source are left alone, with a warning.
+func (repo *Repository) embedSubmodule(selection selectionSet, path string, source *Repository) int {
+	index := source.commitsByHash()
+	copies := make(map[*Blob]*Blob)
+	ncopies := 0
+	pending := make(map[*Commit][]Event)
+	type expansion struct {
+		link gitlink
+		ops  [][]string // mode, source blob mark or hash, path
+	}
+	plans := make([]expansion, 0)
+	for _, link := range repo.gitlinks(selection, path) {
+		target, ok := index[strings.ToLower(link.op.ref)]
+		if !ok {
+			warn("submodule", "%s: gitlink target %s not found in %s", link.commit.idMe(), link.op.ref, source.name)
+			continue
+		}
+		plan := expansion{link: link}
+		target.manifest().iter(func(subpath string, value interface{}) {
+			op := value.(*FileOp)
+			ref := op.ref
+			if op.mode != gitlinkMode {
+				blob, _ := source.markToEvent(ref).(*Blob)
+				clone, ok := copies[blob]
+				if !ok || blob == nil {
+					clone = newBlob(repo)
+					if blob == nil {
+						clone.setContent(op.inline, noOffset)
+					} else {
+						clone.setContent(blob.getContent(), noOffset)
+						copies[blob] = clone
+					}
+					clone.setMark(repo.newmark())
+					pending[link.commit] = append(pending[link.commit], clone)
+					ncopies++
+				}
+				ref = clone.mark
+			}
+			plan.ops = append(plan.ops, []string{op.mode, ref, path + "/" + subpath})
+		})
+		sort.Slice(plan.ops, func(i, j int) bool { return plan.ops[i][2] < plan.ops[j][2] })
+		plans = append(plans, plan)
+	}
+	if len(plans) == 0 {
+		return 0
+	}
+	// New blobs go just before the first commit that uses them
+	events := make([]Event, 0, len(repo.events)+ncopies)
+	for _, event := range repo.events {
+		if commit, ok := event.(*Commit); ok {
+			events = append(events, pending[commit]...)
+		}
+		events = append(events, event)
+	}
+	repo.events = events
+	repo.declareSequenceMutation("submodule embedding")
+	for _, plan := range plans {
+		ops := make([]*FileOp, 0)
+		for _, op := range plan.link.commit.operations() {
+			if op != plan.link.op {
+				ops = append(ops, op)
+				continue
+			}
+			ops = append(ops, newFileOp(repo).construct(opD, path))
+			for _, args := range plan.ops {
+				ops = append(ops, newFileOp(repo).construct(opM, args...))
+			}
+		}
+		plan.link.commit.setOperations(ops)
+	}
+	return len(plans)
+}
+
+// subtreeHash returns the Git tree hash of the directory at path in a
+// manifest, or false if there is nothing there.
+func subtreeHash(manifest *Manifest, path string) (gitHashType, bool) {
+	pm := &manifest.PathMap
+	for _, component := range strings.Split(path, "/") {
+		sub, ok := pm.dirs[component]
+		if !ok {
+			return nullGitHash, false
+		}
+		pm = sub
+	}
+	return pmToManifest(pm).gitHash(), true
+}
+
+// collapseSubtree turns the directory at path into a gitlink in every
+// selected commit that changes it.  The gitlink points at the earliest
+// commit in source whose tree matches the directory's contents there.
+// Returns the number of commits changed; those whose directory matches
+// nothing in source, or that rename or copy files out of it, are left
+// alone with a warning.
+func (repo *Repository) collapseSubtree(selection selectionSet, path string, source *Repository) int {
+	source.hashAll(nil)
+	trees := make(map[gitHashType]*Commit)
+	for _, commit := range source.commits(undefinedSelectionSet) {
+		tree := commit.manifest().gitHash()
+		if _, ok := trees[tree]; !ok {
+			trees[tree] = commit
+		}
+	}
+	within := func(p string) bool {
+		return p == path || strings.HasPrefix(p, path+"/")
+	}
+	type replacement struct {
+		commit *Commit
+		ops    []*FileOp
+	}
+	// Work out every replacement before making any, as each
+	// changes the manifests of the commits after it.
+	plans := make([]replacement, 0)
+	for _, commit := range repo.commits(selection) {
+		touched := false
+		changed := false
+		escapes := false
+		kept := make([]*FileOp, 0)
+		for _, op := range commit.operations() {
+			switch {
+			case op.op == deleteall:
+				touched = true
+				kept = append(kept, op)
+			case within(op.Path):
+				touched = true
+				changed = true
+			case (op.op == opR || op.op == opC) && within(op.Source):
+				escapes = true
+				kept = append(kept, op)
+			default:
+				kept = append(kept, op)
+			}
+		}
+		if !touched {
+			continue
+		}
+		if escapes {
+			warn("submodule", "%s: files are renamed or copied out of %s, not collapsed", commit.idMe(), path)
+			continue
+		}
+		tree, present := subtreeHash(commit.manifest(), path)
+		if !present {
+			// After a deleteall there is nothing to remove
+			if changed {
+				kept = append(kept, newFileOp(repo).construct(opD, path))
+			}
+		} else if target, ok := trees[tree]; ok {
+			kept = append(kept, newFileOp(repo).construct(opM, gitlinkMode, target.gitHash().hexify(), path))
+		} else {
+			warn("submodule", "%s: no commit in %s matches %s", commit.idMe(), source.name, path)
+			continue
+		}
+		plans = append(plans, replacement{commit, kept})
+	}
+	for _, plan := range plans {
+		plan.commit.setOperations(plan.ops)
+	}
+	return len(plans)
+}
+
+// end
@@ -0,0 +1,159 @@
+/*
+ * User-declared branch layouts for Subversion reads
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The Subversion reader finds branches by the standard layout: trunk,
+// a directory under branches/ or tags/, or failing those any top-level
+// directory.  Plenty of repositories were laid out otherwise, with a
+// trunk/branches/tags triple per project, or branches at two levels,
+// or releases kept beside trunk, and the guesses put their files on
+// the wrong branches.  With the --branchmap=PATH read option the
+// layout is declared instead, by rules read from PATH, one per line:
+//
+//	PATTERN [REF]
+//
+// PATTERN is the path of a branch directory.  It is a glob, in which *
+// matches within a path component, or a regular expression delimited
+// by slashes, which must match the whole path.  REF is the ref the
+// branch becomes; $1, $2... in it are replaced by what the wildcards
+// or capture groups matched, and a ref not beginning with refs/ is put
+// under refs/heads/.  Without a REF the branch is named as the
+// standard layout would name it.  Blank lines and lines beginning with
+// # are ignored.
+//
+// Rules are tried in order and the first that matches a path wins.
+// When rules are declared they replace the standard layout entirely,
+// so one for trunk is needed if there is a trunk; files under no
+// declared branch go to the unbranched branch.
+
+const branchMapOption = "--branchmap="
+
+// branchRule declares the branch directories matching a pattern.
+type branchRule struct {
+	pattern  *regexp.Regexp
+	template string
+}
+
+// branchMapFile returns the rule file path from the read options, or
+// the empty string if none was given.
+func branchMapFile(options stringSet) string {
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, branchMapOption) {
+			return option[len(branchMapOption):]
+		}
+	}
+	return ""
+}
+
+// globToRegexp turns a branch glob into an anchored expression with a
+// capture group per wildcard.
+func globToRegexp(glob string) string {
+	var re strings.Builder
+	re.WriteString("^")
+	for _, part := range strings.SplitAfter(glob, "*") {
+		literal := strings.TrimSuffix(part, "*")
+		re.WriteString(regexp.QuoteMeta(literal))
+		if literal != part {
+			re.WriteString("([^/]*)")
+		}
+	}
+	re.WriteString("$")
+	return re.String()
+}
+
+// parseBranchRules reads branch rules.
+func parseBranchRules(r io.Reader) ([]branchRule, error) {
+	rules := make([]branchRule, 0)
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected a pattern and at most one ref", lineno)
+		}
+		expr := fields[0]
+		if len(expr) > 2 && strings.HasPrefix(expr, "/") && strings.HasSuffix(expr, "/") {
+			expr = "^(?:" + expr[1:len(expr)-1] + ")$"
+		} else {
+			expr = globToRegexp(strings.Trim(expr, "/"))
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		rule := branchRule{pattern: pattern}
+		if len(fields) == 2 {
+			rule.template = fields[1]
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// readBranchRules loads the rules named by the read options into the
+// reader.
+func (sp *svnReader) readBranchRules(options stringSet) error {
+	path := branchMapFile(options)
+	if path == "" {
+		return nil
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	rules, err := parseBranchRules(fp)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	sp.branchRules = rules
+	return nil
+}
+
+// matchBranchRule returns the first rule matching a directory path and
+// the indices of its submatches, or nil.
+func (sp *svnReader) matchBranchRule(path string) (*branchRule, []int) {
+	path = filepath.ToSlash(path)
+	for i := range sp.branchRules {
+		if loc := sp.branchRules[i].pattern.FindStringSubmatchIndex(path); loc != nil {
+			return &sp.branchRules[i], loc
+		}
+	}
+	return nil, nil
+}
+
+// branchRef returns the ref a declared rule gives a branch directory,
+// or the empty string to have it named as the standard layout would.
+func (sp *svnReader) branchRef(path string) string {
+	rule, loc := sp.matchBranchRule(path)
+	if rule == nil || rule.template == "" {
+		return ""
+	}
+	ref := string(rule.pattern.ExpandString(nil, rule.template, filepath.ToSlash(path), loc))
+	if !strings.HasPrefix(ref, "refs/") {
+		ref = "refs/heads/" + ref
+	}
+	return ref
+}
+
+// end
@@ -0,0 +1,129 @@
+/*
+ * Confidence scoring of merges synthesized from Subversion mergeinfo
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Subversion records merges as svn:mergeinfo properties (or, from the
+// older svnmerge.py, svnmerge-integrated properties) listing the
+// revisions of each source branch that have been merged, and the
+// reader turns them into merge parents.  Not every mergeinfo record is
+// a merge in git's sense.  A record of revisions picked here and there
+// is a cherry-pick, and a git merge from the last of them would claim
+// the ones that were left out as well.  So each merge link the reader
+// makes is scored, and the scores kept with the repository for "list
+// merges" to show.
+//
+// The score starts as the fraction of the source branch, from where it
+// began or where the target forked from it up to the commit merged,
+// that the mergeinfo covers; a full merge scores 1, a cherry-pick of
+// one commit out of ten 0.1.  It is
+// scaled by 0.9 when the record comes only from svnmerge.py, whose
+// bookkeeping was less reliable, and by 0.8 when the property change
+// has no commit of its own and is charged to an earlier one.
+//
+// By default the reader makes only the links it judges full merges,
+// from the start of the source branch, or from where the target forked
+// from it, without a gap, and records their scores.  With the
+// --merge-threshold=SCORE read option the partial ones are scored too,
+// and every link scoring SCORE or more is made; the others are still
+// recorded.
+
+const mergeThresholdOption = "--merge-threshold="
+
+// mergeLink is a merge parent synthesized from mergeinfo.
+type mergeLink struct {
+	child  *Commit
+	parent *Commit
+	score  float64
+	kept   bool // False if the score was under the threshold
+}
+
+// mergeThreshold returns the lowest score of a merge link to be made,
+// from the read options, or -1 if none was given.
+func mergeThreshold(options stringSet) (float64, error) {
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, mergeThresholdOption) {
+			value := option[len(mergeThresholdOption):]
+			threshold, err := strconv.ParseFloat(value, 64)
+			if err != nil || threshold < 0 || threshold > 1 {
+				return 0, fmt.Errorf("merge threshold %q is not a number from 0 to 1", value)
+			}
+			return threshold, nil
+		}
+	}
+	return -1, nil
+}
+
+// svnRevision returns the Subversion revision a commit was made from.
+func svnRevision(commit *Commit) int {
+	rev, _ := strconv.Atoi(strings.Split(commit.legacyID, splitSeparator)[0])
+	return rev
+}
+
+// mergeCoverage returns the fraction of the commits on a source branch
+// up to and including last, not counting the commit that created the
+// branch or those at or before the event index floor, whose revisions
+// fall in one of the spans, each a pair of lowest and highest
+// revision.
+func (repo *Repository) mergeCoverage(last *Commit, spans [][2]int, floor int) float64 {
+	total, covered := 0, 0
+	for commit := last; commit != nil; {
+		if repo.eventToIndex(commit) <= floor {
+			break
+		}
+		var parent *Commit
+		if commit.hasParents() {
+			parent, _ = commit.parents()[0].(*Commit)
+		}
+		if parent == nil || parent.Branch != last.Branch {
+			// The branch root holds the copy that made the branch
+			if total == 0 {
+				return 1
+			}
+			break
+		}
+		total++
+		rev := svnRevision(commit)
+		for _, span := range spans {
+			if span[0] <= rev && rev <= span[1] {
+				covered++
+				break
+			}
+		}
+		commit = parent
+	}
+	return float64(covered) / float64(total)
+}
+
+// reportMerges lists the synthesized merge links into the selected
+// commits: the child, the parent, the score, and whether the link was
+// made.
+func (repo *Repository) reportMerges(w io.Writer, selection selectionSet) {
+	chosen := make(map[*Commit]bool)
+	for _, commit := range repo.commits(selection) {
+		chosen[commit] = true
+	}
+	for _, link := range repo.mergeLinks {
+		if !chosen[link.child] {
+			continue
+		}
+		state := "made"
+		if !link.kept {
+			state = "skipped"
+		}
+		fmt.Fprintf(w, "%s <- %s %.2f %s\n", link.child.idMe(), link.parent.idMe(), link.score, state)
+	}
+}
+
+// end
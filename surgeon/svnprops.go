@@ -0,0 +1,126 @@
+/*
+ * Sidecar record of Subversion node properties
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Most Subversion node properties have no git equivalent and are
+// discarded during conversion.  With the --property-sidecar=PATH read
+// option, the full property set of every node that carried one is
+// captured before filtering and written, after the conversion is done,
+// to a file of newline-delimited JSON with one record per revision:
+//
+//	{"revision":3,"commits":[{"mark":":4","stamp":"..."}],
+//	 "nodes":[{"path":"trunk/a.png","kind":"file","properties":{...}}]}
+//
+// Commits are identified both by mark and by action stamp, since
+// stamps survive later surgery and marks do not.  A revision that was
+// split across branches lists every commit made from it; one that
+// produced no commits lists none, but its properties are still kept.
+
+const propertySidecarOption = "--property-sidecar="
+
+type svnPropertyNode struct {
+	Path       string            `json:"path"`
+	Kind       string            `json:"kind"`
+	Properties map[string]string `json:"properties"`
+}
+
+type svnPropertyCommit struct {
+	Mark  string `json:"mark"`
+	Stamp string `json:"stamp"`
+}
+
+type svnPropertyRecord struct {
+	Revision revidx              `json:"revision"`
+	Commits  []svnPropertyCommit `json:"commits"`
+	Nodes    []svnPropertyNode   `json:"nodes"`
+}
+
+// propertySidecar returns the sidecar path from the read options, or
+// the empty string if none was requested.
+func propertySidecar(options stringSet) string {
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, propertySidecarOption) {
+			return option[len(propertySidecarOption):]
+		}
+	}
+	return ""
+}
+
+// stashProperties snapshots a node's property set.  Must be called
+// before the properties are filtered, and in stream order.
+func (sp *svnReader) stashProperties(node *NodeAction) {
+	if !node.hasProperties() || node.props.Len() == 0 {
+		return
+	}
+	snap := svnPropertyNode{
+		Path:       node.path,
+		Kind:       "file",
+		Properties: make(map[string]string),
+	}
+	if node.kind == sdDIR {
+		snap.Kind = "dir"
+	}
+	for _, key := range node.props.keys {
+		snap.Properties[key] = node.props.get(key)
+	}
+	n := len(sp.propHistory)
+	if n == 0 || sp.propHistory[n-1].Revision != node.revision {
+		sp.propHistory = append(sp.propHistory, svnPropertyRecord{Revision: node.revision})
+		n++
+	}
+	sp.propHistory[n-1].Nodes = append(sp.propHistory[n-1].Nodes, snap)
+}
+
+// writePropertySidecar attaches commits to the stashed property
+// records by legacy ID and writes them out.
+func (sp *StreamParser) writePropertySidecar(path string) error {
+	byRevision := make(map[revidx][]svnPropertyCommit)
+	for _, commit := range sp.repo.commits(undefinedSelectionSet) {
+		rev, err := strconv.Atoi(strings.Split(commit.legacyID, splitSeparator)[0])
+		if err != nil {
+			continue
+		}
+		byRevision[revidx(rev)] = append(byRevision[revidx(rev)],
+			svnPropertyCommit{Mark: commit.mark, Stamp: commit.actionStamp()})
+	}
+	fp, err := os.Create(filepath.Clean(path))
+	if err != nil {
+		return fmt.Errorf("property sidecar %s could not be created: %v", path, err)
+	}
+	w := bufio.NewWriter(fp)
+	for _, record := range sp.propHistory {
+		record.Commits = byRevision[record.Revision]
+		if record.Commits == nil {
+			record.Commits = make([]svnPropertyCommit, 0)
+		}
+		text, err := json.Marshal(record)
+		if err != nil {
+			fp.Close()
+			return err
+		}
+		w.Write(text)
+		w.WriteByte('\n')
+	}
+	if err = w.Flush(); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// end
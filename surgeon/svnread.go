@@ -88,13 +88,15 @@ func trimSep(s string) string {
 }
 
 type svnReader struct {
-	maplock   sync.Mutex         // Lock modification of shared maps
-	branchify map[int][][]string // Parsed branchification setting
-	revisions []RevisionRecord
-	revmap    map[revidx]revidx // Indices in the revisions array to Subversion revision IDs
-	backfrom  map[revidx]revidx // Subversion revision ID to previous revision ID
-	hashmap   map[string]*NodeAction
-	history   *History
+	maplock        sync.Mutex         // Lock modification of shared maps
+	branchify      map[int][][]string // Parsed branchification setting
+	branchRules    []branchRule       // Declared layout, replacing branchify
+	mergeThreshold float64            // Lowest score of a merge link to make, or -1
+	revisions      []RevisionRecord
+	revmap         map[revidx]revidx // Indices in the revisions array to Subversion revision IDs
+	backfrom       map[revidx]revidx // Subversion revision ID to previous revision ID
+	hashmap        map[string]*NodeAction
+	history        *History
 	// a map from SVN branch names to a revision-indexed list of "last commits"
 	// (not to be used directly but through lastRelevantCommit)
 	lastCommitOnBranchAt map[string][]*Commit
@@ -105,6 +107,9 @@ type svnReader struct {
 	flat        bool
 	noSimplify  bool
 	firstnode   *NodeAction
+	emptyDir    string              // Name of placeholders for empty directories
+	keepMark    string              // Mark of the placeholder blob
+	propHistory []svnPropertyRecord // Only filled for --property-sidecar
 }
 
 func (sp *svnReader) initialize() {
@@ -148,6 +153,10 @@ func (sp svnReader) isDeclaredBranch(path string) bool {
 }
 
 func (sp svnReader) isDeclaredBranchComponents(components []string) bool {
+	if len(sp.branchRules) > 0 {
+		rule, _ := sp.matchBranchRule(strings.Join(components, svnSep))
+		return rule != nil
+	}
 	L := len(components)
 	// When branchify contains an entry ending in /*, we say that everything
 	// up to the last /* is a namespace. Namespaces are not accepted as
@@ -976,6 +985,14 @@ func (sp *StreamParser) svnProcess(ctx context.Context, options stringSet, baton
 	}
 
 	sp.initialize()
+	if err := sp.readBranchRules(options); err != nil {
+		panic(throw("parse", "branch map: %v", err))
+	}
+	threshold, err := mergeThreshold(options)
+	if err != nil {
+		panic(throw("parse", "%v", err))
+	}
+	sp.mergeThreshold = threshold
 
 	sp.repo.addEvent(newPassthrough(sp.repo, "#reposurgeon sourcetype svn\n"))
 
@@ -989,6 +1006,15 @@ func (sp *StreamParser) svnProcess(ctx context.Context, options stringSet, baton
 		sp.repo.addEvent(defaultIgnoreBlob)
 	}
 
+	// Directories are marked with placeholders if they are wanted
+	if control.emptyDir != "" {
+		keepBlob := newBlob(sp.repo)
+		keepBlob.setContent(control.emptyDirContent, noOffset)
+		keepBlob.setMark(sp.repo.newmark())
+		sp.repo.addEvent(keepBlob)
+		sp.emptyDir, sp.keepMark = control.emptyDir, keepBlob.mark
+	}
+
 	svnFilterProperties(ctx, sp, options, baton)
 	timeit("filterprops")
 	svnBuildFilemaps(ctx, sp, options, baton)
@@ -1044,11 +1070,22 @@ func (sp *StreamParser) svnProcess(ctx context.Context, options stringSet, baton
 
 	svnCanonicalize(ctx, sp, options, baton)
 	timeit("canonicalize")
+	if sp.keepMark != "" {
+		svnEmptyDirs(ctx, sp, options, baton)
+		timeit("emptydirs")
+	}
 	svnProcessJunk(ctx, sp, options, baton)
 	timeit("dejunk")
 	svnProcessRenumber(ctx, sp, options, baton)
 	timeit("renumbering")
 
+	if path := propertySidecar(options); path != "" {
+		if err := sp.writePropertySidecar(path); err != nil {
+			croak("%v", err)
+		}
+		sp.propHistory = nil
+	}
+
 	// Treat this in-core state as though it was read from an SVN repo
 	sp.repo.hint("svn", true)
 }
@@ -1067,8 +1104,12 @@ func svnFilterProperties(ctx context.Context, sp *StreamParser, options stringSe
 		logit("SVN Phase 2: filter properties")
 	}
 	baton.startProgress("SVN2: filter properties", uint64(sp.streamcount))
+	sidecar := propertySidecar(options) != ""
 	si := 0
 	for node := sp.firstnode; node != nil; node = sp.next(node) {
+		if sidecar {
+			sp.stashProperties(node)
+		}
 		// Handle per-path properties.
 		if node.hasProperties() {
 			// Some properties should be quietly ignored
@@ -1498,12 +1539,7 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 
 		commit := newCommit(sp.repo)
 		ad := rfc3339(quantizeTime(sp.revisions, ri))
-		var au string
-		if record.author != "" {
-			au = record.author
-		} else {
-			au = "no-author"
-		}
+		au := record.author
 		if record.log != "" {
 			commit.Comment = record.log
 			if !strings.HasSuffix(commit.Comment, control.lineSep) {
@@ -1511,7 +1547,12 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 			}
 		}
 		attribution := ""
-		if strings.Count(au, "@") == 1 {
+		if au == "" {
+			// Treated like the cvs2svn artifact, so the
+			// placeholder policy decides what it becomes.
+			name, email := placeholderIdentity("(no author)", "no-author")
+			attribution = fmt.Sprintf("%s <%s> %s", name, email, ad)
+		} else if strings.Count(au, "@") == 1 {
 			// This is a thing that happens occasionally.  A DVCS-style
 			// attribution (name + email) gets stuffed in a Subversion
 			// author field
@@ -1541,7 +1582,7 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 			commit.committer.date.setTZ("UTC")
 		}
 		if record.props.Len() > 0 {
-			commit.properties = &record.props
+			commit.properties = copyOrderedMap(&record.props)
 			record.props.Clear()
 		}
 
@@ -1577,7 +1618,7 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 			if node.hasProperties() {
 				if node.props.has("cvs2svn:cvs-rev") {
 					cvskey := fmt.Sprintf("CVS:%s:%s", node.path, node.props.get("cvs2svn:cvs-rev"))
-					sp.repo.legacyMap[cvskey] = commit
+					sp.repo.setLegacy(cvskey, commit)
 					node.props.delete("cvs2svn:cvs-rev")
 				}
 			}
@@ -1593,7 +1634,7 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 				// then remove the spec-violating path.
 				fileop := newFileOp(sp.repo)
 				fileop.construct(deleteall)
-				fileop.Path = node.path
+				fileop.Path = sp.repo.intern(node.path)
 				commit.appendOperation(fileop)
 				// Also track the .gitignore deletions
 				dirpath := trimSep(node.path) + svnSep
@@ -1626,6 +1667,17 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 						})
 					}
 				}
+				// Mark directories within branches, so
+				// the empty ones can be given placeholders
+				// once the branches are sorted out.
+				if branch, _ := sp.splitSVNBranchPath(trimSep(node.path)); sp.keepMark != "" && branch != "" && !sp.isDeclaredBranch(node.path) {
+					path := filepath.Join(trimSep(node.path), sp.emptyDir)
+					if node.action == sdDELETE {
+						commit.appendOperation(newFileOp(sp.repo).construct(opD, path))
+					} else if node.action == sdADD || node.action == sdREPLACE {
+						commit.appendOperation(newFileOp(sp.repo).construct(opM, "100644", sp.keepMark, path))
+					}
+				}
 				if node.action == sdREPLACE {
 					// If a file is being replaced
 					// by a directory with the
@@ -1748,9 +1800,7 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 						// it means the dumpfile is malformed.  Might be triggered during partial
 						// lifts of multiproject repos - means the conversion pipeline deleted
 						// something before reposurgeon saw it that needed to be used later.
-						if logEnable(logWARN) {
-							logit("r%d.%d~%s: ancestor node is missing.", node.revision, node.index, node.path)
-						}
+						warn("ancestry", "r%d.%d~%s: ancestor node is missing.", node.revision, node.index, node.path)
 						continue
 					}
 					// This should never happen.
@@ -1760,10 +1810,8 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 					// during partial lifts of
 					// multiproject repos.
 					if node.blobmark == emptyMark {
-						if logEnable(logWARN) {
-							logit("r%d.%d: %s gets impossibly empty blob mark from ancestor %s, skipping",
-								record.revision, node.index, node, ancestor)
-						}
+						warn("ancestry", "r%d.%d: %s gets impossibly empty blob mark from ancestor %s, skipping",
+							record.revision, node.index, node, ancestor)
 						continue
 					}
 
@@ -1851,7 +1899,7 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 		sp.repo.addEvent(commit)
 
 		lastcommit = commit
-		sp.repo.legacyMap["SVN:"+commit.legacyID] = commit
+		sp.repo.setLegacy("SVN:"+commit.legacyID, commit)
 
 		baton.percentProgress(uint64(ri))
 	}
@@ -1919,6 +1967,7 @@ func svnSplitResolve(ctx context.Context, sp *StreamParser, options stringSet, b
 			// their path set, therefore we only care about the Path member.
 			for j, fileop := range commit.fileops {
 				newbranch, commit.fileops[j].Path = sp.splitSVNBranchPath(fileop.Path)
+				commit.fileops[j].Path = sp.repo.intern(commit.fileops[j].Path)
 				if startclique || newbranch != oldbranch {
 					// A new clique is started:
 					// * at the first op following the commit start or a deleteall
@@ -1969,12 +2018,12 @@ func svnSplitResolve(ctx context.Context, sp *StreamParser, options stringSet, b
 		baseID := base.legacyID
 		base.Comment += splitwarn
 		base.legacyID += splitSeparator + "1"
-		sp.repo.legacyMap["SVN:"+base.legacyID] = base
-		delete(sp.repo.legacyMap, "SVN:"+baseID)
+		sp.repo.setLegacy("SVN:"+base.legacyID, base)
+		sp.repo.dropLegacy("SVN:" + baseID)
 		for j := 1; j <= len(split.cliques); j++ {
 			fragment := sp.repo.events[split.loc+j].(*Commit)
 			fragment.legacyID = baseID + splitSeparator + strconv.Itoa(j+1)
-			sp.repo.legacyMap["SVN:"+fragment.legacyID] = fragment
+			sp.repo.setLegacy("SVN:"+fragment.legacyID, fragment)
 			fragment.Comment += splitwarn
 			fragment.setBranch(split.cliques[len(split.cliques)-j].branch)
 			baton.twirl()
@@ -2207,10 +2256,8 @@ func svnLinkFixups(ctx context.Context, sp *StreamParser, options stringSet, bat
 							frombranch = newfrom
 							fromNode = node
 						} else if frombranch != newfrom {
-							if logEnable(logWARN) {
-								logit("Link detection for %s <%s> failed: file copies from multiple branches to %s, difference is %s vs %s",
-									commit.mark, commit.legacyID, destbranch, fromNode, node)
-							}
+							warn("link-detection", "Link detection for %s <%s> failed: file copies from multiple branches to %s, difference is %s vs %s",
+								commit.mark, commit.legacyID, destbranch, fromNode, node)
 							maxfrom = 0
 							break
 						}
@@ -2332,9 +2379,7 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 						continue
 					}
 				}
-				if logEnable(logWARN) {
-					logit("Ignoring corrupt mergeinfo range '%s'", span)
-				}
+				warn("mergeinfo", "Ignoring corrupt mergeinfo range '%s'", span)
 			}
 			if len(revs) > 0 {
 				mergeinfo[branch] = revs
@@ -2408,6 +2453,7 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 			}
 			info := node.props.get("svn:mergeinfo")
 			info2 := node.props.get("svnmerge-integrated")
+			onlySvnmerge := info == "" && info2 != ""
 			if info == "" {
 				info = info2
 			} else if info2 != "" {
@@ -2425,18 +2471,14 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 			}
 			commit := lastRelevantCommit(sp, revidx(revision), branch)
 			if commit == nil {
-				if logEnable(logWARN) {
-					logit("Cannot resolve mergeinfo for r%d.%d which has no commit in branch %s",
-						revision, node.index, branch)
-				}
+				warn("mergeinfo", "Cannot resolve mergeinfo for r%d.%d which has no commit in branch %s",
+					revision, node.index, branch)
 				continue
 			}
 			realrev, _ := strconv.Atoi(strings.Split(commit.legacyID, splitSeparator)[0])
 			if realrev != revision {
-				if logEnable(logWARN) {
-					logit("Resolving mergeinfo targeting r%d.%d on %s <%s> instead",
-						revision, node.index, commit.mark, commit.legacyID)
-				}
+				warn("mergeinfo", "Resolving mergeinfo targeting r%d.%d on %s <%s> instead",
+					revision, node.index, commit.mark, commit.legacyID)
 			}
 			// Now parse the mergeinfo, and find commits for the merge points
 			if logEnable(logTOPOLOGY) {
@@ -2445,6 +2487,7 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 			}
 			newMerges := parseMergeInfo(info)
 			mergeSources := make(map[int]bool, len(newMerges))
+			scores := make(map[int]float64, len(newMerges))
 			// SVN tends to not put in mergeinfo the revisions that
 			// predate the merge base of the source and dest branch
 			// tips. Computing a merge base would be costly, but we
@@ -2472,8 +2515,15 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 				// the previous commit is earlier than the branch
 				// base, due to SVN sometimes omitting revisions
 				// prior to the merge base.
+				// The ranges are narrowed below; score against
+				// what the mergeinfo claims.
+				spans := make([][2]int, len(revs))
+				for i, rng := range revs {
+					spans[i] = [2]int{rng.min, rng.max}
+				}
 				i, lastGood := 0, -1
 				count := len(revs)
+				partial := make([]RevRange, 0)
 				for i < count {
 					// Skip all ranges not starting at the right place
 					// We accept a range [m;M] if the commit just
@@ -2534,6 +2584,11 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 						if index <= baseIndex {
 							break
 						}
+						// A partial merge, wanted only for
+						// scoring
+						if sp.mergeThreshold >= 0 {
+							partial = append(partial, revs[i])
+						}
 					}
 					if i >= count {
 						break
@@ -2553,7 +2608,7 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 						revs[lastGood].max = revs[i].max
 					}
 				}
-				revs := revs[:lastGood+1]
+				revs := append(revs[:lastGood+1:lastGood+1], partial...)
 				// Now we process the merges
 				for _, rng := range revs {
 					baton.twirl()
@@ -2570,9 +2625,7 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 					if lastrev < rng.min {
 						// Snapping the revisions to existing commits
 						// went past the minimum revision in the range
-						if logEnable(logWARN) {
-							logit("Ignoring bogus mergeinfo with no valid commit in the range")
-						}
+						warn("mergeinfo", "Ignoring bogus mergeinfo with no valid commit in the range")
 						continue
 					}
 					index := sp.repo.eventToIndex(last)
@@ -2586,12 +2639,29 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 							fromPath, last.mark, last.legacyID, commit.mark, commit.legacyID)
 					}
 					if index >= destIndex {
-						if logEnable(logWARN) {
-							logit("Ignoring bogus mergeinfo trying to create a forward merge")
-						}
+						warn("mergeinfo", "Ignoring bogus mergeinfo trying to create a forward merge")
 						continue
 					}
 					mergeSources[index] = true
+					// What the target forked from is merged
+					// already.
+					floor := -1
+					for _, forkIndex := range forks[fromPath] {
+						if forkIndex <= index {
+							floor = forkIndex
+							break
+						}
+					}
+					score := sp.repo.mergeCoverage(last, spans, floor)
+					if onlySvnmerge {
+						score *= 0.9
+					}
+					if realrev != revision {
+						score *= 0.8
+					}
+					if score > scores[index] {
+						scores[index] = score
+					}
 					if index < minIndex {
 						minIndex = index
 					}
@@ -2640,6 +2710,16 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 				}
 				delete(mergeSources, highIndex)
 				if source, ok := sp.repo.events[highIndex].(*Commit); ok {
+					link := &mergeLink{child: commit, parent: source, score: scores[highIndex]}
+					link.kept = link.score >= sp.mergeThreshold
+					sp.repo.mergeLinks = append(sp.repo.mergeLinks, link)
+					if !link.kept {
+						if logEnable(logEXTRACT) {
+							logit("Merge from %s <%s> to %s <%s> scored %.2f, not made",
+								source.mark, source.legacyID, commit.mark, commit.legacyID, link.score)
+						}
+						continue
+					}
 					if needDeleteAll {
 						fileop := newFileOp(sp.repo)
 						fileop.construct(deleteall)
@@ -2727,8 +2807,8 @@ func svnGitifyBranches(ctx context.Context, sp *StreamParser, options stringSet,
 		seenRefs.Add(newname)
 		canonicalizedNames[svnname] = newname
 		maplock.Unlock()
-		if svnname != newname && logEnable(logWARN) {
-			logit("illegal branch/tag name %q mapped to %q", svnname, newname)
+		if svnname != newname {
+			warn("branch-name", "illegal branch/tag name %q mapped to %q", svnname, newname)
 		}
 		return newname
 	}
@@ -2738,8 +2818,20 @@ func svnGitifyBranches(ctx context.Context, sp *StreamParser, options stringSet,
 			if !sp.noSimplify {
 				commit.simplify()
 			}
-			commit.setBranch(cleanName(sp, commit.Branch))
-			if commit.Branch == "" {
+			ref := sp.branchRef(commit.Branch)
+			if ref != "" {
+				commit.setBranch(cleanName(sp, ref))
+			} else {
+				commit.setBranch(cleanName(sp, commit.Branch))
+			}
+			if ref != "" {
+				// Named by a declared rule
+				if strings.HasPrefix(commit.Branch, "refs/heads/") {
+					maplock.Lock()
+					baseBranchnames.Add(commit.Branch[len("refs/heads/"):])
+					maplock.Unlock()
+				}
+			} else if commit.Branch == "" {
 				// File or directory is not under any recognizable branch.
 				// Shuffle it off to branch with an illegal name.
 				maplock.Lock()
@@ -2776,10 +2868,8 @@ func svnGitifyBranches(ctx context.Context, sp *StreamParser, options stringSet,
 			unbranched += "-bis"
 		}
 		unbranched = filepath.Join("refs", "heads", unbranched)
-		if logEnable(logWARN) {
-			logit("histories of files in the root directory have been put on branch %s",
-				unbranched)
-		}
+		warn("layout", "histories of files in the root directory have been put on branch %s",
+			unbranched)
 		walkEvents(sp.repo.events, func(i int, event Event) bool {
 			if commit, ok := event.(*Commit); ok && commit.Branch == illegalBranch {
 				commit.setBranch(unbranched)
@@ -2930,6 +3020,25 @@ func svnCanonicalize(ctx context.Context, sp *StreamParser, options stringSet, b
 	baton.endProgress()
 }
 
+func svnEmptyDirs(ctx context.Context, sp *StreamParser, options stringSet, baton *Baton) {
+	// Phase 11b:
+	// Every directory within a branch was marked with a placeholder
+	// in Phase 5.  Keep only the placeholders of directories with
+	// nothing else in them, before commits that only made empty
+	// directories are taken for junk.
+	defer trace.StartRegion(ctx, "SVN Phase 11b: empty directories.").End()
+	if logEnable(logEXTRACT) {
+		logit("SVN Phase 11b: empty directories")
+	}
+	changed := sp.repo.fillEmptyDirs(sp.emptyDir, sp.keepMark, baton)
+	if logEnable(logEXTRACT) {
+		logit("%d commits have placeholders changed", changed)
+	}
+	if keepBlob, ok := sp.repo.markToEvent(sp.keepMark).(*Blob); ok && len(keepBlob.opset) == 0 {
+		sp.repo.dropBlobs(map[*Blob]bool{keepBlob: true})
+	}
+}
+
 func svnProcessJunk(ctx context.Context, sp *StreamParser, options stringSet, baton *Baton) {
 	// Phase 12:
 	// Tagify, or entirely discard, Subversion commits that didn't correspond to a file
@@ -3151,7 +3260,11 @@ func svnProcessRenumber(ctx context.Context, sp *StreamParser, options stringSet
 	if logEnable(logEXTRACT) {
 		logit("SVN Phase 13: renumber")
 	}
-	sp.repo.renumber(1, baton)
+	if err := sp.repo.renumber(ctx, 1, baton); err != nil {
+		croak("renumber: %v", err)
+		return
+	}
+	sp.repo.markAliases = nil // Nobody has seen the marks before now
 	sp.repo.events = append(sp.repo.events, newPassthrough(sp.repo, "done\n"))
 }
 
@@ -0,0 +1,587 @@
+// Serialization of a repository as a Subversion dump stream.
+//
+// This is the inverse of svnread.go, and much simpler, because
+// reposurgeon's model has to lose information to go into a dump
+// rather than recover it.  Each commit becomes a revision in a
+// standard trunk/branches/tags layout; the default branch maps to
+// trunk, refs/heads/NAME to branches/NAME and refs/tags/NAME to
+// tags/NAME.  Annotated tags, and resets that point a ref at an
+// existing commit, become directory copies.
+//
+// A branch directory is created by copying the directory its first
+// parent was committed to, at that parent's revision, and from then
+// on each revision carries the difference between the first parent's
+// tree and the commit's.  If a commit's first parent isn't the last
+// commit written to its branch directory, the directory is replaced.
+// Other parents become svn:mergeinfo on the branch directory, as
+// Subversion would record them, so that the reader turns them back
+// into merges.
+//
+// Executable and symlink modes map to the svn:executable and
+// svn:special properties, .gitignore files to svn:ignore and
+// svn:global-ignores, and commit properties become revision
+// properties.  Gitlinks have no Subversion equivalent and are dropped
+// with a warning.
+//
+// The format written is version 2 of the format documented at
+//
+// https://svn.apache.org/repos/asf/subversion/trunk/notes/dump-load-format.txt
+
+// SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+type svnDumper struct {
+	repo     *Repository
+	w        io.Writer
+	trunk    string          // ref that maps to trunk
+	revision int             // last revision written
+	revs     map[*Commit]int // revision each commit was written in
+	dirs     map[*Commit]string
+	tips     map[string]*Commit // last commit written to each branch directory
+	created  map[string]int     // revision each branch directory was created in
+	made     map[string]bool    // directories outside branches that exist
+	merges   map[string]map[string]string
+	mergesAt map[*Commit]map[string]string
+}
+
+// svnProps encodes Subversion properties, in key order.
+func svnProps(props map[string]string) []byte {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "K %d\n%s\nV %d\n%s\n", len(k), k, len(props[k]), props[k])
+	}
+	buf.WriteString("PROPS-END\n")
+	return buf.Bytes()
+}
+
+// svnAuthor maps an attribution to an svn:author value.  One read
+// from Subversion, where the name and address are both the author's
+// login, goes back to that login; anything else is written as a full
+// address, which the reader accepts.
+func svnAuthor(attr Attribution) string {
+	if attr.fullname == attr.email {
+		return attr.email
+	}
+	return fmt.Sprintf("%s <%s>", attr.fullname, attr.email)
+}
+
+func svnDate(date Date) string {
+	return date.timestamp.UTC().Format("2006-01-02T15:04:05.000000Z")
+}
+
+// branchDir maps a ref to the directory it is kept in.
+func (d *svnDumper) branchDir(ref string) string {
+	switch {
+	case ref == d.trunk:
+		return "trunk"
+	case strings.HasPrefix(ref, "refs/heads/"):
+		return "branches/" + strings.TrimPrefix(ref, "refs/heads/")
+	case strings.HasPrefix(ref, "refs/tags/"):
+		return "tags/" + strings.TrimPrefix(ref, "refs/tags/")
+	default:
+		return "branches/" + strings.TrimPrefix(ref, "refs/")
+	}
+}
+
+func (d *svnDumper) revisionHeader(props map[string]string) {
+	d.revision++
+	p := svnProps(props)
+	fmt.Fprintf(d.w, "Revision-number: %d\nProp-content-length: %d\nContent-length: %d\n\n%s\n",
+		d.revision, len(p), len(p), p)
+}
+
+func (d *svnDumper) revisionProps(attr Attribution, log string, extra *OrderedMap) map[string]string {
+	props := map[string]string{
+		"svn:author": svnAuthor(attr),
+		"svn:date":   svnDate(attr.date),
+		"svn:log":    log,
+	}
+	if extra != nil {
+		for _, k := range extra.keys {
+			props[k] = extra.get(k)
+		}
+	}
+	return props
+}
+
+// node writes a node record.  Props and text are omitted if nil.
+func (d *svnDumper) node(path, kind, action string, copyfrom string, copyrev int, props map[string]string, text []byte) {
+	fmt.Fprintf(d.w, "Node-path: %s\n", path)
+	if kind != "" {
+		fmt.Fprintf(d.w, "Node-kind: %s\n", kind)
+	}
+	fmt.Fprintf(d.w, "Node-action: %s\n", action)
+	if copyfrom != "" {
+		fmt.Fprintf(d.w, "Node-copyfrom-rev: %d\nNode-copyfrom-path: %s\n", copyrev, copyfrom)
+	}
+	var p []byte
+	if props != nil {
+		p = svnProps(props)
+	}
+	if text != nil {
+		fmt.Fprintf(d.w, "Text-content-md5: %x\nText-content-sha1: %x\n", md5.Sum(text), sha1.Sum(text))
+	}
+	if props != nil {
+		fmt.Fprintf(d.w, "Prop-content-length: %d\n", len(p))
+	}
+	if text != nil {
+		fmt.Fprintf(d.w, "Text-content-length: %d\n", len(text))
+	}
+	if props != nil || text != nil {
+		fmt.Fprintf(d.w, "Content-length: %d\n", len(p)+len(text))
+	}
+	fmt.Fprintf(d.w, "\n%s%s\n\n", p, text)
+}
+
+// makeParents adds any missing directories above a branch directory.
+func (d *svnDumper) makeParents(dir string) {
+	parts := strings.Split(dir, svnSep)
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], svnSep)
+		if !d.made[parent] {
+			d.node(parent, "dir", "add", "", 0, map[string]string{}, nil)
+			d.made[parent] = true
+		}
+	}
+}
+
+// placeBranch copies the directory a commit was written to into dir,
+// replacing whatever was there.  If commit is nil an empty directory
+// is made.
+func (d *svnDumper) placeBranch(dir string, commit *Commit, props map[string]string) {
+	if _, ok := d.tips[dir]; ok {
+		d.node(dir, "", "delete", "", 0, nil, nil)
+	} else {
+		d.makeParents(dir)
+	}
+	if commit == nil {
+		if props == nil {
+			props = map[string]string{}
+		}
+		d.node(dir, "dir", "add", "", 0, props, nil)
+		d.merges[dir] = nil
+	} else {
+		d.node(dir, "dir", "add", d.dirs[commit], d.revs[commit], props, nil)
+		d.merges[dir] = d.mergesAt[commit]
+	}
+	d.created[dir] = d.revision
+	d.tips[dir] = commit
+}
+
+type svnTreeDelta struct {
+	deletes []string
+	adddirs []string
+	files   []string
+	ops     map[string]*FileOp
+	added   map[string]bool
+}
+
+// svnTreeDiff finds the differences between two trees.  Subtrees the
+// two share are skipped, which makes this cheap for the usual commit
+// that changes a few files.
+func svnTreeDiff(prefix string, old *PathMap, new *PathMap, delta *svnTreeDelta) {
+	if old == new {
+		return
+	}
+	join := func(name string) string {
+		if prefix == "" {
+			return name
+		}
+		return prefix + svnSep + name
+	}
+	for name := range old.blobs {
+		if _, ok := new.blobs[name]; !ok {
+			delta.deletes = append(delta.deletes, join(name))
+		}
+	}
+	for name := range old.dirs {
+		if _, ok := new.dirs[name]; !ok {
+			delta.deletes = append(delta.deletes, join(name))
+		}
+	}
+	for name, sub := range new.dirs {
+		if oldsub, ok := old.dirs[name]; ok {
+			svnTreeDiff(join(name), oldsub, sub, delta)
+		} else {
+			delta.adddirs = append(delta.adddirs, join(name))
+			svnTreeDiff(join(name), newPathMap(), sub, delta)
+		}
+	}
+	for name, value := range new.blobs {
+		op := value.(*FileOp)
+		oldvalue, ok := old.blobs[name]
+		if ok {
+			oldop := oldvalue.(*FileOp)
+			if oldop.mode == op.mode && oldop.ref == op.ref && bytes.Equal(oldop.inline, op.inline) {
+				continue
+			}
+		}
+		delta.files = append(delta.files, join(name))
+		delta.ops[join(name)] = op
+		delta.added[join(name)] = !ok
+	}
+}
+
+// fileNode writes the content and properties of a file.
+func (d *svnDumper) fileNode(path string, op *FileOp, add bool) {
+	content := opContent(op)
+	props := map[string]string{}
+	switch op.mode {
+	case "100755":
+		props["svn:executable"] = "*"
+	case "120000":
+		props["svn:special"] = "*"
+		content = append([]byte("link "), content...)
+	}
+	action := "change"
+	if add {
+		action = "add"
+	}
+	d.node(path, "file", action, "", 0, props, content)
+}
+
+// opContent returns the content a fileop sets.
+func opContent(op *FileOp) []byte {
+	if op.ref == "inline" {
+		return op.inline
+	}
+	if blob, ok := op.repo.markToEvent(op.ref).(*Blob); ok {
+		return blob.getContent()
+	}
+	panic(throw("command", "no blob for %s at %s", op.Path, op.ref))
+}
+
+func isIgnoreFile(path string) bool {
+	return path == ".gitignore" || strings.HasSuffix(path, svnSep+".gitignore")
+}
+
+// ignoreDir returns the directory an ignore file applies to.
+func ignoreDir(path string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(path, ".gitignore"), svnSep)
+}
+
+// ignoreText returns the content of the .gitignore in a directory of
+// a tree, or the empty string if there isn't one.
+func ignoreText(tree *PathMap, dir string) string {
+	path := ".gitignore"
+	if dir != "" {
+		path = dir + svnSep + path
+	}
+	if value, ok := tree.get(path); ok {
+		return string(opContent(value.(*FileOp)))
+	}
+	return ""
+}
+
+func dirExists(tree *PathMap, dir string) bool {
+	for _, component := range strings.Split(dir, svnSep) {
+		sub, ok := tree.dirs[component]
+		if !ok {
+			return false
+		}
+		tree = sub
+	}
+	return true
+}
+
+// svnIgnores is the inverse of the reader's translation of ignore
+// properties.  It splits .gitignore content into an svn:ignore value,
+// made of patterns anchored to the directory, an svn:global-ignores
+// value, made of unanchored ones, and whatever neither can express,
+// which is left in the tree.  The reader's simulation of Subversion's
+// default ignores is dropped, since Subversion supplies those itself.
+func svnIgnores(content string) (ignore string, global string, intree string) {
+	var ign, glob, rest strings.Builder
+	defaults := false
+	lines := strings.SplitAfter(content, "\n")
+	for i, line := range lines {
+		bare := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(bare, "# A simulation of Subversion default ignores"):
+			defaults = true
+		case strings.HasPrefix(bare, "# Simulated Subversion default ignores end here"):
+			defaults = false
+		case defaults:
+		case bare == "# In-tree .gitignore contents start here":
+			rest.WriteString(strings.Join(lines[i+1:], ""))
+			return ign.String(), glob.String(), rest.String()
+		case bare == "" || strings.HasPrefix(bare, "#"):
+		case strings.HasPrefix(bare, "/") && !strings.ContainsAny(bare[1:], "/!"):
+			ign.WriteString(bare[1:] + "\n")
+		case !strings.ContainsAny(bare, "/!\\"):
+			glob.WriteString(bare + "\n")
+		default:
+			rest.WriteString(bare + "\n")
+		}
+	}
+	return ign.String(), glob.String(), rest.String()
+}
+
+// ignoresChanged tells whether the ignore properties of a directory
+// differ between two trees.
+func ignoresChanged(before *PathMap, after *PathMap, dir string) bool {
+	oldIgnore, oldGlobal, _ := svnIgnores(ignoreText(before, dir))
+	newIgnore, newGlobal, _ := svnIgnores(ignoreText(after, dir))
+	return oldIgnore != newIgnore || oldGlobal != newGlobal
+}
+
+// dirProps returns the properties of a directory in a tree.  Only a
+// branch directory has merges.
+func dirProps(tree *PathMap, dir string, merges map[string]string) map[string]string {
+	props := make(map[string]string)
+	ignore, global, _ := svnIgnores(ignoreText(tree, dir))
+	if ignore != "" {
+		props["svn:ignore"] = ignore
+	}
+	if global != "" {
+		props["svn:global-ignores"] = global
+	}
+	for k, v := range mergeinfoProps(merges) {
+		props[k] = v
+	}
+	return props
+}
+
+// mergeinfo renders a branch directory's merge record as properties.
+func mergeinfoProps(merges map[string]string) map[string]string {
+	if len(merges) == 0 {
+		return nil
+	}
+	sources := make([]string, 0, len(merges))
+	for source := range merges {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	lines := make([]string, len(sources))
+	for i, source := range sources {
+		lines[i] = source + ":" + merges[source]
+	}
+	return map[string]string{"svn:mergeinfo": strings.Join(lines, "\n")}
+}
+
+// writeCommit writes a commit as a revision.
+func (d *svnDumper) writeCommit(commit *Commit) {
+	dir := d.branchDir(commit.Branch)
+	var parent *Commit
+	if p, ok := commit.firstParent().(*Commit); ok {
+		if _, written := d.revs[p]; written {
+			parent = p
+		}
+	}
+	// Merges from other parents, added to what the directory records
+	merges := d.merges[dir]
+	if tip, ok := d.tips[dir]; !ok || tip != parent {
+		if parent != nil {
+			merges = d.mergesAt[parent]
+		} else {
+			merges = nil
+		}
+	}
+	mergesChanged := false
+	for i, p := range commit.parents() {
+		p, ok := p.(*Commit)
+		if i == 0 || !ok {
+			continue
+		}
+		source, written := d.dirs[p]
+		if !written || source == dir {
+			continue
+		}
+		span := fmt.Sprintf("%d-%d", d.created[source], d.revs[p])
+		if merges["/"+source] != span {
+			if !mergesChanged {
+				clone := make(map[string]string, len(merges)+1)
+				for k, v := range merges {
+					clone[k] = v
+				}
+				merges = clone
+				mergesChanged = true
+			}
+			merges["/"+source] = span
+		}
+	}
+
+	d.revisionHeader(d.revisionProps(commit.committer, commit.Comment, commit.properties))
+	if d.revision == 1 {
+		for _, top := range []string{"branches", "tags", "trunk"} {
+			d.node(top, "dir", "add", "", 0, map[string]string{}, nil)
+			d.made[top] = true
+		}
+		d.created["trunk"] = 1
+		d.tips["trunk"] = nil
+	}
+	before := newPathMap()
+	if parent != nil {
+		before = &parent.manifest().PathMap
+	}
+	after := &commit.manifest().PathMap
+	rootChanged := mergesChanged || ignoresChanged(before, after, "")
+	if tip, ok := d.tips[dir]; ok && tip == parent && (tip != nil || d.created[dir] == d.revision) {
+		if rootChanged {
+			d.node(dir, "dir", "change", "", 0, dirProps(after, "", merges), nil)
+		}
+	} else if parent == nil || rootChanged {
+		d.placeBranch(dir, parent, dirProps(after, "", merges))
+	} else {
+		d.placeBranch(dir, parent, nil)
+	}
+	d.merges[dir] = merges
+
+	delta := svnTreeDelta{ops: make(map[string]*FileOp), added: make(map[string]bool)}
+	svnTreeDiff("", before, after, &delta)
+	sort.Strings(delta.deletes)
+	sort.Strings(delta.adddirs)
+	sort.Strings(delta.files)
+	// A .gitignore changes its directory's properties, and only
+	// what they can't express is left in the tree.
+	propdirs := newOrderedStringSet()
+	intree := func(path string) {
+		sub := ignoreDir(path)
+		if ignoresChanged(before, after, sub) {
+			propdirs.Add(sub)
+		}
+		_, _, old := svnIgnores(ignoreText(before, sub))
+		_, _, new := svnIgnores(ignoreText(after, sub))
+		if new == "" && old != "" {
+			d.node(dir+svnSep+path, "", "delete", "", 0, nil, nil)
+		} else if new != old {
+			action := "change"
+			if old == "" {
+				action = "add"
+			}
+			d.node(dir+svnSep+path, "file", action, "", 0, map[string]string{}, []byte(new))
+		}
+	}
+	for _, path := range delta.deletes {
+		if isIgnoreFile(path) {
+			intree(path)
+		} else if !d.gitlinkAt(before, path) {
+			d.node(dir+svnSep+path, "", "delete", "", 0, nil, nil)
+		}
+	}
+	added := newOrderedStringSet("")
+	for _, path := range delta.adddirs {
+		d.node(dir+svnSep+path, "dir", "add", "", 0, dirProps(after, path, nil), nil)
+		added.Add(path)
+	}
+	for _, path := range delta.files {
+		op := delta.ops[path]
+		if isIgnoreFile(path) {
+			intree(path)
+			continue
+		}
+		if op.mode == gitlinkMode {
+			warn("svn", "%s: gitlink at %s dropped", commit.idMe(), path)
+			continue
+		}
+		// A file replacing a gitlink is an add
+		add := delta.added[path]
+		if !add && d.gitlinkAt(before, path) {
+			add = true
+		}
+		d.fileNode(dir+svnSep+path, op, add)
+	}
+	for _, sub := range propdirs {
+		if !added.Contains(sub) && dirExists(after, sub) {
+			d.node(dir+svnSep+sub, "dir", "change", "", 0, dirProps(after, sub, nil), nil)
+		}
+	}
+	d.revs[commit] = d.revision
+	d.dirs[commit] = dir
+	d.tips[dir] = commit
+	d.mergesAt[commit] = merges
+}
+
+// gitlinkAt tells whether a tree has a gitlink at a path, which was
+// never written to the dump.
+func (d *svnDumper) gitlinkAt(tree *PathMap, path string) bool {
+	value, ok := tree.get(path)
+	return ok && value.(*FileOp).mode == gitlinkMode
+}
+
+// writeCopy writes a revision copying the directory a commit was
+// written to into the directory for ref; this is how Subversion
+// represents tags, and branches made without new commits.
+func (d *svnDumper) writeCopy(ref string, commit *Commit, attr Attribution, log string) {
+	if _, ok := d.revs[commit]; !ok {
+		warn("svn", "%s points at %s, which is not in the dump", ref, commit.idMe())
+		return
+	}
+	dir := d.branchDir(ref)
+	if tip, ok := d.tips[dir]; ok && tip == commit {
+		return
+	}
+	d.revisionHeader(d.revisionProps(attr, log, nil))
+	d.placeBranch(dir, commit, nil)
+}
+
+// svnDump writes the repository as a Subversion dump stream.
+func (repo *Repository) svnDump(w io.Writer, baton *Baton) {
+	d := &svnDumper{
+		repo:     repo,
+		w:        w,
+		trunk:    "refs/heads/master",
+		revs:     make(map[*Commit]int),
+		dirs:     make(map[*Commit]string),
+		tips:     make(map[string]*Commit),
+		created:  make(map[string]int),
+		made:     make(map[string]bool),
+		merges:   make(map[string]map[string]string),
+		mergesAt: make(map[*Commit]map[string]string),
+	}
+	branches := repo.branchset()
+	if !branches.Contains(d.trunk) && branches.Contains("refs/heads/main") {
+		d.trunk = "refs/heads/main"
+	}
+	fmt.Fprintf(w, "SVN-fs-dump-format-version: 2\n\n")
+	if repo.uuid != "" {
+		fmt.Fprintf(w, "UUID: %s\n\n", repo.uuid)
+	}
+	// Revision 0 is dated when the repository would have been made
+	var start Date
+	if commits := repo.commits(undefinedSelectionSet); len(commits) > 0 {
+		start = commits[0].committer.date
+	} else {
+		start = Date{timestamp: time.Unix(0, 0)}
+	}
+	p := svnProps(map[string]string{"svn:date": svnDate(start)})
+	fmt.Fprintf(w, "Revision-number: 0\nProp-content-length: %d\nContent-length: %d\n\n%s\n", len(p), len(p), p)
+
+	baton.startProgress("svn dump", uint64(len(repo.events)))
+	for i, event := range repo.events {
+		switch e := event.(type) {
+		case *Commit:
+			d.writeCommit(e)
+		case *Tag:
+			if commit, ok := repo.markToEvent(e.committish).(*Commit); ok {
+				d.writeCopy("refs/tags/"+e.tagname, commit, e.tagger, e.Comment)
+			}
+		case *Reset:
+			if commit, ok := repo.markToEvent(e.committish).(*Commit); ok {
+				d.writeCopy(e.ref, commit, commit.committer, fmt.Sprintf("Create %s.\n", e.ref))
+			}
+		}
+		baton.percentProgress(uint64(i) + 1)
+	}
+	baton.endProgress()
+}
+
+// end
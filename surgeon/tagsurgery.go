@@ -0,0 +1,197 @@
+/*
+ * Bulk tag surgery: renaming by substitution, retargeting, deduplication
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Conversions from older systems tend to leave tags that need fixing
+// in bulk rather than one at a time: names in a scheme nobody wants
+// any more, tags on commits that are about to be squashed out of the
+// history, and several tags on one commit because the old system made
+// a tag per directory or per build.  These are the operations for
+// that.  Each works on the annotated tags in a selection and sets Q
+// bits on what it changes.
+
+// renameTags renames tags by regexp substitution.  Nothing is renamed
+// if two tags would end up with the same name, or a tag would take the
+// name of one that isn't being renamed.  Returns the number of tags
+// renamed.
+func (repo *Repository) renameTags(tags []*Tag, re *regexp.Regexp, replacement string) (int, error) {
+	renaming := make(map[*Tag]string)
+	claimed := make(map[string]*Tag)
+	for _, tag := range tags {
+		newname := GoReplacer(re, tag.tagname, replacement)
+		if newname == tag.tagname {
+			continue
+		}
+		if newname == "" {
+			return 0, fmt.Errorf("tag %s would be renamed to nothing", tag.tagname)
+		}
+		if other, ok := claimed[newname]; ok {
+			return 0, fmt.Errorf("tags %s and %s would both be renamed %s", other.tagname, tag.tagname, newname)
+		}
+		claimed[newname] = tag
+		renaming[tag] = newname
+	}
+	for _, event := range repo.events {
+		if tag, ok := event.(*Tag); ok {
+			if _, moving := renaming[tag]; moving {
+				continue
+			}
+			if other, ok := claimed[tag.tagname]; ok {
+				return 0, fmt.Errorf("tag %s would be renamed %s, which is already a tag", other.tagname, tag.tagname)
+			}
+		}
+	}
+	repo.clearColor(colorQSET)
+	for tag, newname := range renaming {
+		tag.tagname = newname
+		tag.addColor(colorQSET)
+	}
+	return len(renaming), nil
+}
+
+// survivingAncestor returns the nearest ancestor of a commit that the
+// doomed predicate doesn't reject, searching breadth-first with first
+// parents ahead of the others, or nil if there is none.
+func survivingAncestor(commit *Commit, doomed func(*Commit) bool) *Commit {
+	seen := map[*Commit]bool{commit: true}
+	queue := []*Commit{commit}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, parent := range current.parents() {
+			ancestor, ok := parent.(*Commit)
+			if !ok || seen[ancestor] {
+				continue
+			}
+			if !doomed(ancestor) {
+				return ancestor
+			}
+			seen[ancestor] = true
+			queue = append(queue, ancestor)
+		}
+	}
+	return nil
+}
+
+// retargetTags moves every tag on a selected commit to the nearest
+// ancestor of that commit outside the selection, so the commits can be
+// deleted without taking their tags with them.  Tags whose target no
+// longer exists are reported, since there's no history left to find an
+// ancestor in.  Returns the number of tags moved.
+func (repo *Repository) retargetTags(selection selectionSet) int {
+	repo.clearColor(colorQSET)
+	doomed := func(commit *Commit) bool {
+		return selection.Contains(repo.eventToIndex(commit))
+	}
+	moved := 0
+	for _, event := range repo.events {
+		tag, ok := event.(*Tag)
+		if !ok {
+			continue
+		}
+		commit, ok := repo.markToEvent(tag.committish).(*Commit)
+		if !ok {
+			if logEnable(logWARN) {
+				logit("tag %s points at %s, which is not a commit", tag.tagname, tag.committish)
+			}
+			continue
+		}
+		if !doomed(commit) {
+			continue
+		}
+		target := survivingAncestor(commit, doomed)
+		if target == nil {
+			if logEnable(logWARN) {
+				logit("tag %s on %s has no ancestor outside the selection", tag.tagname, commit.idMe())
+			}
+			continue
+		}
+		tag.forget()
+		tag.remember(repo, target.mark)
+		tag.addColor(colorQSET)
+		target.addColor(colorQSET)
+		moved++
+	}
+	return moved
+}
+
+// dedupeTags merges selected tags that point at the same commit, or
+// at equivalent ones, into the earliest of them, appending the comments
+// of the others that say something different.  The others are deleted.
+// Returns the number of tags deleted.
+func (repo *Repository) dedupeTags(selection selectionSet, baton *Baton) int {
+	repo.clearColor(colorQSET)
+	groups := make(map[string][]*Tag)
+	order := make([]string, 0)
+	// Tags are grouped by the target of the first tag in the group
+	group := func(tag *Tag) string {
+		if commit, ok := repo.markToEvent(tag.committish).(*Commit); ok {
+			for _, committish := range order {
+				if other, ok := repo.markToEvent(committish).(*Commit); ok && commit.equivalent(other) {
+					return committish
+				}
+			}
+		}
+		return tag.committish
+	}
+	for it := selection.Iterator(); it.Next(); {
+		if tag, ok := repo.events[it.Value()].(*Tag); ok {
+			committish := group(tag)
+			if _, ok := groups[committish]; !ok {
+				order = append(order, committish)
+			}
+			groups[committish] = append(groups[committish], tag)
+		}
+	}
+	doomed := make([]*Tag, 0)
+	for _, committish := range order {
+		tags := groups[committish]
+		if len(tags) < 2 {
+			continue
+		}
+		keeper := tags[0]
+		comments := newOrderedStringSet()
+		for i, tag := range tags {
+			if !emptyComment(tag.Comment) {
+				comments.Add(strings.TrimSpace(tag.Comment))
+			}
+			if i > 0 {
+				doomed = append(doomed, tag)
+			}
+		}
+		if len(comments) > 1 {
+			keeper.Comment = strings.Join(comments, control.lineSep+control.lineSep) + control.lineSep
+		} else if len(comments) == 1 && emptyComment(keeper.Comment) {
+			keeper.Comment = comments[0] + control.lineSep
+		}
+		keeper.addColor(colorQSET)
+	}
+	if len(doomed) == 0 {
+		return 0
+	}
+	indices := make([]int, len(doomed))
+	for i, tag := range doomed {
+		indices[i] = tag.index()
+	}
+	sort.Ints(indices)
+	repo.delete(newSelectionSet(indices...), nil, baton)
+	for _, tag := range doomed {
+		tag.forget()
+	}
+	repo.declareSequenceMutation("tag deduplication")
+	return len(doomed)
+}
+
+// end
@@ -0,0 +1,92 @@
+/*
+ * Repair of branch tips and resets
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// In a fast-import stream a branch ends up at the last commit carrying
+// its name, or wherever the last reset of it points.  After heavy
+// deletion the two can drift apart from the shape of the DAG: resets
+// are left pointing at marks that no longer exist, which importers
+// reject, and a line of development whose tip shares a branch name
+// with a later commit loses its only ref, so the importer silently
+// drops it.  The repair pass removes the dangling resets and gives
+// each such tip a reset of its own.
+
+// unreferencedTips returns the childless commits no ref would point at
+// after import.
+func (repo *Repository) unreferencedTips() []*Commit {
+	tips := repo.branchtipmap()
+	orphans := make([]*Commit, 0)
+	for _, commit := range repo.commits(undefinedSelectionSet) {
+		if commit.hasChildren() || tips[commit.Branch] == commit || len(commit.attachments) > 0 {
+			continue
+		}
+		orphans = append(orphans, commit)
+	}
+	return orphans
+}
+
+// tipRefName invents a ref for an unreferenced tip, derived from its
+// branch and mark and not already in use.
+func tipRefName(commit *Commit, used map[string]bool) string {
+	base := fmt.Sprintf("%s-%s", commit.Branch, strings.TrimPrefix(commit.mark, ":"))
+	name := base
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+	used[name] = true
+	return name
+}
+
+// repairTips removes dangling resets and adds resets for unreferenced
+// tips, reporting each change to w.  Returns the number of changes.
+// Added resets and the tips they point at get Q bits.
+func (repo *Repository) repairTips(w io.Writer, baton *Baton) int {
+	repo.clearColor(colorQSET)
+	dangling := newSelectionSet()
+	used := make(map[string]bool)
+	for i, event := range repo.events {
+		if reset, ok := event.(*Reset); ok {
+			used[reset.ref] = true
+			if strings.HasPrefix(reset.committish, ":") && repo.markToEvent(reset.committish) == nil {
+				dangling.Add(i)
+			}
+		}
+	}
+	for _, branch := range repo.branchset() {
+		used[branch] = true
+	}
+	orphans := repo.unreferencedTips()
+	if dangling.Size() == 0 && len(orphans) == 0 {
+		return 0
+	}
+	repo.checkpointUndo("repair", baton)
+	for it := dangling.Iterator(); it.Next(); {
+		reset := repo.events[it.Value()].(*Reset)
+		fmt.Fprintf(w, "removed reset %s -> %s (no such event)\n", reset.ref, reset.committish)
+		reset.forget()
+	}
+	if dangling.Size() > 0 {
+		repo.delete(dangling, nil, baton)
+	}
+	for _, commit := range orphans {
+		reset := newReset(repo, tipRefName(commit, used), commit.mark, commit.legacyID)
+		repo.addEvent(reset)
+		reset.addColor(colorQSET)
+		commit.addColor(colorQSET)
+		fmt.Fprintf(w, "added reset %s -> %s (unreferenced tip)\n", reset.ref, commit.mark)
+	}
+	return dangling.Size() + len(orphans)
+}
+
+// end
@@ -0,0 +1,217 @@
+/*
+ * Commit topology lint: merge shapes that trouble downstream tools
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Git is happy with any parent list, but not everything that reads a
+// repository is.  Some review tools and exporters to other systems
+// give up on a merge with many parents; a commit naming the same
+// parent twice, which a careless import or a squash can leave behind,
+// is rejected by git fsck; a merge of a commit with one of its own
+// ancestors says nothing the first-parent line doesn't; and a
+// criss-cross merge, one whose parents have more than one best common
+// ancestor, gives three-way merge tools no single base to work from.
+//
+// Finding common ancestors is the paint-down walk git merge-base does,
+// from both parents at once in reverse event order, which is a
+// topological order, stopping once everything still queued is known
+// to be an ancestor of a common ancestor already found.
+
+// topologyFlags mark the progress of the common-ancestor walk.
+const (
+	paintLeft uint8 = 1 << iota
+	paintRight
+	paintStale
+	paintResult
+)
+
+// topologyWalker finds common ancestors of pairs of commits.
+type topologyWalker struct {
+	order   map[*Commit]int
+	commits []*Commit
+}
+
+func newTopologyWalker(repo *Repository) *topologyWalker {
+	walker := &topologyWalker{order: make(map[*Commit]int), commits: repo.commits(undefinedSelectionSet)}
+	for i, commit := range walker.commits {
+		walker.order[commit] = i
+	}
+	return walker
+}
+
+// mergeBases returns the best common ancestors of two commits, those
+// that aren't ancestors of other common ancestors, in event order.
+func (walker *topologyWalker) mergeBases(left *Commit, right *Commit) []*Commit {
+	if left == right {
+		return []*Commit{left}
+	}
+	flags := make(map[*Commit]uint8)
+	queue := new(IntHeap)
+	push := func(commit *Commit) {
+		// Latest first
+		heap.Push(queue, -walker.order[commit])
+	}
+	live := func() bool {
+		for _, n := range *queue {
+			if flags[walker.commits[-n]]&paintStale == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	flags[left], flags[right] = paintLeft, paintRight
+	push(left)
+	push(right)
+	found := make([]*Commit, 0)
+	for queue.Len() > 0 && live() {
+		commit := walker.commits[-heap.Pop(queue).(int)]
+		paint := flags[commit] & (paintLeft | paintRight | paintStale)
+		if paint == paintLeft|paintRight {
+			if flags[commit]&paintResult == 0 {
+				flags[commit] |= paintResult
+				found = append(found, commit)
+			}
+			paint |= paintStale
+		}
+		for it := commit.parentIterator(); it.Next(); {
+			parent, ok := it.Value().(*Commit)
+			if !ok || flags[parent]&paint == paint {
+				continue
+			}
+			flags[parent] |= paint
+			push(parent)
+		}
+	}
+	// A common ancestor found early can still be an ancestor of
+	// one found later.
+	best := make([]*Commit, 0, len(found))
+	for _, candidate := range found {
+		redundant := false
+		for _, other := range found {
+			if other != candidate && walker.isAncestor(candidate, other) {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			best = append(best, candidate)
+		}
+	}
+	sort.Slice(best, func(i, j int) bool { return walker.order[best[i]] < walker.order[best[j]] })
+	return best
+}
+
+// isAncestor tells whether one commit is an ancestor of another.  The
+// search goes no further back than the candidate.
+func (walker *topologyWalker) isAncestor(ancestor *Commit, descendant *Commit) bool {
+	floor := walker.order[ancestor]
+	seen := make(map[*Commit]bool)
+	stack := []*Commit{descendant}
+	for len(stack) > 0 {
+		commit := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if commit == ancestor {
+			return true
+		}
+		if seen[commit] || walker.order[commit] < floor {
+			continue
+		}
+		seen[commit] = true
+		for it := commit.parentIterator(); it.Next(); {
+			if parent, ok := it.Value().(*Commit); ok {
+				stack = append(stack, parent)
+			}
+		}
+	}
+	return false
+}
+
+// topologyLint reports, for the selected commits, merges with more
+// than maxParents parents, parent lists naming a parent more than once,
+// merges with a parent that is an ancestor of another, and criss-cross
+// merges.  Each category that turns up anything ends with a selection
+// of its commits, which can be pasted into a command to repair them.
+// Commits with problems get Q bits, which the caller clears.  Returns
+// the number of problems found.
+func (repo *Repository) topologyLint(w io.Writer, selection selectionSet, maxParents int) int {
+	walker := newTopologyWalker(repo)
+	type category struct {
+		name    string
+		reports []string
+		commits []string
+	}
+	octopus := &category{name: "octopus merges"}
+	duplicates := &category{name: "duplicate parents"}
+	redundant := &category{name: "redundant parents"}
+	crisscross := &category{name: "criss-cross merges"}
+	flag := func(cat *category, commit *Commit, report string) {
+		cat.reports = append(cat.reports, report)
+		if n := len(cat.commits); n == 0 || cat.commits[n-1] != commit.mark {
+			cat.commits = append(cat.commits, commit.mark)
+		}
+		commit.addColor(colorQSET)
+	}
+	for _, commit := range repo.commits(selection) {
+		parents := make([]*Commit, 0)
+		seen := make(map[CommitLike]bool)
+		for it := commit.parentIterator(); it.Next(); {
+			parent := it.Value()
+			if seen[parent] {
+				flag(duplicates, commit, fmt.Sprintf("%s lists %s more than once", commit.idMe(), parent.getMark()))
+				continue
+			}
+			seen[parent] = true
+			if p, ok := parent.(*Commit); ok {
+				parents = append(parents, p)
+			}
+		}
+		if maxParents > 0 && len(seen) > maxParents {
+			flag(octopus, commit, fmt.Sprintf("%s has %d parents", commit.idMe(), len(seen)))
+		}
+		for i := range parents {
+			for j := range parents {
+				if i != j && walker.isAncestor(parents[i], parents[j]) {
+					flag(redundant, commit, fmt.Sprintf("%s parent %s is an ancestor of parent %s",
+						commit.idMe(), parents[i].mark, parents[j].mark))
+				}
+			}
+		}
+		if len(parents) == 2 {
+			if bases := walker.mergeBases(parents[0], parents[1]); len(bases) > 1 {
+				marks := make([]string, len(bases))
+				for i, base := range bases {
+					marks[i] = base.mark
+				}
+				flag(crisscross, commit, fmt.Sprintf("%s merges parents with bases %s",
+					commit.idMe(), strings.Join(marks, ", ")))
+			}
+		}
+	}
+	problems := 0
+	for _, cat := range []*category{octopus, duplicates, redundant, crisscross} {
+		if len(cat.reports) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%d %s in Q set.\n", len(cat.reports), cat.name)
+		for _, report := range cat.reports {
+			fmt.Fprintf(w, "%s: %s\n", strings.TrimSuffix(cat.name, "s"), report)
+		}
+		fmt.Fprintf(w, "%s selection: %s\n", strings.TrimSuffix(cat.name, "s"), strings.Join(cat.commits, ","))
+		problems += len(cat.reports)
+	}
+	return problems
+}
+
+// end
@@ -0,0 +1,142 @@
+/*
+ * Moving comment trailers into commit properties and back
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Review and tracking tools record what they know about a commit in
+// trailers, "Key: value" lines in the last paragraph of its comment:
+// Reviewed-by, Bug, Change-Id.  Buried in comment text they can only be
+// got at with regular expressions, and a target that keeps commit
+// properties, such as a Subversion dump or a bzr stream, would rather
+// have them there.  So trailers can be moved into properties named by
+// their keys, and properties moved back into trailers.
+//
+// A trailer block is a last paragraph made only of trailers and their
+// continuation lines, which are indented; the first paragraph of a
+// comment, its summary, is never one.  Several trailers with one key
+// become one property whose value is their values a line each, and
+// such a property goes back as a trailer per line.
+
+// Matches the first line of a trailer
+var trailerRE = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*):[ \t]*(.*?)[ \t]*$`)
+
+// trailerBlock splits a comment into what precedes its trailer block
+// and the block's trailers, continuation lines folded in.  A comment
+// without a trailer block gives no trailers.
+func trailerBlock(comment string) (string, [][2]string) {
+	lines := strings.Split(strings.TrimRight(comment, "\n"), "\n")
+	start := len(lines)
+	for start > 0 && strings.TrimSpace(lines[start-1]) != "" {
+		start--
+	}
+	if start == 0 || start == len(lines) {
+		return comment, nil
+	}
+	trailers := make([][2]string, 0)
+	for _, line := range lines[start:] {
+		if m := trailerRE.FindStringSubmatch(line); m != nil {
+			trailers = append(trailers, [2]string{m[1], m[2]})
+		} else if len(trailers) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			trailers[len(trailers)-1][1] += " " + strings.TrimSpace(line)
+		} else {
+			return comment, nil
+		}
+	}
+	body := strings.TrimRight(strings.Join(lines[:start], "\n"), "\n")
+	if body != "" {
+		body += "\n"
+	}
+	return body, trailers
+}
+
+// trailersToProperties moves the trailers of a commit whose keys match
+// a pattern into properties, replacing properties of the same names.
+// Returns the number of trailers moved.
+func (commit *Commit) trailersToProperties(keyRE *regexp.Regexp) int {
+	body, trailers := trailerBlock(commit.Comment)
+	moved := make([][2]string, 0, len(trailers))
+	kept := make([][2]string, 0, len(trailers))
+	for _, trailer := range trailers {
+		if keyRE.MatchString(trailer[0]) {
+			moved = append(moved, trailer)
+		} else {
+			kept = append(kept, trailer)
+		}
+	}
+	if len(moved) == 0 {
+		return 0
+	}
+	if !commit.hasProperties() {
+		props := newOrderedMap()
+		commit.properties = &props
+	}
+	values := make(map[string][]string)
+	for _, trailer := range moved {
+		values[trailer[0]] = append(values[trailer[0]], trailer[1])
+		commit.properties.set(trailer[0], strings.Join(values[trailer[0]], "\n"))
+	}
+	for _, trailer := range kept {
+		body = joinTrailers(body, trailer[0], []string{trailer[1]})
+	}
+	commit.Comment = body
+	return len(moved)
+}
+
+// propertiesToTrailers moves the properties of a commit whose keys
+// match a pattern, and could be trailer keys, into trailers.  Returns
+// the number of trailers made.
+func (commit *Commit) propertiesToTrailers(keyRE *regexp.Regexp) int {
+	if !commit.hasProperties() {
+		return 0
+	}
+	made := 0
+	for _, key := range append([]string{}, commit.properties.keys...) {
+		if !keyRE.MatchString(key) || !trailerRE.MatchString(key+":") {
+			continue
+		}
+		values := strings.Split(strings.TrimRight(commit.properties.get(key), "\n"), "\n")
+		commit.Comment = joinTrailers(commit.Comment, key, values)
+		commit.properties.delete(key)
+		made += len(values)
+	}
+	if commit.properties.Len() == 0 {
+		commit.properties = nil
+	}
+	return made
+}
+
+// trailerProperties moves trailers whose keys match a pattern into
+// properties in the selected commits, or properties into trailers if
+// embed is set.  Changed commits get Q bits.  Returns the number of
+// trailers and of commits changed.
+func (repo *Repository) trailerProperties(selection selectionSet, keyRE *regexp.Regexp, embed bool) (int, int) {
+	repo.clearColor(colorQSET)
+	trailers, commits := 0, 0
+	for it := repo.commitIterator(selection); it.Next(); {
+		commit := it.commit()
+		var moved int
+		if embed {
+			moved = commit.propertiesToTrailers(keyRE)
+		} else {
+			moved = commit.trailersToProperties(keyRE)
+		}
+		if moved > 0 {
+			commit.hash.invalidate()
+			commit.addColor(colorQSET)
+			trailers += moved
+			commits++
+		}
+	}
+	return trailers, commits
+}
+
+// end
@@ -0,0 +1,160 @@
+/*
+ * Transplanting commits between repositories
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Unite and graft move whole repositories.  Sometimes only a commit or
+// two is wanted - a fix made in one conversion that belongs in
+// another - and that is a cherry-pick: the commit's fileops are
+// replayed, as a new commit, on top of a chosen commit of the other
+// repository.  The blobs the fileops refer to are copied along with
+// them under fresh marks, and legacy IDs come too, so the copy can
+// still be found by its Subversion revision or CVS cookie.
+//
+// A run of commits can be transplanted together.  A copied commit
+// whose parent was also copied is parented on that copy; the others go
+// onto the chosen commit.  Parents that weren't copied are otherwise
+// dropped, so a merge arrives as an ordinary commit.
+
+// transplantParent finds the commit a transplant goes onto, by mark
+// or action stamp.
+func (repo *Repository) transplantParent(id string) (*Commit, error) {
+	if commit, ok := repo.markToEvent(id).(*Commit); ok {
+		return commit, nil
+	}
+	if commit := repo.stampCommit(id); commit != nil {
+		return commit, nil
+	}
+	return nil, fmt.Errorf("%q doesn't identify exactly one commit of %s", id, repo.name)
+}
+
+// freshMark returns a mark not in use in a repository.
+func (repo *Repository) freshMark() string {
+	mark := repo.newmark()
+	for repo.markToEvent(mark) != nil {
+		mark = repo.newmark()
+	}
+	return mark
+}
+
+// transplant copies the selected commits of a repository, and the
+// blobs they refer to, onto a commit of another.  The copies go on the
+// named branch, or on the branch of the commit they go onto if that
+// is empty; in that case the commit must be the branch's tip, so no
+// commits are cut off from it.  Returns the copies, which get Q bits.
+// Nothing is changed if an error is returned.
+func (repo *Repository) transplant(source *Repository, selection selectionSet, onto *Commit, branch string) ([]*Commit, error) {
+	picked := source.commits(selection)
+	if len(picked) == 0 {
+		return nil, errors.New("no commits are selected")
+	}
+	if branch == "" {
+		if repo.branchtipmap()[onto.Branch] != onto {
+			return nil, fmt.Errorf("%s is not the tip of %s; name a branch for the copies", onto.idMe(), onto.Branch)
+		}
+		branch = onto.Branch
+	}
+	for _, commit := range picked {
+		for _, op := range commit.operations() {
+			if op.op == opN {
+				return nil, fmt.Errorf("%s has a note, which can't be transplanted", commit.idMe())
+			}
+			if op.op == opM && op.ref != "inline" && op.mode != gitlinkMode {
+				if _, ok := source.markToEvent(op.ref).(*Blob); !ok {
+					return nil, fmt.Errorf("in %s, %s is not a blob", commit.idMe(), op.ref)
+				}
+			}
+		}
+	}
+	cookies := make(map[*Commit][]string)
+	for cookie, commit := range source.legacyMap {
+		cookies[commit] = append(cookies[commit], cookie)
+	}
+	repo.clearColor(colorQSET)
+	copies := make(map[*Commit]*Commit)
+	blobs := make(map[string]string)
+	made := make([]*Commit, 0, len(picked))
+	for _, commit := range picked {
+		ops := make([]*FileOp, 0, len(commit.operations()))
+		for _, op := range commit.operations() {
+			var newop *FileOp
+			switch op.op {
+			case opM:
+				ref := op.ref
+				if ref != "inline" && op.mode != gitlinkMode {
+					if _, ok := blobs[ref]; !ok {
+						blob := source.markToEvent(ref).(*Blob).clone(repo)
+						blob.opset = nil
+						blob.mark = repo.freshMark() // Not in the event list yet
+						blob.uuid = ""
+						repo.addEvent(blob)
+						blobs[ref] = blob.mark
+					}
+					ref = blobs[ref]
+				}
+				newop = newFileOp(repo).construct(opM, op.mode, ref, op.Path)
+				if op.ref == "inline" {
+					newop.inline = make([]byte, len(op.inline))
+					copy(newop.inline, op.inline)
+				}
+			case opD:
+				newop = newFileOp(repo).construct(opD, op.Path)
+			case opR, opC:
+				newop = newFileOp(repo).construct(op.op, op.Source, op.Path)
+			case deleteall:
+				newop = newFileOp(repo).construct(deleteall)
+			}
+			ops = append(ops, newop)
+		}
+		copied := commit.clone(repo)
+		copied.mark = repo.freshMark()
+		copied.uuid = ""
+		copied.Branch = branch
+		copied.recorded = nil
+		copied.implicitParent = false
+		if commit.hasProperties() {
+			props := newOrderedMap()
+			for _, key := range commit.properties.keys {
+				props.set(key, commit.properties.get(key))
+			}
+			copied.properties = &props
+		}
+		copied.setOperations(ops)
+		parents := make([]CommitLike, 0)
+		for _, parent := range commit.parents() {
+			if p, ok := parent.(*Commit); ok && copies[p] != nil {
+				parents = append(parents, copies[p])
+			}
+		}
+		if len(parents) == 0 {
+			parents = append(parents, onto)
+		}
+		copied.setParents(parents)
+		repo.addEvent(copied)
+		copied.addColor(colorQSET)
+		copies[commit] = copied
+		made = append(made, copied)
+		for _, cookie := range cookies[commit] {
+			if _, ok := repo.legacyMap[cookie]; ok {
+				if logEnable(logWARN) {
+					logit("legacy ID %s is already in use in %s", cookie, repo.name)
+				}
+				continue
+			}
+			repo.setLegacy(cookie, copied)
+		}
+	}
+	repo.declareSequenceMutation("")
+	return made, nil
+}
+
+// end
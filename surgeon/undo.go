@@ -0,0 +1,163 @@
+/*
+ * Undo and redo of surgical operations
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// When a squash, delete, reorder or renumber goes wrong on a big
+// repository, writing it out beforehand and reading it back afterwards
+// is the slow way back.  Instead each of those operations first saves
+// the repository's state in the session format, which records
+// structure and metadata but shares blob content rather than copying
+// it, into a journal in the repository's scratch directory.  Undo
+// restores the newest saved state and keeps the state it replaces for
+// redo.  The journal holds a bounded number of states; any new
+// operation forgets whatever could have been redone.
+
+// How many operations can be undone
+const undoDepth = 5
+
+type undoEntry struct {
+	label string // The operation that followed the save
+	file  string
+}
+
+type undoJournal struct {
+	dir  string
+	seq  int
+	undo []undoEntry
+	redo []undoEntry
+}
+
+// drop removes a saved state.
+func (e undoEntry) drop() {
+	os.Remove(e.file)
+	os.RemoveAll(sessionBlobDir(e.file))
+}
+
+// save records the state of a repository.
+func (j *undoJournal) save(repo *Repository, label string, baton *Baton) (undoEntry, error) {
+	if err := os.MkdirAll(j.dir, userReadWriteSearchMode); err != nil {
+		return undoEntry{}, err
+	}
+	j.seq++
+	entry := undoEntry{label, filepath.Join(j.dir, fmt.Sprintf("%d", j.seq))}
+	if _, err := repo.saveSession(entry.file, baton); err != nil {
+		entry.drop()
+		return undoEntry{}, err
+	}
+	return entry, nil
+}
+
+// checkpointUndo saves the state of the repository before an
+// operation described by label.  A failure to save is only a warning;
+// the operation can go ahead, but not be undone.
+func (repo *Repository) checkpointUndo(label string, baton *Baton) {
+	if repo.undo == nil {
+		repo.undo = &undoJournal{dir: filepath.Join(repo.subdir(""), "undo")}
+	}
+	j := repo.undo
+	entry, err := j.save(repo, label, baton)
+	if err != nil {
+		if logEnable(logWARN) {
+			logit("%s can't be undone: %v", label, err)
+		}
+		return
+	}
+	j.undo = append(j.undo, entry)
+	if len(j.undo) > undoDepth {
+		j.undo[0].drop()
+		j.undo = j.undo[1:]
+	}
+	for _, e := range j.redo {
+		e.drop()
+	}
+	j.redo = nil
+}
+
+// journalSeq returns the number of states the journal of a repository
+// has saved, which every checkpoint, undo and redo advances.
+func (repo *Repository) journalSeq() int {
+	if repo.undo == nil {
+		return 0
+	}
+	return repo.undo.seq
+}
+
+// forgetUndo discards the journal of a repository.  It is called after
+// a command that may have altered the repository without saving its
+// state first, since restoring an earlier state would then silently
+// revert that command as well.
+func (repo *Repository) forgetUndo() {
+	j := repo.undo
+	if j == nil {
+		return
+	}
+	for _, e := range j.undo {
+		e.drop()
+	}
+	for _, e := range j.redo {
+		e.drop()
+	}
+	j.undo, j.redo = nil, nil
+}
+
+// discardBlobs removes the blob files of a repository replaced by a
+// restored state.  Its scratch directory is left alone, since the
+// replacement has the same name and uses it.
+func (repo *Repository) discardBlobs() {
+	for _, event := range repo.events {
+		if blob, ok := event.(*Blob); ok && blob.hasfile() && blob.abspath == "" {
+			os.Remove(blob.getBlobfile(false))
+		}
+	}
+	sharedBlobs.release(repo)
+}
+
+// stepJournal moves the repository one step back (undo) or forward
+// (redo) through its journal, returning the repository to replace it
+// and the label of the operation undone or redone.
+func (repo *Repository) stepJournal(back bool, baton *Baton) (*Repository, string, error) {
+	j := repo.undo
+	if j == nil {
+		j = &undoJournal{}
+	}
+	from, to := &j.redo, &j.undo
+	if back {
+		from, to = &j.undo, &j.redo
+	}
+	if len(*from) == 0 {
+		if back {
+			return nil, "", fmt.Errorf("nothing to undo")
+		}
+		return nil, "", fmt.Errorf("nothing to redo")
+	}
+	entry := (*from)[len(*from)-1]
+	current, err := j.save(repo, entry.label, baton)
+	if err != nil {
+		return nil, "", err
+	}
+	restored, err := restoreSession(entry.file, repo.name, nil, baton)
+	if err != nil {
+		current.drop()
+		return nil, "", err
+	}
+	entry.drop()
+	*from = (*from)[:len(*from)-1]
+	*to = append(*to, current)
+	restored.undo = j
+	restored.legacyLog, repo.legacyLog = repo.legacyLog, nil
+	repo.discardBlobs()
+	return restored, entry.label, nil
+}
+
+// end
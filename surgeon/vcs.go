@@ -9,6 +9,7 @@ import (
 	"bufio"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -24,8 +25,17 @@ import (
 //     "export-progress" = exporter generates its own progress messages,
 //                         no need for baton prompt.
 //     "import-defaults" = Import sets default ignores
+//     "utf8-only" = Importer rejects comments and names that aren't UTF-8
 //
-// Preserve and prenuke parts can be directories.
+// Extensions are stream features beyond the git core that the importer
+// accepts: "empty-directories", "multiple-authors", "commit-properties",
+// and "notes".
+//
+// Preserve and prenuke parts can be directories.  Preserve parts can
+// also be glob patterns, expanded in the backup directory at rebuild
+// time.  A rebuild restores the target VCS's preserve parts as well as
+// the repository's own, so hooks and configuration survive it even
+// when the history came from somewhere else.
 //
 // Note that some of the commands used here are plugins or extensions
 // that are not part of the basic VCS. Thus these may fail when called;
@@ -200,8 +210,8 @@ type VCS struct {
 // the pattern applies only to the repository root."  Rule A, with the
 // ignASLASH feature.
 //
-// There's no direct p4 support yet. What's recorded here anticipates
-// that that might someday change. There's a supplement to the p4 docs at
+// p4 is read-only, through an extractor. There's a supplement to the
+// p4 docs at
 // https://stackoverflow.com/questions/18240084/how-does-perforce-ignore-file-syntax-differ-from-gitignore-syntax
 //
 // Yes, the capability flags defined below aren't all used. Yet.
@@ -240,6 +250,15 @@ const dottedNumeric = `\s[0-9]+(\.[0-9]+[.]?)+\s`
 const shortGitHash = `\b[0-9a-fA-F]{6}[^0-9a-zA-z]`
 const longGitHash = `\b[0-9a-fA-F]{40}[^0-9a-zA-z]`
 
+// p4ConfigFile is the name of the file that marks a Perforce workspace.
+// The p4 extractor reads its settings from the same file.
+func p4ConfigFile() string {
+	if name := os.Getenv("P4CONFIG"); name != "" {
+		return name
+	}
+	return ".p4config"
+}
+
 // manages tells us if a directory might be managed by this VCS
 func (vcs VCS) manages(dirname string) bool {
 	if vcs.subdirectory != "" {
@@ -264,6 +283,10 @@ func (vcs VCS) manages(dirname string) bool {
 	if vcs.name == "fossil" && isdir(".fslckout") {
 		return true
 	}
+	// Could be a Perforce workspace, look for its P4CONFIG file.
+	if vcs.name == "p4" && exists(filepath.Join(dirname, p4ConfigFile())) {
+		return true
+	}
 	return false
 }
 
@@ -326,12 +349,14 @@ func vcsInit() {
 		{
 			name:         "git",
 			subdirectory: ".git",
-			// Requires git 2.19.2 or later for --show-original-ids
+			// Requires git 2.19.2 or later for --show-original-ids.
+			// Replace refs and grafts are read separately, so the
+			// export has to see past them to the real history.
 			requires:     newStringSet("git", "cut", "grep"),
-			exporter:     "git fast-export --show-original-ids --signed-tags=verbatim --tag-of-filtered-object=drop --use-done-feature --all",
+			exporter:     "GIT_NO_REPLACE_OBJECTS=1 GIT_GRAFT_FILE=.git/info/no-grafts git fast-export --show-original-ids --signed-tags=verbatim --tag-of-filtered-object=drop --use-done-feature --exclude='refs/replace/*' --all",
 			quieter:      "",
 			styleflags:   newOrderedStringSet(),
-			extensions:   newOrderedStringSet(),
+			extensions:   newOrderedStringSet("notes"),
 			initializer:  "git init --quiet",
 			pathlister:   "git ls-files",
 			taglister:    "git tag -l",
@@ -340,7 +365,7 @@ func vcsInit() {
 			checkout:     "git checkout",
 			viewer:       "gitk --all",
 			prenuke:      newOrderedStringSet(".git/config", ".git/hooks"),
-			preserve:     newOrderedStringSet(".git/config", ".git/hooks"),
+			preserve:     newOrderedStringSet(".git/config", ".git/hooks", ".git/description", ".git/info/exclude"),
 			authormap:    ".git/cvs-authors",
 			ignorename:   ".gitignore",
 			cookies:      reMake(shortGitHash, longGitHash),
@@ -359,7 +384,8 @@ func vcsInit() {
 			styleflags: newOrderedStringSet(
 				"export-progress",
 				"no-nl-after-commit",
-				"nl-after-comment"),
+				"nl-after-comment",
+				"utf8-only"),
 			extensions: newOrderedStringSet(
 				"empty-directories",
 				"multiple-authors", "commit-properties"),
@@ -371,7 +397,7 @@ func vcsInit() {
 			checkout:     "bzr checkout",
 			viewer:       "bzr qlog",
 			prenuke:      newOrderedStringSet(".bzr/plugins"),
-			preserve:     newOrderedStringSet(),
+			preserve:     newOrderedStringSet(".bzr/branch/branch.conf"),
 			authormap:    "",
 			ignorename:   ".bzrignore",
 			cookies:      reMake(tokenNumeric),
@@ -402,7 +428,8 @@ bzr-orphans
 			styleflags: newOrderedStringSet(
 				"export-progress",
 				"no-nl-after-commit",
-				"nl-after-comment"),
+				"nl-after-comment",
+				"utf8-only"),
 			extensions: newOrderedStringSet(
 				"empty-directories",
 				"multiple-authors", "commit-properties"),
@@ -414,7 +441,7 @@ bzr-orphans
 			checkout:     "brz checkout",
 			viewer:       "brz qlog",
 			prenuke:      newOrderedStringSet(".brz/plugins"),
-			preserve:     newOrderedStringSet(),
+			preserve:     newOrderedStringSet(".brz/branch/branch.conf"),
 			authormap:    "",
 			project:      "https://www.breezy-vcs.org/",
 			ignorename:   ".bzrignore", // This is not a typo. It *isn't* .brzignore
@@ -827,6 +854,32 @@ core
 			idformat:     "%s",
 			flags:        ignGLOB | ignQUES | ignCARET | ignESC | ignDSTAR,
 		},
+		{
+			name:         "p4",
+			subdirectory: "", // There's a special case in manages()
+			requires:     newStringSet("p4"),
+			exporter:     "",
+			quieter:      "",
+			styleflags:   newOrderedStringSet(),
+			extensions:   newOrderedStringSet(),
+			initializer:  "",
+			pathlister:   "p4 have",
+			taglister:    "p4 labels",
+			branchlister: "",
+			importer:     "",
+			checkout:     "",
+			viewer:       "p4v",
+			prenuke:      newOrderedStringSet(),
+			preserve:     newOrderedStringSet(),
+			authormap:    "",
+			ignorename:   ".p4ignore",
+			dfltignores:  "",
+			cookies:      reMake(tokenNumeric),
+			project:      "https://www.perforce.com/",
+			notes:        "Read-only, from a workspace; see the p4 extractor settings.",
+			idformat:     "%s",
+			flags:        ignHASH | ignGLOB | ignFNMPATH | ignNEG | ignLOOSE | ignDSTAR | ignASLASH | ignDIRMATCH,
+		},
 	}
 
 	// We'll use this to deduce the types of streams that contain ignore files.
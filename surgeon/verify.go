@@ -0,0 +1,110 @@
+/*
+ * Integrity check of blob storage
+ *
+ * SPDX-FileCopyrightText: Eric S. Raymond <esr@thyrsus.com>
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Blob content lives either in a file under the repository's scratch
+// directory or in the stream it was read from.  A session killed in
+// mid-write, or a scratch directory tampered with between sessions,
+// can leave a file short or garbled, and nothing notices until an
+// export hours later dies or, worse, succeeds with bad content.
+// verifyBlob reads a blob's content back, without trusting anything
+// cached, and checks it against the size recorded when it was stored
+// and against its original-oid if the stream had one.
+
+// verifyBlob returns a description of what is wrong with a blob's
+// stored content, or the empty string if nothing is.
+func (b *Blob) verifyBlob() string {
+	var source io.Reader
+	if b.hasfile() {
+		path := b.getBlobfile(false)
+		file, err := os.Open(filepath.Clean(path))
+		if os.IsNotExist(err) {
+			return "content file is missing"
+		} else if err != nil {
+			return fmt.Sprintf("content file unreadable: %v", err)
+		}
+		defer file.Close()
+		source = file
+		if codec := activeCodec(); codec != nil {
+			input, err := codec.decompress(file)
+			if err != nil {
+				return fmt.Sprintf("content file is not %s-compressed: %v", codec.name, err)
+			}
+			defer input.Close()
+			source = input
+		}
+	} else {
+		info, err := b.repo.seekstream.Stat()
+		if err != nil {
+			return fmt.Sprintf("input stream unreadable: %v", err)
+		}
+		if b.start+b.size > info.Size() {
+			return fmt.Sprintf("input stream ends %d bytes short of the content",
+				b.start+b.size-info.Size())
+		}
+		source = io.NewSectionReader(b.repo.seekstream, b.start, b.size)
+	}
+	// Hash as we count, assuming the size is right; the hash is
+	// only looked at if it is.
+	hasher := sha1.New()
+	fmt.Fprintf(hasher, "blob %d\x00", b.size)
+	n, err := io.Copy(hasher, source)
+	if err != nil {
+		return fmt.Sprintf("read failed after %d bytes: %v", n, err)
+	}
+	if n != b.size {
+		return fmt.Sprintf("size is %d, expected %d", n, b.size)
+	}
+	if b.oid.isValid() {
+		var hash gitHashType
+		copy(hash[:], hasher.Sum(nil))
+		if hash != b.oid {
+			return fmt.Sprintf("hash is %s, original-oid %s", hash.hexify(), b.oid.hexify())
+		}
+	}
+	return ""
+}
+
+// verifyBlobs checks the stored content of every blob in the selection,
+// in parallel, and writes a line to w for each one that is damaged.
+// Returns the number of blobs checked and the number damaged.
+func (repo *Repository) verifyBlobs(selection selectionSet, w io.Writer, baton *Baton) (int, int) {
+	problems := make([]string, selection.Size())
+	var checked int32
+	var count uint64
+	baton.startProgress("verify", uint64(selection.Size()))
+	repo.walkEvents(selection, func(i int, event Event) bool {
+		if blob, ok := event.(*Blob); ok {
+			problems[i] = blob.verifyBlob()
+			atomic.AddInt32(&checked, 1)
+		}
+		baton.percentProgress(atomic.AddUint64(&count, 1))
+		return true
+	})
+	baton.endProgress()
+	damaged := 0
+	for it := selection.Iterator(); it.Next(); {
+		if problem := problems[it.Index()]; problem != "" {
+			blob := repo.events[it.Value()].(*Blob)
+			fmt.Fprintf(w, "%d %s: %s\n", it.Value()+1, blob.mark, problem)
+			damaged++
+		}
+	}
+	return int(checked), damaged
+}
+
+// end
@@ -0,0 +1,143 @@
+## Test applying patches as new commits
+set flag fakeuser
+read <<EOF
+blob
+mark :1
+data 87
+line 1
+line 2
+line 3
+line 4
+line 5
+line 6
+line 7
+line 8
+line 9
+line 10
+line 11
+line 12
+
+blob
+mark :2
+data 18
+#!/bin/sh
+echo hi
+
+commit refs/heads/master
+mark :3
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 16
+Initial import.
+M 100644 :1 numbers
+M 100644 :2 run.sh
+M 100644 :2 doomed
+
+EOF
+:3 apply <<EOF
+From 875ae214a20dbbcebbcdac0bdb24de9a8239977e Mon Sep 17 00:00:00 2001
+From: Ann Author <ann@example.com>
+Date: Sun, 09 Sep 2001 02:47:30 +0100
+Subject: [PATCH 1/2] Reword two lines
+
+The numbers read better spelled out.
+---
+
+diff --git a/added b/added
+new file mode 100644
+index 0000000..9cbb192
+--- /dev/null
++++ b/added
+@@ -0,0 +1,2 @@
++fresh file
++no newline
+\ No newline at end of file
+diff --git a/doomed b/doomed
+deleted file mode 100644
+index 4163036..0000000
+--- a/doomed
++++ /dev/null
+@@ -1,2 +0,0 @@
+-#!/bin/sh
+-echo hi
+diff --git a/numbers b/numbers
+index 624b469..2067ace 100644
+--- a/numbers
++++ b/numbers
+@@ -1,5 +1,5 @@
+ line 1
+-line 2
++line two
+ line 3
+ line 4
+ line 5
+@@ -8,5 +8,5 @@
+ line 8
+ line 9
+ line 10
+-line 11
++line eleven
+ line 12
+diff --git a/run.sh b/run.sh
+old mode 100644
+new mode 100755
+-- 
+reposurgeon
+
+From 419bb33fd721cdc2a3738bc864174147ba8f8381 Mon Sep 17 00:00:00 2001
+From: J. Random Hacker <jrh@example.com>
+Date: Sun, 09 Sep 2001 01:50:00 +0000
+Subject: [PATCH 2/2] Insert a line
+
+---
+
+diff --git a/numbers b/numbers
+index 2067ace..5227de5 100644
+--- a/numbers
++++ b/numbers
+@@ -5,6 +5,7 @@
+ line 5
+ line 6
+ line 7
++line 7.5
+ line 8
+ line 9
+ line 10
+-- 
+reposurgeon
+
+EOF
+@max(=C) apply <<EOF
+Spell out two more numbers.
+
+--- numbers.orig	2001-09-09 02:00:00
++++ numbers	2001-09-09 02:00:00
+@@ -2,3 +2,3 @@
+ line two
+-line 3
++line three
+ line 4
+@@ -10,3 +10,3 @@
+ line 10
+ line eleven
+-line 12
++line twelve
+EOF
+=Q list
+:3 apply --branch=refs/heads/side <<EOF
+diff --git a/run.sh b/run.sh
+--- a/run.sh
++++ b/run.sh
+@@ -1,2 +1,2 @@
+ #!/bin/sh
+-echo hi
++echo bye
+EOF
+write -
+@max(=C) apply <<EOF
+--- a/numbers
++++ b/numbers
+@@ -1,2 +1,2 @@
+ line 1
+-line nine
++line 9
+EOF
@@ -0,0 +1,18 @@
+## Test saving and loading assignments
+read <sample1.fi
+:2,:4 assign pair
+=T assign tags
+:1 assign ablob
+assign --save
+assign --save >/tmp/rsassign$$
+drop
+read <sample1.fi
+:4 squash --delete
+renumber
+assign --load </tmp/rsassign$$
+set flag interactive
+<pair> resolve
+<tags> resolve
+<ablob> resolve
+clear flag interactive
+shell rm -f /tmp/rsassign$$
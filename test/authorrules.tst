@@ -0,0 +1,55 @@
+## Test wildcard domain and name rules in authors files
+read <<EOF
+blob
+mark :1
+data 4
+one
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+author Hacker, Random <jrh@oldcorp.com> 1000000000 +0000
+committer Hacker, Random <jrh@oldcorp.com> 1000000000 +0000
+data 6
+first
+M 100644 :1 README
+
+blob
+mark :3
+data 4
+two
+
+commit refs/heads/master
+mark :4
+author Fred Foonly <fred@OldCorp.com> 1000000100 +0000
+committer Fred Foonly <fred@OldCorp.com> 1000000100 +0000
+data 7
+second
+from :2
+M 100644 :3 README
+
+blob
+mark :5
+data 6
+three
+
+commit refs/heads/master
+mark :6
+author esr <esr> 1000000200 +0000
+committer Ancient Gnu <gnu@elsewhere.org> 1000000200 +0000
+data 6
+third
+from :4
+M 100644 :5 README
+
+EOF
+rename repo authorrules
+authors read <<EOF
+# Exact entries win over rules
+esr = Eric S. Raymond <esr@thyrsus.com> America/New_York
+*@oldcorp.com = *@newcorp.com Europe/Berlin
+/^(\w+), (\w+)$/ = ${2} ${1}
+/^Ancient (\w+)$/ = Modern ${1}
+EOF
+write -
+=Q list
@@ -0,0 +1,8 @@
+## Stream-backed blobs survive division into separate repositories
+read <sample1.fi
+:14 divide
+prefer git
+choose sample1-late
+write -
+choose sample1-early
+write -
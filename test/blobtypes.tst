@@ -0,0 +1,57 @@
+## Test content types of blobs
+read <<EOF
+blob
+mark :1
+data 12
+Plain text.
+
+blob
+mark :2
+data 42
+<?xml version="1.0"?>
+<doc><p>x</p></doc>
+
+blob
+mark :3
+data 18
+GIF89a-not-really
+
+blob
+mark :4
+data 14
+%PDF-1.4 stub
+
+blob
+mark :5
+data 11
+More text.
+
+commit refs/heads/master
+mark :6
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 15
+Mixed content.
+M 100644 :1 README
+M 100644 :2 doc.xml
+M 100644 :3 logo.gif
+M 100644 :4 manual.pdf
+M 100644 :5 notes.txt
+
+EOF
+blobs census
+{mimetype =~ "^image/"} resolve
+=B & {mimetype == "text/plain"} eval {mark + " " + mimetype}
+blobs filter <<EOF
+# Exempt XML, uppercase other text, mark images
+text/xml -
+text/* tr a-z A-Z
+image/* sed s/not-really/%PATHS%/
+EOF
+=Q resolve
+blobs census
+write -
+set flag relax
+blobs filter <<EOF
+application/pdf exit 1
+EOF
+blobs filter
@@ -0,0 +1,11 @@
+## Test stripping of exporter boilerplate from comments
+read <boilerplate.fi
+print "Dry run:"
+boilerplate --dry-run
+=Q list
+print "With a user pattern:"
+boilerplate <<EOF
+# An old mirror script's trailer
+mirror ^Mirrored from https?://\S+ r[0-9]+$\n?
+EOF
+write
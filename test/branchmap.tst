@@ -0,0 +1,4 @@
+## Subversion branches declared by a branch map instead of the standard layout
+read --branchmap=multiproject-branches.map <multiprojectmerge.svn
+prefer git
+write -
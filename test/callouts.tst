@@ -0,0 +1,20 @@
+## Test resolving callouts after the fact
+read <debranch3.fi
+/alternate/b delete
+read <callout.chk
+callouts
+callouts resolve --gitlink=upstream debranch3
+write -
+drop
+read <callout.chk
+callouts resolve --gitlink=vendor <<EOF
+# stamp and hash
+2014-02-14T21:48:26Z!rsc@runtux.com 0123456789abcdef0123456789abcdef01234567
+EOF
+:9 list inspect
+drop
+read <callout.chk
+unite debranch3 callout.chk
+callouts resolve
+callouts
+write -
@@ -0,0 +1,162 @@
+## Test changelogs --dry-run and --header
+log -warn -shout
+read <<EOF
+blob
+mark :1
+data 65
+2001-01-01  Fred Foonly  <fred@example.com>
+
+	* foo.c: New file.
+
+blob
+mark :2
+data 14
+int main() {}
+
+commit refs/heads/master
+mark :3
+committer J. Random Hacker <jrh@example.com> 978307200 +0000
+data 9
+Initial.
+M 100644 :1 ChangeLog
+M 100644 :2 foo.c
+
+blob
+mark :4
+data 95
+2001-01-01  Fred Foonly  <fred@example.com>
+
+	* foo.c (main): Return zero.
+	* foo.c: New file.
+
+blob
+mark :5
+data 25
+int main() { return 0; }
+
+commit refs/heads/master
+mark :6
+committer J. Random Hacker <jrh@example.com> 978393600 +0000
+data 13
+Return zero.
+from :3
+M 100644 :4 ChangeLog
+M 100644 :5 foo.c
+
+blob
+mark :7
+data 197
+2001-01-03  Alice Able  <alice@example.com>
+	    Bob Baker  <bob@example.com>
+
+	* foo.c: Comment it.
+
+2001-01-01  Fred Foonly  <fred@example.com>
+
+	* foo.c (main): Return zero.
+	* foo.c: New file.
+
+blob
+mark :8
+data 35
+/* foo */
+int main() { return 0; }
+
+commit refs/heads/master
+mark :9
+committer J. Random Hacker <jrh@example.com> 978480000 +0000
+data 12
+Comment it.
+from :6
+M 100644 :7 ChangeLog
+M 100644 :8 foo.c
+
+blob
+mark :10
+data 321
+2001-01-05  Dan Dare  <dan@example.com>
+
+	* foo.c: Tidy.
+
+2001-01-04  Carol Cole  <carol@example.com>
+
+	* bar.c: New file.
+
+2001-01-03  Alice Able  <alice@example.com>
+	    Bob Baker  <bob@example.com>
+
+	* foo.c: Comment it.
+
+2001-01-01  Fred Foonly  <fred@example.com>
+
+	* foo.c (main): Return zero.
+	* foo.c: New file.
+
+blob
+mark :11
+data 39
+/* foo */
+int main(void) { return 0; }
+
+blob
+mark :12
+data 9
+int bar;
+
+commit refs/heads/master
+mark :13
+committer J. Random Hacker <jrh@example.com> 978566400 +0000
+data 13
+Two entries.
+from :9
+M 100644 :10 ChangeLog
+M 100644 :11 foo.c
+M 100644 :12 bar.c
+
+blob
+mark :14
+data 377
+Eve Evans <eve@example.com> wrote:
+	* foo.c: Use void.
+
+2001-01-05  Dan Dare  <dan@example.com>
+
+	* foo.c: Tidy.
+
+2001-01-04  Carol Cole  <carol@example.com>
+
+	* bar.c: New file.
+
+2001-01-03  Alice Able  <alice@example.com>
+	    Bob Baker  <bob@example.com>
+
+	* foo.c: Comment it.
+
+2001-01-01  Fred Foonly  <fred@example.com>
+
+	* foo.c (main): Return zero.
+	* foo.c: New file.
+
+blob
+mark :15
+data 28
+/* foo */
+int main(void) {}
+
+commit refs/heads/master
+mark :16
+committer J. Random Hacker <jrh@example.com> 978652800 +0000
+data 10
+Use void.
+from :13
+M 100644 :14 ChangeLog
+M 100644 :15 foo.c
+
+EOF
+log +warn +shout
+# Nothing is changed by a dry run
+changelogs --dry-run
+# A header convention of our own
+changelogs --dry-run --header=/^(.*<[^>]*>)\swrote:$/
+changelogs
+:3,:9 list inspect
@@ -0,0 +1,114 @@
+## Test coalesce --author
+read <<EOF
+blob
+mark :1
+data 2
+a
+
+commit refs/heads/master
+mark :2
+author Ann Author <ann@example.com> 1000000000 +0000
+committer Save Bot <bot@example.com> 1000000005 +0000
+data 7
+Start.
+M 100644 :1 a
+
+blob
+mark :3
+data 4
+a
+b
+
+commit refs/heads/master
+mark :4
+author Ann Author <ann@example.com> 1000000030 +0000
+committer Save Bot <bot@example.com> 1000000035 +0000
+data 9
+Autosave
+from :2
+M 100644 :3 a
+
+blob
+mark :5
+data 2
+x
+
+commit refs/heads/master
+mark :6
+author Ann Author <ann@example.com> 1000000060 +0000
+committer Save Bot <bot@example.com> 1000000065 +0000
+data 6
+Add x
+from :4
+M 100644 :5 x
+
+blob
+mark :7
+data 6
+a
+b
+c
+
+commit refs/heads/master
+mark :8
+author Ann Author <ann@example.com> 1000000080 +0000
+committer Save Bot <bot@example.com> 1000000085 +0000
+data 9
+Autosave
+from :6
+M 100644 :7 a
+D x
+
+blob
+mark :9
+data 2
+y
+
+commit refs/heads/master
+mark :10
+author Bob Other <bob@example.com> 1000000100 +0000
+committer Save Bot <bot@example.com> 1000000105 +0000
+data 13
+Bob's change
+from :8
+M 100644 :9 y
+
+blob
+mark :11
+data 8
+a
+b
+c
+d
+
+commit refs/heads/master
+mark :12
+author Ann Author <ann@example.com> 1000000110 +0000
+committer Save Bot <bot@example.com> 1000000115 +0000
+data 14
+More from Ann
+from :10
+M 100644 :11 a
+
+blob
+mark :13
+data 10
+a
+b
+c
+d
+e
+
+commit refs/heads/master
+mark :14
+author Ann Author <ann@example.com> 1000009000 +0000
+committer Save Bot <bot@example.com> 1000009005 +0000
+data 11
+Much later
+from :12
+M 100644 :13 a
+
+EOF
+coalesce --author 60
+=Q list
+write -
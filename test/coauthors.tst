@@ -0,0 +1,65 @@
+## Test coauthors
+read <<EOF
+blob
+mark :1
+data 4
+one
+
+commit refs/heads/master
+mark :2
+author Fred Foonly <fred@example.com> 1000000000 +0000
+author Bob Baker <bob@example.com> 1000000000 +0000
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 13
+Two authors.
+M 100644 :1 README
+
+blob
+mark :3
+data 4
+two
+
+commit refs/heads/master
+mark :4
+author Alice Able <alice@example.com> 1000000100 +0000
+committer J. Random Hacker <jrh@example.com> 1000000100 +0000
+data 217
+Trailers in odd spellings.
+
+Signed-off-by: Alice Able <alice@example.com>
+co-authored-by:  Carol  Cole <carol@example.com>
+CO-AUTHORED-BY: Carol Cole <carol@example.com>
+Co-Authored-By: Alice Able <alice@example.com>
+from :2
+M 100644 :3 README
+
+blob
+mark :5
+data 6
+three
+
+commit refs/heads/master
+mark :6
+author Dan Dare <dan@example.com> 1000000200 +0000
+committer J. Random Hacker <jrh@example.com> 1000000200 +0000
+data 44
+No address.
+
+Co-authored-by: the whole team
+from :4
+M 100644 :5 README
+
+EOF
+# Trailers into authors
+coauthors authors
+=Q resolve
+write -
+# And back, as git would want
+prefer git
+coauthors
+=Q resolve
+write -
+# bzr keeps multiple authors
+coauthors bzr
+:2 list inspect
+coauthors nosuchvcs
@@ -0,0 +1,17 @@
+## Test blob compression codecs
+set flag compress
+set codec zstd
+read <bs.fi
+:1 filter regex /Makefile/MAKEFILE/
+:1 list inspect
+drop
+set codec lz4
+read <bs.fi
+:1 filter regex /Makefile/MAKEFILE/
+:1 list inspect
+drop
+clear codec
+read <bs.fi
+:1 filter regex /Makefile/MAKEFILE/
+:1 list inspect
+set codec lz4
@@ -0,0 +1,10 @@
+## Test drafting CODEOWNERS from commit history
+read <codeowners.fi
+print "Default depth and owner count:"
+codeowners
+print "Depth 2, two owners:"
+codeowners --depth=2 --top=2
+print "Last 40 days:"
+codeowners --window=40
+print "Branch main only:"
+/^refs.heads.main$/b codeowners --top=1
@@ -0,0 +1,62 @@
+## Test comment policy checks and fixes in lint
+read <<EOF
+blob
+mark :1
+data 4
+one
+
+reset refs/heads/master
+commit refs/heads/master
+#legacy-id 1
+mark :2
+committer Fred J. Foonly <fered@foonly.org> 1000000060 +0000
+data 35
+Root commit without a final newline
+M 100644 :1 README
+
+commit refs/heads/master
+#legacy-id 2
+mark :3
+committer Fred J. Foonly <fered@foonly.org> 1000000120 +0000
+data 72
+Second commit.
+----------------------------------------
+Details follow.
+from :2
+
+commit refs/heads/master
+mark :4
+committer Fred J. Foonly <fered@foonly.org> 1000000180 +0000
+data 92
+This line is deliberately made much longer than the seventy-two characters git log expects.
+from :3
+
+commit refs/heads/master
+mark :5
+committer Fred J. Foonly <fered@foonly.org> 1000000240 +0000
+data 26
+*** empty log message ***
+from :4
+
+commit refs/heads/master
+#legacy-id 5
+mark :6
+committer Fred J. Foonly <fered@foonly.org> 1000000300 +0000
+data 28
+Fifth commit.
+
+Legacy-ID: 5
+from :5
+
+tag v1
+from :6
+tagger Fred J. Foonly <fered@foonly.org> 1000000360 +0000
+data 16
+=====
+Release 1
+EOF
+lint --comments
+=Q list
+lint --width=0 --legacy-trailers --fix
+write -
+lint --m --legacy-trailers
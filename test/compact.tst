@@ -0,0 +1,8 @@
+## Test compaction after large deletions
+set flag materialize
+read <codeowners.fi
+compact
+:2,:5,:7 squash --delete
+gc
+compact
+write -
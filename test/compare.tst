@@ -0,0 +1,11 @@
+## Test comparing the commit graphs of two repositories
+read <svnwrite.fi
+read <svnwrite.fi
+choose svnwrite2
+:6 setfield comment "Reworded.\n"
+:8 squash --pushforward
+choose svnwrite
+compare svnwrite2
+=Q list
+compare --tree svnwrite2
+compare svnwrite
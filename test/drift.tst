@@ -0,0 +1,14 @@
+## Test drift of recomputed hashes from recorded original-oids
+read <drift.fi
+print "Before surgery:"
+drift
+print "Metadata change:"
+:4 setfield comment "second commit, revised\n"
+drift
+print "Content change:"
+:7 filter replace /fourth/FOURTH/
+drift
+print "Commits only:"
+=C drift
+print "Reporting leaves the original-oids to be written alone:"
+:6 write -
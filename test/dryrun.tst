@@ -0,0 +1,50 @@
+## Test rebuild --dry-run
+shell rm -rf /tmp/rsdryrun-target /tmp/rsdryrun-absent
+read <<EOF
+blob
+mark :1
+data 4
+one
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 6
+First
+M 100644 :1 README
+
+blob
+mark :3
+data 4
+two
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@example.com> 1000000100 +0000
+data 7
+Second
+from :2
+M 100644 :3 README
+
+tag v1
+from :2
+tagger J. Random Hacker <jrh@example.com> 1000000050 +0000
+data 8
+Tag v1.
+
+EOF
+prefer git
+# Nothing there yet
+rebuild --dry-run /tmp/rsdryrun-absent
+shell test -e /tmp/rsdryrun-absent && echo "absent target was created" || echo "absent target untouched"
+rebuild /tmp/rsdryrun-target
+# Rebuilding unchanged finds nothing
+rebuild --dry-run /tmp/rsdryrun-target
+# Change the tip's tree, drop the tag, add a branch
+:4 remove M README
+delete tag v1
+:2 create reset refs/heads/topic
+rebuild --dry-run /tmp/rsdryrun-target
+shell test -e /tmp/rsdryrun-target.~1~ && echo "target was backed up" || echo "target was not backed up"
+shell rm -rf /tmp/rsdryrun-target
@@ -0,0 +1,8 @@
+## Test placeholders for empty directories from Subversion
+set emptydir .keep "Placeholder for an empty directory"
+read <emptydirs.svn
+prefer git
+write -
+emptydirs strip
+=Q list
+write -
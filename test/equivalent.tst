@@ -0,0 +1,11 @@
+## Test commit equivalence: the @eqv selection function and tags dedupe
+read <equivalent.fi
+@eqv(:4) resolve
+@eqv(:6) resolve
+@eqv(:2) resolve
+:4 create tag first
+:5 create tag second
+:6 create tag third
+print "Tags on equivalent commits are duplicates:"
+tags dedupe
+list tags
@@ -0,0 +1,19 @@
+## Stable event identifiers survive renumbering and reordering
+set flag echo
+set flag relax
+read <simple.fi
+:4 msgout --filter=/Event-UUID/
+<97d3b50d-9f00-543c-8686-cd1a44907432> resolve
+print "Deleting an earlier event moves the event but not its identifier"
+:2 delete
+<97d3b50d-9f00-543c-8686-cd1a44907432> resolve
+print "Renumbering changes its mark but not its identifier"
+renumber
+<97d3b50d-9f00-543c-8686-cd1a44907432> list
+print "The identifier survives undo"
+undo
+<97d3b50d-9f00-543c-8686-cd1a44907432> list
+print "A commit split in two keeps its identifier; the new half gets one"
+:9 msgout --filter=/Event-UUID/
+:9 split 2
+:9? msgout --filter=/Event-UUID|Event-Mark/
@@ -0,0 +1,12 @@
+## Test event expressions in selections, eval and map
+read <sample4.fi
+{type == "commit" && parents == 2} resolve
+{ops >= 2 || type = "tag"} resolve
+{!(type =~ "^(blob|commit)$")} resolve
+{tagname = "annotated"} eval {tagname + " -> " + target}
+=C & {date < "2012-12-02T05:45"} eval {authoremail + "|" + date + "|" + sub(author, " [A-Z]\\. ", " ")}
+=C & {len(summary) > 40} map comment {upper(summary) + "\n"}
+=Q list
+=T map tagname {"v-" + tagname}
+list tags
+{nosuch} resolve
@@ -0,0 +1,51 @@
+## Test reading alias, ls, get-mark, tag marks and done
+read <<EOF
+feature done
+blob
+mark :1
+data 6
+hello
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+committer Fred J. Foonly <fered@foonly.org> 1000000060 +0000
+data 13
+Root commit.
+M 100644 :1 README
+ls "README"
+
+alias
+mark :3
+to :2
+
+get-mark :2
+ls :2 README
+blob
+mark :4
+data 6
+world
+
+commit refs/heads/master
+mark :5
+committer Fred J. Foonly <fered@foonly.org> 1000000120 +0000
+data 14
+Second commit
+from :3
+M 100644 :4 README
+
+tag v1.0
+mark :6
+from :5
+original-oid 0123456789abcdef0123456789abcdef01234567
+tagger Fred J. Foonly <fered@foonly.org> 1000000180 +0000
+data 8
+Release
+
+reset refs/heads/rel
+from :6
+
+done
+this is junk after done
+EOF
+write -
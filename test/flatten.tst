@@ -0,0 +1,11 @@
+## Test merge flattening and merge-link conflict reporting
+read <flatten.fi
+:10 unmerge --flatten
+write -
+:7,:9,:10 list manifest
+drop
+read <flatten.fi
+:10 unmerge
+:9,:10 merge
+:10 list inspect
+:7 unmerge --flatten	# Should fail, not a merge
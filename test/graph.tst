@@ -1,3 +1,8 @@
 ## Rest graph-generation code
 read <roundup.fi
 graph
+read <sample1.fi
+print "Collapsed:"
+graph --collapse
+print "Mermaid:"
+graph --format=mermaid --collapse
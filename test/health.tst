@@ -0,0 +1,6 @@
+## Test the health report
+read <health.fi
+health
+set flag interactive
+=Q resolve
+health --json
@@ -0,0 +1,81 @@
+## Test merging of ignore files in several dialects
+read <<EOF
+blob
+mark :1
+data 9
+*.o core
+
+blob
+mark :2
+data 14
+*.tmp ! *.bak
+
+blob
+mark :3
+data 6
+Hello
+
+reset refs/heads/master
+commit refs/heads/master
+mark :4
+committer esr <esr@thyrsus.com> 1322671432 +0000
+data 15
+CVS-era start.
+M 100644 :1 .cvsignore
+M 100644 :2 src/.cvsignore
+M 100644 :3 README
+
+blob
+mark :5
+data 7
+build/
+
+blob
+mark :6
+data 7
+*.html
+
+commit refs/heads/master
+mark :7
+committer esr <esr@thyrsus.com> 1322671500 +0000
+data 21
+Native ignore files.
+from :4
+M 100644 :5 src/.gitignore
+M 100644 :6 doc/.gitignore
+
+blob
+mark :8
+data 13
+*.o core *.a
+
+commit refs/heads/master
+mark :9
+committer esr <esr@thyrsus.com> 1322671600 +0000
+data 21
+Ignore archives too.
+from :7
+M 100644 :8 .cvsignore
+
+commit refs/heads/master
+mark :10
+committer esr <esr@thyrsus.com> 1322671700 +0000
+data 23
+Retire src/.cvsignore.
+from :9
+D src/.cvsignore
+
+commit refs/heads/master
+mark :11
+committer esr <esr@thyrsus.com> 1322671800 +0000
+data 27
+Retire the top .cvsignore.
+from :10
+D .cvsignore
+
+EOF
+prefer git
+ignores --merge
+write
+print "Modified commits:"
+=Q list
@@ -0,0 +1,64 @@
+## Test copy inference
+read <<EOF
+blob
+mark :1
+data 6
+alpha
+
+blob
+mark :2
+data 5
+beta
+
+commit refs/heads/master
+mark :3
+committer Fred J. Foonly <fred@example.com> 1000 +0000
+data 9
+Initial.
+M 100644 :1 src/alpha.c
+M 100644 :2 src/beta.c
+
+blob
+mark :4
+data 6
+alpha
+
+blob
+mark :5
+data 5
+beta
+
+commit refs/heads/master
+mark :6
+committer Fred J. Foonly <fred@example.com> 2000 +0000
+data 39
+Copy alpha, copy beta with a new mode.
+from :3
+M 100644 :4 lib/alpha.c
+M 100755 :5 lib/beta.sh
+
+blob
+mark :7
+data 6
+gamma
+
+blob
+mark :8
+data 5
+beta
+
+commit refs/heads/master
+mark :9
+committer Fred J. Foonly <fred@example.com> 3000 +0000
+data 52
+Change alpha, then copy its old content; copy beta.
+from :6
+M 100644 :7 src/alpha.c
+M 100644 :1 attic/alpha.c
+M 100644 :8 attic/beta.c
+
+EOF
+infer copies
+=Q resolve
+write -
+infer nonesuch
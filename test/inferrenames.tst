@@ -0,0 +1,101 @@
+## Test rename inference
+read <<EOF
+blob
+mark :1
+data 6
+alpha
+
+blob
+mark :2
+data 70
+line 0
+line 1
+line 2
+line 3
+line 4
+line 5
+line 6
+line 7
+line 8
+line 9
+
+blob
+mark :3
+data 6
+delta
+
+blob
+mark :4
+data 8
+epsilon
+
+commit refs/heads/master
+mark :5
+committer Fred J. Foonly <fred@example.com> 1000 +0000
+data 9
+Initial.
+M 100644 :1 src/alpha.c
+M 100644 :2 src/text.txt
+M 100644 :3 src/delta.c
+M 100644 :4 src/epsilon.c
+
+blob
+mark :6
+data 6
+alpha
+
+blob
+mark :7
+data 74
+line 0
+line 1
+line 2
+line three
+line 4
+line 5
+line 6
+line 7
+line 8
+line 9
+
+blob
+mark :8
+data 6
+other
+
+commit refs/heads/master
+mark :9
+committer Fred J. Foonly <fred@example.com> 2000 +0000
+data 20
+Move things around.
+from :5
+D src/alpha.c
+M 100644 :6 lib/alpha.c
+D src/text.txt
+M 100644 :7 doc/text.txt
+D src/delta.c
+M 100644 :8 lib/other.c
+
+blob
+mark :10
+data 8
+epsilon
+
+commit refs/heads/master
+mark :11
+committer Fred J. Foonly <fred@example.com> 3000 +0000
+data 18
+Copy then delete.
+from :9
+M 100644 :10 lib/epsilon.c
+D src/epsilon.c
+
+EOF
+infer copies
+=Q resolve
+infer renames
+=Q resolve
+infer renames --similarity=80
+=Q resolve
+write -
+infer renames --similarity=0
@@ -0,0 +1,53 @@
+## Test rewriting issue-tracker references
+read <<EOF
+blob
+mark :1
+data 3
+v0
+
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 60
+Fix #1 and #2, see bug 17.
+
+HTML&#38;entity, page#3 anchor.
+M 100644 :1 README
+
+blob
+mark :3
+data 3
+v1
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@example.com> 1000000100 +0000
+data 24
+Closes PROJ-12 and #99.
+from :2
+M 100644 :3 README
+
+tag v1
+from :4
+tagger J. Random Hacker <jrh@example.com> 1000000200 +0000
+data 19
+Release fixing #2.
+
+EOF
+issues --dry-run hash <<EOF
+1 2
+2 3
+EOF
+=Q list
+issues hash <<EOF
+# old new
+1 2
+2 3
+EOF
+issues bug "PROJ-{id}" <<EOF
+17 40
+EOF
+issues jira "{ref} <https://tracker.example.org/browse/{id}>"
+issues /#(\d+)/ "GH-{id}"
+write -
+issues hash
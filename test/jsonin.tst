@@ -0,0 +1,32 @@
+## Test JSON metadata import
+read <multitag.fi
+jsonin --dry-run <<EOF
+{"mark": ":2", "comment": "Add a file a\n"}
+{"mark": ":4", "comment": "Enlarge file a\n", "branch": "refs/heads/master"}
+{"stamp": "2013-03-25T23:19:44Z!frnchfrgg@free.fr", "authors": [{"name": "J. Random Hacker", "email": "jrh@example.com", "date": ""}]}
+{"type": "tag", "name": "v1", "tagger": {"name": "Release Manager", "email": "rm@example.com", "date": "2013-03-26T00:00:00Z"}}
+EOF
+jsonin <<EOF
+[
+{"mark": ":4", "comment": "Enlarge file a\n", "branch": "refs/heads/master"},
+{"stamp": "2013-03-25T23:19:44Z!frnchfrgg@free.fr", "authors": [{"name": "J. Random Hacker", "email": "jrh@example.com", "date": ""}]},
+{"type": "tag", "name": "v1", "tagger": {"name": "Release Manager", "email": "rm@example.com", "date": "2013-03-26T00:00:00Z"}}
+]
+EOF
+=Q list
+write -
+print "An unchanged export goes back in without changes"
+jsonout >/tmp/rsjsonin$$
+jsonin --dry-run </tmp/rsjsonin$$
+shell rm -f /tmp/rsjsonin$$
+print "An empty author list is applied"
+jsonin --dry-run <<EOF
+{"mark": ":5", "authors": []}
+EOF
+jsonin <<EOF
+{"mark": ":5", "authors": []}
+EOF
+:5 msgout --filter=/Author|Committer/
+jsonin <<EOF
+{"mark": ":99", "comment": "nothing here\n"}
+EOF
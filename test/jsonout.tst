@@ -0,0 +1,4 @@
+## Test JSON metadata export
+read <multitag.fi
+jsonout
+:2,:4 jsonout --ndjson
@@ -0,0 +1,27 @@
+## Test keyword collapse and expansion
+read <keywords.fi
+keywords collapse /\.c$/
+=Q resolve
+write -
+keywords expand
+=Q resolve
+write -
+# A blob shared with a file outside the pattern is copied, not changed
+read <<EOF
+blob
+mark :1
+data 32
+/* $Id: shared.c,v 1.1 esr $ */
+
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 13
+Shared blob.
+M 100644 :1 shared.c
+M 100644 :1 shared.txt
+
+EOF
+keywords collapse /\.c$/
+=Q resolve
+write -
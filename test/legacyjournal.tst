@@ -0,0 +1,20 @@
+## Test the legacy-reference journal
+read --legacy-journal=legacyjournal.log <simpletag.svn
+legacy journal
+legacy write
+write >legacyjournal.fi
+shell sed -i "/^#legacy-id/d" legacyjournal.fi
+legacy journal off
+shell cat legacyjournal.log
+read <legacyjournal.fi
+print "Expect no legacy references before the journal is attached"
+legacy write
+legacy journal legacyjournal.log
+print "Expect the references to be recovered"
+legacy write
+:3 delete
+legacy write
+legacy journal off
+print "Expect a deletion entry at the end"
+shell tail -2 legacyjournal.log
+shell rm -f legacyjournal.log legacyjournal.fi
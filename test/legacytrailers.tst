@@ -0,0 +1,112 @@
+## Test legacy trailers
+log -warn -shout
+read <<EOF
+blob
+mark :1
+data 6
+rev 0
+
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 102
+Via git-svn.
+
+git-svn-id: https://svn.example.com/repo/trunk@101 6d1a3c5e-1f1a-4c5b-8d2e-1a2b3c4d5e6f
+M 100644 :1 README
+
+blob
+mark :3
+data 6
+rev 1
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@example.com> 1000000100 +0000
+data 59
+Via an svn2git rules file.
+
+svn path=/trunk/; revision=102
+from :2
+M 100644 :3 README
+
+blob
+mark :5
+data 6
+rev 2
+
+commit refs/heads/master
+mark :6
+committer J. Random Hacker <jrh@example.com> 1000000200 +0000
+data 28
+By hand.
+
+SVN revision: 103
+from :4
+M 100644 :5 README
+
+blob
+mark :7
+data 6
+rev 3
+
+commit refs/heads/master
+mark :8
+committer J. Random Hacker <jrh@example.com> 1000000300 +0000
+data 63
+A CVS keyword.
+
+$Id: foo.c,v 1.4 2001/01/01 00:00:00 jrh Exp $
+from :6
+M 100644 :7 README
+
+blob
+mark :9
+data 6
+rev 4
+
+commit refs/heads/master
+mark :10
+committer J. Random Hacker <jrh@example.com> 1000000400 +0000
+data 50
+Already a trailer, oddly spelled.
+
+legacy-id: 105
+from :8
+M 100644 :9 README
+
+blob
+mark :11
+data 6
+rev 5
+
+commit refs/heads/master
+mark :12
+committer J. Random Hacker <jrh@example.com> 1000000500 +0000
+data 62
+Mentions r99 and revision=98 in passing, which is left alone.
+from :10
+M 100644 :11 README
+
+blob
+mark :13
+data 6
+rev 6
+
+commit refs/heads/master
+#legacy-id 107
+mark :14
+committer J. Random Hacker <jrh@example.com> 1000000600 +0000
+data 40
+Disagrees with its legacy ID.
+
+svn r200
+from :12
+M 100644 :13 README
+
+EOF
+log +warn +shout
+legacy trailers
+=Q resolve
+legacy write
+write -
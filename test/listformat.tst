@@ -0,0 +1,12 @@
+## Test CSV and JSON serializations of list reports
+read <sample4.fi
+:3..:9 list --csv commits
+:3..:9 list --json commits
+list --csv tags
+list --json tags
+:3..:9 list --csv stamps
+:3..:9 list --json stamps
+# Error cases
+set flag relax
+list --csv --json
+list --bogus
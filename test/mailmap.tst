@@ -0,0 +1,32 @@
+## Test reading and writing git mailmaps
+read <<EOF
+blob
+mark :1
+data 135
+Fred J. Foonly <foonly@foo.com> <fred@oldhost>
+<jrh@example.com> <JRH@Hacker.Example>
+Mary Smith <mary@example.com> mary <mary@laptop>
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+author Fred <fred@oldhost> 1000000000 +0000
+committer J. Random Hacker <jrh@hacker.example> 1000000000 +0000
+data 6
+First
+M 100644 :1 .mailmap
+
+commit refs/heads/master
+mark :3
+author Mary <mary@laptop> 1000000100 +0000
+committer Mary Jones <mary@laptop> 1000000100 +0000
+data 7
+Second
+from :2
+
+EOF
+# Without a redirect the .mailmap in the tip is read
+authors read --mailmap
+=Q list
+write -
+authors write --mailmap
@@ -0,0 +1,14 @@
+## Test mark aliases kept across renumbering
+read <flatten.fi
+:7 squash --pushforward
+renumber
+renumber --aliases
+<:3>,<:9> list
+:3 list
+# Marks keep their first meaning across later renumberings
+<:5> squash --pushforward
+renumber
+renumber --aliases
+<:3>,<:10> list
+# Old marks of deleted events name nothing
+<:7> list
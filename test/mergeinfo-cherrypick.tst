@@ -0,0 +1,11 @@
+## Partial merges in mergeinfo are scored and made above a threshold
+# only the full merge from trunk is made
+read <mergeinfo-cherrypick.svn
+list merges
+# the cherry-pick from the second branch scores 0.5
+read --merge-threshold=0.75 <mergeinfo-cherrypick.svn
+list merges
+read --merge-threshold=0.5 <mergeinfo-cherrypick.svn
+list merges
+<10> list inspect
+read --merge-threshold=2 <mergeinfo-cherrypick.svn
@@ -0,0 +1,10 @@
+## Test selection by structural metrics
+read <simple.fi
+set flag interactive
+{ops>2} resolve commits with more than two fileops
+{ops=0} resolve commits with no fileops
+{parents>=2} resolve merge commits
+{parents=0} resolve root commits
+{bytes>20000} resolve commits writing over 20000 bytes
+{bytes>5000}&{ops<=1} resolve single-fileop commits writing over 5000 bytes
+=C&~{parents!=0} resolve commits without parents
@@ -0,0 +1,73 @@
+## Test file mode audit, repair and pinning
+read <<EOF
+blob
+mark :1
+data 21
+#!/bin/sh
+echo hello
+
+blob
+mark :2
+data 16
+../../etc/passwd
+blob
+mark :3
+data 6
+README
+blob
+mark :4
+data 5
+data
+
+blob
+mark :5
+data 21
+/usr/share/dict/words
+commit refs/heads/master
+mark :6
+committer Fred J. Foonly <fred@example.com> 1000 +0000
+data 9
+Initial.
+M 100644 :1 bin/hello
+M 120000 :2 doc/passwd
+M 120000 :3 doc/readme
+M 100644 :4 data.txt
+M 120000 :5 words
+
+blob
+mark :7
+data 10
+more data
+
+commit refs/heads/master
+mark :8
+committer Fred J. Foonly <fred@example.com> 2000 +0000
+data 6
+Flip.
+from :6
+M 100755 :7 data.txt
+
+blob
+mark :9
+data 14
+yet more data
+
+commit refs/heads/master
+mark :10
+committer Fred J. Foonly <fred@example.com> 3000 +0000
+data 6
+Flop.
+from :8
+M 100644 :9 data.txt
+M 100755 :1 bin/hello
+
+EOF
+modes audit
+=Q resolve
+modes repair
+=Q resolve
+modes pin data.txt 100644
+=Q resolve
+modes pin /^doc/ 100755
+modes audit
+modes pin data.txt 120000
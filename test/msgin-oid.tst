@@ -0,0 +1,6 @@
+## Test that a msgout/msgin round trip keeps original-oids
+read <drift.fi
+msgout >/tmp/rsmsgoid$$$$
+msgin </tmp/rsmsgoid$$$$
+shell rm /tmp/rsmsgoid$$$$
+write -
@@ -0,0 +1,79 @@
+## Git notes follow their commits and fold into comments
+read <<EOF
+blob
+mark :1
+data 6
+first
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+committer Ann <ann@example.com> 1600000000 +0000
+data 7
+Start.
+M 100644 :1 README
+
+blob
+mark :3
+data 7
+second
+
+commit refs/heads/master
+mark :4
+committer Ann <ann@example.com> 1600000100 +0000
+data 8
+Middle.
+from :2
+M 100644 :3 README
+
+blob
+mark :5
+data 6
+third
+
+commit refs/heads/master
+mark :6
+committer Ann <ann@example.com> 1600000200 +0000
+data 5
+End.
+from :4
+M 100644 :5 README
+
+blob
+mark :7
+data 17
+Reviewed-by: Bob
+
+commit refs/notes/commits
+mark :8
+committer Bob <bob@example.com> 1600000300 +0000
+data 31
+Notes added by 'git notes add'
+N :7 :4
+N inline :6
+data 27
+Tested on
+the big machine.
+
+commit refs/notes/review
+mark :9
+committer Bob <bob@example.com> 1600000400 +0000
+data 31
+Notes added by 'git notes add'
+N inline :2
+data 12
+Looks fine.
+
+EOF
+set flag interactive
+notes list
+# squashing an annotated commit moves its note forward
+:4 squash
+notes list
+renumber
+write -
+# fold the default notes with deletion, then the rest
+notes fold --ref=commits --delete
+notes list
+notes fold
+write -
@@ -0,0 +1,58 @@
+## Test reading, baking and rebuilding git replace refs and grafts
+shell rm -rf /tmp/rsoverrides-src /tmp/rsoverrides-out /tmp/rsoverrides-baked
+read <<EOF
+blob
+mark :1
+data 4
+one
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 6
+First
+M 100644 :1 README
+
+blob
+mark :3
+data 4
+two
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@example.com> 1000000100 +0000
+data 7
+Second
+from :2
+M 100644 :3 README
+
+blob
+mark :5
+data 6
+three
+
+commit refs/heads/master
+mark :6
+committer J. Random Hacker <jrh@example.com> 1000000200 +0000
+data 6
+Third
+from :4
+M 100644 :5 README
+
+EOF
+prefer git
+rebuild /tmp/rsoverrides-src
+shell cd /tmp/rsoverrides-src && git replace --graft master master~2
+read /tmp/rsoverrides-src
+# The real history is read, with the replacement as an override
+overrides
+list
+rebuild /tmp/rsoverrides-out
+shell cd /tmp/rsoverrides-out && git log --format=%s master && git replace -l | wc -l
+# Baking keeps the tree of the grafted commit
+overrides bake
+overrides
+rebuild /tmp/rsoverrides-baked
+shell cd /tmp/rsoverrides-baked && git log --format=%s master && cat README && git replace -l | wc -l
+shell rm -rf /tmp/rsoverrides-src /tmp/rsoverrides-out /tmp/rsoverrides-baked
@@ -0,0 +1,14 @@
+## Test passthrough editing
+read <bzr.fi
+passthrough list
+/empty-dir/p passthrough list
+passthrough add --front "# exported by somebody"
+:1 passthrough add "# after the first commit"
+passthrough add "done"
+passthrough list
+passthrough rewrite regex "/after the first/between the/"
+=Q passthrough list
+/^# exported/p passthrough delete
+/multiple-authors/p passthrough rewrite regex /.*//
+passthrough list
+write -
@@ -0,0 +1,64 @@
+## Test rendering commits as format-patch patches
+read <<EOF
+blob
+mark :1
+data 49
+one
+two
+three
+four
+five
+six
+seven
+eight
+nine
+ten
+
+blob
+mark :2
+data 18
+#!/bin/sh
+echo hi
+
+commit refs/heads/master
+mark :3
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 16
+Initial import.
+M 100644 :1 numbers
+M 100644 :2 run.sh
+M 100644 :2 doomed
+
+blob
+mark :4
+data 55
+one
+two
+THREE
+four
+five
+six
+seven
+eight
+nine
+ten
+eleven
+
+commit refs/heads/master
+mark :5
+author Jérôme Doe <jerome@example.com> 1000000100 +0100
+committer J. Random Hacker <jrh@example.com> 1000000100 +0000
+data 85
+Change numbers, drop doomed.
+
+The third line is shouted and the
+last has no newline.
+from :3
+M 100644 :4 numbers
+M 100755 :2 run.sh
+D doomed
+
+EOF
+patches
+1..3 patches
+patches a b
@@ -0,0 +1,12 @@
+## Test listing the history of a path
+read <rename.fi
+list history sample2
+list history sample
+read <copy.fi
+list history sample2
+read <deleteall.fi
+list history README
+list history README-branch2
+read <simple.fi
+:60..:75 list history reposurgeon
+list history
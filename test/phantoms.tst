@@ -0,0 +1,8 @@
+## Test removal of phantom file lifetimes
+set flag echo
+set flag relax
+read <phantoms.fi
+phantoms --dry-run
+phantoms
+=Q resolve
+write -
@@ -0,0 +1,70 @@
+## Test placeholder-identity policy
+set placeholder
+set placeholder root
+set placeholder cvs2svn "Migration Account <migration@example.com>"
+set placeholder
+read <<EOF
+blob
+mark :1
+data 6
+alpha
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+committer (no author) <(no author)> 1322671432 +0000
+data 11
+First rev.
+M 100644 :1 README
+
+blob
+mark :3
+data 5
+beta
+
+commit refs/heads/master
+mark :4
+author root <root@localhost> 1322671500 +0000
+committer cvs2svn <cvs2svn> 1322671521 +0000
+data 12
+Second rev.
+from :2
+M 100644 :3 README
+
+EOF
+write -
+clear placeholder
+read <<EOF
+blob
+mark :1
+data 6
+alpha
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+committer (no author) <(no author)> 1322671432 +0000
+data 11
+First rev.
+M 100644 :1 README
+
+blob
+mark :3
+data 5
+beta
+
+commit refs/heads/master
+mark :4
+author root <root@localhost> 1322671500 +0000
+committer cvs2svn <cvs2svn> 1322671521 +0000
+data 12
+Second rev.
+from :2
+M 100644 :3 README
+
+EOF
+write -
+set placeholder "(no author)" "Nobody <nobody@example.com>"
+read <tagpollute.svn
+print "Subversion revisions with no author:"
+<5> msgout --filter=/Committer/
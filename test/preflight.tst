@@ -0,0 +1,34 @@
+## Test rebuild preflight checks against the target's capabilities
+read <<EOF
+blob
+mark :1
+data 4
+one
+
+commit refs/heads/master
+mark :2
+author Fred Foonly <fred@example.com> 1000000000 +0000
+author Bob Baker <bob@example.com> 1000000000 +0000
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 13
+Two authors.
+M 100644 :1 README
+
+blob
+mark :3
+data 4
+two
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@example.com> 1000000100 +0000
+data 16
+With a property
+property branch-nick 5 trunk
+from :2
+M 100644 :3 README
+
+EOF
+prefer git
+# Refused before anything is created, with the property drop warned of
+rebuild /tmp/rspreflight-never-created
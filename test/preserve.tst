@@ -0,0 +1,52 @@
+## Test preserve-set glob patterns and default preserves on rebuild
+shell rm -rf /tmp/rspreserve-target /tmp/rspreserve-target.~1~
+read <<EOF
+blob
+mark :1
+data 4
+one
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 6
+First
+M 100644 :1 README
+
+blob
+mark :3
+data 4
+two
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@example.com> 1000000100 +0000
+data 7
+Second
+from :2
+M 100644 :3 README
+
+tag v1
+from :2
+tagger J. Random Hacker <jrh@example.com> 1000000050 +0000
+data 8
+Tag v1.
+
+EOF
+prefer git
+rebuild /tmp/rspreserve-target
+# Site configuration and scratch files a user has added
+shell echo "Site description" >/tmp/rspreserve-target/.git/description
+shell echo "*.orig" >/tmp/rspreserve-target/.git/info/exclude
+shell mkdir -p /tmp/rspreserve-target/.git/hooks && echo "#!/bin/sh" >/tmp/rspreserve-target/.git/hooks/post-commit
+shell echo "a" >/tmp/rspreserve-target/scratch-a.txt
+shell echo "b" >/tmp/rspreserve-target/scratch-b.txt
+shell echo "c" >/tmp/rspreserve-target/other.txt
+preserve scratch-*.txt
+rebuild /tmp/rspreserve-target
+shell cat /tmp/rspreserve-target/.git/description /tmp/rspreserve-target/.git/info/exclude /tmp/rspreserve-target/.git/hooks/post-commit
+shell ls /tmp/rspreserve-target
+unpreserve scratch-*.txt
+shell rm -rf /tmp/rspreserve-target /tmp/rspreserve-target.~1~
+preserve scratch-[a
@@ -0,0 +1,64 @@
+## Test bulk editing of commit properties
+read <<EOF
+blob
+mark :1
+data 17
+*.o
+build/
+*.swp
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+committer Ann Other <ann@example.com> 1600000000 +0000
+property svn:mergeinfo 17 /branches/dev:2-5
+property bugtraq:url 21 https://bugs.example/
+data 6
+first
+M 100644 :1 .gitignore
+
+blob
+mark :3
+data 4
+*.o
+
+commit refs/heads/master
+mark :4
+committer Ann Other <ann@example.com> 1600000100 +0000
+property svn:mergeinfo 17 /branches/dev:6-9
+property bugtraq:label 5 Issue
+property tool:origin 13 cvs2svn 2.4.0
+data 7
+second
+from :2
+M 100644 :3 .gitignore
+
+EOF
+print "Initial:"
+property list
+print "Only bugtraq keys:"
+property list /^bugtraq:/
+print "Delete one mergeinfo by value:"
+property delete svn:mergeinfo /:2-/
+=Q list
+property list
+print "Delete the rest:"
+property delete /^svn:mergeinfo$/
+property list
+print "Rename with a group reference:"
+property rename /^bugtraq:(.*)$/ tracker:${1}
+property list
+print "Rewrite a value:"
+property rewrite tool:origin /^cvs2svn\s([0-9.]+)$/ "converted by cvs2svn ${1}"
+property list tool:origin
+print "Set from a file in the tree:"
+property set svn:ignore --from-path=.gitignore
+property list svn:ignore
+print "Set a literal value on the last commit:"
+:4 property set reviewed "yes\tfinal"
+property list reviewed
+print "Read back from a Subversion dump:"
+write --format=svn >propedit.dump
+read <propedit.dump
+property list
+shell rm -f propedit.dump
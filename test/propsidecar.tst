@@ -0,0 +1,8 @@
+## Test the Subversion property sidecar
+read --property-sidecar=propsidecar.json <binary.svn
+shell cat propsidecar.json
+read --property-sidecar=propsidecar.json <ignore.svn
+shell cat propsidecar.json
+read --property-sidecar=propsidecar.json <propsplit.svn
+shell cat propsidecar.json
+shell rm -f propsidecar.json
@@ -0,0 +1,54 @@
+## Test redaction with tombstones
+read <<EOF
+blob
+mark :1
+data 12
+public text
+
+blob
+mark :2
+data 16
+API_KEY=hunter2
+
+commit refs/heads/master
+mark :3
+committer Fred J. Foonly <fred@example.com> 1000 +0000
+data 9
+Initial.
+M 100644 :1 README
+M 100644 :1 secret.txt
+M 100644 :2 config
+
+blob
+mark :4
+data 21
+API_KEY=correcthorse
+
+commit refs/heads/master
+mark :5
+committer Fred J. Foonly <fred@example.com> 2000 +0000
+data 12
+Change key.
+from :3
+M 100644 :4 config
+M 100644 inline notes
+data 20
+password: swordfish
+
+
+commit refs/heads/master
+mark :6
+committer Fred J. Foonly <fred@example.com> 3000 +0000
+data 14
+Touch secret.
+from :5
+M 100644 :1 secret.txt
+D notes
+
+EOF
+redact path /secret/
+=Q resolve
+redact content /API_KEY|password/ "Redacted {hash} ({size} bytes)\n"
+=Q resolve
+write -
+redact fnord /x/
@@ -0,0 +1,82 @@
+## Test ref name checking and bulk renaming by policy
+read <<EOF
+blob
+mark :1
+data 6
+hello
+
+commit refs/heads/main
+mark :2
+committer Ann Other <ann@example.com> 1600000000 +0000
+data 6
+first
+M 100644 :1 README
+
+commit refs/remotes/origin/main
+mark :3
+committer Ann Other <ann@example.com> 1600000100 +0000
+data 7
+second
+from :2
+
+commit refs/heads/fix..it
+mark :4
+committer Ann Other <ann@example.com> 1600000200 +0000
+data 6
+third
+from :2
+
+commit refs/heads/a
+mark :5
+committer Ann Other <ann@example.com> 1600000300 +0000
+data 7
+fourth
+from :2
+
+commit refs/heads/a/b
+mark :6
+committer Ann Other <ann@example.com> 1600000400 +0000
+data 6
+fifth
+from :2
+
+reset tags/v1
+from :2
+
+tag v2
+from :3
+tagger Ann Other <ann@example.com> 1600000500 +0000
+data 8
+release
+
+EOF
+print "Check:"
+refpolicy check
+print "Dry run:"
+refpolicy apply --dry-run <<EOF
+# Fold remote-tracking branches in, fix the tag namespace
+map ^refs.remotes.origin.(.*)$ refs/heads/${1}
+map ^tags.(.*)$ refs/tags/${1}
+sanitize
+collisions suffix
+EOF
+print "Apply:"
+refpolicy apply <<EOF
+map ^refs.remotes.origin.(.*)$ refs/heads/${1}
+map ^tags.(.*)$ refs/tags/${1}
+sanitize
+collisions suffix
+EOF
+print "Check after:"
+refpolicy check
+print "Names kept or asked for have first claim:"
+refpolicy apply --dry-run <<EOF
+map ^refs.heads.fix.it$ refs/heads/main/fix
+map ^refs.heads.a.b$ refs/heads/main-3
+map ^refs.heads.a-2$ refs/heads/main
+collisions suffix
+EOF
+print "Collisions fail by default:"
+refpolicy apply <<EOF
+map ^refs.heads.main-2$ refs/heads/main
+EOF
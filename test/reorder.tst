@@ -24,6 +24,24 @@ write
 :19,:17 reorder
 write
 
+# branchy range: multiple children within the range
+drop reorder
+read <reorder.fi
+:9,:7 reorder
+write
+
+# branchy range: merge commit moved off the merge slot
+drop reorder
+read <reorder.fi
+:17,:16 reorder
+write
+
+# branchy range: both lines of development and the merge
+drop reorder
+read <reorder.fi
+:12,:14,:16,:9,:17 reorder
+write
+
 # error: no repo
 drop reorder
 reorder
@@ -41,11 +59,6 @@ reorder
 # error: range not contiguous
 :9,:14,:16 reorder
 
-# error: non-linear history: multiple children
-:9,:7 reorder
-# error: non-linear history: multiple parents
-:17,:16 reorder
-
 # warning: only 1 commit selected; nothing to re-order
 :2 reorder
 :2..:4 reorder
@@ -0,0 +1,51 @@
+## Test repair of dangling resets and unreferenced tips
+set flag relax
+log -warn -shout
+read <<EOF
+blob
+mark :1
+data 6
+first
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+committer Fred J. Foonly <fered@foonly.org> 1000000060 +0000
+data 13
+Root commit.
+M 100644 :1 README
+
+blob
+mark :3
+data 5
+lost
+
+commit refs/heads/master
+mark :4
+committer Fred J. Foonly <fered@foonly.org> 1000000120 +0000
+data 27
+Tip that no ref points at.
+from :2
+M 100644 :3 README
+
+blob
+mark :5
+data 5
+kept
+
+commit refs/heads/master
+mark :6
+committer Fred J. Foonly <fered@foonly.org> 1000000180 +0000
+data 17
+Real master tip.
+from :2
+M 100644 :5 README
+
+reset refs/tags/gone
+from :99
+
+EOF
+log +warn +shout
+repair
+write -
+repair
@@ -0,0 +1,14 @@
+## Previewing the tree changes of a reparent
+set flag echo
+set flag relax
+read <simple.fi
+set flag interactive
+# keeping the tree, nothing changes
+127,29 reparent --preview
+# rebasing changes the commit and what inherits from it
+127,29 reparent --rebase --preview
+=Q list index
+# a commit without descendants only changes itself
+129,3 reparent --rebase --preview
+# nothing was changed
+127 list inspect
@@ -0,0 +1,79 @@
+## Test retrodating from a map of dates
+read <<EOF
+blob
+mark :1
+data 4
+one
+
+reset refs/heads/master
+commit refs/heads/master
+#legacy-id 1.1
+mark :2
+author Fred <fred@example.com> 1500000000 +0000
+committer Fred <fred@example.com> 1500000000 +0000
+data 6
+first
+M 100644 :1 README
+
+blob
+mark :3
+data 4
+two
+
+blob
+mark :4
+data 5
+code
+
+commit refs/heads/master
+#legacy-id 1.2
+mark :5
+author Fred <fred@example.com> 1500000000 +0000
+committer Fred <fred@example.com> 1500000000 +0000
+data 7
+second
+from :2
+M 100644 :3 README
+M 100644 :4 main.c
+
+blob
+mark :6
+data 5
+more
+
+commit refs/heads/master
+#legacy-id 1.3
+mark :7
+author Fred <fred@example.com> 1500000000 +0000
+committer Fred <fred@example.com> 1500000000 +0000
+data 6
+third
+from :5
+M 100644 :6 main.c
+
+tag v1
+from :7
+tagger Fred <fred@example.com> 1500000100 +0000
+data 8
+release
+
+EOF
+print "Legacy IDs and paths, with a key matching nothing"
+timeshift retrodate <<EOF
+# legacy ID
+1.1 2001-01-01T00:00:00Z
+# paths; the later date wins for the commit touching both
+README 1000000000 +0100
+main.c 2002-02-02T02:02:02Z
+nonesuch 2003-03-03T00:00:00Z
+EOF
+=Q list
+write -
+print "A dry run inverting a parent and child"
+:7 timeshift retrodate --dry-run <<EOF
+1.3 1990-01-01T00:00:00Z
+EOF
+print "A malformed date"
+timeshift retrodate <<EOF
+1.1 yesterday
+EOF
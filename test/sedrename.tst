@@ -0,0 +1,10 @@
+## Test sed-style path rename with capture groups and collision checks
+read <rename.fi
+rename path s/^sam(ple)(2?)$/ex\1-\2\&&/
+write -
+drop
+read <sample1.fi
+rename path s/^(README|\.gitignore)$/same/	# Should fail, two files collide
+rename path s,^foo/(.*)/junk$,\1/junk,
+:6 list manifest
+rename path s/x/y/q	# Should fail, bad flag
@@ -0,0 +1,40 @@
+## Test session save and restore
+read <sample1.fi
+:2,:4 assign pair
+session save /tmp/rssession$$
+drop
+session restore /tmp/rssession$$ restored
+list names
+set flag interactive
+<pair> resolve
+clear flag interactive
+write >/tmp/rsout$$
+shell diff -u sample1.fi /tmp/rsout$$ && echo "stream-backed restore is identical"
+drop
+read <<EOF
+blob
+mark :1
+data 6
+alpha
+
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 1354427312 -0500
+data 14
+First commit.
+M 100644 :1 alpha
+M 100644 inline beta
+data 5
+beta
+
+reset refs/tags/v1
+from :2
+
+EOF
+rename repo inline
+:1 filter regex /alpha/ALPHA/
+session save /tmp/rssession$$
+drop
+session restore /tmp/rssession$$
+write -
+shell rm -rf /tmp/rssession$$ /tmp/rssession$$.blobs /tmp/rsout$$
@@ -0,0 +1,14 @@
+## Test named snapshots and structural diffs
+set flag echo
+set flag relax
+read <reorder.fi
+snapshot take start
+:5 setfield comment "Changed comment\n"
+:9 delete
+snapshot take middle
+:24,:22 reorder --quiet
+snapshot list >/dev/null
+snapshot diff start middle
+snapshot diff middle
+snapshot drop middle
+snapshot diff middle
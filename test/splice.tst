@@ -0,0 +1,12 @@
+## Test splicing a stream fragment over a commit range
+set flag relax
+read <splice.fi
+# error: the fragment leaves a different tree
+:4,:6 splice <splice-c.fi
+:4,:6 splice <splice-a.fi
+=Q resolve
+write -
+# error: not a linear range
+:2,:9 splice <splice-b.fi
+:4..:7 splice <splice-b.fi
+write -
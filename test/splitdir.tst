@@ -0,0 +1,14 @@
+## Test splitting a commit by directory
+set flag relax
+read <splitdir.fi
+:8 split --dir
+write -
+:8..$ list manifest
+drop
+read <splitdir.fi
+:4 split --dir <<EOF
+a/ src
+b/ src
+EOF
+:4,:9 list manifest
+:9 split --dir	# Should fail, only one directory
@@ -0,0 +1,26 @@
+## Writing an export as a stream per period
+set flag echo
+set flag relax
+read <codeowners.fi
+write --split=monthly splitwrite-out
+shell ls splitwrite-out-*
+shell cat splitwrite-out-002.fi
+print "The pieces load on their own and graft back into the whole history"
+write >splitwrite-whole.fi
+read <splitwrite-out-001.fi
+read <splitwrite-out-002.fi
+read <splitwrite-out-003.fi
+read <splitwrite-out-004.fi
+choose splitwrite-out-001
+graft splitwrite-out-002
+graft splitwrite-out-003
+graft splitwrite-out-004
+write >splitwrite-grafted.fi
+shell cmp splitwrite-whole.fi splitwrite-grafted.fi && echo "grafted pieces match the whole"
+drop
+choose codeowners
+shell rm -f splitwrite-out-* splitwrite-whole.fi splitwrite-grafted.fi
+write --split=2021-02-14,2021-04-01 splitwrite-out
+shell grep -c "^commit " splitwrite-out-*.fi
+shell rm -f splitwrite-out-*
+write --split=fortnightly splitwrite-out
@@ -0,0 +1,13 @@
+## Test marks derived from content
+read <svnwrite.fi
+renumber --stable
+write -
+/Update README/ squash --pushforward
+renumber --stable
+list
+renumber
+list
+set flag stablemarks
+read <svnwrite.fi
+list
+renumber --aliases
@@ -0,0 +1,65 @@
+## Test resolution of action-stamp collisions
+read <<EOF
+blob
+mark :1
+data 4
+one
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+author J. Random Hacker <jrh@example.com> 1000000000 +0000
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 6
+first
+M 100644 :1 README
+
+blob
+mark :3
+data 4
+two
+
+commit refs/heads/side
+mark :4
+author J. Random Hacker <jrh@example.com> 1000000000 +0000
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 5
+side
+from :2
+M 100644 :3 README
+
+blob
+mark :5
+data 6
+three
+
+commit refs/heads/master
+mark :6
+author J. Random Hacker <jrh@example.com> 1000000000 +0000
+committer J. Random Hacker <jrh@example.com> 1000000001 +0000
+data 6
+third
+from :2
+M 100644 :5 README
+
+commit refs/heads/master
+mark :7
+author J. Random Hacker <jrh@example.com> 1000000001 +0000
+committer J. Random Hacker <jrh@example.com> 1000000001 +0000
+data 7
+fourth
+from :6
+M 100644 :1 README
+
+EOF
+rename repo stampfix
+print "Suffixed references"
+disambiguate --suffix
+set flag interactive
+<2001-09-09T01:46:40Z!jrh@example.com#3> resolve
+clear flag interactive
+print "Bumping"
+disambiguate
+write -
+print "Nothing left to do"
+disambiguate
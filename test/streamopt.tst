@@ -0,0 +1,36 @@
+## Test parsing and write policy of stream option lines
+read <<EOF
+option git quiet
+option bzr no-plain
+option reposurgeon sourcetype=hg
+blob
+mark :1
+data 6
+hello
+
+commit refs/heads/main
+mark :2
+committer Ann Other <ann@example.com> 1600000000 +0000
+data 6
+first
+M 100644 :1 README
+
+EOF
+rename repo streamopt
+print "Source type:"
+sourcetype
+print "Options:"
+option list
+print "Policy:"
+option policy
+print "Written for hg:"
+write
+prefer git
+print "Written for git:"
+write
+option policy strip
+print "Stripped:"
+write
+option policy keep
+print "Kept:"
+write
@@ -0,0 +1,26 @@
+## Test submodule (gitlink) operations
+read <submodule-sub.fi
+rename repo sub
+read <submodule.fi
+rename repo super
+print "Gitlinks:"
+submodule list
+submodule list nosuch
+print "Remapped:"
+submodule remap <<EOF
+# old new
+7b0046f173c91ea9681db36821704b8346972bb9 0000000000000000000000000000000000000001
+EOF
+submodule list
+submodule remap <<EOF
+0000000000000000000000000000000000000001 7b0046f173c91ea9681db36821704b8346972bb9
+EOF
+print "Embedded:"
+submodule embed lib sub
+submodule list
+write -
+print "Collapsed again:"
+submodule collapse lib sub
+submodule list
+gc
+write -
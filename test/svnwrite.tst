@@ -0,0 +1,8 @@
+## Test writing a Subversion dump and reading it back
+read <svnwrite.fi
+write --format=svn >svnwrite.dump
+shell cat svnwrite.dump
+print "Read back:"
+read <svnwrite.dump
+write
+shell rm -f svnwrite.dump
@@ -0,0 +1,88 @@
+## Test bulk tag surgery
+read <<EOF
+blob
+mark :1
+data 6
+hello
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+committer Fred <fred@foo.com> 1000000000 +0000
+data 6
+First
+M 100644 :1 README
+
+commit refs/heads/master
+mark :3
+committer Fred <fred@foo.com> 1000000100 +0000
+data 7
+Second
+from :2
+
+commit refs/heads/master
+mark :4
+committer Fred <fred@foo.com> 1000000200 +0000
+data 9
+Junk one
+from :3
+
+commit refs/heads/master
+mark :5
+committer Fred <fred@foo.com> 1000000300 +0000
+data 9
+Junk two
+from :4
+
+commit refs/heads/master
+mark :6
+committer Fred <fred@foo.com> 1000000400 +0000
+data 7
+Fourth
+from :5
+
+tag release_1_0
+from :3
+tagger Fred <fred@foo.com> 1000000150 +0000
+data 12
+Release 1.0
+
+tag release_1_0_build
+from :3
+tagger Fred <fred@foo.com> 1000000160 +0000
+data 21
+Build of release 1.0
+
+tag release_1_0_copy
+from :3
+tagger Fred <fred@foo.com> 1000000170 +0000
+data 12
+Release 1.0
+
+tag release_1_1
+from :5
+tagger Fred <fred@foo.com> 1000000350 +0000
+data 12
+Release 1.1
+
+tag release_1_2
+from :6
+tagger Fred <fred@foo.com> 1000000450 +0000
+data 12
+Release 1.2
+
+EOF
+# Bulk rename by substitution
+rename tag s/^release_([0-9]+)_([0-9]+)/v\1.\2/
+=Q list tags
+# Keep the tag on the junk commits, then delete them
+/Junk/ tags retarget
+=Q list tags
+/Junk/ delete
+list tags
+# Merge the duplicates
+<v1.0>,<v1.0_build>,<v1.0_copy> tags dedupe
+=Q list tags
+write -
+# Error cases
+rename tag s/^v1.1$/v1.0/
@@ -1,4 +1,7 @@
 ## Test the timeoffset command
 read <min.fi
 :2 timeoffset +5
+:4 timeoffset 2:00:00
+# The sign belongs to the hours only, so this is 3570 seconds back
+:4 timeoffset -1:00:30
 write -
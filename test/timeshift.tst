@@ -0,0 +1,69 @@
+## Test the timeshift command
+read <<EOF
+blob
+mark :1
+data 4
+one
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+author Jean Dupont <jean@example.fr> 1000000000 +0000
+committer Jean Dupont <jean@example.fr> 1000000000 +0000
+data 6
+first
+M 100644 :1 README
+
+blob
+mark :3
+data 4
+two
+
+commit refs/heads/master
+mark :4
+author Hans Meier <hans@example.de> 1000000000 +0000
+committer Hans Meier <hans@example.de> 1000000000 +0000
+data 7
+second
+from :2
+M 100644 :3 README
+
+blob
+mark :5
+data 6
+three
+
+commit refs/heads/master
+mark :6
+author J. Random Hacker <jrh@example.com> 1000000000 +0000
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 6
+third
+from :4
+M 100644 :5 README
+
+tag v1
+from :6
+tagger J. Random Hacker <jrh@example.com> 1000000100 +0000
+data 8
+release
+
+EOF
+rename repo timeshift
+print "Clamp identical stamps"
+timeshift clamp
+write -
+print "Localize by email domain"
+timeshift localize
+write -
+print "Localize to a fixed zone"
+timeshift localize +0530
+write -
+print "A backward shift inverts nothing when applied to everything"
+timeshift offset -1:00:00
+write -
+print "Dry run of shifting the middle commit too far"
+:4 timeshift offset -10 --dry-run
+=Q list
+print "Bad zone"
+timeshift localize Nowhere/Special
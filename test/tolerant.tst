@@ -0,0 +1,44 @@
+## Test salvaging a damaged stream with read --tolerant
+log -warn -shout
+read --tolerant <<EOF
+blob
+mark :1
+data 6
+hello
+
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 8
+Create.
+M 100644 :1 README
+
+commit refs/heads/master
+mark :3
+author J. Random Hacker <jrh@example.com> 1000000060 +0000
+data 16
+Lost committer.
+from :2
+M 100644 :9 NOTES
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@example.com> not-a-date
+data 9
+Garbled.
+from :3
+M 100644 :1 OTHER
+
+commit refs/heads/master
+mark :5
+committer J. Random Hacker <jrh@example.com> 1000000180 +0000
+data 15
+Lost a parent.
+from :4
+M 100644 :1 LAST
+
+EOF
+log +warn +shout
+list quarantine
+list
+write -
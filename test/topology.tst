@@ -0,0 +1,91 @@
+## Topology lint: octopus, duplicate, redundant and criss-cross merges
+read <<EOF
+blob
+mark :1
+data 2
+x
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+committer Ann <ann@example.com> 1600000100 +0000
+data 2
+A
+M 100644 :1 README
+
+commit refs/heads/master
+mark :3
+committer Ann <ann@example.com> 1600000200 +0000
+data 2
+B
+from :2
+
+commit refs/heads/side
+mark :4
+committer Ann <ann@example.com> 1600000300 +0000
+data 2
+C
+from :2
+
+commit refs/heads/master
+mark :5
+committer Ann <ann@example.com> 1600000400 +0000
+data 11
+D merges C
+from :3
+merge :4
+
+commit refs/heads/side
+mark :6
+committer Ann <ann@example.com> 1600000500 +0000
+data 11
+E merges B
+from :4
+merge :3
+
+commit refs/heads/master
+mark :7
+committer Ann <ann@example.com> 1600000600 +0000
+data 16
+F criss-crosses
+from :5
+merge :6
+
+commit refs/heads/other
+mark :8
+committer Ann <ann@example.com> 1600000700 +0000
+data 2
+G
+from :2
+
+commit refs/heads/master
+mark :9
+committer Ann <ann@example.com> 1600000800 +0000
+data 10
+H octopus
+from :7
+merge :8
+merge :6
+
+commit refs/heads/master
+mark :10
+committer Ann <ann@example.com> 1600000900 +0000
+data 21
+I merges an ancestor
+from :9
+merge :3
+
+commit refs/heads/master
+mark :11
+committer Ann <ann@example.com> 1600001000 +0000
+data 17
+J merges G twice
+from :10
+merge :8
+merge :8
+
+EOF
+lint --topology
+=Q resolve
+lint --max-parents=0
+lint --max-parents=x
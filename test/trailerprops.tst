@@ -0,0 +1,79 @@
+## Test moving trailers into properties and back
+read <<EOF
+blob
+mark :1
+data 3
+v0
+
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 162
+Fix the frobnicator.
+
+It was broken.
+
+Reviewed-by: Alice Able <alice@example.com>
+Reviewed-by: Bob Baker <bob@example.com>
+Bug: 1234
+Change-Id: I0123456789abcdef
+M 100644 :1 README
+
+blob
+mark :3
+data 3
+v1
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@example.com> 1000000100 +0000
+data 30
+Summary: not a trailer block.
+from :2
+M 100644 :3 README
+
+blob
+mark :5
+data 3
+v2
+
+commit refs/heads/master
+mark :6
+committer J. Random Hacker <jrh@example.com> 1000000200 +0000
+data 69
+Mixed paragraph.
+
+This: looks like a trailer
+but this line does not.
+from :4
+M 100644 :5 README
+
+blob
+mark :7
+data 3
+v3
+
+commit refs/heads/master
+mark :8
+committer J. Random Hacker <jrh@example.com> 1000000300 +0000
+data 78
+Keep some.
+
+Signed-off-by: Carol Cole <carol@example.com>
+Bug: 99
+  continued
+from :6
+M 100644 :7 README
+
+EOF
+property extract /Bug|Reviewed-by/
+property list
+=Q list
+property extract
+property list
+write -
+property set Tested-by "Dana Dee <dana@example.com>\nEd Eel <ed@example.com>"
+property embed /Bug|Tested-by|Change-Id/
+property list
+write -
+property embed
@@ -0,0 +1,14 @@
+## Test transplanting commits between repositories
+read <min.fi
+read <keywords.fi
+:3,:5 transplant min 1970-01-01T00:00:10Z!rsc@runtux.com
+choose min
+write -
+=Q list
+<17> list
+choose keywords
+:5 transplant --branch=refs/heads/side min :2
+choose min
+=Q list
+choose keywords
+:5 transplant min :2
@@ -0,0 +1,83 @@
+## Test tagifying commits that leave the tree unchanged
+read <<EOF
+blob
+mark :1
+data 6
+hello
+
+blob
+mark :2
+data 6
+world
+
+commit refs/heads/master
+mark :3
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 8
+Create.
+M 100644 :1 README
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@example.com> 1000000060 +0000
+data 21
+Property change only
+from :3
+M 100644 :1 README
+
+commit refs/heads/master
+mark :5
+committer J. Random Hacker <jrh@example.com> 1000000120 +0000
+data 8
+Change.
+from :4
+M 100644 :2 README
+
+commit refs/heads/master
+mark :6
+committer J. Random Hacker <jrh@example.com> 1000000180 +0000
+data 17
+Rename and back.
+from :5
+R README NOTES
+R NOTES README
+
+commit refs/heads/master
+mark :7
+committer J. Random Hacker <jrh@example.com> 1000000240 +0000
+data 6
+Mode.
+from :6
+M 100755 :2 README
+
+EOF
+tagify
+list
+tagify --tree-same
+list
+list tags
+read <<EOF
+blob
+mark :1
+data 6
+hello
+
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 8
+Create.
+M 100644 :1 README
+
+commit refs/heads/master
+mark :3
+committer J. Random Hacker <jrh@example.com> 1000000060 +0000
+data 7
+No-op.
+from :2
+M 100644 :1 README
+
+EOF
+tagify --tree-same --collapse
+list
+list tags
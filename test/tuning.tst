@@ -0,0 +1,15 @@
+## Test worker, queue and spill settings
+set workers 2
+set queue 1
+set spill 16
+set workers
+set queue
+set spill
+read <min.fi
+write -
+clear workers
+clear queue
+clear spill
+set workers
+set spill
+set workers -1
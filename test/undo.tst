@@ -0,0 +1,25 @@
+## Test undo and redo of surgical operations
+read <sample1.fi
+write >/tmp/rsundo-before$$
+:10 squash
+delete path hello
+write >/tmp/rsundo-done$$
+set flag interactive
+undo list
+clear flag interactive
+undo
+undo
+write >/tmp/rsundo-after$$
+shell cmp /tmp/rsundo-before$$ /tmp/rsundo-after$$ && echo "undo restored the original"
+redo
+redo
+write >/tmp/rsundo-after$$
+shell cmp /tmp/rsundo-done$$ /tmp/rsundo-after$$ && echo "redo restored the edits"
+undo
+:12 squash
+:4 setfield comment "Changed behind the journal's back.\n"
+set flag interactive
+undo list
+clear flag interactive
+shell rm -f /tmp/rsundo-before$$ /tmp/rsundo-done$$ /tmp/rsundo-after$$
+redo
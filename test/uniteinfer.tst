@@ -0,0 +1,108 @@
+## Test unite --infer
+log -warn -shout
+read <<EOF
+blob
+mark :1
+data 2
+a
+
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 1000 +0000
+data 7
+First.
+M 100644 :1 README
+
+blob
+mark :3
+data 2
+b
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@example.com> 2000 +0000
+data 8
+Second.
+from :2
+M 100644 :3 README
+
+blob
+mark :5
+data 2
+c
+
+commit refs/heads/master
+mark :6
+committer J. Random Hacker <jrh@example.com> 3000 +0000
+data 7
+Third.
+from :4
+M 100644 :5 README
+
+EOF
+rename repo upstream
+read <<EOF
+blob
+mark :1
+data 2
+b
+
+commit refs/heads/master
+mark :2
+committer Fred Foonly <fred@example.com> 3500 +0000
+data 30
+Import of the second release.
+M 100644 :1 README
+
+blob
+mark :3
+data 7
+b
+fork
+
+commit refs/heads/master
+mark :4
+committer Fred Foonly <fred@example.com> 3600 +0000
+data 9
+Fork it.
+from :2
+M 100644 :3 README
+
+EOF
+rename repo fork
+read <<EOF
+blob
+mark :1
+data 11
+c
+replayed
+
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 3000 +0000
+data 7
+Third.
+M 100644 :1 README
+
+EOF
+rename repo replay
+read <<EOF
+blob
+mark :1
+data 2
+x
+
+commit refs/heads/master
+mark :2
+committer Ann Other <ann@example.com> 2500 +0000
+data 11
+Unrelated.
+M 100644 :1 OTHER
+
+EOF
+rename repo stray
+log +warn +shout
+# Report only
+unite --infer upstream fork replay stray
+unite --infer --confirm upstream fork replay stray
+write -
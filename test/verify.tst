@@ -0,0 +1,12 @@
+## Test blob integrity verification
+set flag materialize
+read <drift.fi
+print "Undamaged:"
+verify
+shell printf 'seconD content\n' >.rs$PPID-*/blobs/000/000/001
+shell printf 'thi' >.rs$PPID-*/blobs/000/000/002
+shell rm .rs$PPID-*/blobs/000/000/003
+print "Damaged:"
+verify
+print "Blob selection:"
+:1,:3 verify
@@ -0,0 +1,52 @@
+## Test the warnings registry
+read <<EOF
+blob
+mark :1
+data 6
+hello
+
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 1456976347 -0500
+data 20
+First, see [[SVN:9]]
+M 100644 :1 README
+
+commit refs/heads/master
+mark :3
+committer J. Random Hacker <jrh@example.com> 1456976348 -0500
+data 21
+Second, see [[SVN:9]]
+from :2
+M 100644 :1 README
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@example.com> 1456976349 -0500
+data 21
+Third, see [[SVN:10]]
+from :3
+M 100644 :1 README
+
+EOF
+print "Expect two warnings shown for three bad references"
+stampify
+warnings
+warnings suppress legacy
+print "Expect no warnings shown"
+stampify
+warnings
+warnings unsuppress legacy
+set flag relax
+print "Errors go through the registry too; expect one shown of two"
+list --bogus
+warnings suppress error
+list --bogus
+warnings
+warnings unsuppress error
+clear flag relax
+warnings clear
+warnings
+print "Expect two warnings again, then a summary table at exit"
+stampify
+stampify